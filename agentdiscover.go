@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Agent discovery: SSH_AUTH_SOCK often points at a socket of an agent that is gone (a shell that
+// outlived its desktop session, or an agent that was restarted). Agent is checked at start, and if it
+// does not answer (or SSH_AUTH_SOCK is not set at all), a live one is looked for at the usual places:
+// sockets of systemd user units ($XDG_RUNTIME_DIR/ssh-agent.socket, openssh_agent, gcr/ssh,
+// keyring/ssh, gnupg/S.gpg-agent.ssh), ~/.gnupg/S.gpg-agent.ssh, sockets of ssh-agent processes in
+// /tmp and of launchd. A warning tells which agent is used instead, or that agent identities are
+// not offered. Agent that stops answering during the run is looked up again the same way. Empty
+// SSH_AUTH_SOCK disables the agent, -no-agent disables agent authentication and discovery.
+
+const agentProbeTimeout = 2 * time.Second
+
+var (
+	agentWarning string // problem with agent found at start, reported by initialize
+
+	agentSockMu                 sync.Mutex
+	replacedSock, replacingSock string // agent of sshAuthSock that stopped answering during the run and agent used instead
+)
+
+// probeAgent returns error if agent at sock does not answer
+func probeAgent(sock string) error {
+	conn, err := dialAgent(sock)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if c, ok := conn.(net.Conn); ok {
+		c.SetDeadline(time.Now().Add(agentProbeTimeout))
+	}
+	_, err = agent.NewClient(conn).List()
+	return err
+}
+
+// findAgent returns the first of agentSockCandidates other than skip that answers, empty if none does
+func findAgent(skip string) string {
+	for _, sock := range agentSockCandidates() {
+		if sock != skip && probeAgent(sock) == nil {
+			return sock
+		}
+	}
+	return ""
+}
+
+// discoverAgent returns agent socket to use instead of SSH_AUTH_SOCK and warning about it or about
+// missing agent, set tells whether SSH_AUTH_SOCK is set
+func discoverAgent(sock string, set bool) (string, string) {
+	if sock == "" && set {
+		return "", ""
+	}
+	if sock == "" {
+		return findAgent(""), ""
+	}
+
+	err := probeAgent(sock)
+	if err == nil {
+		return sock, ""
+	}
+	if found := findAgent(sock); found != "" {
+		return found, "SSH agent at " + sock + " does not answer (" + err.Error() + "), using agent at " + found
+	}
+	return sock, "SSH agent at " + sock + " does not answer (" + err.Error() + "): its identities are not offered to hosts, start the agent or use -no-agent"
+}
+
+// initAgentSock resolves sshAuthSock at start, warning is returned to be reported to user
+func initAgentSock() (warning string) {
+	sock, set := os.LookupEnv("SSH_AUTH_SOCK")
+	if sock == "" {
+		sock = defaultAgentSock()
+	}
+	if !noAgentAuth {
+		sock, warning = discoverAgent(sock, set)
+	}
+	sshAuthSock = sock
+	return warning
+}
+
+// currentAgentSock returns socket of agent, it changes if agent is rediscovered
+func currentAgentSock() string {
+	agentSockMu.Lock()
+	defer agentSockMu.Unlock()
+	if replacingSock != "" && replacedSock == sshAuthSock {
+		return replacingSock
+	}
+	return sshAuthSock
+}
+
+// dialCurrentAgent connects to agent, looking for another one if the agent cannot be connected to
+func dialCurrentAgent() (io.ReadWriteCloser, error) {
+	sock := currentAgentSock()
+	conn, err := dialAgent(sock)
+	if err == nil || noAgentAuth {
+		return conn, err
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+		return nil, err
+	}
+
+	found := findAgent(sock)
+	if found == "" {
+		return nil, err
+	}
+
+	agentSockMu.Lock()
+	switched := replacingSock != found
+	if switched {
+		replacedSock, replacingSock = sshAuthSock, found
+	}
+	agentSockMu.Unlock()
+	if switched {
+		reportErrorToUser("SSH agent at " + sock + " stopped answering (" + err.Error() + "), using agent at " + found)
+	}
+	return dialAgent(found)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestAgentDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossha-agent-discovery")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	// agent of systemd user unit
+	live := filepath.Join(dir, "ssh-agent.socket")
+	list, err := net.Listen("unix", live)
+	must(err, "Could not listen agent socket")
+	defer list.Close()
+	go func() {
+		for {
+			c, err := list.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(agent.NewKeyring(), c)
+				c.Close()
+			}()
+		}
+	}()
+
+	defer os.Setenv("XDG_RUNTIME_DIR", os.Getenv("XDG_RUNTIME_DIR"))
+	os.Setenv("XDG_RUNTIME_DIR", dir)
+	stale := filepath.Join(dir, "stale.sock")
+
+	if sock, warning := discoverAgent(stale, true); sock != live || !strings.Contains(warning, "SSH agent at "+stale+" does not answer") || !strings.Contains(warning, "using agent at "+live) {
+		t.Fatalf("Unexpected agent for stale socket: %q, %q", sock, warning)
+	}
+	if sock, warning := discoverAgent(live, true); sock != live || warning != "" {
+		t.Fatalf("Unexpected agent for live socket: %q, %q", sock, warning)
+	}
+	if sock, warning := discoverAgent("", true); sock != "" || warning != "" {
+		t.Fatalf("Empty SSH_AUTH_SOCK must disable agent, got %q, %q", sock, warning)
+	}
+	if sock, _ := discoverAgent("", false); sock != live {
+		t.Fatalf("Expected agent to be found without SSH_AUTH_SOCK, got %q", sock)
+	}
+
+	// agent that stops answering during the run is replaced
+	oldSock := sshAuthSock
+	defer func() { sshAuthSock, replacedSock, replacingSock = oldSock, "", "" }()
+	sshAuthSock = stale
+
+	replies := make(chan interface{}, 1)
+	go func() { replies <- <-repliesChan }()
+
+	conn, err := dialCurrentAgent()
+	if err != nil {
+		t.Fatalf("Could not connect to rediscovered agent: %v", err)
+	}
+	conn.Close()
+	if sock := currentAgentSock(); sock != live {
+		t.Fatalf("Unexpected current agent: %q", sock)
+	}
+	if reply, ok := (<-replies).(*UserError); !ok || !strings.Contains(reply.ErrorMsg, "stopped answering") {
+		t.Fatalf("Expected warning about replaced agent, got %+v", reply)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Agent identity selection: servers with low MaxAuthTries reject clients before the right key is
+// tried when ssh-agent holds many identities, so -agent-key limits agent identities that are offered
+// to the listed ones, in the listed order. Entries are fingerprints ("SHA256:<base64>" or MD5 in
+// hex) or comments of keys, comments can be shell globs. -no-agent disables agent authentication,
+// agent is still used for forwarding and security keys.
+
+var (
+	agentKeySpec string // -agent-key
+	noAgentAuth  bool   // -no-agent
+)
+
+// agentAuthEnabled tells whether identities of ssh-agent are offered to servers
+func agentAuthEnabled() bool {
+	return sshAuthSock != "" && !noAgentAuth
+}
+
+// agentKeySpecs returns entries of -agent-key
+func agentKeySpecs() []string {
+	var res []string
+	for _, s := range strings.Split(agentKeySpec, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// agentKeyMatches tells whether agent identity key is selected by -agent-key entry spec
+func agentKeyMatches(key *agent.Key, spec string) bool {
+	if key.Comment == spec {
+		return true
+	}
+	if ok, _ := path.Match(spec, key.Comment); ok {
+		return true
+	}
+
+	pub, err := ssh.ParsePublicKey(key.Blob)
+	if err != nil {
+		return false
+	}
+	md5 := ssh.FingerprintLegacyMD5(pub)
+	return spec == ssh.FingerprintSHA256(pub) || spec == md5 || spec == "MD5:"+md5
+}
+
+// selectAgentKeys returns identities of the agent that are selected by -agent-key in its order
+func selectAgentKeys(keys []*agent.Key) []*agent.Key {
+	specs := agentKeySpecs()
+	if len(specs) == 0 {
+		return keys
+	}
+
+	var res []*agent.Key
+	used := make([]bool, len(keys))
+	for _, spec := range specs {
+		for i, key := range keys {
+			if !used[i] && agentKeyMatches(key, spec) {
+				res = append(res, key)
+				used[i] = true
+			}
+		}
+	}
+	return res
+}
+
+// checkAgentKeys reports -agent-key entries that do not match any identity of ssh-agent
+func checkAgentKeys() {
+	specs := agentKeySpecs()
+	if len(specs) == 0 || !agentAuthEnabled() {
+		return
+	}
+
+	a := agents.get()
+	defer agents.put(a)
+
+	keys, err := agents.identities(a)
+	if err != nil {
+		reportErrorToUser("Cannot list identities of SSH agent: " + err.Error())
+		return
+	}
+
+	for _, spec := range specs {
+		found := false
+		for _, key := range keys {
+			if agentKeyMatches(key, spec) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			reportErrorToUser("No identity of SSH agent matches -agent-key " + spec)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestSelectAgentKeys(t *testing.T) {
+	keyring := agent.NewKeyring()
+	fingerprints := make(map[string]string)
+	for _, comment := range []string{"work@laptop", "deploy@ci", "deploy@prod"} {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		must(err, "Could not generate key")
+		must(keyring.Add(agent.AddedKey{PrivateKey: priv, Comment: comment}), "Could not add key to agent")
+		sshPub, err := ssh.NewPublicKey(pub)
+		must(err, "Could not convert key")
+		fingerprints[ssh.FingerprintSHA256(sshPub)] = comment
+	}
+
+	var prodFingerprint string
+	for fp, comment := range fingerprints {
+		if comment == "deploy@prod" {
+			prodFingerprint = fp
+		}
+	}
+
+	defer func() { agentKeySpec = "" }()
+	for spec, expected := range map[string][]string{
+		"":                                {"work@laptop", "deploy@ci", "deploy@prod"},
+		prodFingerprint + ", work@laptop": {"deploy@prod", "work@laptop"},
+		"deploy@*," + prodFingerprint:     {"deploy@ci", "deploy@prod"},
+		"nobody@nowhere":                  nil,
+	} {
+		agentKeySpec = spec
+		keys, err := keyring.List()
+		if err != nil {
+			t.Fatalf("Could not list agent identities: %s", err)
+		}
+
+		var comments []string
+		for _, k := range selectAgentKeys(keys) {
+			comments = append(comments, fingerprints[ssh.FingerprintSHA256(k)])
+		}
+		if len(comments) != len(expected) {
+			t.Fatalf("Unexpected identities for %q: %v", spec, comments)
+		}
+		for i := range comments {
+			if comments[i] != expected[i] {
+				t.Fatalf("Unexpected identities for %q: %v", spec, comments)
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Shared ssh-agent connections: handshakes take agent connection from the pool and return it when
+// they finish, so that the agent is not dialed again for every host. Requests over one connection
+// are serialized by its mutex, so that a handshake that still runs after connectHost gave up on it
+// (e.g. after timeout) cannot mix its messages with messages of the next handshake; connection is
+// dropped after an error and dialed again when it is needed. With -agent-prefetch identities of
+// the agent are listed once instead of in every handshake, signatures are still made by the agent
+// for every connection, since they sign data of the session.
+
+var (
+	agentPrefetch bool // -agent-prefetch
+	agents        = &agentPool{}
+)
+
+// agentPool keeps idle connections to ssh-agent
+type agentPool struct {
+	mu   sync.Mutex
+	idle []*sharedAgent
+
+	prefetchMu sync.Mutex
+	prefetched []*agent.Key // identities listed once with -agent-prefetch, nil until they are listed
+}
+
+// sharedAgent is a connection to ssh-agent that can be used from several goroutines
+type sharedAgent struct {
+	mu     sync.Mutex
+	conn   io.ReadWriteCloser // nil if not connected
+	client agent.ExtendedAgent
+}
+
+// get returns idle connection or a new one, which dials the agent when it is used first
+func (p *agentPool) get() *sharedAgent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if n := len(p.idle); n > 0 {
+		a := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		return a
+	}
+	return &sharedAgent{}
+}
+
+// put returns connection to the pool, connections that were dropped after errors are not kept
+func (p *agentPool) put(a *sharedAgent) {
+	a.mu.Lock()
+	connected := a.conn != nil
+	a.mu.Unlock()
+
+	if connected {
+		p.mu.Lock()
+		p.idle = append(p.idle, a)
+		p.mu.Unlock()
+	}
+}
+
+// identities returns identities of the agent, listed over a unless they were prefetched
+func (p *agentPool) identities(a *sharedAgent) ([]*agent.Key, error) {
+	if !agentPrefetch {
+		return a.list()
+	}
+
+	p.prefetchMu.Lock()
+	defer p.prefetchMu.Unlock()
+
+	if p.prefetched == nil {
+		keys, err := a.list()
+		if err != nil {
+			return nil, err // listed again by the next handshake
+		}
+		p.prefetched = append([]*agent.Key{}, keys...)
+	}
+	return p.prefetched, nil
+}
+
+// prefetchAgentIdentities lists identities of the agent with -agent-prefetch before hosts are connected to
+func prefetchAgentIdentities() {
+	if !agentPrefetch || !agentAuthEnabled() {
+		return
+	}
+
+	a := agents.get()
+	defer agents.put(a)
+
+	if _, err := agents.identities(a); err != nil {
+		reportErrorToUser("Cannot list identities of SSH agent: " + err.Error())
+	}
+}
+
+// call runs fn with client of connection, connecting to the agent if needed
+func (a *sharedAgent) call(fn func(client agent.ExtendedAgent) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.conn == nil {
+		for {
+			conn, err := dialCurrentAgent()
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+					time.Sleep(time.Duration(rand.Intn(100)) * time.Millisecond)
+					continue
+				}
+				return errors.New("Cannot open connection to SSH agent: " + err.Error())
+			}
+			a.conn, a.client = conn, agent.NewClient(conn)
+			break
+		}
+	}
+
+	err := fn(a.client)
+	if err != nil {
+		a.conn.Close()
+		a.conn, a.client = nil, nil
+	}
+	return err
+}
+
+func (a *sharedAgent) list() (keys []*agent.Key, err error) {
+	err = a.call(func(client agent.ExtendedAgent) error {
+		keys, err = client.List()
+		return err
+	})
+	return
+}
+
+// signers returns signers of identities of the agent that are selected by -agent-key
+func (a *sharedAgent) signers() ([]ssh.Signer, error) {
+	keys, err := agents.identities(a)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []ssh.Signer
+	for _, k := range selectAgentKeys(keys) {
+		res = append(res, &sharedAgentSigner{agent: a, key: k})
+	}
+	return res, nil
+}
+
+// sharedAgentSigner signs with identity key of the agent over shared connection
+type sharedAgentSigner struct {
+	agent *sharedAgent
+	key   *agent.Key
+}
+
+func (s *sharedAgentSigner) PublicKey() ssh.PublicKey {
+	return s.key
+}
+
+func (s *sharedAgentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+// SignWithAlgorithm asks agent for SHA-2 signatures of RSA keys, other keys only have one algorithm
+func (s *sharedAgentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (sig *ssh.Signature, err error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case ssh.KeyAlgoRSASHA256, ssh.CertAlgoRSASHA256v01:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512, ssh.CertAlgoRSASHA512v01:
+		flags = agent.SignatureFlagRsaSha512
+	}
+
+	err = s.agent.call(func(client agent.ExtendedAgent) error {
+		sig, err = client.SignWithFlags(s.key, data, flags)
+		return err
+	})
+	return
+}
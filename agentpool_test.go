@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestSharedAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossha-agent")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	keyring := agent.NewKeyring()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	must(err, "Could not generate key")
+	must(keyring.Add(agent.AddedKey{PrivateKey: priv, Comment: "test"}), "Could not add key to agent")
+
+	list, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	must(err, "Could not listen agent socket")
+	defer list.Close()
+
+	var (
+		mu    sync.Mutex
+		conns int
+	)
+	go func() {
+		for {
+			c, err := list.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns++
+			mu.Unlock()
+			go func() {
+				agent.ServeAgent(keyring, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	oldSock, oldAgents := sshAuthSock, agents
+	defer func() { sshAuthSock, agents, agentPrefetch = oldSock, oldAgents, false }()
+	sshAuthSock, agents, agentPrefetch = list.Addr().String(), &agentPool{}, true
+
+	a := agents.get()
+	signers, err := a.signers()
+	if err != nil {
+		t.Fatalf("Could not get agent signers: %v", err)
+	}
+	if len(signers) != 1 {
+		t.Fatalf("Unexpected number of signers: %d", len(signers))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := make([]byte, 32)
+			rand.Read(data)
+			sig, err := signers[0].Sign(rand.Reader, data)
+			if err != nil {
+				t.Errorf("Could not sign: %v", err)
+				return
+			}
+			if err := signers[0].PublicKey().Verify(data, sig); err != nil {
+				t.Errorf("Invalid signature: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	agents.put(a)
+
+	must(keyring.RemoveAll(), "Could not remove keys from agent")
+	b := agents.get()
+	if b != a {
+		t.Fatalf("Agent connection is not reused")
+	}
+	if signers, err := b.signers(); err != nil || len(signers) != 1 {
+		t.Fatalf("Prefetched identities are not used: %d signers, %v", len(signers), err)
+	}
+	agents.put(b)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 1 {
+		t.Fatalf("Agent was dialed %d times", conns)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Algorithm selection: -ciphers, -kex, -macs and -hostkey-algorithms restrict algorithms that are
+// offered to all hosts, inventory variables override them for hosts of a group. Algorithms that
+// x/crypto considers insecure (e.g. for ancient appliances) are only used when listed explicitly.
+
+var globalAlgorithms sshAlgorithms // algorithms set by flags, nil lists mean defaults of x/crypto
+
+type sshAlgorithms struct {
+	ciphers  []string
+	kex      []string
+	macs     []string
+	hostKeys []string
+}
+
+// knownAlgorithms returns secure and insecure algorithms of kind ("cipher", "kex", "mac" or "hostkey")
+func knownAlgorithms(kind string) []string {
+	supported, insecure := ssh.SupportedAlgorithms(), ssh.InsecureAlgorithms()
+	switch kind {
+	case "cipher":
+		return append(supported.Ciphers, insecure.Ciphers...)
+	case "kex":
+		return append(supported.KeyExchanges, insecure.KeyExchanges...)
+	case "mac":
+		return append(supported.MACs, insecure.MACs...)
+	default:
+		return append(supported.HostKeys, insecure.HostKeys...)
+	}
+}
+
+// parseAlgorithms parses comma-separated list of algorithms of kind, empty list means defaults
+func parseAlgorithms(kind, list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	known := make(map[string]bool)
+	for _, alg := range knownAlgorithms(kind) {
+		known[alg] = true
+	}
+
+	res := strings.Split(list, ",")
+	for _, alg := range res {
+		if !known[alg] {
+			names := knownAlgorithms(kind)
+			sort.Strings(names)
+			return nil, errors.New("Unsupported " + kind + " algorithm '" + alg + "', known ones are " + strings.Join(names, ","))
+		}
+	}
+
+	return res, nil
+}
+
+// hostAlgorithms returns global algorithms overridden by inventory variables gossha_ciphers,
+// gossha_kex_algorithms, gossha_macs and gossha_host_key_algorithms of host
+func hostAlgorithms(vars map[string]string) (algs sshAlgorithms, err error) {
+	algs = globalAlgorithms
+
+	for _, v := range []struct {
+		kind, name string
+		dst        *[]string
+	}{
+		{"cipher", "gossha_ciphers", &algs.ciphers},
+		{"kex", "gossha_kex_algorithms", &algs.kex},
+		{"mac", "gossha_macs", &algs.macs},
+		{"hostkey", "gossha_host_key_algorithms", &algs.hostKeys},
+	} {
+		if list := vars[v.name]; list != "" {
+			if *v.dst, err = parseAlgorithms(v.kind, list); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func (a *sshAlgorithms) apply(conf *ssh.ClientConfig) {
+	if a.ciphers != nil {
+		conf.Ciphers = a.ciphers
+	}
+	if a.kex != nil {
+		conf.KeyExchanges = a.kex
+	}
+	if a.macs != nil {
+		conf.MACs = a.macs
+	}
+	if a.hostKeys != nil {
+		conf.HostKeyAlgorithms = a.hostKeys
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAlgorithms(t *testing.T) {
+	if algs, err := parseAlgorithms("cipher", "aes128-ctr,3des-cbc"); err != nil || len(algs) != 2 {
+		t.Fatalf("Insecure algorithms must be allowed explicitly: %v, %v", algs, err)
+	}
+
+	if algs, err := parseAlgorithms("kex", ""); err != nil || algs != nil {
+		t.Fatalf("Empty list must mean defaults: %v, %v", algs, err)
+	}
+
+	if _, err := parseAlgorithms("mac", "hmac-md5"); err == nil || !strings.Contains(err.Error(), "hmac-sha2-256") {
+		t.Fatalf("Unknown algorithm must be rejected with list of known ones: %v", err)
+	}
+
+	globalAlgorithms = sshAlgorithms{ciphers: []string{"aes128-ctr"}, macs: []string{"hmac-sha2-256"}}
+	defer func() { globalAlgorithms = sshAlgorithms{} }()
+
+	algs, err := hostAlgorithms(map[string]string{"gossha_ciphers": "aes256-ctr", "gossha_kex_algorithms": "diffie-hellman-group14-sha1"})
+	if err != nil || algs.ciphers[0] != "aes256-ctr" || algs.kex[0] != "diffie-hellman-group14-sha1" || algs.macs[0] != "hmac-sha2-256" {
+		t.Fatalf("Unexpected host algorithms: %+v, %v", algs, err)
+	}
+}
+
+func TestAlgorithmsAreOffered(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-algorithms", 1)
+	defer func() { globalAlgorithms = sshAlgorithms{} }()
+
+	for addr := range r.hosts {
+		// test server does not enable insecure ciphers, so handshake has to fail
+		globalAlgorithms = sshAlgorithms{ciphers: []string{"3des-cbc"}}
+		conf, _ := makeConfig()
+		if _, err := dialHost(addr, conf); err == nil || !strings.Contains(err.Error(), "no common algorithm") {
+			t.Fatalf("Handshake with restricted ciphers must fail: %v", err)
+		}
+
+		globalAlgorithms = sshAlgorithms{ciphers: []string{"aes128-ctr"}, kex: []string{"curve25519-sha256"}}
+		conf, _ = makeConfig()
+		conn, err := dialHost(addr, conf)
+		must(err, "Could not connect with allowed algorithms")
+		conn.Close()
+	}
+}
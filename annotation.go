@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Host annotations: inventory variables gossha_description, gossha_owner and gossha_contact (or
+// "description", "owner" and "contact" options of hosts in "hosts" section of configuration file)
+// describe who to ask about a host. They are echoed with failures, so that triaging a partially failed
+// run does not need a separate lookup: replies of failed hosts get "Annotation" like "primary billing
+// database, owned by payments team, contact #db-ops", FinalReply lists annotations of all hosts that
+// did not succeed in "Annotations", and run notifications show them next to failed hosts.
+
+// hostAnnotation returns annotation of inventory host, "" if it has none
+func hostAnnotation(hostname string) string {
+	if hostInventory == nil {
+		return ""
+	}
+	vars := hostInventory.HostVars(hostname)
+
+	var parts []string
+	if v := vars["gossha_description"]; v != "" {
+		parts = append(parts, v)
+	}
+	if v := vars["gossha_owner"]; v != "" {
+		parts = append(parts, "owned by "+v)
+	}
+	if v := vars["gossha_contact"]; v != "" {
+		parts = append(parts, "contact "+v)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// failedAnnotations returns annotations of failed hosts by hostname, nil if none of them have any
+func failedAnnotations(failed map[string]bool) map[string]string {
+	var res map[string]string
+	for h := range failed {
+		if a := hostAnnotation(h); a != "" {
+			if res == nil {
+				res = make(map[string]string)
+			}
+			res[h] = a
+		}
+	}
+	return res
+}
+
+// formatAnnotations returns "<host> — <annotation>" lines in alphabetical order of hosts
+func formatAnnotations(annotations map[string]string) []string {
+	hosts := make([]string, 0, len(annotations))
+	for h := range annotations {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+
+	res := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		res = append(res, h+" — "+annotations[h])
+	}
+	return res
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHostAnnotations(t *testing.T) {
+	inv, err := parseInventory([]byte("[db]\ndb03 gossha_description=\"billing database\"\ndb04\n\n[db:vars]\ngossha_owner=\"payments team\"\ngossha_contact=#db-ops\n\n[web]\nweb1\n"), "ini")
+	must(err, "Could not parse inventory")
+	hostInventory = inv
+	defer func() { hostInventory = nil }()
+
+	if a := hostAnnotation("db03"); a != "billing database, owned by payments team, contact #db-ops" {
+		t.Fatalf("Unexpected annotation of db03: %q", a)
+	}
+	if a := hostAnnotation("web1"); a != "" {
+		t.Fatalf("Host without annotation variables must not be annotated: %q", a)
+	}
+
+	annotations := failedAnnotations(map[string]bool{"db04": true, "web1": true, "other": true})
+	if !reflect.DeepEqual(annotations, map[string]string{"db04": "owned by payments team, contact #db-ops"}) {
+		t.Fatalf("Unexpected annotations: %v", annotations)
+	}
+
+	s := &RunSummary{Hosts: 3, Failed: 2, FailedHosts: []string{"db04", "web1"}, Annotations: annotations}
+	if text := s.slackMessage(); !strings.HasSuffix(text, "\ndb04 — owned by payments team, contact #db-ops") {
+		t.Fatalf("Slack message must end with annotations: %s", text)
+	}
+}
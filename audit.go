@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	osuser "os/user"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit log (-audit-log): every operation on every host is recorded as a JSON line with time,
+// local user, host, description of what was executed (as in -dry-run), exit code, duration and
+// "AuditFields" of request.
+// Records are appended to a file or sent to syslog ("syslog"), requests are refused if the log
+// cannot be opened.
+
+var (
+	auditLogSpec string    // path to audit log or "syslog" (-audit-log), empty disables auditing
+	audit        *auditLog // nil if auditing is disabled
+	auditErr     error     // audit log could not be opened
+)
+
+type (
+	auditLog struct {
+		mu   sync.Mutex
+		w    io.Writer
+		user string // local user that runs GoSSHa
+	}
+
+	auditRecord struct {
+		Time      string
+		User      string
+		Hostname  string
+		Action    string
+		Operation string
+		Success   bool
+		ExitCode  int
+		Duration  float64
+		ErrMsg    string            `json:",omitempty"`
+		ErrorKind string            `json:",omitempty"`
+		Client    string            `json:",omitempty"` // -policy token that submitted request
+		Fields    map[string]string `json:",omitempty"` // AuditFields of request
+		Changes   []*FileChange     `json:",omitempty"` // how uploaded files changed (only with ChangeReport)
+	}
+)
+
+// openAuditLog opens file for appending or connects to local syslog if spec is "syslog"
+func openAuditLog(spec string) (*auditLog, error) {
+	a := &auditLog{user: localUser()}
+
+	if spec == "syslog" {
+		w, err := openSyslog()
+		if err != nil {
+			return nil, errors.New("Cannot connect to syslog: " + err.Error())
+		}
+		a.w = w
+		return a, nil
+	}
+
+	fp, err := os.OpenFile(spec, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.New("Cannot open audit log: " + err.Error())
+	}
+	a.w = fp
+	return a, nil
+}
+
+// localUser returns name of user that runs GoSSHa (without domain on Windows)
+func localUser() string {
+	if u, err := osuser.Current(); err == nil {
+		return u.Username[strings.LastIndex(u.Username, `\`)+1:]
+	}
+	if name := os.Getenv("LOGNAME"); name != "" {
+		return name
+	}
+	return os.Getenv("USERNAME")
+}
+
+// recorder returns function that records result of action described by msg, it is nil if auditing is disabled
+func (a *auditLog) recorder(msg *ProxyRequest) func(res *SshResult, start time.Time) {
+	if a == nil {
+		return nil
+	}
+
+	render, _ := newHostRenderer(msg) // templates are already validated by getExecFunc
+
+	return func(res *SshResult, start time.Time) {
+		rec := &auditRecord{
+			Time:     start.Format(time.RFC3339Nano),
+			User:     a.user,
+			Hostname: res.hostname,
+			Action:   msg.Action,
+			Success:  res.err == nil,
+			ExitCode: exitCode(res.err),
+			Duration: res.duration.Seconds(),
+			Client:   msg.client,
+			Fields:   msg.AuditFields,
+			Changes:  res.changes,
+		}
+		if res.err != nil {
+			rec.ErrMsg = res.err.Error()
+			rec.ErrorKind = errorKind(res.err, msg.Action)
+		}
+
+		if req, err := render(res.hostname); err == nil {
+			rec.Operation = strings.TrimSuffix(describeAction(req), "\n")
+		} else {
+			rec.Operation = strings.TrimSuffix(describeAction(msg), "\n")
+		}
+
+		if err := a.write(rec); err != nil {
+			reportErrorToUser("Cannot write audit log: " + err.Error())
+		}
+	}
+}
+
+func (a *auditLog) write(rec *auditRecord) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// records are written with a single call, so that concurrent GoSSHa processes do not mix them
+	_, err = a.w.Write(append(buf, '\n'))
+	return err
+}
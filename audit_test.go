@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossha-audit")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	audit, err = openAuditLog(path)
+	must(err, "Could not open audit log")
+	defer func() { audit = nil }()
+
+	r := makeTestResult()
+	startTestServers(r, "test-audit", 2)
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "echo {{.Host}}", Template: true})
+
+	// log is appended to, not overwritten
+	audit, err = openAuditLog(path)
+	must(err, "Could not reopen audit log")
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = "exit 3"
+	for addr := range r.hosts {
+		req.Hosts = append(req.Hosts, addr)
+	}
+	requestsChan <- req
+	for reply := range repliesChan {
+		if _, ok := reply.(*FinalReply); ok {
+			break
+		}
+	}
+
+	fp, err := os.Open(path)
+	must(err, "Could not open audit log")
+	defer fp.Close()
+
+	var records []auditRecord
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		var rec auditRecord
+		must(json.Unmarshal(scanner.Bytes(), &rec), "Could not parse audit record")
+		records = append(records, rec)
+	}
+
+	if len(records) != 4 {
+		t.Fatalf("Expected record for every host and request, got %+v", records)
+	}
+
+	for _, rec := range records[:2] {
+		if rec.User == "" || rec.Time == "" || rec.Action != "ssh" || !rec.Success || rec.Operation != "Run: echo 127.0.0.1" {
+			t.Fatalf("Unexpected record: %+v", rec)
+		}
+		if _, ok := r.hosts[rec.Hostname]; !ok {
+			t.Fatalf("Unexpected host in record: %+v", rec)
+		}
+	}
+
+	for _, rec := range records[2:] {
+		if rec.Success || rec.ExitCode != 3 || rec.Operation != "Run: exit 3" || rec.ErrMsg == "" {
+			t.Fatalf("Unexpected record of failed command: %+v", rec)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Authentication providers: credentials offered to a host are assembled from providers in order,
+// every one adds public keys or other methods (password, keyboard-interactive):
+//
+//	identity              key of ansible_ssh_private_key_file of host
+//	vault                 certificate signed by Vault (-vault-role)
+//	agent                 identities of ssh-agent (see -agent-key)
+//	keys                  keys and certificates of -i (or default keys)
+//	command               output of -auth-command, a private key (and an optional certificate line)
+//	                      or a password, the command is run for every new connection with HOST set
+//	password              password of host (ansible_password or -password)
+//	keyboard-interactive  challenges answered by user (-kbd-interactive)
+//
+// Order is set with -auth or with gossha_auth variable of inventory hosts and groups (comma-separated
+// names). By default identity key is used instead of vault, agent and keys if host has one, and all
+// providers are used otherwise. Public keys of all providers are offered in one "publickey" method,
+// because ssh client tries every method only once.
+
+const helperCommandTimeout = 30 * time.Second // timeout of -auth-command, -password-cmd and -passphrase-cmd
+
+var (
+	authChainDefault string // -auth
+	authCommand      string // -auth-command
+)
+
+type (
+	// AuthProvider adds credentials of one kind for connection to hostname to auth
+	AuthProvider interface {
+		AddAuth(hostname string, auth *hostAuth)
+	}
+
+	// AuthProviderFunc is a function that implements AuthProvider
+	AuthProviderFunc func(hostname string, auth *hostAuth)
+
+	// hostAuth collects credentials for connection to a host
+	hostAuth struct {
+		usage   *authUsage                     // records credentials that were used
+		signers []func() ([]ssh.Signer, error) // sources of public keys, called during handshake
+		methods []ssh.AuthMethod               // other methods, tried after public keys
+		release []func()                       // called when handshake is finished
+	}
+)
+
+// authProviders are providers that can be used in -auth and gossha_auth by name
+var authProviders = map[string]AuthProvider{
+	"identity":             AuthProviderFunc(identityAuth),
+	"vault":                AuthProviderFunc(vaultAuth),
+	"agent":                AuthProviderFunc(agentAuth),
+	"keys":                 AuthProviderFunc(keysAuth),
+	"command":              AuthProviderFunc(commandAuth),
+	"password":             AuthProviderFunc(hostPasswordAuth),
+	"keyboard-interactive": AuthProviderFunc(interactiveAuth),
+}
+
+func (f AuthProviderFunc) AddAuth(hostname string, auth *hostAuth) {
+	f(hostname, auth)
+}
+
+// addSigners adds source of public keys, errors of it are reported and other keys are still offered
+func (a *hostAuth) addSigners(get func() ([]ssh.Signer, error)) {
+	a.signers = append(a.signers, get)
+}
+
+func (a *hostAuth) addMethods(methods ...ssh.AuthMethod) {
+	a.methods = append(a.methods, methods...)
+}
+
+// onRelease registers f to be called when handshake is finished, e.g. to return agent connection
+func (a *hostAuth) onRelease(f func()) {
+	a.release = append(a.release, f)
+}
+
+// authMethods returns methods for ssh.ClientConfig
+func (a *hostAuth) authMethods() []ssh.AuthMethod {
+	var res []ssh.AuthMethod
+	if len(a.signers) > 0 {
+		res = append(res, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			var keys []ssh.Signer
+			for _, get := range a.signers {
+				s, err := get()
+				if err != nil {
+					reportErrorToUser(err.Error())
+					continue
+				}
+				keys = append(keys, s...)
+			}
+			return a.usage.signers(keys...), nil
+		}))
+	}
+	return append(res, a.methods...)
+}
+
+func (a *hostAuth) done() {
+	for _, f := range a.release {
+		f()
+	}
+}
+
+// parseAuthChain parses comma-separated names of providers
+func parseAuthChain(s string) ([]string, error) {
+	var res []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := authProviders[name]; !ok {
+			return nil, errors.New("unknown authentication provider " + name)
+		}
+		res = append(res, name)
+	}
+	return res, nil
+}
+
+// hostAuthChain returns names of providers to authenticate on hostname with
+func hostAuthChain(hostname string) []string {
+	opts := hostOptionsOf(hostname)
+	if len(opts.auth) > 0 {
+		return opts.auth
+	}
+	if chain, _ := parseAuthChain(authChainDefault); len(chain) > 0 { // validated in initialize
+		return chain
+	}
+	if len(identitySigners[opts.identityFile]) > 0 {
+		// key of the host is offered alone, so that global keys do not use up MaxAuthTries of server
+		return []string{"identity", "command", "password", "keyboard-interactive"}
+	}
+	return []string{"vault", "agent", "keys", "command", "password", "keyboard-interactive"}
+}
+
+// hostAuthConfig returns client config with credentials for hostname, credentials that are used
+// are recorded in usage; release must be called when handshake is finished
+func hostAuthConfig(hostname string, usage *authUsage) (config *ssh.ClientConfig, release func()) {
+	auth := &hostAuth{usage: usage}
+	for _, name := range hostAuthChain(hostname) {
+		authProviders[name].AddAuth(hostname, auth)
+	}
+
+	config = &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth.authMethods(),
+		HostKeyCallback: logHostKey,
+	}
+	globalAlgorithms.apply(config)
+
+	return config, auth.done
+}
+
+func identityAuth(hostname string, auth *hostAuth) {
+	if hostInventory == nil {
+		return
+	}
+	// not hostOptionsOf, options are validated with names of providers
+	if identity := identitySigners[hostInventory.HostVars(hostname)["ansible_ssh_private_key_file"]]; len(identity) > 0 {
+		auth.addSigners(func() ([]ssh.Signer, error) { return identity, nil })
+	}
+}
+
+func vaultAuth(hostname string, auth *hostAuth) {
+	if vault != nil {
+		auth.addSigners(func() ([]ssh.Signer, error) {
+			signer, err := vault.signer()
+			if err != nil {
+				return nil, err
+			}
+			return []ssh.Signer{signer}, nil
+		})
+	}
+}
+
+func agentAuth(hostname string, auth *hostAuth) {
+	if !agentAuthEnabled() {
+		return
+	}
+	sa := agents.get()
+	auth.onRelease(func() { agents.put(sa) })
+	auth.addSigners(func() ([]ssh.Signer, error) {
+		s, err := sa.signers()
+		if err != nil {
+			return nil, err
+		}
+		return securityKeySigners(s), nil
+	})
+}
+
+func keysAuth(hostname string, auth *hostAuth) {
+	if len(signers) > 0 {
+		keys := signers
+		auth.addSigners(func() ([]ssh.Signer, error) { return keys, nil })
+	}
+}
+
+func hostPasswordAuth(hostname string, auth *hostAuth) {
+	if password := hostPassword(hostname); password != "" {
+		auth.addMethods(passwordAuth(password, auth.usage)...)
+	}
+}
+
+func interactiveAuth(hostname string, auth *hostAuth) {
+	if kbdInteractive {
+		auth.addMethods(keyboardInteractiveAuth(hostname, auth.usage))
+	}
+}
+
+func commandAuth(hostname string, auth *hostAuth) {
+	if authCommand == "" {
+		return
+	}
+
+	out, err := runAuthCommand(hostname)
+	if err != nil {
+		reportErrorToUser(err.Error())
+		return
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(out), []byte("-----BEGIN")) {
+		password := strings.TrimRight(strings.SplitN(string(out), "\n", 2)[0], "\r")
+		if password != "" {
+			auth.addMethods(passwordAuth(password, auth.usage)...)
+		}
+		return
+	}
+
+	keys, err := parseAuthCommandKey(out)
+	if err != nil {
+		reportErrorToUser("Cannot use key of -auth-command for " + hostname + ": " + err.Error())
+		return
+	}
+	auth.addSigners(func() ([]ssh.Signer, error) { return keys, nil })
+}
+
+// runAuthCommand runs -auth-command for hostname and returns its stdout
+func runAuthCommand(hostname string) ([]byte, error) {
+	out, err := runHelperCommand(authCommand, "HOST="+hostname)
+	if err != nil {
+		return nil, errors.New("Auth command failed for " + hostname + ": " + err.Error())
+	}
+	return out, nil
+}
+
+// runHelperCommand runs local command that provides credentials with additional environment
+// variables env and returns its stdout, error includes stderr of the command
+func runHelperCommand(command string, env ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), helperCommandTimeout)
+	defer cancel()
+
+	c := localShellCommand(ctx, command)
+	c.Env = append(os.Environ(), env...)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.New("timed out after " + helperCommandTimeout.String())
+	}
+	if err != nil {
+		msg := err.Error()
+		if s := strings.TrimSpace(stderr.String()); s != "" {
+			msg += ": " + s
+		}
+		return nil, errors.New(msg)
+	}
+	return out, nil
+}
+
+// parseAuthCommandKey parses PEM private key from out, certificate of the key in authorized_keys
+// format can follow it and is offered first
+func parseAuthCommandKey(out []byte) ([]ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(out)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(scanner.Bytes())
+		if err != nil {
+			continue
+		}
+		if cert, ok := pub.(*ssh.Certificate); ok && bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+			certSigner, err := ssh.NewCertSigner(cert, signer)
+			if err != nil {
+				return nil, err
+			}
+			return []ssh.Signer{certSigner, signer}, nil
+		}
+	}
+	return []ssh.Signer{signer}, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAuthCommand(t *testing.T) {
+	r := makeTestResult()
+	for i := 0; i < 2; i++ {
+		srv := &testSSHServer{hostname: "test-auth-command", password: "command secret"}
+		srv.start()
+		r.hosts[srv.addr] = srv
+		r.hostsLeft[srv.addr] = struct{}{}
+	}
+
+	authCommand = `test -n "$HOST" && echo 'command secret'`
+	defer func() { authCommand = "" }()
+
+	runTestRequest(t, r, makeProxyRequest(maxTimeout))
+	checkSuccess(t, r)
+}
+
+func TestAuthChain(t *testing.T) {
+	if _, err := parseAuthChain("agent,token"); err == nil {
+		t.Fatalf("Unknown provider must be rejected")
+	}
+
+	inv := newInventory()
+	inv.group("all")
+	must(inv.addHost("switches", "sw1", map[string]string{"gossha_auth": "password, keyboard-interactive"}), "Could not add host")
+	inv.resolveVars()
+	hostInventory = inv
+	defer func() { hostInventory = nil }()
+
+	if chain := hostAuthChain("sw1"); !reflect.DeepEqual(chain, []string{"password", "keyboard-interactive"}) {
+		t.Fatalf("Unexpected providers of host with gossha_auth: %v", chain)
+	}
+	if chain := hostAuthChain("web1"); len(chain) != len(authProviders)-1 || chain[0] != "vault" {
+		t.Fatalf("Unexpected default providers: %v", chain)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// splitBatches splits hosts into batches for rolling execution, serial is batch size
+// specified either as number of hosts ("10") or as percentage of all hosts ("10%")
+func splitBatches(hosts []string, serial string) ([][]string, error) {
+	if serial == "" {
+		return [][]string{hosts}, nil
+	}
+
+	size := 0
+	if strings.HasSuffix(serial, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(serial, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, errors.New("Invalid 'Serial' percentage: " + serial)
+		}
+		// round up, so that small percentage of few hosts still means at least one host per batch
+		size = int((percent*float64(len(hosts)) + 99.999999) / 100)
+	} else {
+		n, err := strconv.Atoi(serial)
+		if err != nil || n <= 0 {
+			return nil, errors.New("Invalid 'Serial': " + serial)
+		}
+		size = n
+	}
+
+	if size < 1 {
+		size = 1
+	}
+
+	var batches [][]string
+	for len(hosts) > size {
+		batches = append(batches, hosts[:size])
+		hosts = hosts[size:]
+	}
+	return append(batches, hosts), nil
+}
+
+// tooManyFailures checks whether rollout must be stopped after batch of size hosts finished with failed failures
+func tooManyFailures(failed, size int, maxFailPercentage float64) bool {
+	return float64(failed)*100 > maxFailPercentage*float64(size)
+}
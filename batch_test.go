@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSplitBatches(t *testing.T) {
+	hosts := []string{"a", "b", "c", "d", "e"}
+
+	for serial, expected := range map[string][][]string{
+		"":    {{"a", "b", "c", "d", "e"}},
+		"2":   {{"a", "b"}, {"c", "d"}, {"e"}},
+		"10%": {{"a"}, {"b"}, {"c"}, {"d"}, {"e"}},
+		"50%": {{"a", "b", "c"}, {"d", "e"}},
+		"10":  {{"a", "b", "c", "d", "e"}},
+	} {
+		batches, err := splitBatches(hosts, serial)
+		if err != nil || !reflect.DeepEqual(batches, expected) {
+			t.Fatalf("Unexpected batches for %q: %v, %v", serial, batches, err)
+		}
+	}
+
+	for _, serial := range []string{"0", "-1", "x", "0%", "120%"} {
+		if _, err := splitBatches(hosts, serial); err == nil {
+			t.Fatalf("Invalid serial %q must be rejected", serial)
+		}
+	}
+}
+
+// runSerial runs command that fails on test-serial-0 in batches of two and returns hosts that replied and skipped hosts
+func runSerial(t *testing.T, hosts []string, maxFailPercentage float64) (replied, skipped []string) {
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = `[ "$TEST_HOSTNAME" != test-serial-0 ]`
+	req.Hosts = hosts
+	req.Serial = "2"
+	req.MaxFailPercentage = maxFailPercentage
+
+	requestsChan <- req
+
+	timeout := time.After(maxTimeout)
+	for {
+		select {
+		case reply := <-repliesChan:
+			switch reply := reply.(type) {
+			case *Reply:
+				replied = append(replied, reply.Hostname)
+			case *FinalReply:
+				sort.Strings(replied)
+				return replied, reply.SkippedHosts
+			}
+		case <-timeout:
+			t.Fatalf("Timed out")
+		}
+	}
+}
+
+func TestSerial(t *testing.T) {
+	var hosts []string
+	for i := 0; i < 4; i++ {
+		srv := &testSSHServer{hostname: fmt.Sprintf("test-serial-%d", i)}
+		srv.start()
+		hosts = append(hosts, srv.addr)
+	}
+
+	firstBatch := []string{hosts[0], hosts[1]}
+	sort.Strings(firstBatch)
+
+	replied, skipped := runSerial(t, hosts, 0)
+	if !reflect.DeepEqual(replied, firstBatch) || !reflect.DeepEqual(skipped, hosts[2:]) {
+		t.Fatalf("Rollout must stop after failed batch, replied: %v, skipped: %v", replied, skipped)
+	}
+
+	replied, skipped = runSerial(t, hosts, 50)
+	if len(replied) != 4 || len(skipped) != 0 {
+		t.Fatalf("Rollout must continue when failures are within limit, replied: %v, skipped: %v", replied, skipped)
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	oldMaxConnections := maxConnections
+	maxConnections = 1
+	defer func() { maxConnections = oldMaxConnections }()
+
+	var hosts []string
+	for i := 0; i < 3; i++ {
+		srv := &testSSHServer{hostname: fmt.Sprintf("test-fail-fast-%d", i)}
+		srv.start()
+		hosts = append(hosts, srv.addr)
+	}
+
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = "exit 1"
+	req.Hosts = hosts
+	req.FailFast = true
+
+	requestsChan <- req
+
+	replies := 0
+	timeout := time.After(maxTimeout)
+	for {
+		select {
+		case reply := <-repliesChan:
+			switch reply := reply.(type) {
+			case *Reply:
+				replies++
+			case *FinalReply:
+				// next host may have been started already
+				if replies != 1 || len(reply.SkippedHosts) == 0 || len(reply.SkippedHosts)+len(reply.PendingHosts) != 2 {
+					t.Fatalf("Expected one failure and two cancelled hosts, got %d replies and %+v", replies, reply)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Timed out")
+		}
+	}
+}
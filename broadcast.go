@@ -0,0 +1,635 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Broadcast shell ("gossha cssh [flags] host1 ... hostN"): interactive shell with pseudo-terminal
+// is opened on every host and typed keys are sent to all of them, like cluster SSH. Output is
+// merged line by line with host prefixes, or shown in a pane per host with -panes. Ctrl-] starts
+// a command: a digit, n or p zooms into one host (keys only go to it and its output is shown as is,
+// so full-screen programs work), a returns to broadcasting, m switches between merged output and
+// panes, q closes all sessions and Ctrl-] sends Ctrl-] itself.
+
+const (
+	csshEscape     = 0x1d // Ctrl-], starts command
+	csshScrollback = 200  // lines of output kept for every host
+	csshMaxLine    = 4096 // longer lines are split
+)
+
+const csshHelp = "Ctrl-] then: 1-9/n/p zoom into host, a broadcast to all, m merged/panes, q quit"
+
+type (
+	// csshConnected is sent by csshMain after sessions are opened
+	csshConnected struct {
+		sessions []*csshSession
+		status   int
+	}
+
+	// csshOutput is output of session (or its end if data is nil)
+	csshOutput struct {
+		s    *csshSession
+		data []byte
+	}
+
+	csshSession struct {
+		hostname string
+		conn     *ssh.Client
+		session  *ssh.Session
+		stdin    io.WriteCloser
+		stdout   io.Reader
+		lines    csshLines
+		closed   bool
+	}
+
+	// csshLines splits terminal output into lines, control sequences are dropped
+	csshLines struct {
+		lines   []string
+		partial []byte // line that is not finished yet
+		state   byte   // 0 normal, 'e' after ESC, '[' in CSI, ']' in OSC, '\\' after ESC in OSC
+		cr      bool   // carriage return was received, the line is overwritten unless newline follows
+	}
+
+	// csshView is state of broadcast shell screen
+	csshView struct {
+		w         io.Writer
+		t         *tuiTerminal // terminal that is restored on exit, nil in tests
+		sessions  []*csshSession
+		panes     bool
+		zoomed    *csshSession // host that receives keys and which output is shown as is, nil when broadcasting
+		width     int
+		height    int
+		prefixLen int
+		status    string
+	}
+)
+
+// write adds terminal output data and returns lines that were finished by it
+func (l *csshLines) write(data []byte) (finished []string) {
+	for _, b := range data {
+		switch l.state {
+		case 'e':
+			switch b {
+			case '[', ']':
+				l.state = b
+			default:
+				l.state = 0 // two-byte sequence
+			}
+			continue
+		case '[':
+			if b >= 0x40 && b <= 0x7e {
+				l.state = 0
+			}
+			continue
+		case ']':
+			if b == 0x07 {
+				l.state = 0
+			} else if b == 0x1b {
+				l.state = '\\'
+			}
+			continue
+		case '\\':
+			l.state = 0
+			continue
+		}
+
+		if l.cr && b != '\n' {
+			l.partial = l.partial[:0]
+		}
+		l.cr = false
+
+		switch {
+		case b == 0x1b:
+			l.state = 'e'
+		case b == '\n':
+			finished = append(finished, l.finish())
+		case b == '\r':
+			l.cr = true
+		case b == '\b':
+			if _, size := utf8.DecodeLastRune(l.partial); size > 0 {
+				l.partial = l.partial[:len(l.partial)-size]
+			}
+		case b == '\t' || b >= 0x20 && b != 0x7f:
+			l.partial = append(l.partial, b)
+			if len(l.partial) >= csshMaxLine {
+				finished = append(finished, l.finish())
+			}
+		}
+	}
+	return
+}
+
+func (l *csshLines) finish() string {
+	line := string(l.partial)
+	l.partial = l.partial[:0]
+
+	l.lines = append(l.lines, line)
+	if len(l.lines) > csshScrollback {
+		l.lines = l.lines[len(l.lines)-csshScrollback:]
+	}
+	return line
+}
+
+// tail returns last n lines, including unfinished one
+func (l *csshLines) tail(n int) []string {
+	lines := append(append([]string(nil), l.lines...), string(l.partial))
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+func newCSSHView(w io.Writer, sessions []*csshSession, panes bool, width, height int) *csshView {
+	v := &csshView{w: w, sessions: sessions, panes: panes, width: width, height: height}
+	for _, s := range sessions {
+		if len(s.hostname)+2 > v.prefixLen {
+			v.prefixLen = len(s.hostname) + 2
+		}
+	}
+	return v
+}
+
+// paneGrid returns number of pane columns and rows
+func (v *csshView) paneGrid() (cols, rows int) {
+	for cols = 1; cols*cols < len(v.sessions); cols++ {
+	}
+	rows = (len(v.sessions) + cols - 1) / cols
+	return
+}
+
+// ptySize returns size of terminal of session s in the current layout
+func (v *csshView) ptySize(s *csshSession) (width, height int) {
+	switch {
+	case v.zoomed == s:
+		return v.width, v.height
+	case v.panes:
+		cols, rows := v.paneGrid()
+		return atLeast(v.width/cols-1, 10), atLeast((v.height-1)/rows-1, 2)
+	}
+	return atLeast(v.width-v.prefixLen, 10), v.height
+}
+
+func atLeast(n, min int) int {
+	if n < min {
+		return min
+	}
+	return n
+}
+
+// resize changes terminal size of all sessions after layout or terminal size changes
+func (v *csshView) resize() {
+	for _, s := range v.sessions {
+		if !s.closed {
+			w, h := v.ptySize(s)
+			s.session.WindowChange(h, w)
+		}
+	}
+}
+
+// promptSession returns session which unfinished line is shown as prompt in merged output
+func (v *csshView) promptSession() *csshSession {
+	for _, s := range v.sessions {
+		if !s.closed {
+			return s
+		}
+	}
+	return nil
+}
+
+// output shows data received from s
+func (v *csshView) output(s *csshSession, data []byte) {
+	finished := s.lines.write(data)
+
+	switch {
+	case v.zoomed == s:
+		v.w.Write(data)
+	case v.zoomed != nil || v.panes:
+		// panes are redrawn periodically
+	case len(finished) > 0 || s == v.promptSession():
+		var buf bytes.Buffer
+		buf.WriteString("\r\x1b[K")
+		for _, line := range finished {
+			buf.WriteString(v.prefix(s) + line + "\x1b[0m\r\n")
+		}
+		v.writePrompt(&buf)
+		v.w.Write(buf.Bytes())
+	}
+}
+
+func (v *csshView) prefix(s *csshSession) string {
+	return fmt.Sprintf("\x1b[1m%-*s\x1b[0m", v.prefixLen, s.hostname+":")
+}
+
+func (v *csshView) writePrompt(buf *bytes.Buffer) {
+	if s := v.promptSession(); s != nil {
+		buf.WriteString(v.prefix(s) + string(s.lines.partial))
+	}
+}
+
+// message shows status line (in merged output it is printed as a separate line)
+func (v *csshView) message(msg string) {
+	v.status = msg
+	if v.panes || v.zoomed != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("\r\x1b[K=== " + msg + "\r\n")
+	v.writePrompt(&buf)
+	v.w.Write(buf.Bytes())
+}
+
+// redraw draws panes, or the whole merged output prompt
+func (v *csshView) redraw() {
+	var buf bytes.Buffer
+
+	switch {
+	case v.zoomed != nil:
+		return
+	case !v.panes:
+		buf.WriteString("\r\x1b[K")
+		v.writePrompt(&buf)
+		v.w.Write(buf.Bytes())
+		return
+	}
+
+	cols, rows := v.paneGrid()
+	pw, ph := v.width/cols, (v.height-1)/rows
+	buf.WriteString("\x1b[H\x1b[2J")
+
+	for i, s := range v.sessions {
+		x, y := i%cols*pw, i/cols*ph
+
+		title := s.hostname
+		if s.closed {
+			title += " (closed)"
+		}
+		fmt.Fprintf(&buf, "\x1b[%d;%dH\x1b[7m%s\x1b[0m", y+1, x+1, fitLine(" "+title, pw-1))
+
+		lines := s.lines.tail(ph - 1)
+		for j, line := range lines {
+			fmt.Fprintf(&buf, "\x1b[%d;%dH%s", y+2+j, x+1, fitLine(line, pw-1))
+		}
+	}
+
+	fmt.Fprintf(&buf, "\x1b[%d;1H\x1b[7m%s\x1b[0m", v.height, fitLine(" "+v.status, v.width))
+	v.w.Write(buf.Bytes())
+}
+
+// zoom sends keys only to s and shows its output as is, nil returns to broadcasting
+func (v *csshView) zoom(s *csshSession) {
+	if s != nil && s.closed {
+		v.message("Session to " + s.hostname + " is closed")
+		return
+	}
+
+	v.zoomed = s
+	v.resize()
+	if s == nil {
+		v.message(fmt.Sprintf("Broadcasting to %d host(s), %s", v.open(), csshHelp))
+		v.redraw()
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H\x1b[2J=== " + s.hostname + " (Ctrl-] a to broadcast to all hosts again)\r\n")
+	for _, line := range s.lines.tail(v.height - 1) {
+		buf.WriteString(line + "\r\n")
+	}
+	v.w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\r\n")))
+}
+
+func (v *csshView) open() (n int) {
+	for _, s := range v.sessions {
+		if !s.closed {
+			n++
+		}
+	}
+	return
+}
+
+// command handles key typed after Ctrl-], it returns false if broadcast shell must be closed
+func (v *csshView) command(key byte) bool {
+	idx := -1
+	for i, s := range v.sessions {
+		if s == v.zoomed {
+			idx = i
+		}
+	}
+
+	switch {
+	case key >= '1' && key <= '9':
+		if i := int(key - '1'); i < len(v.sessions) {
+			v.zoom(v.sessions[i])
+		}
+	case key == 'n':
+		v.zoom(v.sessions[(idx+1)%len(v.sessions)])
+	case key == 'p':
+		if idx <= 0 {
+			idx = len(v.sessions)
+		}
+		v.zoom(v.sessions[idx-1])
+	case key == 'a':
+		v.zoom(nil)
+	case key == 'm':
+		v.panes = !v.panes
+		if v.panes {
+			io.WriteString(v.w, "\x1b[?1049h")
+		} else {
+			io.WriteString(v.w, "\x1b[?1049l")
+		}
+		if v.t != nil {
+			v.t.altScreen = v.panes
+		}
+		v.zoom(v.zoomed)
+	case key == 'q':
+		return false
+	default:
+		v.message(csshHelp)
+	}
+	return true
+}
+
+// keys sends typed keys to sessions, handling Ctrl-] commands; it returns false if broadcast shell must be closed
+func (v *csshView) keys(in []byte, escaped *bool) bool {
+	var out []byte
+	for _, b := range in {
+		switch {
+		case *escaped:
+			*escaped = false
+			if b == csshEscape {
+				out = append(out, b)
+				continue
+			}
+			v.send(out)
+			out = nil
+			if !v.command(b) {
+				return false
+			}
+		case b == csshEscape:
+			*escaped = true
+		default:
+			out = append(out, b)
+		}
+	}
+	v.send(out)
+	return true
+}
+
+func (v *csshView) send(keys []byte) {
+	if len(keys) == 0 {
+		return
+	}
+	for _, s := range v.sessions {
+		if !s.closed && (v.zoomed == nil || v.zoomed == s) {
+			s.stdin.Write(keys)
+		}
+	}
+}
+
+// openCSSHSession opens interactive shell on hostname with terminal of size width x height
+func openCSSHSession(hostname string, width, height int) (*csshSession, error) {
+	conn, err := getConnection(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &csshSession{hostname: hostname, conn: conn}
+	if s.session, err = conn.NewSession(); err != nil {
+		connectedHosts.Release(hostname, conn)
+		return nil, err
+	}
+
+	term := os.Getenv("TERM")
+	if term == "" {
+		term = "xterm"
+	}
+	if err = s.session.RequestPty(term, height, width, ssh.TerminalModes{ssh.ECHO: 1}); err == nil {
+		if s.stdin, err = s.session.StdinPipe(); err == nil {
+			if s.stdout, err = s.session.StdoutPipe(); err == nil {
+				err = s.session.Shell()
+			}
+		}
+	}
+	if err != nil {
+		s.session.Close()
+		connectedHosts.Release(hostname, conn)
+		return nil, err
+	}
+	return s, nil
+}
+
+// readCSSHOutput sends output of s to out until session ends
+func readCSSHOutput(s *csshSession, out chan<- csshOutput) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := s.stdout.Read(buf)
+		if n > 0 {
+			out <- csshOutput{s: s, data: append([]byte(nil), buf[:n]...)}
+		}
+		if err != nil {
+			s.session.Wait()
+			out <- csshOutput{s: s}
+			return
+		}
+	}
+}
+
+// connectCSSH opens sessions to hosts in parallel, failures are reported to user
+func connectCSSH(hosts []string, width, height int) *csshConnected {
+	res := &csshConnected{sessions: make([]*csshSession, len(hosts))}
+
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func(i int, h string) {
+			defer wg.Done()
+			s, err := openCSSHSession(h, width, height)
+			if err != nil {
+				reportErrorToUser("Cannot open shell on " + h + ": " + err.Error())
+				return
+			}
+			res.sessions[i] = s
+		}(i, h)
+	}
+	wg.Wait()
+
+	sessions := res.sessions[:0]
+	for _, s := range res.sessions {
+		if s != nil {
+			sessions = append(sessions, s)
+		}
+	}
+	if len(sessions) < len(hosts) {
+		res.status = 1
+	}
+	res.sessions = sessions
+	return res
+}
+
+func csshMain(args []string) int {
+	var panes bool
+
+	os.Args = append([]string{os.Args[0]}, args...)
+	flag.BoolVar(&panes, "panes", false, "Show output of every host in its own pane instead of merging lines")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gossha cssh [flags] host1 ... hostN")
+		fmt.Fprintln(os.Stderr, csshHelp)
+		flag.PrintDefaults()
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot open terminal: "+err.Error())
+		return 1
+	}
+	t := &tuiTerminal{tty: tty}
+	width, height := t.size()
+
+	go func() {
+		initialize(true)
+		if flag.NArg() < 1 {
+			flag.Usage()
+			repliesChan <- &csshConnected{status: 2}
+			return
+		}
+
+		hosts, err := expandHosts(flag.Args())
+		if err != nil {
+			reportCriticalErrorToUser(err.Error())
+			repliesChan <- &csshConnected{status: 2}
+			return
+		}
+		repliesChan <- connectCSSH(uniqueHosts(hosts), width, height)
+	}()
+
+	// passphrases and host keys are asked before terminal is switched to raw mode
+	var connected *csshConnected
+	stdin := bufio.NewReader(os.Stdin)
+	for connected == nil {
+		switch reply := (<-repliesChan).(type) {
+		case *csshConnected:
+			connected = reply
+		case *HostKeyRequest:
+			promptHostKey(stdin, reply)
+		case *PasswordRequest, *UserError:
+			writeReplyText(os.Stdout, os.Stderr, reply, "")
+			if _, ok := reply.(*PasswordRequest); ok {
+				line, _ := stdin.ReadString('\n')
+				requestsChan <- &ProxyRequest{Password: strings.TrimRight(line, "\r\n")}
+			}
+		}
+	}
+	if len(connected.sessions) == 0 {
+		if connected.status == 0 {
+			connected.status = 1
+		}
+		return connected.status
+	}
+
+	status := runCSSH(t, connected.sessions, panes, width, height)
+	if status == 0 {
+		status = connected.status
+	}
+	return status
+}
+
+// runCSSH broadcasts keys to sessions until all of them are closed or user quits
+func runCSSH(t *tuiTerminal, sessions []*csshSession, panes bool, width, height int) int {
+	var err error
+	if t.saved, err = t.stty("-g"); err == nil {
+		_, err = t.stty("raw", "-echo")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot set up terminal: "+err.Error())
+		return 1
+	}
+	activeTerminal = t
+	defer t.restore()
+
+	out := make(chan csshOutput, 64)
+	for _, s := range sessions {
+		go readCSSHOutput(s, out)
+	}
+
+	keys := make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := t.tty.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	resized := make(chan os.Signal, 1)
+	notifyResize(resized)
+
+	ticker := time.NewTicker(tuiRefreshInterval)
+	defer ticker.Stop()
+
+	v := newCSSHView(t.tty, sessions, false, width, height)
+	v.t = t
+	if panes {
+		v.command('m')
+	}
+	v.resize()
+	v.message(fmt.Sprintf("Broadcasting to %d host(s), %s", len(sessions), csshHelp))
+
+	dirty, escaped := true, false
+	defer func() {
+		io.WriteString(t.tty, "\r\n")
+		for _, s := range sessions {
+			s.session.Close()
+			connectedHosts.Release(s.hostname, s.conn)
+		}
+	}()
+
+	for {
+		select {
+		case o := <-out:
+			if o.data != nil {
+				v.output(o.s, o.data)
+				dirty = true
+				continue
+			}
+
+			o.s.closed = true
+			if v.zoomed == o.s {
+				v.zoom(nil)
+			}
+			v.message("Session to " + o.s.hostname + " is closed")
+			if v.open() == 0 {
+				return 0
+			}
+		case in, ok := <-keys:
+			if !ok || !v.keys(in, &escaped) {
+				return 0
+			}
+			dirty = true
+		case <-resized:
+			v.width, v.height = t.size()
+			v.resize()
+			dirty = true
+		case <-ticker.C:
+			if dirty && v.panes {
+				v.redraw()
+			}
+			dirty = false
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testStdin struct{ bytes.Buffer }
+
+func (*testStdin) Close() error { return nil }
+
+func TestCSSHLines(t *testing.T) {
+	var l csshLines
+	finished := l.write([]byte("\x1b[1;32mgreen\x1b[0m line\r\nprogress 10%\rprogress 100%\r\n\x1b]0;title\x07ab\bc"))
+	if expected := []string{"green line", "progress 100%"}; !reflect.DeepEqual(finished, expected) {
+		t.Fatalf("Unexpected lines: %q", finished)
+	}
+	if string(l.partial) != "ac" {
+		t.Fatalf("Unexpected unfinished line: %q", l.partial)
+	}
+
+	if lines := l.tail(2); !reflect.DeepEqual(lines, []string{"progress 100%", "ac"}) {
+		t.Fatalf("Unexpected tail: %q", lines)
+	}
+
+	for i := 0; i < csshScrollback*2; i++ {
+		l.write([]byte("line\n"))
+	}
+	if len(l.lines) != csshScrollback {
+		t.Fatalf("Only %d lines must be kept, got %d", csshScrollback, len(l.lines))
+	}
+}
+
+func TestCSSHKeys(t *testing.T) {
+	var out bytes.Buffer
+	in1, in2 := &testStdin{}, &testStdin{}
+	sessions := []*csshSession{{hostname: "web1", stdin: in1}, {hostname: "web2", stdin: in2}}
+	v := newCSSHView(&out, sessions, false, 80, 24)
+
+	escaped := false
+	if !v.keys([]byte("ls\r"), &escaped) {
+		t.Fatalf("Keys must not close broadcast shell")
+	}
+
+	// keys only go to zoomed host, Ctrl-] Ctrl-] is sent as is
+	v.zoomed = sessions[1]
+	if !v.keys([]byte{'x', csshEscape, csshEscape}, &escaped) {
+		t.Fatalf("Keys must not close broadcast shell")
+	}
+
+	if in1.String() != "ls\r" || in2.String() != "ls\rx\x1d" {
+		t.Fatalf("Unexpected keys sent: %q, %q", in1.String(), in2.String())
+	}
+
+	if v.keys([]byte{csshEscape, 'q'}, &escaped) {
+		t.Fatalf("Ctrl-] q must close broadcast shell")
+	}
+}
+
+func TestCSSHSession(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-cssh", 2)
+
+	var hosts []string
+	for addr := range r.hosts {
+		hosts = append(hosts, addr)
+	}
+
+	done := make(chan *csshConnected)
+	go func() { done <- connectCSSH(hosts, 80, 24) }()
+
+	// connection progress is sent to proxy replies
+	var connected *csshConnected
+	for connected == nil {
+		select {
+		case connected = <-done:
+		case <-repliesChan:
+		}
+	}
+	if connected.status != 0 || len(connected.sessions) != 2 {
+		t.Fatalf("Could not open sessions: %+v", connected)
+	}
+
+	out := make(chan csshOutput, 64)
+	var screen bytes.Buffer
+	for _, s := range connected.sessions {
+		s.stdin.Write([]byte("echo $TEST_HOSTNAME $TEST_PTY\nexit\n"))
+		go readCSSHOutput(s, out)
+	}
+	v := newCSSHView(&screen, connected.sessions, false, 80, 24)
+
+	timeoutCh := time.After(maxTimeout)
+	for open := 2; open > 0; {
+		select {
+		case o := <-out:
+			if o.data == nil {
+				open--
+				continue
+			}
+			v.output(o.s, o.data)
+		case <-timeoutCh:
+			t.Fatalf("Timed out")
+		}
+	}
+
+	for _, s := range connected.sessions {
+		if line := r.hosts[s.hostname].hostname + " 1"; !strings.Contains(strings.Join(s.lines.lines, "\n"), line) {
+			t.Fatalf("Expected %q in output of %s: %q", line, s.hostname, s.lines.lines)
+		}
+		if !strings.Contains(screen.String(), s.hostname+":") {
+			t.Fatalf("Output must be prefixed with host: %q", screen.String())
+		}
+		s.session.Close()
+		connectedHosts.Release(s.hostname, s.conn)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Result cache: with "CacheTTL" successful results of commands are kept in memory and returned
+// for the same command on the same host without connecting to it until they expire. Cache lives
+// as long as GoSSHa process, so it is mostly useful for expensive read-only probes that tools run
+// repeatedly with -daemon, -serve or -repl. "NoCache" (or -no-cache) runs commands anyway.
+
+var noCacheDefault bool // do not return cached results (-no-cache)
+
+var resultCache = struct {
+	sync.Mutex
+	results map[string]*cachedResult // by resultCacheKey
+}{results: make(map[string]*cachedResult)}
+
+type cachedResult struct {
+	res     SshResult
+	expires time.Time
+}
+
+// resultCacheKey identifies command of rendered request msg on hostname together with settings that affect its output
+func resultCacheKey(hostname string, msg *ProxyRequest) string {
+	buf, _ := json.Marshal([]interface{}{msg.Cmd, msg.Cmds, msg.Stdin, msg.StdinFile, msg.Env, msg.Pty, msg.Sudo, msg.RunAs, msg.RunAsMethod, msg.Shell, msg.NoShell, msg.OnlyIf, msg.Session, msg.RemoteEncoding, msg.StripANSI, msg.Then, msg.OnFail, msg.SummaryOnly, msg.SummaryLines})
+	sum := sha256.Sum256(buf)
+	return hostname + " " + hex.EncodeToString(sum[:])
+}
+
+// withResultCache returns cached results of commands that are younger than msg.CacheTTL and caches new successful ones
+func withResultCache(msg *ProxyRequest, execFunc func(string) *SshResult) func(string) *SshResult {
+	if msg.CacheTTL == 0 || dryRun {
+		return execFunc
+	}
+
+	ttl := time.Duration(msg.CacheTTL) * time.Millisecond
+	useCached := !msg.NoCache && !noCacheDefault
+	render, _ := newHostRenderer(msg) // templates are already validated by getExecFunc
+
+	return func(hostname string) *SshResult {
+		req, err := render(hostname)
+		if err != nil {
+			return execFunc(hostname)
+		}
+		key := resultCacheKey(hostname, req)
+
+		if useCached {
+			if res := lookupCachedResult(key); res != nil {
+				logf(logInfo, hostname, "Using cached result")
+				return res
+			}
+		}
+
+		res := execFunc(hostname)
+		if res.err == nil {
+			storeCachedResult(key, res, ttl)
+		}
+		return res
+	}
+}
+
+func lookupCachedResult(key string) *SshResult {
+	resultCache.Lock()
+	defer resultCache.Unlock()
+
+	c, ok := resultCache.results[key]
+	if !ok || time.Now().After(c.expires) {
+		return nil
+	}
+
+	res := c.res
+	res.cached = true
+	return &res
+}
+
+func storeCachedResult(key string, res *SshResult, ttl time.Duration) {
+	resultCache.Lock()
+	defer resultCache.Unlock()
+
+	now := time.Now()
+	for k, c := range resultCache.results {
+		if now.After(c.expires) {
+			delete(resultCache.results, k)
+		}
+	}
+	resultCache.results[key] = &cachedResult{res: *res, expires: now.Add(ttl)}
+}
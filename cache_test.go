@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestResultCache(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-cache", 2)
+
+	check := func(req *ProxyRequest, cached bool, stdout string) {
+		r.replies = make(map[string]*Reply)
+		for addr := range r.hosts {
+			r.hostsLeft[addr] = struct{}{}
+		}
+		req.Hosts = nil
+		runTestRequest(t, r, req)
+
+		for _, reply := range r.replies {
+			if reply.Cached != cached || reply.Stdout != stdout {
+				t.Fatalf("Unexpected reply to %+v: %+v", req, reply)
+			}
+		}
+	}
+
+	req := &ProxyRequest{Action: "ssh", Cmd: "echo x >> runs; wc -l < runs", CacheTTL: 60000}
+	check(req, false, "1\n")
+	check(req, true, "1\n")
+
+	// result of run with NoCache replaces cached one
+	req.NoCache = true
+	check(req, false, "2\n")
+	req.NoCache = false
+	check(req, true, "2\n")
+
+	check(&ProxyRequest{Action: "ssh", Cmd: "wc -l < runs", CacheTTL: 60000}, false, "2\n")
+	check(&ProxyRequest{Action: "ssh", Cmd: "echo x >> runs; wc -l < runs"}, false, "3\n")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+)
+
+// Canary execution ("Canary": N or "CanaryHosts"): action is run on N random (or explicitly
+// specified) hosts first, their replies are sent and ConfirmationRequest is sent to user; the
+// rest of hosts is only started after {"Confirm": true} is received. Rollout stops without
+// asking if the canary fails.
+
+var canaryDefault uint64 // number of canary hosts for requests that do not specify them (-canary)
+
+// ConfirmationRequest asks user whether action should be started on the remaining hosts
+type ConfirmationRequest struct {
+	CanaryHosts []string `json:",omitempty"` // hosts where action succeeded
+	Remaining   int      // hosts that action will be started on
+	Reason      string   `json:",omitempty"` // why action that was not started yet must be confirmed (see guardReason)
+}
+
+// canaryBatches splits hosts into canary batch followed by batches of the remaining hosts
+// (see splitBatches); canary hosts are selected randomly if explicit list is empty
+func canaryBatches(hosts []string, count uint64, explicit []string, serial string) ([][]string, error) {
+	if count == 0 && len(explicit) == 0 {
+		return splitBatches(hosts, serial)
+	}
+
+	canary := make(map[string]bool)
+	if len(explicit) > 0 {
+		expanded, err := expandHosts(explicit)
+		if err != nil {
+			return nil, err
+		}
+
+		requested := make(map[string]bool, len(hosts))
+		for _, h := range hosts {
+			requested[h] = true
+		}
+		for _, h := range expanded {
+			if !requested[h] {
+				return nil, errors.New("Canary host " + h + " is not one of hosts of request")
+			}
+			canary[h] = true
+		}
+	} else {
+		for _, idx := range rand.Perm(len(hosts)) {
+			if uint64(len(canary)) == count {
+				break
+			}
+			canary[hosts[idx]] = true
+		}
+	}
+
+	var first, rest []string
+	for _, h := range hosts {
+		if canary[h] {
+			first = append(first, h)
+		} else {
+			rest = append(rest, h)
+		}
+	}
+	if len(rest) == 0 {
+		return [][]string{first}, nil
+	}
+
+	batches, err := splitBatches(rest, serial)
+	if err != nil {
+		return nil, err
+	}
+	return append([][]string{first}, batches...), nil
+}
+
+// confirmRollout asks user to confirm that action should be started on remaining hosts after it succeeded on canary hosts
+func confirmRollout(canary []string, remaining int) bool {
+	sendProxyReply(&ConfirmationRequest{CanaryHosts: canary, Remaining: remaining})
+
+	response, ok := <-requestsChan
+	return ok && response.Confirm
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCanaryBatches(t *testing.T) {
+	hosts := []string{"a", "b", "c", "d", "e"}
+
+	batches, err := canaryBatches(hosts, 2, nil, "2")
+	if err != nil || len(batches) != 3 || len(batches[0]) != 2 || len(batches[1]) != 2 || len(batches[2]) != 1 {
+		t.Fatalf("Unexpected batches with 2 random canaries: %v, %v", batches, err)
+	}
+
+	batches, err = canaryBatches(hosts, 0, []string{"d"}, "")
+	if err != nil || !reflect.DeepEqual(batches, [][]string{{"d"}, {"a", "b", "c", "e"}}) {
+		t.Fatalf("Unexpected batches with explicit canary: %v, %v", batches, err)
+	}
+
+	if batches, err = canaryBatches(hosts, 10, nil, ""); err != nil || len(batches) != 1 {
+		t.Fatalf("Canary of all hosts must be a single batch: %v, %v", batches, err)
+	}
+
+	if _, err := canaryBatches(hosts, 0, []string{"x"}, ""); err == nil {
+		t.Fatalf("Canary host that is not in request must be rejected")
+	}
+}
+
+// runCanary runs request with one canary host, answers confirmation with confirm and returns replies and final reply
+func runCanary(t *testing.T, r *testResult, confirm bool) (canaryReplies, replies []*Reply, final *FinalReply) {
+	req := makeProxyRequest(maxTimeout)
+	for addr := range r.hosts {
+		req.Hosts = append(req.Hosts, addr)
+	}
+	req.Canary = 1
+	requestsChan <- req
+
+	timeoutCh := time.After(maxTimeout)
+	for {
+		select {
+		case reply := <-repliesChan:
+			switch reply := reply.(type) {
+			case *Reply:
+				replies = append(replies, reply)
+			case *ConfirmationRequest:
+				if len(reply.CanaryHosts) != 1 || reply.Remaining != len(r.hosts)-1 {
+					t.Fatalf("Unexpected confirmation request: %+v", reply)
+				}
+				canaryReplies, replies = replies, nil
+				requestsChan <- &ProxyRequest{Confirm: confirm}
+			case *FinalReply:
+				return canaryReplies, replies, reply
+			case *UserError:
+				t.Fatalf("Unexpected error: %s", reply.ErrorMsg)
+			}
+		case <-timeoutCh:
+			t.Fatalf("Timed out")
+		}
+	}
+}
+
+func TestCanary(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-canary", 3)
+
+	canary, rest, final := runCanary(t, r, true)
+	if len(canary) != 1 || !canary[0].Success || len(rest) != 2 || len(final.SkippedHosts) != 0 {
+		t.Fatalf("Action must run on all hosts after confirmation: %v, %v, %+v", canary, rest, final)
+	}
+
+	canary, rest, final = runCanary(t, r, false)
+	if len(canary) != 1 || len(rest) != 0 || len(final.SkippedHosts) != 2 {
+		t.Fatalf("Remaining hosts must be skipped without confirmation: %v, %v, %+v", canary, rest, final)
+	}
+}
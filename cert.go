@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var certFiles []string // OpenSSH certificates specified with -cert flag
+
+// loadCertificate reads OpenSSH certificate (e.g. id_rsa-cert.pub)
+func loadCertificate(filename string) (*ssh.Certificate, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		return nil, errors.New("Could not parse certificate " + filename + ": " + err.Error())
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New(filename + " is not a certificate")
+	}
+
+	return cert, nil
+}
+
+// certSigners returns signers that present certificates for private keys: certificate is taken from
+// "<key>-cert.pub" file next to the key (if it exists) or from certFiles if it matches the key
+func certSigners(keyNames []string, keySigners []ssh.Signer) (res []ssh.Signer) {
+	var certs []*ssh.Certificate
+
+	for _, filename := range certFiles {
+		cert, err := loadCertificate(filename)
+		if err != nil {
+			reportErrorToUser(err.Error())
+			continue
+		}
+		certs = append(certs, cert)
+	}
+
+	for i, signer := range keySigners {
+		keyCerts := certs
+
+		if cert, err := loadCertificate(keyNames[i] + "-cert.pub"); err == nil {
+			keyCerts = append([]*ssh.Certificate{cert}, keyCerts...)
+		} else if !os.IsNotExist(err) {
+			reportErrorToUser(err.Error())
+		}
+
+		for _, cert := range keyCerts {
+			if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+				continue
+			}
+
+			certSigner, err := ssh.NewCertSigner(cert, signer)
+			if err != nil {
+				reportErrorToUser("Could not use certificate for " + keyNames[i] + ": " + err.Error())
+				continue
+			}
+			res = append(res, certSigner)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCertificateAuth(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	must(err, "Could not generate key")
+	signer, err := ssh.NewSignerFromKey(key)
+	must(err, "Could not create signer")
+
+	// test servers trust certificates signed by their own host key
+	ca, err := ssh.ParsePrivateKey([]byte(idRsa))
+	must(err, "Could not parse CA key")
+
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{testUserName},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	must(cert.SignCert(rand.Reader, ca), "Could not sign certificate")
+
+	dir, err := ioutil.TempDir("", "gossha-cert")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	keyName := filepath.Join(dir, "id_ed25519")
+	must(ioutil.WriteFile(keyName+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0600), "Could not write certificate")
+
+	r := makeTestResult()
+	startTestServers(r, "test-cert", 1)
+
+	for addr := range r.hosts {
+		conf := &ssh.ClientConfig{User: testUserName, HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+
+		conf.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+		if _, err := dialHost(addr, conf); err == nil {
+			t.Fatalf("Key without certificate must not be accepted")
+		}
+
+		certs := certSigners([]string{keyName}, []ssh.Signer{signer})
+		if len(certs) != 1 {
+			t.Fatalf("Expected certificate signer, got %d", len(certs))
+		}
+
+		conf.Auth = []ssh.AuthMethod{ssh.PublicKeys(certs...)}
+		conn, err := dialHost(addr, conf)
+		if err != nil {
+			t.Fatalf("Could not authenticate with certificate: %s", err)
+		}
+		conn.Close()
+	}
+}
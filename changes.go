@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Upload change report ("ChangeReport": true): before every file is uploaded, its existing target
+// is examined, and reply of host lists for every file whether it was "created", "replaced" or left
+// "unchanged" (contents were the same) together with SHA-256, size, permissions and modification
+// time that the target had before. Reports are also written to audit log, so that it tells what
+// was changed on regulated systems. Files uploaded before a failure are reported as well.
+
+type (
+	// FileChange tells how upload changed remote file (only with ChangeReport)
+	FileChange struct {
+		Target   string
+		Change   string     // "created", "replaced", "unchanged" or "deleted" (only with MirrorDelete)
+		SHA256   string     `json:",omitempty"` // checksum of uploaded contents, empty for deleted files
+		Previous *FileState `json:",omitempty"` // state of target before upload, nil if it did not exist
+		Planned  bool       `json:",omitempty"` // change was not made (only with MirrorPlan)
+	}
+
+	// FileState describes remote file before it was replaced
+	FileState struct {
+		SHA256 string    `json:",omitempty"` // empty if target was not a regular file
+		Size   uint64    // size in bytes
+		Mode   string    `json:",omitempty"` // octal permissions, e.g. "0644"
+		Mtime  time.Time // modification time
+	}
+)
+
+// remoteFileState returns state of remotePath before upload, nil if it does not exist
+func remoteFileState(conn *ssh.Client, client *sftpClient, remotePath string) (*FileState, error) {
+	attrs, err := client.Stat(remotePath)
+	if isSftpNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.New("Cannot stat " + remotePath + ": " + err.Error())
+	}
+
+	st := newFileState(attrs)
+	if attrs.Flags&sshFileXferAttrPermissions != 0 && attrs.Perm&0170000 != 0100000 {
+		return st, nil
+	}
+
+	if st.SHA256, err = remoteChecksum(conn, client, remotePath); err != nil {
+		return nil, errors.New("Cannot compute checksum of " + remotePath + ": " + err.Error())
+	}
+	return st, nil
+}
+
+// newFileState returns state of remote file with attrs, without checksum
+func newFileState(attrs *sftpAttrs) *FileState {
+	st := &FileState{}
+	if attrs.Flags&sshFileXferAttrSize != 0 {
+		st.Size = attrs.Size
+	}
+	if attrs.Flags&sshFileXferAttrACModTime != 0 {
+		st.Mtime = time.Unix(int64(attrs.Mtime), 0).UTC()
+	}
+	if attrs.Flags&sshFileXferAttrPermissions != 0 {
+		st.Mode = fmt.Sprintf("%04o", attrs.Perm&07777)
+	}
+	return st
+}
+
+// newFileChange classifies upload of contents with checksum sum to target that was in state prev
+func newFileChange(target string, prev *FileState, sum string) *FileChange {
+	c := &FileChange{Target: target, SHA256: sum, Previous: prev}
+	switch {
+	case prev == nil:
+		c.Change = "created"
+	case prev.SHA256 == sum:
+		c.Change = "unchanged"
+	default:
+		c.Change = "replaced"
+	}
+	return c
+}
+
+// sameContents tells whether regular file in state s has the same contents as entry (like remoteFileUnchanged)
+func (s *FileState) sameContents(entry *uploadEntry) (bool, error) {
+	if s == nil || s.SHA256 == "" || s.Size != uint64(entry.size) {
+		return false, nil
+	}
+
+	sum, err := entry.sha256()
+	if err != nil {
+		return false, err
+	}
+	return s.SHA256 == sum, nil
+}
+
+// formatPreviousState describes state s of replaced target for human-readable output
+func formatPreviousState(s *FileState) string {
+	if s == nil {
+		return ""
+	}
+	res := fmt.Sprintf(" (was %d bytes", s.Size)
+	if s.Mode != "" {
+		res += ", mode " + s.Mode
+	}
+	res += ", modified " + s.Mtime.Format(time.RFC3339)
+	if s.SHA256 != "" {
+		res += ", sha256 " + s.SHA256
+	}
+	return res + ")"
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChangeReport(t *testing.T) {
+	src, err := ioutil.TempFile("", "gossha-upload")
+	must(err, "Could not create source file")
+	defer os.Remove(src.Name())
+	_, err = src.WriteString("contents")
+	must(err, "Could not write source file")
+	must(src.Close(), "Could not close source file")
+
+	r := makeTestResult()
+	startTestServers(r, "test-change-report", 3)
+
+	oldTime := time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+	existing := map[string]string{}
+	i := 0
+	for addr, srv := range r.hosts {
+		// same contents, different contents, no file at all
+		if i < 2 {
+			existing[addr] = []string{"contents", "old contents"}[i]
+			name := filepath.Join(srv.root, "app.conf")
+			must(ioutil.WriteFile(name, []byte(existing[addr]), 0640), "Could not write remote file")
+			must(os.Chmod(name, 0640), "Could not change mode")
+			must(os.Chtimes(name, oldTime, oldTime), "Could not change mtime")
+		}
+		i++
+	}
+
+	runTestRequest(t, r, &ProxyRequest{Action: "scp", Source: src.Name(), Target: "app.conf", ChangeReport: true})
+
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+
+	for addr, reply := range r.replies {
+		if !reply.Success || len(reply.Changes) != 1 {
+			t.Fatalf("Expected one change on %s, got %+v", addr, reply)
+		}
+		c := reply.Changes[0]
+		if c.Target != "app.conf" || c.SHA256 != sum("contents") {
+			t.Fatalf("Unexpected change on %s: %+v", addr, c)
+		}
+
+		prev, ok := existing[addr]
+		switch {
+		case !ok:
+			if c.Change != "created" || c.Previous != nil {
+				t.Fatalf("Expected created file on %s, got %+v", addr, c)
+			}
+			continue
+		case prev == "contents":
+			if c.Change != "unchanged" {
+				t.Fatalf("Expected unchanged file on %s, got %+v", addr, c)
+			}
+		default:
+			if c.Change != "replaced" {
+				t.Fatalf("Expected replaced file on %s, got %+v", addr, c)
+			}
+		}
+
+		want := FileState{SHA256: sum(prev), Size: uint64(len(prev)), Mode: "0640", Mtime: oldTime}
+		if c.Previous == nil || *c.Previous != want {
+			t.Fatalf("Expected previous state %+v on %s, got %+v", want, addr, c.Previous)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// verifyRemoteFile compares SHA-256 of remote file with expected one; remote checksum is
+// computed with sha256sum if it is available, otherwise the file is read back over SFTP
+func verifyRemoteFile(conn *ssh.Client, client *sftpClient, remotePath string, expected string) error {
+	actual, err := remoteChecksum(conn, client, remotePath)
+	if err != nil {
+		return errors.New("Cannot verify " + remotePath + ": " + err.Error())
+	}
+
+	if actual != expected {
+		return fmt.Errorf("Checksum mismatch for %s: expected sha256 %s, got %s", remotePath, expected, actual)
+	}
+
+	return nil
+}
+
+// remoteFileUnchanged reports whether remote regular file exists and has the same contents;
+// checksum is only computed when sizes match
+func remoteFileUnchanged(conn *ssh.Client, client *sftpClient, remotePath string, entry *uploadEntry) (bool, error) {
+	attrs, err := client.Stat(remotePath)
+	if isSftpNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.New("Cannot stat " + remotePath + ": " + err.Error())
+	}
+
+	if attrs.Flags&sshFileXferAttrSize != 0 && attrs.Size != uint64(entry.size) {
+		return false, nil
+	}
+	if attrs.Flags&sshFileXferAttrPermissions != 0 && attrs.Perm&0170000 != 0100000 {
+		return false, nil
+	}
+
+	expected, err := entry.sha256()
+	if err != nil {
+		return false, err
+	}
+
+	actual, err := remoteChecksum(conn, client, remotePath)
+	if err != nil {
+		return false, errors.New("Cannot compute checksum of " + remotePath + ": " + err.Error())
+	}
+
+	return actual == expected, nil
+}
+
+// sha256 returns hex-encoded SHA-256 of entry contents
+func (e *uploadEntry) sha256() (string, error) {
+	e.sumOnce.Do(func() {
+		r, err := e.open()
+		if err != nil {
+			e.sumErr = err
+			return
+		}
+		defer r.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			e.sumErr = errors.New("Cannot read " + e.localPath + " contents: " + err.Error())
+			return
+		}
+		e.sum = hex.EncodeToString(h.Sum(nil))
+	})
+
+	return e.sum, e.sumErr
+}
+
+// remoteChecksum returns SHA-256 of remote file using sha256sum or reading the file back if it fails
+func remoteChecksum(conn *ssh.Client, client *sftpClient, remotePath string) (string, error) {
+	sum, err := remoteSHA256(conn, remotePath)
+	if err != nil {
+		return readBackSHA256(client, remotePath)
+	}
+	return sum, nil
+}
+
+func remoteSHA256(conn *ssh.Client, remotePath string) (string, error) {
+	stdout, _, err := runCmd(conn, "", "sha256sum -- "+shellQuote(remotePath), &cmdOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	// GNU sha256sum prefixes output with "\" if file name contains special characters
+	fields := strings.Fields(stdout)
+	if len(fields) == 0 || len(strings.TrimPrefix(fields[0], "\\")) != sha256.Size*2 {
+		return "", errors.New("Unexpected sha256sum output: " + stdout)
+	}
+
+	return strings.ToLower(strings.TrimPrefix(fields[0], "\\")), nil
+}
+
+func readBackSHA256(client *sftpClient, remotePath string) (string, error) {
+	fp, err := client.Open(remotePath)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fp); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Host circuit breaker: with -daemon and -serve GoSSHa counts consecutive failures of every host
+// to connect or to finish in time across requests. After -circuit-failures of them in a row the
+// circuit of host opens: requests fail on it immediately with "circuit-open" error kind instead
+// of waiting for connection timeouts again. After -circuit-cooldown the next request is run on
+// the host as a probe (half-open circuit), success closes the circuit and failure opens it for
+// another cooldown. Failures of commands themselves (e.g. non-zero exit status) do not count,
+// host is reachable then. Open circuits are listed on GET /circuits of HTTP API.
+
+const (
+	defaultCircuitFailures = 5
+	defaultCircuitCooldown = time.Minute
+)
+
+var (
+	circuitFailures int           // -circuit-failures, 0 disables circuit breaker
+	circuitCooldown time.Duration // -circuit-cooldown
+
+	circuits = &circuitBreaker{hosts: make(map[string]*hostCircuit)}
+)
+
+type (
+	circuitBreaker struct {
+		mu    sync.Mutex
+		hosts map[string]*hostCircuit // hosts that failed at least once since last success
+	}
+
+	hostCircuit struct {
+		failures int       // consecutive failures
+		openedAt time.Time // zero if circuit is closed
+		probing  bool      // request is run on host after cooldown
+		lastErr  string
+	}
+
+	// CircuitInfo describes open circuit of a host in GET /circuits
+	CircuitInfo struct {
+		Hostname  string
+		Failures  int       // consecutive failures
+		OpenedAt  time.Time // last time circuit was opened
+		RetryAt   time.Time // time after which next request probes the host
+		HalfOpen  bool      // probe is running
+		LastError string
+	}
+
+	// circuitOpenError is returned for hosts that are not connected to because their circuit is open
+	circuitOpenError struct {
+		msg string
+	}
+)
+
+func (e *circuitOpenError) Error() string {
+	return e.msg
+}
+
+// circuitBreakerEnabled tells whether failures of hosts are tracked across requests
+func circuitBreakerEnabled() bool {
+	return circuitFailures > 0 && (daemonMode || serveAddr != "")
+}
+
+// circuitFailure tells whether err means that host cannot be reached, so that further requests would likely fail too
+func circuitFailure(err error) bool {
+	switch errorKind(err, "") {
+	case errorKindDNS, errorKindConnectTimeout, errorKindConnect, errorKindTimeout, errorKindDisconnected:
+		return true
+	}
+	return false
+}
+
+// allow tells whether request can be run on hostname, see circuitBreaker for details
+func (b *circuitBreaker) allow(hostname string, now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.hosts[hostname]
+	if c == nil || c.openedAt.IsZero() {
+		return nil
+	}
+
+	retryAt := c.openedAt.Add(circuitCooldown)
+	if c.probing || now.Before(retryAt) {
+		return &circuitOpenError{fmt.Sprintf("Circuit open: host failed %d times in a row, next attempt after %s", c.failures, retryAt.Format(time.RFC3339))}
+	}
+
+	c.probing = true
+	return nil
+}
+
+// record counts result of request on hostname and opens or closes its circuit
+func (b *circuitBreaker) record(hostname string, err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !circuitFailure(err) {
+		if c := b.hosts[hostname]; c != nil && !c.openedAt.IsZero() {
+			logf(logInfo, hostname, "Circuit closed")
+		}
+		delete(b.hosts, hostname)
+		return
+	}
+
+	c := b.hosts[hostname]
+	if c == nil {
+		c = &hostCircuit{}
+		b.hosts[hostname] = c
+	}
+	c.failures++
+	c.probing = false
+	if c.failures >= circuitFailures {
+		if c.openedAt.IsZero() {
+			logf(logInfo, hostname, "Circuit opened after %d failures: %s", c.failures, err)
+		}
+		c.openedAt = now
+	}
+	c.lastErr = err.Error()
+}
+
+// List returns open circuits sorted by hostname
+func (b *circuitBreaker) List() []CircuitInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	res := make([]CircuitInfo, 0)
+	for h, c := range b.hosts {
+		if c.openedAt.IsZero() {
+			continue
+		}
+		res = append(res, CircuitInfo{
+			Hostname:  h,
+			Failures:  c.failures,
+			OpenedAt:  c.openedAt,
+			RetryAt:   c.openedAt.Add(circuitCooldown),
+			HalfOpen:  c.probing,
+			LastError: c.lastErr,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Hostname < res[j].Hostname })
+	return res
+}
+
+// withCircuitBreaker fails execFunc immediately on hosts with open circuit and records results of other hosts
+func withCircuitBreaker(execFunc func(string) *SshResult) func(string) *SshResult {
+	if !circuitBreakerEnabled() || dryRun {
+		return execFunc
+	}
+
+	return func(hostname string) *SshResult {
+		if err := circuits.allow(hostname, time.Now()); err != nil {
+			return &SshResult{hostname: hostname, err: err}
+		}
+
+		res := execFunc(hostname)
+		circuits.record(hostname, res.err, time.Now())
+		return res
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	oldCircuits, oldFailures, oldCooldown := circuits, circuitFailures, circuitCooldown
+	defer func() {
+		circuits, circuitFailures, circuitCooldown, daemonMode = oldCircuits, oldFailures, oldCooldown, false
+	}()
+	circuits = &circuitBreaker{hosts: make(map[string]*hostCircuit)}
+	circuitFailures, circuitCooldown, daemonMode = 2, 50*time.Millisecond, true
+
+	var (
+		calls  int
+		result error
+	)
+	execFunc := withCircuitBreaker(func(hostname string) *SshResult {
+		calls++
+		return &SshResult{hostname: hostname, err: result}
+	})
+
+	run := func(expectedKind string, expectedCalls int) {
+		t.Helper()
+		calls = 0
+		if kind := errorKind(execFunc("host").err, "ssh"); kind != expectedKind {
+			t.Fatalf("Unexpected error kind %q, expected %q", kind, expectedKind)
+		}
+		if calls != expectedCalls {
+			t.Fatalf("Action was run %d times, expected %d", calls, expectedCalls)
+		}
+	}
+
+	result = &hostTimeoutError{"Timed out after 1s"}
+	run(errorKindTimeout, 1)
+	result = errors.New("Process exited with status 1")
+	run(errorKindOther, 1) // host is reachable, failures are counted again
+	result = &hostTimeoutError{"Timed out after 1s"}
+	run(errorKindTimeout, 1)
+	run(errorKindTimeout, 1)
+	run(errorKindCircuitOpen, 0)
+
+	if list := circuits.List(); len(list) != 1 || list[0].Hostname != "host" || list[0].Failures != 2 {
+		t.Fatalf("Unexpected open circuits: %+v", list)
+	}
+
+	time.Sleep(circuitCooldown)
+	run(errorKindTimeout, 1) // probe fails, circuit is opened again
+	run(errorKindCircuitOpen, 0)
+
+	time.Sleep(circuitCooldown)
+	result = nil
+	run("", 1)
+	run("", 1)
+	if list := circuits.List(); len(list) != 0 {
+		t.Fatalf("Circuit is not closed: %+v", list)
+	}
+}
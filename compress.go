@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Compressed uploads ("Compress": true or -C): contents of files are gzipped on the fly and unpacked
+// by gzip on remote side, so that text files (configs, scripts) take a fraction of time to transfer
+// over slow links. SSH-level compression is not available (x/crypto/ssh does not implement zlib), so
+// files are streamed over a separate session instead of SFTP. Hosts without gzip get files over SFTP
+// as usual. Throughput limits apply to compressed bytes, progress is reported in bytes of files.
+
+const (
+	compressMinSize = 4 << 10 // smaller files are not worth a session
+	noGzipStatus    = 127     // exit status of remote script if gzip is not available
+)
+
+var compressUploads bool // -C
+
+var errNoGzip = errors.New("gzip is not available on remote host")
+
+// compressedWriter is stdin of remote gzip, writes of compressed data are throttled
+type compressedWriter struct {
+	w        io.Writer
+	limiters []*rateLimiter
+}
+
+func (c *compressedWriter) Write(p []byte) (int, error) {
+	for _, l := range c.limiters {
+		l.wait(len(p))
+	}
+	n, err := c.w.Write(p)
+	metricUploadedBytes.add(float64(n))
+	return n, err
+}
+
+// writeRemoteFileCompressed creates remote file with contents of entry that are decompressed by gzip
+// on remote side, errNoGzip is returned if it is not available there
+func writeRemoteFileCompressed(conn *ssh.Client, client *sftpClient, target string, entry *uploadEntry, attrs *sftpAttrs, progress *transferProgress, limiters []*rateLimiter) (err error) {
+	// file is created over SFTP, so that it gets the same permissions as uncompressed uploads
+	fp, err := client.Create(target, attrs)
+	if err != nil {
+		return errors.New("Cannot create " + target + ": " + err.Error())
+	}
+	if err = fp.Close(); err != nil {
+		return errors.New("Cannot create " + target + ": " + err.Error())
+	}
+
+	r, err := entry.open()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return &retryableError{err}
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return errors.New("Cannot open stdin of gzip: " + err.Error())
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	script := fmt.Sprintf("command -v gzip >/dev/null 2>&1 || exit %d; exec gzip -dc > %s", noGzipStatus, shellQuote(target))
+	if err = session.Start("/bin/sh -c " + shellQuote(script)); err != nil {
+		return errors.New("Cannot start gzip: " + err.Error())
+	}
+
+	zw := gzip.NewWriter(&compressedWriter{w: stdin, limiters: limiters})
+	buf := make([]byte, chunkSize)
+	var written int64
+	var readErr, writeErr error
+	for writeErr == nil {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, writeErr = zw.Write(buf[:n]); writeErr != nil {
+				break
+			}
+			progress.add(n)
+			written += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			writeErr = zw.Close()
+			break
+		} else if err != nil {
+			readErr = errors.New("Cannot read " + entry.localPath + " contents: " + err.Error())
+			break
+		}
+	}
+	stdin.Close()
+	waitErr := session.Wait()
+
+	var exitErr *ssh.ExitError
+	if errors.As(waitErr, &exitErr) && exitErr.ExitStatus() == noGzipStatus {
+		progress.add(-int(written)) // file is uploaded again
+		return errNoGzip
+	}
+	if readErr != nil {
+		return readErr
+	}
+	if waitErr != nil {
+		return errors.New("Cannot decompress " + target + ": " + strings.TrimSpace(waitErr.Error()+" "+stderr.String()))
+	}
+	if writeErr != nil {
+		return errors.New("Cannot upload " + target + ": " + writeErr.Error())
+	}
+
+	if written != entry.size {
+		return fmt.Errorf("Size of %s changed during upload: expected %d bytes, read %d", entry.localPath, entry.size, written)
+	}
+
+	if attrs.Flags != 0 {
+		if err = client.Setstat(target, attrs); err != nil {
+			return errors.New("Cannot set attributes of " + target + ": " + err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressedUpload(t *testing.T) {
+	contents := bytes.Repeat([]byte("listen 80;\nserver_name example.com;\n"), 1000)
+
+	r := makeTestResult()
+	startTestServers(r, "test-compress", 2)
+	runTestRequest(t, r, &ProxyRequest{Action: "scp", Source: dataSource, Data: contents, Target: "nginx.conf", Mode: "0640", Compress: true, Verify: true})
+
+	for addr, srv := range r.hosts {
+		name := filepath.Join(srv.root, "nginx.conf")
+		if got, err := ioutil.ReadFile(name); err != nil || !bytes.Equal(got, contents) {
+			t.Fatalf("Unexpected contents on %s: %d bytes, %v", addr, len(got), err)
+		}
+		if fi, err := os.Stat(name); err != nil || fi.Mode().Perm() != 0640 {
+			t.Fatalf("Unexpected mode on %s: %v, %v", addr, fi.Mode(), err)
+		}
+	}
+
+	// without gzip on remote side file is uploaded over SFTP
+	emptyDir, err := ioutil.TempDir("", "gossha-no-gzip")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(emptyDir)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", emptyDir)
+
+	contents = append(contents, "# updated\n"...)
+	r = makeTestResult()
+	startTestServers(r, "test-compress-fallback", 1)
+	runTestRequest(t, r, &ProxyRequest{Action: "scp", Source: dataSource, Data: contents, Target: "nginx.conf", Compress: true})
+
+	for addr, srv := range r.hosts {
+		if got, err := ioutil.ReadFile(filepath.Join(srv.root, "nginx.conf")); err != nil || !bytes.Equal(got, contents) {
+			t.Fatalf("Unexpected contents on %s without gzip: %d bytes, %v", addr, len(got), err)
+		}
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+	"strings"
+)
+
+// Configuration file (~/.gossha.yml, ~/.gossha.toml or -config <file>) contains defaults for
+// command-line flags, identity files and host groups:
+//
+//	user: deploy
+//	concurrency: 50
+//	timeout: 1m
+//	identity_files: [~/.ssh/deploy_key]
+//	groups:
+//	  web: ["web[1-10].example.com"]
+//
+// Flags that are specified on the command line take precedence over the file.
+
+// configFlags maps configuration options to flags they set
+var configFlags = map[string]string{
+	"user":                "l",
+	"concurrency":         "m",
+	"agent_connections":   "c",
+	"disconnect":          "d",
+	"timeout":             "timeout",
+	"max_run_time":        "max-run-time",
+	"max_open_files":      "max-open-files",
+	"remote_timeout":      "remote-timeout",
+	"jump_hosts":          "J",
+	"jump_connections":    "jump-connections",
+	"idle_timeout":        "idle-timeout",
+	"proxy":               "proxy",
+	"inventory":           "inventory",
+	"certificates":        "cert",
+	"keepalive":           "keepalive",
+	"keepalive_count":     "keepalive-count",
+	"forward_agent":       "A",
+	"forward_x11":         "X",
+	"agent_key":           "agent-key",
+	"no_agent":            "no-agent",
+	"auth":                "auth",
+	"auth_command":        "auth-command",
+	"agent_prefetch":      "agent-prefetch",
+	"kbd_interactive":     "kbd-interactive",
+	"gssapi":              "gssapi",
+	"host_keys":           "host-keys",
+	"accept_changed":      "accept-changed",
+	"host_key_file":       "host-key-file",
+	"share_answers":       "share-answers",
+	"output":              "output",
+	"sort":                "sort",
+	"spill_dir":           "spill-dir",
+	"transfer":            "transfer",
+	"verbose":             "v",
+	"debug":               "vv",
+	"quiet":               "q",
+	"bwlimit":             "bwlimit",
+	"ipv4":                "4",
+	"ciphers":             "ciphers",
+	"kex_algorithms":      "kex",
+	"macs":                "macs",
+	"host_key_algorithms": "hostkey-algorithms",
+	"ipv6":                "6",
+	"connect_rate":        "connect-rate",
+	"inplace":             "inplace",
+	"resume":              "resume",
+	"delta":               "delta",
+	"compress":            "C",
+	"host_parallel":       "host-parallel",
+	"audit_log":           "audit-log",
+	"record":              "record",
+	"failed_hosts":        "failed-hosts",
+	"latency_file":        "latency-file",
+	"health":              "health",
+	"history":             "history",
+	"canary":              "canary",
+	"rerun_on_disconnect": "rerun-on-disconnect",
+	"shell":               "shell",
+	"no_shell":            "no-shell",
+	"chdir":               "chdir",
+	"no_cache":            "no-cache",
+	"no_run_env":          "no-run-env",
+	"max_output_bytes":    "max-output-bytes",
+	"summary_only":        "summary-only",
+	"summary_lines":       "summary-lines",
+	"pre_resolve":         "pre-resolve",
+	"resolve":             "resolve",
+	"hosts_file":          "hosts-file",
+	"dns":                 "dns",
+	"probe":               "probe",
+	"discover":            "discover",
+	"k8s_nodes":           "k8s-nodes",
+	"k8s_selector":        "k8s-selector",
+	"kubeconfig":          "kubeconfig",
+	"only_if":             "only-if",
+	"splay":               "splay",
+	"snapshot":            "snapshot",
+	"snapshot_dir":        "snapshot-dir",
+	"then":                "then",
+	"on_fail":             "on-fail",
+	"remote_encoding":     "remote-encoding",
+	"strip_ansi":          "strip-ansi",
+	"filter":              "filter",
+	"filter_remote":       "filter-remote",
+	"exclude":             "exclude",
+	"limit":               "limit",
+	"run_as":              "run-as",
+	"run_as_method":       "run-as-method",
+	"sudo_password":       "sudo-password",
+	"guard":               "guard",
+	"guard_hosts":         "guard-hosts",
+	"yes":                 "yes",
+	"diff":                "diff",
+	"expect":              "expect",
+	"notify":              "notify",
+	"timing":              "timing",
+	"notify_failures":     "notify-failures",
+	"ship":                "ship",
+	"hook_before_run":     "hook-before-run",
+	"hook_after_run":      "hook-after-run",
+	"hook_before_host":    "hook-before-host",
+	"hook_after_host":     "hook-after-host",
+	"hook_timeout":        "hook-timeout",
+	"pipe_results":        "pipe-results",
+	"password_file":       "password-file",
+	"password_cmd":        "password-cmd",
+	"passphrase_cmd":      "passphrase-cmd",
+	"vault_role":          "vault-role",
+	"vault_mount":         "vault-mount",
+	"ask_password":        "ask-password",
+	"cache_credentials":   "cache-credentials",
+	"credential_store":    "credential-store",
+	"serve_token":         "serve-token",
+	"policy":              "policy",
+	"oidc_issuer":         "oidc-issuer",
+	"oidc_audience":       "oidc-audience",
+	"oidc_claim":          "oidc-claim",
+	"control":             "control",
+	"circuit_failures":    "circuit-failures",
+	"circuit_cooldown":    "circuit-cooldown",
+}
+
+// gosshaConfig is configuration that cannot be expressed with flags
+type gosshaConfig struct {
+	identityFiles []string
+	groups        map[string][]string
+	groupNames    []string                     // group names in file order
+	passwords     map[string]string            // password sources of groups
+	hostPatterns  []string                     // host patterns of "hosts" section in file order
+	hostVars      map[string]map[string]string // inventory variables set by "hosts" section
+	stages        map[string][]string          // sequences of groups of "stages" section
+	guardPatterns []string                     // dangerous command patterns of "guard_patterns" section
+	sessions      map[string]*sessionConfig    // setup and teardown commands of "sessions" section
+	schedules     map[string]*ProxyRequest     // jobs of "schedules" section
+	scheduleNames []string                     // names of schedules in file order
+}
+
+var defaultConfigFiles = []string{".gossha.yml", ".gossha.yaml", ".gossha.toml"}
+
+// findConfigFile returns configuration file from home directory, if any
+func findConfigFile() string {
+	for _, name := range defaultConfigFiles {
+		filename := filepath.Join(homeDir(), name)
+		if _, err := os.Stat(filename); err == nil {
+			return filename
+		}
+	}
+	return ""
+}
+
+// loadConfig reads configuration file and sets flags that were not specified on the command line
+func loadConfig(filename string) (*gosshaConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.New("Cannot read config: " + err.Error())
+	}
+
+	var doc interface{}
+	if filepath.Ext(filename) == ".toml" {
+		doc, err = parseToml(data)
+	} else {
+		doc, err = parseYaml(data)
+	}
+	if err != nil {
+		return nil, errors.New("Cannot parse config " + filename + ": " + err.Error())
+	}
+
+	conf, err := applyConfig(doc)
+	if err != nil {
+		return nil, errors.New("Invalid config " + filename + ": " + err.Error())
+	}
+
+	return conf, nil
+}
+
+func applyConfig(doc interface{}) (*gosshaConfig, error) {
+	conf := &gosshaConfig{groups: make(map[string][]string), hostVars: make(map[string]map[string]string)}
+	if doc == nil {
+		return conf, nil
+	}
+
+	top, ok := doc.(*yamlMap)
+	if !ok {
+		return nil, errors.New("config must be a mapping")
+	}
+
+	for _, key := range top.Keys() {
+		value := top.Get(key)
+
+		switch key {
+		case "identity_files":
+			files, err := configStrings(key, value)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range files {
+				conf.identityFiles = append(conf.identityFiles, expandHome(strings.TrimSuffix(f, ".pub")))
+			}
+		case "guard_patterns":
+			patterns, err := configStrings(key, value)
+			if err != nil {
+				return nil, err
+			}
+			conf.guardPatterns = append([]string{}, patterns...)
+		case "groups":
+			groups, ok := value.(*yamlMap)
+			if !ok {
+				return nil, errors.New("groups must be a mapping of group names to hosts")
+			}
+			for _, name := range groups.Keys() {
+				hosts, err := configStrings("group "+name, groups.Get(name))
+				if err != nil {
+					return nil, err
+				}
+				conf.groupNames = append(conf.groupNames, name)
+				conf.groups[name] = hosts
+			}
+		case "stages":
+			stages, ok := value.(*yamlMap)
+			if !ok {
+				return nil, errors.New("stages must be a mapping of names to lists of groups")
+			}
+			conf.stages = make(map[string][]string)
+			for _, name := range stages.Keys() {
+				groups, err := configStrings("stages "+name, stages.Get(name))
+				if err != nil {
+					return nil, err
+				}
+				conf.stages[name] = groups
+			}
+		case "sessions":
+			sessions, err := parseConfigSessions(value)
+			if err != nil {
+				return nil, err
+			}
+			conf.sessions = sessions
+		case "schedules":
+			jobs, names, err := parseConfigSchedules(value)
+			if err != nil {
+				return nil, err
+			}
+			conf.schedules, conf.scheduleNames = jobs, names
+		case "passwords":
+			passwords, ok := value.(*yamlMap)
+			if !ok {
+				return nil, errors.New("passwords must be a mapping of group names to password sources")
+			}
+			conf.passwords = make(map[string]string)
+			for _, name := range passwords.Keys() {
+				source, ok := passwords.Get(name).(string)
+				if !ok {
+					return nil, errors.New("password source of group " + name + " must be a string")
+				}
+				conf.passwords[name] = source
+			}
+		case "hosts":
+			hosts, ok := value.(*yamlMap)
+			if !ok {
+				return nil, errors.New("hosts must be a mapping of host patterns to options")
+			}
+			for _, pattern := range hosts.Keys() {
+				vars, err := configHostVars(pattern, hosts.Get(pattern))
+				if err != nil {
+					return nil, err
+				}
+				conf.hostPatterns = append(conf.hostPatterns, pattern)
+				conf.hostVars[pattern] = vars
+			}
+		default:
+			name, ok := configFlags[key]
+			if !ok {
+				return nil, errors.New("unknown option " + key)
+			}
+
+			values, err := configStrings(key, value)
+			if err != nil {
+				return nil, err
+			}
+
+			if isFlagSet(name) {
+				continue
+			}
+
+			if err := flag.Set(name, strings.Join(values, ",")); err != nil {
+				return nil, fmt.Errorf("invalid value of %s: %s", key, err)
+			}
+		}
+	}
+
+	return conf, nil
+}
+
+// configStrings converts scalar or sequence of scalars into list of strings
+func configStrings(key string, value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		var res []string
+		for _, el := range v {
+			s, ok := el.(string)
+			if !ok {
+				return nil, errors.New(key + " must be a list of strings")
+			}
+			res = append(res, s)
+		}
+		return res, nil
+	}
+	return nil, errors.New(key + " must be a string or a list of strings")
+}
+
+// homeDir returns home directory of user ($HOME on unix, %USERPROFILE% on Windows)
+func homeDir() string {
+	if dir, err := os.UserHomeDir(); err == nil {
+		return dir
+	}
+	if u, err := osuser.Current(); err == nil {
+		return u.HomeDir
+	}
+	return ""
+}
+
+// defaultLoginName returns login name for hosts: $LOGNAME if it is set (as on unix), local user otherwise
+func defaultLoginName() string {
+	if name := os.Getenv("LOGNAME"); name != "" {
+		return name
+	}
+	return localUser()
+}
+
+// expandHome replaces leading "~/" (or "~\" on Windows) of path with home directory
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		return filepath.Join(homeDir(), path[1:])
+	}
+	return path
+}
+
+// configHostVars converts options of host pattern from "hosts" section to inventory variables
+func configHostVars(pattern string, value interface{}) (map[string]string, error) {
+	options, ok := value.(*yamlMap)
+	if !ok {
+		return nil, errors.New("options of host " + pattern + " must be a mapping")
+	}
+
+	vars := make(map[string]string)
+	for _, key := range options.Keys() {
+		if key == "tags" {
+			tags, ok := options.Get(key).(*yamlMap)
+			if !ok {
+				return nil, errors.New("tags of host " + pattern + " must be a mapping of names to values")
+			}
+			for _, name := range tags.Keys() {
+				v, ok := tags.Get(name).(string)
+				if !ok {
+					return nil, errors.New("tag " + name + " of host " + pattern + " must be a string")
+				}
+				vars[tagVarPrefix+name] = v
+			}
+			continue
+		}
+
+		name, ok := hostOptionVars[key]
+		if !ok {
+			return nil, errors.New("unknown option " + key + " of host " + pattern)
+		}
+		v, ok := options.Get(key).(string)
+		if !ok {
+			return nil, errors.New("option " + key + " of host " + pattern + " must be a string")
+		}
+		if key == "identity_file" {
+			v = expandHome(strings.TrimSuffix(v, ".pub"))
+		}
+		vars[name] = v
+	}
+
+	if _, err := parseHostOptions(vars); err != nil {
+		return nil, errors.New("invalid options of host " + pattern + ": " + err.Error())
+	}
+	return vars, nil
+}
+
+// addConfigGroups adds host groups and per-host options from configuration to inventory,
+// options of "hosts" section override inventory variables
+func addConfigGroups(inv *inventory, conf *gosshaConfig) error {
+	for _, name := range conf.groupNames {
+		for _, h := range conf.groups[name] {
+			if err := inv.addHost(name, h, nil); err != nil {
+				return errors.New("Invalid group " + name + " in config: " + err.Error())
+			}
+		}
+	}
+	for _, pattern := range conf.hostPatterns {
+		if err := inv.addHost("all", pattern, conf.hostVars[pattern]); err != nil {
+			return errors.New("Invalid host " + pattern + " in config: " + err.Error())
+		}
+	}
+	inv.resolveVars()
+	return nil
+}
+
+// parseToml parses the subset of TOML needed for configuration: key/value pairs with strings,
+// numbers, booleans and arrays of them, [groups] table, [hosts."<pattern>"] and [sessions.<name>] tables. Result has the same form as parseYaml one.
+func parseToml(data []byte) (interface{}, error) {
+	top := newYamlMap()
+	cur := top
+
+	for i, ln := range strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n") {
+		ln = strings.TrimSpace(stripYamlComment(ln))
+		if ln == "" {
+			continue
+		}
+
+		if strings.HasPrefix(ln, "[") && strings.HasSuffix(ln, "]") {
+			name := strings.TrimSpace(ln[1 : len(ln)-1])
+			cur = newYamlMap()
+			if idx := strings.Index(name, "."); idx > 0 && (name[:idx] == "hosts" || name[:idx] == "sessions") {
+				// [hosts."web[1-2].example.com"] table sets options of a single host pattern, [sessions.app] of a single session
+				section, ok := top.Get(name[:idx]).(*yamlMap)
+				if !ok {
+					section = newYamlMap()
+					top.set(name[:idx], section)
+				}
+				section.set(strings.Trim(name[idx+1:], `"`), cur)
+				continue
+			}
+			if name == "" || strings.ContainsAny(name, "[]") {
+				return nil, fmt.Errorf("toml: line %d: invalid table name", i+1)
+			}
+			top.set(name, cur)
+			continue
+		}
+
+		idx := strings.Index(ln, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("toml: line %d: expected key = value", i+1)
+		}
+
+		key := strings.Trim(strings.TrimSpace(ln[:idx]), `"`)
+		value, rest, err := parseTomlValue(strings.TrimSpace(ln[idx+1:]))
+		if err == nil && strings.TrimSpace(rest) != "" {
+			err = errors.New("unexpected " + rest)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("toml: line %d: %s", i+1, err)
+		}
+
+		cur.set(key, value)
+	}
+
+	return top, nil
+}
+
+// parseTomlValue parses value of key, inline tables ({ key = value, ... }) are converted to mappings
+func parseTomlValue(s string) (v interface{}, rest string, err error) {
+	if !strings.HasPrefix(s, "{") {
+		return parseYamlFlow(s)
+	}
+
+	m := newYamlMap()
+	s = strings.TrimSpace(s[1:])
+	for !strings.HasPrefix(s, "}") {
+		idx := strings.Index(s, "=")
+		if idx <= 0 {
+			return nil, "", errors.New("expected key = value in inline table")
+		}
+
+		value, rest, err := parseTomlValue(strings.TrimSpace(s[idx+1:]))
+		if err != nil {
+			return nil, "", err
+		}
+		m.set(strings.Trim(strings.TrimSpace(s[:idx]), `"`), value)
+
+		if s = strings.TrimSpace(rest); strings.HasPrefix(s, ",") {
+			s = strings.TrimSpace(s[1:])
+		} else if !strings.HasPrefix(s, "}") {
+			return nil, "", errors.New("unterminated inline table")
+		}
+	}
+	return m, s[1:], nil
+}
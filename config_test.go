@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	oldTimeout := requestTimeout
+	defer func() { requestTimeout = oldTimeout }()
+
+	dir, err := ioutil.TempDir("", "gossha-config")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	yamlConfig := "timeout: 1m # comment\nidentity_files:\n  - ~/.ssh/deploy.pub\ngroups:\n  web: [\"web[1-2]\", lb]\npasswords:\n  web: env:WEB_PASSWORD\n"
+	tomlConfig := "timeout = \"1m\" # comment\nidentity_files = [\"~/.ssh/deploy.pub\"]\n\n[groups]\nweb = [\"web[1-2]\", \"lb\"]\n\n[passwords]\nweb = \"env:WEB_PASSWORD\"\n"
+
+	yamlDoc, err := parseYaml([]byte(yamlConfig))
+	must(err, "Could not parse yaml config")
+	tomlDoc, err := parseToml([]byte(tomlConfig))
+	if err != nil {
+		t.Fatalf("Could not parse toml config: %s", err)
+	}
+	if !reflect.DeepEqual(yamlToPlain(yamlDoc), yamlToPlain(tomlDoc)) {
+		t.Fatalf("TOML config differs from YAML one: %#v", yamlToPlain(tomlDoc))
+	}
+
+	filename := filepath.Join(dir, "gossha.yml")
+	must(ioutil.WriteFile(filename, []byte(yamlConfig), 0600), "Could not write config")
+
+	conf, err := loadConfig(filename)
+	if err != nil {
+		t.Fatalf("Could not load config: %s", err)
+	}
+
+	if requestTimeout != time.Minute {
+		t.Fatalf("Timeout from config was not applied: %s", requestTimeout)
+	}
+
+	if expected := []string{os.Getenv("HOME") + "/.ssh/deploy"}; !reflect.DeepEqual(conf.identityFiles, expected) {
+		t.Fatalf("Unexpected identity files: %v", conf.identityFiles)
+	}
+
+	if conf.passwords["web"] != "env:WEB_PASSWORD" {
+		t.Fatalf("Unexpected password sources: %v", conf.passwords)
+	}
+
+	inv := newInventory()
+	must(addConfigGroups(inv, conf), "Could not add groups")
+	if hosts, _ := inv.GroupHosts("web"); !reflect.DeepEqual(hosts, []string{"web1", "web2", "lb"}) {
+		t.Fatalf("Unexpected hosts of group: %v", hosts)
+	}
+
+	filename = filepath.Join(dir, "bad.yml")
+	must(ioutil.WriteFile(filename, []byte("colour: red\n"), 0600), "Could not write config")
+	if _, err := loadConfig(filename); err == nil || !strings.Contains(err.Error(), "unknown option colour") {
+		t.Fatalf("Expected unknown option error, got %v", err)
+	}
+}
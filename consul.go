@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// Service discovery host sources:
+//
+//	consul://<service>?tag=<tag>&dc=<datacenter>&all=1   nodes of Consul service (only passing ones unless all=1)
+//	etcd:///<key-prefix>                                 values (or last path elements of keys if values are empty) under etcd v3 prefix
+
+type (
+	consulServiceEntry struct {
+		Node struct {
+			Node    string
+			Address string
+		}
+		Service struct {
+			Address string
+		}
+	}
+
+	etcdRangeResponse struct {
+		Kvs []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+)
+
+// apiBaseURL returns base URL for HTTP API from environment variable that may contain only host:port
+func apiBaseURL(env, defaultAddr string) string {
+	addr := os.Getenv(env)
+	if addr == "" {
+		addr = defaultAddr
+	}
+
+	if idx := strings.Index(addr, ","); idx >= 0 {
+		addr = addr[:idx]
+	}
+
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	return strings.TrimRight(addr, "/")
+}
+
+func consulHosts(u *url.URL) ([]string, error) {
+	if u.Host == "" {
+		return nil, errors.New("service name is not specified")
+	}
+
+	params := url.Values{}
+	if u.Query().Get("all") == "" {
+		params.Set("passing", "true")
+	}
+	for _, p := range []string{"tag", "dc"} {
+		if v := u.Query().Get(p); v != "" {
+			params.Set(p, v)
+		}
+	}
+
+	req, err := http.NewRequest("GET", apiBaseURL("CONSUL_HTTP_ADDR", "127.0.0.1:8500")+"/v1/health/service/"+url.PathEscape(u.Host)+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	var entries []consulServiceEntry
+	if err := doJSONRequest(req, &entries); err != nil {
+		return nil, err
+	}
+
+	var hosts []string
+	for _, e := range entries {
+		if e.Service.Address != "" {
+			hosts = append(hosts, e.Service.Address)
+		} else if e.Node.Address != "" {
+			hosts = append(hosts, e.Node.Address)
+		}
+	}
+
+	return hosts, nil
+}
+
+// etcdPrefixEnd returns end of the range that contains all keys with the specified prefix
+func etcdPrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\x00" // prefix consists of 0xff bytes only, range to the end of keyspace
+}
+
+func etcdHosts(u *url.URL) ([]string, error) {
+	prefix := u.Host + u.Path
+	if prefix == "" {
+		return nil, errors.New("key prefix is not specified")
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(prefix)),
+		"range_end": base64.StdEncoding.EncodeToString([]byte(etcdPrefixEnd(prefix))),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", apiBaseURL("ETCDCTL_ENDPOINTS", "127.0.0.1:2379")+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var resp etcdRangeResponse
+	if err := doJSONRequest(req, &resp); err != nil {
+		return nil, err
+	}
+
+	var hosts []string
+	for _, kv := range resp.Kvs {
+		key, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil {
+			return nil, errors.New("Cannot decode etcd key: " + err.Error())
+		}
+
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, errors.New("Cannot decode etcd value: " + err.Error())
+		}
+
+		if host := strings.TrimSpace(string(value)); host != "" {
+			hosts = append(hosts, host)
+		} else {
+			hosts = append(hosts, path.Base(string(key)))
+		}
+	}
+
+	return hosts, nil
+}
+
+// doJSONRequest performs HTTP API request and decodes JSON response into res
+func doJSONRequest(req *http.Request, res interface{}) error {
+	resp, err := httpAPIClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(req.URL.Host + " returned " + resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return errors.New("Cannot parse response of " + req.URL.Host + ": " + err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestServiceDiscovery(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/health/service/web":
+			if r.URL.Query().Get("passing") != "true" || r.Header.Get("X-Consul-Token") != "token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, `[{"Node":{"Node":"n1","Address":"10.0.0.1"},"Service":{"Address":""}},
+				{"Node":{"Node":"n2","Address":"10.0.0.2"},"Service":{"Address":"10.1.0.2"}}]`)
+		case "/v3/kv/range":
+			var req map[string]string
+			json.NewDecoder(r.Body).Decode(&req)
+			if req["key"] != b64([]byte("/hosts/")) || req["range_end"] != b64([]byte("/hosts0")) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, `{"kvs":[{"key":"%s","value":"%s"},{"key":"%s","value":""}]}`,
+				b64([]byte("/hosts/a")), b64([]byte("db1:2222")), b64([]byte("/hosts/db2")))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	for k, v := range map[string]string{"CONSUL_HTTP_ADDR": srv.URL, "CONSUL_HTTP_TOKEN": "token", "ETCDCTL_ENDPOINTS": srv.URL + ",http://127.0.0.1:1"} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	hosts, err := discoverHosts([]string{"consul://web", "etcd:///hosts/"})
+	if err != nil {
+		t.Fatalf("Could not discover hosts: %s", err)
+	}
+
+	if expected := []string{"10.0.0.1", "10.1.0.2", "db1:2222", "db2"}; !reflect.DeepEqual(hosts, expected) {
+		t.Fatalf("Unexpected discovered hosts: %v", hosts)
+	}
+
+	if _, err := discoverHosts([]string{"consul://unknown"}); err == nil {
+		t.Fatalf("Expected error for unknown service")
+	}
+}
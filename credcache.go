@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Credential cache (-cache-credentials <ttl>, e.g. -cache-credentials 8h): passwords that are asked
+// for (-ask-password and "prompt" sources of "passwords") and passphrases of keys are remembered for
+// that time, so that a long maintenance session asks for them once rather than on every run of
+// gossha. They are kept in the OS keychain when there is one ("security" on macOS, "secret-tool" of
+// libsecret elsewhere), or in ~/.gossha_credentials encrypted with a random key, which is kept in
+// $XDG_RUNTIME_DIR (removed at logout). Without it the file is not used at all: a key next to the
+// file would be copied and read along with it, e.g. from backups of home directory. -credential-store
+// keychain or file chooses the store. Passphrases that do not decrypt keys are forgotten, and
+// "gossha forget" removes everything that is cached.
+
+const (
+	credentialService = "gossha" // service of keychain items
+	credentialKeySize = 32
+)
+
+var (
+	credentialTTL   time.Duration // -cache-credentials, 0 disables the cache
+	credentialStore string        // -credential-store
+
+	credentials credentialBackend // nil if credentials are not cached
+)
+
+// credentialBackend stores entries (JSON of credentialEntry) by name
+type credentialBackend interface {
+	get(name string) (string, error) // empty if there is no entry
+	set(name, entry string) error
+	remove(name string) error
+	clear() error
+}
+
+// credentialEntry is cached secret with its expiration time
+type credentialEntry struct {
+	Secret  string
+	Expires time.Time
+}
+
+// initCredentials opens store of -credential-store if credentials are cached
+func initCredentials() (err error) {
+	credentials = nil
+	if credentialTTL <= 0 {
+		return nil
+	}
+	credentials, err = openCredentialBackend(credentialStore)
+	return err
+}
+
+// openCredentialBackend returns store by name: keychain, file, or "auto" (and empty) for keychain if there is one
+func openCredentialBackend(name string) (credentialBackend, error) {
+	keychain := newKeychainBackend()
+	switch name {
+	case "", "auto":
+		if keychain != nil {
+			return keychain, nil
+		}
+		return newDefaultFileCredentials()
+	case "keychain":
+		if keychain == nil {
+			return nil, errors.New("No OS keychain found for -credential-store keychain (need security or secret-tool)")
+		}
+		return keychain, nil
+	case "file":
+		return newDefaultFileCredentials()
+	}
+	return nil, errors.New("Invalid -credential-store " + name + ", expected auto, keychain or file")
+}
+
+// cachedSecret returns secret name from the cache, or the one returned by ask, which is cached then
+func cachedSecret(name string, ask func() (string, error)) (string, error) {
+	if credentials == nil {
+		return ask()
+	}
+
+	data, err := credentials.get(name)
+	if err != nil {
+		logf(logInfo, "", "Cannot read cached credential: %s", err)
+	} else if data != "" {
+		var e credentialEntry
+		if json.Unmarshal([]byte(data), &e) == nil && time.Now().Before(e.Expires) && e.Secret != "" {
+			return e.Secret, nil
+		}
+		credentials.remove(name)
+	}
+
+	secret, err := ask()
+	if err != nil {
+		return "", err
+	}
+	entry, _ := json.Marshal(&credentialEntry{Secret: secret, Expires: time.Now().Add(credentialTTL)})
+	if err := credentials.set(name, string(entry)); err != nil {
+		reportErrorToUser("Cannot cache credential: " + err.Error())
+	}
+	return secret, nil
+}
+
+// forgetSecret removes secret name from the cache, e.g. because it turned out to be wrong
+func forgetSecret(name string) {
+	if credentials != nil {
+		credentials.remove(name)
+	}
+}
+
+func defaultCredentialFile() string {
+	return filepath.Join(homeDir(), ".gossha_credentials")
+}
+
+// defaultCredentialKeyFile returns path of the key in $XDG_RUNTIME_DIR, empty if it is not set
+func defaultCredentialKeyFile() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "gossha_credentials.key")
+	}
+	return ""
+}
+
+// newDefaultFileCredentials returns the file store, it fails if there is no place for the key apart from the file
+func newDefaultFileCredentials() (*fileCredentials, error) {
+	keyPath := defaultCredentialKeyFile()
+	if keyPath == "" {
+		return nil, errors.New("Cannot cache credentials in a file: XDG_RUNTIME_DIR is not set and the key cannot be kept next to the file, use -credential-store keychain")
+	}
+	return newFileCredentials(defaultCredentialFile(), keyPath), nil
+}
+
+// fileCredentials keeps entries in a file encrypted with secretbox
+type fileCredentials struct {
+	mu            sync.Mutex // passphrases of keys can be asked for in parallel
+	path, keyPath string
+}
+
+func newFileCredentials(path, keyPath string) *fileCredentials {
+	return &fileCredentials{path: path, keyPath: keyPath}
+}
+
+// key returns encryption key, new one is created if create is set and there is none
+func (f *fileCredentials) key(create bool) (*[credentialKeySize]byte, error) {
+	var key [credentialKeySize]byte
+	data, err := ioutil.ReadFile(f.keyPath)
+	if err == nil && len(data) == credentialKeySize {
+		copy(key[:], data)
+		return &key, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, errors.New("Cannot read credential key: " + err.Error())
+	} else if !create {
+		return nil, nil
+	}
+
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	if err := replaceFileMode(f.keyPath, key[:], 0600); err != nil {
+		return nil, errors.New("Cannot write credential key: " + err.Error())
+	}
+	return &key, nil
+}
+
+// load returns entries of the file; file that cannot be decrypted (e.g. because key was removed at logout) has none
+func (f *fileCredentials) load() (map[string]string, error) {
+	entries := make(map[string]string)
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, errors.New("Cannot read credentials: " + err.Error())
+	}
+	key, err := f.key(false)
+	if err != nil || key == nil || len(data) < 24 {
+		return entries, err
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], data)
+	plain, ok := secretbox.Open(nil, data[24:], &nonce, key)
+	if !ok || json.Unmarshal(plain, &entries) != nil {
+		return make(map[string]string), nil
+	}
+	return entries, nil
+}
+
+// save encrypts entries with a fresh nonce and replaces the file with them
+func (f *fileCredentials) save(entries map[string]string) error {
+	if len(entries) == 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	key, err := f.key(true)
+	if err != nil {
+		return err
+	}
+	plain, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	if err := replaceFileMode(f.path, secretbox.Seal(nonce[:], plain, &nonce, key), 0600); err != nil {
+		return errors.New("Cannot write credentials: " + err.Error())
+	}
+	return nil
+}
+
+func (f *fileCredentials) get(name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries, err := f.load()
+	return entries[name], err
+}
+
+func (f *fileCredentials) set(name, entry string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries, err := f.load()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for n, data := range entries { // expired entries of other names are not wanted either
+		var e credentialEntry
+		if json.Unmarshal([]byte(data), &e) != nil || !now.Before(e.Expires) {
+			delete(entries, n)
+		}
+	}
+	entries[name] = entry
+	return f.save(entries)
+}
+
+func (f *fileCredentials) remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries, err := f.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[name]; !ok {
+		return nil
+	}
+	delete(entries, name)
+	return f.save(entries)
+}
+
+// clear removes the file and its key
+func (f *fileCredentials) clear() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, path := range []string{f.path, f.keyPath} {
+		if path == "" {
+			continue // there is no key without $XDG_RUNTIME_DIR
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.New("Cannot remove credentials: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// keychainBackend keeps entries in the OS keychain with its command line tool; entries are
+// base64-encoded, so that they do not need quoting and secrets are never in arguments of commands
+type keychainBackend struct {
+	macOS bool // security instead of secret-tool
+}
+
+// newKeychainBackend returns keychain of the OS, nil if there is none
+func newKeychainBackend() *keychainBackend {
+	if runtime.GOOS == "darwin" {
+		if _, err := exec.LookPath("security"); err == nil {
+			return &keychainBackend{macOS: true}
+		}
+		return nil
+	}
+	if _, err := exec.LookPath("secret-tool"); err == nil && runtime.GOOS != "windows" {
+		return &keychainBackend{}
+	}
+	return nil
+}
+
+// run runs command of keychain tool with stdin, stdout is returned
+func (k *keychainBackend) run(stdin string, args ...string) (string, error) {
+	tool := "secret-tool"
+	if k.macOS {
+		tool = "security"
+	}
+	cmd := exec.Command(tool, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if s := strings.TrimSpace(stderr.String()); s != "" {
+			return "", fmt.Errorf("%s failed: %s", tool, s)
+		}
+		return "", fmt.Errorf("%s failed: %s", tool, err)
+	}
+	return stdout.String(), nil
+}
+
+func (k *keychainBackend) get(name string) (string, error) {
+	var out string
+	var err error
+	if k.macOS {
+		if out, err = k.run("", "find-generic-password", "-s", credentialService, "-a", name, "-w"); err != nil {
+			return "", nil // security fails if there is no such item
+		}
+	} else if out, err = k.run("", "lookup", "service", credentialService, "name", name); err != nil {
+		return "", nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(out))
+	if err != nil {
+		return "", errors.New("Invalid keychain item " + name)
+	}
+	return string(data), nil
+}
+
+func (k *keychainBackend) set(name, entry string) error {
+	value := base64.StdEncoding.EncodeToString([]byte(entry))
+	if k.macOS {
+		// commands of "security -i" are read from stdin; name is quoted because key files can have spaces
+		_, err := k.run(fmt.Sprintf("add-generic-password -U -s %s -a %q -w %s\n", credentialService, name, value), "-i")
+		return err
+	}
+	_, err := k.run(value, "store", "--label=GoSSHa "+name, "service", credentialService, "name", name)
+	return err
+}
+
+func (k *keychainBackend) remove(name string) error {
+	if k.macOS {
+		k.run("", "delete-generic-password", "-s", credentialService, "-a", name)
+		return nil
+	}
+	_, err := k.run("", "clear", "service", credentialService, "name", name)
+	return err
+}
+
+func (k *keychainBackend) clear() error {
+	if !k.macOS {
+		_, err := k.run("", "clear", "service", credentialService)
+		return err
+	}
+	// security deletes one item at a time and fails when there are no more
+	for {
+		if _, err := k.run("", "delete-generic-password", "-s", credentialService); err != nil {
+			return nil
+		}
+	}
+}
+
+// forgetMain implements "gossha forget", which removes cached credentials from all stores
+func forgetMain(args []string) int {
+	fs := flag.NewFlagSet("forget", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gossha forget")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	status := 0
+	stores := []credentialBackend{newFileCredentials(defaultCredentialFile(), defaultCredentialKeyFile())}
+	if keychain := newKeychainBackend(); keychain != nil {
+		stores = append(stores, keychain)
+	}
+	for _, s := range stores {
+		if err := s.clear(); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			status = 1
+		}
+	}
+	return status
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func withFileCredentials(t *testing.T, ttl time.Duration) *fileCredentials {
+	t.Helper()
+	dir := t.TempDir()
+	f := newFileCredentials(filepath.Join(dir, "credentials"), filepath.Join(dir, "run", "credentials.key"))
+	must(os.Mkdir(filepath.Join(dir, "run"), 0700), "Mkdir")
+
+	credentials, credentialTTL = f, ttl
+	t.Cleanup(func() { credentials, credentialTTL = nil, 0 })
+	return f
+}
+
+func TestCachedSecret(t *testing.T) {
+	f := withFileCredentials(t, time.Hour)
+
+	asked := 0
+	ask := func() (string, error) { asked++; return "s3cret", nil }
+	for i := 0; i < 2; i++ {
+		if secret, err := cachedSecret("password:root:login", ask); err != nil || secret != "s3cret" {
+			t.Fatalf("cachedSecret returned %q, %v", secret, err)
+		}
+	}
+	if asked != 1 {
+		t.Fatalf("Secret was asked for %d times", asked)
+	}
+
+	data, err := ioutil.ReadFile(f.path)
+	must(err, "ReadFile")
+	if bytes.Contains(data, []byte("s3cret")) {
+		t.Fatalf("Credentials are stored in plain text")
+	}
+	if runtime.GOOS != "windows" {
+		for _, path := range []string{f.path, f.keyPath} {
+			if st, err := os.Stat(path); err != nil || st.Mode().Perm() != 0600 {
+				t.Fatalf("Mode of %s is %v, %v", path, st.Mode(), err)
+			}
+		}
+	}
+
+	forgetSecret("password:root:login")
+	cachedSecret("password:root:login", ask)
+	if asked != 2 {
+		t.Fatalf("Forgotten secret was not asked for again")
+	}
+}
+
+func TestCachedSecretExpires(t *testing.T) {
+	withFileCredentials(t, -time.Second) // entries expire before they are read
+
+	asked := 0
+	ask := func() (string, error) { asked++; return "s3cret", nil }
+	cachedSecret("passphrase:id_rsa", ask)
+	cachedSecret("passphrase:id_rsa", ask)
+	if asked != 2 {
+		t.Fatalf("Expired secret was used, asked %d times", asked)
+	}
+}
+
+func TestCredentialsWithoutKey(t *testing.T) {
+	f := withFileCredentials(t, time.Hour)
+	cachedSecret("passphrase:id_rsa", func() (string, error) { return "s3cret", nil })
+
+	must(os.Remove(f.keyPath), "Remove") // as at logout
+	if entry, err := f.get("passphrase:id_rsa"); err != nil || entry != "" {
+		t.Fatalf("Entry %q, %v was read without key", entry, err)
+	}
+	if secret, _ := cachedSecret("passphrase:id_rsa", func() (string, error) { return "new", nil }); secret != "new" {
+		t.Fatalf("cachedSecret returned %q", secret)
+	}
+
+	must(f.clear(), "clear")
+	for _, path := range []string{f.path, f.keyPath} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s was not removed: %v", path, err)
+		}
+	}
+}
+
+func TestOpenCredentialBackend(t *testing.T) {
+	if _, err := openCredentialBackend("vault"); err == nil {
+		t.Fatalf("Unknown store was accepted")
+	}
+
+	dir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	if b, err := openCredentialBackend("file"); err != nil {
+		t.Fatalf("openCredentialBackend: %s", err)
+	} else if f, ok := b.(*fileCredentials); !ok || filepath.Dir(f.keyPath) != dir {
+		t.Fatalf("file store is %#v", b)
+	}
+
+	// the key must not be kept next to the file
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	if b, err := openCredentialBackend("file"); err == nil {
+		t.Fatalf("file store without XDG_RUNTIME_DIR was opened: %#v", b)
+	}
+}
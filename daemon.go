@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Control daemon (-daemon): GoSSHa keeps running in background and accepts sessions on unix
+// socket (-control). Every session speaks the same JSON protocol as stdin and stdout, requests
+// of all sessions (and scheduled jobs, see scheduler) run one after another using the same connection cache. GoSSHa started
+// without -daemon relays stdin and stdout to the daemon if the socket accepts connections,
+// so repeated invocations against the same hosts skip handshakes entirely.
+
+var (
+	daemonMode    bool   // serve sessions on control socket (-daemon)
+	controlSocket string // path to control socket (-control), relaying is disabled if empty
+
+	control *controlServer
+)
+
+type (
+	// controlServer runs requests of sessions one at a time and passes replies to the session of running one
+	controlServer struct {
+		requests chan<- *ProxyRequest
+		runMu    sync.Mutex // held while request is running
+
+		mu      sync.Mutex
+		current *controlSession
+	}
+
+	controlSession struct {
+		mu                  sync.Mutex
+		w                   io.Writer
+		connectionReporting bool
+		broken              bool          // client disconnected, further replies are dropped
+		done                chan struct{} // receives when running request of session finishes
+		job                 *scheduledJob // scheduled job that runs in session, replies are only counted
+	}
+)
+
+func newControlServer(requests chan<- *ProxyRequest) *controlServer {
+	return &controlServer{requests: requests}
+}
+
+func defaultControlSocket() string {
+	if path := os.Getenv("GOSSHA_CONTROL"); path != "" {
+		return path
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "gossha.sock")
+	}
+	return filepath.Join(homeDir(), ".gossha.sock")
+}
+
+// listenControlSocket listens on path, socket left by daemon that was killed is removed
+func listenControlSocket(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, errors.New("Daemon is already running on " + path)
+	}
+
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("Cannot listen on " + path + ": file exists and is not a socket")
+		}
+		os.Remove(path)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.New("Cannot listen on " + path + ": " + err.Error())
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, errors.New("Cannot change permissions of " + path + ": " + err.Error())
+	}
+
+	return ln, nil
+}
+
+// daemonReplierThread starts accepting sessions once initialized and passes replies to them,
+// other replies are printed to stderr
+func daemonReplierThread() {
+	for reply := range repliesChan {
+		if _, ok := reply.(*InitializeComplete); ok {
+			close(serveInitialized)
+
+			ln, err := listenControlSocket(controlSocket)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+			fmt.Fprintln(os.Stderr, "Accepting sessions on "+controlSocket)
+			go control.serve(ln)
+			go schedules.loop(control)
+			continue
+		}
+
+		if !control.handleReply(reply) {
+			writeReplyText(os.Stderr, os.Stderr, reply, "")
+		}
+	}
+}
+
+func (d *controlServer) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot accept session: "+err.Error())
+			return
+		}
+
+		go func() {
+			d.serveSession(conn)
+			conn.Close()
+		}()
+	}
+}
+
+// serveSession runs requests read from r until EOF, replies are written to w
+func (d *controlServer) serveSession(rw io.ReadWriter) {
+	sess := &controlSession{w: rw, connectionReporting: true, done: make(chan struct{}, 1)}
+	sess.write(&InitializeComplete{InitializeComplete: true})
+
+	scanner := bufio.NewScanner(rw)
+	for scanner.Scan() {
+		msg := new(ProxyRequest)
+		if err := json.Unmarshal(scanner.Bytes(), msg); err != nil {
+			sess.write(&UserError{IsCritical: true, ErrorMsg: "Cannot parse JSON: " + err.Error()})
+			continue
+		}
+
+		if msg.Action != "" || msg.Schedule != "" {
+			if !d.handleSchedule(sess, msg) {
+				d.run(sess, msg)
+			}
+		}
+	}
+}
+
+func (d *controlServer) run(sess *controlSession, msg *ProxyRequest) {
+	d.runMu.Lock()
+	defer d.runMu.Unlock()
+
+	d.mu.Lock()
+	d.current = sess
+	d.mu.Unlock()
+
+	d.requests <- msg
+	<-sess.done
+}
+
+// handleReply writes reply to the session of running request, it returns false if nothing is running
+func (d *controlServer) handleReply(reply interface{}) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sess := d.current
+	if sess == nil {
+		return false
+	}
+
+	finished := false
+	switch reply := reply.(type) {
+	case DisableReportConnectedHosts:
+		sess.connectionReporting = false
+		return true
+	case EnableReportConnectedHosts:
+		sess.connectionReporting = true
+		return true
+	case *ConnectionProgress:
+		if !sess.connectionReporting || quiet {
+			return true
+		}
+	case *UserError:
+		finished = reply.IsCritical
+	case *FinalReply:
+		finished = true
+	}
+
+	if !sess.write(reply) {
+		// client is gone, so there is no one to wait for the rest of replies
+		select {
+		case actionInterrupts <- struct{}{}:
+		default:
+		}
+	}
+
+	if finished {
+		d.current = nil
+		sess.done <- struct{}{}
+	}
+
+	return true
+}
+
+// write sends reply to client, it returns false if client has disconnected
+func (s *controlSession) write(reply interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.job != nil {
+		schedules.record(s.job, reply)
+		return true
+	}
+
+	if s.broken {
+		return false
+	}
+
+	if err := writeReplyJSON(s.w, reply); err != nil {
+		s.broken = true
+		return false
+	}
+	return true
+}
+
+// relayToDaemon passes stdin to daemon and its replies to stdout until daemon closes connection,
+// it returns exit status
+func relayToDaemon(conn net.Conn) int {
+	go func() {
+		io.Copy(conn, os.Stdin)
+		if uc, ok := conn.(*net.UnixConn); ok {
+			uc.CloseWrite()
+		}
+	}()
+
+	if _, err := io.Copy(os.Stdout, conn); err != nil {
+		fmt.Fprintln(os.Stderr, "Connection to daemon lost: "+err.Error())
+		return 1
+	}
+	return 0
+}
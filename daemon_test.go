@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestControlDaemon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossha-daemon")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gossha.sock")
+
+	requests := make(chan *ProxyRequest)
+	d := newControlServer(requests)
+
+	// replies are produced like runAction does it
+	go func() {
+		for req := range requests {
+			d.handleReply(DisableReportConnectedHosts(true))
+			d.handleReply(&ConnectionProgress{ConnectedHost: req.Hosts[0]})
+			d.handleReply(EnableReportConnectedHosts(true))
+			d.handleReply(&Reply{Hostname: req.Hosts[0], Stdout: req.Cmd, Success: true})
+			d.handleReply(&FinalReply{TimedOutHosts: map[string]bool{}})
+		}
+	}()
+
+	ln, err := listenControlSocket(path)
+	must(err, "Could not listen on control socket")
+	defer ln.Close()
+	go d.serve(ln)
+
+	if _, err := listenControlSocket(path); err == nil {
+		t.Fatalf("Second daemon must not be started on the same socket")
+	}
+
+	conn, err := net.Dial("unix", path)
+	must(err, "Could not connect to daemon")
+	defer conn.Close()
+
+	conn.Write([]byte("not json\n" + `{"Action":"ssh","Cmd":"uptime","Hosts":["host1"]}` + "\n"))
+	conn.(*net.UnixConn).CloseWrite()
+
+	var types []string
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var reply struct {
+			Type   string
+			Stdout string
+		}
+		must(json.Unmarshal(scanner.Bytes(), &reply), "Could not parse reply")
+		types = append(types, reply.Type)
+
+		if reply.Type == "Reply" && reply.Stdout != "uptime" {
+			t.Fatalf("Unexpected reply: %s", scanner.Text())
+		}
+	}
+
+	// connection progress is suppressed and session is closed after the last request finishes
+	expected := []string{"InitializeComplete", "UserError", "Reply", "FinalReply"}
+	if len(types) != len(expected) {
+		t.Fatalf("Unexpected replies: %v", types)
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Fatalf("Unexpected replies: %v", types)
+		}
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Delta uploads ("Delta": true or -delta): when target already exists, its signature (weak CRC and
+// SHA-256 of every block, computed on remote side with dd, cksum and sha256sum) is compared with
+// rolling checksum of the new contents like rsync does, so that only literal data that is not found
+// in the old file is uploaded. New file is assembled on remote side from blocks of the old one and
+// uploaded literal data, and its checksum is always verified; if anything fails, the file is uploaded
+// in full. Hosts with the same old file share the computed delta.
+
+const (
+	deltaSuffix    = ".gossha.delta" // suffix of temporary file with literal data
+	deltaMaxBlocks = 1024            // block size grows with file size, so that signature stays small
+)
+
+var (
+	deltaMinSize      int64 = 1 << 20  // smaller files are uploaded in full
+	deltaMinBlockSize int64 = 64 << 10 // block size of files up to deltaMaxBlocks*deltaMinBlockSize bytes
+)
+
+var cksumTable = makeCksumTable()
+
+type (
+	// deltaSignature describes blocks of remote file
+	deltaSignature struct {
+		blockSize int64
+		weak      map[uint32][]int64 // POSIX cksum of block -> indexes of blocks
+		strong    [][sha256.Size]byte
+		outTable  [256]uint32 // CRC of byte followed by blockSize zero bytes, to remove it from rolling CRC
+	}
+
+	// deltaOp copies count blocks starting from block of the old file (count > 0), or size
+	// bytes of the new contents starting from off
+	deltaOp struct {
+		block, count int64
+		off, size    int64
+	}
+
+	// deltaPlan is delta of entry against a remote signature, computed once for all hosts having it
+	deltaPlan struct {
+		once sync.Once
+		ops  []deltaOp
+		err  error
+	}
+)
+
+func makeCksumTable() (t [256]uint32) {
+	for i := range t {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04c11db7
+			} else {
+				c <<= 1
+			}
+		}
+		t[i] = c
+	}
+	return
+}
+
+func cksumUpdate(crc uint32, b byte) uint32 {
+	return crc<<8 ^ cksumTable[byte(crc>>24)^b]
+}
+
+// cksumFinish returns POSIX cksum of n bytes which CRC is crc
+func cksumFinish(crc uint32, n int64) uint32 {
+	for ; n > 0; n >>= 8 {
+		crc = cksumUpdate(crc, byte(n))
+	}
+	return ^crc
+}
+
+// deltaBlockSize returns block size of signature of file of size bytes
+func deltaBlockSize(size int64) int64 {
+	bs := deltaMinBlockSize
+	for size/bs > deltaMaxBlocks {
+		bs *= 2
+	}
+	return bs
+}
+
+// remoteDeltaSignature computes signature of full blocks of remote file of size bytes
+func remoteDeltaSignature(conn *ssh.Client, remotePath string, size int64) (*deltaSignature, error) {
+	bs := deltaBlockSize(size)
+	n := size / bs
+
+	script := fmt.Sprintf(`f=%s; i=0
+while [ $i -lt %d ]; do
+  w=$(dd if="$f" bs=%d skip=$i count=1 2>/dev/null | cksum) || exit 1
+  s=$(dd if="$f" bs=%d skip=$i count=1 2>/dev/null | sha256sum) || exit 1
+  echo "$w $s"
+  i=$((i+1))
+done`, shellQuote(remotePath), n, bs, bs)
+
+	stdout, stderr, err := runCmd(conn, "", "sh -s", &cmdOptions{stdin: []byte(script)})
+	if err != nil {
+		return nil, errors.New("Cannot compute block checksums: " + strings.TrimSpace(err.Error()+" "+stderr))
+	}
+
+	return parseDeltaSignature(stdout, bs, n)
+}
+
+// parseDeltaSignature parses "<cksum> <size> <sha256> -" lines of n blocks
+func parseDeltaSignature(out string, bs, n int64) (*deltaSignature, error) {
+	sig := &deltaSignature{blockSize: bs, weak: make(map[uint32][]int64)}
+
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if out == "" {
+		lines = nil
+	}
+	if int64(len(lines)) != n {
+		return nil, fmt.Errorf("Unexpected block checksums: expected %d blocks, got %d", n, len(lines))
+	}
+
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, errors.New("Unexpected block checksum: " + line)
+		}
+		weak, weakErr := strconv.ParseUint(fields[0], 10, 32)
+		strong, strongErr := hex.DecodeString(strings.TrimPrefix(fields[2], "\\"))
+		if weakErr != nil || strongErr != nil || len(strong) != sha256.Size || fields[1] != strconv.FormatInt(bs, 10) {
+			return nil, errors.New("Unexpected block checksum: " + line)
+		}
+
+		var sum [sha256.Size]byte
+		copy(sum[:], strong)
+		sig.strong = append(sig.strong, sum)
+		sig.weak[uint32(weak)] = append(sig.weak[uint32(weak)], int64(i))
+	}
+
+	// CRC is linear, so CRC of a byte followed by zeros is combined from CRCs of its bits
+	var bits [8]uint32
+	for k := range bits {
+		crc := cksumUpdate(0, 1<<uint(k))
+		for j := int64(0); j < bs; j++ {
+			crc = cksumUpdate(crc, 0)
+		}
+		bits[k] = crc
+	}
+	for b := range sig.outTable {
+		for k := range bits {
+			if b&(1<<uint(k)) != 0 {
+				sig.outTable[b] ^= bits[k]
+			}
+		}
+	}
+
+	return sig, nil
+}
+
+// key identifies signature, so that hosts with the same old file share the delta
+func (s *deltaSignature) key() string {
+	h := sha256.New()
+	fmt.Fprint(h, s.blockSize)
+	for _, sum := range s.strong {
+		h.Write(sum[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// diff returns operations that assemble size bytes read from r out of remote blocks and literal data
+func (s *deltaSignature) diff(r io.Reader, size int64) ([]deltaOp, error) {
+	bs := s.blockSize
+
+	var ops []deltaOp
+	literal := func(off, end int64) {
+		if end > off {
+			ops = append(ops, deltaOp{off: off, size: end - off})
+		}
+	}
+
+	// data holds contents starting from file offset start, it is read as window moves
+	var data []byte
+	var start int64
+	eof := false
+	buf := make([]byte, chunkSize)
+	fill := func(pos, n int64) error {
+		for !eof && pos+n > start+int64(len(data)) {
+			if pos > start {
+				data = data[:copy(data, data[pos-start:])]
+				start = pos
+			}
+			m, err := r.Read(buf)
+			data = append(data, buf[:m]...)
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var pos, litStart int64
+	var crc uint32
+	rolling := false
+	for pos+bs <= size {
+		if err := fill(pos, bs+1); err != nil {
+			return nil, err
+		}
+		if pos-start+bs > int64(len(data)) {
+			return nil, errors.New("Contents changed during upload")
+		}
+		window := data[pos-start : pos-start+bs]
+
+		if !rolling {
+			crc = 0
+			for _, b := range window {
+				crc = cksumUpdate(crc, b)
+			}
+			rolling = true
+		}
+
+		if idxs, ok := s.weak[cksumFinish(crc, bs)]; ok {
+			sum := sha256.Sum256(window)
+			matched := int64(-1)
+			for _, idx := range idxs {
+				if s.strong[idx] == sum {
+					matched = idx
+					break
+				}
+			}
+
+			if matched >= 0 {
+				literal(litStart, pos)
+				if last := len(ops) - 1; last >= 0 && ops[last].count > 0 && ops[last].block+ops[last].count == matched {
+					ops[last].count++
+				} else {
+					ops = append(ops, deltaOp{block: matched, count: 1})
+				}
+				pos += bs
+				litStart, rolling = pos, false
+				continue
+			}
+		}
+
+		if pos+bs < size {
+			if pos-start+bs >= int64(len(data)) {
+				return nil, errors.New("Contents changed during upload")
+			}
+			crc = cksumUpdate(crc, data[pos-start+bs]) ^ s.outTable[window[0]]
+		}
+		pos++
+	}
+	literal(litStart, size)
+
+	return ops, nil
+}
+
+// deltaPlan returns delta of entry against sig, it is computed once for every distinct signature
+func (e *uploadEntry) deltaPlan(sig *deltaSignature) ([]deltaOp, error) {
+	key := sig.key()
+
+	e.deltaMu.Lock()
+	if e.deltas == nil {
+		e.deltas = make(map[string]*deltaPlan)
+	}
+	plan, ok := e.deltas[key]
+	if !ok {
+		plan = &deltaPlan{}
+		e.deltas[key] = plan
+	}
+	e.deltaMu.Unlock()
+
+	plan.once.Do(func() {
+		r, err := e.open()
+		if err != nil {
+			plan.err = err
+			return
+		}
+		defer r.Close()
+
+		if plan.ops, plan.err = sig.diff(r, e.size); plan.err != nil {
+			plan.err = errors.New("Cannot read " + e.localPath + " contents: " + plan.err.Error())
+		}
+	})
+
+	return plan.ops, plan.err
+}
+
+// literalReader reads literal data of ops one after another
+type literalReader struct {
+	entry *uploadEntry
+	ops   []deltaOp
+	cur   io.ReadCloser
+}
+
+func (l *literalReader) Read(p []byte) (int, error) {
+	for {
+		if l.cur != nil {
+			n, err := l.cur.Read(p)
+			if err != io.EOF {
+				return n, err
+			}
+			l.cur.Close()
+			l.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+		}
+
+		for len(l.ops) > 0 && l.ops[0].count > 0 {
+			l.ops = l.ops[1:]
+		}
+		if len(l.ops) == 0 {
+			return 0, io.EOF
+		}
+
+		r, err := l.entry.openRange(l.ops[0].off, l.ops[0].size)
+		if err != nil {
+			return 0, err
+		}
+		l.cur, l.ops = r, l.ops[1:]
+	}
+}
+
+func (l *literalReader) Close() error {
+	if l.cur != nil {
+		return l.cur.Close()
+	}
+	return nil
+}
+
+// assembleScript returns shell script that writes new file to tmpPath from blocks of old file and literal data of deltaPath
+func assembleScript(ops []deltaOp, bs int64, old, deltaPath, tmpPath string) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "{\n")
+
+	var litOff int64
+	for _, op := range ops {
+		if op.count > 0 {
+			fmt.Fprintf(&buf, "dd if=%s bs=%d skip=%d count=%d 2>/dev/null || exit 1\n", shellQuote(old), bs, op.block, op.count)
+		} else {
+			fmt.Fprintf(&buf, "tail -c +%d -- %s | head -c %d || exit 1\n", litOff+1, shellQuote(deltaPath), op.size)
+			litOff += op.size
+		}
+	}
+
+	fmt.Fprintf(&buf, "} > %s\n", shellQuote(tmpPath))
+	return buf.String()
+}
+
+// deltaBase returns attributes of target if it is a regular file that has at least one block
+func deltaBase(client *sftpClient, target string) *sftpAttrs {
+	old, err := client.Stat(target)
+	if err != nil || old.Flags&sshFileXferAttrSize == 0 || old.Size < uint64(deltaMinBlockSize) {
+		return nil
+	}
+	if old.Flags&sshFileXferAttrPermissions != 0 && old.Perm&0170000 != 0100000 {
+		return nil
+	}
+	return old
+}
+
+// writeRemoteFileDelta writes entry to tmpPath reusing blocks of existing file target which attributes are old
+func writeRemoteFileDelta(conn *ssh.Client, client *sftpClient, old *sftpAttrs, target, tmpPath string, entry *uploadEntry, attrs *sftpAttrs, progress *transferProgress, limiters []*rateLimiter) (err error) {
+	sig, err := remoteDeltaSignature(conn, target, int64(old.Size))
+	if err != nil {
+		return
+	}
+
+	ops, err := entry.deltaPlan(sig)
+	if err != nil {
+		return
+	}
+
+	deltaPath := target + deltaSuffix
+	fp, err := client.Create(deltaPath, &sftpAttrs{})
+	if err != nil {
+		return errors.New("Cannot create " + deltaPath + ": " + err.Error())
+	}
+	defer client.Remove(deltaPath)
+
+	// progress is only reported once file is assembled, because it is uploaded anew if that fails
+	r := &literalReader{entry: entry, ops: ops}
+	_, err = copyChunks(fp, r, entry, nil, limiters)
+	r.Close()
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+
+	script := assembleScript(ops, sig.blockSize, target, deltaPath, tmpPath)
+	if _, stderr, err := runCmd(conn, "", "sh -s", &cmdOptions{stdin: []byte(script)}); err != nil {
+		return errors.New("Cannot assemble " + tmpPath + ": " + strings.TrimSpace(err.Error()+" "+stderr))
+	}
+
+	if attrs.Flags != 0 {
+		if err = client.Setstat(tmpPath, attrs); err != nil {
+			return errors.New("Cannot set attributes of " + tmpPath + ": " + err.Error())
+		}
+	}
+
+	expected, err := entry.sha256()
+	if err != nil {
+		return
+	}
+	if err = verifyRemoteFile(conn, client, tmpPath, expected); err != nil {
+		return
+	}
+
+	progress.add(int(entry.size))
+	return nil
+}
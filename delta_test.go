@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testDeltaSignature returns signature output for full blocks of data like remoteDeltaSignature script prints it
+func testDeltaSignature(data []byte, bs int64) string {
+	var out bytes.Buffer
+	for off := int64(0); off+bs <= int64(len(data)); off += bs {
+		var crc uint32
+		for _, b := range data[off : off+bs] {
+			crc = cksumUpdate(crc, b)
+		}
+		fmt.Fprintf(&out, "%d %d %x  -\n", cksumFinish(crc, bs), bs, sha256.Sum256(data[off:off+bs]))
+	}
+	return out.String()
+}
+
+func TestCksum(t *testing.T) {
+	data := make([]byte, 70000)
+	rand.Read(data)
+
+	out, err := exec.Command("cksum").CombinedOutput()
+	if err != nil {
+		t.Skipf("cksum is not available: %s", err)
+	}
+	if !strings.HasPrefix(string(out), "4294967295 0") {
+		t.Fatalf("Unexpected cksum of empty input: %s", out)
+	}
+
+	cmd := exec.Command("cksum")
+	cmd.Stdin = bytes.NewReader(data)
+	out, err = cmd.Output()
+	must(err, "Could not run cksum")
+
+	if expected := strings.Fields(testDeltaSignature(data, int64(len(data))))[0]; strings.Fields(string(out))[0] != expected {
+		t.Fatalf("Unexpected cksum: %s, expected %s", out, expected)
+	}
+}
+
+func TestDeltaDiff(t *testing.T) {
+	const bs = 1024
+	old := make([]byte, 16*bs+100)
+	rand.Read(old)
+
+	// bytes inserted into the middle shift the rest of file, one block is changed
+	updated := append(append(append([]byte(nil), old[:5*bs+10]...), "inserted"...), old[5*bs+10:]...)
+	copy(updated[10*bs:], "changed")
+
+	sig, err := parseDeltaSignature(testDeltaSignature(old, bs), bs, int64(len(old))/bs)
+	must(err, "Could not parse signature")
+
+	ops, err := sig.diff(bytes.NewReader(updated), int64(len(updated)))
+	must(err, "Could not compute delta")
+
+	var assembled []byte
+	var literal int64
+	for _, op := range ops {
+		if op.count > 0 {
+			assembled = append(assembled, old[op.block*bs:(op.block+op.count)*bs]...)
+		} else {
+			assembled = append(assembled, updated[op.off:op.off+op.size]...)
+			literal += op.size
+		}
+	}
+
+	if !bytes.Equal(assembled, updated) {
+		t.Fatalf("Delta does not assemble new contents: %+v", ops)
+	}
+	if literal > 4*bs {
+		t.Fatalf("Too much literal data for small changes: %d bytes, %+v", literal, ops)
+	}
+
+	if _, err := parseDeltaSignature("123 1024 xyz -\n", bs, 1); err == nil {
+		t.Fatalf("Invalid signature must be rejected")
+	}
+}
+
+func TestDeltaUpload(t *testing.T) {
+	oldMinSize, oldBlockSize := deltaMinSize, deltaMinBlockSize
+	deltaMinSize, deltaMinBlockSize = 1, 1024
+	defer func() { deltaMinSize, deltaMinBlockSize = oldMinSize, oldBlockSize }()
+
+	old := make([]byte, 100*1024)
+	rand.Read(old)
+	updated := append(append([]byte("header"), old[:50000]...), old[50100:]...)
+
+	r := makeTestResult()
+	startTestServers(r, "test-delta", 2)
+	for _, srv := range r.hosts {
+		must(ioutil.WriteFile(filepath.Join(srv.root, "build.bin"), old, 0644), "Could not write old file")
+	}
+
+	runTestRequest(t, r, &ProxyRequest{Action: "scp", Source: dataSource, Data: updated, Target: "build.bin", Delta: true})
+
+	for addr, srv := range r.hosts {
+		if got, err := ioutil.ReadFile(filepath.Join(srv.root, "build.bin")); err != nil || !bytes.Equal(got, updated) {
+			t.Fatalf("Unexpected contents on %s: %d bytes, %v", addr, len(got), err)
+		}
+		if _, err := os.Stat(filepath.Join(srv.root, "build.bin"+deltaSuffix)); !os.IsNotExist(err) {
+			t.Fatalf("Literal data must be removed on %s: %v", addr, err)
+		}
+	}
+}
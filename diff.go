@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Output diffing ("Diff": "<host>" or "file:<path>"): replies are sent after all hosts finish,
+// Stdout of every other host is compared with Stdout of the reference host (or contents of
+// the local file) and unified diff is sent in Diff field of their replies.
+
+const (
+	diffContext  = 3    // number of unchanged lines around changes in unified diff
+	maxDiffEdits = 2000 // edits after which outputs are reported as entirely different instead of computing minimal diff
+)
+
+var diffDefault string // reference for requests that do not specify "Diff" (-diff)
+
+// diffReference is a source of output that replies are compared with
+type diffReference struct {
+	name      string // reference host or local file name
+	host      bool   // reference is a host of request, its output becomes known when it replies
+	output    string
+	available bool
+	reported  bool // error about unavailable reference was already sent
+}
+
+// newDiffReference validates reference ref for hosts of request and reads it if it is a local file
+func newDiffReference(ref string, hosts []string) (*diffReference, error) {
+	if strings.HasPrefix(ref, "file:") {
+		filename := expandHome(strings.TrimPrefix(ref, "file:"))
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, errors.New("Cannot read diff reference: " + err.Error())
+		}
+		return &diffReference{name: filename, output: string(data), available: true}, nil
+	}
+
+	for _, h := range hosts {
+		if h == ref {
+			return &diffReference{name: ref, host: true}, nil
+		}
+	}
+	return nil, errors.New("Diff reference host " + ref + " is not one of hosts of request")
+}
+
+// apply sets Diff or SameAsReference of replies of hosts other than the reference one
+func (d *diffReference) apply(replies []*Reply) {
+	for _, r := range replies {
+		if d.host && r.Hostname == d.name && r.Success {
+			r.unspill()
+			d.output, d.available = r.Stdout, true
+			r.dropSpilled()
+		}
+	}
+
+	if !d.available {
+		if !d.reported {
+			d.reported = true
+			reportErrorToUser("Output of reference host " + d.name + " is not available, outputs are not compared")
+		}
+		return
+	}
+
+	for _, r := range replies {
+		if d.host && r.Hostname == d.name || !r.Success {
+			continue
+		}
+		r.unspill()
+		r.Diff = unifiedDiff(d.name, r.Hostname, d.output, r.Stdout)
+		r.SameAsReference = r.Diff == ""
+		r.dropSpilled()
+	}
+}
+
+// diffOp is a line of edit script: ' ' (same), '-' (removed) or '+' (added)
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// splitDiffLines splits text into lines, missing newline at the end is marked like diff(1) does
+func splitDiffLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	} else {
+		lines[len(lines)-1] += "\n\\ No newline at end of file\n"
+	}
+	return lines
+}
+
+// diffLines returns shortest edit script that turns a into b (Myers' algorithm); if more than
+// maxDiffEdits edits are needed, all lines of a are removed and all lines of b are added instead
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	offset := n + m
+	v := make([]int, 2*offset+2)
+	var trace [][]int
+
+	for d := 0; d <= n+m; d++ {
+		if d > maxDiffEdits {
+			ops := make([]diffOp, 0, n+m)
+			for _, l := range a {
+				ops = append(ops, diffOp{'-', l})
+			}
+			for _, l := range b {
+				ops = append(ops, diffOp{'+', l})
+			}
+			return ops
+		}
+
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				return backtrackDiff(trace, a, b, offset)
+			}
+		}
+	}
+
+	return nil
+}
+
+// backtrackDiff restores edit script from states of diffLines
+func backtrackDiff(trace [][]int, a, b []string, offset int) []diffOp {
+	var ops []diffOp
+	x, y := len(a), len(b)
+
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		prevK := k - 1
+		if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+			prevK = k + 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x, y = x-1, y-1
+		}
+		if x == prevX {
+			ops = append(ops, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			ops = append(ops, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		ops = append(ops, diffOp{' ', a[x-1]})
+		x, y = x-1, y-1
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// unifiedDiff returns unified diff of from and to texts (empty if they are the same)
+func unifiedDiff(fromName, toName, from, to string) string {
+	if from == to {
+		return ""
+	}
+
+	ops := diffLines(splitDiffLines(from), splitDiffLines(to))
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+
+	// aLines[i] and bLines[i] are numbers of lines of from and to that precede ops[i]
+	aLines, bLines := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		aLines[i+1], bLines[i+1] = aLines[i], bLines[i]
+		if op.kind != '+' {
+			aLines[i+1]++
+		}
+		if op.kind != '-' {
+			bLines[i+1]++
+		}
+	}
+
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// hunk includes changes separated by at most 2*diffContext unchanged lines
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops) && j-end <= 2*diffContext; j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			}
+		}
+		i = end
+		if end += diffContext; end > len(ops) {
+			end = len(ops)
+		}
+
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aLines[start], aLines[end]), hunkRange(bLines[start], bLines[end]))
+		for _, op := range ops[start:end] {
+			out.WriteString(string(op.kind) + op.line)
+		}
+	}
+
+	return out.String()
+}
+
+// hunkRange formats range of lines (from, to] of unified diff hunk header
+func hunkRange(from, to int) string {
+	if to-from == 1 {
+		return fmt.Sprint(from + 1)
+	}
+	if to == from {
+		return fmt.Sprintf("%d,0", from)
+	}
+	return fmt.Sprintf("%d,%d", from+1, to-from)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	from := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+	to := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm"
+
+	// same as diff -u output
+	expected := "--- ref\n+++ host\n" +
+		"@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n" +
+		"@@ -10,3 +10,4 @@\n j\n k\n l\n+m\n\\ No newline at end of file\n"
+	if diff := unifiedDiff("ref", "host", from, to); diff != expected {
+		t.Fatalf("Unexpected diff:\n%s", diff)
+	}
+
+	if diff := unifiedDiff("ref", "host", "", "x\n"); diff != "--- ref\n+++ host\n@@ -0,0 +1 @@\n+x\n" {
+		t.Fatalf("Unexpected diff with empty reference:\n%s", diff)
+	}
+
+	if diff := unifiedDiff("ref", "host", from, from); diff != "" {
+		t.Fatalf("Same outputs must not differ:\n%s", diff)
+	}
+}
+
+func TestDiffReplies(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-diff", 3)
+
+	req := makeProxyRequest(maxTimeout)
+	for addr := range r.hosts {
+		req.Hosts = append(req.Hosts, addr)
+	}
+	req.Diff = req.Hosts[0]
+	runTestRequest(t, r, req)
+
+	ref := r.hosts[req.Diff].hostname
+	for addr, reply := range r.replies {
+		if addr == req.Diff {
+			if reply.Diff != "" || reply.SameAsReference {
+				t.Fatalf("Reference host must not be compared: %+v", reply)
+			}
+			continue
+		}
+		expected := "-" + ref + "\n\\ No newline at end of file\n+" + reply.Stdout + "\n\\ No newline at end of file\n"
+		if !strings.HasPrefix(reply.Diff, "--- "+req.Diff+"\n+++ "+addr+"\n@@ -1 +1 @@\n") || !strings.HasSuffix(reply.Diff, expected) {
+			t.Fatalf("Unexpected diff of %s: %q", addr, reply.Diff)
+		}
+	}
+
+	if _, err := newDiffReference("unknown", req.Hosts); err == nil {
+		t.Fatalf("Reference host that is not in request must be rejected")
+	}
+}
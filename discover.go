@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	httpAPIClient   = &http.Client{Timeout: time.Millisecond * defaultTimeout} // client for APIs of host sources
+	discoverDefault string                                                     // host source of requests without hosts (-discover)
+)
+
+// hostSources are dynamic sources of hosts that can be listed in "Discover", keyed by URL scheme
+var hostSources = map[string]func(u *url.URL) ([]string, error){
+	"ec2":    ec2Hosts,
+	"consul": consulHosts,
+	"etcd":   etcdHosts,
+	"mdns":   mdnsHosts,
+	"k8s":    k8sHosts,
+}
+
+// withDefaultDiscover returns host sources of msg, -discover is used if request has no hosts at all
+func withDefaultDiscover(msg *ProxyRequest) []string {
+	if discoverDefault != "" && len(msg.Hosts) == 0 && len(msg.Groups) == 0 && len(msg.Discover) == 0 && msg.Stages == "" {
+		return []string{discoverDefault}
+	}
+	return msg.Discover
+}
+
+// discoverHosts queries all specified dynamic host sources and returns hosts found
+func discoverHosts(sources []string) (res []string, err error) {
+	for _, src := range sources {
+		u, err := url.Parse(src)
+		if err != nil {
+			return nil, errors.New("Invalid host source " + src + ": " + err.Error())
+		}
+
+		discover, ok := hostSources[u.Scheme]
+		if !ok {
+			return nil, errors.New("Unsupported host source: " + src)
+		}
+
+		hosts, err := discover(u)
+		if err != nil {
+			return nil, errors.New("Cannot discover hosts from " + src + ": " + err.Error())
+		}
+
+		res = append(res, hosts...)
+	}
+
+	return
+}
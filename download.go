@@ -0,0 +1,153 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Recursive download ("Recursive": true or `gossha get -recursive`): remote directory is packed by
+// tar on host and the archive is streamed over ssh session and unpacked on the fly under
+// <Target>/<host>/<basename of Source>, so nothing is stored on host and local disk only gets
+// the files. Only directories and regular files are unpacked, other entries (e.g. symbolic links,
+// which could point outside of the local directory) are skipped and reported in stderr.
+
+// downloadDir fetches remote source directory with tar and unpacks it under <localDir>/<hostname>
+func downloadDir(source, localDir, hostname string) (stdout, stderr string, err error) {
+	dirName := downloadDirName(hostname)
+	if !isSafeLocalName(dirName) {
+		err = errors.New("Refusing to write downloaded files to unsafe local path " + dirName)
+		return
+	}
+
+	source = strings.TrimRight(source, "/")
+	parent, base := path.Dir(source), path.Base(source)
+	if source == "" {
+		parent, base = "/", "."
+	}
+
+	conn, err := getConnection(hostname)
+	if err != nil {
+		return
+	}
+	defer connectedHosts.Release(hostname, conn)
+
+	session, err := conn.NewSession()
+	if err != nil {
+		err = &retryableError{err}
+		return
+	}
+	defer session.Close()
+
+	metricActiveSessions.add(1)
+	defer metricActiveSessions.add(-1)
+
+	pipe, err := session.StdoutPipe()
+	if err != nil {
+		return
+	}
+	var stderrBuf bytes.Buffer
+	session.Stderr = &stderrBuf
+
+	if commandsInterrupted() {
+		err = errors.New("Action was interrupted before command was started")
+		return
+	}
+	if err = session.Start("tar -C " + shellQuote(parent) + " -cf - -- " + shellQuote(base)); err != nil {
+		err = checkDisconnected(conn, hostname, connLostError(conn, err))
+		return
+	}
+	trackCommand(session, hostname)
+	defer untrackCommand(session)
+
+	dir := filepath.Join(localDir, dirName)
+	skipped, unpackErr := unpackTar(pipe, dir)
+	if unpackErr != nil {
+		io.Copy(ioutil.Discard, pipe) // let tar exit
+	}
+
+	err = connLostError(conn, session.Wait())
+	stderr = stderrBuf.String() + skipped
+
+	// GNU tar exits with status 1 if files changed while they were read, e.g. logs that are written to
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitStatus() == 1 && unpackErr == nil {
+		err = nil
+	}
+
+	if err != nil {
+		err = checkDisconnected(conn, hostname, err)
+		if msg := strings.TrimSpace(stderrBuf.String()); msg != "" {
+			err = errors.New("Cannot download " + source + ": " + msg)
+		}
+	} else if unpackErr != nil {
+		err = errors.New("Cannot unpack " + source + ": " + unpackErr.Error())
+	}
+
+	return
+}
+
+// unpackTar writes directories and regular files of tar archive read from r under dir and
+// returns lines about entries that were skipped
+func unpackTar(r io.Reader, dir string) (skipped string, err error) {
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return skipped, nil
+		} else if err != nil {
+			return skipped, err
+		}
+
+		name := path.Clean(hdr.Name)
+		if name == "." {
+			continue
+		}
+		for _, part := range strings.Split(name, "/") {
+			if !isSafeLocalName(part) {
+				return skipped, errors.New("Refusing to write archive entry to unsafe local path " + hdr.Name)
+			}
+		}
+		localPath := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(localPath, os.FileMode(hdr.Mode)&0777|0700); err != nil {
+				return skipped, err
+			}
+		case tar.TypeReg:
+			if err := unpackFile(tr, localPath, os.FileMode(hdr.Mode)&0777|0600); err != nil {
+				return skipped, err
+			}
+			os.Chtimes(localPath, hdr.ModTime, hdr.ModTime)
+		default:
+			skipped += "Skipped " + name + ": not a regular file or directory\n"
+		}
+	}
+}
+
+func unpackFile(r io.Reader, localPath string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+
+	fp, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fp, r)
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var dryRun bool // only report what would be done instead of connecting to hosts (-dry-run)
+
+// dryRunExecFunc returns function that describes what action would do on host without connecting to it
+func dryRunExecFunc(msg *ProxyRequest) func(string) *SshResult {
+	render, _ := newHostRenderer(msg) // templates are already validated by getExecFunc
+
+	return func(hostname string) *SshResult {
+		req, err := render(hostname)
+		if err != nil {
+			return &SshResult{hostname: hostname, err: err}
+		}
+
+		target, conf := inventoryTarget(hostname, &ssh.ClientConfig{User: user})
+		host, port := splitHostPort(target)
+
+		stdout := "Connect to " + conf.User + "@" + net.JoinHostPort(host, port)
+		if len(jumpHosts) > 0 {
+			stdout += " via " + strings.Join(jumpHosts, ",")
+		}
+		stdout += "\n" + describeAction(req)
+
+		if len(signers) == 0 && !agentAuthEnabled() && !kbdInteractive && hostPassword(hostname) == "" && vault == nil && authCommand == "" {
+			err = errors.New("No private keys, ssh-agent or password to authenticate with")
+		}
+
+		return &SshResult{hostname: hostname, stdout: stdout, err: err}
+	}
+}
+
+// describeAction returns human-readable description of what is executed on each host
+func describeAction(msg *ProxyRequest) string {
+	var res []string
+
+	if cond := msg.OnlyIf; cond != "" || onlyIfDefault != "" {
+		if cond == "" {
+			cond = onlyIfDefault
+		}
+		res = append(res, "Only if succeeds: "+cond)
+	}
+	for _, cmd := range requestSnapshot(msg) {
+		res = append(res, "Snapshot before and after: "+cmd)
+	}
+	session, _ := requestSession(msg)
+	if session != nil {
+		for _, cmd := range session.setup {
+			res = append(res, "Setup: "+cmd)
+		}
+	}
+
+	switch msg.Action {
+	case "ssh":
+		cmds := msg.Cmds
+		if msg.Cmd != "" {
+			cmds = []string{msg.Cmd}
+		}
+		opts, err := parseCmdOptions(msg)
+		if err != nil {
+			opts = &cmdOptions{sudo: msg.Sudo}
+		}
+		opts.chdir = withDefaultChdir(msg).Chdir
+		opts.cmdTimeouts, _ = commandTimeouts(msg)
+		for i, cmd := range cmds {
+			if wrapped, err := shellCommand(cmd, opts); err == nil {
+				cmd = wrapped
+			}
+			if opts.sudo || opts.runAs != "" {
+				cmd = runAsCommand(cmd, opts, newSudoAuth(opts.sudoPassword))
+			}
+			if pattern, _, remote, err := requestFilter(msg); err == nil && remote {
+				cmd = remoteFilterCommand(cmd, pattern)
+			}
+			if timeout := opts.forCommand(i).remoteTimeout; timeout > 0 {
+				cmd = remoteTimeoutCommand(cmd, timeout)
+			}
+			res = append(res, "Run: "+cmd)
+		}
+	case "script":
+		script := "Run script " + msg.Source
+		for _, arg := range msg.Args {
+			script += " " + shellQuote(arg)
+		}
+		if user, method, err := requestRunAs(msg); err == nil && user != "" {
+			script += " as " + user + " using " + method
+		} else if msg.Sudo {
+			script += " using sudo"
+		}
+		if dir := withDefaultChdir(msg).Chdir; dir != "" {
+			script += " in " + dir
+		}
+		res = append(res, script)
+	case "scp":
+		if msg.Manifest != "" {
+			entries, err := loadUploadManifest(msg.Manifest)
+			if err != nil {
+				res = append(res, "Upload files of manifest "+msg.Manifest)
+			}
+			for _, e := range entries {
+				mode, owner := e.Mode, e.Owner
+				if mode == "" {
+					mode = msg.Mode
+				}
+				if owner == "" {
+					owner = msg.Owner
+				}
+				upload := "Upload " + e.Source + " to " + e.Target
+				if mode != "" {
+					upload += " with mode " + mode
+				}
+				if owner != "" {
+					upload += " with owner " + owner
+				}
+				res = append(res, upload)
+			}
+			break
+		}
+		source := msg.Source
+		if len(msg.Sources) > 0 {
+			source = strings.Join(msg.Sources, ", ")
+		} else if source == dataSource {
+			source = fmt.Sprintf("%d bytes of Data", len(msg.Data))
+		}
+		upload := "Upload " + source + " to " + msg.Target
+		if msg.Mirror {
+			upload = "Mirror " + source + " to " + msg.Target
+			if msg.MirrorDelete {
+				upload += " deleting extraneous files"
+			}
+			if msg.MirrorPlan {
+				upload += " (only plan)"
+			}
+		}
+		if msg.Mode != "" {
+			upload += " with mode " + msg.Mode
+		}
+		if msg.Owner != "" {
+			upload += " with owner " + msg.Owner
+		}
+		if msg.Sudo {
+			upload += " using sudo"
+		}
+		if msg.Transfer != "" && msg.Transfer != transferAuto {
+			upload += " over " + msg.Transfer
+		}
+		if msg.Relay > 0 {
+			upload += fmt.Sprintf(", relayed between hosts with fan-out %d", msg.Relay)
+		}
+		res = append(res, upload)
+	case "download":
+		if msg.Recursive {
+			res = append(res, "Download directory "+msg.Source+" with tar to "+filepath.Join(msg.Target, "<host>", path.Base(msg.Source)))
+		} else {
+			res = append(res, "Download "+msg.Source+" to "+filepath.Join(msg.Target, "<host>"))
+		}
+	case "forward":
+		if msg.LocalForward != "" {
+			res = append(res, "Forward local "+msg.LocalForward)
+		}
+		if msg.RemoteForward != "" {
+			res = append(res, "Forward remote "+msg.RemoteForward)
+		}
+	case "unforward":
+		res = append(res, "Close forwarded ports")
+	case "facts":
+		res = append(res, "Gather facts")
+	case "ping":
+		res = append(res, "Connect and authenticate")
+	case "reboot":
+		cmd := msg.Cmd
+		if cmd == "" {
+			cmd = defaultRebootCmd
+		}
+		res = append(res, fmt.Sprintf("Reboot with %s and wait up to %s for host to come back", cmd, rebootWait(msg)))
+	case "service":
+		res = append(res, fmt.Sprintf("Detect init system and %s service %s", msg.Operation, msg.Service))
+	case "pkg":
+		res = append(res, fmt.Sprintf("Detect package manager and %s packages %s", msg.Operation, strings.Join(msg.Packages, ", ")))
+	}
+
+	if len(msg.Env) > 0 {
+		res = append(res, fmt.Sprintf("Environment: %v", msg.Env))
+	}
+	if msg.Pty {
+		res = append(res, "Allocate pty")
+	}
+	if summary, lines, _ := requestSummary(msg); summary && (msg.Action == "ssh" || msg.Action == "script") {
+		res = append(res, fmt.Sprintf("Report only sizes of output with %d first and last lines", lines))
+	}
+	if msg.Stdin != "" || msg.StdinFile != "" {
+		res = append(res, "Send data to stdin")
+	}
+	if then, onFail := requestFollowUps(msg); msg.Action == "ssh" || msg.Action == "script" {
+		if then != "" {
+			res = append(res, "Then: "+then)
+		}
+		if onFail != "" {
+			res = append(res, "On failure: "+onFail)
+		}
+	}
+	if session != nil {
+		for _, cmd := range session.teardown {
+			res = append(res, "Teardown: "+cmd)
+		}
+	}
+
+	return strings.Join(res, "\n") + "\n"
+}
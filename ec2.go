@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EC2 host source: "ec2:<tag>=<value>,...?region=<region>&address=private|public|private-dns|public-dns"
+// returns addresses of running instances that have all specified tags. Credentials are taken from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+
+const ec2APIVersion = "2016-11-15"
+
+type (
+	awsCredentials struct {
+		accessKey    string
+		secretKey    string
+		sessionToken string
+	}
+
+	ec2Instance struct {
+		PrivateIP  string `xml:"privateIpAddress"`
+		PublicIP   string `xml:"ipAddress"`
+		PrivateDNS string `xml:"privateDnsName"`
+		PublicDNS  string `xml:"dnsName"`
+	}
+
+	ec2DescribeInstancesResponse struct {
+		Reservations []struct {
+			Instances []ec2Instance `xml:"instancesSet>item"`
+		} `xml:"reservationSet>item"`
+		NextToken string `xml:"nextToken"`
+	}
+
+	ec2ErrorResponse struct {
+		Errors []struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		} `xml:"Errors>Error"`
+	}
+)
+
+func awsCredentialsFromEnv() (*awsCredentials, error) {
+	creds := &awsCredentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+
+	return creds, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsQueryEscape escapes string as required by AWS Signature Version 4 (RFC 3986 unreserved characters are kept)
+func awsQueryEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// signAWSRequest adds AWS Signature Version 4 authentication headers to req
+func signAWSRequest(req *http.Request, body []byte, service, region string, creds *awsCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	var headerNames []string
+	for k := range headers {
+		headerNames = append(headerNames, k)
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders string
+	for _, k := range headerNames {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	query := req.URL.Query()
+	var queryParts []string
+	for k, values := range query {
+		for _, v := range values {
+			queryParts = append(queryParts, awsQueryEscape(k)+"="+awsQueryEscape(v))
+		}
+	}
+	sort.Strings(queryParts)
+
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		strings.Join(queryParts, "&"),
+		canonicalHeaders,
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, stringToSign)))
+}
+
+// ec2Hosts returns addresses of running instances matching tag filters of ec2 host source
+func ec2Hosts(u *url.URL) ([]string, error) {
+	params := u.Query()
+
+	region := params.Get("region")
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region == "" {
+			region = os.Getenv(env)
+		}
+	}
+	if region == "" {
+		return nil, errors.New("region is not specified (use ?region=... or AWS_REGION)")
+	}
+
+	address := params.Get("address")
+	if address == "" {
+		address = "private"
+	}
+
+	switch address {
+	case "private", "public", "private-dns", "public-dns":
+	default:
+		return nil, errors.New("unsupported address type: " + address)
+	}
+
+	creds, err := awsCredentialsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_EC2")
+	if endpoint == "" {
+		endpoint = "https://ec2." + region + ".amazonaws.com/"
+	}
+
+	query := url.Values{}
+	query.Set("Action", "DescribeInstances")
+	query.Set("Version", ec2APIVersion)
+	query.Set("Filter.1.Name", "instance-state-name")
+	query.Set("Filter.1.Value.1", "running")
+
+	filterNum := 2
+	if u.Opaque != "" {
+		for _, tag := range strings.Split(u.Opaque, ",") {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, errors.New("expected <tag>=<value>, got " + tag)
+			}
+
+			query.Set(fmt.Sprintf("Filter.%d.Name", filterNum), "tag:"+kv[0])
+			query.Set(fmt.Sprintf("Filter.%d.Value.1", filterNum), kv[1])
+			filterNum++
+		}
+	}
+
+	var hosts []string
+
+	for {
+		resp, err := ec2Request(endpoint, query, region, creds)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range resp.Reservations {
+			for _, inst := range r.Instances {
+				addr := map[string]string{
+					"private":     inst.PrivateIP,
+					"public":      inst.PublicIP,
+					"private-dns": inst.PrivateDNS,
+					"public-dns":  inst.PublicDNS,
+				}[address]
+
+				if addr != "" {
+					hosts = append(hosts, addr)
+				}
+			}
+		}
+
+		if resp.NextToken == "" {
+			break
+		}
+		query.Set("NextToken", resp.NextToken)
+	}
+
+	return hosts, nil
+}
+
+func ec2Request(endpoint string, query url.Values, region string, creds *awsCredentials) (*ec2DescribeInstancesResponse, error) {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = query.Encode()
+
+	signAWSRequest(req, nil, "ec2", region, creds, time.Now())
+
+	resp, err := httpAPIClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp ec2ErrorResponse
+		if xml.Unmarshal(body, &errResp) == nil && len(errResp.Errors) > 0 {
+			return nil, errors.New(errResp.Errors[0].Code + ": " + errResp.Errors[0].Message)
+		}
+		return nil, errors.New("EC2 API returned " + resp.Status)
+	}
+
+	res := new(ec2DescribeInstancesResponse)
+	if err := xml.Unmarshal(body, res); err != nil {
+		return nil, errors.New("Cannot parse EC2 response: " + err.Error())
+	}
+
+	return res, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAWSRequest(t *testing.T) {
+	// example from AWS Signature Version 4 documentation
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	creds := &awsCredentials{accessKey: "AKIDEXAMPLE", secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signAWSRequest(req, nil, "iam", "us-east-1", creds, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+
+	if got := req.Header.Get("Authorization"); got != expected {
+		t.Fatalf("Unexpected Authorization header: %s", got)
+	}
+}
+
+func TestEC2Hosts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if q.Get("Filter.2.Name") != "tag:role" || q.Get("Filter.2.Value.1") != "web" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<Response><Errors><Error><Code>InvalidParameterValue</Code><Message>bad filter</Message></Error></Errors></Response>`)
+			return
+		}
+
+		ip, next := "10.0.0.1", "<nextToken>page2</nextToken>"
+		if q.Get("NextToken") == "page2" {
+			ip, next = "10.0.0.2", ""
+		}
+
+		fmt.Fprintf(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet>
+			<item><privateIpAddress>%s</privateIpAddress><ipAddress>1.2.3.4</ipAddress></item>
+			<item><ipAddress>1.2.3.5</ipAddress></item>
+			</instancesSet></item></reservationSet>%s</DescribeInstancesResponse>`, ip, next)
+	}))
+	defer srv.Close()
+
+	for k, v := range map[string]string{"AWS_ENDPOINT_URL_EC2": srv.URL, "AWS_ACCESS_KEY_ID": "key", "AWS_SECRET_ACCESS_KEY": "secret"} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	u, _ := url.Parse("ec2:role=web?region=eu-west-1")
+	hosts, err := ec2Hosts(u)
+	if err != nil {
+		t.Fatalf("Could not get EC2 hosts: %s", err)
+	}
+
+	if expected := []string{"10.0.0.1", "10.0.0.2"}; !reflect.DeepEqual(hosts, expected) {
+		t.Fatalf("Unexpected EC2 hosts: %v", hosts)
+	}
+
+	u, _ = url.Parse("ec2:env=prod?region=eu-west-1")
+	if _, err := ec2Hosts(u); err == nil || !strings.Contains(err.Error(), "bad filter") {
+		t.Fatalf("Expected EC2 API error, got %v", err)
+	}
+}
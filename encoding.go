@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
+)
+
+// Output encoding ("RemoteEncoding", gossha_remote_encoding inventory variable or -remote-encoding):
+// output of commands on hosts that do not use UTF-8 (e.g. Latin-1, Windows-1252, GBK or Shift_JIS)
+// is converted to UTF-8 with decoders of golang.org/x/text before it is sent in replies and output
+// chunks. Every output stream has its own decoder, so characters split between chunks are kept
+// whole. "StripANSI" (or -strip-ansi) removes ANSI escape sequences (colors, cursor movement) from
+// output, by default they are kept as is.
+
+var (
+	remoteEncodingDefault string // -remote-encoding
+	stripANSIDefault      bool   // -strip-ansi
+)
+
+// ansiEscape matches CSI (e.g. colors), OSC (e.g. window title) and other escape sequences (e.g. charset selection)
+var ansiEscape = regexp.MustCompile("\x1b(\\[[0-?]*[ -/]*[@-~]|\\][^\x07\x1b]*(\x07|\x1b\\\\)|[ -/]*[0-~])")
+
+// encodingName returns canonical name of encodings that are looked up by hand ("utf-8", "latin1" or "cp1252") or name as is
+func encodingName(name string) string {
+	switch strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(name)) {
+	case "", "utf8":
+		return "utf-8"
+	case "latin1", "iso88591", "l1":
+		return "latin1" // WHATWG treats it as Windows-1252
+	case "cp1252", "windows1252":
+		return "cp1252"
+	}
+	return name
+}
+
+// lookupEncoding returns decoder of encoding by IANA name or WHATWG label (e.g. "sjis"), nil for UTF-8
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	switch name = encodingName(name); name {
+	case "utf-8":
+		return nil, nil
+	case "latin1":
+		return charmap.ISO8859_1, nil
+	case "cp1252":
+		return charmap.Windows1252, nil
+	}
+
+	if e, err := ianaindex.IANA.Encoding(name); err == nil && e != nil {
+		return e, nil
+	}
+	if e, err := htmlindex.Get(name); err == nil {
+		return e, nil
+	}
+	return nil, errors.New("Unsupported remote encoding " + name)
+}
+
+// checkEncoding returns error if output in encoding cannot be converted
+func checkEncoding(encoding string) error {
+	_, err := lookupEncoding(encoding)
+	return err
+}
+
+// outputDecoder converts output of host to UTF-8 text
+type outputDecoder struct {
+	charset   encoding.Encoding // nil if output is in UTF-8
+	stripANSI bool
+}
+
+// newOutputDecoder returns decoder for output of hostname, nil if output is sent as is; encoding
+// is set by request, inventory and -remote-encoding in order of precedence
+func newOutputDecoder(opts *cmdOptions, hostname string) *outputDecoder {
+	name := opts.encoding
+	if name == "" {
+		name = hostOptionsOf(hostname).encoding
+	}
+	if name == "" {
+		name = remoteEncodingDefault
+	}
+
+	charset, _ := lookupEncoding(name) // names are checked when requests and inventory are read
+	d := &outputDecoder{charset: charset, stripANSI: opts.stripANSI || stripANSIDefault}
+	if d.charset == nil && !d.stripANSI {
+		return nil
+	}
+	return d
+}
+
+// decode converts complete output s to UTF-8 and strips escape sequences if needed
+func (d *outputDecoder) decode(s string) string {
+	if d == nil {
+		return s
+	}
+	if d.charset != nil {
+		if out, err := d.charset.NewDecoder().String(s); err == nil {
+			s = out
+		}
+	}
+	return d.strip(s)
+}
+
+// strip removes escape sequences from s if needed
+func (d *outputDecoder) strip(s string) string {
+	if d != nil && d.stripANSI {
+		return ansiEscape.ReplaceAllString(s, "")
+	}
+	return s
+}
+
+// streamConverter converts chunks of one output stream with a single decoder, so that characters
+// (and shift states of encodings like ISO-2022-JP) that are split between chunks are converted correctly
+type streamConverter struct {
+	t    transform.Transformer
+	rest []byte // beginning of a character at the end of the previous chunk
+}
+
+// newStreamConverter returns converter for a stream of output, nil if it is in UTF-8
+func (d *outputDecoder) newStreamConverter() *streamConverter {
+	if d == nil || d.charset == nil {
+		return nil
+	}
+	return &streamConverter{t: d.charset.NewDecoder()}
+}
+
+// convert returns chunk p in UTF-8, incomplete character at the end of it is kept for the next chunk unless atEOF
+func (c *streamConverter) convert(p []byte, atEOF bool) string {
+	src := append(c.rest, p...)
+	c.rest = nil
+
+	var out []byte
+	dst := make([]byte, 2*len(src)+utf8.UTFMax)
+	for {
+		nDst, nSrc, err := c.t.Transform(dst, src, atEOF)
+		out = append(out, dst[:nDst]...)
+		src = src[nSrc:]
+		if err != transform.ErrShortDst || nDst == 0 && nSrc == 0 {
+			break
+		}
+	}
+	if !atEOF {
+		c.rest = append(c.rest, src...)
+	}
+	return string(out)
+}
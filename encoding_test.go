@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestOutputDecoder(t *testing.T) {
+	for _, c := range []struct {
+		encoding  string
+		stripANSI bool
+		in, out   string
+	}{
+		{"utf-8", true, "\x1b[1;31mred\x1b[0m \x1b]0;title\x07ok\x1b(B\n", "red ok\n"},
+		{"ISO-8859-1", false, "caf\xe9 \x1b[1m\n", "café \x1b[1m\n"},
+		{"windows-1252", false, "\x93quoted\x94 \x80 \xe9", "“quoted” € é"},
+		{"GBK", false, "\xc4\xe3\xba\xc3", "你好"},
+		{"Shift_JIS", false, "\x82\xb1\x82\xf1", "こん"},
+		{"KOI8-R", false, "\xf0\xd2\xc9", "При"},
+	} {
+		d := newOutputDecoder(&cmdOptions{encoding: c.encoding, stripANSI: c.stripANSI}, "")
+		if res := d.decode(c.in); res != c.out {
+			t.Errorf("Unexpected output in %s: %q instead of %q", c.encoding, res, c.out)
+		}
+	}
+
+	if newOutputDecoder(&cmdOptions{encoding: "UTF8"}, "") != nil {
+		t.Errorf("UTF-8 output must be sent as is")
+	}
+	if err := checkEncoding("no-such-encoding"); err == nil {
+		t.Errorf("Unknown encoding must be rejected")
+	}
+}
+
+func TestRemoteEncoding(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-encoding", 1)
+
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: `printf '\033[32m\351t\351\033[0m\n'`, RemoteEncoding: "latin1", StripANSI: true, Stream: true})
+	for addr, reply := range r.replies {
+		if reply.Stdout != "été\n" {
+			t.Fatalf("Unexpected output of %s: %q", addr, reply.Stdout)
+		}
+	}
+}
+
+func TestStreamConverter(t *testing.T) {
+	d := newOutputDecoder(&cmdOptions{encoding: "GBK"}, "")
+	c := d.newStreamConverter()
+
+	// "你好" split in the middle of the second character
+	if out := c.convert([]byte("\xc4\xe3\xba"), false); out != "你" {
+		t.Fatalf("Unexpected first chunk %q", out)
+	}
+	if out := c.convert([]byte("\xc3\n"), false); out != "好\n" {
+		t.Fatalf("Unexpected second chunk %q", out)
+	}
+	if out := c.convert([]byte("\xc4"), true); out != "�" {
+		t.Fatalf("Incomplete character at the end must be replaced, got %q", out)
+	}
+
+	if newOutputDecoder(&cmdOptions{stripANSI: true}, "").newStreamConverter() != nil {
+		t.Errorf("UTF-8 output must not be converted")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Error kinds ("ErrorKind" of replies) tell what failed on host, so that automation does not
+// have to parse error messages.
+const (
+	errorKindDNS              = "dns"                  // host name cannot be resolved
+	errorKindConnectTimeout   = "connect-timeout"      // connection or handshake timed out
+	errorKindConnect          = "connect"              // connection was refused or failed otherwise
+	errorKindAuth             = "auth"                 // all authentication methods were rejected
+	errorKindHostKey          = "host-key-mismatch"    // host key is not trusted
+	errorKindExit             = "command-nonzero-exit" // command exited with non-zero status or by signal
+	errorKindTimeout          = "command-timeout"      // action did not finish in gossha_timeout
+	errorKindDisconnected     = "disconnected"         // connection was lost while action was running
+	errorKindUnexpectedOutput = "unexpected-output"    // output does not match Expect
+	errorKindTransfer         = "transfer"             // upload or download failed
+	errorKindCircuitOpen      = "circuit-open"         // host was not connected to after repeated failures (see circuitBreaker)
+	errorKindOther            = "other"
+)
+
+type (
+	// hostKeyError is a rejection of host key by hostKeyCallback
+	hostKeyError struct {
+		msg string
+	}
+
+	// hostTimeoutError is returned for hosts which action did not finish in time
+	hostTimeoutError struct {
+		msg string
+	}
+)
+
+func (e *hostKeyError) Error() string {
+	return e.msg
+}
+
+func (e *hostTimeoutError) Error() string {
+	return e.msg
+}
+
+// errorKind classifies error of action on host, empty string is returned for nil
+func errorKind(err error, action string) string {
+	if err == nil {
+		return ""
+	}
+
+	var (
+		circuitOpen  *circuitOpenError
+		mismatch     *mismatchError
+		timeout      *hostTimeoutError
+		disconnected *disconnectedError
+		exitErr      *ssh.ExitError
+		hostKey      *hostKeyError
+		dnsErr       *net.DNSError
+		netErr       net.Error
+		opErr        *net.OpError
+	)
+
+	switch {
+	case errors.As(err, &circuitOpen):
+		return errorKindCircuitOpen
+	case errors.As(err, &mismatch):
+		return errorKindUnexpectedOutput
+	case errors.As(err, &timeout):
+		return errorKindTimeout
+	case errors.As(err, &disconnected):
+		return errorKindDisconnected
+	case errors.As(err, &exitErr):
+		return errorKindExit
+	case errors.As(err, &hostKey):
+		return errorKindHostKey
+	case errors.As(err, &dnsErr):
+		return errorKindDNS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errorKindConnectTimeout // there are no deadlines after connection is established
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return errorKindConnect
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return errorKindAuth
+	case strings.HasPrefix(err.Error(), "ssh: handshake failed") || strings.HasPrefix(err.Error(), "Cannot connect to"):
+		return errorKindConnect
+	case action == "scp" || action == "download":
+		return errorKindTransfer
+	}
+
+	return errorKindOther
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestErrorKind(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		action string
+		kind   string
+	}{
+		{nil, "ssh", ""},
+		{&mismatchError{spec: "ok"}, "ssh", errorKindUnexpectedOutput},
+		{&hostTimeoutError{"Timed out after 1s"}, "ssh", errorKindTimeout},
+		{&disconnectedError{errors.New("EOF")}, "scp", errorKindDisconnected},
+		{fmt.Errorf("ssh: handshake failed: %w", &hostKeyError{"Host key was not accepted"}), "ssh", errorKindHostKey},
+		{fmt.Errorf("Cannot resolve host: %w", &net.DNSError{Err: "no such host", Name: "x", IsNotFound: true}), "ssh", errorKindDNS},
+		{&retryableError{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}, "ssh", errorKindConnect},
+		{errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey]"), "ssh", errorKindAuth},
+		{errors.New("Cannot connect to jump host bastion: EOF"), "ssh", errorKindConnect},
+		{errors.New("Cannot create target file: permission denied"), "scp", errorKindTransfer},
+		{errors.New("Empty output"), "ssh", errorKindOther},
+	} {
+		if kind := errorKind(tc.err, tc.action); kind != tc.kind {
+			t.Fatalf("Unexpected kind of %v: %q, expected %q", tc.err, kind, tc.kind)
+		}
+	}
+}
+
+func TestReplyErrorKind(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	must(err, "Could not listen")
+	closed := l.Addr().String()
+	l.Close()
+
+	r := makeTestResult()
+	startTestServers(r, "test-errkind", 1)
+	r.hostsLeft[closed] = struct{}{}
+
+	req := &ProxyRequest{Action: "ssh", Cmd: "exit 3", Timeout: uint64(maxTimeout / time.Millisecond)}
+	for h := range r.hostsLeft {
+		req.Hosts = append(req.Hosts, h)
+	}
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+
+	for hostname, reply := range r.replies {
+		expected := errorKindExit
+		if hostname == closed {
+			expected = errorKindConnect
+		}
+		if reply.ErrorKind != expected {
+			t.Fatalf("Unexpected kind of error of %s: %q (%s), expected %q", hostname, reply.ErrorKind, reply.ErrMsg, expected)
+		}
+	}
+}
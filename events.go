@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Event stream (-events or -output events): instead of replies, stdout gets a line of JSON for every
+// lifecycle event of hosts, so that external tools can show their own progress from a plain pipe:
+//
+//	{"Event":"connect-start","Time":"...","Hostname":"web1","Target":"10.0.0.1:22"}
+//	{"Event":"connect-ok","Time":"...","Hostname":"web1"}          TCP connection is established
+//	{"Event":"auth-ok","Time":"...","Hostname":"web1"}             key exchange and authentication succeeded
+//	{"Event":"exec-start","Time":"...","Hostname":"web1","Cmd":"uptime"}
+//	{"Event":"stdout-chunk","Time":"...","Hostname":"web1","Data":"..."} (and "stderr-chunk")
+//	{"Event":"exit","Time":"...","Hostname":"web1","Success":true,"ExitCode":0,"ErrMsg":""}
+//	{"Event":"done","Time":"...","TotalTime":1.5,"Stats":{...}}    action finished
+//
+// Output of commands is streamed (like with "Stream": true), connection events are only sent for
+// new connections. Other replies (errors, prompts) go to stderr as text.
+
+var eventsOutput bool // -events
+
+type (
+	// HostEvent is a lifecycle event of host that is sent with -events
+	HostEvent struct {
+		Event    string
+		Hostname string
+		Target   string `json:",omitempty"` // address that is connected to (only for "connect-start")
+		Cmd      string `json:",omitempty"` // command that is started (only for "exec-start")
+		at       time.Time
+	}
+
+	// eventLine is a line of event stream
+	eventLine struct {
+		Event     string
+		Time      string
+		Hostname  string    `json:",omitempty"`
+		Target    string    `json:",omitempty"`
+		Cmd       string    `json:",omitempty"`
+		Data      string    `json:",omitempty"`
+		Success   *bool     `json:",omitempty"`
+		ExitCode  *int      `json:",omitempty"`
+		ErrMsg    *string   `json:",omitempty"`
+		ErrorKind string    `json:",omitempty"`
+		Duration  *float64  `json:",omitempty"`
+		TotalTime *float64  `json:",omitempty"`
+		Stats     *RunStats `json:",omitempty"`
+	}
+
+	eventsRenderer struct {
+		stdout, stderr io.Writer
+	}
+)
+
+// sendHostEvent sends e if event stream is written
+func sendHostEvent(e *HostEvent) {
+	if eventsOutput {
+		e.at = time.Now()
+		sendProxyReply(e)
+	}
+}
+
+func (r *eventsRenderer) Render(reply interface{}) {
+	switch reply := reply.(type) {
+	case *HostEvent:
+		r.write(&eventLine{Event: reply.Event, Hostname: reply.Hostname, Target: reply.Target, Cmd: reply.Cmd}, reply.at)
+	case *OutputChunk:
+		r.write(&eventLine{Event: reply.Stream + "-chunk", Hostname: reply.Hostname, Data: reply.Data}, time.Now())
+	case *Reply:
+		r.write(&eventLine{Event: "exit", Hostname: reply.Hostname, Success: &reply.Success, ExitCode: &reply.ExitCode, ErrMsg: &reply.ErrMsg, ErrorKind: reply.ErrorKind, Duration: &reply.Duration}, time.Now())
+	case *GroupedReply:
+		for _, h := range reply.Hosts {
+			r.write(&eventLine{Event: "exit", Hostname: h, Success: &reply.Success, ExitCode: &reply.ExitCode, ErrMsg: &reply.ErrMsg, ErrorKind: reply.ErrorKind}, time.Now())
+		}
+	case *FinalReply:
+		r.write(&eventLine{Event: "done", TotalTime: &reply.TotalTime, Stats: reply.Stats}, time.Now())
+	case *ConnectionProgress, *RunProgress:
+		// connect-start and exit events tell the same
+	default:
+		writeReplyText(r.stderr, r.stderr, reply, "")
+	}
+}
+
+func (r *eventsRenderer) write(e *eventLine, at time.Time) {
+	e.Time = at.UTC().Format(time.RFC3339Nano)
+	buf, err := json.Marshal(e)
+	if err != nil {
+		panic("Could not marshal event: " + err.Error())
+	}
+	fmt.Fprintln(r.stdout, string(buf))
+}
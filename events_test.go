@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEventsRenderer(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	r := &eventsRenderer{stdout: &stdout, stderr: &stderr}
+	r.Render(&HostEvent{Event: "exec-start", Hostname: "web1", Cmd: "uptime"})
+	r.Render(&OutputChunk{Hostname: "web1", Stream: "stdout", Data: "up\n"})
+	r.Render(&Reply{Hostname: "web1", ExitCode: 1, ErrMsg: "Process exited with status 1"})
+	r.Render(&UserError{ErrorMsg: "warning"})
+	r.Render(&FinalReply{TotalTime: 1.5})
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Unexpected events: %s", stdout.String())
+	}
+
+	var events []map[string]interface{}
+	for _, ln := range lines {
+		var e map[string]interface{}
+		must(json.Unmarshal([]byte(ln), &e), "Could not parse event")
+		if _, ok := e["Time"].(string); !ok {
+			t.Fatalf("Event has no time: %s", ln)
+		}
+		events = append(events, e)
+	}
+
+	if events[0]["Event"] != "exec-start" || events[0]["Cmd"] != "uptime" || events[1]["Event"] != "stdout-chunk" || events[1]["Data"] != "up\n" {
+		t.Fatalf("Unexpected command events: %v", events[:2])
+	}
+	if events[2]["Event"] != "exit" || events[2]["Success"] != false || events[2]["ExitCode"] != 1.0 {
+		t.Fatalf("Unexpected exit event: %v", events[2])
+	}
+	if events[3]["Event"] != "done" || events[3]["TotalTime"] != 1.5 {
+		t.Fatalf("Unexpected done event: %v", events[3])
+	}
+	if !strings.Contains(stderr.String(), "warning") {
+		t.Fatalf("Errors must be written to stderr, got %q", stderr.String())
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Compliance checks ("Expect": "<string>" or "re:<regexp>"): stdout of command must contain the
+// string (or match the regular expression) on every host, hosts where command succeeded but
+// output does not match are failed, and FinalReply summarizes compliant and non-compliant hosts.
+
+var expectDefault string // expectation for requests that do not specify "Expect" (-expect)
+
+type (
+	// ComplianceSummary is a result of Expect check sent in FinalReply
+	ComplianceSummary struct {
+		Compliant         int      // number of hosts which output matched
+		NonCompliantHosts []string // hosts which output did not match
+		UncheckedHosts    []string // hosts where command failed, timed out or was not started
+	}
+
+	// expectation is a compiled "Expect" of request
+	expectation struct {
+		spec string
+		re   *regexp.Regexp // nil if output must contain spec
+	}
+
+	// mismatchError marks host which output does not match expectation
+	mismatchError struct {
+		spec string
+	}
+)
+
+func (e *mismatchError) Error() string {
+	return "Output does not match expectation " + e.spec
+}
+
+// newExpectation parses spec for request msg, nil is returned if nothing is expected
+func newExpectation(msg *ProxyRequest) (*expectation, error) {
+	spec := msg.Expect
+	if spec == "" {
+		spec = expectDefault
+	}
+	if spec == "" {
+		return nil, nil
+	}
+
+	if msg.Action != "ssh" && msg.Action != "script" {
+		return nil, errors.New("Expect is only supported for ssh and script actions")
+	}
+
+	e := &expectation{spec: spec}
+	if strings.HasPrefix(spec, "re:") {
+		re, err := regexp.Compile(strings.TrimPrefix(spec, "re:"))
+		if err != nil {
+			return nil, errors.New("Invalid Expect regular expression: " + err.Error())
+		}
+		e.re = re
+	}
+	return e, nil
+}
+
+func (e *expectation) matches(output string) bool {
+	if e.re != nil {
+		return e.re.MatchString(output)
+	}
+	return strings.Contains(output, e.spec)
+}
+
+// withExpectation fails hosts where action succeeded but output does not match e
+func withExpectation(e *expectation, execFunc func(string) *SshResult) func(string) *SshResult {
+	if e == nil {
+		return execFunc
+	}
+
+	return func(hostname string) *SshResult {
+		res := execFunc(hostname)
+		if res.err == nil && !e.matches(res.stdout) {
+			res.err = &mismatchError{spec: e.spec}
+		}
+		return res
+	}
+}
+
+// complianceSummary counts results of Expect check, hosts that did not finish are unchecked
+func complianceSummary(results map[string]error, hosts []string) *ComplianceSummary {
+	s := &ComplianceSummary{NonCompliantHosts: []string{}, UncheckedHosts: []string{}}
+	for _, h := range hosts {
+		err, ok := results[h]
+		var mismatch *mismatchError
+		switch {
+		case ok && err == nil:
+			s.Compliant++
+		case ok && errors.As(err, &mismatch):
+			s.NonCompliantHosts = append(s.NonCompliantHosts, h)
+		default:
+			s.UncheckedHosts = append(s.UncheckedHosts, h)
+		}
+	}
+	sort.Strings(s.NonCompliantHosts)
+	sort.Strings(s.UncheckedHosts)
+	return s
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpect(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-expect", 3)
+
+	req := makeProxyRequest(maxTimeout)
+	req.Expect = "re:-[01]$"
+	var nonCompliant string
+	for addr, srv := range r.hosts {
+		req.Hosts = append(req.Hosts, addr)
+		if srv.hostname == "test-expect-2" {
+			nonCompliant = addr
+		}
+	}
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+
+	for addr, reply := range r.replies {
+		if addr == nonCompliant {
+			if reply.Success || reply.ExitCode != 0 || reply.ErrMsg != "Output does not match expectation re:-[01]$" {
+				t.Fatalf("Host with other output must fail: %+v", reply)
+			}
+		} else if !reply.Success {
+			t.Fatalf("Host with matching output must succeed: %+v", reply)
+		}
+	}
+
+	expected := &ComplianceSummary{Compliant: 2, NonCompliantHosts: []string{nonCompliant}, UncheckedHosts: []string{}}
+	if !reflect.DeepEqual(r.final.Compliance, expected) {
+		t.Fatalf("Unexpected compliance summary: %+v", r.final.Compliance)
+	}
+
+	for _, bad := range []*ProxyRequest{{Action: "scp", Expect: "x"}, {Action: "ssh", Expect: "re:("}} {
+		if _, err := newExpectation(bad); err == nil {
+			t.Fatalf("Invalid expectation must be rejected: %+v", bad)
+		}
+	}
+}
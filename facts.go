@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+)
+
+// Facts gathering (Action == "facts"): a fixed set of probes is run in a single session on
+// every host and parsed into HostFacts, which is sent in Reply. Probes that are not available
+// on the host (e.g. /proc on BSD) are skipped and corresponding facts are left empty.
+
+const factsSectionPrefix = "== gossha:"
+
+// factsScript prints output of every probe after "== gossha:<name>" header
+var factsScript = strings.Join([]string{
+	"echo '" + factsSectionPrefix + "uname'; uname -snrm",
+	"echo '" + factsSectionPrefix + "os-release'; cat /etc/os-release",
+	"echo '" + factsSectionPrefix + "uptime'; cat /proc/uptime",
+	"echo '" + factsSectionPrefix + "meminfo'; cat /proc/meminfo",
+	"echo '" + factsSectionPrefix + "df'; df -P -k",
+	"echo '" + factsSectionPrefix + "addresses'; { ip -o addr show || ifconfig -a; }",
+}, " 2>/dev/null; ") + " 2>/dev/null; true"
+
+type (
+	HostFacts struct {
+		Hostname      string
+		Kernel        string // e.g. "Linux"
+		KernelRelease string
+		Arch          string
+		OS            string            `json:",omitempty"` // PRETTY_NAME from /etc/os-release
+		OSRelease     map[string]string `json:",omitempty"` // all fields of /etc/os-release
+		Uptime        float64           // in seconds, 0 if unknown
+		MemTotal      uint64            // in bytes, 0 if unknown
+		MemAvailable  uint64
+		Disks         []*DiskFacts `json:",omitempty"`
+		Addresses     []string     `json:",omitempty"` // non-loopback IPv4 and IPv6 addresses
+	}
+
+	DiskFacts struct {
+		Filesystem string
+		Mount      string
+		Size       uint64 // in bytes
+		Used       uint64
+		Available  uint64
+	}
+)
+
+func gatherFacts(opts *cmdOptions, hostname string) *SshResult {
+	stdout, stderr, err := executeCmd(factsScript, opts, hostname)
+	if err != nil {
+		return &SshResult{hostname: hostname, stdout: stdout, stderr: stderr, err: err}
+	}
+
+	return &SshResult{hostname: hostname, stderr: stderr, facts: parseFacts(stdout)}
+}
+
+// parseFacts parses output of factsScript
+func parseFacts(out string) *HostFacts {
+	facts := &HostFacts{}
+	sections := make(map[string][]string)
+
+	var section string
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		ln := scanner.Text()
+		if strings.HasPrefix(ln, factsSectionPrefix) {
+			section = strings.TrimPrefix(ln, factsSectionPrefix)
+			continue
+		}
+		sections[section] = append(sections[section], ln)
+	}
+
+	if uname := sections["uname"]; len(uname) > 0 {
+		fields := strings.Fields(uname[0])
+		if len(fields) == 4 {
+			facts.Kernel, facts.Hostname, facts.KernelRelease, facts.Arch = fields[0], fields[1], fields[2], fields[3]
+		}
+	}
+
+	for _, ln := range sections["os-release"] {
+		kv := strings.SplitN(ln, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		if facts.OSRelease == nil {
+			facts.OSRelease = make(map[string]string)
+		}
+		facts.OSRelease[kv[0]] = strings.Trim(kv[1], `"'`)
+	}
+	facts.OS = facts.OSRelease["PRETTY_NAME"]
+
+	if uptime := sections["uptime"]; len(uptime) > 0 {
+		if fields := strings.Fields(uptime[0]); len(fields) > 0 {
+			facts.Uptime, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+
+	for _, ln := range sections["meminfo"] {
+		fields := strings.Fields(ln)
+		if len(fields) < 2 {
+			continue
+		}
+		kb, _ := strconv.ParseUint(fields[1], 10, 64)
+		switch fields[0] {
+		case "MemTotal:":
+			facts.MemTotal = kb << 10
+		case "MemAvailable:":
+			facts.MemAvailable = kb << 10
+		}
+	}
+
+	for i, ln := range sections["df"] {
+		fields := strings.Fields(ln)
+		if i == 0 || len(fields) < 6 {
+			continue // header
+		}
+		disk := &DiskFacts{Filesystem: fields[0], Mount: strings.Join(fields[5:], " ")}
+		disk.Size, _ = strconv.ParseUint(fields[1], 10, 64)
+		disk.Used, _ = strconv.ParseUint(fields[2], 10, 64)
+		disk.Available, _ = strconv.ParseUint(fields[3], 10, 64)
+		disk.Size, disk.Used, disk.Available = disk.Size<<10, disk.Used<<10, disk.Available<<10
+		facts.Disks = append(facts.Disks, disk)
+	}
+
+	facts.Addresses = parseAddresses(sections["addresses"])
+
+	return facts
+}
+
+// parseAddresses extracts addresses from "ip -o addr show" or "ifconfig -a" output
+func parseAddresses(lines []string) (res []string) {
+	seen := make(map[string]bool)
+
+	for _, ln := range lines {
+		fields := strings.Fields(ln)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] != "inet" && fields[i] != "inet6" {
+				continue
+			}
+
+			addr := strings.TrimPrefix(fields[i+1], "addr:")
+			if idx := strings.IndexAny(addr, "/%"); idx >= 0 {
+				addr = addr[:idx]
+			}
+
+			if addr == "" || addr == "::1" || strings.HasPrefix(addr, "127.") || seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			res = append(res, addr)
+		}
+	}
+
+	return
+}
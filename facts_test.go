@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testFactsOutput = `== gossha:uname
+Linux web1 5.15.0-91-generic x86_64
+== gossha:os-release
+PRETTY_NAME="Ubuntu 22.04.3 LTS"
+ID=ubuntu
+== gossha:uptime
+86400.50 170000.00
+== gossha:meminfo
+MemTotal:        8136128 kB
+MemFree:          512000 kB
+MemAvailable:    6065538 kB
+== gossha:df
+Filesystem     1024-blocks     Used Available Capacity Mounted on
+/dev/sda1         49433805 11766172  37651760      24% /
+tmpfs                 1024        0      1024       0% /mnt/with space
+== gossha:addresses
+1: lo    inet 127.0.0.1/8 scope host lo\       valid_lft forever preferred_lft forever
+2: eth0    inet 10.0.0.5/24 brd 10.0.0.255 scope global eth0\       valid_lft forever preferred_lft forever
+2: eth0    inet6 fe80::1/64 scope link \       valid_lft forever preferred_lft forever
+`
+
+func TestParseFacts(t *testing.T) {
+	facts := parseFacts(testFactsOutput)
+
+	expected := &HostFacts{
+		Hostname:      "web1",
+		Kernel:        "Linux",
+		KernelRelease: "5.15.0-91-generic",
+		Arch:          "x86_64",
+		OS:            "Ubuntu 22.04.3 LTS",
+		OSRelease:     map[string]string{"PRETTY_NAME": "Ubuntu 22.04.3 LTS", "ID": "ubuntu"},
+		Uptime:        86400.5,
+		MemTotal:      8136128 << 10,
+		MemAvailable:  6065538 << 10,
+		Disks: []*DiskFacts{
+			{Filesystem: "/dev/sda1", Mount: "/", Size: 49433805 << 10, Used: 11766172 << 10, Available: 37651760 << 10},
+			{Filesystem: "tmpfs", Mount: "/mnt/with space", Size: 1024 << 10, Available: 1024 << 10},
+		},
+		Addresses: []string{"10.0.0.5", "fe80::1"},
+	}
+
+	if !reflect.DeepEqual(facts, expected) {
+		t.Fatalf("Unexpected facts: %+v", facts)
+	}
+
+	ifconfig := []string{
+		"lo0: flags=8049<UP,LOOPBACK,RUNNING,MULTICAST> mtu 16384",
+		"	inet 127.0.0.1 netmask 0xff000000",
+		"	inet6 fe80::1%lo0 prefixlen 64 scopeid 0x1",
+		"eth0      Link encap:Ethernet  HWaddr 00:00:00:00:00:00",
+		"          inet addr:192.168.1.2  Bcast:192.168.1.255  Mask:255.255.255.0",
+	}
+	if addrs := parseAddresses(ifconfig); !reflect.DeepEqual(addrs, []string{"fe80::1", "192.168.1.2"}) {
+		t.Fatalf("Unexpected addresses from ifconfig: %v", addrs)
+	}
+}
+
+func TestGatherFacts(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-facts", 2)
+	runTestRequest(t, r, &ProxyRequest{Action: "facts"})
+
+	for addr, reply := range r.replies {
+		if reply.Facts == nil || reply.Facts.Kernel == "" || reply.Facts.Hostname == "" {
+			t.Fatalf("Expected facts from %s, got %+v", addr, reply.Facts)
+		}
+	}
+}
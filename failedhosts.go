@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Retrying failed hosts: with -failed-hosts FILE hosts where action did not succeed (failed,
+// timed out, interrupted or skipped) are written to FILE one per line after every action, and
+// -retry-from FILE restricts all requests to hosts listed in FILE, so that only they are re-run.
+
+var (
+	failedHostsFile string   // file to write hosts that did not succeed to (-failed-hosts)
+	retryFromFile   string   // file with hosts to restrict requests to (-retry-from)
+	retryHosts      []string // contents of retryFromFile
+)
+
+// readHostsFile reads hosts from file with one host per line, empty lines and lines starting with "#" are skipped
+func readHostsFile(filename string) (hosts []string, err error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.New("Cannot read hosts: " + err.Error())
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		if ln := strings.TrimSpace(scanner.Text()); ln != "" && !strings.HasPrefix(ln, "#") {
+			hosts = append(hosts, ln)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.New("Cannot read hosts: " + err.Error())
+	}
+
+	return hosts, nil
+}
+
+// filterRetryHosts returns hosts of request that are listed in -retry-from file,
+// request without hosts is run on all listed hosts
+func filterRetryHosts(hosts []string) []string {
+	if retryFromFile == "" {
+		return hosts
+	}
+	if len(hosts) == 0 {
+		return retryHosts
+	}
+
+	listed := make(map[string]bool, len(retryHosts))
+	for _, h := range retryHosts {
+		listed[h] = true
+	}
+
+	res := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		if listed[h] {
+			res = append(res, h)
+		}
+	}
+	return res
+}
+
+// writeFailedHosts replaces contents of filename with hosts that did not succeed in order of request;
+// file is replaced atomically, so that it can be used with -retry-from of the same session
+func writeFailedHosts(filename string, hosts []string, failed map[string]bool) error {
+	var buf strings.Builder
+	for _, h := range hosts {
+		if failed[h] {
+			buf.WriteString(h + "\n")
+		}
+	}
+
+	if err := replaceFile(filename, []byte(buf.String())); err != nil {
+		return errors.New("Cannot write failed hosts: " + err.Error())
+	}
+	return nil
+}
+
+// replaceFile atomically replaces contents of filename with data, so that readers never see partial contents
+func replaceFile(filename string, data []byte) error {
+	return replaceFileMode(filename, data, 0644)
+}
+
+// replaceFileMode is replaceFile for file with permissions mode (until it is renamed, only owner can read it)
+func replaceFileMode(filename string, data []byte, mode os.FileMode) error {
+	tmpfp, err := ioutil.TempFile(filepath.Dir(filename), ".gossha-"+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfp.Name())
+
+	if _, err = tmpfp.Write(data); err == nil {
+		err = tmpfp.Chmod(mode)
+	}
+	if closeErr := tmpfp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpfp.Name(), filename)
+	}
+	return err
+}
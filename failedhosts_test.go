@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRetryFailedHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossha-failed-hosts")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	r := makeTestResult()
+	var failedAddr string
+	for i, srv := range []*testSSHServer{{hostname: "test-failed-0"}, {hostname: "test-failed-1", exitStatus: 1}, {hostname: "test-failed-2"}} {
+		srv.start()
+		r.hosts[srv.addr] = srv
+		if i == 1 {
+			failedAddr = srv.addr
+		}
+	}
+
+	hosts := make([]string, 0, len(r.hosts))
+	for addr := range r.hosts {
+		hosts = append(hosts, addr)
+		r.hostsLeft[addr] = struct{}{}
+	}
+
+	failedHostsFile = filepath.Join(dir, "failed.txt")
+	defer func() { failedHostsFile, retryFromFile, retryHosts = "", "", nil }()
+
+	req := makeProxyRequest(maxTimeout)
+	req.Hosts = hosts
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+	checkSuccess(t, r)
+
+	buf, err := ioutil.ReadFile(failedHostsFile)
+	must(err, "Could not read failed hosts")
+	if string(buf) != failedAddr+"\n" {
+		t.Fatalf("Unexpected failed hosts: %q", buf)
+	}
+
+	// hosts that are not listed are dropped from request even if they are specified explicitly
+	retryFromFile = failedHostsFile
+	retryHosts, err = readHostsFile(retryFromFile)
+	must(err, "Could not read hosts")
+
+	r.replies = make(map[string]*Reply)
+	r.hostsLeft = map[string]struct{}{failedAddr: {}}
+	req = makeProxyRequest(maxTimeout)
+	req.Hosts = hosts
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+
+	if len(r.hostsLeft) != 0 || len(r.replies) != 1 {
+		t.Fatalf("Only failed host must be retried, got %v", r.replies)
+	}
+
+	if _, err := readHostsFile(filepath.Join(dir, "missing.txt")); err == nil || !strings.Contains(err.Error(), "Cannot read hosts") {
+		t.Fatalf("Missing file must be reported: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Host filtering: "Exclude" (or -exclude) removes hosts from request after groups, dynamic sources
+// and patterns are expanded: entries are host names, range and brace patterns ("web[1-3]"), shell
+// globs ("db*.example.com") or inventory groups ("@maintenance"). "Limit" (or -limit) keeps only
+// hosts which names match the regular expression. Flags apply to all requests in addition to
+// their own settings, so that e.g. hosts in maintenance can be left out of a session.
+
+var (
+	excludeList string         // -exclude
+	limitSpec   string         // -limit
+	limitRe     *regexp.Regexp // compiled limitSpec
+)
+
+// initFilter compiles -limit
+func initFilter() (err error) {
+	limitRe = nil
+	if limitSpec != "" {
+		if limitRe, err = regexp.Compile(limitSpec); err != nil {
+			return errors.New("Invalid -limit: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// hostFilter tells whether host is left in request by Exclude and Limit
+type hostFilter struct {
+	excluded map[string]bool
+	globs    []string
+	limits   []*regexp.Regexp
+}
+
+// newHostFilter returns filter of msg together with -exclude and -limit
+func newHostFilter(msg *ProxyRequest) (*hostFilter, error) {
+	f := &hostFilter{excluded: make(map[string]bool)}
+
+	exclude := msg.Exclude
+	if excludeList != "" {
+		exclude = append(strings.Split(excludeList, ","), exclude...)
+	}
+
+	var patterns []string
+	for _, e := range exclude {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		if strings.HasPrefix(e, "@") {
+			hosts, err := inventoryHosts([]string{e[1:]})
+			if err != nil {
+				return nil, errors.New("Cannot exclude " + e + ": " + err.Error())
+			}
+			patterns = append(patterns, hosts...)
+			continue
+		}
+		patterns = append(patterns, e)
+	}
+
+	expanded, err := expandHosts(patterns)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range expanded {
+		if strings.ContainsAny(p, "*?") {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, errors.New("Invalid exclude pattern " + p + ": " + err.Error())
+			}
+			f.globs = append(f.globs, p)
+		} else {
+			f.excluded[p] = true
+		}
+	}
+
+	if limitRe != nil {
+		f.limits = append(f.limits, limitRe)
+	}
+	if msg.Limit != "" {
+		re, err := regexp.Compile(msg.Limit)
+		if err != nil {
+			return nil, errors.New("Invalid 'Limit': " + err.Error())
+		}
+		f.limits = append(f.limits, re)
+	}
+
+	return f, nil
+}
+
+// keep checks host both with and without port, so that "web1" also excludes "web1:2222"
+func (f *hostFilter) keep(hostname string) bool {
+	host, _ := splitHostPort(hostname)
+	if f.excluded[hostname] || f.excluded[host] {
+		return false
+	}
+	for _, g := range f.globs {
+		if ok, _ := path.Match(g, hostname); ok {
+			return false
+		}
+		if ok, _ := path.Match(g, host); ok {
+			return false
+		}
+	}
+	for _, re := range f.limits {
+		if !re.MatchString(hostname) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterHosts removes hosts that are excluded or do not match limits of msg
+func filterHosts(hosts []string, msg *ProxyRequest) ([]string, error) {
+	f, err := newHostFilter(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.excluded) == 0 && len(f.globs) == 0 && len(f.limits) == 0 {
+		return hosts, nil
+	}
+
+	res := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		if f.keep(h) {
+			res = append(res, h)
+		} else {
+			logf(logDebug, h, "Host is filtered out by Exclude or Limit")
+		}
+	}
+	return res, nil
+}
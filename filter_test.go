@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterHosts(t *testing.T) {
+	inv := newInventory()
+	must(inv.addHost("maintenance", "web2", nil), "Could not add host")
+	inv.resolveVars()
+	hostInventory = inv
+	defer func() { hostInventory, excludeList, limitSpec, limitRe = nil, "", "", nil }()
+
+	hosts := []string{"web1", "web2", "web3:2222", "web4", "db1.example.com", "db2.example.com"}
+
+	for _, c := range []struct {
+		msg      *ProxyRequest
+		expected []string
+	}{
+		{&ProxyRequest{}, hosts},
+		{&ProxyRequest{Exclude: []string{"web[3-4]", "db*"}}, []string{"web1", "web2"}},
+		{&ProxyRequest{Exclude: []string{"@maintenance"}, Limit: `^web`}, []string{"web1", "web3:2222", "web4"}},
+		{&ProxyRequest{Limit: `\.example\.com$`}, []string{"db1.example.com", "db2.example.com"}},
+	} {
+		res, err := filterHosts(append([]string{}, hosts...), c.msg)
+		if err != nil || !reflect.DeepEqual(res, c.expected) {
+			t.Errorf("Unexpected hosts with %+v: %v, %v", c.msg, res, err)
+		}
+	}
+
+	excludeList, limitSpec = "web1", "^web"
+	must(initFilter(), "Could not init filter")
+	if res, err := filterHosts(hosts, &ProxyRequest{Exclude: []string{"web4"}}); err != nil || !reflect.DeepEqual(res, []string{"web2", "web3:2222"}) {
+		t.Errorf("Flags must apply in addition to request: %v, %v", res, err)
+	}
+
+	for _, msg := range []*ProxyRequest{{Exclude: []string{"@unknown"}}, {Exclude: []string{"web[*"}}, {Limit: "("}} {
+		if _, err := filterHosts(hosts, msg); err == nil {
+			t.Errorf("Filter %+v must be rejected", msg)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Follow-up commands ("Then" and "OnFail", or -then and -on-fail): after command or script of
+// the action, "Then" command is run on every host where it exited with zero status and "OnFail"
+// command on every host where it exited with non-zero one (e.g. to collect logs), over the same
+// connection and with the same options. Hosts where action could not be run at all (e.g. they are
+// unreachable) or which were skipped by OnlyIf do not run either of them. Result of the follow-up
+// command is sent in "FollowUp" of reply, and host fails if "Then" command fails.
+
+var (
+	thenDefault   string // -then
+	onFailDefault string // -on-fail
+)
+
+// requestFollowUps returns Then and OnFail commands of msg
+func requestFollowUps(msg *ProxyRequest) (then, onFail string) {
+	if then = msg.Then; then == "" {
+		then = thenDefault
+	}
+	if onFail = msg.OnFail; onFail == "" {
+		onFail = onFailDefault
+	}
+	return
+}
+
+// withFollowUp runs Then or OnFail command of msg on every host after execFunc depending on its exit status
+func withFollowUp(msg *ProxyRequest, execFunc func(string) *SshResult) (func(string) *SshResult, error) {
+	then, onFail := requestFollowUps(msg)
+	if then == "" && onFail == "" || dryRun {
+		return execFunc, nil
+	}
+
+	opts, err := parseCmdOptions(msg)
+	if err != nil {
+		return nil, err
+	}
+	opts.stdin, opts.record = nil, nil
+
+	return func(hostname string) *SshResult {
+		res := execFunc(hostname)
+
+		var (
+			cmd     string
+			exitErr *ssh.ExitError
+		)
+		if res.err == nil && !res.skipped {
+			cmd = then
+		} else if errors.As(res.err, &exitErr) {
+			cmd = onFail
+		}
+		if cmd == "" {
+			return res
+		}
+
+		hostOpts := opts.forHost()
+		stdout, stderr, err := executeCmd(cmd, hostOpts, hostname)
+		res.followUp = &CommandResult{Cmd: cmd, Stdout: stdout, Stderr: stderr, Success: err == nil, ExitCode: exitCode(err)}
+		res.truncated = res.truncated || hostOpts.output.truncated()
+		if err != nil {
+			res.followUp.ErrMsg, res.followUp.ErrorKind = err.Error(), errorKind(err, "ssh")
+			logf(logInfo, hostname, "Follow-up command failed: %s", err)
+			if res.err == nil {
+				res.err = errors.New("Follow-up command failed: " + err.Error())
+			}
+		}
+		return res
+	}, nil
+}
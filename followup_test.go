@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFollowUp(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-follow-up", 2)
+
+	var healthy string
+	for addr, srv := range r.hosts {
+		healthy = addr
+		must(ioutil.WriteFile(filepath.Join(srv.root, "healthy"), nil, 0644), "Could not create file")
+		break
+	}
+
+	sendTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "echo check; test -f healthy", Then: "echo restarted", OnFail: "echo logs >&2"})
+
+	for addr, reply := range r.replies {
+		f := reply.FollowUp
+		if f == nil || reply.Stdout != "check\n" {
+			t.Fatalf("Unexpected reply from %s: %+v", addr, reply)
+		}
+		if addr == healthy && (!reply.Success || f.Cmd != "echo restarted" || f.Stdout != "restarted\n" || !f.Success) {
+			t.Fatalf("Then command must run where command succeeds: %+v, %+v", reply, f)
+		}
+		if addr != healthy && (reply.Success || reply.ExitCode != 1 || f.Cmd != "echo logs >&2" || f.Stderr != "logs\n") {
+			t.Fatalf("OnFail command must run where command fails: %+v, %+v", reply, f)
+		}
+	}
+
+	r.replies = make(map[string]*Reply)
+	sendTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "true", Then: "exit 3"})
+	for addr, reply := range r.replies {
+		if reply.Success || reply.ErrMsg != "Follow-up command failed: Process exited with status 3" || reply.FollowUp.ExitCode != 3 {
+			t.Fatalf("Host must fail if Then command fails on %s: %+v", addr, reply)
+		}
+	}
+}
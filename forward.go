@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Port forwarding (Action == "forward"): LocalForward and RemoteForward have format
+// "[bind_address:]port[+i]:host:hostport", where "+i" means that i-th host of the request
+// uses port+i, so that every host gets its own tunnel. Tunnels stay open until
+// Action == "unforward" is requested for the host or connection to it is lost.
+
+const defaultForwardBind = "127.0.0.1"
+
+type (
+	forwardSpec struct {
+		bind    string
+		port    int
+		perHost bool // add host index to port
+		target  string
+	}
+
+	// tunnel is a set of listeners that forward connections through (or from) a host
+	tunnel struct {
+		listeners []net.Listener
+		conn      *ssh.Client
+	}
+)
+
+var (
+	tunnelsMu sync.Mutex
+	tunnels   = make(map[string][]*tunnel) // open tunnels by hostname
+)
+
+func parseForwardSpec(spec string) (*forwardSpec, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) == 3 {
+		parts = append([]string{defaultForwardBind}, parts...)
+	}
+
+	if len(parts) != 4 || parts[2] == "" {
+		return nil, errors.New("Invalid forwarding spec " + spec + ", expected [bind_address:]port[+i]:host:hostport")
+	}
+
+	res := &forwardSpec{bind: parts[0], target: net.JoinHostPort(parts[2], parts[3])}
+	if res.bind == "" || res.bind == "*" {
+		res.bind = "0.0.0.0"
+	}
+
+	port := parts[1]
+	if strings.HasSuffix(port, "+i") {
+		res.perHost = true
+		port = strings.TrimSuffix(port, "+i")
+	}
+
+	var err error
+	if res.port, err = strconv.Atoi(port); err != nil || res.port <= 0 || res.port > 65535 {
+		return nil, errors.New("Invalid port in forwarding spec " + spec)
+	}
+
+	if _, err := strconv.Atoi(parts[3]); err != nil {
+		return nil, errors.New("Invalid host port in forwarding spec " + spec)
+	}
+
+	return res, nil
+}
+
+// listenAddr returns address to listen on for host with the specified index
+func (f *forwardSpec) listenAddr(idx int) string {
+	port := f.port
+	if f.perHost {
+		port += idx
+	}
+	return net.JoinHostPort(f.bind, fmt.Sprint(port))
+}
+
+// forwardPorts opens tunnels for hostname, it keeps connection in use until tunnels are closed
+func forwardPorts(local, remote *forwardSpec, idx int, hostname string) (stdout, stderr string, err error) {
+	conn, err := getConnection(hostname)
+	if err != nil {
+		return
+	}
+
+	t := &tunnel{conn: conn}
+
+	defer func() {
+		if err != nil {
+			t.close(hostname)
+		}
+	}()
+
+	if local != nil {
+		l, err := net.Listen("tcp", local.listenAddr(idx))
+		if err != nil {
+			return "", "", errors.New("Cannot listen on local port: " + err.Error())
+		}
+		t.listeners = append(t.listeners, l)
+		go serveTunnel(l, local.target, conn.Dial)
+		stdout += "Local " + l.Addr().String() + " -> " + local.target + "\n"
+	}
+
+	if remote != nil {
+		l, err := conn.Listen("tcp", remote.listenAddr(idx))
+		if err != nil {
+			return "", "", errors.New("Cannot listen on remote port: " + err.Error())
+		}
+		t.listeners = append(t.listeners, l)
+		go serveTunnel(l, remote.target, net.Dial)
+		stdout += "Remote " + remote.listenAddr(idx) + " -> " + remote.target + "\n"
+	}
+
+	tunnelsMu.Lock()
+	tunnels[hostname] = append(tunnels[hostname], t)
+	tunnelsMu.Unlock()
+
+	// tunnels are useless after connection is lost
+	go func() {
+		conn.Wait()
+		closeTunnels(hostname, conn)
+	}()
+
+	return
+}
+
+// closeTunnels closes tunnels of hostname that use conn (or all tunnels of hostname if conn is nil)
+func closeTunnels(hostname string, conn *ssh.Client) (closed int) {
+	tunnelsMu.Lock()
+	var left []*tunnel
+	for _, t := range tunnels[hostname] {
+		if conn == nil || t.conn == conn {
+			t.close(hostname)
+			closed++
+		} else {
+			left = append(left, t)
+		}
+	}
+	if len(left) > 0 {
+		tunnels[hostname] = left
+	} else {
+		delete(tunnels, hostname)
+	}
+	tunnelsMu.Unlock()
+
+	return
+}
+
+// close closes listeners and releases connection of the tunnel
+func (t *tunnel) close(hostname string) {
+	for _, l := range t.listeners {
+		l.Close()
+	}
+	connectedHosts.Release(hostname, t.conn)
+}
+
+func unforwardPorts(hostname string) (stdout, stderr string, err error) {
+	if closeTunnels(hostname, nil) == 0 {
+		return "", "", errors.New("No forwarded ports")
+	}
+	return
+}
+
+// serveTunnel forwards every accepted connection to target using dial
+func serveTunnel(l net.Listener, target string, dial func(network, addr string) (net.Conn, error)) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer c.Close()
+
+			tc, err := dial("tcp", target)
+			if err != nil {
+				return
+			}
+			defer tc.Close()
+
+			done := make(chan struct{}, 2)
+			go func() {
+				io.Copy(tc, c)
+				done <- struct{}{}
+			}()
+			go func() {
+				io.Copy(c, tc)
+				done <- struct{}{}
+			}()
+			<-done
+		}()
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"testing"
+)
+
+func TestParseForwardSpec(t *testing.T) {
+	f, err := parseForwardSpec("9000+i:localhost:3306")
+	if err != nil {
+		t.Fatalf("Could not parse spec: %s", err)
+	}
+
+	if f.listenAddr(2) != "127.0.0.1:9002" || f.target != "localhost:3306" {
+		t.Fatalf("Unexpected spec: %+v", f)
+	}
+
+	for _, spec := range []string{"9000", "9000:localhost", "x:localhost:22", "9000::22", "9000:localhost:ssh"} {
+		if _, err := parseForwardSpec(spec); err == nil {
+			t.Fatalf("Invalid spec %s must be rejected", spec)
+		}
+	}
+}
+
+func TestLocalForward(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	must(err, "Could not listen")
+	defer echo.Close()
+
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	r := makeTestResult()
+	startTestServers(r, "test-forward", 2)
+
+	var hosts []string
+	for h := range r.hostsLeft {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+
+	// connect to hosts before choosing ports, so that local ports of connections do not take port+1
+	runTestRequest(t, r, makeProxyRequest(maxTimeout))
+	r = makeTestResult()
+	for _, h := range hosts {
+		r.hostsLeft[h] = struct{}{}
+	}
+
+	// find two free consecutive ports
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	must(err, "Could not listen")
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	req := &ProxyRequest{Action: "forward", LocalForward: fmt.Sprintf("%d+i:%s", port, echo.Addr())}
+	runTestRequest(t, r, req)
+
+	for i := range hosts {
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port+i))
+		if err != nil {
+			t.Fatalf("Could not connect to tunnel: %s", err)
+		}
+
+		fmt.Fprintln(c, "ping")
+		if ln, err := bufio.NewReader(c).ReadString('\n'); err != nil || ln != "ping\n" {
+			t.Fatalf("Unexpected tunnel reply: %q, %v", ln, err)
+		}
+		c.Close()
+	}
+
+	r = makeTestResult()
+	for _, h := range hosts {
+		r.hostsLeft[h] = struct{}{}
+	}
+	runTestRequest(t, r, &ProxyRequest{Action: "unforward"})
+
+	if c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+		c.Close()
+		t.Fatalf("Tunnel must be closed")
+	}
+}
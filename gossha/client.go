@@ -0,0 +1,129 @@
+// Package gossha runs commands and uploads files on many hosts over SSH in parallel.
+//
+// It is the embeddable counterpart of GoSSHa proxy: a Pool keeps one connection per host
+// and runs each command or upload in a new session over it.
+package gossha
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultPort = "22"
+
+// Config contains settings that are used to connect to hosts
+type Config struct {
+	User            string
+	Auth            []ssh.AuthMethod
+	HostKeyCallback ssh.HostKeyCallback // required, use ssh.InsecureIgnoreHostKey() to skip host key checks
+	Timeout         time.Duration       // connection timeout, no timeout if zero
+	MaxConcurrency  int                 // maximum number of hosts that are processed at once, unlimited if zero
+}
+
+// Result is the outcome of running command or upload on a single host
+type Result struct {
+	Host     string
+	Stdout   string
+	Stderr   string
+	ExitCode int // exit status of command, -1 if it is unknown (e.g. connection failed)
+	Err      error
+	Duration time.Duration
+}
+
+// Client is a connection to a single host
+type Client struct {
+	host string
+	conn *ssh.Client
+}
+
+// hostAddr adds default ssh port to host if it is not specified
+func hostAddr(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+}
+
+// Dial connects to host ("host" or "host:port")
+func Dial(host string, conf *Config) (*Client, error) {
+	if conf.HostKeyCallback == nil {
+		return nil, errors.New("HostKeyCallback is not set")
+	}
+
+	conn, err := ssh.Dial("tcp", hostAddr(host), &ssh.ClientConfig{
+		User:            conf.User,
+		Auth:            conf.Auth,
+		HostKeyCallback: conf.HostKeyCallback,
+		Timeout:         conf.Timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{host: host, conn: conn}, nil
+}
+
+// Close closes connection to host
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Run executes cmd (stdin is sent to its standard input if it is not nil)
+func (c *Client) Run(cmd string, stdin []byte) *Result {
+	start := time.Now()
+	res := &Result{Host: c.host}
+
+	session, err := c.conn.NewSession()
+	if err != nil {
+		res.Err, res.ExitCode, res.Duration = err, -1, time.Since(start)
+		return res
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if stdin != nil {
+		session.Stdin = bytes.NewReader(stdin)
+	}
+
+	res.Err = session.Run(cmd)
+	res.Stdout, res.Stderr = stdout.String(), stderr.String()
+	res.ExitCode = exitCode(res.Err)
+	res.Duration = time.Since(start)
+
+	return res
+}
+
+// Upload writes contents to target file and sets its permissions; it uses "cat" on remote side,
+// so it works with any server that has POSIX shell. Like uploads of GoSSHa proxy, the file is written
+// to target+UploadTmpSuffix and renamed, so target is replaced atomically and never left truncated.
+func (c *Client) Upload(target string, contents []byte, mode os.FileMode) *Result {
+	if err := CheckRemotePath("target", target); err != nil {
+		return &Result{Host: c.host, ExitCode: -1, Err: errors.New("Cannot upload " + target + ": " + err.Error())}
+	}
+	res := c.Run(UploadScript(target, target+UploadTmpSuffix, int(mode.Perm()), -1, -1), contents)
+	if res.Err != nil {
+		res.Err = errors.New("Cannot upload " + target + ": " + res.Err.Error())
+	}
+	return res
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus()
+	}
+
+	return -1
+}
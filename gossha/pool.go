@@ -0,0 +1,115 @@
+package gossha
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Pool keeps connections to hosts and runs actions on many hosts in parallel
+type Pool struct {
+	conf *Config
+
+	mu      sync.Mutex
+	clients map[string]*Client
+}
+
+// NewPool creates pool that connects to hosts using conf
+func NewPool(conf *Config) *Pool {
+	return &Pool{conf: conf, clients: make(map[string]*Client)}
+}
+
+// Client returns cached connection to host or establishes a new one
+func (p *Pool) Client(host string) (*Client, error) {
+	p.mu.Lock()
+	c, ok := p.clients[host]
+	p.mu.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	c, err := Dial(host, p.conf)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// connection could have been established concurrently
+	if existing, ok := p.clients[host]; ok {
+		c.Close()
+		return existing, nil
+	}
+
+	p.clients[host] = c
+	return c, nil
+}
+
+// Forget closes connection to host, so that the next action establishes a new one
+func (p *Pool) Forget(host string) {
+	p.mu.Lock()
+	c, ok := p.clients[host]
+	delete(p.clients, host)
+	p.mu.Unlock()
+
+	if ok {
+		c.Close()
+	}
+}
+
+// Close closes all connections
+func (p *Pool) Close() {
+	p.mu.Lock()
+	clients := p.clients
+	p.clients = make(map[string]*Client)
+	p.mu.Unlock()
+
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
+// each runs action on every host respecting MaxConcurrency; results are in the same order as hosts
+func (p *Pool) each(hosts []string, action func(c *Client) *Result) []*Result {
+	results := make([]*Result, len(hosts))
+
+	limit := p.conf.MaxConcurrency
+	if limit <= 0 {
+		limit = len(hosts)
+	}
+	sem := make(chan struct{}, limit)
+
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			start := time.Now()
+			c, err := p.Client(host)
+			if err != nil {
+				results[i] = &Result{Host: host, Err: err, ExitCode: -1, Duration: time.Since(start)}
+				return
+			}
+
+			results[i] = action(c)
+			results[i].Duration = time.Since(start)
+		}(i, host)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// Run executes cmd on all hosts
+func (p *Pool) Run(hosts []string, cmd string) []*Result {
+	return p.each(hosts, func(c *Client) *Result { return c.Run(cmd, nil) })
+}
+
+// Upload writes contents to target file on all hosts
+func (p *Pool) Upload(hosts []string, target string, contents []byte, mode os.FileMode) []*Result {
+	return p.each(hosts, func(c *Client) *Result { return c.Upload(target, contents, mode) })
+}
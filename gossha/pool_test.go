@@ -0,0 +1,148 @@
+package gossha
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startServer starts ssh server that runs commands using local shell in dir
+func startServer(t *testing.T, dir string) string {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &ssh.ServerConfig{NoClientAuth: true}
+	conf.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			nConn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(nConn, conf)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+
+				for newCh := range chans {
+					ch, requests, err := newCh.Accept()
+					if err != nil {
+						continue
+					}
+					go serveSession(ch, requests, dir)
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func serveSession(ch ssh.Channel, requests <-chan *ssh.Request, dir string) {
+	defer ch.Close()
+
+	for req := range requests {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+
+		cmd := exec.Command("/bin/sh", "-c", string(req.Payload[4:]))
+		cmd.Dir = dir
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = ch, ch, ch.Stderr()
+
+		status := uint32(0)
+		if err := cmd.Run(); err != nil {
+			status = uint32(cmd.ProcessState.ExitCode())
+		}
+
+		var b bytes.Buffer
+		binary.Write(&b, binary.BigEndian, status)
+		ch.SendRequest("exit-status", false, b.Bytes())
+		return
+	}
+}
+
+func TestPool(t *testing.T) {
+	var hosts, dirs []string
+	for i := 0; i < 3; i++ {
+		dir, err := ioutil.TempDir("", "gossha-lib")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		dirs = append(dirs, dir)
+		hosts = append(hosts, startServer(t, dir))
+	}
+
+	pool := NewPool(&Config{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey(), MaxConcurrency: 2})
+	defer pool.Close()
+
+	for i, res := range pool.Upload(hosts, "it's a file", []byte("contents"), 0640) {
+		if res.Err != nil || res.Host != hosts[i] {
+			t.Fatalf("Upload to %s failed: %v", hosts[i], res.Err)
+		}
+
+		got, err := ioutil.ReadFile(filepath.Join(dirs[i], "it's a file"))
+		if err != nil || string(got) != "contents" {
+			t.Fatalf("Unexpected uploaded file on %s: %q (%v)", hosts[i], got, err)
+		}
+	}
+
+	// targets are never options of remote commands and temporary files do not stay behind
+	for i, res := range pool.Upload(hosts, "-rf", []byte("x"), 0600) {
+		if got, err := ioutil.ReadFile(filepath.Join(dirs[i], "-rf")); res.Err != nil || err != nil || string(got) != "x" {
+			t.Fatalf("Upload of -rf to %s failed: %v, %v", hosts[i], res.Err, err)
+		}
+		if tmp, _ := filepath.Glob(filepath.Join(dirs[i], "*"+UploadTmpSuffix)); len(tmp) > 0 {
+			t.Fatalf("Temporary files left on %s: %v", hosts[i], tmp)
+		}
+	}
+	if res := pool.Upload(hosts[:1], "a\nb", []byte("x"), 0600)[0]; res.Err == nil {
+		t.Fatalf("Target with line break was accepted")
+	}
+
+	for i, res := range pool.Run(hosts, "cat \"it's a file\"; exit 2") {
+		if res.Stdout != "contents" || res.ExitCode != 2 || res.Err == nil {
+			t.Fatalf("Unexpected result on %s: %+v", hosts[i], res)
+		}
+	}
+
+	c, err := pool.Client(hosts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := pool.Client(hosts[0]); again != c {
+		t.Fatalf("Connection was not reused")
+	}
+
+	if res := pool.Run([]string{"127.0.0.1:1"}, "true")[0]; res.Err == nil || res.ExitCode != -1 {
+		t.Fatalf("Expected connection error, got %+v", res)
+	}
+}
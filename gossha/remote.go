@@ -0,0 +1,44 @@
+package gossha
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// UploadTmpSuffix is the suffix of temporary files that uploads are written to before they are renamed into place
+const UploadTmpSuffix = ".gossha.tmp"
+
+// ShellQuote quotes s for POSIX shell, so that it is passed to the command as a single word
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// CheckRemotePath validates path of remote file: remote commands quote it with ShellQuote,
+// but NUL cannot be passed to them and line breaks would end records of scp protocol
+func CheckRemotePath(field, p string) error {
+	if p == "" {
+		return errors.New("Empty '" + field + "'")
+	}
+	if strings.ContainsAny(p, "\x00\n\r") {
+		return fmt.Errorf("'%s' cannot contain NUL bytes or line breaks: %q", field, p)
+	}
+	return nil
+}
+
+// UploadScript returns shell command that writes its stdin to tmpPath, sets mode and owner of it (they
+// are kept if negative) and renames it to target, tmpPath is removed if any step fails; the file is
+// written directly if tmpPath is target. Paths are passed after "--", so they cannot become options.
+func UploadScript(target, tmpPath string, mode, uid, gid int) string {
+	script := "cat > " + ShellQuote(tmpPath)
+	if mode >= 0 {
+		script += fmt.Sprintf(" && chmod %04o -- %s", mode&07777, ShellQuote(tmpPath))
+	}
+	if uid >= 0 && gid >= 0 {
+		script += fmt.Sprintf(" && chown %d:%d -- %s", uid, gid, ShellQuote(tmpPath))
+	}
+	if tmpPath != target {
+		script = "{ " + script + " && mv -f -- " + ShellQuote(tmpPath) + " " + ShellQuote(target) + "; } || { rm -f -- " + ShellQuote(tmpPath) + "; exit 1; }"
+	}
+	return script
+}
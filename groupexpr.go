@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Group expressions ("Groups": ["web & eu - canary"] or -g 'web & eu - canary' of subcommands):
+// inventory groups can be combined with set operations wherever a group name is accepted, so that
+// precise slices of the fleet can be targeted without temporary host files. "a | b" is union, "a & b"
+// is intersection and "a - b" is difference; "&" binds tighter than "|" and "-", which are evaluated
+// left to right, and parentheses group. A dash between characters of a name is part of it, so
+// "web-eu - canary" is group web-eu without canary. Hosts keep the order of the groups they come from.
+
+// groupExprOperators are characters that are never part of group names in expressions
+const groupExprOperators = "&|()"
+
+// isGroupExpr tells whether name of group is an expression with operators
+func isGroupExpr(name string) bool {
+	tokens, err := tokenizeGroupExpr(name)
+	return err != nil || len(tokens) != 1
+}
+
+// tokenizeGroupExpr splits expr into group names, operators and parentheses
+func tokenizeGroupExpr(expr string) ([]string, error) {
+	var tokens []string
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '-' || strings.ContainsRune(groupExprOperators, c):
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(groupExprOperators, runes[i]) {
+				i++
+			}
+			tokens = append(tokens, string(runes[start:i]))
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("Empty group expression")
+	}
+	return tokens, nil
+}
+
+// groupExprNames returns names of groups that expr refers to
+func groupExprNames(expr string) []string {
+	tokens, _ := tokenizeGroupExpr(expr)
+	var res []string
+	for _, tok := range tokens {
+		if tok != "-" && !strings.Contains(groupExprOperators, tok) {
+			res = append(res, tok)
+		}
+	}
+	return res
+}
+
+// hostSet is a set of hosts that keeps their order
+type hostSet struct {
+	hosts []string
+	has   map[string]bool
+}
+
+func newHostSet(hosts []string) *hostSet {
+	s := &hostSet{has: make(map[string]bool, len(hosts))}
+	for _, h := range hosts {
+		if !s.has[h] {
+			s.has[h] = true
+			s.hosts = append(s.hosts, h)
+		}
+	}
+	return s
+}
+
+// combine returns result of operator op applied to s and other
+func (s *hostSet) combine(op string, other *hostSet) *hostSet {
+	switch op {
+	case "|":
+		return newHostSet(append(append([]string{}, s.hosts...), other.hosts...))
+	case "&", "-":
+		var res []string
+		for _, h := range s.hosts {
+			if other.has[h] == (op == "&") {
+				res = append(res, h)
+			}
+		}
+		return newHostSet(res)
+	}
+	panic("unknown operator " + op)
+}
+
+// groupExprParser evaluates group expression with recursive descent
+type groupExprParser struct {
+	inv    *inventory
+	tokens []string
+	pos    int
+}
+
+// GroupExprHosts returns hosts of group expression expr
+func (inv *inventory) GroupExprHosts(expr string) ([]string, error) {
+	tokens, err := tokenizeGroupExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &groupExprParser{inv: inv, tokens: tokens}
+	s, err := p.union()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid group expression %q: %s", expr, err)
+	}
+	return s.hosts, nil
+}
+
+// union parses operands joined with "|" and "-"
+func (p *groupExprParser) union() (*hostSet, error) {
+	s, err := p.intersection()
+	for err == nil && p.pos < len(p.tokens) && (p.tokens[p.pos] == "|" || p.tokens[p.pos] == "-") {
+		op := p.tokens[p.pos]
+		p.pos++
+		var other *hostSet
+		if other, err = p.intersection(); err == nil {
+			s = s.combine(op, other)
+		}
+	}
+	return s, err
+}
+
+// intersection parses operands joined with "&"
+func (p *groupExprParser) intersection() (*hostSet, error) {
+	s, err := p.operand()
+	for err == nil && p.pos < len(p.tokens) && p.tokens[p.pos] == "&" {
+		p.pos++
+		var other *hostSet
+		if other, err = p.operand(); err == nil {
+			s = s.combine("&", other)
+		}
+	}
+	return s, err
+}
+
+// operand parses group name or expression in parentheses
+func (p *groupExprParser) operand() (*hostSet, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("group name expected at the end")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+
+	switch tok {
+	case "(":
+		s, err := p.union()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos] != ")" {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return s, nil
+	case ")", "&", "|", "-":
+		return nil, fmt.Errorf("group name expected instead of %q", tok)
+	}
+
+	hosts, err := p.inv.GroupHosts(tok)
+	if err != nil {
+		return nil, err
+	}
+	return newHostSet(hosts), nil
+}
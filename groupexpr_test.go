@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testGroupExprInventory = `
+[web]
+web[1:4]
+
+[eu]
+web1
+web2
+db1
+
+[canary]
+web2
+
+[db-eu]
+db1
+db2
+`
+
+func TestGroupExpr(t *testing.T) {
+	inv, err := parseInventory([]byte(testGroupExprInventory), "ini")
+	must(err, "Could not parse inventory")
+
+	for expr, expected := range map[string][]string{
+		"web & eu - canary":           {"web1"},
+		"web&eu -canary":              {"web1"},
+		"web | db-eu":                 {"web1", "web2", "web3", "web4", "db1", "db2"},
+		"web - eu | canary":           {"web3", "web4", "web2"},
+		"web - (eu | canary)":         {"web3", "web4"},
+		"db-eu & eu":                  {"db1"},
+		"(web | db-eu) & eu - canary": {"web1", "db1"},
+		"all - web - db-eu":           nil,
+	} {
+		hosts, err := inv.GroupExprHosts(expr)
+		if err != nil {
+			t.Fatalf("Could not evaluate %q: %s", expr, err)
+		}
+		if !reflect.DeepEqual(hosts, expected) {
+			t.Fatalf("Unexpected hosts of %q: %v", expr, hosts)
+		}
+	}
+
+	for _, expr := range []string{"", "web &", "& web", "(web | eu", "web | eu)", "web | unknown", "web eu"} {
+		if _, err := inv.GroupExprHosts(expr); err == nil {
+			t.Fatalf("Expected error for %q", expr)
+		}
+	}
+
+	if isGroupExpr("db-eu") || !isGroupExpr("web - eu") {
+		t.Fatalf("Group names must not be expressions")
+	}
+	if names := groupExprNames("(web | db-eu) & eu"); !reflect.DeepEqual(names, []string{"web", "db-eu", "eu"}) {
+		t.Fatalf("Unexpected names of groups: %v", names)
+	}
+
+	hostInventory = inv
+	defer func() { hostInventory = nil }()
+	hosts, err := inventoryHosts([]string{"canary", "web & eu"})
+	must(err, "Could not get hosts of groups")
+	if !reflect.DeepEqual(hosts, []string{"web2", "web1", "web2"}) {
+		t.Fatalf("Unexpected hosts of groups: %v", hosts)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// GSSAPI authentication (-gssapi): "gssapi-with-mic" authentication with Kerberos tickets from local
+// credential cache (kinit) is tried before other methods for every host and jump host. It needs
+// GSSAPI library, so GoSSHa must be built with "-tags gssapi" (and cgo) to support it.
+
+var (
+	gssapiAuth       bool      // try GSSAPI authentication (-gssapi)
+	gssapiReportOnce sync.Once // missing credentials are only reported once
+)
+
+// withGSSAPI returns conf that tries GSSAPI authentication to host first, if it is enabled; failed
+// GSSAPI authentication aborts connection, so it is not tried at all without Kerberos credentials
+func withGSSAPI(conf *ssh.ClientConfig, host string) *ssh.ClientConfig {
+	if !gssapiAuth {
+		return conf
+	}
+
+	client, err := newGSSAPIClient()
+	if err != nil {
+		gssapiReportOnce.Do(func() { reportErrorToUser("GSSAPI authentication is not used: " + err.Error()) })
+		return conf
+	}
+
+	gssConf := *conf
+	gssConf.Auth = append([]ssh.AuthMethod{ssh.GSSAPIWithMICAuthMethod(client, host)}, conf.Auth...)
+	return &gssConf
+}
@@ -0,0 +1,135 @@
+//go:build gssapi && cgo
+// +build gssapi,cgo
+
+package main
+
+/*
+#cgo LDFLAGS: -lgssapi_krb5
+#include <stdlib.h>
+#include <gssapi/gssapi.h>
+
+// Kerberos V5 mechanism, 1.2.840.113554.1.2.2
+static gss_OID krb5_mech(void) {
+	static gss_OID_desc oid = {9, (void *)"\x2a\x86\x48\x86\xf7\x12\x01\x02\x02"};
+	return &oid;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const gssapiSupported = true // GoSSHa is built with GSSAPI library
+
+// gssapiClient is security context of one connection, established with Kerberos mechanism
+type gssapiClient struct {
+	name C.gss_name_t
+	ctx  C.gss_ctx_id_t
+}
+
+// newGSSAPIClient returns client for a new connection, it fails if there are no Kerberos credentials
+func newGSSAPIClient() (ssh.GSSAPIClient, error) {
+	var major, minor C.OM_uint32
+	var cred C.gss_cred_id_t
+
+	if major = C.gss_acquire_cred(&minor, nil, 0, nil, C.GSS_C_INITIATE, &cred, nil, nil); gssapiFailed(major) {
+		return nil, gssapiError("Cannot get Kerberos credentials", major, minor)
+	}
+	C.gss_release_cred(&minor, &cred)
+
+	return &gssapiClient{}, nil
+}
+
+// gssapiFailed checks whether major status is an error (GSS_ERROR macro)
+func gssapiFailed(major C.OM_uint32) bool {
+	return major&0xffff0000 != 0
+}
+
+// gssapiError describes major and minor (mechanism) status of failed call
+func gssapiError(action string, major, minor C.OM_uint32) error {
+	msgs := gssapiStatus(major, C.GSS_C_GSS_CODE)
+	if minor != 0 {
+		msgs = append(msgs, gssapiStatus(minor, C.GSS_C_MECH_CODE)...)
+	}
+	return errors.New(action + ": " + strings.Join(msgs, ": "))
+}
+
+func gssapiStatus(code C.OM_uint32, codeType C.int) (msgs []string) {
+	var minor, msgCtx C.OM_uint32
+	for {
+		var buf C.gss_buffer_desc
+		if gssapiFailed(C.gss_display_status(&minor, code, codeType, C.krb5_mech(), &msgCtx, &buf)) {
+			return
+		}
+		msgs = append(msgs, C.GoStringN((*C.char)(buf.value), C.int(buf.length)))
+		C.gss_release_buffer(&minor, &buf)
+		if msgCtx == 0 {
+			return
+		}
+	}
+}
+
+func (c *gssapiClient) InitSecContext(target string, token []byte, isGSSDelegCreds bool) ([]byte, bool, error) {
+	var major, minor C.OM_uint32
+
+	if c.name == nil {
+		name := C.CString(target)
+		defer C.free(unsafe.Pointer(name))
+
+		buf := C.gss_buffer_desc{length: C.size_t(len(target)), value: unsafe.Pointer(name)}
+		if major = C.gss_import_name(&minor, &buf, C.GSS_C_NT_HOSTBASED_SERVICE, &c.name); gssapiFailed(major) {
+			return nil, false, gssapiError("Cannot import GSSAPI name "+target, major, minor)
+		}
+	}
+
+	var input, output C.gss_buffer_desc
+	if len(token) > 0 {
+		input.value, input.length = C.CBytes(token), C.size_t(len(token))
+		defer C.free(input.value)
+	}
+
+	flags := C.OM_uint32(C.GSS_C_MUTUAL_FLAG | C.GSS_C_INTEG_FLAG)
+	if isGSSDelegCreds {
+		flags |= C.GSS_C_DELEG_FLAG
+	}
+
+	major = C.gss_init_sec_context(&minor, nil, &c.ctx, c.name, C.krb5_mech(), flags, 0, nil, &input, nil, &output, nil, nil)
+	defer C.gss_release_buffer(&minor, &output)
+	if gssapiFailed(major) {
+		return nil, false, gssapiError("Cannot initialize GSSAPI security context for "+target, major, minor)
+	}
+
+	return C.GoBytes(output.value, C.int(output.length)), major&C.GSS_S_CONTINUE_NEEDED != 0, nil
+}
+
+func (c *gssapiClient) GetMIC(micField []byte) ([]byte, error) {
+	var major, minor C.OM_uint32
+	var input, output C.gss_buffer_desc
+
+	input.value, input.length = C.CBytes(micField), C.size_t(len(micField))
+	defer C.free(input.value)
+
+	major = C.gss_get_mic(&minor, c.ctx, C.GSS_C_QOP_DEFAULT, &input, &output)
+	defer C.gss_release_buffer(&minor, &output)
+	if gssapiFailed(major) {
+		return nil, gssapiError("Cannot sign GSSAPI MIC", major, minor)
+	}
+
+	return C.GoBytes(output.value, C.int(output.length)), nil
+}
+
+func (c *gssapiClient) DeleteSecContext() error {
+	var minor C.OM_uint32
+	if c.ctx != nil {
+		C.gss_delete_sec_context(&minor, &c.ctx, nil)
+	}
+	if c.name != nil {
+		C.gss_release_name(&minor, &c.name)
+	}
+	return nil
+}
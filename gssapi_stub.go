@@ -0,0 +1,16 @@
+//go:build !gssapi || !cgo
+// +build !gssapi !cgo
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const gssapiSupported = false // GoSSHa is built without GSSAPI library
+
+func newGSSAPIClient() (ssh.GSSAPIClient, error) {
+	return nil, errors.New("GoSSHa is built without GSSAPI library, rebuild it with -tags gssapi")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Safety guard: with -guard-hosts N commands, scripts and uploads that run on more than N hosts
+// and with -guard commands (and scripts) that match one of dangerous patterns (rm -rf, shutdown,
+// mkfs, ...) are not started until user confirms them: ConfirmationRequest with Reason is sent and
+// {"Confirm": true} is expected in reply. "guard_patterns" section of configuration file replaces
+// built-in patterns. Requests with "Confirm": true and all requests with -yes are not asked about;
+// with -serve, -daemon and -repl confirmations cannot be answered, so guarded requests fail.
+
+var (
+	guardHosts    uint64 // -guard-hosts
+	guardCommands bool   // -guard
+	assumeYes     bool   // -yes
+
+	noConfirmations bool // requests cannot be confirmed with -serve, -daemon and -repl
+)
+
+// guardPatterns are regular expressions of commands that must be confirmed with -guard
+var guardPatterns = compileGuardPatterns([]string{
+	`\brm\s+(-\S+\s+)*(-[a-zA-Z]*[rR]|--recursive)`,
+	`\b(shutdown|reboot|halt|poweroff)\b`,
+	`\bmkfs(\.\w+)?\b`,
+	`\bdd\s+.*\bof=/dev/`,
+	`\b(init|telinit)\s+[06]\b`,
+	`>\s*/dev/(sd|nvme|vd|xvd|hd)`,
+	`\bwipefs\b`,
+})
+
+func compileGuardPatterns(patterns []string) []*regexp.Regexp {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		res[i] = regexp.MustCompile(p)
+	}
+	return res
+}
+
+// initGuard replaces built-in dangerous patterns with ones from configuration, they enable -guard
+func initGuard(conf *gosshaConfig) error {
+	if conf.guardPatterns == nil {
+		return nil
+	}
+
+	patterns := make([]*regexp.Regexp, len(conf.guardPatterns))
+	for i, p := range conf.guardPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("Invalid guard pattern %q of config: %s", p, err)
+		}
+		patterns[i] = re
+	}
+
+	guardPatterns, guardCommands = patterns, true
+	return nil
+}
+
+// guardReason tells why msg must be confirmed before it is started, empty string if it must not be
+func guardReason(msg *ProxyRequest) string {
+	if guardCommands {
+		cmds := append([]string{msg.Cmd}, msg.Cmds...)
+		if msg.Action == "script" {
+			if script, err := ioutil.ReadFile(msg.Source); err == nil {
+				cmds = append(cmds, string(script))
+			}
+		}
+
+		for _, cmd := range cmds {
+			for _, re := range guardPatterns {
+				if m := re.FindString(cmd); m != "" {
+					return fmt.Sprintf("Command matches dangerous pattern %q", m)
+				}
+			}
+		}
+	}
+
+	changes := msg.Action == "ssh" || msg.Action == "script" || msg.Action == "scp"
+	if guardHosts > 0 && changes && uint64(len(msg.Hosts)) > guardHosts {
+		return fmt.Sprintf("Action runs on %d hosts, more than %d", len(msg.Hosts), guardHosts)
+	}
+
+	return ""
+}
+
+// confirmRun asks user to confirm that action should be started on hosts, reason is returned by guardReason
+func confirmRun(reason string, hosts int) bool {
+	sendProxyReply(&ConfirmationRequest{Reason: reason, Remaining: hosts})
+
+	response, ok := <-requestsChan
+	return ok && response.Confirm
+}
+
+// promptConfirmation asks about ConfirmationRequest on terminal for subcommands and sends the answer
+func promptConfirmation(stdin *bufio.Reader, req *ConfirmationRequest) {
+	if req.Reason != "" {
+		fmt.Fprintf(os.Stderr, "%s\nStart it on %d host(s) (yes/no)? ", req.Reason, req.Remaining)
+	} else {
+		fmt.Fprintf(os.Stderr, "Canary succeeded on %s\nContinue on %d remaining host(s) (yes/no)? ", strings.Join(req.CanaryHosts, ","), req.Remaining)
+	}
+	line, _ := stdin.ReadString('\n')
+	requestsChan <- &ProxyRequest{Confirm: strings.TrimSpace(line) == "yes"}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGuardReason(t *testing.T) {
+	defer func() { guardCommands, guardHosts = false, 0 }()
+	guardCommands = true
+
+	for cmd, dangerous := range map[string]bool{
+		"rm -rf /var/lib/app":         true,
+		"rm -f -R old":                true,
+		"sudo shutdown -h now":        true,
+		"mkfs.ext4 /dev/sdb1":         true,
+		"dd if=image of=/dev/sda":     true,
+		"cat data > /dev/nvme0n1":     true,
+		"rm -f /tmp/lock":             false,
+		"systemctl restart nginx":     false,
+		"grep -r shutdowns /var/log/": false,
+	} {
+		if reason := guardReason(&ProxyRequest{Action: "ssh", Cmd: cmd}); (reason != "") != dangerous {
+			t.Errorf("Unexpected reason for %q: %q", cmd, reason)
+		}
+	}
+
+	if reason := guardReason(&ProxyRequest{Action: "ssh", Cmds: []string{"uptime", "reboot"}}); reason == "" {
+		t.Errorf("Dangerous command in Cmds must be guarded")
+	}
+
+	guardCommands, guardHosts = false, 2
+	if reason := guardReason(&ProxyRequest{Action: "ssh", Hosts: []string{"a", "b", "c"}}); reason == "" {
+		t.Errorf("Command on 3 hosts must be guarded")
+	}
+	if reason := guardReason(&ProxyRequest{Action: "ping", Hosts: []string{"a", "b", "c"}}); reason != "" {
+		t.Errorf("Ping must not be guarded: %q", reason)
+	}
+	if reason := guardReason(&ProxyRequest{Action: "ssh", Hosts: []string{"a", "b"}}); reason != "" {
+		t.Errorf("Command on 2 hosts must not be guarded: %q", reason)
+	}
+}
+
+func TestInitGuard(t *testing.T) {
+	defer func(patterns []*regexp.Regexp) { guardPatterns, guardCommands = patterns, false }(guardPatterns)
+
+	doc, err := parseYaml([]byte("guard_patterns: ['\\bdrop\\s+table\\b']\n"))
+	must(err, "Could not parse yaml config")
+	conf, err := applyConfig(doc)
+	if err != nil {
+		t.Fatalf("Cannot apply config: %s", err)
+	}
+	if err := initGuard(conf); err != nil {
+		t.Fatalf("Cannot init guard: %s", err)
+	}
+	if !guardCommands || guardReason(&ProxyRequest{Cmd: "psql -c 'drop table users'"}) == "" || guardReason(&ProxyRequest{Cmd: "rm -rf /"}) != "" {
+		t.Fatalf("Patterns of config must replace built-in ones")
+	}
+
+	if err := initGuard(&gosshaConfig{guardPatterns: []string{"("}}); err == nil {
+		t.Fatalf("Invalid pattern must be rejected")
+	}
+}
+
+func TestGuard(t *testing.T) {
+	defer func() { guardHosts = 0 }()
+	guardHosts = 1
+
+	r := makeTestResult()
+	startTestServers(r, "test-guard", 2)
+
+	// run sends request to 2 hosts, answers confirmation with confirm and returns replies
+	run := func(req *ProxyRequest, confirm bool) (replies []*Reply, errMsg string) {
+		for addr := range r.hosts {
+			req.Hosts = append(req.Hosts, addr)
+		}
+		requestsChan <- req
+
+		timeoutCh := time.After(maxTimeout)
+		for {
+			select {
+			case reply := <-repliesChan:
+				switch reply := reply.(type) {
+				case *Reply:
+					replies = append(replies, reply)
+				case *ConfirmationRequest:
+					if !strings.Contains(reply.Reason, "2 hosts") || reply.Remaining != 2 {
+						t.Fatalf("Unexpected confirmation request: %+v", reply)
+					}
+					requestsChan <- &ProxyRequest{Confirm: confirm}
+				case *FinalReply:
+					return replies, ""
+				case *UserError:
+					if reply.IsCritical {
+						return replies, reply.ErrorMsg
+					}
+				}
+			case <-timeoutCh:
+				t.Fatalf("Timed out")
+			}
+		}
+	}
+
+	if replies, errMsg := run(makeProxyRequest(maxTimeout), false); len(replies) != 0 || errMsg != "Action was not confirmed" {
+		t.Fatalf("Action must not start without confirmation: %v, %q", replies, errMsg)
+	}
+	if replies, errMsg := run(makeProxyRequest(maxTimeout), true); len(replies) != 2 || errMsg != "" {
+		t.Fatalf("Action must run on all hosts after confirmation: %v, %q", replies, errMsg)
+	}
+
+	req := makeProxyRequest(maxTimeout)
+	req.Confirm = true
+	if replies, errMsg := run(req, false); len(replies) != 2 || errMsg != "" {
+		t.Fatalf("Action confirmed in advance must not be asked about: %v, %q", replies, errMsg)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Host health ledger (-health <file>): result of every action is counted for every host in a small
+// JSON file: number of runs and failures, current streak of failures or successes, the last error
+// and when the host last succeeded. Replies get "Health" note when the host keeps failing ("host has
+// failed the last 5 runs"), fails after a series of successes or recovers, so that chronically broken
+// hosts can be told from new regressions. "gossha status" prints the ledger. Hosts that timed out
+// count as failed, hosts that were not started or were interrupted are not counted.
+
+const chronicFailures = 3 // failures in a row after which failing host is noted as chronic
+
+var (
+	healthFile string        // file to keep health of hosts in (-health)
+	health     *healthLedger // contents of healthFile
+)
+
+type (
+	// hostHealth is history of results of a host
+	hostHealth struct {
+		Runs          int       `json:"runs"`
+		Failures      int       `json:"failures"`
+		Streak        int       `json:"streak"` // successes in a row, or failures in a row if negative
+		LastError     string    `json:"last_error,omitempty"`
+		LastErrorKind string    `json:"last_error_kind,omitempty"`
+		LastFailure   time.Time `json:"last_failure"`
+		LastSuccess   time.Time `json:"last_success"`
+	}
+
+	healthLedger struct {
+		mu    sync.Mutex
+		hosts map[string]*hostHealth
+	}
+)
+
+func defaultHealthFile() string {
+	return filepath.Join(homeDir(), ".gossha_health.json")
+}
+
+// loadHealth reads ledger from filename, file does not have to exist
+func loadHealth(filename string) (*healthLedger, error) {
+	l := &healthLedger{hosts: make(map[string]*hostHealth)}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, errors.New("Cannot read host health: " + err.Error())
+	}
+	if err := json.Unmarshal(data, &l.hosts); err != nil {
+		return nil, errors.New("Cannot parse host health " + filename + ": " + err.Error())
+	}
+	return l, nil
+}
+
+// record counts result of action on hostname and returns note about health of the host for reply,
+// empty if the result is not remarkable
+func (l *healthLedger) record(hostname string, err error, kind string, at time.Time) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h := l.hosts[hostname]
+	if h == nil {
+		h = &hostHealth{}
+		l.hosts[hostname] = h
+	}
+	prev := h.Streak
+	h.Runs++
+
+	if err == nil {
+		h.LastSuccess = at
+		if h.Streak < 0 {
+			h.Streak = 0
+		}
+		h.Streak++
+		if prev < 0 {
+			return fmt.Sprintf("host recovered after %d failed runs", -prev)
+		}
+		return ""
+	}
+
+	h.Failures++
+	h.LastFailure, h.LastError, h.LastErrorKind = at, err.Error(), kind
+	if h.Streak > 0 {
+		h.Streak = 0
+	}
+	h.Streak--
+	switch {
+	case -h.Streak >= chronicFailures:
+		return fmt.Sprintf("host has failed the last %d runs", -h.Streak)
+	case prev > 0:
+		return fmt.Sprintf("first failure after %d successful runs", prev)
+	}
+	return ""
+}
+
+// save replaces contents of filename atomically
+func (l *healthLedger) save(filename string) error {
+	l.mu.Lock()
+	data, err := json.MarshalIndent(l.hosts, "", "  ")
+	l.mu.Unlock()
+	if err != nil {
+		return errors.New("Cannot write host health: " + err.Error())
+	}
+	if err := replaceFile(filename, append(data, '\n')); err != nil {
+		return errors.New("Cannot write host health: " + err.Error())
+	}
+	return nil
+}
+
+// statusMain implements "gossha status [-db FILE] [-host PATTERN] [-failing]"
+func statusMain(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	db := fs.String("db", defaultHealthFile(), "File that health of hosts was recorded in with -health")
+	host := fs.String("host", "", "Show only hosts matching shell-style pattern")
+	failing := fs.Bool("failing", false, "Show only hosts that failed the last run")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gossha status [-db FILE] [-host PATTERN] [-failing]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	if _, err := path.Match(*host, ""); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid host pattern "+*host+": "+err.Error())
+		return 2
+	}
+
+	if _, err := os.Stat(*db); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot read host health: "+err.Error())
+		return 1
+	}
+	l, err := loadHealth(*db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	var hosts []string
+	for h, s := range l.hosts {
+		if ok, _ := path.Match(*host, h); (*host == "" || ok) && (!*failing || s.Streak < 0) {
+			hosts = append(hosts, h)
+		}
+	}
+	sort.Strings(hosts)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tRUNS\tSUCCESS\tSTREAK\tLAST SUCCESS\tLAST ERROR")
+	for _, h := range hosts {
+		s := l.hosts[h]
+		streak := fmt.Sprintf("%d ok", s.Streak)
+		if s.Streak < 0 {
+			streak = fmt.Sprintf("%d failed", -s.Streak)
+		}
+		lastSuccess := "never"
+		if !s.LastSuccess.IsZero() {
+			lastSuccess = s.LastSuccess.Local().Format("2006-01-02 15:04:05")
+		}
+		lastError := ""
+		if !s.LastFailure.IsZero() {
+			lastError = s.LastFailure.Local().Format("2006-01-02 15:04:05") + " " + strings.SplitN(s.LastError, "\n", 2)[0]
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.0f%%\t%s\t%s\t%s\n", h, s.Runs, 100*float64(s.Runs-s.Failures)/float64(s.Runs), streak, lastSuccess, lastError)
+	}
+	w.Flush()
+	return 0
+}
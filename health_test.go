@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHealthNotes(t *testing.T) {
+	l := &healthLedger{hosts: make(map[string]*hostHealth)}
+	fail := errors.New("Process exited with status 1")
+	now := time.Now()
+
+	for i, c := range []struct {
+		err  error
+		note string
+	}{
+		{nil, ""},
+		{nil, ""},
+		{fail, "first failure after 2 successful runs"},
+		{fail, ""},
+		{fail, "host has failed the last 3 runs"},
+		{fail, "host has failed the last 4 runs"},
+		{nil, "host recovered after 4 failed runs"},
+	} {
+		if note := l.record("web1", c.err, "command-nonzero-exit", now); note != c.note {
+			t.Fatalf("Unexpected note after result #%d: %q, expected %q", i+1, note, c.note)
+		}
+	}
+
+	h := l.hosts["web1"]
+	if h.Runs != 7 || h.Failures != 4 || h.Streak != 1 || h.LastError != fail.Error() || h.LastErrorKind != "command-nonzero-exit" {
+		t.Fatalf("Unexpected health %+v", h)
+	}
+}
+
+func TestHealthFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossha-health")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	r := makeTestResult()
+	srv := &testSSHServer{hostname: "test-health", exitStatus: 1}
+	srv.start()
+	r.hosts[srv.addr] = srv
+
+	healthFile = filepath.Join(dir, "health.json")
+	defer func() { healthFile, health = "", nil }()
+
+	for run := 1; run <= chronicFailures; run++ {
+		health, err = loadHealth(healthFile)
+		must(err, "Could not load health")
+		r.replies = make(map[string]*Reply)
+		sendTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "hostname"})
+
+		note := r.replies[srv.addr].Health
+		if run < chronicFailures && note != "" || run == chronicFailures && note != "host has failed the last 3 runs" {
+			t.Fatalf("Unexpected note in run %d: %q", run, note)
+		}
+	}
+}
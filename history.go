@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Run history (-history DB): every action is stored in a local SQLite database with its
+// description, local user and result of every host (including output), so that past runs can
+// be queried with "gossha history" and "gossha show <run-id>". Database is accessed through
+// sqlite3 command-line tool, so that GoSSHa does not need cgo.
+
+var (
+	historyDB string        // SQLite database to store runs in (-history), empty disables history
+	history   *historyStore // nil if history is disabled
+)
+
+const historySchema = `CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	started REAL NOT NULL,
+	duration REAL NOT NULL,
+	user TEXT NOT NULL,
+	action TEXT NOT NULL,
+	operation TEXT NOT NULL,
+	hosts INTEGER NOT NULL,
+	failed INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS results (
+	run_id INTEGER NOT NULL REFERENCES runs (id),
+	hostname TEXT NOT NULL,
+	operation TEXT NOT NULL,
+	success INTEGER NOT NULL,
+	exit_code INTEGER NOT NULL,
+	duration REAL NOT NULL,
+	stdout TEXT NOT NULL,
+	stderr TEXT NOT NULL,
+	errmsg TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS results_run_id ON results (run_id);
+CREATE INDEX IF NOT EXISTS results_hostname ON results (hostname);
+`
+
+type (
+	historyStore struct {
+		path string
+		user string // local user that runs GoSSHa
+	}
+
+	// historyRun is a row of runs table
+	historyRun struct {
+		ID        int64   `json:"id"`
+		Started   float64 `json:"started"` // unix time
+		Duration  float64 `json:"duration"`
+		User      string  `json:"user"`
+		Action    string  `json:"action"`
+		Operation string  `json:"operation"`
+		Hosts     int     `json:"hosts"`
+		Failed    int     `json:"failed"`
+	}
+
+	// historyResult is a row of results table
+	historyResult struct {
+		Hostname  string  `json:"hostname"`
+		Operation string  `json:"operation"`
+		Success   int     `json:"success"`
+		ExitCode  int     `json:"exit_code"`
+		Duration  float64 `json:"duration"`
+		Stdout    string  `json:"stdout"`
+		Stderr    string  `json:"stderr"`
+		ErrMsg    string  `json:"errmsg"`
+	}
+
+	// historyFilter selects runs for "gossha history"
+	historyFilter struct {
+		host         string // shell-style pattern of host names
+		since, until time.Time
+		limit        int
+	}
+)
+
+func defaultHistoryDB() string {
+	return filepath.Join(homeDir(), ".gossha_history.db")
+}
+
+// openHistory creates database with private permissions if it does not exist and creates tables
+func openHistory(path string) (*historyStore, error) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		return nil, errors.New("Cannot use history: sqlite3 is not installed")
+	}
+
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.New("Cannot open history: " + err.Error())
+	}
+	fp.Close()
+
+	h := &historyStore{path: path, user: localUser()}
+	if _, err := h.exec(historySchema); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// exec runs SQL script with sqlite3 and returns its output
+func (h *historyStore) exec(script string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("sqlite3", append(append([]string{"-batch", "-bail"}, args...), h.path)...)
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, errors.New("Cannot access history " + h.path + ": " + msg)
+	}
+	return stdout.Bytes(), nil
+}
+
+// query runs SELECT statement and decodes rows into v, database is opened read-only
+func (h *historyStore) query(stmt string, v interface{}) error {
+	out, err := h.exec(stmt, "-readonly", "-json")
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return nil // sqlite3 prints nothing if there are no rows
+	}
+	if err := json.Unmarshal(out, v); err != nil {
+		return errors.New("Cannot parse history: " + err.Error())
+	}
+	return nil
+}
+
+// sqlQuote returns SQL string literal of s; NUL bytes cannot be passed through sqlite3 and are dropped
+func sqlQuote(s string) string {
+	return "'" + strings.Replace(strings.Replace(s, "\x00", "", -1), "'", "''", -1) + "'"
+}
+
+func sqlFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// save stores run of msg that started at start with results of all hosts in a single transaction
+func (h *historyStore) save(msg *ProxyRequest, start time.Time, results []*SshResult) error {
+	render, _ := newHostRenderer(msg) // templates are already validated by getExecFunc
+
+	failed := 0
+	for _, res := range results {
+		if res.err != nil {
+			failed++
+		}
+	}
+
+	user := h.user
+	if msg.scheduled != "" {
+		user += " (schedule " + msg.scheduled + ")"
+	}
+
+	var script strings.Builder
+	script.WriteString("BEGIN IMMEDIATE;\n")
+	fmt.Fprintf(&script, "INSERT INTO runs (started, duration, user, action, operation, hosts, failed) VALUES (%s, %s, %s, %s, %s, %d, %d);\n",
+		sqlFloat(float64(start.UnixNano())/1e9), sqlFloat(time.Since(start).Seconds()), sqlQuote(user), sqlQuote(msg.Action),
+		sqlQuote(strings.TrimSuffix(describeAction(msg), "\n")), len(msg.Hosts), failed)
+
+	for _, res := range results {
+		operation := describeAction(msg)
+		if req, err := render(res.hostname); err == nil {
+			operation = describeAction(req)
+		}
+		errMsg := ""
+		if res.err != nil {
+			errMsg = res.err.Error()
+		}
+		success := 0
+		if res.err == nil {
+			success = 1
+		}
+
+		fmt.Fprintf(&script, "INSERT INTO results VALUES ((SELECT max(id) FROM runs), %s, %s, %d, %d, %s, %s, %s, %s);\n",
+			sqlQuote(res.hostname), sqlQuote(strings.TrimSuffix(operation, "\n")), success, exitCode(res.err),
+			sqlFloat(res.duration.Seconds()), sqlQuote(res.stdout), sqlQuote(res.stderr), sqlQuote(errMsg))
+	}
+	script.WriteString("COMMIT;\n")
+
+	_, err := h.exec(script.String())
+	return err
+}
+
+// runs returns runs matching filter, latest first
+func (h *historyStore) runs(f *historyFilter) (runs []*historyRun, err error) {
+	stmt := "SELECT * FROM runs WHERE 1"
+	if f.host != "" {
+		stmt += " AND id IN (SELECT run_id FROM results WHERE hostname GLOB " + sqlQuote(f.host) + ")"
+	}
+	if !f.since.IsZero() {
+		stmt += " AND started >= " + strconv.FormatInt(f.since.Unix(), 10)
+	}
+	if !f.until.IsZero() {
+		stmt += " AND started < " + strconv.FormatInt(f.until.Unix(), 10)
+	}
+	stmt += " ORDER BY id DESC"
+	if f.limit > 0 {
+		stmt += " LIMIT " + strconv.Itoa(f.limit)
+	}
+
+	err = h.query(stmt+";", &runs)
+	return
+}
+
+// run returns run with id and results of hosts matching pattern (all hosts if it is empty) ordered by host
+func (h *historyStore) run(id int64, host string) (*historyRun, []*historyResult, error) {
+	var runs []*historyRun
+	if err := h.query(fmt.Sprintf("SELECT * FROM runs WHERE id = %d;", id), &runs); err != nil {
+		return nil, nil, err
+	}
+	if len(runs) == 0 {
+		return nil, nil, fmt.Errorf("Run %d not found", id)
+	}
+
+	stmt := fmt.Sprintf("SELECT hostname, operation, success, exit_code, duration, stdout, stderr, errmsg FROM results WHERE run_id = %d", id)
+	if host != "" {
+		stmt += " AND hostname GLOB " + sqlQuote(host)
+	}
+
+	var results []*historyResult
+	if err := h.query(stmt+" ORDER BY hostname;", &results); err != nil {
+		return nil, nil, err
+	}
+	return runs[0], results, nil
+}
+
+// parseHistoryTime parses date or date and time in local time zone
+func parseHistoryTime(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02 15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("Invalid time " + s + ", expected YYYY-MM-DD[ HH:MM[:SS]]")
+}
+
+func formatHistoryTime(unix float64) string {
+	return time.Unix(0, int64(unix*1e9)).Format("2006-01-02 15:04:05")
+}
+
+// historyMain implements "gossha history [-db FILE] [-host PATTERN] [-since TIME] [-until TIME] [-n N]"
+func historyMain(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	db := fs.String("db", defaultHistoryDB(), "SQLite database that runs were stored in with -history")
+	host := fs.String("host", "", "Show only runs that included hosts matching shell-style pattern")
+	since := fs.String("since", "", "Show only runs started at or after YYYY-MM-DD[ HH:MM[:SS]] (local time)")
+	until := fs.String("until", "", "Show only runs started before YYYY-MM-DD[ HH:MM[:SS]] (local time)")
+	limit := fs.Int("n", 50, "Maximum number of runs to show, 0 shows all")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gossha history [-db FILE] [-host PATTERN] [-since TIME] [-until TIME] [-n N]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	f := &historyFilter{host: *host, limit: *limit}
+	var err error
+	if *since != "" {
+		if f.since, err = parseHistoryTime(*since); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 2
+		}
+	}
+	if *until != "" {
+		if f.until, err = parseHistoryTime(*until); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 2
+		}
+	}
+
+	runs, err := (&historyStore{path: *db}).runs(f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTARTED\tUSER\tACTION\tHOSTS\tFAILED\tOPERATION")
+	for _, r := range runs {
+		operation := r.Operation
+		if idx := strings.IndexByte(operation, '\n'); idx >= 0 {
+			operation = operation[:idx] + " ..."
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%s\n", r.ID, formatHistoryTime(r.Started), r.User, r.Action, r.Hosts, r.Failed, operation)
+	}
+	w.Flush()
+	return 0
+}
+
+// showMain implements "gossha show [-db FILE] [-host PATTERN] <run-id>", results are printed as with -output text
+func showMain(args []string) int {
+	fs := flag.NewFlagSet("show", flag.ContinueOnError)
+	db := fs.String("db", defaultHistoryDB(), "SQLite database that runs were stored in with -history")
+	host := fs.String("host", "", "Show only results of hosts matching shell-style pattern")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gossha show [-db FILE] [-host PATTERN] <run-id>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid run id "+fs.Arg(0))
+		return 2
+	}
+
+	run, results, err := (&historyStore{path: *db}).run(id, *host)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	fmt.Printf("Run %d started at %s by %s: %s on %d host(s), %d failed (%.2fs)\n", run.ID, formatHistoryTime(run.Started), run.User, run.Action, run.Hosts, run.Failed, run.Duration)
+	fmt.Print(indentOutput(run.Operation))
+
+	for _, res := range results {
+		reply := &Reply{Hostname: res.Hostname, Stdout: res.Stdout, Stderr: res.Stderr, Success: res.Success != 0, ErrMsg: res.ErrMsg, ExitCode: res.ExitCode, Duration: res.Duration}
+		writeReplyText(os.Stdout, os.Stderr, reply, "")
+		if res.Operation != run.Operation {
+			fmt.Print("  --- operation:\n" + indentOutput(res.Operation))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "gossha-history")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	history, err = openHistory(filepath.Join(dir, "history.db"))
+	must(err, "Could not open history")
+	defer func() { history = nil }()
+
+	r := makeTestResult()
+	startTestServers(r, "test-history", 2)
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = "echo 'it''s'"
+	runTestRequest(t, r, req)
+
+	runs, err := history.runs(&historyFilter{since: time.Now().Add(-time.Hour)})
+	must(err, "Could not list runs")
+	if len(runs) != 1 || runs[0].Hosts != 2 || runs[0].Failed != 0 || runs[0].Operation != "Run: echo 'it''s'" {
+		t.Fatalf("Unexpected runs: %+v", runs)
+	}
+
+	for addr := range r.hosts {
+		if runs, err := history.runs(&historyFilter{host: addr}); err != nil || len(runs) != 1 {
+			t.Fatalf("Run must be found by host %s: %v, %v", addr, runs, err)
+		}
+
+		run, results, err := history.run(runs[0].ID, addr)
+		must(err, "Could not get run")
+		if run.ID != runs[0].ID || len(results) != 1 || results[0].Success != 1 || results[0].Stdout != r.replies[addr].Stdout {
+			t.Fatalf("Unexpected results of %s: %+v", addr, results)
+		}
+	}
+
+	if runs, err := history.runs(&historyFilter{until: time.Now().Add(-time.Hour)}); err != nil || len(runs) != 0 {
+		t.Fatalf("No runs expected before the test: %v, %v", runs, err)
+	}
+	if _, _, err := history.run(runs[0].ID+1, ""); err == nil {
+		t.Fatalf("Missing run must be reported")
+	}
+}
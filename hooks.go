@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Local hooks (-hook-before-run, -hook-after-run, -hook-before-host, -hook-after-host): commands run
+// with local shell before and after every run and every host of it, e.g. to update a ticket, drain
+// host from load balancer and return it back, or push metrics. Failed before-run hook cancels the
+// run, failed before-host hook fails the host without running action on it and failed after-host
+// hook fails the host if action succeeded. Hooks are not run with -dry-run.
+
+const (
+	defaultHookTimeout = time.Minute
+	maxHookOutput      = 512 // bytes of output of failed hook included in error
+)
+
+var (
+	hookBeforeRun  string        // local command run before every run (-hook-before-run)
+	hookAfterRun   string        // local command run after every run (-hook-after-run)
+	hookBeforeHost string        // local command run before action on every host (-hook-before-host)
+	hookAfterHost  string        // local command run after action on every host (-hook-after-host)
+	hookTimeout    time.Duration // hooks that run longer are killed (-hook-timeout)
+)
+
+// runHook runs local command cmd of hook name with env added to environment, empty cmd does nothing
+func runHook(name, cmd string, env []string) error {
+	return runHookInput(name, cmd, env, nil)
+}
+
+// runHookInput is runHook that writes stdin to input of the command
+func runHookInput(name, cmd string, env []string, stdin []byte) error {
+	if cmd == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	c := localShellCommand(ctx, cmd)
+	c.Env = append(os.Environ(), env...)
+	if stdin != nil {
+		c.Stdin = bytes.NewReader(stdin)
+	}
+	out, err := c.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.New("timed out after " + hookTimeout.String())
+	}
+	if err == nil {
+		return nil
+	}
+
+	msg := "Hook " + name + " failed: " + err.Error()
+	if out := strings.TrimSpace(string(out)); out != "" {
+		if len(out) > maxHookOutput {
+			out = "..." + out[len(out)-maxHookOutput:]
+		}
+		msg += ": " + out
+	}
+	return errors.New(msg)
+}
+
+// runHookEnv is environment of run hooks of msg
+func runHookEnv(msg *ProxyRequest) []string {
+	return []string{"GOSSHA_ACTION=" + msg.Action, "HOST_COUNT=" + strconv.Itoa(len(msg.Hosts))}
+}
+
+// afterRunHookEnv adds result of the whole run to environment of run hooks
+func afterRunHookEnv(msg *ProxyRequest, failed int, duration time.Duration) []string {
+	status := 0
+	if failed > 0 {
+		status = 1
+	}
+	return append(runHookEnv(msg), "EXIT_CODE="+strconv.Itoa(status), "FAILED_COUNT="+strconv.Itoa(failed), hookDuration(duration))
+}
+
+func hookDuration(d time.Duration) string {
+	return fmt.Sprintf("DURATION=%.3f", d.Seconds())
+}
+
+// withHostHooks runs host hooks around execFunc: HOST is set for both of them, after-host hook also
+// gets EXIT_CODE (-1 if it is unknown), ERROR (empty if action succeeded) and DURATION in seconds
+func withHostHooks(msg *ProxyRequest, execFunc func(string) *SshResult) func(string) *SshResult {
+	if hookBeforeHost == "" && hookAfterHost == "" {
+		return execFunc
+	}
+
+	return func(hostname string) *SshResult {
+		env := []string{"GOSSHA_ACTION=" + msg.Action, "HOST=" + hostname}
+		if err := runHook("before-host", hookBeforeHost, env); err != nil {
+			return &SshResult{hostname: hostname, err: err}
+		}
+
+		start := time.Now()
+		res := execFunc(hostname)
+
+		errMsg := ""
+		if res.err != nil {
+			errMsg = res.err.Error()
+		}
+		env = append(env, "EXIT_CODE="+strconv.Itoa(exitCode(res.err)), "ERROR="+errMsg, hookDuration(time.Since(start)))
+
+		if err := runHook("after-host", hookAfterHost, env); err != nil {
+			if res.err == nil {
+				res.err = err
+			} else {
+				reportErrorToUser(hostname + ": " + err.Error())
+			}
+		}
+		return res
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-hooks", 3)
+
+	dir, err := ioutil.TempDir("", "gossha-hooks")
+	must(err, "Could not create temporary directory")
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "hooks.log")
+
+	var drained string
+	for addr := range r.hosts {
+		drained = addr
+		break
+	}
+
+	hookBeforeRun = `echo "before-run $GOSSHA_ACTION $HOST_COUNT" >>` + log
+	hookAfterRun = `echo "after-run $EXIT_CODE $FAILED_COUNT" >>` + log
+	hookBeforeHost = `[ "$HOST" != "` + drained + `" ] || { echo cannot drain; exit 3; }`
+	hookAfterHost = `echo "after-host $HOST $EXIT_CODE" >>` + log
+	defer func() { hookBeforeRun, hookAfterRun, hookBeforeHost, hookAfterHost = "", "", "", "" }()
+
+	req := makeProxyRequest(maxTimeout)
+	for addr := range r.hosts {
+		req.Hosts = append(req.Hosts, addr)
+	}
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+
+	for addr, reply := range r.replies {
+		if addr == drained {
+			if reply.Success || reply.ErrMsg != "Hook before-host failed: exit status 3: cannot drain" {
+				t.Fatalf("Host must fail when before-host hook fails: %+v", reply)
+			}
+		} else if !reply.Success {
+			t.Fatalf("Other hosts must succeed: %+v", reply)
+		}
+	}
+
+	data, err := ioutil.ReadFile(log)
+	must(err, "Could not read hooks log")
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 || lines[0] != "before-run ssh 3" || lines[3] != "after-run 1 1" {
+		t.Fatalf("Unexpected hooks log: %q", lines)
+	}
+
+	var hosts []string
+	for addr := range r.hosts {
+		if addr != drained {
+			hosts = append(hosts, "after-host "+addr+" 0")
+		}
+	}
+	sort.Strings(hosts)
+	sort.Strings(lines[1:3])
+	if strings.Join(lines[1:3], "\n") != strings.Join(hosts, "\n") {
+		t.Fatalf("After-host hook must run on hosts where action ran: %q", lines)
+	}
+}
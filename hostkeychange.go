@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Changed host keys: hosts which key does not match pinned fingerprints are collected while an
+// action runs, and FinalReply lists them in "HostKeyChanges" with old and new fingerprints, so that
+// a mass reinstall shows up as one report instead of a failure per host. After keys were verified,
+// -accept-changed <hosts> (comma-separated names or shell-style patterns) accepts new keys of those
+// hosts and re-pins them in -host-key-file (~/.gossha_host_keys.json): the new fingerprint is trusted
+// instead of pinned ones as long as inventory pins the same fingerprints, so that updating
+// gossha_host_key later makes the entry obsolete. Keys that changed after they were accepted in
+// "tofu" mode are reported the same way and accepted until GoSSHa exits.
+
+var (
+	acceptChanged string // -accept-changed
+	hostKeyFile   string // -host-key-file
+
+	hostKeyChangesMu sync.Mutex
+	hostKeyChanges   = make(map[string]*HostKeyChange) // changes found since the last report, by hostname
+	repinnedKeys     = make(map[string]*repinnedKey)   // contents of hostKeyFile, guarded by hostKeyChangesMu
+)
+
+// HostKeyChange is a host which key does not match the one it is expected to have
+type HostKeyChange struct {
+	Hostname    string
+	KeyType     string
+	Expected    []string // pinned (or accepted) fingerprints
+	Fingerprint string   // fingerprint of key presented by host
+	Accepted    bool     `json:",omitempty"` // key was accepted with -accept-changed
+}
+
+// repinnedKey is fingerprint accepted with -accept-changed instead of pinned ones
+type repinnedKey struct {
+	Fingerprint string    `json:"fingerprint"`
+	Replaces    []string  `json:"replaces"` // gossha_host_key of host when the key was accepted
+	Accepted    time.Time `json:"accepted"`
+}
+
+func defaultHostKeyFile() string {
+	return filepath.Join(homeDir(), ".gossha_host_keys.json")
+}
+
+// checkAcceptChanged validates -accept-changed
+func checkAcceptChanged(hosts string) error {
+	for _, p := range strings.Split(hosts, ",") {
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.New("Invalid -accept-changed pattern " + p + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// acceptsChanged tells whether -accept-changed lists hostname (with or without port)
+func acceptsChanged(hostname string) bool {
+	if acceptChanged == "" {
+		return false
+	}
+	host, _ := splitHostPort(hostname)
+	for _, p := range strings.Split(acceptChanged, ",") {
+		if ok, _ := path.Match(p, hostname); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRepinnedKeys reads filename, file does not have to exist
+func loadRepinnedKeys(filename string) (map[string]*repinnedKey, error) {
+	keys := make(map[string]*repinnedKey)
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return keys, nil
+	} else if err != nil {
+		return nil, errors.New("Cannot read host keys: " + err.Error())
+	}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, errors.New("Cannot parse host keys " + filename + ": " + err.Error())
+	}
+	return keys, nil
+}
+
+// expectedHostKeys returns fingerprints that hostname must present: pins, or the key that
+// replaced them
+func expectedHostKeys(hostname string, pins []string) []string {
+	hostKeyChangesMu.Lock()
+	defer hostKeyChangesMu.Unlock()
+
+	if k := repinnedKeys[hostname]; k != nil && strings.Join(k.Replaces, ",") == strings.Join(pins, ",") {
+		return []string{k.Fingerprint}
+	}
+	return pins
+}
+
+// changedHostKey records that key of hostname is not one of expected fingerprints and returns
+// error unless -accept-changed lists the host; pinned key is re-pinned then
+func changedHostKey(hostname string, expected, pins []string, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+	change := &HostKeyChange{Hostname: hostname, KeyType: key.Type(), Expected: expected, Fingerprint: fingerprint, Accepted: acceptsChanged(hostname)}
+
+	hostKeyChangesMu.Lock()
+	defer hostKeyChangesMu.Unlock()
+	hostKeyChanges[hostname] = change
+
+	if !change.Accepted {
+		what := "pinned "
+		if len(pins) == 0 {
+			what = "accepted "
+		}
+		return &hostKeyError{"Host key " + fingerprint + " of " + hostname + " does not match " + what + strings.Join(expected, ", ") +
+			", use -accept-changed " + hostname + " if the host was reinstalled"}
+	}
+	if len(pins) == 0 {
+		return nil
+	}
+
+	prev := repinnedKeys[hostname]
+	repinnedKeys[hostname] = &repinnedKey{Fingerprint: fingerprint, Replaces: pins, Accepted: time.Now()}
+	if err := saveRepinnedKeys(hostKeyFile); err != nil {
+		if prev != nil {
+			repinnedKeys[hostname] = prev
+		} else {
+			delete(repinnedKeys, hostname)
+		}
+		change.Accepted = false
+		return &hostKeyError{"Cannot re-pin host key of " + hostname + ": " + err.Error()}
+	}
+	logf(logInfo, hostname, "Host key %s is re-pinned in %s", fingerprint, hostKeyFile)
+	return nil
+}
+
+// saveRepinnedKeys replaces contents of filename atomically, hostKeyChangesMu must be held
+func saveRepinnedKeys(filename string) error {
+	data, err := json.MarshalIndent(repinnedKeys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFile(filename, append(data, '\n'))
+}
+
+// takeHostKeyChanges returns changes found since the last call, ordered by hostname
+func takeHostKeyChanges() []*HostKeyChange {
+	hostKeyChangesMu.Lock()
+	defer hostKeyChangesMu.Unlock()
+
+	var res []*HostKeyChange
+	for _, c := range hostKeyChanges {
+		res = append(res, c)
+	}
+	hostKeyChanges = make(map[string]*HostKeyChange)
+	sort.Slice(res, func(i, j int) bool { return res[i].Hostname < res[j].Hostname })
+	return res
+}
+
+// formatHostKeyChanges returns lines of report about changes for text output
+func formatHostKeyChanges(changes []*HostKeyChange) []string {
+	var res, rejected []string
+	for _, c := range changes {
+		if !c.Accepted {
+			rejected = append(rejected, c.Hostname)
+		}
+	}
+	if len(rejected) > 0 {
+		res = append(res, "host key changed on "+strings.Join(rejected, ",")+", verify new keys and run with -accept-changed "+strings.Join(rejected, ",")+" to re-pin them:")
+	} else if len(changes) > 0 {
+		res = append(res, "host keys changed and were accepted:")
+	}
+	for _, c := range changes {
+		ln := "  " + c.Hostname + ": " + strings.Join(c.Expected, ", ") + " -> " + c.KeyType + " " + c.Fingerprint
+		if c.Accepted {
+			ln += " (accepted)"
+		}
+		res = append(res, ln)
+	}
+	return res
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAcceptChangedHostKeys(t *testing.T) {
+	k, err := ssh.ParsePrivateKey([]byte(idRsa))
+	must(err, "Could not parse host key")
+	fingerprint := ssh.FingerprintSHA256(k.PublicKey())
+
+	r := makeTestResult()
+	startTestServers(r, "test-host-key-change", 2)
+
+	inv := newInventory()
+	inv.group("all")
+	var hosts []string
+	for addr := range r.hosts {
+		must(inv.addHost("all", addr, map[string]string{"gossha_host_key": "SHA256:old"}), "Could not add host")
+		hosts = append(hosts, addr)
+	}
+	inv.resolveVars()
+	accepted, rejected := hosts[0], hosts[1]
+
+	hostInventory = inv
+	hostKeyFile = filepath.Join(t.TempDir(), "host_keys.json")
+	defer func() {
+		hostInventory, acceptChanged, hostKeyFile = nil, "", ""
+		repinnedKeys = make(map[string]*repinnedKey)
+	}()
+
+	run := func() {
+		req := makeProxyRequest(maxTimeout)
+		req.Cmd = "echo hello"
+		req.Hosts = hosts
+		r.hostsLeft = map[string]struct{}{accepted: {}, rejected: {}}
+		requestsChan <- req
+		waitReply(t, r, maxTimeout)
+	}
+
+	run()
+	if changes := r.final.HostKeyChanges; len(changes) != 2 || changes[0].Accepted || changes[0].Fingerprint != fingerprint || changes[0].Expected[0] != "SHA256:old" {
+		t.Fatalf("Unexpected host key changes: %+v", changes)
+	}
+	if reply := r.replies[rejected]; reply.Success || !strings.Contains(reply.ErrMsg, "-accept-changed "+rejected) {
+		t.Fatalf("Host with changed key must be rejected: %+v", reply)
+	}
+
+	acceptChanged = accepted
+	run()
+	if !r.replies[accepted].Success || r.replies[rejected].Success {
+		t.Fatalf("Only key of %s must be accepted: %+v", accepted, r.replies)
+	}
+	if changes := r.final.HostKeyChanges; len(changes) != 2 || !changes[0].Accepted && !changes[1].Accepted {
+		t.Fatalf("Unexpected host key changes: %+v", changes)
+	}
+
+	acceptChanged = ""
+	run()
+	if !r.replies[accepted].Success {
+		t.Fatalf("Re-pinned key must be trusted: %+v", r.replies[accepted])
+	}
+	if changes := r.final.HostKeyChanges; len(changes) != 1 || changes[0].Hostname != rejected {
+		t.Fatalf("Unexpected host key changes: %+v", changes)
+	}
+
+	keys, err := loadRepinnedKeys(hostKeyFile)
+	if err != nil || len(keys) != 1 || keys[accepted] == nil || keys[accepted].Fingerprint != fingerprint {
+		t.Fatalf("Unexpected re-pinned keys: %+v, %v", keys, err)
+	}
+
+	acceptChanged = "db1,web*"
+	if !acceptsChanged("web2:2222") || !acceptsChanged("db1") || acceptsChanged("db2") {
+		t.Fatalf("Unexpected matching of -accept-changed hosts")
+	}
+
+	// new pins in inventory make re-pinned key obsolete
+	if exp := expectedHostKeys(accepted, []string{"SHA256:new"}); len(exp) != 1 || exp[0] != "SHA256:new" {
+		t.Fatalf("Unexpected expected keys: %v", exp)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Host key checking (-host-keys): fingerprints pinned with gossha_host_key inventory variable (or
+// host_key option of "hosts" section of configuration file) are always enforced. Keys of other hosts
+// are accepted in "any" mode (the default), rejected in "pin" mode, and in "tofu" mode fingerprint
+// is sent to user (HostKeyRequest), accepted keys are trusted until GoSSHa exits. Keys that do not
+// match are collected for a report, see hostkeychange.go.
+
+var (
+	hostKeyMode     = "any"                   // how keys of hosts without pinned fingerprints are checked (-host-keys)
+	trustedHostKeys = make(map[string]string) // fingerprints accepted by user in "tofu" mode, guarded by challengeMu
+)
+
+// HostKeyRequest asks user to confirm key of host that is not pinned, answer is expected in
+// the next request: {"AcceptHostKey":true}
+type HostKeyRequest struct {
+	Hostname    string
+	KeyType     string
+	Fingerprint string
+}
+
+// checkHostKeyMode validates -host-keys
+func checkHostKeyMode(mode string) error {
+	if mode != "any" && mode != "pin" && mode != "tofu" {
+		return errors.New("Invalid -host-keys mode " + mode + ": must be any, pin or tofu")
+	}
+	return nil
+}
+
+// parseHostKeyPins parses gossha_host_key: comma or space separated SHA256 fingerprints
+func parseHostKeyPins(v string) ([]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+
+	pins := strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+	for _, p := range pins {
+		if !strings.HasPrefix(p, "SHA256:") {
+			return nil, errors.New("gossha_host_key must be a list of SHA256:<base64> fingerprints")
+		}
+	}
+	return pins, nil
+}
+
+// hostKeyCallback returns callback that checks keys of inventory host hostname
+func hostKeyCallback(hostname string) ssh.HostKeyCallback {
+	pins := hostOptionsOf(hostname).hostKeys
+
+	return func(addr string, remote net.Addr, key ssh.PublicKey) error {
+		logHostKey(addr, remote, key)
+		fingerprint := ssh.FingerprintSHA256(key)
+
+		if len(pins) > 0 {
+			expected := expectedHostKeys(hostname, pins)
+			for _, p := range expected {
+				if p == fingerprint {
+					return nil
+				}
+			}
+			return changedHostKey(hostname, expected, pins, key)
+		}
+
+		switch hostKeyMode {
+		case "pin":
+			return &hostKeyError{"Host key of " + hostname + " is not pinned, set gossha_host_key to " + fingerprint + " to trust it"}
+		case "tofu":
+			return confirmHostKey(hostname, key)
+		}
+		return nil
+	}
+}
+
+// promptHostKey asks about HostKeyRequest on terminal for subcommands and sends the answer
+func promptHostKey(stdin *bufio.Reader, req *HostKeyRequest) {
+	fmt.Fprintf(os.Stderr, "Unknown host key of %s: %s %s\nTrust it (yes/no)? ", req.Hostname, req.KeyType, req.Fingerprint)
+	line, _ := stdin.ReadString('\n')
+	requestsChan <- &ProxyRequest{AcceptHostKey: strings.TrimSpace(line) == "yes"}
+}
+
+// confirmHostKey asks user whether key of hostname can be trusted, unless it was already accepted
+func confirmHostKey(hostname string, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	challengeMu.Lock()
+	defer challengeMu.Unlock()
+
+	if trusted, ok := trustedHostKeys[hostname]; ok {
+		if trusted != fingerprint {
+			if err := changedHostKey(hostname, []string{trusted}, nil, key); err != nil {
+				return err
+			}
+			trustedHostKeys[hostname] = fingerprint
+		}
+		return nil
+	}
+
+	sendProxyReply(&HostKeyRequest{Hostname: hostname, KeyType: key.Type(), Fingerprint: fingerprint})
+
+	response, ok := <-requestsChan
+	if !ok || !response.AcceptHostKey {
+		return &hostKeyError{"Host key " + fingerprint + " of " + hostname + " was not accepted"}
+	}
+
+	trustedHostKeys[hostname] = fingerprint
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostKeyPinning(t *testing.T) {
+	k, err := ssh.ParsePrivateKey([]byte(idRsa))
+	must(err, "Could not parse host key")
+	fingerprint := ssh.FingerprintSHA256(k.PublicKey())
+
+	r := makeTestResult()
+	startTestServers(r, "test-host-key-pin", 3)
+
+	var pinned, wrong, unpinned string
+	inv := newInventory()
+	inv.group("all")
+	for addr := range r.hosts {
+		pin := ""
+		switch {
+		case pinned == "":
+			pinned, pin = addr, "SHA256:other, "+fingerprint
+		case wrong == "":
+			wrong, pin = addr, "SHA256:other"
+		default:
+			unpinned = addr
+		}
+		must(inv.addHost("all", addr, map[string]string{"gossha_host_key": pin}), "Could not add host")
+	}
+	inv.resolveVars()
+
+	hostInventory = inv
+	hostKeyMode = "pin"
+	defer func() { hostInventory, hostKeyMode = nil, "any" }()
+
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = "echo hello"
+	for addr := range r.hosts {
+		req.Hosts = append(req.Hosts, addr)
+	}
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+
+	if !r.replies[pinned].Success {
+		t.Fatalf("Host with pinned key must be connected to: %+v", r.replies[pinned])
+	}
+	if reply := r.replies[wrong]; reply.Success || !strings.Contains(reply.ErrMsg, "does not match pinned SHA256:other") {
+		t.Fatalf("Host with different key must be rejected: %+v", reply)
+	}
+	if reply := r.replies[unpinned]; reply.Success || !strings.Contains(reply.ErrMsg, "set gossha_host_key to "+fingerprint) {
+		t.Fatalf("Host without pinned key must be rejected in pin mode: %+v", reply)
+	}
+
+	if _, err := parseHostKeyPins("MD5:00:11"); err == nil {
+		t.Fatalf("Fingerprints other than SHA256 must be rejected")
+	}
+}
+
+func TestHostKeyTOFU(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-host-key-tofu", 2)
+
+	hostKeyMode = "tofu"
+	setDisconnectAfterUse(true)
+	defer func() {
+		hostKeyMode = "any"
+		setDisconnectAfterUse(false)
+		trustedHostKeys = make(map[string]string)
+	}()
+
+	var accepted string
+	asked := make(map[string]int)
+	for addr := range r.hosts {
+		accepted = addr
+		break
+	}
+
+	run := func() map[string]*Reply {
+		replies := make(map[string]*Reply)
+		req := makeProxyRequest(maxTimeout)
+		req.Cmd = "echo hello"
+		for addr := range r.hosts {
+			req.Hosts = append(req.Hosts, addr)
+		}
+		requestsChan <- req
+
+		timeoutCh := time.After(maxTimeout)
+		for {
+			select {
+			case reply := <-repliesChan:
+				switch reply := reply.(type) {
+				case *HostKeyRequest:
+					if reply.Fingerprint == "" || reply.KeyType != "ssh-rsa" {
+						t.Fatalf("Unexpected host key request: %+v", reply)
+					}
+					asked[reply.Hostname]++
+					requestsChan <- &ProxyRequest{AcceptHostKey: reply.Hostname == accepted}
+				case *Reply:
+					replies[reply.Hostname] = reply
+				case *FinalReply:
+					return replies
+				}
+			case <-timeoutCh:
+				t.Fatalf("Timed out")
+			}
+		}
+	}
+
+	replies := run()
+	for addr, reply := range replies {
+		if addr == accepted && !reply.Success {
+			t.Fatalf("Host with accepted key must be connected to: %+v", reply)
+		} else if addr != accepted && (reply.Success || !strings.Contains(reply.ErrMsg, "was not accepted")) {
+			t.Fatalf("Host with rejected key must fail: %+v", reply)
+		}
+	}
+
+	if trustedHostKeys[accepted] == "" || len(trustedHostKeys) != 1 {
+		t.Fatalf("Only accepted key must be trusted: %v", trustedHostKeys)
+	}
+
+	// accepted key is not asked about again, rejected one is
+	if replies = run(); !replies[accepted].Success || asked[accepted] != 1 || len(asked) != 2 {
+		t.Fatalf("Accepted key must be trusted on reconnect: %v, %+v", asked, replies[accepted])
+	}
+	for addr, n := range asked {
+		if addr != accepted && n != 2 {
+			t.Fatalf("Rejected key must be asked about again: %v", asked)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Per-host options: inventory variables ansible_ssh_private_key_file, ansible_timeout (seconds),
+// gossha_connect_timeout and gossha_timeout (durations) override global key list and timeouts
+// for specific hosts, gossha_host_key pins host key fingerprints (see hostkeys.go), gossha_remote_encoding sets encoding
+// of output (see encoding.go), gossha_auth sets authentication providers (see auth.go), gossha_transfer sets
+// backend of uploads (see transfer.go), "hosts" section of configuration file sets them (together with ansible_host,
+// ansible_port and ansible_user) for host patterns.
+
+// hostOptionVars maps options of "hosts" section of configuration file to inventory variables
+var hostOptionVars = map[string]string{
+	"host":            "ansible_host",
+	"port":            "ansible_port",
+	"user":            "ansible_user",
+	"identity_file":   "ansible_ssh_private_key_file",
+	"connect_timeout": "gossha_connect_timeout",
+	"timeout":         "gossha_timeout",
+	"host_key":        "gossha_host_key",
+	"remote_encoding": "gossha_remote_encoding",
+	"auth":            "gossha_auth",
+	"transfer":        "gossha_transfer",
+	"description":     "gossha_description",
+	"owner":           "gossha_owner",
+	"contact":         "gossha_contact",
+}
+
+var identitySigners map[string][]ssh.Signer // signers of ansible_ssh_private_key_file keys by path
+
+// hostOptions are options of a single host that override global ones
+type hostOptions struct {
+	identityFile   string        // key that is offered before global ones
+	connectTimeout time.Duration // time limit for TCP connection, handshake and authentication
+	timeout        time.Duration // time limit for action on host
+	hostKeys       []string      // pinned fingerprints of host key
+	encoding       string        // encoding of output of commands (see encoding.go)
+	auth           []string      // names of authentication providers (see auth.go)
+	transfer       string        // backend of uploads (see transfer.go)
+}
+
+// parseHostOptions parses per-host options from inventory variables of host
+func parseHostOptions(vars map[string]string) (opts hostOptions, err error) {
+	opts.identityFile = vars["ansible_ssh_private_key_file"]
+
+	if opts.encoding = vars["gossha_remote_encoding"]; opts.encoding != "" {
+		if err = checkEncoding(opts.encoding); err != nil {
+			return
+		}
+	}
+
+	if opts.hostKeys, err = parseHostKeyPins(vars["gossha_host_key"]); err != nil {
+		return
+	}
+
+	if opts.auth, err = parseAuthChain(vars["gossha_auth"]); err != nil {
+		return opts, errors.New("gossha_auth: " + err.Error())
+	}
+
+	if opts.transfer = vars["gossha_transfer"]; opts.transfer != "" {
+		if err = checkTransfer(opts.transfer); err != nil {
+			return opts, errors.New("gossha_transfer: " + err.Error())
+		}
+	}
+
+	if v := vars["ansible_timeout"]; v != "" {
+		secs, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || secs == 0 {
+			return opts, errors.New("ansible_timeout must be a positive number of seconds")
+		}
+		opts.connectTimeout = time.Duration(secs) * time.Second
+	}
+
+	for _, v := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"gossha_connect_timeout", &opts.connectTimeout},
+		{"gossha_timeout", &opts.timeout},
+	} {
+		if s := vars[v.name]; s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				return opts, errors.New(v.name + " must be a positive duration like 30s")
+			}
+			*v.dst = d
+		}
+	}
+
+	return
+}
+
+// hostOptionsOf returns per-host options of inventory host (zero options if host is not in inventory)
+func hostOptionsOf(hostname string) hostOptions {
+	if hostInventory == nil {
+		return hostOptions{}
+	}
+	opts, _ := parseHostOptions(hostInventory.HostVars(hostname)) // validated when inventory is loaded
+	return opts
+}
+
+// loadIdentityFiles loads keys referenced by ansible_ssh_private_key_file of inventory hosts;
+// keys that cannot be loaded are reported and hosts fall back to global keys
+func loadIdentityFiles() {
+	identitySigners = make(map[string][]ssh.Signer)
+	if hostInventory == nil {
+		return
+	}
+
+	var files []string
+	for _, vars := range hostInventory.mergedVars {
+		if f := vars["ansible_ssh_private_key_file"]; f != "" && identitySigners[f] == nil {
+			identitySigners[f] = []ssh.Signer{}
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+
+	for _, f := range files {
+		signer, err := makeSigner(expandHome(f))
+		if err != nil {
+			reportErrorToUser("Cannot load identity file " + f + ": " + err.Error())
+			continue
+		}
+		identitySigners[f] = append(certSigners([]string{expandHome(f)}, []ssh.Signer{signer}), signer)
+	}
+}
+
+// withHostTimeouts limits duration of action on hosts that have gossha_timeout; connection to host
+// is closed when time is up, so that commands that are still running are aborted
+func withHostTimeouts(msg *ProxyRequest, execFunc func(string) *SshResult) func(string) *SshResult {
+	if hostInventory == nil {
+		return execFunc
+	}
+
+	return func(hostname string) *SshResult {
+		timeout := hostOptionsOf(hostname).timeout
+		if timeout == 0 {
+			return execFunc(hostname)
+		}
+
+		resCh := make(chan *SshResult, 1)
+		go func() { resCh <- execFunc(hostname) }()
+
+		select {
+		case res := <-resCh:
+			return res
+		case <-time.After(timeout):
+			logf(logInfo, hostname, "Timed out after %s (gossha_timeout)", timeout)
+			if requestRemoteTimeout(msg) > 0 {
+				signalHostCommands(map[string]bool{hostname: true}, ssh.SIGKILL)
+			}
+			connectedHosts.Close(hostname)
+			return &SshResult{hostname: hostname, err: &hostTimeoutError{fmt.Sprintf("Timed out after %s", timeout)}}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHostOptions(t *testing.T) {
+	opts, err := parseHostOptions(map[string]string{"ansible_timeout": "5", "gossha_timeout": "10m", "ansible_ssh_private_key_file": "/keys/db"})
+	if err != nil || !reflect.DeepEqual(opts, hostOptions{identityFile: "/keys/db", connectTimeout: 5 * time.Second, timeout: 10 * time.Minute}) {
+		t.Fatalf("Unexpected options: %+v, %v", opts, err)
+	}
+
+	if opts, err = parseHostOptions(map[string]string{"ansible_timeout": "5", "gossha_connect_timeout": "1.5s"}); err != nil || opts.connectTimeout != 1500*time.Millisecond {
+		t.Fatalf("gossha_connect_timeout must override ansible_timeout: %+v, %v", opts, err)
+	}
+
+	for _, vars := range []map[string]string{{"ansible_timeout": "5s"}, {"gossha_timeout": "10"}, {"gossha_connect_timeout": "-1s"}} {
+		if _, err := parseHostOptions(vars); err == nil {
+			t.Fatalf("Invalid options must be rejected: %v", vars)
+		}
+	}
+}
+
+func TestConfigHosts(t *testing.T) {
+	yamlConfig := "hosts:\n  \"db[1-2]\":\n    user: postgres\n    port: 2222\n    identity_file: ~/.ssh/db.pub\n    timeout: 10m\n    tags:\n      dc: eu\n"
+	tomlConfig := "[hosts.\"db[1-2]\"]\nuser = \"postgres\"\nport = 2222\nidentity_file = \"~/.ssh/db.pub\"\ntimeout = \"10m\"\ntags = { dc = \"eu\" }\n"
+
+	yamlDoc, err := parseYaml([]byte(yamlConfig))
+	must(err, "Could not parse yaml config")
+	tomlDoc, err := parseToml([]byte(tomlConfig))
+	must(err, "Could not parse toml config")
+	if !reflect.DeepEqual(yamlToPlain(yamlDoc), yamlToPlain(tomlDoc)) {
+		t.Fatalf("TOML config differs from YAML one: %#v", yamlToPlain(tomlDoc))
+	}
+
+	conf, err := applyConfig(yamlDoc)
+	must(err, "Could not apply config")
+
+	// options from config override inventory variables
+	inv := newInventory()
+	must(inv.addHost("all", "db1", map[string]string{"ansible_user": "deploy", "ansible_host": "10.0.0.1"}), "Could not add host")
+	must(addConfigGroups(inv, conf), "Could not add hosts")
+
+	expected := map[string]string{
+		"ansible_host":                 "10.0.0.1",
+		"ansible_user":                 "postgres",
+		"ansible_port":                 "2222",
+		"ansible_ssh_private_key_file": os.Getenv("HOME") + "/.ssh/db",
+		"gossha_timeout":               "10m",
+		"gossha_tag_dc":                "eu",
+	}
+	if vars := inv.HostVars("db1"); !reflect.DeepEqual(vars, expected) {
+		t.Fatalf("Unexpected vars of db1: %v", vars)
+	}
+	if vars := inv.HostVars("db2"); vars["ansible_user"] != "postgres" {
+		t.Fatalf("Unexpected vars of db2: %v", vars)
+	}
+
+	for _, bad := range []string{"hosts:\n  db1:\n    colour: red\n", "hosts:\n  db1:\n    connect_timeout: soon\n"} {
+		doc, err := parseYaml([]byte(bad))
+		must(err, "Could not parse yaml config")
+		if _, err := applyConfig(doc); err == nil || !strings.Contains(err.Error(), "db1") {
+			t.Fatalf("Expected error for %q, got %v", bad, err)
+		}
+	}
+}
+
+func TestHostTimeout(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-host-timeout", 2)
+
+	var slow string
+	inv := newInventory()
+	inv.group("all")
+	for addr := range r.hosts {
+		if slow == "" {
+			slow = addr
+			must(inv.addHost("all", addr, map[string]string{"gossha_timeout": "200ms"}), "Could not add host")
+		} else {
+			must(inv.addHost("all", addr, nil), "Could not add host")
+		}
+	}
+	inv.resolveVars()
+
+	hostInventory = inv
+	defer func() { hostInventory = nil }()
+
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = "sleep 1"
+	for addr := range r.hosts {
+		req.Hosts = append(req.Hosts, addr)
+	}
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+
+	for addr, reply := range r.replies {
+		if addr == slow {
+			if reply.Success || reply.ErrMsg != "Timed out after 200ms" {
+				t.Fatalf("Action on %s must time out, got %+v", addr, reply)
+			}
+		} else if !reply.Success {
+			t.Fatalf("Action on %s must not be affected by timeout of another host: %+v", addr, reply)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Concurrent commands on a host ("HostParallel": N or -host-parallel N): commands of "Cmds" are
+// treated as independent tasks and run over up to N sessions of the same connection at once, instead
+// of one after another, e.g. to vacuum several databases of a big server in parallel. All commands
+// are run even if some of them fail. "Commands" and concatenated output keep order of "Cmds", and the
+// host fails with error of the first failed command in that order. sshd limits number of sessions
+// of a connection (MaxSessions, 10 by default), so at most maxHostParallel can be requested.
+
+const maxHostParallel = 10
+
+var hostParallelDefault uint64 // -host-parallel
+
+// requestHostParallel returns number of concurrent sessions for commands of msg, 0 or 1 means
+// commands are run one after another
+func requestHostParallel(msg *ProxyRequest) (int, error) {
+	n := msg.HostParallel
+	if n == 0 {
+		n = hostParallelDefault
+	}
+	if n > maxHostParallel {
+		return 0, fmt.Errorf("Invalid 'HostParallel': at most %d sessions per host are supported", maxHostParallel)
+	}
+	if msg.HostParallel > 1 && len(msg.Cmds) == 0 {
+		return 0, errors.New("'HostParallel' can only be used with 'Cmds'")
+	}
+	return int(n), nil
+}
+
+// executeCmdsParallel runs commands over up to parallel sessions of the same connection at once
+func executeCmdsParallel(cmds []string, parallel int, opts *cmdOptions, hostname string) *SshResult {
+	res := &SshResult{hostname: hostname}
+
+	conn, err := getConnection(hostname)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	defer connectedHosts.Release(hostname, conn)
+
+	results := make([]*CommandResult, len(cmds))
+	errs := make([]error, len(cmds))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+
+	for i, cmd := range cmds {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, cmd string) {
+			defer func() { <-sem; wg.Done() }()
+			stdout, stderr, err := runCmd(conn, hostname, cmd, opts.forCommand(i))
+			results[i] = &CommandResult{Cmd: cmd, Stdout: stdout, Stderr: stderr, Success: err == nil, ExitCode: exitCode(err)}
+			if err != nil {
+				results[i].ErrMsg, results[i].ErrorKind = err.Error(), errorKind(err, "ssh")
+			}
+			errs[i] = err
+		}(i, cmd)
+	}
+	wg.Wait()
+
+	// host is only retried if none of commands could be started
+	var retryable *retryableError
+	retry := true
+	for _, err := range errs {
+		if !errors.As(err, &retryable) {
+			retry = false
+		}
+	}
+
+	for i, cmdRes := range results {
+		res.commands = append(res.commands, cmdRes)
+		res.stdout += cmdRes.Stdout
+		res.stderr += cmdRes.Stderr
+		if err := errs[i]; err != nil && res.err == nil {
+			if !retry && errors.As(err, &retryable) {
+				err = retryable.err
+			}
+			res.err = err
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostParallel(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-host-parallel", 2)
+
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = ""
+	req.Cmds = []string{"sleep 0.5; echo first", "sleep 0.5; exit 3", "sleep 0.5; echo third", "exit 4"}
+	req.HostParallel = 4
+
+	start := time.Now()
+	sendTestRequest(t, r, req)
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Fatalf("Commands were not run concurrently: %s", elapsed)
+	}
+
+	for addr, reply := range r.replies {
+		if reply.Success || reply.ExitCode != 3 || len(reply.Commands) != 4 {
+			t.Fatalf("Unexpected result for %s: %+v", addr, reply)
+		}
+		if reply.Stdout != "first\nthird\n" || reply.Commands[1].ExitCode != 3 || !reply.Commands[2].Success || reply.Commands[3].ExitCode != 4 {
+			t.Fatalf("Unexpected command results for %s: %q, %+v", addr, reply.Stdout, reply.Commands)
+		}
+		if atomic.LoadInt32(&r.hosts[addr].connections) != 1 {
+			t.Fatalf("Commands must be executed over single connection")
+		}
+	}
+
+	if _, err := requestHostParallel(&ProxyRequest{Cmds: []string{"a", "b"}, HostParallel: maxHostParallel + 1}); err == nil {
+		t.Fatalf("Expected too many sessions to be rejected")
+	}
+	if _, err := requestHostParallel(&ProxyRequest{Cmd: "a", HostParallel: 2}); err == nil {
+		t.Fatalf("Expected 'HostParallel' without 'Cmds' to be rejected")
+	}
+}
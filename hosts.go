@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const maxExpandedHosts = 100000 // protection against typos like "host[1-1000000000]"
+
+// expandHosts expands brace and range patterns in host list, e.g. "web[01-03].example.com"
+// becomes "web01.example.com", "web02.example.com", "web03.example.com" and "db{a,b}.prod"
+// becomes "dba.prod", "dbb.prod"
+func expandHosts(hosts []string) (res []string, err error) {
+	for _, h := range hosts {
+		expanded, err := expandHostPattern(h)
+		if err != nil {
+			return nil, errors.New("Invalid host pattern " + h + ": " + err.Error())
+		}
+
+		res = append(res, expanded...)
+		if len(res) > maxExpandedHosts {
+			return nil, fmt.Errorf("Too many hosts after expansion (more than %d)", maxExpandedHosts)
+		}
+	}
+
+	return
+}
+
+// isRangeSpec checks whether contents of [...] is a range and not e.g. IPv6 address
+func isRangeSpec(spec string) bool {
+	if spec == "" {
+		return false
+	}
+
+	for _, c := range spec {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c == ',') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func expandHostPattern(pattern string) ([]string, error) {
+	for i, c := range pattern {
+		if c != '[' && c != '{' {
+			continue
+		}
+
+		closing := "]"
+		if c == '{' {
+			closing = "}"
+		}
+
+		end := strings.Index(pattern[i:], closing)
+		if end < 0 {
+			if c == '{' {
+				return nil, errors.New("unmatched '{'")
+			}
+			continue
+		}
+		end += i
+
+		spec := pattern[i+1 : end]
+
+		var alternatives []string
+		var err error
+
+		if c == '{' {
+			alternatives = strings.Split(spec, ",")
+		} else if isRangeSpec(spec) {
+			alternatives, err = expandRangeSpec(spec)
+		} else {
+			// e.g. IPv6 literal, leave brackets as is
+			alternatives = []string{pattern[i : end+1]}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		rest, err := expandHostPattern(pattern[end+1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if len(alternatives)*len(rest) > maxExpandedHosts {
+			return nil, fmt.Errorf("too many hosts after expansion (more than %d)", maxExpandedHosts)
+		}
+
+		res := make([]string, 0, len(alternatives)*len(rest))
+		for _, a := range alternatives {
+			for _, r := range rest {
+				res = append(res, pattern[:i]+a+r)
+			}
+		}
+
+		return res, nil
+	}
+
+	return []string{pattern}, nil
+}
+
+// expandRangeSpec expands comma-separated list of values and ranges like "01-10,15,a-c";
+// width of numbers is preserved if the range start is zero-padded
+func expandRangeSpec(spec string) (res []string, err error) {
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		if len(bounds) == 1 {
+			if part == "" {
+				return nil, errors.New("empty range element")
+			}
+			res = append(res, part)
+			continue
+		}
+
+		from, to := bounds[0], bounds[1]
+
+		if len(from) == 1 && len(to) == 1 && !isDigit(from[0]) && !isDigit(to[0]) {
+			if from[0] > to[0] {
+				return nil, errors.New("invalid range " + part)
+			}
+			for c := from[0]; c <= to[0]; c++ {
+				res = append(res, string(c))
+			}
+			continue
+		}
+
+		fromNum, err := strconv.ParseUint(from, 10, 32)
+		if err != nil {
+			return nil, errors.New("invalid range " + part)
+		}
+
+		toNum, err := strconv.ParseUint(to, 10, 32)
+		if err != nil || fromNum > toNum {
+			return nil, errors.New("invalid range " + part)
+		}
+
+		if toNum-fromNum >= maxExpandedHosts {
+			return nil, fmt.Errorf("range %s is too large", part)
+		}
+
+		format := "%d"
+		if len(from) > 1 && from[0] == '0' {
+			format = "%0" + strconv.Itoa(len(from)) + "d"
+		}
+
+		for n := fromNum; n <= toNum; n++ {
+			res = append(res, fmt.Sprintf(format, n))
+		}
+	}
+
+	return
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// uniqueHosts removes duplicate hosts keeping the order of their first occurrence
+func uniqueHosts(hosts []string) []string {
+	seen := make(map[string]bool, len(hosts))
+	res := hosts[:0]
+
+	for _, h := range hosts {
+		if !seen[h] {
+			seen[h] = true
+			res = append(res, h)
+		}
+	}
+
+	return res
+}
+
+// hostIdentities returns keys identifying machine and user that hostname connects to: its target
+// (see inventoryTarget) in lower case without trailing dot, and addresses it was resolved to
+func hostIdentities(hostname string) []string {
+	target, conf := inventoryTarget(hostname, &ssh.ClientConfig{User: "-"})
+	host, port := splitHostPort(target)
+
+	resolvedHosts.Lock()
+	addrs := resolvedHosts.addrs[host]
+	resolvedHosts.Unlock()
+
+	keys := []string{conf.User + "@" + net.JoinHostPort(strings.ToLower(strings.TrimSuffix(host, ".")), port)}
+	for _, a := range addrs {
+		keys = append(keys, conf.User+"@"+net.JoinHostPort(a, port))
+	}
+	return keys
+}
+
+// dedupeHosts removes hosts that are the same machine as one of the previous hosts under another
+// name (see hostIdentities) with a warning, replies are sent using names that are kept; short name
+// and FQDN starting with it can only be told apart by resolving them, so they are reported if
+// they were not resolved (see PreResolve)
+func dedupeHosts(hosts []string) []string {
+	seen := make(map[string]string, len(hosts)) // identity -> host
+	byLabel := make(map[string][]string)        // first label of unresolved name -> hosts
+	res := hosts[:0]
+
+	for _, h := range hosts {
+		keys := hostIdentities(h)
+
+		same := ""
+		for _, k := range keys {
+			if same = seen[k]; same != "" {
+				break
+			}
+		}
+		if same != "" {
+			reportErrorToUser("Host " + h + " is the same as " + same + ", action is only run on " + same)
+			continue
+		}
+
+		for _, k := range keys {
+			seen[k] = h
+		}
+		res = append(res, h)
+
+		host, _ := splitHostPort(h)
+		if len(keys) > 1 || net.ParseIP(host) != nil {
+			continue // resolved or address
+		}
+		label := strings.ToLower(strings.SplitN(host, ".", 2)[0])
+		for _, other := range byLabel[label] {
+			if o, _ := splitHostPort(other); strings.Contains(o, ".") != strings.Contains(host, ".") {
+				reportErrorToUser("Hosts " + other + " and " + h + " may be the same machine, set PreResolve to detect it")
+				break
+			}
+		}
+		byLabel[label] = append(byLabel[label], h)
+	}
+
+	return res
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandHosts(t *testing.T) {
+	cases := []struct {
+		in  []string
+		out []string
+	}{
+		{[]string{"localhost", "example.com:2222"}, []string{"localhost", "example.com:2222"}},
+		{[]string{"web[01-03].example.com"}, []string{"web01.example.com", "web02.example.com", "web03.example.com"}},
+		{[]string{"web[8-10]"}, []string{"web8", "web9", "web10"}},
+		{[]string{"db{a,b,c}.prod"}, []string{"dba.prod", "dbb.prod", "dbc.prod"}},
+		{[]string{"rack[1-2]-node[a-b]"}, []string{"rack1-nodea", "rack1-nodeb", "rack2-nodea", "rack2-nodeb"}},
+		{[]string{"h[1,3,05-06]"}, []string{"h1", "h3", "h05", "h06"}},
+		{[]string{"{app,db}[1-2]"}, []string{"app1", "app2", "db1", "db2"}},
+		{[]string{"[2001:db8::1]:22"}, []string{"[2001:db8::1]:22"}},
+	}
+
+	for _, c := range cases {
+		got, err := expandHosts(c.in)
+		if err != nil {
+			t.Fatalf("Unexpected error for %v: %s", c.in, err)
+		}
+
+		if !reflect.DeepEqual(got, c.out) {
+			t.Fatalf("Expansion of %v: expected %v, got %v", c.in, c.out, got)
+		}
+	}
+
+	for _, bad := range []string{"web[10-1]", "web[1-]", "db{a,b", "h[1-100000000]", "h[0-999][0-999]"} {
+		if _, err := expandHosts([]string{bad}); err == nil {
+			t.Fatalf("Expected error for %s", bad)
+		}
+	}
+}
+
+func TestDedupeHosts(t *testing.T) {
+	inv := newInventory()
+	must(inv.addHost("all", "alias", map[string]string{"ansible_host": "10.0.0.1"}), "Could not add host")
+	must(inv.addHost("all", "other-user", map[string]string{"ansible_host": "10.0.0.1", "ansible_user": "deploy"}), "Could not add host")
+	inv.resolveVars()
+	hostInventory = inv
+	defer func() { hostInventory = nil }()
+
+	resolvedHosts.Lock()
+	resolvedHosts.addrs["db1.example.com"] = []string{"10.0.0.2"}
+	resolvedHosts.Unlock()
+	defer forgetResolved([]string{"db1.example.com"})
+
+	done := make(chan []string)
+	go func() {
+		var warnings []string
+		for reply := range repliesChan {
+			if e, ok := reply.(*UserError); ok {
+				warnings = append(warnings, e.ErrorMsg)
+			} else {
+				break
+			}
+		}
+		done <- warnings
+	}()
+
+	hosts := dedupeHosts([]string{"Web1.example.com.", "web1.example.com:22", "alias", "10.0.0.1", "other-user", "db1.example.com", "10.0.0.2:22", "app1", "app1.example.com"})
+	repliesChan <- &FinalReply{}
+	warnings := <-done
+
+	if expected := []string{"Web1.example.com.", "alias", "other-user", "db1.example.com", "app1", "app1.example.com"}; !reflect.DeepEqual(hosts, expected) {
+		t.Fatalf("Unexpected hosts: %v", hosts)
+	}
+	if len(warnings) != 4 || !strings.Contains(warnings[3], "app1 and app1.example.com may be the same machine") {
+		t.Fatalf("Unexpected warnings: %q", warnings)
+	}
+}
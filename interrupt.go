@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	actionRunning    int32                     // set to 1 while runAction waits for replies
+	actionInterrupts = make(chan struct{}, 1)  // Ctrl-C presses that should cancel running action
+	interruptSignals = make(chan os.Signal, 1) // SIGINT notifications
+
+	sessionsMu     sync.Mutex
+	remoteCommands = make(map[*ssh.Session]string) // sessions of remote commands of running action and their hosts
+	sessionsSignal ssh.Signal                      // last signal sent to remote commands, commands started later get it as well
+)
+
+// interruptThread cancels running action on Ctrl-C, or exits if nothing is running
+func interruptThread() {
+	signal.Notify(interruptSignals, os.Interrupt)
+
+	for range interruptSignals {
+		if atomic.LoadInt32(&actionRunning) == 0 {
+			activeTerminal.restore()
+			os.Exit(130)
+		}
+
+		select {
+		case actionInterrupts <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// startAction marks action as running and forgets interrupts that were sent before it started
+func startAction() {
+	select {
+	case <-actionInterrupts:
+	default:
+	}
+
+	sessionsMu.Lock()
+	sessionsSignal = ""
+	sessionsMu.Unlock()
+
+	atomic.StoreInt32(&actionRunning, 1)
+}
+
+func finishAction() {
+	atomic.StoreInt32(&actionRunning, 0)
+}
+
+// commandsInterrupted reports whether remote commands of running action were signalled, so that new ones must not start
+func commandsInterrupted() bool {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	return sessionsSignal != ""
+}
+
+// trackCommand registers session of started remote command on hostname, so that Ctrl-C is forwarded to it
+func trackCommand(s *ssh.Session, hostname string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	remoteCommands[s] = hostname
+	if sessionsSignal != "" {
+		// command was started while signal was being sent to others
+		s.Signal(sessionsSignal)
+	}
+}
+
+func untrackCommand(s *ssh.Session) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	delete(remoteCommands, s)
+}
+
+// signalCommands sends sig to all running remote commands, it returns how many commands were signalled
+func signalCommands(sig ssh.Signal) int {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	sessionsSignal = sig
+	for s := range remoteCommands {
+		s.Signal(sig)
+	}
+	return len(remoteCommands)
+}
+
+// signalHostCommands sends sig to running remote commands of hosts
+func signalHostCommands(hosts map[string]bool, sig ssh.Signal) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	for s, hostname := range remoteCommands {
+		if hosts[hostname] {
+			s.Signal(sig)
+		}
+	}
+}
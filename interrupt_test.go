@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+// runInterruptedRequest runs cmd on 3 test servers and presses Ctrl-C the given number of times
+// after the first reply (that must come from <name>-0, which gives other commands time to start)
+func runInterruptedRequest(t *testing.T, name, cmd string, presses int) (fast string, slow []string, replies []*Reply, final *FinalReply) {
+	r := makeTestResult()
+	startTestServers(r, name, 3)
+
+	for addr, srv := range r.hosts {
+		if srv.hostname == name+"-0" {
+			fast = addr
+		} else {
+			slow = append(slow, addr)
+		}
+	}
+	sort.Strings(slow)
+
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = cmd
+	req.Hosts = append([]string{fast}, slow...)
+
+	start := time.Now()
+	requestsChan <- req
+
+	timeout := time.After(maxTimeout)
+	for {
+		select {
+		case reply := <-repliesChan:
+			switch reply := reply.(type) {
+			case *Reply:
+				replies = append(replies, reply)
+				if len(replies) == 1 {
+					actionInterrupts <- struct{}{}
+					for i := 1; i < presses; i++ {
+						// wait until SIGINT is sent before pressing again
+						time.Sleep(100 * time.Millisecond)
+						actionInterrupts <- struct{}{}
+					}
+				}
+			case *FinalReply:
+				if elapsed := time.Since(start); elapsed > time.Second {
+					t.Fatalf("Action was not cancelled in time: %s", elapsed)
+				}
+				return fast, slow, replies, reply
+			}
+		case <-timeout:
+			t.Fatalf("Timed out")
+		}
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	fast, _, replies, final := runInterruptedRequest(t, "test-interrupt",
+		`if [ "$TEST_HOSTNAME" = test-interrupt-0 ]; then sleep 0.2; echo done; else sleep 1.5; fi`, 1)
+
+	if replies[0].Hostname != fast || !replies[0].Success {
+		t.Fatalf("Unexpected reply: %+v", replies[0])
+	}
+
+	// commands exit on SIGINT, so all hosts reply
+	if len(replies) != 3 || !final.Interrupted || len(final.PendingHosts) != 0 {
+		t.Fatalf("Unexpected replies: %+v, final reply: %+v", replies, final)
+	}
+	for _, reply := range replies[1:] {
+		if reply.Success || reply.ExitCode != 130 {
+			t.Fatalf("Interrupted command must fail with SIGINT: %+v", reply)
+		}
+	}
+}
+
+func TestInterruptKill(t *testing.T) {
+	fast, slow, replies, final := runInterruptedRequest(t, "test-interrupt-kill",
+		`if [ "$TEST_HOSTNAME" = test-interrupt-kill-0 ]; then sleep 0.2; echo done; else trap '' INT; sleep 1.5; fi`, 2)
+
+	// SIGINT is ignored, so second Ctrl-C kills commands and cancels action right away
+	if len(replies) != 1 || replies[0].Hostname != fast {
+		t.Fatalf("Unexpected replies: %+v", replies)
+	}
+	if !final.Interrupted || len(final.PendingHosts) != 2 || final.PendingHosts[0] != slow[0] || final.PendingHosts[1] != slow[1] {
+		t.Fatalf("Unexpected final reply: %+v", final)
+	}
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Inventory of hosts and host groups in Ansible format (INI or YAML), e.g.
+//
+//	[webservers]
+//	web[01:20].example.com ansible_user=deploy
+//
+//	[webservers:vars]
+//	ansible_port=2222
+//
+// Groups can be referenced in requests instead of listing all hosts and the following
+// variables (group or host ones) are used when connecting: ansible_host, ansible_port,
+// ansible_user and ansible_password.
+
+type (
+	inventoryGroup struct {
+		hosts    []string
+		children []string
+		vars     map[string]string
+	}
+
+	inventory struct {
+		groups     map[string]*inventoryGroup
+		hostVars   map[string]map[string]string // variables specified for host itself
+		mergedVars map[string]map[string]string // host variables merged with variables of its groups
+	}
+)
+
+// inventoryLoaders contains supported inventory formats
+var inventoryLoaders = map[string]func(data []byte) (*inventory, error){
+	"ini":  parseIniInventory,
+	"yaml": parseYamlInventory,
+}
+
+var hostInventory *inventory // inventory loaded with -inventory flag (nil if none)
+
+func newInventory() *inventory {
+	return &inventory{
+		groups:   make(map[string]*inventoryGroup),
+		hostVars: make(map[string]map[string]string),
+	}
+}
+
+// loadInventory reads inventory file, format is determined by file extension
+func loadInventory(filename string) (*inventory, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.New("Cannot read inventory: " + err.Error())
+	}
+
+	format := "ini"
+	if ext := filepath.Ext(filename); ext == ".yml" || ext == ".yaml" {
+		format = "yaml"
+	}
+
+	inv, err := parseInventory(data, format)
+	if err != nil {
+		return nil, errors.New("Cannot parse inventory " + filename + ": " + err.Error())
+	}
+
+	hosts := make([]string, 0, len(inv.mergedVars))
+	for h := range inv.mergedVars {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+
+	for _, h := range hosts {
+		if _, err := hostAlgorithms(inv.mergedVars[h]); err != nil {
+			return nil, errors.New("Invalid algorithms of " + h + " in inventory " + filename + ": " + err.Error())
+		}
+		if _, err := parseHostOptions(inv.mergedVars[h]); err != nil {
+			return nil, errors.New("Invalid options of " + h + " in inventory " + filename + ": " + err.Error())
+		}
+	}
+
+	return inv, nil
+}
+
+// parseInventory parses inventory in the specified format and resolves variables of its hosts
+func parseInventory(data []byte, format string) (*inventory, error) {
+	inv, err := inventoryLoaders[format](data)
+	if err != nil {
+		return nil, err
+	}
+
+	inv.resolveVars()
+	return inv, nil
+}
+
+func (inv *inventory) group(name string) *inventoryGroup {
+	g, ok := inv.groups[name]
+	if !ok {
+		g = &inventoryGroup{vars: make(map[string]string)}
+		inv.groups[name] = g
+	}
+	return g
+}
+
+// addHost adds host (which may contain Ansible-style range like "web[01:10]") to the group
+func (inv *inventory) addHost(groupName, hostPattern string, vars map[string]string) error {
+	hosts, err := expandHostPattern(ansibleRangeRe.ReplaceAllString(hostPattern, "[$1-$2]"))
+	if err != nil {
+		return errors.New("invalid host pattern " + hostPattern + ": " + err.Error())
+	}
+
+	g := inv.group(groupName)
+	for _, h := range hosts {
+		g.hosts = append(g.hosts, h)
+
+		hv, ok := inv.hostVars[h]
+		if !ok {
+			hv = make(map[string]string)
+			inv.hostVars[h] = hv
+		}
+		for k, v := range vars {
+			hv[k] = v
+		}
+	}
+
+	return nil
+}
+
+var ansibleRangeRe = regexp.MustCompile(`\[([0-9a-zA-Z]+):([0-9a-zA-Z]+)\]`)
+
+// GroupHosts returns all hosts of the group including hosts of child groups
+func (inv *inventory) GroupHosts(name string) ([]string, error) {
+	if name == "all" {
+		var res []string
+		for h := range inv.hostVars {
+			res = append(res, h)
+		}
+		sort.Strings(res)
+		return res, nil
+	}
+
+	if _, ok := inv.groups[name]; !ok {
+		return nil, errors.New("Unknown group: " + name)
+	}
+
+	var res []string
+	seen := make(map[string]bool)
+	visited := make(map[string]bool)
+
+	var walk func(name string)
+	walk = func(name string) {
+		g, ok := inv.groups[name]
+		if !ok || visited[name] {
+			return
+		}
+		visited[name] = true
+
+		for _, h := range g.hosts {
+			if !seen[h] {
+				seen[h] = true
+				res = append(res, h)
+			}
+		}
+
+		for _, child := range g.children {
+			walk(child)
+		}
+	}
+
+	walk(name)
+	return res, nil
+}
+
+// groupDepth returns distance from the top of groups hierarchy, deeper groups have higher variables priority
+func (inv *inventory) groupDepth(name string, visited map[string]bool) int {
+	if visited[name] {
+		return 0
+	}
+	visited[name] = true
+
+	depth := 0
+	for parentName, parent := range inv.groups {
+		for _, child := range parent.children {
+			if child == name {
+				if d := inv.groupDepth(parentName, visited) + 1; d > depth {
+					depth = d
+				}
+			}
+		}
+	}
+
+	return depth
+}
+
+// resolveVars merges variables for every host once the whole inventory is parsed: host variables
+// override variables of groups, child groups override parent groups and "all" group has the lowest priority
+func (inv *inventory) resolveVars() {
+	type groupInfo struct {
+		name  string
+		depth int
+	}
+
+	var groups []groupInfo
+	for name := range inv.groups {
+		if name != "all" {
+			groups = append(groups, groupInfo{name: name, depth: inv.groupDepth(name, make(map[string]bool))})
+		}
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].depth != groups[j].depth {
+			return groups[i].depth < groups[j].depth
+		}
+		return groups[i].name < groups[j].name
+	})
+
+	inv.mergedVars = make(map[string]map[string]string, len(inv.hostVars))
+	for h := range inv.hostVars {
+		res := make(map[string]string)
+		for k, v := range inv.group("all").vars {
+			res[k] = v
+		}
+		inv.mergedVars[h] = res
+	}
+
+	for _, g := range groups {
+		hosts, _ := inv.GroupHosts(g.name)
+		for _, h := range hosts {
+			for k, v := range inv.groups[g.name].vars {
+				inv.mergedVars[h][k] = v
+			}
+		}
+	}
+
+	for h, hv := range inv.hostVars {
+		for k, v := range hv {
+			inv.mergedVars[h][k] = v
+		}
+	}
+}
+
+// HostVars returns merged variables for host (nil if host is not in inventory)
+func (inv *inventory) HostVars(hostname string) map[string]string {
+	return inv.mergedVars[hostname]
+}
+
+// inventoryTarget returns address to connect to and config to use for the specified host
+func inventoryTarget(hostname string, conf *ssh.ClientConfig) (string, *ssh.ClientConfig) {
+	if hostInventory == nil {
+		return hostname, conf
+	}
+
+	vars := hostInventory.HostVars(hostname)
+	if vars == nil {
+		return hostname, conf
+	}
+
+	target := hostname
+	if h := vars["ansible_host"]; h != "" {
+		target = h
+	}
+
+	if port := vars["ansible_port"]; port != "" {
+		host, _ := splitHostPort(target)
+		target = net.JoinHostPort(host, port)
+	}
+
+	hostConf := *conf
+	if u := vars["ansible_user"]; u != "" {
+		hostConf.User = u
+	}
+	algs, _ := hostAlgorithms(vars) // validated when inventory is loaded
+	algs.apply(&hostConf)
+	conf = &hostConf
+
+	return target, conf
+}
+
+// inventoryHosts returns hosts of all specified groups, which can be group expressions
+func inventoryHosts(groups []string) (res []string, err error) {
+	if len(groups) == 0 {
+		return nil, nil
+	}
+
+	if hostInventory == nil {
+		return nil, errors.New("Groups are specified, but no inventory is loaded (use -inventory flag)")
+	}
+
+	for _, name := range groups {
+		getHosts := hostInventory.GroupHosts
+		if isGroupExpr(name) {
+			getHosts = hostInventory.GroupExprHosts
+		}
+		hosts, err := getHosts(name)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, hosts...)
+	}
+
+	return
+}
+
+// splitIniFields splits line into whitespace-separated fields, taking quotes into account
+func splitIniFields(line string) (fields []string, err error) {
+	var cur bytes.Buffer
+	var quote rune
+	inField := false
+
+	for _, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inField = true
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, cur.String())
+				cur.Reset()
+				inField = false
+			}
+		default:
+			cur.WriteRune(c)
+			inField = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unterminated quote in: " + line)
+	}
+
+	if inField {
+		fields = append(fields, cur.String())
+	}
+
+	return
+}
+
+// stripIniComment removes "#" or ";" comment that starts the line or follows whitespace outside of quotes
+func stripIniComment(line string) string {
+	var quote rune
+	prevSpace := true
+
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case (c == '#' || c == ';') && prevSpace:
+			return line[:i]
+		}
+		prevSpace = quote == 0 && (c == ' ' || c == '\t')
+	}
+
+	return line
+}
+
+func parseIniVars(fields []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, f := range fields {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.New("expected key=value, got " + f)
+		}
+		vars[kv[0]] = kv[1]
+	}
+	return vars, nil
+}
+
+func parseIniInventory(data []byte) (*inventory, error) {
+	inv := newInventory()
+	inv.group("all")
+
+	section, kind := "ungrouped", "hosts"
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(stripIniComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		lineErr := func(err error) error {
+			return fmt.Errorf("line %d: %s", lineNum, err)
+		}
+
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section, kind = line[1:len(line)-1], "hosts"
+			if idx := strings.LastIndex(section, ":"); idx >= 0 {
+				section, kind = section[:idx], section[idx+1:]
+			}
+
+			if kind != "hosts" && kind != "vars" && kind != "children" {
+				return nil, lineErr(errors.New("unknown section type: " + kind))
+			}
+
+			inv.group(section)
+			continue
+		}
+
+		fields, err := splitIniFields(line)
+		if err != nil {
+			return nil, lineErr(err)
+		}
+
+		switch kind {
+		case "hosts":
+			vars, err := parseIniVars(fields[1:])
+			if err != nil {
+				return nil, lineErr(err)
+			}
+
+			if err := inv.addHost(section, fields[0], vars); err != nil {
+				return nil, lineErr(err)
+			}
+		case "vars":
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				return nil, lineErr(errors.New("expected key=value, got " + line))
+			}
+			value := strings.TrimSpace(kv[1])
+			if unquoted, err := splitIniFields(value); err == nil && len(unquoted) == 1 {
+				value = unquoted[0]
+			}
+			inv.group(section).vars[strings.TrimSpace(kv[0])] = value
+		case "children":
+			inv.group(section).children = append(inv.group(section).children, fields[0])
+			inv.group(fields[0])
+		}
+	}
+
+	return inv, scanner.Err()
+}
+
+func parseYamlInventory(data []byte) (*inventory, error) {
+	doc, err := parseYaml(data)
+	if err != nil {
+		return nil, err
+	}
+
+	inv := newInventory()
+	inv.group("all")
+
+	if doc == nil {
+		return inv, nil
+	}
+
+	top, ok := doc.(*yamlMap)
+	if !ok {
+		return nil, errors.New("inventory must be a mapping of groups")
+	}
+
+	for _, name := range top.Keys() {
+		if err := inv.parseYamlGroup(name, top.Get(name)); err != nil {
+			return nil, err
+		}
+	}
+
+	return inv, nil
+}
+
+// yamlStringMap converts mapping of scalars into map of strings; non-scalar values are ignored
+func yamlStringMap(v interface{}) map[string]string {
+	res := make(map[string]string)
+	if m, ok := v.(*yamlMap); ok {
+		for _, k := range m.Keys() {
+			if s, ok := m.Get(k).(string); ok {
+				res[k] = s
+			}
+		}
+	}
+	return res
+}
+
+func (inv *inventory) parseYamlGroup(name string, v interface{}) error {
+	g := inv.group(name)
+	if v == nil {
+		return nil
+	}
+
+	def, ok := v.(*yamlMap)
+	if !ok {
+		return errors.New("group " + name + " must be a mapping")
+	}
+
+	if hosts, ok := def.Get("hosts").(*yamlMap); ok {
+		for _, h := range hosts.Keys() {
+			if err := inv.addHost(name, h, yamlStringMap(hosts.Get(h))); err != nil {
+				return err
+			}
+		}
+	}
+
+	for k, val := range yamlStringMap(def.Get("vars")) {
+		g.vars[k] = val
+	}
+
+	if children, ok := def.Get("children").(*yamlMap); ok {
+		for _, child := range children.Keys() {
+			g.children = append(g.children, child)
+			if err := inv.parseYamlGroup(child, children.Get(child)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
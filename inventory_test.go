@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testIniInventory = `
+# ungrouped host
+bastion.example.com ansible_port=2222
+
+[web]
+web[01:03].example.com
+web-canary.example.com ansible_user="canary user"
+
+[db]
+db1.example.com ansible_host=10.0.0.1 ; comment
+db1.example.com # duplicate entries are merged
+
+[prod:children]
+web
+db
+
+[prod:vars]
+ansible_user=deploy
+
+[all:vars]
+ansible_user=nobody
+ansible_port=22
+`
+
+const testYamlInventory = `
+all:
+  hosts:
+    bastion.example.com:
+      ansible_port: 2222
+  vars:
+    ansible_user: nobody
+    ansible_port: 22
+  children:
+    prod:
+      vars:
+        ansible_user: deploy
+      children:
+        web:
+          hosts:
+            web[01:03].example.com:
+            web-canary.example.com:
+              ansible_user: canary user
+        db:
+          hosts:
+            db1.example.com:
+              ansible_host: 10.0.0.1
+`
+
+func TestInventory(t *testing.T) {
+	for format, data := range map[string]string{"ini": testIniInventory, "yaml": testYamlInventory} {
+		inv, err := parseInventory([]byte(data), format)
+		if err != nil {
+			t.Fatalf("Could not parse %s inventory: %s", format, err)
+		}
+
+		hosts, err := inv.GroupHosts("prod")
+		if err != nil {
+			t.Fatalf("Could not get %s group hosts: %s", format, err)
+		}
+
+		expected := []string{"web01.example.com", "web02.example.com", "web03.example.com", "web-canary.example.com", "db1.example.com"}
+		if !reflect.DeepEqual(hosts, expected) {
+			t.Fatalf("Unexpected %s group hosts: %v", format, hosts)
+		}
+
+		checkVars := func(host string, expected map[string]string) {
+			if got := inv.HostVars(host); !reflect.DeepEqual(got, expected) {
+				t.Fatalf("Unexpected vars of %s in %s inventory: %v", host, format, got)
+			}
+		}
+
+		checkVars("bastion.example.com", map[string]string{"ansible_user": "nobody", "ansible_port": "2222"})
+		checkVars("web02.example.com", map[string]string{"ansible_user": "deploy", "ansible_port": "22"})
+		checkVars("web-canary.example.com", map[string]string{"ansible_user": "canary user", "ansible_port": "22"})
+		checkVars("db1.example.com", map[string]string{"ansible_user": "deploy", "ansible_port": "22", "ansible_host": "10.0.0.1"})
+
+		if _, err := inv.GroupHosts("unknown"); err == nil {
+			t.Fatalf("Expected error for unknown group in %s inventory", format)
+		}
+	}
+}
+
+func TestInventoryGroups(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-inventory", 3)
+
+	inv := newInventory()
+	inv.group("all")
+	for addr, srv := range r.hosts {
+		host, port := splitHostPort(addr)
+		must(inv.addHost("testservers", srv.hostname, map[string]string{"ansible_host": host, "ansible_port": port}), "Could not add host")
+
+		// replies are keyed by inventory host names
+		delete(r.hostsLeft, addr)
+		r.hostsLeft[srv.hostname] = struct{}{}
+	}
+
+	inv.resolveVars()
+
+	hostInventory = inv
+	defer func() { hostInventory = nil }()
+
+	// group is listed twice and one of the hosts is also specified explicitly, each host must get one reply
+	req := makeProxyRequest(maxTimeout)
+	req.Timeout = uint64(maxTimeout / time.Millisecond)
+	req.Groups = []string{"testservers", "testservers"}
+	for _, srv := range r.hosts {
+		req.Hosts = append(req.Hosts, srv.hostname)
+		break
+	}
+
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+
+	if len(r.hostsLeft) != 0 {
+		t.Fatalf("Hosts left: %#v", r.hostsLeft)
+	}
+
+	for hostname, reply := range r.replies {
+		if !reply.Success {
+			t.Fatalf("Request to %s failed: %s", hostname, reply.ErrMsg)
+		}
+
+		if !strings.HasPrefix(reply.Stdout, "test-inventory-") || reply.Stdout != hostname {
+			t.Fatalf("Unexpected reply from %s: %q", hostname, reply.Stdout)
+		}
+	}
+}
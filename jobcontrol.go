@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Cancelling jobs and draining HTTP API (-serve): POST /jobs/<id>/cancel cancels a job. Queued job
+// is not run, running one is interrupted like with Ctrl-C: remote commands get SIGINT, and cancelling
+// it again kills them. Job finishes with status "cancelled" and "Final" of the interrupted action.
+// POST /drain makes GoSSHa refuse new jobs, finish the running and queued ones and exit, so that it can
+// be restarted safely, GET /drain returns progress of draining. Clients can only cancel jobs they
+// can see (see visible), and with -policy only tokens without restrictions can drain.
+
+const (
+	jobCancelled = "cancelled"
+
+	apiShutdownTimeout = 10 * time.Second // time to finish responses before exiting after drain
+)
+
+// apiDrainStatus is response of /drain
+type apiDrainStatus struct {
+	Draining bool
+	Running  string `json:",omitempty"` // id of running job
+	Queued   int    // jobs that are going to run before exit
+}
+
+// cancel cancels job, s.mu must be held
+func (s *apiServer) cancel(job *apiJob) {
+	switch job.Status {
+	case jobQueued:
+		// job stays in queue until run gets to it
+		s.finish(job, jobCancelled)
+	case jobRunning:
+		job.cancelled = true
+		go interruptJob(job)
+	}
+}
+
+// interruptJob interrupts action of job once it is started
+func interruptJob(job *apiJob) {
+	for {
+		select {
+		case <-job.done:
+			return
+		default:
+		}
+		if atomic.LoadInt32(&actionRunning) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case actionInterrupts <- struct{}{}:
+	default:
+	}
+}
+
+// drain stops accepting jobs, GoSSHa exits when queued ones are finished; s.mu must be held
+func (s *apiServer) drain() {
+	if !s.draining {
+		s.draining = true
+		close(s.drained)
+		fmt.Fprintln(os.Stderr, "Draining HTTP API, new jobs are refused")
+	}
+}
+
+// drainStatus returns progress of draining, s.mu must be held
+func (s *apiServer) drainStatus() *apiDrainStatus {
+	st := &apiDrainStatus{Draining: s.draining}
+	if s.current != nil {
+		st.Running = s.current.ID
+	}
+	for _, job := range s.jobs {
+		if job.Status == jobQueued {
+			st.Queued++
+		}
+	}
+	return st
+}
+
+// shutdown finishes HTTP responses and exits after draining
+func (s *apiServer) shutdown() {
+	fmt.Fprintln(os.Stderr, "All jobs are finished, exiting")
+	if s.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+		defer cancel()
+		s.server.Shutdown(ctx)
+	}
+	s.exit()
+}
+
+// serveCancel handles POST /jobs/<id>/cancel, s.mu must be held and is released
+func (s *apiServer) serveCancel(w http.ResponseWriter, job *apiJob) {
+	if job.Finished != nil {
+		s.mu.Unlock()
+		writeAPIError(w, http.StatusConflict, "Job "+job.ID+" is already finished")
+		return
+	}
+	s.cancel(job)
+	writeAPIResponseLocked(w, http.StatusAccepted, job, &s.mu)
+}
+
+// serveDrain handles /drain
+func (s *apiServer) serveDrain(w http.ResponseWriter, r *http.Request, client *policyToken) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if client != nil && !client.unrestricted() {
+			writeAPIError(w, http.StatusForbidden, "Token "+client.name+" is not allowed to drain")
+			return
+		}
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	s.mu.Lock()
+	if r.Method == "POST" {
+		s.drain()
+	}
+	writeAPIResponseLocked(w, http.StatusOK, s.drainStatus(), &s.mu)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAPICancelAndDrain(t *testing.T) {
+	requests := make(chan *ProxyRequest)
+	s := newAPIServer("secret", requests)
+	exited := make(chan struct{})
+	s.exit = func() { close(exited) }
+	go s.run()
+
+	// "block" commands run until they are interrupted like runAction does it
+	go func() {
+		for req := range requests {
+			if req.Cmd == "block" {
+				startAction()
+				<-actionInterrupts
+				finishAction()
+			}
+			s.handleReply(&Reply{Hostname: req.Hosts[0], Success: req.Cmd != "block"})
+			s.handleReply(&FinalReply{TimedOutHosts: map[string]bool{}, Interrupted: req.Cmd == "block"})
+		}
+	}()
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	waitStatus := func(id, status string) *apiJob {
+		for deadline := time.Now().Add(maxTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			job := new(apiJob)
+			if apiRequest(t, "GET", srv.URL+"/jobs/"+id, "", job); job.Status == status {
+				return job
+			}
+		}
+		t.Fatalf("Job %s did not get status %s", id, status)
+		return nil
+	}
+
+	blocked, queued := new(apiJob), new(apiJob)
+	apiRequest(t, "POST", srv.URL+"/jobs", `{"Action":"ssh","Cmd":"block","Hosts":["h1"]}`, blocked)
+	apiRequest(t, "POST", srv.URL+"/jobs", `{"Action":"ssh","Cmd":"uptime","Hosts":["h2"]}`, queued)
+	waitStatus(blocked.ID, jobRunning)
+
+	if code := apiRequest(t, "POST", srv.URL+"/jobs/"+queued.ID+"/cancel", "", queued); code != http.StatusAccepted || queued.Status != jobCancelled {
+		t.Fatalf("Queued job must be cancelled right away: %d %+v", code, queued)
+	}
+	if code := apiRequest(t, "POST", srv.URL+"/jobs/"+blocked.ID+"/cancel", "", &apiJob{}); code != http.StatusAccepted {
+		t.Fatalf("Could not cancel running job: %d", code)
+	}
+	if job := waitStatus(blocked.ID, jobCancelled); job.Final == nil || !job.Final.Interrupted {
+		t.Fatalf("Cancelled job must be interrupted: %+v", job)
+	}
+	if code := apiRequest(t, "POST", srv.URL+"/jobs/"+blocked.ID+"/cancel", "", &apiError{}); code != http.StatusConflict {
+		t.Fatalf("Expected 409 for finished job, got %d", code)
+	}
+	if code := apiRequest(t, "GET", srv.URL+"/jobs/"+blocked.ID+"/cancel", "", &apiError{}); code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected 405 for GET of cancel, got %d", code)
+	}
+
+	// running and queued jobs are finished before exit
+	apiRequest(t, "POST", srv.URL+"/jobs", `{"Action":"ssh","Cmd":"block","Hosts":["h1"]}`, blocked)
+	apiRequest(t, "POST", srv.URL+"/jobs", `{"Action":"ssh","Cmd":"uptime","Hosts":["h2"]}`, queued)
+	waitStatus(blocked.ID, jobRunning)
+
+	var st apiDrainStatus
+	if code := apiRequest(t, "POST", srv.URL+"/drain", "", &st); code != http.StatusOK || !st.Draining || st.Running != blocked.ID || st.Queued != 1 {
+		t.Fatalf("Unexpected drain status: %d %+v", code, st)
+	}
+	if code := apiRequest(t, "POST", srv.URL+"/jobs", `{"Action":"ssh","Cmd":"uptime","Hosts":["h3"]}`, &apiError{}); code != http.StatusServiceUnavailable {
+		t.Fatalf("Jobs must be refused while draining, got %d", code)
+	}
+
+	select {
+	case <-exited:
+		t.Fatalf("Exited before jobs were finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	apiRequest(t, "POST", srv.URL+"/jobs/"+blocked.ID+"/cancel", "", &apiJob{})
+
+	select {
+	case <-exited:
+	case <-time.After(maxTimeout):
+		t.Fatalf("Did not exit after draining")
+	}
+	waitStatus(queued.ID, jobDone)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Jump host connection sharing (-jump-connections N, 4 by default): targets that are reached through
+// jump hosts (-J) are tunneled over a pool of up to N connections to the jump hosts instead of a new
+// chain of connections per target, which trips MaxStartups and MaxSessions of the bastion when
+// hundreds of targets are connected to at once. Tunnels are spread over connections of the pool
+// evenly, a connection is closed when the last target tunneled over it disconnects, and connections
+// that were lost are replaced by new ones. Connections are shared by targets with the same user and
+// keys (ansible_ssh_private_key_file and gossha_auth). -jump-connections 0 connects to jump hosts for
+// every target.
+
+var jumpConnections uint64 // -jump-connections
+
+type (
+	// jumpPool is pool of connections to the last jump host by user and keys of targets
+	jumpPool struct {
+		mu    sync.Mutex
+		conns map[string][]*pooledJump
+	}
+
+	// pooledJump is connection of jumpPool
+	pooledJump struct {
+		conn    *ssh.Client
+		ready   chan struct{} // closed when connection is established or failed
+		err     error
+		tunnels int // targets tunneled over connection, including ones that are being connected
+	}
+)
+
+var jumpConns = &jumpPool{conns: make(map[string][]*pooledJump)}
+
+// jumpPoolKey tells which targets can share connections to jump hosts
+func jumpPoolKey(conf *ssh.ClientConfig, timing *connectTiming) string {
+	key := conf.User
+	if timing != nil {
+		opts := hostOptionsOf(timing.hostname)
+		key += "\x00" + opts.identityFile + "\x00" + strings.Join(opts.auth, ",")
+	}
+	return key
+}
+
+// dialPooled connects to hostname through a connection of jumpConns
+func dialPooled(hostname string, conf *ssh.ClientConfig, timing *connectTiming) (*ssh.Client, error) {
+	key := jumpPoolKey(conf, timing)
+	jump, err := jumpConns.acquire(key, func() (*ssh.Client, error) { return dialChain(jumpHosts, "", conf, nil) })
+	if err != nil {
+		return nil, err
+	}
+	release := func() { jumpConns.release(key, jump) }
+
+	host, port := splitHostPort(hostname)
+	conn, err := tunnelConnection(jump.conn, net.JoinHostPort(host, port), withGSSAPI(conf, host), timing, release)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// acquire returns connection for key, new one is established with dial while there are less than
+// jumpConnections of them; it must be released using release after use
+func (p *jumpPool) acquire(key string, dial func() (*ssh.Client, error)) (*pooledJump, error) {
+	p.mu.Lock()
+	conns := p.conns[key]
+	if uint64(len(conns)) < jumpConnections {
+		jump := &pooledJump{ready: make(chan struct{}), tunnels: 1}
+		p.conns[key] = append(conns, jump)
+		p.mu.Unlock()
+
+		jump.conn, jump.err = dial()
+		if jump.err != nil {
+			p.remove(key, jump)
+		} else {
+			go func() {
+				jump.conn.Wait()
+				p.remove(key, jump)
+			}()
+		}
+		close(jump.ready)
+		return jump, jump.err
+	}
+
+	jump := conns[0]
+	for _, c := range conns[1:] {
+		if c.tunnels < jump.tunnels {
+			jump = c
+		}
+	}
+	jump.tunnels++
+	p.mu.Unlock()
+
+	<-jump.ready
+	return jump, jump.err
+}
+
+// release tells that a target does not use jump any more, unused connection is closed
+func (p *jumpPool) release(key string, jump *pooledJump) {
+	p.mu.Lock()
+	jump.tunnels--
+	unused := jump.tunnels == 0
+	if unused {
+		p.removeLocked(key, jump)
+	}
+	p.mu.Unlock()
+
+	if unused {
+		jump.conn.Close()
+	}
+}
+
+// remove drops jump from pool, so that new targets do not use it
+func (p *jumpPool) remove(key string, jump *pooledJump) {
+	p.mu.Lock()
+	p.removeLocked(key, jump)
+	p.mu.Unlock()
+}
+
+// removeLocked is remove, p.mu must be held
+func (p *jumpPool) removeLocked(key string, jump *pooledJump) {
+	conns := p.conns[key]
+	for i, c := range conns {
+		if c == jump {
+			p.conns[key] = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(p.conns[key]) == 0 {
+		delete(p.conns, key)
+	}
+}
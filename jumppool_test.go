@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJumpConnectionSharing(t *testing.T) {
+	bastions := makeTestResult()
+	startTestServers(bastions, "test-jump-pool-bastion", 1)
+
+	var bastion *testSSHServer
+	for addr, srv := range bastions.hosts {
+		jumpHosts, bastion = []string{testUserName + "@" + addr}, srv
+	}
+	jumpConnections = 2
+	setDisconnectAfterUse(true)
+	defer func() {
+		jumpHosts, jumpConnections = nil, 0
+		setDisconnectAfterUse(false)
+	}()
+
+	r := makeTestResult()
+	startTestServers(r, "test-jump-pool", 8)
+	runTestRequest(t, r, makeProxyRequest(maxTimeout))
+	checkSuccess(t, r)
+
+	if n := atomic.LoadInt32(&bastion.connections); n < 1 || n > 2 {
+		t.Fatalf("Expected at most 2 connections to jump host, got %d", n)
+	}
+	if n := int(atomic.LoadInt32(&bastion.forwardedConns)); n != len(r.hosts) {
+		t.Fatalf("Expected %d connections forwarded through jump host, got %d", len(r.hosts), n)
+	}
+
+	// connections to jump host are closed when targets disconnect
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		jumpConns.mu.Lock()
+		n := len(jumpConns.conns)
+		jumpConns.mu.Unlock()
+		if n == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Expected no connections to jump host after targets disconnected, %d are left", n)
+		}
+	}
+}
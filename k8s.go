@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Kubernetes host source: "k8s:nodes?selector=<label selector>&kubeconfig=<path>&context=<name>&
+// address=internal|external|hostname|name&ready=1" lists nodes of the cluster through Kubernetes
+// API and returns their InternalIP addresses (or other addresses of address parameter).
+// Credentials are taken from current context of kubeconfig (kubeconfig parameter, the first file
+// of KUBECONFIG or ~/.kube/config) or from service account when GoSSHa runs inside of a pod:
+// bearer tokens, token files, client certificates and exec plugins are supported.
+// -k8s-nodes (with -k8s-selector and -kubeconfig) is a shortcut for -discover with this source.
+
+const k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+var (
+	k8sNodes       bool   // -k8s-nodes
+	k8sSelector    string // -k8s-selector
+	k8sKubeconfig  string // -kubeconfig
+	k8sAddressType = map[string]string{"internal": "InternalIP", "external": "ExternalIP", "hostname": "Hostname"}
+)
+
+type (
+	// k8sCluster is API server and credentials of kubeconfig context
+	k8sCluster struct {
+		server string
+		token  string
+		client *http.Client
+	}
+
+	k8sNode struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Status struct {
+			Addresses []struct {
+				Type    string `json:"type"`
+				Address string `json:"address"`
+			} `json:"addresses"`
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	}
+
+	k8sNodeList struct {
+		Items    []k8sNode `json:"items"`
+		Metadata struct {
+			Continue string `json:"continue"`
+		} `json:"metadata"`
+	}
+)
+
+// k8sNodesSource returns host source of -k8s-nodes, -k8s-selector and -kubeconfig
+func k8sNodesSource() string {
+	params := url.Values{}
+	if k8sSelector != "" {
+		params.Set("selector", k8sSelector)
+	}
+	if k8sKubeconfig != "" {
+		params.Set("kubeconfig", k8sKubeconfig)
+	}
+	if len(params) == 0 {
+		return "k8s:nodes"
+	}
+	return "k8s:nodes?" + params.Encode()
+}
+
+func k8sHosts(u *url.URL) ([]string, error) {
+	if kind := u.Opaque + u.Host; kind != "nodes" {
+		return nil, errors.New("only nodes can be listed, use k8s:nodes")
+	}
+
+	q := u.Query()
+	addrType := q.Get("address")
+	if addrType == "" {
+		addrType = "internal"
+	}
+	if _, ok := k8sAddressType[addrType]; !ok && addrType != "name" {
+		return nil, errors.New("address must be internal, external, hostname or name")
+	}
+
+	cluster, err := loadK8sCluster(q.Get("kubeconfig"), q.Get("context"))
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{"limit": {"500"}}
+	if s := q.Get("selector"); s != "" {
+		params.Set("labelSelector", s)
+	}
+
+	var hosts []string
+	for {
+		var list k8sNodeList
+		if err := cluster.get("/api/v1/nodes?"+params.Encode(), &list); err != nil {
+			return nil, err
+		}
+
+		for _, node := range list.Items {
+			if q.Get("ready") != "" && !node.ready() {
+				continue
+			}
+			if addr := node.address(addrType); addr != "" {
+				hosts = append(hosts, addr)
+			} else {
+				logf(logInfo, "", "Node %s has no %s address", node.Metadata.Name, addrType)
+			}
+		}
+
+		if list.Metadata.Continue == "" {
+			return hosts, nil
+		}
+		params.Set("continue", list.Metadata.Continue)
+	}
+}
+
+func (n *k8sNode) address(addrType string) string {
+	if addrType == "name" {
+		return n.Metadata.Name
+	}
+	for _, a := range n.Status.Addresses {
+		if a.Type == k8sAddressType[addrType] {
+			return a.Address
+		}
+	}
+	return ""
+}
+
+func (n *k8sNode) ready() bool {
+	for _, c := range n.Status.Conditions {
+		if c.Type == "Ready" {
+			return c.Status == "True"
+		}
+	}
+	return false
+}
+
+func (c *k8sCluster) get(path string, res interface{}) error {
+	req, err := http.NewRequest("GET", c.server+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&status) == nil && status.Message != "" {
+			return errors.New(req.URL.Host + " returned " + resp.Status + ": " + status.Message)
+		}
+		return errors.New(req.URL.Host + " returned " + resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return errors.New("Cannot parse response of " + req.URL.Host + ": " + err.Error())
+	}
+	return nil
+}
+
+// kubeconfigPath returns kubeconfig file that is used if none is specified, empty if there is none
+func kubeconfigPath() string {
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		return filepath.SplitList(env)[0]
+	}
+	path := filepath.Join(homeDir(), ".kube", "config")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// loadK8sCluster reads API server and credentials of context (current one if it is empty) of kubeconfig
+func loadK8sCluster(kubeconfig, context string) (*k8sCluster, error) {
+	if kubeconfig == "" {
+		kubeconfig = kubeconfigPath()
+	}
+	if kubeconfig == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return inClusterK8sCluster()
+	}
+	if kubeconfig == "" {
+		return nil, errors.New("no kubeconfig found, set KUBECONFIG or kubeconfig parameter")
+	}
+
+	data, err := ioutil.ReadFile(kubeconfig)
+	if err != nil {
+		return nil, errors.New("Cannot read kubeconfig: " + err.Error())
+	}
+	doc, err := parseYaml(data)
+	if err != nil {
+		return nil, errors.New("Cannot parse kubeconfig " + kubeconfig + ": " + err.Error())
+	}
+	top, ok := doc.(*yamlMap)
+	if !ok {
+		return nil, errors.New("Invalid kubeconfig " + kubeconfig)
+	}
+
+	if context == "" {
+		context = yamlString(top, "current-context")
+	}
+	ctx := kubeconfigEntry(top, "contexts", context, "context")
+	if ctx == nil {
+		return nil, errors.New("Context " + context + " is not found in " + kubeconfig)
+	}
+	cluster := kubeconfigEntry(top, "clusters", yamlString(ctx, "cluster"), "cluster")
+	if cluster == nil {
+		return nil, errors.New("Cluster of context " + context + " is not found in " + kubeconfig)
+	}
+	user := kubeconfigEntry(top, "users", yamlString(ctx, "user"), "user")
+	if user == nil {
+		user = newYamlMap()
+	}
+
+	// relative paths of files are relative to kubeconfig
+	dir := filepath.Dir(kubeconfig)
+	file := func(m *yamlMap, key string) string {
+		p := yamlString(m, key)
+		if p != "" && !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		return p
+	}
+
+	tlsConf := &tls.Config{InsecureSkipVerify: yamlString(cluster, "insecure-skip-tls-verify") == "true"}
+	if err := setK8sCA(tlsConf, yamlString(cluster, "certificate-authority-data"), file(cluster, "certificate-authority")); err != nil {
+		return nil, err
+	}
+
+	c := &k8sCluster{server: strings.TrimRight(yamlString(cluster, "server"), "/"), token: yamlString(user, "token")}
+	if c.server == "" {
+		return nil, errors.New("Cluster of context " + context + " has no server")
+	}
+	if path := file(user, "tokenFile"); c.token == "" && path != "" {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.New("Cannot read token: " + err.Error())
+		}
+		c.token = strings.TrimSpace(string(buf))
+	}
+
+	certData, keyData := yamlString(user, "client-certificate-data"), yamlString(user, "client-key-data")
+	if execConf, ok := user.Get("exec").(*yamlMap); ok {
+		cred, err := runK8sExecPlugin(execConf)
+		if err != nil {
+			return nil, err
+		}
+		if cred.Status.Token != "" {
+			c.token = cred.Status.Token
+		}
+		if cred.Status.ClientCertificateData != "" {
+			certData = base64.StdEncoding.EncodeToString([]byte(cred.Status.ClientCertificateData))
+			keyData = base64.StdEncoding.EncodeToString([]byte(cred.Status.ClientKeyData))
+		}
+	}
+	if err := setK8sClientCert(tlsConf, certData, keyData, file(user, "client-certificate"), file(user, "client-key")); err != nil {
+		return nil, err
+	}
+
+	c.client = &http.Client{Timeout: httpAPIClient.Timeout, Transport: &http.Transport{TLSClientConfig: tlsConf, Proxy: http.ProxyFromEnvironment}}
+	return c, nil
+}
+
+// inClusterK8sCluster uses service account of pod that GoSSHa runs in
+func inClusterK8sCluster() (*k8sCluster, error) {
+	token, err := ioutil.ReadFile(filepath.Join(k8sServiceAccountDir, "token"))
+	if err != nil {
+		return nil, errors.New("Cannot read service account token: " + err.Error())
+	}
+
+	tlsConf := &tls.Config{}
+	if err := setK8sCA(tlsConf, "", filepath.Join(k8sServiceAccountDir, "ca.crt")); err != nil {
+		return nil, err
+	}
+
+	return &k8sCluster{
+		server: "https://" + net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")),
+		token:  strings.TrimSpace(string(token)),
+		client: &http.Client{Timeout: httpAPIClient.Timeout, Transport: &http.Transport{TLSClientConfig: tlsConf}},
+	}, nil
+}
+
+// kubeconfigEntry returns field of named entry of list in kubeconfig (e.g. "context" of "contexts")
+func kubeconfigEntry(top *yamlMap, list, name, field string) *yamlMap {
+	entries, _ := top.Get(list).([]interface{})
+	for _, e := range entries {
+		if e, ok := e.(*yamlMap); ok && yamlString(e, "name") == name {
+			res, _ := e.Get(field).(*yamlMap)
+			return res
+		}
+	}
+	return nil
+}
+
+func yamlString(m *yamlMap, key string) string {
+	s, _ := m.Get(key).(string)
+	return s
+}
+
+func setK8sCA(conf *tls.Config, data, path string) error {
+	var pem []byte
+	var err error
+	switch {
+	case data != "":
+		if pem, err = base64.StdEncoding.DecodeString(data); err != nil {
+			return errors.New("Invalid certificate-authority-data: " + err.Error())
+		}
+	case path != "":
+		if pem, err = ioutil.ReadFile(path); err != nil {
+			return errors.New("Cannot read certificate authority: " + err.Error())
+		}
+	default:
+		return nil // system roots
+	}
+
+	conf.RootCAs = x509.NewCertPool()
+	if !conf.RootCAs.AppendCertsFromPEM(pem) {
+		return errors.New("No certificates found in certificate authority of cluster")
+	}
+	return nil
+}
+
+func setK8sClientCert(conf *tls.Config, certData, keyData, certPath, keyPath string) error {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case certData != "":
+		var certPEM, keyPEM []byte
+		if certPEM, err = base64.StdEncoding.DecodeString(certData); err == nil {
+			keyPEM, err = base64.StdEncoding.DecodeString(keyData)
+		}
+		if err == nil {
+			cert, err = tls.X509KeyPair(certPEM, keyPEM)
+		}
+	case certPath != "":
+		cert, err = tls.LoadX509KeyPair(certPath, keyPath)
+	default:
+		return nil
+	}
+	if err != nil {
+		return errors.New("Cannot load client certificate: " + err.Error())
+	}
+	conf.Certificates = []tls.Certificate{cert}
+	return nil
+}
+
+// k8sExecCredential is output of exec credential plugin
+type k8sExecCredential struct {
+	Status struct {
+		Token                 string `json:"token"`
+		ClientCertificateData string `json:"clientCertificateData"` // PEM
+		ClientKeyData         string `json:"clientKeyData"`
+	} `json:"status"`
+}
+
+// runK8sExecPlugin runs exec credential plugin of kubeconfig user (e.g. aws eks get-token)
+func runK8sExecPlugin(conf *yamlMap) (*k8sExecCredential, error) {
+	command := yamlString(conf, "command")
+	if command == "" {
+		return nil, errors.New("exec plugin of kubeconfig user has no command")
+	}
+	var args []string
+	if conf.Get("args") != nil {
+		var err error
+		if args, err = configStrings("exec args", conf.Get("args")); err != nil {
+			return nil, err
+		}
+	}
+
+	cmd := exec.Command(command, args...)
+	cmd.Env = os.Environ()
+	envs, _ := conf.Get("env").([]interface{})
+	for _, e := range envs {
+		if e, ok := e.(*yamlMap); ok {
+			cmd.Env = append(cmd.Env, yamlString(e, "name")+"="+yamlString(e, "value"))
+		}
+	}
+	apiVersion := yamlString(conf, "apiVersion")
+	if apiVersion == "" {
+		apiVersion = "client.authentication.k8s.io/v1"
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf(`KUBERNETES_EXEC_INFO={"apiVersion":%q,"kind":"ExecCredential","spec":{"interactive":false}}`, apiVersion))
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.New("Credential plugin " + command + " failed: " + strings.TrimSpace(err.Error()+" "+stderr.String()))
+	}
+
+	cred := &k8sExecCredential{}
+	if err := json.Unmarshal(out, cred); err != nil {
+		return nil, errors.New("Cannot parse output of credential plugin " + command + ": " + err.Error())
+	}
+	return cred, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestK8sHosts(t *testing.T) {
+	nodes := []string{
+		`{"metadata":{"name":"node-1"},"status":{"addresses":[{"type":"InternalIP","address":"10.0.0.1"},{"type":"Hostname","address":"node-1"}],"conditions":[{"type":"Ready","status":"True"}]}}`,
+		`{"metadata":{"name":"node-2"},"status":{"addresses":[{"type":"InternalIP","address":"10.0.0.2"},{"type":"ExternalIP","address":"203.0.113.2"}],"conditions":[{"type":"Ready","status":"False"}]}}`,
+	}
+	api := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer k8s-token" || r.URL.Path != "/api/v1/nodes" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"message": "Unauthorized"})
+			return
+		}
+		if s := r.URL.Query().Get("labelSelector"); s != "" && s != "pool=gpu" {
+			t.Errorf("Unexpected selector %s", s)
+		}
+		// nodes are returned one per page
+		if r.URL.Query().Get("continue") == "" {
+			w.Write([]byte(`{"items":[` + nodes[0] + `],"metadata":{"continue":"next"}}`))
+		} else {
+			w.Write([]byte(`{"items":[` + nodes[1] + `],"metadata":{}}`))
+		}
+	}))
+	defer api.Close()
+
+	dir, err := ioutil.TempDir("", "gossha-k8s")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: api.Certificate().Raw})
+	kubeconfig := filepath.Join(dir, "config")
+	writeConfig := func(token string) {
+		must(ioutil.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+current-context: test
+contexts:
+- context:
+    cluster: test-cluster
+    user: test-user
+  name: test
+clusters:
+- cluster:
+    certificate-authority-data: `+base64.StdEncoding.EncodeToString(ca)+`
+    server: `+api.URL+`
+  name: test-cluster
+users:
+- name: test-user
+  user:
+    token: `+token+`
+`), 0600), "Could not write kubeconfig")
+	}
+	writeConfig("k8s-token")
+
+	k8sSelector, k8sKubeconfig = "pool=gpu", kubeconfig
+	defer func() { k8sSelector, k8sKubeconfig = "", "" }()
+
+	for params, expected := range map[string]string{
+		"":                               "10.0.0.1 10.0.0.2",
+		"&address=external":              "203.0.113.2",
+		"&address=name&ready=1":          "node-1",
+		"&address=hostname&context=test": "node-1",
+	} {
+		u, err := url.Parse(k8sNodesSource() + params)
+		must(err, "Could not parse source")
+		hosts, err := k8sHosts(u)
+		if err != nil || strings.Join(hosts, " ") != expected {
+			t.Fatalf("Expected %s for %s, got %v, %v", expected, u, hosts, err)
+		}
+	}
+
+	writeConfig("wrong")
+	u, _ := url.Parse(k8sNodesSource())
+	if _, err := k8sHosts(u); err == nil || !strings.Contains(err.Error(), "Unauthorized") {
+		t.Fatalf("Expected API error to be reported, got %v", err)
+	}
+}
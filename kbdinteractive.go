@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	kbdInteractive bool // use keyboard-interactive authentication (e.g. OTP codes) if keys are not enough
+	shareAnswers   bool // reuse answers to identical challenges for all hosts of the request
+
+	challengeMu   sync.Mutex // challenges are sent to user one at a time
+	sharedAnswers = make(map[string][]string)
+)
+
+// ChallengeRequest asks user to answer keyboard-interactive questions, answers are
+// expected in the next request: {"Answers":["<answer1>",...]}
+type ChallengeRequest struct {
+	Hostname    string
+	User        string
+	Instruction string
+	Questions   []string
+	Echos       []bool // whether answer to the question can be displayed
+}
+
+// resetSharedAnswers forgets shared answers, it is called before each request because OTP codes expire
+func resetSharedAnswers() {
+	challengeMu.Lock()
+	sharedAnswers = make(map[string][]string)
+	challengeMu.Unlock()
+}
+
+// keyboardInteractiveAuth returns auth method that forwards challenges of hostname to user
+func keyboardInteractiveAuth(hostname string, usage *authUsage) ssh.AuthMethod {
+	return ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		usage.set("keyboard-interactive", "")
+		if len(questions) == 0 {
+			return nil, nil
+		}
+
+		challengeMu.Lock()
+		defer challengeMu.Unlock()
+
+		key := instruction + "\x00" + strings.Join(questions, "\x00")
+		if answers, ok := sharedAnswers[key]; ok && shareAnswers {
+			return answers, nil
+		}
+
+		sendProxyReply(&ChallengeRequest{Hostname: hostname, User: user, Instruction: instruction, Questions: questions, Echos: echos})
+
+		response, ok := <-requestsChan
+		if !ok {
+			return nil, errors.New("No answers supplied")
+		}
+
+		if len(response.Answers) != len(questions) {
+			return nil, fmt.Errorf("Expected %d answers, got %d", len(questions), len(response.Answers))
+		}
+
+		if shareAnswers {
+			sharedAnswers[key] = response.Answers
+		}
+
+		return response.Answers, nil
+	})
+}
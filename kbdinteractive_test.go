@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestKeyboardInteractive(t *testing.T) {
+	kbdInteractive, shareAnswers = true, true
+	defer func() { kbdInteractive, shareAnswers = false, false }()
+
+	var hosts []string
+	for i := 0; i < 3; i++ {
+		srv := &testSSHServer{hostname: fmt.Sprintf("test-kbd-%d", i), otp: "123456"}
+		srv.start()
+		hosts = append(hosts, srv.addr)
+	}
+
+	requestsChan <- &ProxyRequest{Action: "ssh", Cmd: "hostname", Hosts: hosts, Timeout: uint64(maxTimeout / time.Millisecond)}
+
+	challenges, successful := 0, 0
+	timeout := time.After(maxTimeout)
+
+	for {
+		select {
+		case reply := <-repliesChan:
+			switch reply := reply.(type) {
+			case *ChallengeRequest:
+				challenges++
+				if len(reply.Questions) != 1 || reply.Questions[0] != "Verification code: " {
+					t.Fatalf("Unexpected challenge: %#v", reply)
+				}
+				requestsChan <- &ProxyRequest{Answers: []string{"123456"}}
+			case *Reply:
+				if !reply.Success {
+					t.Fatalf("Request to %s failed: %s", reply.Hostname, reply.ErrMsg)
+				}
+				successful++
+			case *FinalReply:
+				if successful != len(hosts) {
+					t.Fatalf("Expected %d successful replies, got %d", len(hosts), successful)
+				}
+				if challenges != 1 {
+					t.Fatalf("Expected answer to be shared between hosts, got %d challenges", challenges)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Timed out")
+		}
+	}
+}
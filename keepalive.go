@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultKeepAliveInterval = 30 * time.Second
+	defaultKeepAliveCount    = 3
+)
+
+var (
+	keepAliveInterval = defaultKeepAliveInterval // interval between keepalive requests (0 disables them)
+	keepAliveCount    = defaultKeepAliveCount    // number of unanswered keepalive requests after which connection is considered lost
+
+	errConnectionLost = errors.New("Connection lost: no response to keepalive requests")
+
+	lostConnsMu sync.Mutex
+	lostConns   = make(map[*ssh.Client]bool) // connections closed because keepalive requests were not answered
+)
+
+// keepAlive sends keepalive requests over conn until it is closed, connection is closed when count
+// requests in a row are not answered within interval; settings are passed by the caller, so that
+// they are read before the goroutine starts and later changes do not affect running ones
+func keepAlive(conn *ssh.Client, interval time.Duration, count int) {
+	done := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	replied := make(chan error, 1)
+	pending := false
+	missed := 0
+
+	for {
+		select {
+		case <-done:
+			return
+		case err := <-replied:
+			if err != nil {
+				return
+			}
+			pending, missed = false, 0
+		case <-ticker.C:
+			if !pending {
+				pending = true
+				go func() {
+					// any reply (even failure) means that the other side is alive
+					_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+					replied <- err
+				}()
+				continue
+			}
+
+			if missed++; missed >= count {
+				logf(logInfo, conn.RemoteAddr().String(), "Connection lost: %d keepalive requests were not answered", missed)
+
+				lostConnsMu.Lock()
+				lostConns[conn] = true
+				lostConnsMu.Unlock()
+
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// connLostError replaces err with errConnectionLost if conn was closed by keepAlive
+func connLostError(conn *ssh.Client, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	lostConnsMu.Lock()
+	lost := lostConns[conn]
+	lostConnsMu.Unlock()
+
+	if lost {
+		return errConnectionLost
+	}
+	return err
+}
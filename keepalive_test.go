@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeepAlive(t *testing.T) {
+	keepAliveInterval, keepAliveCount = 50*time.Millisecond, 2
+	defer func() { keepAliveInterval, keepAliveCount = defaultKeepAliveInterval, defaultKeepAliveCount }()
+
+	r := makeTestResult()
+	startTestServers(r, "test-keepalive", 1)
+
+	var srv *testSSHServer
+	for _, s := range r.hosts {
+		srv = s
+	}
+
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = "sleep 1.5"
+	req.Hosts = []string{srv.addr}
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		atomic.StoreInt32(&srv.stalled, 1)
+	}()
+
+	start := time.Now()
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+
+	reply := r.replies[srv.addr]
+	if reply == nil || reply.Success || reply.ErrMsg != errConnectionLost.Error() {
+		t.Fatalf("Expected connection lost error, got %+v", reply)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Lost connection was detected too late: %s", elapsed)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Latency-aware scheduling (-latency-file <file>): how long the action took on every host is kept
+// in the file (moving average of runs, in seconds), and when -m limits number of hosts that run at
+// once, hosts that are expected to be slow are started first, so that they do not end up as the
+// last ones and the run finishes sooner. Hosts without recorded timing are started before all
+// others, because they may be the slowest. Without the limit all hosts are started at once anyway,
+// and order of replies does not change either way.
+
+const latencyWeight = 0.3 // weight of the last run in moving average
+
+var (
+	latencyFile string        // file to keep durations of hosts in (-latency-file)
+	latencies   *latencyStore // contents of latencyFile
+)
+
+// latencyStore keeps expected duration of action for hosts
+type latencyStore struct {
+	mu    sync.Mutex
+	hosts map[string]float64 // hostname => moving average of durations in seconds
+}
+
+// loadLatencies reads durations of hosts from filename, file does not have to exist
+func loadLatencies(filename string) (*latencyStore, error) {
+	s := &latencyStore{hosts: make(map[string]float64)}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.New("Cannot read latencies: " + err.Error())
+	}
+	if err := json.Unmarshal(data, &s.hosts); err != nil {
+		return nil, errors.New("Cannot parse latencies " + filename + ": " + err.Error())
+	}
+	return s, nil
+}
+
+// observe records that action took d on hostname
+func (s *latencyStore) observe(hostname string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.hosts[hostname]; ok {
+		s.hosts[hostname] = prev + latencyWeight*(d.Seconds()-prev)
+	} else {
+		s.hosts[hostname] = d.Seconds()
+	}
+}
+
+// order returns hosts ordered by expected duration, unknown hosts and the slowest ones first;
+// hosts with equal duration keep their order
+func (s *latencyStore) order(hosts []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := append([]string(nil), hosts...)
+	sort.SliceStable(res, func(i, j int) bool {
+		a, aok := s.hosts[res[i]]
+		b, bok := s.hosts[res[j]]
+		if aok != bok {
+			return !aok
+		}
+		return a > b
+	})
+	return res
+}
+
+// save replaces contents of filename atomically
+func (s *latencyStore) save(filename string) error {
+	s.mu.Lock()
+	data, err := json.MarshalIndent(s.hosts, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return errors.New("Cannot write latencies: " + err.Error())
+	}
+	if err := replaceFile(filename, append(data, '\n')); err != nil {
+		return errors.New("Cannot write latencies: " + err.Error())
+	}
+	return nil
+}
+
+// latencyOrdered returns batches with hosts ordered by expected duration when not all hosts
+// of a batch can run at once
+func latencyOrdered(batches [][]string, concurrency uint64) [][]string {
+	if latencies == nil {
+		return batches
+	}
+	res := make([][]string, len(batches))
+	for i, b := range batches {
+		res[i] = b
+		if uint64(len(b)) > concurrency {
+			res[i] = latencies.order(b)
+		}
+	}
+	return res
+}
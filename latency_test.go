@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLatencyOrder(t *testing.T) {
+	s := &latencyStore{hosts: map[string]float64{"fast": 1, "slow": 10, "medium": 5, "medium2": 5}}
+	got := s.order([]string{"fast", "medium", "new", "slow", "medium2"})
+	if want := []string{"new", "slow", "medium", "medium2", "fast"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected order %v, expected %v", got, want)
+	}
+
+	s.observe("fast", 11*time.Second)
+	if d := s.hosts["fast"]; d != 4 {
+		t.Fatalf("Unexpected moving average %v", d)
+	}
+
+	defer func() { latencies = nil }()
+	latencies = s
+	batches := latencyOrdered([][]string{{"fast", "slow"}, {"fast", "slow", "new"}}, 2)
+	if want := [][]string{{"fast", "slow"}, {"new", "slow", "fast"}}; !reflect.DeepEqual(batches, want) {
+		t.Fatalf("Only batches larger than concurrency must be ordered, got %v", batches)
+	}
+}
+
+func TestLatencyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossha-latency")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	r := makeTestResult()
+	startTestServers(r, "test-latency-", 3)
+
+	latencyFile = filepath.Join(dir, "latencies.json")
+	latencies, err = loadLatencies(latencyFile)
+	must(err, "Could not load latencies")
+	maxConnections = 1
+	defer func() { latencyFile, latencies, maxConnections = "", nil, 0 }()
+
+	runTestRequest(t, r, makeProxyRequest(maxTimeout))
+	checkSuccess(t, r)
+
+	saved, err := loadLatencies(latencyFile)
+	must(err, "Could not load latencies")
+	for addr := range r.hosts {
+		if _, ok := saved.hosts[addr]; !ok {
+			t.Errorf("Duration of %s was not recorded: %v", addr, saved.hosts)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// log levels enabled by -v and -vv
+const (
+	logInfo  = 1 // connections and results of actions
+	logDebug = 2 // ssh handshake details, sessions and retries
+)
+
+var (
+	verbosity   int  // 0 means no logging
+	quiet       bool // do not send ConnectionProgress messages (-q)
+	debugLogger = log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
+)
+
+// logf writes message to stderr if verbosity is at least level; messages about a host are prefixed with its name
+func logf(level int, hostname string, format string, args ...interface{}) {
+	if verbosity < level {
+		return
+	}
+
+	if hostname != "" {
+		format = "[" + hostname + "] " + format
+	}
+	debugLogger.Printf(format, args...)
+}
+
+// logHostKey accepts any host key (as before), but logs its fingerprint
+func logHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	logf(logDebug, hostname, "Host key %s %s (%s)", key.Type(), ssh.FingerprintSHA256(key), remote)
+	return nil
+}
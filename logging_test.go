@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestLogLevels(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger, oldVerbosity := debugLogger, verbosity
+	defer func() { debugLogger, verbosity = oldLogger, oldVerbosity }()
+
+	debugLogger = log.New(&buf, "", 0)
+	verbosity = logInfo
+
+	logf(logInfo, "host1", "Connected")
+	logf(logDebug, "host1", "Handshake complete")
+	logf(logInfo, "", "No host")
+
+	if got := buf.String(); got != "[host1] Connected\nNo host\n" {
+		t.Fatalf("Unexpected log: %q", got)
+	}
+
+	buf.Reset()
+	verbosity = logDebug
+	logf(logDebug, "host2", "Handshake complete")
+
+	if !strings.HasPrefix(buf.String(), "[host2] Handshake") {
+		t.Fatalf("Debug messages must be logged with -vv: %q", buf.String())
+	}
+}
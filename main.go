@@ -3,31 +3,39 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"math/rand"
 	"net"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/YuriyNasretdinov/GoSSHa/gossha"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
 const (
 	defaultTimeout             = 30000 // default timeout for operations (in milliseconds)
-	chunkSize                  = 65536 // chunk size in bytes for scp
-	throughputSleepInterval    = 100   // how many milliseconds to sleep between writing "tickets" to channel in maxThroughputThread
-	minChunks                  = 10    // minimum allowed count of chunks to be sent per sleep interval
-	minThroughput              = chunkSize * minChunks * (1000 / throughputSleepInterval)
-	maxOpensshAgentConnections = 128 // default connection backlog for openssh
+	defaultRetryDelay          = 1000  // default delay before first retry (in milliseconds)
+	ptyWidth                   = 200   // pseudo-terminal size for commands that are run with Pty
+	ptyHeight                  = 50
+	chunkSize                  = 65536   // chunk size in bytes for scp
+	maxOpensshAgentConnections = 128     // default connection backlog for openssh
+	maxAgentMessageLen         = 1 << 20 // largest forwarded ssh-agent message
 )
 
 var (
@@ -37,55 +45,201 @@ var (
 	repliesChan  = make(chan interface{})
 	requestsChan = make(chan *ProxyRequest)
 
-	maxThroughputChan = make(chan bool, minChunks) // channel that is used for throughput limiting in scp
-
-	maxThroughput uint64 // max throughput (for scp) in bytes per second
-
 	agentConnChan      = make(chan chan bool) // channel for getting "ticket" for new agent connection
 	agentConnFreeChan  = make(chan bool, 10)  // channel for freeing connections
 	sshAuthSock        string
-	maxConnections     uint64 // max concurrent ssh connections
-	disconnectAfterUse bool   // close connection after each action
-
-	connectedHosts = connHostsMap{v: make(map[string]*ssh.Client)}
+	maxConnections     uint64   // max concurrent ssh connections
+	disconnectAfterUse bool     // close connection after each action
+	jumpHosts          []string // hosts to tunnel connections through, like ProxyJump in OpenSSH
+
+	connectedHosts = connHostsMap{v: make(map[string]*cachedConn)}
+	idleTimeout    time.Duration // close cached connections that are not used for that long (0 means never)
+
+	requestTimeout  = time.Duration(defaultTimeout) * time.Millisecond // timeout of requests that do not specify it (-timeout)
+	sortDefault     string                                             // order of replies of requests that do not specify Sort (-sort), empty means as hosts finish
+	outputFormat    = "json"                                           // format of replies (-output)
+	prefixOutput    bool                                               // print output lines prefixed with host as they arrive (-P)
+	failFastDefault bool                                               // cancel actions after first failure (-fail-fast)
+	inplaceUploads  bool                                               // write uploaded files directly instead of renaming temporary files (-inplace)
+	resumeUploads   bool                                               // continue partial uploads in every request (-resume)
+	deltaUploads    bool                                               // upload only changed blocks of existing files in every request (-delta)
+
+	forwardAgent     bool   // request agent forwarding for sessions (-A)
+	agentForwardSock string // ssh-agent socket that remote hosts are given access to, empty if forwarding is disabled
 )
 
+// connHostsMap is a cache of established connections; connections are shared between
+// all sessions to the same host and are closed after being idle for idleTimeout
 type connHostsMap struct {
 	mu sync.Mutex
-	v  map[string]*ssh.Client
+	v  map[string]*cachedConn
+}
+
+type cachedConn struct {
+	conn     *ssh.Client
+	inUse    int // number of actions that currently use the connection
+	lastUsed time.Time
 }
 
+// Get returns cached connection and marks it as used, Release must be called after use
 func (c *connHostsMap) Get(hostname string) (v *ssh.Client, ok bool) {
 	c.mu.Lock()
-	v, ok = c.v[hostname]
+	defer c.mu.Unlock()
+
+	cc, ok := c.v[hostname]
+	if !ok {
+		return nil, false
+	}
+
+	cc.inUse++
+	cc.lastUsed = time.Now()
+	return cc.conn, true
+}
+
+// Set caches connection and marks it as used; if connection to hostname was established
+// concurrently then v is closed and the existing connection is returned instead
+func (c *connHostsMap) Set(hostname string, v *ssh.Client) *ssh.Client {
+	c.mu.Lock()
+	if cc, ok := c.v[hostname]; ok {
+		cc.inUse++
+		cc.lastUsed = time.Now()
+		c.mu.Unlock()
+		v.Close()
+		return cc.conn
+	}
+	c.v[hostname] = &cachedConn{conn: v, inUse: 1, lastUsed: time.Now()}
 	c.mu.Unlock()
-	return v, ok
+
+	// forget connection as soon as it is closed by either side
+	go func() {
+		v.Wait()
+		c.mu.Lock()
+		if cc, ok := c.v[hostname]; ok && cc.conn == v {
+			delete(c.v, hostname)
+		}
+		c.mu.Unlock()
+	}()
+
+	return v
 }
 
-func (c *connHostsMap) Set(hostname string, v *ssh.Client) {
+// Release marks connection v to hostname as no longer used by the caller; it is a no-op for
+// the cache if v was already replaced by a newer connection (e.g. after reconnect)
+func (c *connHostsMap) Release(hostname string, v *ssh.Client) {
 	c.mu.Lock()
-	c.v[hostname] = v
+	cc, ok := c.v[hostname]
+	if ok && cc.conn != v {
+		ok = false
+	}
+
+	disconnect := disconnectAfterUse // tests change it under c.mu
+	if ok && disconnect {
+		delete(c.v, hostname)
+	} else if ok {
+		cc.inUse--
+		cc.lastUsed = time.Now()
+	}
 	c.mu.Unlock()
+
+	if disconnect {
+		v.Close()
+	}
 }
 
 func (c *connHostsMap) Close(hostname string) error {
 	c.mu.Lock()
-	v, ok := c.v[hostname]
+	cc, ok := c.v[hostname]
 	delete(c.v, hostname)
 	c.mu.Unlock()
 	if !ok {
 		return nil
 	}
 
-	return v.Close()
+	return cc.conn.Close()
+}
+
+// Forget closes connection v to hostname and removes it from cache unless it was already replaced by a newer one
+func (c *connHostsMap) Forget(hostname string, v *ssh.Client) {
+	c.mu.Lock()
+	if cc, ok := c.v[hostname]; ok && cc.conn == v {
+		delete(c.v, hostname)
+	}
+	c.mu.Unlock()
+
+	v.Close()
+}
+
+// CloseIdle closes connections that were not used for longer than timeout
+func (c *connHostsMap) CloseIdle(timeout time.Duration) {
+	var idle []*ssh.Client
+
+	c.mu.Lock()
+	for hostname, cc := range c.v {
+		if cc.inUse <= 0 && time.Since(cc.lastUsed) > timeout {
+			idle = append(idle, cc.conn)
+			delete(c.v, hostname)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, conn := range idle {
+		conn.Close()
+	}
+}
+
+// List returns information about cached connections sorted by hostname
+func (c *connHostsMap) List() []*ConnectionInfo {
+	c.mu.Lock()
+	res := make([]*ConnectionInfo, 0, len(c.v))
+	for hostname, cc := range c.v {
+		res = append(res, &ConnectionInfo{
+			Hostname:      hostname,
+			RemoteAddr:    cc.conn.RemoteAddr().String(),
+			ServerVersion: string(cc.conn.ServerVersion()),
+			InUse:         cc.inUse,
+			LastUsed:      cc.lastUsed,
+		})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Hostname < res[j].Hostname })
+	return res
+}
+
+func idleConnectionsThread() {
+	for {
+		time.Sleep(idleTimeout / 2)
+		connectedHosts.CloseIdle(idleTimeout)
+	}
 }
 
 type (
 	SshResult struct {
-		hostname string
-		stdout   string
-		stderr   string
-		err      error
+		hostname    string
+		stdout      string
+		stderr      string
+		err         error
+		duration    time.Duration
+		commands    []*CommandResult // results of individual commands if Cmds were specified
+		files       []*FileResult    // results of individual files if several sources were uploaded
+		unchanged   bool             // upload was skipped because all files were already up to date
+		changes     []*FileChange    // how uploaded files changed (only with ChangeReport)
+		facts       *HostFacts       // result of Action == "facts"
+		ping        *PingResult      // result of Action == "ping"
+		reboot      *RebootResult    // result of Action == "reboot"
+		service     *ServiceResult   // result of Action == "service"
+		pkg         *PkgResult       // result of Action == "pkg"
+		relayedFrom string           // host that pushed uploaded file to this one (only with Relay)
+		rerun       bool             // action was run again because connection was lost (see withReruns)
+		truncated   bool             // output exceeded MaxOutputBytes and was truncated
+		matches     *int             // number of lines that matched Filter
+		cached      bool             // result was taken from cache (see withResultCache)
+		skipped     bool             // action was not run because OnlyIf command failed (see withOnlyIf)
+		followUp    *CommandResult   // result of Then or OnFail command (see withFollowUp)
+		snapshot    string           // file with outputs of capture commands (see withSnapshot)
+		summary     *OutputSummary   // sizes of output that was not kept (only with SummaryOnly)
+
+		snapshotChanged []string // capture commands which output changed
 	}
 
 	ScpResult struct {
@@ -93,23 +247,219 @@ type (
 		err      error
 	}
 
+	// ConnectionInfo describes cached connection (GET /connections in HTTP API mode)
+	ConnectionInfo struct {
+		Hostname      string
+		RemoteAddr    string
+		ServerVersion string
+		InUse         int // actions that currently use the connection
+		LastUsed      time.Time
+	}
+
 	ProxyRequest struct {
-		Action        string
-		Password      string // password for private key (only for Action == "password")
-		Cmd           string // command to execute (only for Action == "ssh")
-		Source        string // source file to copy (only for Action == "scp")
-		Target        string // target file (only for Action == "scp")
-		Hosts         []string
-		Timeout       uint64 // timeout (in milliseconds), default is defaultTimeout
-		MaxThroughput uint64 // max throughput (for scp) in bytes per second, default is no limit
+		Action            string
+		Password          string            // password for private key (only for Action == "password")
+		Answers           []string          // answers to ChallengeRequest questions
+		Cmd               string            // command to execute (only for Action == "ssh"), or command that reboots host (for Action == "reboot", default is reboot)
+		Cmds              []string          // commands to execute one after another instead of Cmd, stops at first failure (only for Action == "ssh")
+		CmdTimeouts       []uint64          // timeouts of commands of Cmds in milliseconds that are enforced on remote side like with RemoteTimeout, 0 means none
+		HostParallel      uint64            // run Cmds over that many concurrent sessions per host instead of one after another, default is set by -host-parallel flag
+		RebootWait        uint64            // time for host to come back after reboot in milliseconds, default is 10 minutes (only for Action == "reboot")
+		RebootGrace       uint64            // time after reboot command before host is connected to again in milliseconds, default is 10 seconds (only for Action == "reboot")
+		Operation         string            // start, stop, restart, reload, status, enable or disable (for Action == "service"), or install, remove, upgrade or status (for Action == "pkg")
+		Service           string            // name of service (only for Action == "service")
+		Packages          []string          // names of packages (only for Action == "pkg")
+		Stdin             string            // data to send to stdin of command (only for Action == "ssh" or "script")
+		StdinFile         string            // local file which contents are sent to stdin of command (only for Action == "ssh" or "script")
+		Env               map[string]string // environment variables to set for command, server must accept them (AcceptEnv in sshd_config)
+		Pty               bool              // allocate pseudo-terminal for command, stderr is merged into stdout (only for Action == "ssh" or "script")
+		Sudo              bool              // run command using sudo (only for Action == "ssh" or "script"), or install uploaded files with sudo (for Action == "scp")
+		SudoPassword      string            // password that is sent to sudo, sudo must not ask for password if it is empty, default is set by -sudo-password flag
+		RunAs             string            // user to run command as, login user is used for authentication (only for Action == "ssh" or "script"), default is set by -run-as flag
+		RunAsMethod       string            // "sudo" (sudo -u <user>) or "su" (su - <user> -c) to run command as RunAs user, default is set by -run-as-method flag
+		Source            string            // source file to copy (only for Action == "scp" or "download") or local script (only for Action == "script")
+		Sources           []string          // files to upload into Target directory instead of Source, glob patterns are allowed (only for Action == "scp")
+		Manifest          string            // local YAML or JSON file with sources, targets, modes and owners of files to upload instead of Source and Target (only for Action == "scp")
+		Data              []byte            // contents to upload if Source is "-" (base64-encoded in JSON, only for Action == "scp")
+		Args              []string          // arguments of script (only for Action == "script")
+		Target            string            // target file (only for Action == "scp") or local directory (only for Action == "download")
+		Recursive         bool              // Source is a directory that is downloaded as a whole with tar (only for Action == "download")
+		Mode              string            // octal permissions to set on target file, e.g. "0644" (only for Action == "scp")
+		Owner             string            // numeric "<uid>:<gid>" to set on target file (only for Action == "scp")
+		Preserve          bool              // preserve permissions and modification time of source file (only for Action == "scp")
+		Verify            bool              // compare SHA-256 of uploaded files with local ones (only for Action == "scp")
+		SkipUnchanged     bool              // do not transfer files which remote copies have the same SHA-256 (only for Action == "scp")
+		ChangeReport      bool              // report whether each file was created, replaced or unchanged and previous state of target (only for Action == "scp")
+		Parallel          uint64            // upload files of at least 16 MiB over that many concurrent sessions per host (only for Action == "scp")
+		Resume            bool              // continue partial uploads left by failed attempts instead of starting over (only for Action == "scp")
+		Delta             bool              // only upload blocks that differ from existing target file, like rsync (only for Action == "scp")
+		Compress          bool              // gzip contents of files and decompress them on remote side (only for Action == "scp")
+		Transfer          string            // how files are uploaded: "auto", "sftp", "scp" or "cat", default is set by gossha_transfer inventory variable or -transfer flag (only for Action == "scp")
+		Relay             uint64            // upload file only to that many hosts, every host pushes it to that many others with scp (only for Action == "scp")
+		Mirror            bool              // make Target directory mirror of Source directory, only new and changed files are uploaded (only for Action == "scp")
+		MirrorDelete      bool              // with Mirror: remove remote files and directories that are not in Source
+		MirrorPlan        bool              // with Mirror: only report Changes that would be made on every host without changing anything
+		LocalForward      string            // "[bind_address:]port[+i]:host:hostport" to listen locally and forward through each host (only for Action == "forward")
+		RemoteForward     string            // "[bind_address:]port[+i]:host:hostport" to listen on each host and forward to local side (only for Action == "forward")
+		Hosts             []string
+		Groups            []string // inventory groups which hosts are added to Hosts
+		Stages            string   // name of sequence of groups from "stages" section of configuration file to run action on one after another
+		Discover          []string // dynamic host sources (e.g. "ec2:role=web") which hosts are added to Hosts
+		Exclude           []string // hosts, patterns ("web[1-3]", "db*") or inventory groups ("@maintenance") to remove from Hosts, -exclude flag adds to them
+		Limit             string   // regular expression that names of hosts must match, -limit flag is applied as well
+		Timeout           uint64   // timeout (in milliseconds), default is set by -timeout flag
+		RemoteTimeout     bool     // also terminate commands on remote hosts when Timeout (or gossha_timeout) expires (also enabled by -remote-timeout flag)
+		MaxThroughput     uint64   // max total throughput of all hosts (for scp) in bytes per second, default is no limit
+		MaxHostThroughput uint64   // max throughput of each host (for scp) in bytes per second, default is no limit
+		Retries           uint64   // how many times to retry action on host if it fails for reasons other than non-zero exit status
+		RetryDelay        uint64   // delay before first retry (in milliseconds), doubled after each attempt, default is defaultRetryDelay
+		GroupOutput       bool     // send one GroupedReply per distinct result instead of Reply per host
+		Sort              string   // send replies after all hosts finish ordered by "input" order of hosts, host "name" or "duration", default is set by -sort flag
+		OutputDir         string   // local directory to write stdout and stderr of each host to instead of sending them in Reply
+		Progress          bool     // send RunProgress after each host finishes and TransferProgress during uploads
+		Stream            bool     // send OutputChunk with command output as it is produced (only for Action == "ssh" or "script")
+		Serial            string   // run action on N hosts (or N% of hosts) at a time, next batch starts after previous one finishes
+		MaxFailPercentage float64  // with Serial: stop rollout if more than this percentage of batch hosts fail, default is to stop on any failure
+		FailFast          bool     // cancel action on all hosts after first failure (also enabled by -fail-fast flag)
+		Template          bool     // render Cmd, Cmds, Chdir, Source and Target as text/template for every host, e.g. "conf/{{.Host}}.cfg"
+		Canary            uint64   // run action on that many random hosts first and send ConfirmationRequest before the rest, default is set by -canary flag
+		CanaryHosts       []string // hosts (patterns are allowed) to run action on first instead of random ones
+		Confirm           bool     // answer to ConfirmationRequest, action is started on the remaining hosts only if it is true; in action request it confirms guarded action in advance (see -guard)
+		AcceptHostKey     bool     // answer to HostKeyRequest, key is trusted until GoSSHa exits only if it is true
+		Timing            bool     // add HostTiming to replies and TimingSummary to FinalReply (also enabled by -timing flag)
+		Expect            string   // string that Stdout of every host must contain ("re:<regexp>" to match regular expression), default is set by -expect flag
+		Diff              string   // host (or local "file:<path>") which output Stdout of other hosts is compared with, default is set by -diff flag
+		RerunOnDisconnect bool     // run action once more over new connection if connection is lost while it is running (also enabled by -rerun-on-disconnect flag)
+		Shell             string   // shell command line (e.g. "/bin/bash -c") that command is passed to instead of login shell of user, default is set by -shell flag
+		NoShell           bool     // split command into words locally and execute program directly without shell (also enabled by -no-shell flag)
+		Chdir             string   // remote directory to run command or script in (only for Action == "ssh" or "script"), default is set by -chdir flag
+		CacheTTL          uint64   // return successful result of the same command on host if it is younger than that (in milliseconds) instead of running it again (only for Action == "ssh")
+		NoCache           bool     // run command even if its result is cached (also enabled by -no-cache flag), new result is still cached
+		NoRunEnv          bool     // do not export GOSSHA_HOST and other run metadata to commands (also enabled by -no-run-env flag)
+		PreResolve        bool     // resolve names of all hosts in parallel before connecting and fail hosts which names do not exist right away (also enabled by -pre-resolve flag)
+		Probe             uint64   // probe SSH ports of all hosts in parallel with that timeout (in milliseconds) before connecting and fail unreachable hosts right away, default is set by -probe flag
+		Session           string   // name of session from "sessions" section of configuration file which setup commands are run before command and teardown ones after action, default is set by -session flag
+		MaxOutputBytes    uint64   // keep at most that many bytes of stdout and stderr of every command and drop the rest, default is set by -max-output-bytes flag
+		SummaryOnly       bool     // report only sizes of stdout and stderr in OutputSummary instead of them (only for Action == "ssh" or "script"), also enabled by -summary-only flag
+		SummaryLines      uint64   // with SummaryOnly: keep that many first and last lines of stdout and stderr, default is set by -summary-lines flag
+		OnlyIf            string   // command that is run on every host before action, hosts where it exits with non-zero status are skipped, default is set by -only-if flag
+		Then              string   // command that is run on every host after command or script exits with zero status, default is set by -then flag
+		OnFail            string   // command that is run on every host after command or script exits with non-zero status, default is set by -on-fail flag
+		RemoteEncoding    string   // encoding of output of commands (e.g. "latin1", "cp1252" or "GBK") that is converted to UTF-8, default is set by gossha_remote_encoding inventory variable and -remote-encoding flag
+		StripANSI         bool     // remove ANSI escape sequences (colors, cursor movement) from output (also enabled by -strip-ansi flag)
+		Filter            string   // keep only lines of stdout that match regular expression and report their number in Matches, default is set by -filter flag
+		FilterRemote      bool     // filter stdout with grep -E on remote side instead (also enabled by -filter-remote flag)
+		Snapshot          []string // commands which output is captured on every host before and after action and written to SnapshotDir, default is set by -snapshot flag
+		SnapshotDir       string   // local directory for snapshot bundles, default is set by -snapshot-dir flag
+		Splay             uint64   // start action on every host after random delay up to that (in milliseconds) to spread load on shared backends, default is set by -splay flag
+
+		Vars     map[string]map[string]string // variables of every host ({{.Vars.name}} in templates), setting them implies Template
+		VarsFile string                       // local CSV or TSV file with host names in the first column and their variables in the rest, added to Vars
+
+		AuditFields map[string]string // fields (e.g. ticket) that are written to audit log with every operation, -policy can require them
+
+		Schedule     string // cron expression (e.g. "*/15 * * * *") to register request as scheduled job of daemon instead of running it once
+		ScheduleName string // name of scheduled job (with Schedule and for Action == "unschedule")
+
+		client    string // identity of HTTP API client that submitted request
+		scheduled string // name of scheduled job that request is a run of
+		runID     string // identifier of run, GOSSHA_RUN_ID of commands
 	}
 
 	Reply struct {
+		Hostname    string
+		Stdout      string
+		Stderr      string
+		Success     bool
+		ErrMsg      string
+		ExitCode    int               // exit status of command, -1 if it is unknown (e.g. connection failed)
+		ErrorKind   string            `json:",omitempty"` // what failed: "dns", "connect-timeout", "connect", "auth", "host-key-mismatch", "command-nonzero-exit", "command-timeout", "disconnected", "unexpected-output", "transfer" or "other"
+		Duration    float64           // time spent on host (in seconds)
+		Commands    []*CommandResult  `json:",omitempty"` // results of each executed command if Cmds were specified
+		Files       []*FileResult     `json:",omitempty"` // results of each uploaded source if Sources or glob pattern were specified
+		Unchanged   bool              `json:",omitempty"` // all files were already up to date, so nothing was uploaded (only with SkipUnchanged)
+		Changes     []*FileChange     `json:",omitempty"` // how each uploaded file changed on host (only with ChangeReport)
+		Facts       *HostFacts        `json:",omitempty"` // facts about host (only for Action == "facts")
+		Ping        *PingResult       `json:",omitempty"` // connection details (only for Action == "ping")
+		Reboot      *RebootResult     `json:",omitempty"` // when host came back (only for Action == "reboot")
+		Service     *ServiceResult    `json:",omitempty"` // init system and state of service (only for Action == "service")
+		Pkg         *PkgResult        `json:",omitempty"` // package manager and versions of packages (only for Action == "pkg")
+		RelayedFrom string            `json:",omitempty"` // host that pushed uploaded file to this one (only with Relay)
+		Rerun       bool              `json:",omitempty"` // action was run again because connection was lost (only with RerunOnDisconnect)
+		Truncated   bool              `json:",omitempty"` // some output was dropped because it exceeded MaxOutputBytes
+		Matches     *int              `json:",omitempty"` // number of lines of stdout that matched Filter (only with Filter)
+		Cached      bool              `json:",omitempty"` // result of earlier run of the same command that is younger than CacheTTL (only with CacheTTL)
+		Skipped     bool              `json:",omitempty"` // OnlyIf command failed, so action was not run (only with OnlyIf)
+		FollowUp    *CommandResult    `json:",omitempty"` // result of command that was run after action depending on its exit status (only with Then or OnFail)
+		Snapshot    string            `json:",omitempty"` // local file with outputs of capture commands before and after action (only with Snapshot)
+		Tags        map[string]string `json:",omitempty"` // tags of host from gossha_tag_<name> inventory variables
+		Health      string            `json:",omitempty"` // note about results of host in earlier runs, e.g. "host has failed the last 5 runs" (only with -health)
+		Annotation  string            `json:",omitempty"` // description, owner and contact of failed host from inventory
+
+		SnapshotChanged []string       `json:",omitempty"` // capture commands which output changed after action (only with Snapshot)
+		OutputSummary   *OutputSummary `json:",omitempty"` // sizes and excerpt of output, which is not kept (only with SummaryOnly)
+
+		Diff            string `json:",omitempty"` // unified diff of Stdout against reference output (only with Diff)
+		SameAsReference bool   `json:",omitempty"` // Stdout is the same as reference output (only with Diff)
+
+		Timing *HostTiming `json:",omitempty"` // time spent on stages of connection and action (only with Timing)
+
+		spilled *spilledOutput // outputs written to spill file (only with -spill-dir)
+	}
+
+	CommandResult struct {
+		Cmd       string
+		Stdout    string
+		Stderr    string
+		Success   bool
+		ErrMsg    string
+		ExitCode  int
+		ErrorKind string `json:",omitempty"` // see Reply
+	}
+
+	FileResult struct {
+		Source    string
+		Target    string
+		Success   bool
+		ErrMsg    string
+		Unchanged bool `json:",omitempty"`
+	}
+
+	// GroupedReply is a result shared by all listed hosts (sent instead of Reply if GroupOutput is set)
+	GroupedReply struct {
+		Hosts     []string
+		Stdout    string
+		Stderr    string
+		Success   bool
+		ErrMsg    string
+		ExitCode  int
+		ErrorKind string         `json:",omitempty"` // see Reply
+		Unchanged bool           `json:",omitempty"`
+		Skipped   bool           `json:",omitempty"`
+		FollowUp  *CommandResult `json:",omitempty"` // see Reply
+
+		source *Reply // reply with spilled outputs of group (only with -spill-dir)
+	}
+
+	// RunProgress is sent after each host finishes if Progress is set
+	RunProgress struct {
+		Completed int // hosts that finished successfully
+		Failed    int
+		Pending   int
+	}
+
+	// OutputChunk is a piece of command output (complete lines when possible), sent if Stream is set
+	OutputChunk struct {
 		Hostname string
-		Stdout   string
-		Stderr   string
-		Success  bool
-		ErrMsg   string
+		Stream   string // "stdout" or "stderr"
+		Data     string
+	}
+
+	// TransferProgress is sent periodically during upload to each host if Progress is set
+	TransferProgress struct {
+		Hostname   string
+		Bytes      int64 // bytes uploaded so far
+		TotalBytes int64
 	}
 
 	PasswordRequest struct {
@@ -119,6 +469,18 @@ type (
 	FinalReply struct {
 		TotalTime     float64
 		TimedOutHosts map[string]bool
+		Interrupted   bool     `json:",omitempty"` // action was cancelled with Ctrl-C
+		PendingHosts  []string `json:",omitempty"` // hosts that did not finish before action was cancelled
+		SkippedHosts  []string `json:",omitempty"` // hosts where action was not started because rollout was stopped
+		Aborted       string   `json:",omitempty"` // why watchdog aborted the action, e.g. "run exceeded -max-run-time 1h0m0s"
+
+		Compliance *ComplianceSummary    `json:",omitempty"` // result of output check (only with Expect)
+		Timing     *TimingSummary        `json:",omitempty"` // percentiles of host timings and the slowest hosts (only with Timing)
+		Tags       map[string]*TagCounts `json:",omitempty"` // successful and failed hosts by "<tag>=<value>" (only if hosts have tags)
+		Stats      *RunStats             // numbers of hosts by outcome, the slowest host and traffic
+
+		HostKeyChanges []*HostKeyChange  `json:",omitempty"` // hosts which keys do not match pinned fingerprints
+		Annotations    map[string]string `json:",omitempty"` // annotations of hosts that did not succeed, by hostname
 	}
 
 	ConnectionProgress struct {
@@ -166,43 +528,10 @@ func releaseAgent() {
 	}
 }
 
-func makeConfig() (config *ssh.ClientConfig, agentUnixSock net.Conn) {
-	clientAuth := []ssh.AuthMethod{}
-
-	var err error
-
-	if sshAuthSock != "" {
-		for {
-			agentUnixSock, err = net.Dial("unix", sshAuthSock)
-
-			if err != nil {
-				netErr := err.(net.Error)
-				if netErr.Temporary() {
-					time.Sleep(time.Duration(rand.Intn(100)) * time.Millisecond)
-					continue
-				}
-
-				reportErrorToUser("Cannot open connection to SSH agent: " + netErr.Error())
-			} else {
-				authAgent := ssh.PublicKeysCallback(agent.NewClient(agentUnixSock).Signers)
-				clientAuth = append(clientAuth, authAgent)
-			}
-
-			break
-		}
-	}
-
-	if len(signers) > 0 {
-		clientAuth = append(clientAuth, ssh.PublicKeys(signers...))
-	}
-
-	config = &ssh.ClientConfig{
-		User:            user,
-		Auth:            clientAuth,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-
-	return
+// makeConfig returns client config with credentials of hosts that are not in inventory, release
+// must be called when handshake is finished
+func makeConfig() (config *ssh.ClientConfig, release func()) {
+	return hostAuthConfig("", nil)
 }
 
 func makeSigner(keyname string) (signer ssh.Signer, err error) {
@@ -221,6 +550,14 @@ func makeSigner(keyname string) (signer ssh.Signer, err error) {
 		return
 	}
 
+	// security keys cannot sign by themselves and their public key is readable without passphrase
+	if pub, ok := securityKeyPublicKey(buf); ok {
+		if signer, err = newSecurityKeySigner(keyname, pub); err != nil {
+			reportErrorToUser(err.Error())
+		}
+		return
+	}
+
 	if bytes.Contains(buf, []byte("ENCRYPTED")) {
 		var (
 			tmpfp *os.File
@@ -250,18 +587,16 @@ func makeSigner(keyname string) (signer ssh.Signer, err error) {
 			return
 		}
 
-		repliesChan <- &PasswordRequest{PasswordFor: keyname}
-		response := <-requestsChan
-
-		if response.Password == "" {
-			reportErrorToUser("No passphrase supplied in request for " + keyname)
-			err = errors.New("No passphrase supplied")
+		var passphrase string
+		if passphrase, err = keyPassphrase(keyname); err != nil {
+			reportErrorToUser(err.Error())
 			return
 		}
 
-		cmd := exec.Command("ssh-keygen", "-f", tmpName, "-N", "", "-P", response.Password, "-p")
+		cmd := exec.Command("ssh-keygen", "-f", tmpName, "-N", "", "-P", passphrase, "-p")
 		out, err = cmd.CombinedOutput()
 		if err != nil {
+			forgetSecret(passphraseSecret(keyname)) // it is probably wrong
 			reportErrorToUser(strings.TrimSpace(string(out)))
 			return
 		}
@@ -292,367 +627,3083 @@ func makeSigner(keyname string) (signer ssh.Signer, err error) {
 
 func makeSigners() {
 	signers = []ssh.Signer{}
+	var keyNames []string
 
 	for _, keyname := range keys {
 		signer, err := makeSigner(keyname)
 		if err == nil {
 			signers = append(signers, signer)
+			keyNames = append(keyNames, keyname)
 		}
 	}
+
+	// certificates are offered before plain keys
+	signers = append(certSigners(keyNames, signers), signers...)
 }
 
-func getConnection(hostname string) (conn *ssh.Client, err error) {
-	conn, ok := connectedHosts.Get(hostname)
-	if ok {
-		return
+// splitHostPort splits "host[:port]" or "[ipv6]:port" into host and port, port defaults to 22;
+// IPv6 literals without port can be written without brackets, e.g. "2001:db8::1"
+func splitHostPort(hostname string) (host, port string) {
+	if host, port, err := net.SplitHostPort(hostname); err == nil && port != "" {
+		return host, port
 	}
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSuffix(hostname, ":"), "["), "]"), "22"
+}
 
-	defer func() {
-		if msg := recover(); msg != nil {
-			err = errors.New("Panic: " + fmt.Sprint(msg))
-		}
-	}()
+// dialHost establishes ssh connection to hostname, tunneling it through jump hosts if they are specified
+func dialHost(hostname string, conf *ssh.ClientConfig) (conn *ssh.Client, err error) {
+	return dialHostTimed(hostname, conf, nil)
+}
 
-	waitAgent()
-	conf, agentConn := makeConfig()
-	if agentConn != nil {
-		defer agentConn.Close()
+// dialHostTimed is dialHost that records stages of connection to hostname (not to jump hosts) in timing
+func dialHostTimed(hostname string, conf *ssh.ClientConfig, timing *connectTiming) (conn *ssh.Client, err error) {
+	if len(jumpHosts) > 0 && jumpConnections > 0 {
+		return dialPooled(hostname, conf, timing)
 	}
+	return dialChain(jumpHosts, hostname, conf, timing)
+}
 
-	defer releaseAgent()
-
-	port := "22"
-	str := strings.SplitN(hostname, ":", 2)
-	if len(str) == 2 {
-		hostname = str[0]
-		port = str[1]
+// dialChain connects to hostname through jumps one after another, empty hostname returns connection
+// to the last jump host
+func dialChain(jumps []string, hostname string, conf *ssh.ClientConfig, timing *connectTiming) (conn *ssh.Client, err error) {
+	hops := append([]string{}, jumps...)
+	if hostname != "" {
+		hops = append(hops, hostname)
 	}
 
-	conn, err = ssh.Dial("tcp", hostname+":"+port, conf)
-	if err != nil {
-		return
-	}
+	for i, hop := range hops {
+		hopConf := conf
+		isJump := i < len(jumps)
+		if isJump {
+			hopConf = jumpHostConfig(hop, conf)
+			if idx := strings.LastIndex(hop, "@"); idx >= 0 {
+				hop = hop[idx+1:]
+			}
+		}
 
-	sendProxyReply(&ConnectionProgress{ConnectedHost: hostname})
+		host, port := splitHostPort(hop)
+		addr := net.JoinHostPort(host, port)
+		hopConf = withGSSAPI(hopConf, host)
 
-	connectedHosts.Set(hostname, conn)
-	return
-}
+		var hopTiming *connectTiming
+		if !isJump {
+			hopTiming = timing
+		}
 
-func uploadFile(target string, contents []byte, hostname string) (stdout, stderr string, err error) {
-	conn, err := getConnection(hostname)
-	if err != nil {
-		return
+		if conn == nil {
+			conn, err = sshDial(addr, hopConf, hopTiming)
+		} else {
+			jumpConn := conn
+			closeJump := func() { jumpConn.Close() }
+			if conn, err = tunnelConnection(jumpConn, addr, hopConf, hopTiming, closeJump); err != nil {
+				closeJump()
+			}
+		}
+
+		if err != nil {
+			if isJump {
+				err = fmt.Errorf("Cannot connect to jump host %s: %w", hop, err)
+			}
+			return nil, err
+		}
 	}
 
-	session, err := conn.NewSession()
+	return
+}
+
+// sshDial is like ssh.Dial, but connects through proxy if it is configured
+func sshDial(addr string, conf *ssh.ClientConfig, timing *connectTiming) (*ssh.Client, error) {
+	netConn, err := dialTCP(addr, conf.Timeout)
 	if err != nil {
-		return
+		return nil, err
 	}
-	if disconnectAfterUse {
-		defer connectedHosts.Close(hostname)
+	if timing != nil { // traffic of jump hosts includes tunneled connections
+		netConn = countTraffic(timing.hostname, netConn)
 	}
-	defer session.Close()
+	conf = timing.connectedConfig(conf)
 
-	cmd := "cat >'" + strings.Replace(target, "'", "'\\''", -1) + "'"
-	stdinPipe, err := session.StdinPipe()
+	// like ssh.Dial, Timeout limits handshake and authentication as well
+	if conf.Timeout > 0 {
+		netConn.SetDeadline(time.Now().Add(conf.Timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(netConn, addr, conf)
 	if err != nil {
-		return
+		netConn.Close()
+		return nil, err
 	}
+	netConn.SetDeadline(time.Time{})
+	timing.authenticated()
+	logf(logDebug, addr, "Handshake complete, user %s, server version %s", conf.User, c.ServerVersion())
 
-	var stdoutBuf bytes.Buffer
-	var stderrBuf bytes.Buffer
-	session.Stdout = &stdoutBuf
-	session.Stderr = &stderrBuf
+	return ssh.NewClient(c, chans, reqs), nil
+}
 
-	err = session.Start(cmd)
+// tunnelConnection establishes ssh connection to addr through already established jumpConn;
+// onClose is called when the tunneled connection is closed
+func tunnelConnection(jumpConn *ssh.Client, addr string, conf *ssh.ClientConfig, timing *connectTiming, onClose func()) (*ssh.Client, error) {
+	netConn, err := jumpConn.Dial("tcp", overriddenAddr(addr)) // jump host does not know overridden names
 	if err != nil {
-		return
+		return nil, err
 	}
-
-	for start, maxEnd := 0, len(contents); start < maxEnd; start += chunkSize {
-		<-maxThroughputChan
-
-		end := start + chunkSize
-		if end > maxEnd {
-			end = maxEnd
-		}
-		_, err = stdinPipe.Write(contents[start:end])
-		if err != nil {
-			return
-		}
+	if timing != nil {
+		netConn = countTraffic(timing.hostname, netConn)
 	}
+	conf = timing.connectedConfig(conf)
 
-	err = stdinPipe.Close()
+	c, chans, reqs, err := ssh.NewClientConn(netConn, addr, conf)
 	if err != nil {
-		return
+		netConn.Close()
+		return nil, err
 	}
+	timing.authenticated()
+	logf(logDebug, addr, "Handshake complete through jump host, user %s, server version %s", conf.User, c.ServerVersion())
 
-	err = session.Wait()
-	stdout = stdoutBuf.String()
-	stderr = stderrBuf.String()
+	conn := ssh.NewClient(c, chans, reqs)
+	go func() {
+		conn.Wait()
+		onClose()
+	}()
 
-	return
+	return conn, nil
 }
 
-func executeCmd(cmd string, hostname string) (stdout, stderr string, err error) {
-	conn, err := getConnection(hostname)
-	if err != nil {
+// jumpHostConfig returns config for "[user@]host[:port]" jump host specification
+func jumpHostConfig(jumpHost string, conf *ssh.ClientConfig) *ssh.ClientConfig {
+	hopConf := *conf
+	if idx := strings.LastIndex(jumpHost, "@"); idx >= 0 {
+		hopConf.User = jumpHost[:idx]
+		jumpHost = jumpHost[idx+1:]
+	}
+	hopConf.HostKeyCallback = hostKeyCallback(jumpHost)
+	return &hopConf
+}
+
+// getConnection returns cached or newly established connection to hostname,
+// it must be released using connectedHosts.Release after use
+func getConnection(hostname string) (conn *ssh.Client, err error) {
+	conn, ok := connectedHosts.Get(hostname)
+	if ok {
 		return
 	}
 
-	session, err := conn.NewSession()
-	if err != nil {
+	if conn, err = connectHost(hostname, nil); err != nil {
 		return
 	}
-	if disconnectAfterUse {
-		defer connectedHosts.Close(hostname)
+
+	if agentForwardSock != "" {
+		if err = serveAgentForwarding(conn, agentForwardSock); err != nil {
+			conn.Close()
+			err = errors.New("Cannot set up agent forwarding: " + err.Error())
+			return
+		}
+	}
+
+	if x11 != nil {
+		if err = serveX11Forwarding(conn); err != nil {
+			conn.Close()
+			err = errors.New("Cannot set up X11 forwarding: " + err.Error())
+			return
+		}
 	}
-	defer session.Close()
 
-	var stdoutBuf bytes.Buffer
-	var stderrBuf bytes.Buffer
-	session.Stdout = &stdoutBuf
-	session.Stderr = &stderrBuf
-	err = session.Run(cmd)
+	if keepAliveInterval > 0 {
+		go keepAlive(conn, keepAliveInterval, keepAliveCount)
+	}
 
-	stdout = stdoutBuf.String()
-	stderr = stderrBuf.String()
+	host, _ := splitHostPort(hostname)
+	sendProxyReply(&ConnectionProgress{ConnectedHost: host})
 
+	conn = connectedHosts.Set(hostname, conn)
 	return
 }
 
-// do not allow more than maxConn simultaneous ssh-agent connections
-func agentConnectionManagerThread(maxConn uint64) {
-	freeConn := maxConn // free connections count
+// serveAgentForwarding serves agent channels opened by remote side of conn using agent at sock;
+// messages are relayed one by one, so it works with agents that only allow synchronous I/O (named pipes, Pageant)
+func serveAgentForwarding(conn *ssh.Client, sock string) error {
+	channels := conn.HandleChannelOpen("auth-agent@openssh.com")
+	if channels == nil {
+		return errors.New("agent forwarding is already set up")
+	}
 
-	for {
-		reqCh := agentConnChan
-		freeCh := agentConnFreeChan
+	go func() {
+		for ch := range channels {
+			channel, reqs, err := ch.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
 
-		if freeConn <= 0 {
-			reqCh = nil
+			go func() {
+				defer channel.Close()
+				agentConn, err := dialAgent(sock)
+				if err != nil {
+					return
+				}
+				defer agentConn.Close()
+
+				for {
+					msg, err := readAgentMessage(channel)
+					if err != nil {
+						return
+					}
+					if _, err = agentConn.Write(msg); err != nil {
+						return
+					}
+					if msg, err = readAgentMessage(agentConn); err != nil {
+						return
+					}
+					if _, err = channel.Write(msg); err != nil {
+						return
+					}
+				}
+			}()
 		}
+	}()
+	return nil
+}
 
-		select {
-		case respChan := <-reqCh:
-			freeConn--
-			respChan <- true
-		case <-freeCh:
-			freeConn++
-		}
+// readAgentMessage reads ssh-agent protocol message with its length prefix
+func readAgentMessage(r io.Reader) ([]byte, error) {
+	msg := make([]byte, 4)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(msg)
+	if length > maxAgentMessageLen {
+		return nil, errors.New("agent message is too long")
 	}
+	msg = append(msg, make([]byte, length)...)
+	_, err := io.ReadFull(r, msg[4:])
+	return msg, err
 }
 
-func initialize(internalInput bool) {
-	var (
-		pubKey              string
-		maxAgentConnections uint64
-	)
+// connectHost establishes new connection to hostname, authentication methods that are used are recorded in usage
+func connectHost(hostname string, usage *authUsage) (conn *ssh.Client, err error) {
+	defer func() {
+		if msg := recover(); msg != nil {
+			err = errors.New("Panic: " + fmt.Sprint(msg))
+		}
+	}()
 
-	flag.StringVar(&pubKey, "i", "", "Optional path to public key to use")
-	flag.StringVar(&user, "l", os.Getenv("LOGNAME"), "Optional login name")
-	flag.Uint64Var(&maxAgentConnections, "c", maxOpensshAgentConnections, "Maximum simultaneous ssh-agent connections")
-	flag.BoolVar(&disconnectAfterUse, "d", false, "Disconnect after each action")
-	flag.Uint64Var(&maxConnections, "m", 0, "Maximum simultaneous connections")
-	flag.Parse()
+	connectLimiter.wait(1)
 
-	keys = []string{os.Getenv("HOME") + "/.ssh/id_rsa", os.Getenv("HOME") + "/.ssh/id_dsa", os.Getenv("HOME") + "/.ssh/id_ecdsa"}
+	opts := hostOptionsOf(hostname)
 
-	if pubKey != "" {
-		if strings.HasSuffix(pubKey, ".pub") {
-			pubKey = strings.TrimSuffix(pubKey, ".pub")
-		}
+	waitAgent()
+	conf, release := hostAuthConfig(hostname, usage)
+	defer release()
+	conf.Timeout = opts.connectTimeout
+	conf.HostKeyCallback = hostKeyCallback(hostname)
 
-		keys = append(keys, pubKey)
-	}
+	defer releaseAgent()
 
-	sshAuthSock = os.Getenv("SSH_AUTH_SOCK")
+	target, conf := inventoryTarget(hostname, conf)
 
-	if sshAuthSock != "" {
-		go agentConnectionManagerThread(maxAgentConnections)
-	}
+	logf(logInfo, hostname, "Connecting to %s", target)
+	sendHostEvent(&HostEvent{Event: "connect-start", Hostname: hostname, Target: target})
 
-	if !internalInput {
-		go inputDecoder()
-		go jsonReplierThread()
+	timing := &connectTiming{hostname: hostname, start: time.Now()}
+	conn, err = dialHostTimed(target, conf, timing)
+	if err != nil {
+		logf(logInfo, hostname, "Connection failed: %s", err)
+		metricConnections.add(1, hostname, "failed")
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			metricAuthFailures.add(1, hostname)
+		}
+		if isTransientConnError(err) {
+			err = &retryableError{err}
+		}
+		return
 	}
+	metricConnections.add(1, hostname, "ok")
+	recordConnectTiming(hostname, timing)
 
-	go maxThroughputThread()
+	logf(logInfo, hostname, "Connected")
+	return
+}
 
-	makeSigners()
+// uploadEntry is a single file or directory to be uploaded
+type uploadEntry struct {
+	relPath   string // slash-separated path relative to upload target, empty for the target itself
+	isDir     bool
+	mode      os.FileMode
+	modTime   time.Time
+	size      int64
+	localPath string // file that is streamed to every host, contents are used if it is empty
+	contents  []byte // contents sent in request ("Source": "-")
+
+	sumOnce sync.Once // SHA-256 is computed once for all hosts
+	sum     string
+	sumErr  error
+
+	deltaMu sync.Mutex            // guards deltas
+	deltas  map[string]*deltaPlan // deltas against signatures of remote files (-delta)
 }
 
-func jsonReplierThread() {
-	connectionReporting := true
+// open returns reader of entry contents; local file is opened separately for every host,
+// so memory usage does not depend on file size and number of hosts
+func (e *uploadEntry) open() (io.ReadCloser, error) {
+	if e.localPath == "" {
+		return ioutil.NopCloser(bytes.NewReader(e.contents)), nil
+	}
 
-	for {
-		reply := <-repliesChan
+	fp, err := os.Open(e.localPath)
+	if err != nil {
+		return nil, errors.New("Cannot read " + e.localPath + " contents: " + err.Error())
+	}
+	return fp, nil
+}
 
-		switch reply.(type) {
-		case DisableReportConnectedHosts:
-			connectionReporting = false
-			continue
+// uploadOptions are per-request upload settings
+type uploadOptions struct {
+	attrs          *sftpAttrs   // attributes overrides from "Mode" and "Owner"
+	preserve       bool         // preserve local permissions and modification times
+	progress       bool         // report TransferProgress
+	limiter        *rateLimiter // limit of total throughput of the request
+	hostThroughput uint64       // limit of throughput of each host
+	verify         bool         // compare checksums of uploaded files
+	skipUnchanged  bool         // skip files that have the same checksum on remote side
+	changeReport   bool         // examine targets before upload and report FileChange for each file
+	parallel       int          // sessions to upload large files over
+	resume         bool         // keep partial files of failed uploads and continue them
+	delta          bool         // upload only blocks that differ from existing target
+	compress       bool         // gzip contents and decompress them on remote side
+	sudo           bool         // install files with sudo through staging files
+	sudoPassword   string       // password that is sent to sudo
+	transfer       string       // backend of uploads, empty if it is not set in request (see transfer.go)
+	mirrorDelete   bool         // remove remote files that are not in uploaded directory (see mirror.go)
+	plan           bool         // only report changes that would be made (MirrorPlan)
+}
 
-		case EnableReportConnectedHosts:
-			connectionReporting = true
-			continue
+const progressInterval = time.Second // how often TransferProgress is sent
 
-		case *ConnectionProgress:
-			if !connectionReporting {
-				continue
-			}
-		}
+const (
+	uploadTmpSuffix = gossha.UploadTmpSuffix // suffix of temporary files that uploads are written to
+	dataSource      = "-"                    // upload source that means contents are sent in Data field of request
+)
 
-		buf, err := json.Marshal(reply)
-		if err != nil {
-			panic("Could not marshal json reply: " + err.Error())
-		}
+// transferProgress tracks bytes uploaded to a single host
+type transferProgress struct {
+	mu         sync.Mutex // ranges of parallel uploads are reported concurrently
+	hostname   string
+	sent       int64
+	total      int64
+	lastReport time.Time
+}
 
-		if buf[0] == '{' {
-			typeStr := strings.TrimPrefix(fmt.Sprintf("%T", reply), "*main.")
-			fmt.Printf("{\"Type\":\"%s\",%s}\n", typeStr, buf[1:len(buf)-1])
-		} else {
-			fmt.Println(string(buf))
-		}
+// add accounts n more bytes sent, progress is reported if it was not reported recently or transfer is complete
+func (p *transferProgress) add(n int) {
+	if p == nil {
+		return
 	}
-}
 
-func sendProxyReply(response interface{}) {
-	repliesChan <- response
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sent += int64(n)
+	if p.sent == p.total || time.Since(p.lastReport) >= progressInterval {
+		p.lastReport = time.Now()
+		sendProxyReply(&TransferProgress{Hostname: p.hostname, Bytes: p.sent, TotalBytes: p.total})
+	}
 }
 
-func maxThroughputThread() {
-	for {
-		throughput := atomic.LoadUint64(&maxThroughput)
+// readUploadSource lists source file or the whole directory tree, contents of files are
+// streamed from disk during upload
+func readUploadSource(source string) (entries []*uploadEntry, err error) {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return
+	}
+
+	if !fi.IsDir() {
+		entry := &uploadEntry{mode: fi.Mode(), modTime: fi.ModTime(), size: fi.Size(), localPath: source}
+		if err := checkReadable(entry); err != nil {
+			return nil, err
+		}
 
-		// how many chunks can be sent in specified time interval
-		chunks := throughput / chunkSize * throughputSleepInterval / 1000
+		return []*uploadEntry{entry}, nil
+	}
 
-		if chunks < minChunks {
-			chunks = minChunks
+	err = filepath.Walk(source, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
 
-		for i := uint64(0); i < chunks; i++ {
-			maxThroughputChan <- true
+		rel, err := filepath.Rel(source, name)
+		if err != nil {
+			return err
 		}
 
-		if throughput > 0 {
-			time.Sleep(throughputSleepInterval * time.Millisecond)
+		entry := &uploadEntry{mode: fi.Mode(), modTime: fi.ModTime(), isDir: fi.IsDir()}
+		if rel != "." {
+			entry.relPath = filepath.ToSlash(rel)
 		}
-	}
-}
 
-func getExecFunc(msg *ProxyRequest) func(string) *SshResult {
-	if msg.Action == "ssh" {
-		if msg.Cmd == "" {
-			reportCriticalErrorToUser("Empty 'Cmd'")
+		if !fi.IsDir() {
+			if !fi.Mode().IsRegular() {
+				reportErrorToUser("Skipping " + name + ": not a regular file")
+				return nil
+			}
+
+			entry.size, entry.localPath = fi.Size(), name
+			if err := checkReadable(entry); err != nil {
+				return err
+			}
+		}
+
+		entries = append(entries, entry)
+		return nil
+	})
+
+	return
+}
+
+// openRange returns reader of n bytes of entry contents starting from off
+func (e *uploadEntry) openRange(off, n int64) (io.ReadCloser, error) {
+	if e.localPath == "" {
+		return ioutil.NopCloser(bytes.NewReader(e.contents[off : off+n])), nil
+	}
+
+	fp, err := os.Open(e.localPath)
+	if err != nil {
+		return nil, errors.New("Cannot read " + e.localPath + " contents: " + err.Error())
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(fp, off, n), fp}, nil
+}
+
+// checkReadable makes sure that unreadable files are reported before connecting to hosts
+func checkReadable(entry *uploadEntry) error {
+	r, err := entry.open()
+	if err != nil {
+		return err
+	}
+	return r.Close()
+}
+
+// entryAttrs returns attributes that must be set on uploaded entry
+func (opts *uploadOptions) entryAttrs(entry *uploadEntry, isDirUpload bool) *sftpAttrs {
+	attrs := *opts.attrs
+
+	if (isDirUpload || opts.preserve) && (entry.isDir || attrs.Flags&sshFileXferAttrPermissions == 0) {
+		attrs.Flags |= sshFileXferAttrPermissions
+		attrs.Perm = uint32(entry.mode.Perm())
+	}
+
+	if opts.preserve {
+		attrs.Flags |= sshFileXferAttrACModTime
+		attrs.Atime = uint32(entry.modTime.Unix())
+		attrs.Mtime = uint32(entry.modTime.Unix())
+	}
+
+	return &attrs
+}
+
+// uploadFile uploads entries to target path; for directory uploads local permissions are
+// preserved unless they are overridden by "Mode". Unchanged is set if SkipUnchanged was requested
+// and all files were already up to date.
+func uploadFile(target string, entries []*uploadEntry, opts *uploadOptions, hostname string) (unchanged bool, changes []*FileChange, err error) {
+	// target can be rendered from a template, and names of uploaded files come from local directory
+	if err = checkRemotePath("Target", target); err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if err = checkRemotePath("Target", path.Join(target, entry.relPath)); err != nil {
+			return
+		}
+	}
+
+	conn, err := getConnection(hostname)
+	if err != nil {
+		return
+	}
+	defer connectedHosts.Release(hostname, conn)
+	defer func() { err = connLostError(conn, err) }()
+
+	t, err := openTransfer(conn, hostname, opts.transfer)
+	if err != nil {
+		return
+	}
+	defer t.Close()
+
+	isDirUpload := len(entries) > 0 && entries[0].isDir
+	if isDirUpload && opts.sudo {
+		err = errors.New("Directory " + target + " cannot be uploaded with sudo")
+		return
+	}
+	if err = checkTransferOptions(t, target, opts, isDirUpload); err != nil {
+		return
+	}
+	var client *sftpClient // only set for SFTP, other transfers do not support options that need it
+	if st, ok := t.(*sftpTransfer); ok {
+		client = st.client
+	}
+
+	var deleted []*FileChange
+	if opts.mirrorDelete {
+		var deletions []*mirrorDeletion
+		if deletions, err = mirrorExtraneous(client, target, entries); err != nil {
+			return
+		}
+		deleted, err = removeMirrorExtraneous(client, deletions, opts.plan)
+		changes = append(changes, deleted...)
+		if err != nil {
+			return
+		}
+	}
+
+	if dir := path.Dir(target); dir != "." && !opts.sudo && !opts.plan {
+		if err = t.mkdirAll(dir); err != nil {
+			err = errors.New("Cannot create " + dir + ": " + err.Error())
+			return
+		}
+	}
+
+	limiters := []*rateLimiter{globalUploadLimiter, opts.limiter, newRateLimiter(opts.hostThroughput)}
+
+	var progress *transferProgress
+	if opts.progress {
+		progress = &transferProgress{hostname: hostname, lastReport: time.Now()}
+		for _, entry := range entries {
+			progress.total += entry.size
+		}
+	}
+
+	var files, unchangedFiles int
+
+	for _, entry := range entries {
+		remotePath := path.Join(target, entry.relPath)
+
+		if entry.isDir {
+			if opts.plan {
+				continue
+			}
+			if err = t.mkdirAll(remotePath); err != nil {
+				err = errors.New("Cannot create " + remotePath + ": " + err.Error())
+				return
+			}
+			continue
+		}
+
+		attrs := opts.entryAttrs(entry, isDirUpload)
+		files++
+
+		var prev *FileState
+		if opts.changeReport && !(opts.plan && isMirrorDeleted(deleted, remotePath)) {
+			if prev, err = remoteFileState(conn, client, remotePath); err != nil {
+				return
+			}
+		}
+
+		if opts.skipUnchanged {
+			var same bool
+			if opts.changeReport {
+				same, err = prev.sameContents(entry)
+			} else {
+				same, err = remoteFileUnchanged(conn, client, remotePath, entry)
+			}
+			if err != nil {
+				return
+			}
+
+			if same {
+				// contents are the same, but requested attributes may still differ
+				if opts.sudo && attrs.Flags&(sshFileXferAttrUIDGID|sshFileXferAttrPermissions) != 0 {
+					if err = setRemoteAttrsSudo(conn, client, remotePath, attrs, opts); err != nil {
+						return
+					}
+				} else if attrs.Flags != 0 && !opts.sudo && !opts.plan {
+					if err = client.Setstat(remotePath, attrs); err != nil {
+						err = errors.New("Cannot set attributes of " + remotePath + ": " + err.Error())
+						return
+					}
+				}
+				progress.add(int(entry.size))
+				unchangedFiles++
+				if opts.changeReport {
+					changes = append(changes, newFileChange(remotePath, prev, prev.SHA256))
+				}
+				continue
+			}
+		}
+
+		if !opts.plan {
+			if err = t.writeFile(remotePath, entry, attrs, opts, progress, limiters); err != nil {
+				return
+			}
+		}
+		if opts.changeReport {
+			var sum string
+			if sum, err = entry.sha256(); err != nil {
+				return
+			}
+			change := newFileChange(remotePath, prev, sum)
+			change.Planned = opts.plan
+			changes = append(changes, change)
+		}
+	}
+
+	// directory attributes are set last (deepest first) because creating files inside
+	// a directory changes its mtime and restrictive permissions may prevent writing into it
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entry := entries[i]; entry.isDir && !opts.plan {
+			remotePath := path.Join(target, entry.relPath)
+			if err = client.Setstat(remotePath, opts.entryAttrs(entry, isDirUpload)); err != nil {
+				err = errors.New("Cannot set attributes of " + remotePath + ": " + err.Error())
+				return
+			}
+		}
+	}
+
+	return files > 0 && unchangedFiles == files && len(deleted) == 0, changes, nil
+}
+
+// expandUploadSources expands glob patterns in sources, every match is uploaded into target directory under its base name
+func expandUploadSources(sources []string, target string) (res []string, err error) {
+	targets := make(map[string]string)
+
+	for _, pattern := range sources {
+		if pattern == dataSource {
+			return nil, errors.New("'Data' cannot be uploaded as one of 'Sources'")
+		}
+
+		matches := []string{pattern}
+		if strings.ContainsAny(pattern, "*?[") {
+			if matches, err = filepath.Glob(pattern); err != nil {
+				return nil, errors.New("Invalid pattern " + pattern + ": " + err.Error())
+			}
+			if len(matches) == 0 {
+				return nil, errors.New("No files match " + pattern)
+			}
+		}
+
+		for _, source := range matches {
+			name := filepath.Base(source)
+			if other, ok := targets[name]; ok {
+				return nil, errors.New("Both " + other + " and " + source + " would be uploaded to " + path.Join(target, name))
+			}
+			targets[name] = source
+			res = append(res, source)
+		}
+	}
+
+	return res, nil
+}
+
+// uploadItem is one of several files of request and its target
+type uploadItem struct {
+	source, target string
+	opts           *uploadOptions
+}
+
+// sourceUploads returns items that upload every source into target directory under its base name
+func sourceUploads(target string, sourceFiles []string, opts *uploadOptions) []*uploadItem {
+	res := make([]*uploadItem, len(sourceFiles))
+	for i, source := range sourceFiles {
+		res[i] = &uploadItem{source: source, target: path.Join(target, filepath.Base(source)), opts: opts}
+	}
+	return res
+}
+
+// uploadFiles uploads every item, upload continues after failures of individual files, so that
+// result of each of them is reported
+func uploadFiles(items []*uploadItem, sources *uploadSourceCache, hostname string) *SshResult {
+	res := &SshResult{hostname: hostname, unchanged: true}
+	var failed int
+	var firstErr error
+
+	for _, item := range items {
+		source, fileTarget := item.source, item.target
+		entries, err := sources.read(source)
+
+		var unchanged bool
+		var changes []*FileChange
+		if err == nil {
+			unchanged, changes, err = uploadFile(fileTarget, entries, item.opts, hostname)
+		}
+		res.changes = append(res.changes, changes...)
+
+		// nothing can be uploaded if connection failed, so the whole action is retried
+		var retryable *retryableError
+		if errors.As(err, &retryable) {
+			return &SshResult{hostname: hostname, err: err}
+		}
+
+		file := &FileResult{Source: source, Target: fileTarget, Success: err == nil, Unchanged: unchanged}
+		if err != nil {
+			file.ErrMsg = err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+		}
+		res.unchanged = res.unchanged && unchanged
+		res.files = append(res.files, file)
+	}
+
+	if failed > 0 {
+		res.unchanged = false
+		res.err = fmt.Errorf("Cannot upload %d of %d files: %s", failed, len(items), firstErr)
+	}
+
+	return res
+}
+
+// uploadRemoteFile writes (and verifies) contents of entry to target; unless -inplace is specified,
+// contents are written to temporary file that replaces target only after successful transfer
+func uploadRemoteFile(conn *ssh.Client, client *sftpClient, target string, entry *uploadEntry, attrs *sftpAttrs, opts *uploadOptions, progress *transferProgress, limiters []*rateLimiter) (err error) {
+	tmpPath := target
+	if !inplaceUploads {
+		tmpPath = target + uploadTmpSuffix
+		defer func() {
+			// partial file is kept for the next attempt to continue from
+			if err != nil && !opts.resume {
+				client.Remove(tmpPath)
+			}
+		}()
+	}
+
+	var offset int64
+	if opts.resume {
+		if offset, err = resumeOffset(conn, client, tmpPath, entry); err != nil {
+			return
+		}
+	}
+
+	verify := opts.verify
+	if offset > 0 {
+		err = resumeRemoteFile(client, tmpPath, entry, offset, attrs, progress, limiters)
+	} else if old := deltaBase(client, target); opts.delta && tmpPath != target && entry.size >= deltaMinSize && old != nil {
+		// assembled file is always verified, whole file is uploaded if anything fails
+		verify = false
+		if err = writeRemoteFileDelta(conn, client, old, target, tmpPath, entry, attrs, progress, limiters); err != nil {
+			logf(logInfo, "", "Uploading whole %s to %s: %s", target, conn.RemoteAddr(), err)
+			err = writeRemoteFile(client, tmpPath, entry, attrs, progress, limiters)
+			verify = opts.verify
+		}
+	} else if opts.parallel > 1 && entry.size >= parallelUploadMinSize {
+		// ranges are written independently, so the whole file is checked
+		verify = true
+		err = writeRemoteFileParallel(conn, client, tmpPath, entry, attrs, opts.parallel, progress, limiters)
+	} else if opts.compress && entry.size >= compressMinSize {
+		if err = writeRemoteFileCompressed(conn, client, tmpPath, entry, attrs, progress, limiters); err == errNoGzip {
+			logf(logInfo, "", "Uploading %s to %s uncompressed: %s", target, conn.RemoteAddr(), err)
+			err = writeRemoteFile(client, tmpPath, entry, attrs, progress, limiters)
+		}
+	} else {
+		err = writeRemoteFile(client, tmpPath, entry, attrs, progress, limiters)
+	}
+	if err != nil {
+		return
+	}
+
+	if verify {
+		var expected string
+		if expected, err = entry.sha256(); err != nil {
+			return
+		}
+		if err = verifyRemoteFile(conn, client, tmpPath, expected); err != nil {
+			return
+		}
+	}
+
+	if tmpPath != target {
+		if err = client.Replace(tmpPath, target); err != nil {
+			return errors.New("Cannot rename " + tmpPath + " to " + target + ": " + err.Error())
+		}
+	}
+
+	return
+}
+
+// writeRemoteFile creates remote file with contents of entry that are read chunk by chunk
+func writeRemoteFile(client *sftpClient, target string, entry *uploadEntry, attrs *sftpAttrs, progress *transferProgress, limiters []*rateLimiter) (err error) {
+	r, err := entry.open()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	fp, err := client.Create(target, attrs)
+	if err != nil {
+		return errors.New("Cannot create " + target + ": " + err.Error())
+	}
+
+	written, err := copyChunks(fp, r, entry, progress, limiters)
+	if err != nil {
+		fp.Close()
+		return
+	}
+
+	if written != entry.size {
+		fp.Close()
+		return fmt.Errorf("Size of %s changed during upload: expected %d bytes, read %d", entry.localPath, entry.size, written)
+	}
+
+	// permissions in SSH_FXP_OPEN are only applied to newly created files (and are subject to umask)
+	if attrs.Flags != 0 {
+		if err = fp.Setstat(attrs); err != nil {
+			fp.Close()
+			return errors.New("Cannot set attributes of " + target + ": " + err.Error())
+		}
+	}
+
+	return fp.Close()
+}
+
+// parseUploadOptions converts upload-related request fields to uploadOptions
+func parseUploadOptions(msg *ProxyRequest) (opts *uploadOptions, err error) {
+	attrs := &sftpAttrs{}
+	opts = &uploadOptions{
+		attrs:          attrs,
+		preserve:       msg.Preserve,
+		progress:       msg.Progress,
+		limiter:        newRateLimiter(msg.MaxThroughput),
+		hostThroughput: msg.MaxHostThroughput,
+		verify:         msg.Verify,
+		skipUnchanged:  msg.SkipUnchanged || msg.Mirror,
+		changeReport:   msg.ChangeReport || msg.Mirror,
+		parallel:       int(msg.Parallel),
+		resume:         msg.Resume || resumeUploads,
+		delta:          msg.Delta || deltaUploads,
+		compress:       msg.Compress || compressUploads,
+		sudo:           msg.Sudo,
+		sudoPassword:   msg.SudoPassword,
+		transfer:       msg.Transfer,
+		mirrorDelete:   msg.MirrorDelete,
+		plan:           msg.MirrorPlan,
+	}
+
+	if msg.Transfer != "" {
+		if err = checkTransfer(msg.Transfer); err != nil {
+			return nil, errors.New("Invalid 'Transfer': " + err.Error())
+		}
+	}
+
+	if msg.SudoPassword != "" && !msg.Sudo {
+		return nil, errors.New("'SudoPassword' is specified without 'Sudo'")
+	}
+	if opts.sudo && opts.sudoPassword == "" {
+		opts.sudoPassword = sudoPasswordDefault
+	}
+
+	if msg.Parallel > maxParallelUploads {
+		return nil, fmt.Errorf("Invalid 'Parallel': at most %d sessions per host are supported", maxParallelUploads)
+	}
+
+	if err = setUploadAttrs(attrs, msg.Mode, msg.Owner); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// setUploadAttrs sets permissions and owner of attrs from octal mode and numeric "<uid>:<gid>" owner, empty ones are not set
+func setUploadAttrs(attrs *sftpAttrs, mode, owner string) error {
+	if mode != "" {
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || perm > 07777 {
+			return errors.New("Invalid 'Mode': " + mode)
+		}
+
+		attrs.Flags |= sshFileXferAttrPermissions
+		attrs.Perm = uint32(perm)
+	}
+
+	if owner != "" {
+		parts := strings.SplitN(owner, ":", 2)
+		if len(parts) != 2 {
+			return errors.New("Invalid 'Owner', expected numeric <uid>:<gid>: " + owner)
+		}
+
+		uid, uidErr := strconv.ParseUint(parts[0], 10, 32)
+		gid, gidErr := strconv.ParseUint(parts[1], 10, 32)
+		if uidErr != nil || gidErr != nil {
+			return errors.New("Invalid 'Owner', expected numeric <uid>:<gid>: " + owner)
+		}
+
+		attrs.Flags |= sshFileXferAttrUIDGID
+		attrs.UID = uint32(uid)
+		attrs.GID = uint32(gid)
+	}
+
+	return nil
+}
+
+// downloadFile fetches remote source file and saves it as <localDir>/<hostname>/<basename of source>
+func downloadFile(source, localDir, hostname string) (stdout, stderr string, err error) {
+	conn, err := getConnection(hostname)
+	if err != nil {
+		return
+	}
+	defer connectedHosts.Release(hostname, conn)
+	defer func() { err = connLostError(conn, err) }()
+
+	client, err := newSftpClient(conn)
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	fp, err := client.Open(source)
+	if err != nil {
+		err = errors.New("Cannot open " + source + ": " + err.Error())
+		return
+	}
+	defer fp.Close()
+
+	dirName, fileName := downloadDirName(hostname), path.Base(source)
+	for _, name := range []string{dirName, fileName} {
+		if !isSafeLocalName(name) {
+			err = errors.New("Refusing to write downloaded file to unsafe local path " + filepath.Join(dirName, fileName))
+			return
+		}
+	}
+
+	dir := filepath.Join(localDir, dirName)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	localPath := filepath.Join(dir, fileName)
+	localFp, err := os.Create(localPath)
+	if err != nil {
+		return
+	}
+
+	_, err = io.Copy(localFp, fp)
+	if closeErr := localFp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(localPath)
+	}
+
+	return
+}
+
+// downloadDirName returns name of local directory for files downloaded from hostname: "<host>" or "<host>_<port>" for non-standard port
+func downloadDirName(hostname string) string {
+	host, port := splitHostPort(hostname)
+	if port != "22" {
+		return host + "_" + port
+	}
+	return host
+}
+
+// isSafeLocalName checks that name refers to an entry inside of a directory and not e.g. to its parent
+func isSafeLocalName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`+string(os.PathSeparator))
+}
+
+// cmdOptions are per-request settings of command execution
+type cmdOptions struct {
+	stdin         []byte // sent to every host
+	env           map[string]string
+	pty           bool
+	sudo          bool
+	sudoPassword  string
+	runAs         string // user to run command as with runAsMethod
+	runAsMethod   string
+	session       *sessionConfig  // session which setup commands are run before command
+	stream        bool            // send OutputChunk as output is produced
+	streamOnly    bool            // with stream: do not keep output for Reply (-P)
+	shell         string          // command line of shell to pass command to, e.g. "/bin/bash -c"
+	noShell       bool            // split command into words and execute it directly
+	chdir         string          // remote directory to change to before running command
+	remoteTimeout time.Duration   // terminate command on remote host after that, see requestRemoteTimeout
+	encoding      string          // "RemoteEncoding" of request, see newOutputDecoder
+	stripANSI     bool            // remove escape sequences from output
+	maxOutput     uint64          // keep at most that many bytes of stdout and stderr of every command, 0 means no limit
+	output        *outputLimit    // limit of output of the current run on host (see forHost)
+	filter        *regexp.Regexp  // keep only matching lines of stdout, see requestFilter
+	filterPattern string          // source of filter
+	filterRemote  bool            // filter stdout with grep on remote side
+	matches       *int64          // number of lines that passed filter in the current run on host
+	cmdTimeouts   []time.Duration // remote timeouts of Cmds, see forCommand
+	record        *runRecording
+	runEnv        *runEnv        // exported to commands, nil if it is not
+	summaryOnly   bool           // count output instead of keeping it, see requestSummary
+	summaryLines  int            // with summaryOnly: number of first and last lines to keep
+	summary       *outputSummary // summary of output of the current run on host
+}
+
+// quoting and validation of remote paths are shared with the gossha package, so that embedding
+// programs get the same safeguards as requests to the proxy
+var (
+	shellQuote      = gossha.ShellQuote
+	checkRemotePath = gossha.CheckRemotePath
+)
+
+// sudoCommand wraps cmd so that it is executed by sudo as user (root if it is empty); if password
+// is needed, auth sends it to stdin when sudo asks for it (see sudoauth.go)
+func sudoCommand(cmd string, user string, auth *sudoAuth) string {
+	flags := "-n"
+	if auth != nil {
+		flags, cmd = auth.sudoFlags(), auth.wrap(cmd)
+	}
+	if user != "" {
+		flags += " -u " + shellQuote(user)
+	}
+	return "sudo " + flags + " -- /bin/sh -c " + shellQuote(cmd)
+}
+
+func parseCmdOptions(msg *ProxyRequest) (opts *cmdOptions, err error) {
+	opts = &cmdOptions{env: msg.Env, pty: msg.Pty, sudo: msg.Sudo, sudoPassword: msg.SudoPassword, stream: msg.Stream || prefixOutput || eventsOutput, streamOnly: prefixOutput}
+
+	if opts.runAs, opts.runAsMethod, err = requestRunAs(msg); err != nil {
+		return nil, err
+	}
+
+	if opts.session, err = requestSession(msg); err != nil {
+		return nil, err
+	}
+
+	if msg.SudoPassword != "" && !msg.Sudo && opts.runAs == "" {
+		return nil, errors.New("'SudoPassword' is specified without 'Sudo' or 'RunAs'")
+	}
+
+	if opts.sudo || opts.runAs != "" && opts.runAsMethod == "sudo" {
+		if opts.sudoPassword == "" {
+			opts.sudoPassword = sudoPasswordDefault
+		}
+	} else if msg.SudoPassword != "" {
+		return nil, errors.New("'SudoPassword' cannot be used with su without 'Sudo': su reads password from terminal")
+	}
+
+	if msg.Stdin != "" && msg.StdinFile != "" {
+		return nil, errors.New("Only one of 'Stdin' and 'StdinFile' can be specified")
+	}
+
+	if msg.Shell != "" && msg.NoShell {
+		return nil, errors.New("Only one of 'Shell' and 'NoShell' can be specified")
+	}
+	opts.shell, opts.noShell = requestShell(msg)
+	opts.runEnv = newRunEnv(msg)
+	if opts.noShell && opts.session != nil {
+		return nil, errors.New("Sessions cannot be used with NoShell")
+	}
+
+	if msg.RemoteEncoding != "" {
+		if err = checkEncoding(msg.RemoteEncoding); err != nil {
+			return nil, err
+		}
+	}
+	opts.encoding, opts.stripANSI = msg.RemoteEncoding, msg.StripANSI
+	opts.remoteTimeout = requestRemoteTimeout(msg)
+
+	if opts.maxOutput = msg.MaxOutputBytes; opts.maxOutput == 0 {
+		opts.maxOutput = maxOutputBytes
+	}
+
+	if msg.Stdin != "" {
+		opts.stdin = []byte(msg.Stdin)
+	} else if msg.StdinFile != "" {
+		if opts.stdin, err = ioutil.ReadFile(msg.StdinFile); err != nil {
+			return nil, errors.New("Cannot read 'StdinFile': " + err.Error())
+		}
+	}
+
+	return
+}
+
+// forHost returns copy of opts for a single run on host, so that truncation of its output is tracked separately
+func (opts *cmdOptions) forHost() *cmdOptions {
+	res := *opts
+	res.output = newOutputLimit(opts.maxOutput)
+	if opts.summaryOnly {
+		res.summary = newOutputSummary(opts.summaryLines)
+	}
+	if opts.filter != nil {
+		res.matches = new(int64)
+	}
+	return &res
+}
+
+func executeCmd(cmd string, opts *cmdOptions, hostname string) (stdout, stderr string, err error) {
+	conn, err := getConnection(hostname)
+	if err != nil {
+		return
+	}
+	defer connectedHosts.Release(hostname, conn)
+
+	return runCmd(conn, hostname, cmd, opts)
+}
+
+// executeCmds runs commands one after another over the same connection until one of them fails;
+// stdout and stderr of the result are concatenated outputs of all executed commands
+func executeCmds(cmds []string, opts *cmdOptions, hostname string) *SshResult {
+	res := &SshResult{hostname: hostname}
+
+	conn, err := getConnection(hostname)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	defer connectedHosts.Release(hostname, conn)
+
+	for i, cmd := range cmds {
+		stdout, stderr, err := runCmd(conn, hostname, cmd, opts.forCommand(i))
+
+		// commands that were already executed must not be run again by retries
+		var retryable *retryableError
+		if i > 0 && errors.As(err, &retryable) {
+			err = retryable.err
+		}
+
+		cmdRes := &CommandResult{Cmd: cmd, Stdout: stdout, Stderr: stderr, Success: err == nil, ExitCode: exitCode(err)}
+		if err != nil {
+			cmdRes.ErrMsg, cmdRes.ErrorKind = err.Error(), errorKind(err, "ssh")
+		}
+
+		res.commands = append(res.commands, cmdRes)
+		res.stdout += stdout
+		res.stderr += stderr
+		res.err = err
+
+		if err != nil {
+			break
+		}
+	}
+
+	return res
+}
+
+// runCmd executes cmd in a new session over already established connection, hostname is used to tag streamed output
+func runCmd(conn *ssh.Client, hostname, cmd string, opts *cmdOptions) (stdout, stderr string, err error) {
+	origCmd := cmd
+	session, err := conn.NewSession()
+	if err != nil {
+		err = &retryableError{err}
+		return
+	}
+	defer session.Close()
+
+	metricActiveSessions.add(1)
+	defer metricActiveSessions.add(-1)
+
+	stdoutBuf := &outputBuffer{limit: opts.output}
+	stderrBuf := &outputBuffer{limit: opts.output}
+	var stdoutW, stderrW io.Writer = stdoutBuf, stderrBuf
+	if opts.summary != nil {
+		stdoutW, stderrW = opts.summary.stdout, opts.summary.stderr
+	}
+	session.Stdout = stdoutW
+	session.Stderr = stderrW
+
+	decoder := newOutputDecoder(opts, hostname)
+
+	if opts.stream {
+		stdoutStream := &outputStreamer{hostname: hostname, stream: "stdout", decoder: decoder, conv: decoder.newStreamConverter()}
+		stderrStream := &outputStreamer{hostname: hostname, stream: "stderr", decoder: decoder, conv: decoder.newStreamConverter()}
+		defer stdoutStream.Flush()
+		defer stderrStream.Flush()
+		session.Stdout = io.MultiWriter(stdoutW, stdoutStream)
+		session.Stderr = io.MultiWriter(stderrW, stderrStream)
+		if opts.streamOnly {
+			session.Stdout, session.Stderr = stdoutStream, stderrStream
+		}
+	}
+
+	var filter *lineFilter
+	if opts.filter != nil {
+		filter = &lineFilter{re: opts.filter, w: session.Stdout, matches: opts.matches}
+		if opts.filterRemote {
+			filter.re = nil // only counted
+		}
+		session.Stdout = filter
+	}
+
+	if opts.record != nil {
+		rec, recErr := opts.record.open(hostname, cmd)
+		if recErr != nil {
+			err = recErr
+			return
+		}
+		defer func() {
+			if recErr := rec.finish(err); recErr != nil {
+				reportErrorToUser("Cannot write recording of " + hostname + ": " + recErr.Error())
+			}
+		}()
+		session.Stdout = io.MultiWriter(session.Stdout, rec.writer("o"))
+		session.Stderr = io.MultiWriter(session.Stderr, rec.writer("e"))
+	}
+
+	envNames := make([]string, 0, len(opts.env))
+	for name := range opts.env {
+		envNames = append(envNames, name)
+	}
+	sort.Strings(envNames)
+
+	for _, name := range envNames {
+		if err = session.Setenv(name, opts.env[name]); err != nil {
+			err = errors.New("Cannot set environment variable " + name + " (check AcceptEnv of remote sshd): " + err.Error())
+			return
+		}
+	}
+
+	if agentForwardSock != "" {
+		if err = agent.RequestAgentForwarding(session); err != nil {
+			err = errors.New("Cannot request agent forwarding: " + err.Error())
+			return
+		}
+	}
+
+	if x11 != nil {
+		if err = requestX11Forwarding(session); err != nil {
+			err = errors.New("Cannot request X11 forwarding: " + err.Error())
+			return
+		}
+	}
+
+	if opts.pty {
+		// disable echo, so that data sent to stdin (e.g. sudo password) does not appear in output
+		modes := ssh.TerminalModes{ssh.ECHO: 0, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+		if err = session.RequestPty("xterm", ptyHeight, ptyWidth, modes); err != nil {
+			err = errors.New("Cannot allocate pty: " + err.Error())
+			return
+		}
+	}
+
+	if cmd, err = shellCommand(opts.session.wrap(cmd), opts); err != nil {
+		return
+	}
+	if opts.runEnv != nil {
+		cmd = opts.runEnv.wrap(cmd, hostname)
+	}
+
+	var auth *sudoAuth
+	if opts.sudo || opts.runAs != "" {
+		auth = newSudoAuth(opts.sudoPassword)
+		defer auth.finish()
+		cmd = runAsCommand(cmd, opts, auth)
+	}
+
+	if opts.filterRemote {
+		cmd = remoteFilterCommand(cmd, opts.filterPattern)
+	}
+
+	remoteTimeout := remoteTimeoutOf(opts, hostname)
+	if remoteTimeout > 0 {
+		cmd = remoteTimeoutCommand(cmd, remoteTimeout)
+	}
+
+	session.Stdout, session.Stderr = auth.filter(session.Stdout), auth.filter(session.Stderr)
+	if err = auth.start(session, opts.stdin); err != nil {
+		return
+	}
+
+	if commandsInterrupted() {
+		err = errors.New("Action was interrupted before command was started")
+		return
+	}
+	if err = session.Start(cmd); err != nil {
+		err = checkDisconnected(conn, hostname, connLostError(conn, err))
+		return
+	}
+	trackCommand(session, hostname)
+	defer untrackCommand(session)
+	sendHostEvent(&HostEvent{Event: "exec-start", Hostname: hostname, Cmd: origCmd})
+	err = checkRemoteTimeout(checkDisconnected(conn, hostname, connLostError(conn, session.Wait())), remoteTimeout)
+	auth.finish()
+	if filter != nil {
+		filter.Flush()
+	}
+
+	stdout = decoder.decode(stdoutBuf.String())
+	stderr = decoder.decode(stderrBuf.String())
+
+	return
+}
+
+// do not allow more than maxConn simultaneous ssh-agent connections
+func agentConnectionManagerThread(maxConn uint64) {
+	freeConn := maxConn // free connections count
+
+	for {
+		reqCh := agentConnChan
+		freeCh := agentConnFreeChan
+
+		if freeConn <= 0 {
+			reqCh = nil
+		}
+
+		select {
+		case respChan := <-reqCh:
+			freeConn--
+			respChan <- true
+		case <-freeCh:
+			freeConn++
+		}
+	}
+}
+
+func initialize(internalInput bool) {
+	var (
+		pubKey              string
+		maxAgentConnections uint64
+		jumpHostsList       string
+		proxySpec           string
+		inventoryFile       string
+		replHosts           string
+		certList            string
+		verboseFlag         bool
+		debugFlag           bool
+		configFile          string
+		bwLimit             string
+		ipv4Only            bool
+		cipherList          string
+		kexList             string
+		macList             string
+		hostKeyAlgList      string
+		ipv6Only            bool
+		connectRate         uint64
+		tuiErr              error
+	)
+
+	flag.StringVar(&pubKey, "i", "", "Optional path to public key to use")
+	flag.StringVar(&user, "l", defaultLoginName(), "Optional login name")
+	flag.Uint64Var(&maxAgentConnections, "c", maxOpensshAgentConnections, "Maximum simultaneous ssh-agent connections")
+	flag.BoolVar(&disconnectAfterUse, "d", false, "Disconnect after each action")
+	flag.Uint64Var(&maxConnections, "m", 0, "Maximum simultaneous connections")
+	flag.StringVar(&jumpHostsList, "J", "", "Optional comma-separated list of jump hosts ([user@]host[:port]) to connect through")
+	flag.Uint64Var(&jumpConnections, "jump-connections", 4, "Tunnel targets over at most that many shared connections to jump hosts, 0 connects to jump hosts for every target")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0, "Close connections that were not used for specified time (e.g. 10m), default is to keep them open")
+	flag.BoolVar(&ipv4Only, "4", false, "Connect to hosts using IPv4 addresses only")
+	flag.BoolVar(&ipv6Only, "6", false, "Connect to hosts using IPv6 addresses only")
+	flag.StringVar(&cipherList, "ciphers", "", "Optional comma-separated list of allowed ciphers in order of preference")
+	flag.StringVar(&kexList, "kex", "", "Optional comma-separated list of allowed key exchange algorithms in order of preference")
+	flag.StringVar(&macList, "macs", "", "Optional comma-separated list of allowed MAC algorithms in order of preference")
+	flag.StringVar(&hostKeyAlgList, "hostkey-algorithms", "", "Optional comma-separated list of allowed host key algorithms in order of preference")
+	flag.StringVar(&proxySpec, "proxy", "", "Optional SOCKS5 or HTTP CONNECT proxy (socks5://[user:pass@]host:port, socks5h://..., http://...), default is taken from ALL_PROXY or HTTPS_PROXY")
+	flag.StringVar(&inventoryFile, "inventory", "", "Optional path to Ansible-style inventory (INI or YAML) with host groups")
+	flag.StringVar(&certList, "cert", "", "Optional comma-separated list of OpenSSH certificates for private keys (<key>-cert.pub files are used automatically)")
+	flag.DurationVar(&keepAliveInterval, "keepalive", defaultKeepAliveInterval, "Interval between keepalive requests, 0 disables them")
+	flag.IntVar(&keepAliveCount, "keepalive-count", defaultKeepAliveCount, "Number of unanswered keepalive requests after which connection is considered lost")
+	flag.BoolVar(&verboseFlag, "v", false, "Log connections and results of actions to stderr")
+	flag.BoolVar(&debugFlag, "vv", false, "Log ssh handshake details, host keys and retries to stderr in addition to -v messages")
+	flag.BoolVar(&quiet, "q", false, "Do not report connected hosts")
+	flag.StringVar(&bwLimit, "bwlimit", "", "Limit of total upload throughput in bytes per second (K, M and G suffixes are allowed), default is no limit")
+	flag.Uint64Var(&connectRate, "connect-rate", 0, "Maximum new connections per second (regardless of -m), default is no limit")
+	flag.Uint64Var(&canaryDefault, "canary", 0, "Run every request on that many random hosts first and ask for confirmation (ConfirmationRequest) before running it on the rest (same as \"Canary\": N in every request)")
+	flag.BoolVar(&failFastDefault, "fail-fast", false, "Cancel action on all hosts after first failure (same as \"FailFast\": true in every request)")
+	flag.BoolVar(&timingDefault, "timing", false, "Report time of connection stages and action for every host and percentiles of them (same as \"Timing\": true in every request)")
+	flag.StringVar(&notifyURL, "notify", "", "Optional webhook URL (e.g. Slack incoming webhook) to POST summary of every finished run to")
+	flag.Float64Var(&notifyFailPercentage, "notify-failures", 0, "With -notify: only send summary if more than this percentage of hosts failed")
+	flag.StringVar(&shipSpec, "ship", "", "Optional collector to send results of hosts with their output and summaries of runs to: syslog://host[:port], syslog+tcp://host[:port], fluent://host[:port][/tag] or http(s) URL")
+	flag.StringVar(&hookBeforeRun, "hook-before-run", "", "Optional local command to run before every run (GOSSHA_ACTION and HOST_COUNT are set), run is cancelled if it fails")
+	flag.StringVar(&hookAfterRun, "hook-after-run", "", "Optional local command to run after every run (EXIT_CODE, FAILED_COUNT and DURATION are also set)")
+	flag.StringVar(&hookBeforeHost, "hook-before-host", "", "Optional local command to run before action on every host (HOST is set), host fails without running action if it fails")
+	flag.StringVar(&hookAfterHost, "hook-after-host", "", "Optional local command to run after action on every host (HOST, EXIT_CODE, ERROR and DURATION are set)")
+	flag.DurationVar(&hookTimeout, "hook-timeout", defaultHookTimeout, "Maximum time of every hook command")
+	flag.StringVar(&pipeResultsCmd, "pipe-results", "", "Optional local command to write every Reply to as JSON on stdin as hosts finish (HOST, GOSSHA_ACTION and GOSSHA_RUN_ID are set)")
+	flag.StringVar(&expectDefault, "expect", "", "Fail hosts which output does not contain this string (or match re:<regexp>) and summarize compliance (same as \"Expect\" in every request)")
+	flag.StringVar(&diffDefault, "diff", "", "Compare output of every host with output of this host or local file:<path> (same as \"Diff\" in every request)")
+	flag.BoolVar(&rerunOnDisconnect, "rerun-on-disconnect", false, "Run action again if connection is lost while it is running, only for idempotent commands (same as \"RerunOnDisconnect\": true in every request)")
+	flag.StringVar(&shellDefault, "shell", "", "Optional shell command line (e.g. \"/bin/bash -c\") to pass commands to instead of login shell of user (same as \"Shell\" in every request)")
+	flag.BoolVar(&noShellDefault, "no-shell", false, "Split commands into words locally and execute them without shell (same as \"NoShell\": true in every request)")
+	flag.StringVar(&chdirDefault, "chdir", "", "Optional remote directory to run commands and scripts in, e.g. /srv/app (same as \"Chdir\" in every request)")
+	flag.StringVar(&maxOutputSpec, "max-output-bytes", "", "Keep at most that many bytes (K, M and G suffixes are allowed) of stdout and stderr of every command and drop the rest (same as \"MaxOutputBytes\" in every request), default is no limit")
+	flag.BoolVar(&summaryOnlyDefault, "summary-only", false, "Report only exit status and sizes of output of commands instead of output (same as \"SummaryOnly\": true in every request)")
+	flag.Uint64Var(&summaryLinesDefault, "summary-lines", 0, "With -summary-only: keep that many first and last lines of output of every host")
+	flag.StringVar(&discoverDefault, "discover", "", "Host source (e.g. mdns:// or consul://web) to discover hosts of requests without Hosts, Groups, Discover and Stages from, hosts can be omitted in subcommands then")
+	flag.BoolVar(&k8sNodes, "k8s-nodes", false, "Run requests without hosts on nodes of Kubernetes cluster (like -discover k8s:nodes)")
+	flag.StringVar(&k8sSelector, "k8s-selector", "", "With -k8s-nodes: label selector of nodes, e.g. node-role.kubernetes.io/worker or zone=eu-1a")
+	flag.StringVar(&k8sKubeconfig, "kubeconfig", "", "With -k8s-nodes: kubeconfig file, default is the first file of KUBECONFIG or ~/.kube/config")
+	flag.DurationVar(&probeDefault, "probe", 0, "Probe SSH ports of all hosts in parallel with this timeout (e.g. 500ms) before every run and fail hosts that do not accept connections without waiting for connection timeout (same as \"Probe\" in every request)")
+	flag.Var(resolveFlag, "resolve", "Connect to host at address instead of resolving its name (host=address, can be repeated or comma-separated)")
+	flag.StringVar(&hostsFile, "hosts-file", "", "Optional file in /etc/hosts format with addresses of hosts that are used instead of resolving their names")
+	flag.StringVar(&dnsServer, "dns", "", "Optional DNS server (address[:port]) to resolve names of hosts with instead of the system resolver")
+	flag.BoolVar(&preResolveDefault, "pre-resolve", false, "Resolve names of all hosts in parallel before every run and fail hosts which names do not exist without connecting (same as \"PreResolve\": true in every request)")
+	flag.StringVar(&sessionDefault, "session", "", "Optional name of session from \"sessions\" section of config to run commands and scripts in (same as \"Session\" in every request)")
+	flag.StringVar(&remoteEncodingDefault, "remote-encoding", "", "Optional encoding of output of commands on hosts, e.g. latin1, cp1252 or GBK, output is converted to UTF-8 (same as \"RemoteEncoding\" in every request)")
+	flag.BoolVar(&stripANSIDefault, "strip-ansi", false, "Remove ANSI escape sequences from output of commands (same as \"StripANSI\" in every request)")
+	flag.StringVar(&filterDefault, "filter", "", "Keep only lines of stdout of commands that match regular expression and report their number (same as \"Filter\" in every request)")
+	flag.BoolVar(&filterRemoteDefault, "filter-remote", false, "Apply -filter with grep -E on remote hosts, so that other output is not transferred (same as \"FilterRemote\": true in every request)")
+	flag.StringVar(&thenDefault, "then", "", "Optional command to run on every host where command or script succeeds (same as \"Then\" in every request)")
+	flag.StringVar(&onFailDefault, "on-fail", "", "Optional command to run on every host where command or script exits with non-zero status (same as \"OnFail\" in every request)")
+	flag.StringVar(&snapshotDefault, "snapshot", "", "Capture commands separated by ';' which output is recorded on every host before and after action (same as \"Snapshot\" in every request)")
+	flag.StringVar(&snapshotDirDefault, "snapshot-dir", defaultSnapshotDir, "Local directory for snapshots taken with -snapshot")
+	flag.DurationVar(&splayDefault, "splay", 0, "Start action on every host after random delay within this window (e.g. 30s), so that runs on many hosts do not hit shared backends at once (same as \"Splay\" in every request)")
+	flag.StringVar(&onlyIfDefault, "only-if", "", "Optional command to run on every host before action, hosts where it fails are skipped (same as \"OnlyIf\" in every request)")
+	flag.StringVar(&excludeList, "exclude", "", "Optional comma-separated list of hosts, patterns (web[1-3], db*) or inventory groups (@maintenance) to leave out of every request")
+	flag.StringVar(&limitSpec, "limit", "", "Only run requests on hosts which names match this regular expression")
+	flag.StringVar(&runAsDefault, "run-as", "", "Run commands and scripts as this user with sudo -u (or su, see -run-as-method) after logging in as usual (same as \"RunAs\" in every request)")
+	flag.StringVar(&runAsMethodDefault, "run-as-method", "sudo", "How commands are run as -run-as user: sudo (sudo -u <user>) or su (su - <user> -c) (same as \"RunAsMethod\" in every request)")
+	flag.StringVar(&sudoPasswordSource, "sudo-password", "", "Password for sudo of requests without SudoPassword: env:NAME, file:PATH or prompt (asked at startup as PasswordRequest)")
+	flag.Uint64Var(&guardHosts, "guard-hosts", 0, "Ask for confirmation (ConfirmationRequest) before running actions on more than that many hosts, default is not to ask")
+	flag.BoolVar(&guardCommands, "guard", false, "Ask for confirmation (ConfirmationRequest) before running commands that match dangerous patterns (rm -rf, shutdown, mkfs, ...)")
+	flag.BoolVar(&assumeYes, "yes", false, "Do not ask for confirmations of -guard and -guard-hosts (same as \"Confirm\": true in every request)")
+	flag.BoolVar(&noRunEnvDefault, "no-run-env", false, "Do not export GOSSHA_HOST, GOSSHA_HOST_INDEX, GOSSHA_RUN_ID and tags of hosts to commands (same as \"NoRunEnv\": true in every request)")
+	flag.BoolVar(&noCacheDefault, "no-cache", false, "Run commands even if their results are cached by requests with CacheTTL (same as \"NoCache\": true in every request)")
+	flag.BoolVar(&inplaceUploads, "inplace", false, "Write uploaded files directly to target instead of uploading to <target>"+uploadTmpSuffix+" and renaming it")
+	flag.BoolVar(&resumeUploads, "resume", false, "Keep partial files of failed uploads and continue them on the next upload (same as \"Resume\": true in every request)")
+	flag.BoolVar(&deltaUploads, "delta", false, "Only upload blocks of files that differ from existing targets, like rsync (same as \"Delta\": true in every request)")
+	flag.Uint64Var(&hostParallelDefault, "host-parallel", 0, "Run commands of Cmds over that many concurrent sessions per host instead of one after another (same as \"HostParallel\": N in every request)")
+	flag.BoolVar(&compressUploads, "C", false, "Compress uploaded files with gzip, they are decompressed on remote side (same as \"Compress\": true in every request)")
+	flag.StringVar(&auditLogSpec, "audit-log", "", "Optional path to append-only audit log of operations on every host, or \"syslog\" to send records to local syslog")
+	flag.StringVar(&recordDir, "record", "", "Optional directory to record output of commands of every request to (play it back with \"gossha replay\")")
+	flag.StringVar(&failedHostsFile, "failed-hosts", "", "Optional file to write hosts where action did not succeed to after every action (one per line)")
+	flag.StringVar(&healthFile, "health", "", "Optional file to count results of hosts in, replies of hosts that keep failing get a note (see \"gossha status\"), e.g. "+defaultHealthFile())
+	flag.StringVar(&latencyFile, "latency-file", "", "Optional file to keep durations of hosts in, with -m hosts that were slow before are started first")
+	flag.StringVar(&retryFromFile, "retry-from", "", "Optional file with hosts (e.g. written by -failed-hosts) to run requests only on, requests without hosts are run on all of them")
+	flag.StringVar(&historyDB, "history", "", "Optional SQLite database to store every run with outputs of all hosts in (query it with \"gossha history\" and \"gossha show\"), e.g. "+defaultHistoryDB())
+	flag.BoolVar(&dryRun, "dry-run", false, "Resolve hosts and validate requests, but only report what would be done instead of connecting to hosts")
+	flag.BoolVar(&forwardAgent, "A", false, "Forward ssh-agent connection to remote hosts")
+	flag.BoolVar(&forwardX11, "X", false, "Forward X11 connections of remote programs to local display of DISPLAY")
+	flag.StringVar(&agentKeySpec, "agent-key", "", "Comma-separated fingerprints or comments (globs allowed) of ssh-agent identities to offer, in that order (default is all of them)")
+	flag.BoolVar(&noAgentAuth, "no-agent", false, "Do not authenticate with ssh-agent identities and do not look for another agent if SSH_AUTH_SOCK does not answer (agent is still used for -A and security keys)")
+	flag.StringVar(&authChainDefault, "auth", "", "Comma-separated authentication providers to use in that order: identity, vault, agent, keys, command, password, keyboard-interactive (default is all of them, gossha_auth inventory variable overrides it)")
+	flag.StringVar(&authCommand, "auth-command", "", "Local command that prints private key (optionally followed by its certificate) or password to authenticate on $HOST with")
+	flag.BoolVar(&agentPrefetch, "agent-prefetch", false, "List ssh-agent identities once instead of in every handshake (keys added to the agent later are not used)")
+	flag.StringVar(&vaultRole, "vault-role", "", "Optional role of Vault SSH secrets engine to sign certificate for in-memory key with (VAULT_ADDR and VAULT_TOKEN are used)")
+	flag.StringVar(&vaultMount, "vault-mount", "ssh", "Path Vault SSH secrets engine is mounted at")
+	flag.StringVar(&passwordFile, "password-file", "", "Optional file with password for password authentication (first line), default is taken from GOSSHA_PASSWORD")
+	flag.StringVar(&passwordCmd, "password-cmd", "", "Optional command that prints password for password authentication (first line), e.g. \"pass show ssh/login\"")
+	flag.StringVar(&passphraseCmd, "passphrase-cmd", "", "Optional command that prints passphrase of encrypted key which file is in KEY environment variable, instead of asking for it")
+	flag.BoolVar(&askPassword, "ask-password", false, "Ask for password for password authentication at startup (as PasswordRequest)")
+	flag.DurationVar(&credentialTTL, "cache-credentials", 0, "Remember passwords and passphrases that were asked for that long (e.g. 8h) in OS keychain or encrypted file, \"gossha forget\" removes them")
+	flag.StringVar(&credentialStore, "credential-store", "auto", "Where -cache-credentials keeps secrets: keychain, file or auto (keychain if there is one)")
+	flag.BoolVar(&kbdInteractive, "kbd-interactive", false, "Use keyboard-interactive authentication (e.g. for OTP codes), challenges are sent as ChallengeRequest")
+	flag.StringVar(&hostKeyMode, "host-keys", "any", "How keys of hosts without pinned gossha_host_key fingerprints are checked: any (accept), pin (reject) or tofu (ask with HostKeyRequest)")
+	flag.StringVar(&acceptChanged, "accept-changed", "", "Accept changed keys of comma-separated hosts (or shell-style patterns) after they were verified, and re-pin them in -host-key-file")
+	flag.StringVar(&hostKeyFile, "host-key-file", defaultHostKeyFile(), "File that keys accepted with -accept-changed are re-pinned in")
+	flag.BoolVar(&gssapiAuth, "gssapi", false, "Try GSSAPI (Kerberos) authentication with tickets from local credential cache")
+	flag.BoolVar(&shareAnswers, "share-answers", false, "Reuse answers to identical keyboard-interactive challenges for all hosts of a request")
+	flag.StringVar(&configFile, "config", "", "Optional path to configuration file (YAML or TOML), default is ~/.gossha.yml or ~/.gossha.toml if present")
+	flag.DurationVar(&requestTimeout, "timeout", defaultTimeout*time.Millisecond, "Default timeout of requests that do not specify Timeout")
+	flag.DurationVar(&maxRunTime, "max-run-time", 0, "Abort actions that run longer than this, whatever their Timeout (0 means no limit)")
+	flag.IntVar(&maxOpenFiles, "max-open-files", 0, "Abort actions when more file descriptors are open (0 means 90% of the limit of the process, -1 disables the check)")
+	flag.BoolVar(&remoteTimeoutDefault, "remote-timeout", false, "Terminate commands on remote hosts with timeout(1) when timeout of request expires, instead of leaving them running (same as \"RemoteTimeout\": true in every request)")
+	flag.StringVar(&transferDefault, "transfer", transferAuto, "How files are uploaded to hosts without gossha_transfer: auto (SFTP, then scp, then cat), sftp, scp (classic scp protocol) or cat (through remote shell)")
+	flag.StringVar(&spillDir, "spill-dir", "", "Optional directory to write outputs of replies held until action finishes (Sort, GroupOutput, Diff) to instead of memory, e.g. "+os.TempDir())
+	flag.StringVar(&sortDefault, "sort", "", "Send replies after all hosts finish ordered by: input (order of hosts), name or duration, default is to send them as hosts finish")
+	flag.StringVar(&outputFormat, "output", "json", "Format of replies: json, text (human-readable, also plain), prefixed, grouped, csv or html (report)")
+	flag.BoolVar(&eventsOutput, "events", false, "Write a line of JSON for every lifecycle event of hosts (connect-start, connect-ok, auth-ok, exec-start, stdout-chunk, stderr-chunk, exit) instead of replies (same as -output events)")
+	flag.BoolVar(&prefixOutput, "P", false, "Print each line of command output prefixed with \"<host>: \" as it arrives (implies -output text)")
+	flag.BoolVar(&tuiMode, "tui", false, "Show live table of hosts of the current request in terminal instead of printing replies (requests are still read from stdin)")
+	flag.StringVar(&replHosts, "repl", "", "Start interactive mode with comma-separated list of hosts (use \":hosts\" to change it later)")
+	flag.StringVar(&serveAddr, "serve", "", "Serve HTTP API on specified address (e.g. 127.0.0.1:8080) instead of reading requests from stdin")
+	flag.StringVar(&serveToken, "serve-token", os.Getenv("GOSSHA_SERVE_TOKEN"), "Token that HTTP API clients must send in \"Authorization: Bearer <token>\" header, default is taken from GOSSHA_SERVE_TOKEN")
+	flag.StringVar(&policyFile, "policy", "", "Optional policy file with tokens of HTTP API clients and commands, hosts and audit fields allowed for them (replaces -serve-token)")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", "", "Optional URL of OIDC provider which tokens (JWT) are accepted by HTTP API, e.g. https://accounts.example.com")
+	flag.StringVar(&oidcAudience, "oidc-audience", "", "Audience (client ID) that OIDC tokens must be issued for, required with -oidc-issuer")
+	flag.StringVar(&oidcClaim, "oidc-claim", "sub", "Claim of OIDC tokens that identifies client in jobs, audit log and -policy")
+	flag.BoolVar(&daemonMode, "daemon", false, "Keep connections open in background and accept sessions on control socket instead of reading requests from stdin")
+	flag.IntVar(&circuitFailures, "circuit-failures", defaultCircuitFailures, "With -daemon and -serve, consecutive connection failures or timeouts of host after which requests fail on it immediately for -circuit-cooldown, 0 disables it")
+	flag.DurationVar(&circuitCooldown, "circuit-cooldown", defaultCircuitCooldown, "Time after which host with open circuit is tried again (see -circuit-failures)")
+	flag.StringVar(&controlSocket, "control", defaultControlSocket(), "Control socket of daemon, requests are relayed to daemon if it is running (empty disables relaying), default is taken from GOSSHA_CONTROL")
+	flag.Parse()
+
+	if configFile == "" {
+		configFile = findConfigFile()
+	}
+
+	conf := &gosshaConfig{}
+	var configErr error
+	if configFile != "" {
+		if conf, configErr = loadConfig(configFile); configErr != nil {
+			conf = &gosshaConfig{}
+		}
+	}
+
+	if prefixOutput {
+		outputFormat = "text"
+	}
+	if eventsOutput {
+		outputFormat = "events"
+	}
+
+	if debugFlag {
+		verbosity = logDebug
+	} else if verboseFlag {
+		verbosity = logInfo
+	}
+
+	if jumpHostsList != "" {
+		jumpHosts = strings.Split(jumpHostsList, ",")
+	}
+
+	if certList != "" {
+		certFiles = strings.Split(certList, ",")
+	}
+
+	// daemon holds connections made with its own flags, so only plain JSON sessions are relayed to it
+	if !internalInput && !daemonMode && controlSocket != "" && replHosts == "" && !isFlagSet("repl") && serveAddr == "" && outputFormat == "json" && !dryRun && !tuiMode {
+		if conn, err := net.Dial("unix", controlSocket); err == nil {
+			os.Exit(relayToDaemon(conn))
+		}
+	}
+
+	sshDir := filepath.Join(homeDir(), ".ssh")
+	keys = []string{filepath.Join(sshDir, "id_rsa"), filepath.Join(sshDir, "id_dsa"), filepath.Join(sshDir, "id_ecdsa")}
+
+	if pubKey != "" {
+		if strings.HasSuffix(pubKey, ".pub") {
+			pubKey = strings.TrimSuffix(pubKey, ".pub")
+		}
+
+		keys = append(keys, pubKey)
+	}
+
+	keys = append(keys, conf.identityFiles...)
+
+	agentWarning = initAgentSock()
+
+	if sshAuthSock != "" {
+		go agentConnectionManagerThread(maxAgentConnections)
+	}
+
+	if internalInput {
+		// requests and replies are exchanged directly through channels
+	} else if replHosts != "" || isFlagSet("repl") {
+		go replInputThread(splitHostList(replHosts))
+		go replReplierThread()
+	} else if serveAddr != "" {
+		api = newAPIServer(serveToken, requestsChan)
+		go serveInputThread()
+		go serveReplierThread()
+	} else if daemonMode {
+		control = newControlServer(requestsChan)
+		go serveInputThread()
+		go daemonReplierThread()
+	} else if tuiMode {
+		if activeTerminal, tuiErr = openTerminal(); tuiErr == nil {
+			go inputDecoder()
+			go tuiReplierThread(activeTerminal)
+		} else {
+			tuiMode = false
+			go inputDecoder()
+			go outputReplierThread(newTextRenderer(os.Stdout, os.Stderr))
+		}
+	} else {
+		go inputDecoder()
+		go outputReplierThread(initOutputRenderer())
+	}
+
+	if idleTimeout > 0 {
+		go idleConnectionsThread()
+	}
+
+	if configErr != nil {
+		reportCriticalErrorToUser(configErr.Error())
+	}
+
+	if tuiErr != nil {
+		reportCriticalErrorToUser(tuiErr.Error())
+	}
+
+	if bwLimit != "" {
+		rate, err := parseByteRate(bwLimit)
+		if err != nil {
+			reportCriticalErrorToUser("Invalid -bwlimit: " + err.Error())
+		} else {
+			globalUploadLimiter = newRateLimiter(rate)
+		}
+	}
+
+	connectLimiter = newRateLimiter(connectRate)
+
+	if maxOutputSpec != "" {
+		var err error
+		if maxOutputBytes, err = parseByteSize(maxOutputSpec); err != nil {
+			reportCriticalErrorToUser("Invalid -max-output-bytes: " + err.Error())
+		}
+	}
+
+	for _, v := range []struct {
+		kind, flag, list string
+		dst              *[]string
+	}{
+		{"cipher", "ciphers", cipherList, &globalAlgorithms.ciphers},
+		{"kex", "kex", kexList, &globalAlgorithms.kex},
+		{"mac", "macs", macList, &globalAlgorithms.macs},
+		{"hostkey", "hostkey-algorithms", hostKeyAlgList, &globalAlgorithms.hostKeys},
+	} {
+		algs, err := parseAlgorithms(v.kind, v.list)
+		if err != nil {
+			reportCriticalErrorToUser("Invalid -" + v.flag + ": " + err.Error())
+		}
+		*v.dst = algs
+	}
+
+	if _, err := parseAuthChain(authChainDefault); err != nil {
+		reportCriticalErrorToUser("Invalid -auth: " + err.Error())
+		authChainDefault = ""
+	}
+
+	if shellDefault != "" && noShellDefault {
+		reportCriticalErrorToUser("-shell and -no-shell cannot be used together")
+		noShellDefault = false
+	}
+
+	if ipv4Only && ipv6Only {
+		reportCriticalErrorToUser("-4 and -6 cannot be used together")
+	} else if ipv4Only {
+		dialNetwork = "tcp4"
+	} else if ipv6Only {
+		dialNetwork = "tcp6"
+	}
+
+	if err := checkSortOrder(sortDefault); err != nil {
+		reportCriticalErrorToUser("Invalid -sort: " + err.Error())
+		sortDefault = ""
+	}
+
+	if historyDB != "" {
+		h, err := openHistory(historyDB)
+		if err != nil {
+			reportCriticalErrorToUser(err.Error())
+		} else {
+			history = h
+		}
+	}
+
+	if auditLogSpec != "" {
+		if audit, auditErr = openAuditLog(auditLogSpec); auditErr != nil {
+			reportCriticalErrorToUser(auditErr.Error())
+		}
+	}
+
+	if policyFile != "" {
+		var p *requestPolicy
+		switch {
+		case api == nil:
+			policyErr = errors.New("-policy can only be used with -serve")
+		case serveToken != "":
+			policyErr = errors.New("-serve-token cannot be used with -policy, tokens are defined in policy file")
+		default:
+			p, policyErr = loadPolicy(policyFile)
+		}
+		if policyErr != nil {
+			reportCriticalErrorToUser(policyErr.Error())
+		} else {
+			api.policy = p
+		}
+	}
+
+	if oidcIssuer != "" && policyErr == nil {
+		switch {
+		case api == nil:
+			policyErr = errors.New("-oidc-issuer can only be used with -serve")
+		case oidcAudience == "":
+			policyErr = errors.New("-oidc-audience is required with -oidc-issuer")
+		case serveToken != "":
+			policyErr = errors.New("-serve-token cannot be used with -oidc-issuer, use tokens of -policy instead")
+		}
+		if policyErr != nil {
+			reportCriticalErrorToUser(policyErr.Error())
+		} else {
+			api.oidc = newOIDCVerifier(oidcIssuer, oidcAudience, oidcClaim)
+		}
+	}
+
+	if notifyURL != "" {
+		if err := checkNotifyURL(notifyURL); err != nil {
+			reportCriticalErrorToUser(err.Error())
+			notifyURL = ""
+		}
+	}
+	notifyOnlyFailures = isFlagSet("notify-failures")
+
+	if k8sNodes {
+		if discoverDefault != "" {
+			reportCriticalErrorToUser("-k8s-nodes cannot be combined with -discover")
+		} else {
+			discoverDefault = k8sNodesSource()
+		}
+	}
+
+	if shipSpec != "" {
+		var err error
+		if shipper, err = newLogShipper(shipSpec); err != nil {
+			reportCriticalErrorToUser(err.Error())
+		}
+	}
+
+	if _, err := newOutputRenderer(outputFormat, os.Stdout, os.Stderr); err != nil {
+		reportErrorToUser(err.Error() + ", using json")
+	}
+
+	if err := initProxy(proxySpec); err != nil {
+		reportCriticalErrorToUser(err.Error())
+	}
+
+	if err := initResolver(); err != nil {
+		reportCriticalErrorToUser(err.Error())
+	}
+
+	if serveAddr != "" && kbdInteractive {
+		reportCriticalErrorToUser("-kbd-interactive cannot be used with -serve: challenges cannot be answered over HTTP API")
+		kbdInteractive = false
+	}
+
+	if daemonMode && kbdInteractive {
+		reportCriticalErrorToUser("-kbd-interactive cannot be used with -daemon: challenges cannot be answered by sessions")
+		kbdInteractive = false
+	}
+
+	if err := checkHostKeyMode(hostKeyMode); err != nil {
+		reportCriticalErrorToUser(err.Error())
+		hostKeyMode = "pin"
+	}
+
+	if err := checkTransfer(transferDefault); err != nil {
+		reportCriticalErrorToUser("-transfer: " + err.Error())
+		transferDefault = transferAuto
+	}
+
+	if acceptChanged != "" {
+		if err := checkAcceptChanged(acceptChanged); err != nil {
+			reportCriticalErrorToUser(err.Error())
+			acceptChanged = ""
+		}
+	}
+
+	if keys, err := loadRepinnedKeys(hostKeyFile); err != nil {
+		reportCriticalErrorToUser(err.Error())
+	} else {
+		hostKeyChangesMu.Lock()
+		repinnedKeys = keys
+		hostKeyChangesMu.Unlock()
+	}
+
+	if hostKeyMode == "tofu" && (serveAddr != "" || daemonMode || replHosts != "" || isFlagSet("repl")) {
+		reportCriticalErrorToUser("-host-keys tofu cannot be used with -serve, -daemon or -repl: host keys cannot be confirmed, pinned keys are required instead")
+		hostKeyMode = "pin"
+	}
+
+	if gssapiAuth && !gssapiSupported {
+		reportCriticalErrorToUser("-gssapi is not supported: GoSSHa is built without GSSAPI library, rebuild it with -tags gssapi")
+		gssapiAuth = false
+	}
+
+	noConfirmations = serveAddr != "" || daemonMode || replHosts != "" || isFlagSet("repl")
+	if canaryDefault > 0 && noConfirmations {
+		reportCriticalErrorToUser("-canary cannot be used with -serve, -daemon or -repl: confirmations cannot be sent")
+		canaryDefault = 0
+	}
+
+	if agentWarning != "" {
+		reportErrorToUser(agentWarning)
+	}
+
+	if forwardAgent {
+		if sshAuthSock == "" {
+			reportErrorToUser("Cannot forward ssh-agent: SSH_AUTH_SOCK is not set")
+		} else {
+			agentForwardSock = sshAuthSock
+		}
+	}
+
+	if forwardX11 {
+		if err := initX11(); err != nil {
+			reportErrorToUser(err.Error())
+		}
+	}
+
+	if inventoryFile != "" {
+		inv, err := loadInventory(inventoryFile)
+		if err != nil {
+			reportCriticalErrorToUser(err.Error())
+		} else {
+			hostInventory = inv
+		}
+	}
+
+	if len(conf.groupNames) > 0 || len(conf.hostPatterns) > 0 {
+		if hostInventory == nil {
+			hostInventory = newInventory()
+			hostInventory.group("all")
+		}
+		if err := addConfigGroups(hostInventory, conf); err != nil {
+			reportCriticalErrorToUser(err.Error())
+		}
+	}
+
+	if retryFromFile != "" {
+		var err error
+		if retryHosts, err = readHostsFile(retryFromFile); err != nil {
+			reportCriticalErrorToUser(err.Error())
+		}
+	}
+
+	if latencyFile != "" {
+		var err error
+		if latencies, err = loadLatencies(latencyFile); err != nil {
+			reportCriticalErrorToUser(err.Error())
+		}
+	}
+
+	if healthFile != "" {
+		var err error
+		if health, err = loadHealth(healthFile); err != nil {
+			reportCriticalErrorToUser(err.Error())
+		}
+	}
+
+	if err := initCredentials(); err != nil {
+		reportCriticalErrorToUser(err.Error())
+	}
+
+	if err := initPasswords(conf); err != nil {
+		reportCriticalErrorToUser(err.Error())
+	}
+
+	if err := initStages(conf); err != nil {
+		reportCriticalErrorToUser(err.Error())
+	}
+
+	if err := initSessions(conf); err != nil {
+		reportCriticalErrorToUser(err.Error())
+	}
+
+	if err := initSchedules(conf); err != nil {
+		reportCriticalErrorToUser(err.Error())
+	}
+
+	if err := initGuard(conf); err != nil {
+		reportCriticalErrorToUser(err.Error())
+	}
+
+	if err := initRunAs(); err != nil {
+		reportCriticalErrorToUser(err.Error())
+	}
+
+	if err := initFilter(); err != nil {
+		reportCriticalErrorToUser(err.Error())
+	}
+
+	if remoteEncodingDefault != "" {
+		if err := checkEncoding(remoteEncodingDefault); err != nil {
+			reportCriticalErrorToUser(err.Error())
+		}
+	}
+
+	if vaultRole != "" {
+		v, err := newVaultSigner(vaultMount, vaultRole)
+		if err == nil {
+			// credentials are checked right away instead of failing on every host
+			_, err = v.signer()
+		}
+		if err != nil {
+			reportCriticalErrorToUser(err.Error())
+		} else {
+			vault = v
+		}
+	}
+
+	makeSigners()
+	loadIdentityFiles()
+	checkAgentKeys()
+	prefetchAgentIdentities()
+}
+
+func isFlagSet(name string) (res bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			res = true
+		}
+	})
+	return
+}
+
+// writeReplyJSON writes reply as a single line, objects get "Type" field with name of reply type
+func writeReplyJSON(w io.Writer, reply interface{}) error {
+	buf, err := json.Marshal(reply)
+	if err != nil {
+		panic("Could not marshal json reply: " + err.Error())
+	}
+
+	if buf[0] == '{' {
+		typeStr := strings.TrimPrefix(fmt.Sprintf("%T", reply), "*main.")
+		_, err = fmt.Fprintf(w, "{\"Type\":\"%s\",%s}\n", typeStr, buf[1:len(buf)-1])
+	} else {
+		_, err = fmt.Fprintln(w, string(buf))
+	}
+	return err
+}
+
+func sendProxyReply(response interface{}) {
+	repliesChan <- response
+}
+
+func getExecFunc(msg *ProxyRequest) func(string) *SshResult {
+	msg = withDefaultChdir(msg)
+	render, err := newHostRenderer(msg)
+	if err != nil {
+		reportCriticalErrorToUser(err.Error())
+		return nil
+	}
+
+	if msg.Action == "ssh" {
+		if msg.Cmd == "" && len(msg.Cmds) == 0 {
+			reportCriticalErrorToUser("Empty 'Cmd'")
+			return nil
+		}
+
+		if msg.Cmd != "" && len(msg.Cmds) > 0 {
+			reportCriticalErrorToUser("Only one of 'Cmd' and 'Cmds' can be specified")
+			return nil
+		}
+
+		opts, err := parseCmdOptions(msg)
+		if err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+
+		parallel, err := requestHostParallel(msg)
+		if err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+
+		if opts.filterPattern, opts.filter, opts.filterRemote, err = requestFilter(msg); err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+
+		if opts.cmdTimeouts, err = commandTimeouts(msg); err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+
+		if opts.summaryOnly, opts.summaryLines, err = requestSummary(msg); err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+
+		if opts.record, err = startRecording(); err != nil {
+			reportCriticalErrorToUser(err.Error())
 			return nil
 		}
 
 		return func(hostname string) *SshResult {
-			stdout, stderr, err := executeCmd(msg.Cmd, hostname)
-			return &SshResult{hostname: hostname, stdout: stdout, stderr: stderr, err: err}
+			req, err := render(hostname)
+			if err != nil {
+				return &SshResult{hostname: hostname, err: err}
+			}
+
+			opts := opts.forHost()
+			opts.chdir = req.Chdir
+			if len(req.Cmds) > 1 && parallel > 1 {
+				res := executeCmdsParallel(req.Cmds, parallel, opts, hostname)
+				res.truncated, res.matches, res.summary = opts.output.truncated(), opts.filterMatches(), opts.outputSummary()
+				return res
+			} else if len(req.Cmds) > 0 {
+				res := executeCmds(req.Cmds, opts, hostname)
+				res.truncated, res.matches, res.summary = opts.output.truncated(), opts.filterMatches(), opts.outputSummary()
+				return res
+			}
+
+			stdout, stderr, err := executeCmd(req.Cmd, opts, hostname)
+			return &SshResult{hostname: hostname, stdout: stdout, stderr: stderr, err: err, truncated: opts.output.truncated(), matches: opts.filterMatches(), summary: opts.outputSummary()}
 		}
 	} else if msg.Action == "scp" {
+		if msg.Manifest != "" {
+			return manifestExecFunc(msg)
+		}
+
+		if msg.Source == "" && len(msg.Sources) == 0 {
+			reportCriticalErrorToUser("Empty 'Source'")
+			return nil
+		}
+
+		if msg.Source != "" && len(msg.Sources) > 0 {
+			reportCriticalErrorToUser("Only one of 'Source' and 'Sources' can be specified")
+			return nil
+		}
+
+		if msg.Data != nil && msg.Source != dataSource {
+			reportCriticalErrorToUser("'Data' can only be specified with \"Source\": \"-\"")
+			return nil
+		}
+
+		if err := checkRemotePath("Target", msg.Target); err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+
+		// templated source is read when it is rendered for a host
+		var entries []*uploadEntry
+		perHostSource := msg.Template && strings.Contains(msg.Source, "{{")
+		sources := newUploadSourceCache()
+
+		// several sources (or glob pattern) are uploaded into Target directory
+		var sourceFiles []string
+		if len(msg.Sources) > 0 || (!perHostSource && strings.ContainsAny(msg.Source, "*?[")) {
+			patterns := msg.Sources
+			if msg.Source != "" {
+				patterns = []string{msg.Source}
+			}
+
+			if sourceFiles, err = expandUploadSources(patterns, msg.Target); err != nil {
+				reportCriticalErrorToUser(err.Error())
+				return nil
+			}
+
+			for _, source := range sourceFiles {
+				if _, err = sources.read(source); err != nil {
+					reportCriticalErrorToUser(err.Error())
+					return nil
+				}
+			}
+		} else if msg.Source == dataSource {
+			entries = []*uploadEntry{{mode: 0644, modTime: time.Now(), size: int64(len(msg.Data)), contents: msg.Data}}
+		} else if !perHostSource {
+			if entries, err = readUploadSource(msg.Source); err != nil {
+				reportCriticalErrorToUser(err.Error())
+				return nil
+			}
+		}
+
+		opts, err := parseUploadOptions(msg)
+		if err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+
+		var relay *relayTree
+		if msg.Relay > 0 {
+			if err := checkRelayOptions(msg, entries); err != nil {
+				reportCriticalErrorToUser(err.Error())
+				return nil
+			}
+			relay = newRelayTree(int(msg.Relay))
+		}
+
+		if msg.Mirror || msg.MirrorDelete || msg.MirrorPlan {
+			if err := checkMirrorOptions(msg, entries); err != nil {
+				reportCriticalErrorToUser(err.Error())
+				return nil
+			}
+		}
+
+		return func(hostname string) *SshResult {
+			req, err := render(hostname)
+			if err != nil {
+				return &SshResult{hostname: hostname, err: err}
+			}
+
+			if relay != nil {
+				return relay.upload(req.Target, entries, opts, hostname)
+			}
+
+			if sourceFiles != nil {
+				return uploadFiles(sourceUploads(req.Target, sourceFiles, opts), sources, hostname)
+			}
+
+			entries := entries
+			if perHostSource {
+				if entries, err = sources.read(req.Source); err != nil {
+					return &SshResult{hostname: hostname, err: err}
+				}
+			}
+
+			unchanged, changes, err := uploadFile(req.Target, entries, opts, hostname)
+			return &SshResult{hostname: hostname, unchanged: unchanged, changes: changes, err: err}
+		}
+	} else if msg.Action == "script" {
 		if msg.Source == "" {
 			reportCriticalErrorToUser("Empty 'Source'")
 			return nil
 		}
 
+		script, err := ioutil.ReadFile(msg.Source)
+		if err != nil {
+			reportCriticalErrorToUser("Cannot read script: " + err.Error())
+			return nil
+		}
+
+		opts, err := parseCmdOptions(msg)
+		if err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+
+		if opts.filterPattern, opts.filter, opts.filterRemote, err = requestFilter(msg); err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+
+		if opts.summaryOnly, opts.summaryLines, err = requestSummary(msg); err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+
+		if opts.record, err = startRecording(); err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+
+		return func(hostname string) *SshResult {
+			req, err := render(hostname)
+			if err != nil {
+				return &SshResult{hostname: hostname, err: err}
+			}
+
+			opts := opts.forHost()
+			opts.chdir = req.Chdir
+			stdout, stderr, err := runScript(script, msg.Args, opts, hostname)
+			return &SshResult{hostname: hostname, stdout: stdout, stderr: stderr, err: err, truncated: opts.output.truncated(), matches: opts.filterMatches(), summary: opts.outputSummary()}
+		}
+	} else if msg.Action == "download" {
+		if err := checkRemotePath("Source", msg.Source); err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+
 		if msg.Target == "" {
 			reportCriticalErrorToUser("Empty 'Target'")
 			return nil
 		}
-
-		if msg.MaxThroughput > 0 && msg.MaxThroughput < minThroughput {
-			reportErrorToUser(fmt.Sprint("Minimal supported throughput is ", minThroughput, " Bps"))
+
+		download := downloadFile
+		if msg.Recursive {
+			download = downloadDir
+		}
+
+		return func(hostname string) *SshResult {
+			stdout, stderr, err := download(msg.Source, msg.Target, hostname)
+			return &SshResult{hostname: hostname, stdout: stdout, stderr: stderr, err: err}
+		}
+	} else if msg.Action == "forward" {
+		if msg.LocalForward == "" && msg.RemoteForward == "" {
+			reportCriticalErrorToUser("Empty 'LocalForward' and 'RemoteForward'")
+			return nil
+		}
+
+		var local, remote *forwardSpec
+		var err error
+
+		if msg.LocalForward != "" {
+			if local, err = parseForwardSpec(msg.LocalForward); err != nil {
+				reportCriticalErrorToUser(err.Error())
+				return nil
+			}
+
+			if !local.perHost && len(msg.Hosts) > 1 {
+				reportCriticalErrorToUser("Local port must be different for each host, use port+i in 'LocalForward'")
+				return nil
+			}
+		}
+
+		if msg.RemoteForward != "" {
+			if remote, err = parseForwardSpec(msg.RemoteForward); err != nil {
+				reportCriticalErrorToUser(err.Error())
+				return nil
+			}
+		}
+
+		hostIdx := make(map[string]int, len(msg.Hosts))
+		for i, h := range msg.Hosts {
+			hostIdx[h] = i
+		}
+
+		return func(hostname string) *SshResult {
+			stdout, stderr, err := forwardPorts(local, remote, hostIdx[hostname], hostname)
+			return &SshResult{hostname: hostname, stdout: stdout, stderr: stderr, err: err}
+		}
+	} else if msg.Action == "unforward" {
+		return func(hostname string) *SshResult {
+			stdout, stderr, err := unforwardPorts(hostname)
+			return &SshResult{hostname: hostname, stdout: stdout, stderr: stderr, err: err}
+		}
+	} else if msg.Action == "facts" {
+		if msg.GroupOutput {
+			reportCriticalErrorToUser("'GroupOutput' is not supported for facts")
+			return nil
+		}
+
+		opts, err := parseCmdOptions(msg)
+		if err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+		opts.stream, opts.streamOnly = false, false // output of probes is parsed, not shown
+		opts.noShell, opts.maxOutput = false, 0     // probes are shell pipelines which output is parsed
+
+		return func(hostname string) *SshResult {
+			return gatherFacts(opts, hostname)
+		}
+	} else if msg.Action == "ping" {
+		if msg.GroupOutput {
+			reportCriticalErrorToUser("'GroupOutput' is not supported for ping")
+			return nil
+		}
+
+		return pingHost
+	} else if msg.Action == "reboot" {
+		r, err := parseRebootOptions(msg)
+		if err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+
+		return func(hostname string) *SshResult {
+			return rebootHost(r, hostname)
+		}
+	} else if msg.Action == "service" {
+		s, err := parseServiceOptions(msg)
+		if err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+
+		return func(hostname string) *SshResult {
+			return manageService(s, hostname)
+		}
+	} else if msg.Action == "pkg" {
+		p, err := parsePkgOptions(msg)
+		if err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+
+		return func(hostname string) *SshResult {
+			return managePackages(p, hostname)
+		}
+	}
+
+	reportCriticalErrorToUser(fmt.Sprintf("Unsupported action: %s", msg.Action))
+	return nil
+}
+
+// retryableError is a failure that happened before action was started on host (e.g. connection
+// could not be established or session could not be opened), so the action can be safely retried
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// isTransientConnError checks whether connection failure is likely to go away by itself, as opposed to
+// e.g. authentication failure or unknown host name
+func isTransientConnError(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// withRetries retries execFunc up to msg.Retries times with exponential backoff if it fails before
+// the action was started on host (see retryableError), until timeout is reached
+func withRetries(msg *ProxyRequest, timeout uint64, execFunc func(string) *SshResult) func(string) *SshResult {
+	if msg.Retries == 0 {
+		return execFunc
+	}
+
+	delay := time.Duration(defaultRetryDelay) * time.Millisecond
+	if msg.RetryDelay > 0 {
+		delay = time.Duration(msg.RetryDelay) * time.Millisecond
+	}
+
+	deadline := time.Now().Add(time.Millisecond * time.Duration(timeout))
+
+	return func(hostname string) *SshResult {
+		attemptDelay := delay
+		for attempt := uint64(0); ; attempt++ {
+			res := execFunc(hostname)
+			if res.err == nil || attempt >= msg.Retries || time.Now().Add(attemptDelay).After(deadline) {
+				return res
+			}
+
+			var retryable *retryableError
+			if !errors.As(res.err, &retryable) {
+				return res
+			}
+
+			// connection may be broken, so establish a new one for the next attempt
+			connectedHosts.Close(hostname)
+
+			logf(logDebug, hostname, "Retrying in %s after error: %s", attemptDelay, res.err)
+
+			time.Sleep(attemptDelay)
+			attemptDelay *= 2
+		}
+	}
+}
+
+// writeOutputFiles writes stdout and stderr of result to <dir>/<host>.out and <dir>/<host>.err
+func writeOutputFiles(dir string, res *SshResult) error {
+	name := downloadDirName(res.hostname)
+	if !isSafeLocalName(name) {
+		return errors.New("Refusing to write output of " + res.hostname + " to unsafe local path")
+	}
+
+	for ext, contents := range map[string]string{".out": res.stdout, ".err": res.stderr} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+ext), []byte(contents), 0644); err != nil {
+			return errors.New("Cannot write output of " + res.hostname + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// groupReplies groups hosts with identical results, largest groups go first
+func groupReplies(replies []*Reply) []*GroupedReply {
+	type resultKey struct {
+		stdout, stderr, errMsg string
+		success, unchanged     bool
+		skipped                bool
+		exitCode               int
+		followUp               CommandResult
+		spilled                string // digests of spilled outputs
+	}
+
+	var groups []*GroupedReply
+	byResult := make(map[resultKey]*GroupedReply)
+
+	for _, r := range replies {
+		key := resultKey{stdout: r.Stdout, stderr: r.Stderr, errMsg: r.ErrMsg, success: r.Success, unchanged: r.Unchanged, skipped: r.Skipped, exitCode: r.ExitCode}
+		if r.FollowUp != nil {
+			key.followUp = *r.FollowUp
+		}
+		if r.spilled != nil {
+			key.spilled = r.spilled.key
+		}
+		g, ok := byResult[key]
+		if !ok {
+			g = &GroupedReply{Stdout: r.Stdout, Stderr: r.Stderr, Success: r.Success, ErrMsg: r.ErrMsg, ExitCode: r.ExitCode, ErrorKind: r.ErrorKind, Unchanged: r.Unchanged, Skipped: r.Skipped, FollowUp: r.FollowUp}
+			if r.spilled != nil {
+				g.source = r
+			}
+			byResult[key] = g
+			groups = append(groups, g)
 		}
+		g.Hosts = append(g.Hosts, r.Hostname)
+	}
 
-		atomic.StoreUint64(&msg.MaxThroughput, maxThroughput)
+	for _, g := range groups {
+		sort.Strings(g.Hosts)
+	}
 
-		fp, err := os.Open(msg.Source)
-		if err != nil {
-			reportCriticalErrorToUser(err.Error())
-			return nil
+	sort.SliceStable(groups, func(i, j int) bool {
+		if len(groups[i].Hosts) != len(groups[j].Hosts) {
+			return len(groups[i].Hosts) > len(groups[j].Hosts)
 		}
+		return groups[i].Hosts[0] < groups[j].Hosts[0]
+	})
 
-		defer fp.Close()
+	return groups
+}
 
-		contents, err := ioutil.ReadAll(fp)
-		if err != nil {
-			reportCriticalErrorToUser("Cannot read " + msg.Source + " contents: " + err.Error())
-			return nil
-		}
+func checkSortOrder(order string) error {
+	switch order {
+	case "", "input", "name", "duration":
+		return nil
+	}
+	return errors.New("Unsupported sort order '" + order + "', expected input, name or duration")
+}
 
-		return func(hostname string) *SshResult {
-			stdout, stderr, err := uploadFile(msg.Target, contents, hostname)
-			return &SshResult{hostname: hostname, stdout: stdout, stderr: stderr, err: err}
+// sortReplies orders replies by position of host in hosts ("input"), by host name ("name") or by duration ("duration")
+func sortReplies(replies []*Reply, order string, hosts []string) {
+	switch order {
+	case "input":
+		idx := make(map[string]int, len(hosts))
+		for i, h := range hosts {
+			idx[h] = i
 		}
+		sort.SliceStable(replies, func(i, j int) bool { return idx[replies[i].Hostname] < idx[replies[j].Hostname] })
+	case "name":
+		sort.SliceStable(replies, func(i, j int) bool { return replies[i].Hostname < replies[j].Hostname })
+	case "duration":
+		sort.SliceStable(replies, func(i, j int) bool {
+			if replies[i].Duration != replies[j].Duration {
+				return replies[i].Duration < replies[j].Duration
+			}
+			return replies[i].Hostname < replies[j].Hostname
+		})
 	}
+}
 
-	reportCriticalErrorToUser(fmt.Sprintf("Unsupported action: %s", msg.Action))
-	return nil
+// exitCode returns exit status of remote command that finished with err
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus()
+	}
+
+	var mismatch *mismatchError
+	if errors.As(err, &mismatch) {
+		return 0 // command succeeded, but its output is wrong
+	}
+
+	return -1
 }
 
 func runAction(msg *ProxyRequest) {
+	timeout := uint64(requestTimeout / time.Millisecond)
+
+	if msg.Timeout > 0 {
+		timeout = msg.Timeout
+	} else if msg.Action == "reboot" {
+		timeout = rebootTimeout(msg)
+	}
+	if msg.Timeout == 0 {
+		timeout += uint64(requestSplay(msg) / time.Millisecond)
+	}
+
+	stages, err := stageGroups(msg)
+	if err != nil {
+		reportCriticalErrorToUser(err.Error())
+		return
+	}
+
+	if err := loadRequestVars(msg); err != nil {
+		reportCriticalErrorToUser(err.Error())
+		return
+	}
+
+	groupHosts, err := inventoryHosts(append(msg.Groups, stages...))
+	if err != nil {
+		reportCriticalErrorToUser(err.Error())
+		return
+	}
+
+	msg.Discover = withDefaultDiscover(msg)
+	discoveredHosts, err := discoverHosts(msg.Discover)
+	if err != nil {
+		reportCriticalErrorToUser(err.Error())
+		return
+	}
+
+	hosts, err := expandHosts(append(append(msg.Hosts, groupHosts...), discoveredHosts...))
+	if err != nil {
+		reportCriticalErrorToUser(err.Error())
+		return
+	}
+	if msg.Hosts, err = filterHosts(filterRetryHosts(uniqueHosts(hosts)), msg); err != nil {
+		reportCriticalErrorToUser(err.Error())
+		return
+	}
+
+	var unresolved map[string]error // hosts which names do not exist (see PreResolve)
+	if (msg.PreResolve || preResolveDefault) && !dryRun {
+		var names []string
+		unresolved, names = preResolveHosts(msg.Hosts)
+		defer forgetResolved(names)
+	}
+	msg.Hosts = dedupeHosts(msg.Hosts)
+
+	var unreachable map[string]error // hosts that did not accept TCP connections (see Probe)
+	if probe := probeTimeout(msg); probe > 0 && !dryRun {
+		unreachable = probeHosts(msg.Hosts, unresolved, probe)
+	}
+
+	sortOrder := msg.Sort
+	if sortOrder == "" {
+		sortOrder = sortDefault
+	}
+	if err := checkSortOrder(sortOrder); err != nil {
+		reportCriticalErrorToUser(err.Error())
+		return
+	}
+
+	var diff *diffReference
+	if ref := msg.Diff; ref != "" || diffDefault != "" {
+		if ref == "" {
+			ref = diffDefault
+		}
+		if msg.GroupOutput || msg.OutputDir != "" {
+			reportCriticalErrorToUser("Diff cannot be used with GroupOutput or OutputDir")
+			return
+		}
+		if diff, err = newDiffReference(ref, msg.Hosts); err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return
+		}
+	}
+
+	expect, err := newExpectation(msg)
+	if err != nil {
+		reportCriticalErrorToUser(err.Error())
+		return
+	}
+
+	if auditErr != nil {
+		reportCriticalErrorToUser(auditErr.Error())
+		return
+	}
+
+	if msg.CacheTTL > 0 && msg.Action != "ssh" {
+		reportCriticalErrorToUser("'CacheTTL' is only supported for commands")
+		return
+	}
+
+	if msg.Recursive && msg.Action != "download" {
+		reportCriticalErrorToUser("'Recursive' is only supported for downloads")
+		return
+	}
+
+	if msg.Session != "" && msg.Action != "ssh" && msg.Action != "script" {
+		reportCriticalErrorToUser("'Session' is only supported for commands and scripts")
+		return
+	}
+
+	if msg.Schedule != "" || msg.Action == "schedules" || msg.Action == "unschedule" {
+		reportCriticalErrorToUser("Scheduled jobs are only supported by control daemon (-daemon)")
+		return
+	}
+
+	if (msg.Then != "" || msg.OnFail != "") && msg.Action != "ssh" && msg.Action != "script" {
+		reportCriticalErrorToUser("'Then' and 'OnFail' are only supported for commands and scripts")
+		return
+	}
+
+	msg.runID = newShipRunID(time.Now())
 	execFunc := getExecFunc(msg)
 	if execFunc == nil {
 		return
 	}
 
-	timeout := uint64(defaultTimeout)
+	var record func(*SshResult, time.Time)
+	if dryRun {
+		execFunc = dryRunExecFunc(msg)
+	} else {
+		record = audit.recorder(msg)
+	}
 
-	if msg.Timeout > 0 {
-		timeout = msg.Timeout
+	if msg.Action == "ssh" || msg.Action == "script" {
+		if execFunc, err = withFollowUp(msg, execFunc); err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return
+		}
+		if execFunc, err = withSessionTeardown(msg, execFunc); err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return
+		}
+	}
+
+	if execFunc, err = withSnapshot(msg, execFunc); err != nil {
+		reportCriticalErrorToUser(err.Error())
+		return
+	}
+
+	if execFunc, err = withOnlyIf(msg, execFunc); err != nil {
+		reportCriticalErrorToUser(err.Error())
+		return
+	}
+
+	execFunc = withResultCache(msg, withCircuitBreaker(withHostTimeouts(msg, withRetries(msg, timeout, withReruns(msg, execFunc)))))
+	execFunc = withPreResolved(unresolved, execFunc)
+	execFunc = withPreResolved(unreachable, execFunc) // unreachable hosts fail the same way
+	if dryRun {
+		expect = nil // output of dry run is description of action
+	}
+	execFunc = withExpectation(expect, execFunc)
+	if !dryRun {
+		execFunc = withHostHooks(msg, execFunc)
+	}
+
+	resetSharedAnswers()
+
+	canary := msg.Canary
+	if canary == 0 && len(msg.CanaryHosts) == 0 && stages == nil {
+		canary = canaryDefault
+	}
+	confirmCanary := canary > 0 || len(msg.CanaryHosts) > 0
+	if confirmCanary && (api != nil || control != nil) {
+		reportCriticalErrorToUser("Canaries cannot be confirmed over HTTP API or control socket")
+		return
+	}
+
+	var batches [][]string
+	switch {
+	case stages != nil && confirmCanary:
+		err = errors.New("Canaries cannot be used with Stages")
+	case stages != nil:
+		batches, err = stageBatches(stages, msg.Hosts, msg.Serial)
+	default:
+		batches, err = canaryBatches(msg.Hosts, canary, msg.CanaryHosts, msg.Serial)
+	}
+	if err != nil {
+		reportCriticalErrorToUser(err.Error())
+		return
+	}
+
+	if reason := guardReason(msg); reason != "" && !msg.Confirm && !assumeYes && !dryRun {
+		if noConfirmations {
+			reportCriticalErrorToUser(reason + ": confirmations cannot be sent, set \"Confirm\": true in request or use -yes")
+			return
+		}
+		if !confirmRun(reason, len(msg.Hosts)) {
+			reportCriticalErrorToUser("Action was not confirmed")
+			return
+		}
+	}
+
+	if !dryRun {
+		if err := runHook("before-run", hookBeforeRun, runHookEnv(msg)); err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return
+		}
 	}
 
 	startTime := time.Now().UnixNano()
 
+	shipRun := msg.runID
+	var ship func(*SshResult, time.Time)
+	if !dryRun {
+		ship = shipper.recorder(msg, shipRun)
+	}
+	pipe := newResultPipe(msg, shipRun)
+
 	responseChannel := make(chan *SshResult, len(msg.Hosts))
 	timeoutChannel := time.After(time.Millisecond * time.Duration(timeout))
 
-	timedOutHosts := make(map[string]bool)
+	timedOutHosts := make(map[string]bool, len(msg.Hosts)) // hosts that did not reply yet
+	for _, h := range msg.Hosts {
+		timedOutHosts[h] = true
+	}
+	interrupted := false
+
 	sendProxyReply(EnableReportConnectedHosts(true))
 
+	groupOutput, outputDir, progress := msg.GroupOutput, msg.OutputDir, msg.Progress
+	var completed, failed int
+	var slowest *SshResult
+	totalHosts := len(msg.Hosts)
+	traffic := trafficSnapshot(msg.Hosts)
+	if outputDir != "" {
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			reportCriticalErrorToUser("Cannot create output directory: " + err.Error())
+			return
+		}
+	}
+	var spill *spillFile // outputs of held replies (only with -spill-dir)
+	if spillDir != "" && (groupOutput || sortOrder != "" || diff != nil) {
+		if spill, err = newSpillFile(spillDir); err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return
+		}
+		defer spill.Close()
+	}
+	var replies []*Reply
+	expectResults := make(map[string]error) // results of hosts that finished (only with Expect)
+	timing := msg.Timing || timingDefault
+	var timings []*HostTiming
+	sendReplies := func() {
+		if groupOutput {
+			for _, g := range groupReplies(replies) {
+				g.unspill()
+				sendProxyReply(g)
+			}
+		} else {
+			if diff != nil {
+				diff.apply(replies)
+			}
+			sortReplies(replies, sortOrder, msg.Hosts)
+			for _, reply := range replies {
+				reply.unspill()
+				sendProxyReply(reply)
+			}
+		}
+		replies = nil
+	}
+
 	maxConcurrency := uint64(len(msg.Hosts))
 	if maxConnections > 0 {
 		maxConcurrency = maxConnections
 	}
 	maxConcurrencyCh := make(chan struct{}, maxConcurrency)
+	batches = latencyOrdered(batches, maxConcurrency)
+	cancelled := make(chan struct{}) // closed when action times out or is interrupted
+	stopping := make(chan struct{})  // closed on Ctrl-C while interrupted commands are exiting
+	drainHosts := -1                 // number of started hosts to wait for after Ctrl-C
+	action, maxFailPercentage := msg.Action, msg.MaxFailPercentage
+	failFast := msg.FailFast || failFastDefault
+	failedFast := false
+
+	var startedMu sync.Mutex
+	startedHosts := make(map[string]bool)
+	failedHosts := make(map[string]bool) // hosts that replied with failure
+	var historyResults []*SshResult      // results of all hosts for -history
+
+	runHost := func(h string) {
+		defer func() { <-maxConcurrencyCh }()
+		if delay := splayDelay(msg); delay > 0 {
+			logf(logDebug, h, "Waiting %s before starting (splay)", delay.Round(time.Millisecond))
+			select {
+			case <-time.After(delay):
+			case <-cancelled:
+				return
+			case <-stopping:
+				return
+			}
+		}
+		startedMu.Lock()
+		select {
+		case <-cancelled:
+			startedMu.Unlock()
+			return
+		case <-stopping:
+			startedMu.Unlock()
+			return
+		default:
+		}
+		startedHosts[h] = true
+		startedMu.Unlock()
+		if tuiMode {
+			sendProxyReply(&hostStarted{hostname: h})
+		}
+		start := time.Now()
+		logf(logDebug, h, "Starting %s", action)
+		res := execFunc(h)
+		res.duration = time.Since(start)
+		if res.err != nil {
+			logf(logInfo, h, "%s failed in %s: %s", action, res.duration, res.err)
+			metricHostResults.add(1, action, "failed")
+		} else {
+			logf(logInfo, h, "%s finished in %s", action, res.duration)
+			metricHostResults.add(1, action, "ok")
+		}
+		metricActionDuration.observe(res.duration.Seconds(), action)
+		if record != nil {
+			record(res, start)
+		}
+		if ship != nil {
+			ship(res, start)
+		}
+		responseChannel <- res
+	}
+	launch := func(hosts []string) {
+		go func() { // hosts are started in order of batch
+			for _, h := range hosts {
+				maxConcurrencyCh <- struct{}{}
+				go runHost(h)
+			}
+		}()
+	}
 
-	for _, h := range msg.Hosts {
-		go func(h string) {
-			maxConcurrencyCh <- struct{}{}
-			defer func() { <-maxConcurrencyCh }()
-			responseChannel <- execFunc(h)
-		}(h)
+	batch, batchDone, batchFailures := 0, 0, 0
+	var skippedHosts []string
+	if tuiMode {
+		sendProxyReply(&actionStarted{description: describeAction(msg), hosts: msg.Hosts})
 	}
+	launch(batches[0])
+
+	startAction()
+	defer finishAction()
+	watchdog := startWatchdog(time.Now())
 
 	for i := 0; i < len(msg.Hosts); i++ {
 		select {
 		case <-timeoutChannel:
 			goto finish
+		case <-actionInterrupts:
+			if interrupted {
+				signalCommands(ssh.SIGKILL)
+				goto finish
+			}
+			interrupted = true
+
+			// remote commands get SIGINT and a chance to exit, second Ctrl-C kills them
+			if signalCommands(ssh.SIGINT) == 0 {
+				goto finish
+			}
+			startedMu.Lock()
+			close(stopping)
+			drainHosts = len(startedHosts)
+			startedMu.Unlock()
+			if completed+failed == drainHosts {
+				goto finish
+			}
+			i-- // no reply was received
 		case msg := <-responseChannel:
 			delete(timedOutHosts, msg.hostname)
+			if expect != nil {
+				expectResults[msg.hostname] = msg.err
+			}
 			success := true
 			errMsg := ""
 			if msg.err != nil {
 				errMsg = msg.err.Error()
 				success = false
 			}
-			sendProxyReply(&Reply{Hostname: msg.hostname, Stdout: msg.stdout, Stderr: msg.stderr, ErrMsg: errMsg, Success: success})
+
+			if history != nil && !dryRun {
+				res := *msg // output is cleared below with OutputDir
+				historyResults = append(historyResults, &res)
+			}
+
+			if latencies != nil && !dryRun {
+				latencies.observe(msg.hostname, msg.duration)
+			}
+
+			if outputDir != "" {
+				if err := writeOutputFiles(outputDir, msg); err != nil {
+					reportErrorToUser(err.Error())
+				}
+				msg.stdout, msg.stderr = "", ""
+			}
+
+			reply := &Reply{
+				Hostname:    msg.hostname,
+				Stdout:      msg.stdout,
+				Stderr:      msg.stderr,
+				ErrMsg:      errMsg,
+				ErrorKind:   errorKind(msg.err, action),
+				Success:     success,
+				ExitCode:    exitCode(msg.err),
+				Duration:    msg.duration.Seconds(),
+				Commands:    msg.commands,
+				Files:       msg.files,
+				Unchanged:   msg.unchanged,
+				Changes:     msg.changes,
+				Facts:       msg.facts,
+				Ping:        msg.ping,
+				Reboot:      msg.reboot,
+				Service:     msg.service,
+				Pkg:         msg.pkg,
+				RelayedFrom: msg.relayedFrom,
+				Rerun:       msg.rerun,
+				Cached:      msg.cached,
+				Truncated:   msg.truncated,
+				Matches:     msg.matches,
+				Skipped:     msg.skipped,
+				FollowUp:    msg.followUp,
+				Snapshot:    msg.snapshot,
+				Tags:        hostTags(msg.hostname),
+
+				SnapshotChanged: msg.snapshotChanged,
+				OutputSummary:   msg.summary,
+			}
+			if !success {
+				reply.Annotation = hostAnnotation(msg.hostname)
+			}
+			if health != nil && !dryRun {
+				reply.Health = health.record(msg.hostname, msg.err, reply.ErrorKind, time.Now())
+			}
+			if timing {
+				reply.Timing = hostTiming(msg.hostname, msg.duration, time.Unix(0, startTime))
+				t := *reply.Timing
+				t.Hostname = msg.hostname
+				timings = append(timings, &t)
+			}
+			pipe.send(reply)
+
+			if groupOutput || sortOrder != "" || diff != nil {
+				spill.store(reply)
+				replies = append(replies, reply)
+			} else {
+				sendProxyReply(reply)
+			}
+
+			if success {
+				completed++
+			} else {
+				failed++
+				failedHosts[msg.hostname] = true
+			}
+			if slowest == nil || msg.duration > slowest.duration {
+				slowest = msg
+			}
+
+			if progress {
+				sendProxyReply(&RunProgress{Completed: completed, Failed: failed, Pending: totalHosts - completed - failed})
+			}
+
+			if !success && failFast && completed+failed < totalHosts {
+				failedFast = true
+				goto finish
+			}
+
+			if completed+failed == drainHosts {
+				goto finish
+			}
+
+			batchDone++
+			if !success {
+				batchFailures++
+			}
+
+			if batchDone == len(batches[batch]) && batch+1 < len(batches) {
+				if tooManyFailures(batchFailures, batchDone, maxFailPercentage) {
+					for _, b := range batches[batch+1:] {
+						skippedHosts = append(skippedHosts, b...)
+					}
+					goto finish
+				}
+
+				// nothing runs while user looks at results of canary, so Ctrl-C exits as usual
+				if batch == 0 && confirmCanary && !dryRun {
+					sendReplies()
+					finishAction()
+					confirmed := confirmRollout(batches[0], totalHosts-len(batches[0]))
+					startAction()
+					if !confirmed {
+						for _, b := range batches[1:] {
+							skippedHosts = append(skippedHosts, b...)
+						}
+						goto finish
+					}
+					timeoutChannel = time.After(time.Millisecond * time.Duration(timeout))
+				}
+
+				batch, batchDone, batchFailures = batch+1, 0, 0
+				launch(batches[batch])
+			}
 		}
 	}
 
 finish:
+	close(cancelled)
+	aborted := watchdog.stop()
+
+	for _, h := range skippedHosts {
+		delete(timedOutHosts, h)
+	}
+
+	if failedFast {
+		startedMu.Lock()
+		for h := range timedOutHosts {
+			if !startedHosts[h] {
+				skippedHosts = append(skippedHosts, h)
+				delete(timedOutHosts, h)
+			}
+		}
+		startedMu.Unlock()
+		sort.Strings(skippedHosts)
+	}
+
+	if requestRemoteTimeout(msg) > 0 {
+		signalHostCommands(timedOutHosts, ssh.SIGKILL)
+	}
+
+	// closing connections aborts sessions that are still running
 	for hostname := range timedOutHosts {
 		connectedHosts.Close(hostname)
 	}
 
 	sendProxyReply(DisableReportConnectedHosts(true))
 
-	sendProxyReply(&FinalReply{TotalTime: float64(time.Now().UnixNano()-startTime) / 1e9, TimedOutHosts: timedOutHosts})
+	sendReplies()
+
+	final := &FinalReply{TotalTime: float64(time.Now().UnixNano()-startTime) / 1e9, TimedOutHosts: timedOutHosts, SkippedHosts: skippedHosts, Aborted: aborted}
+	if interrupted || failedFast {
+		final.Interrupted = interrupted
+		for hostname := range timedOutHosts {
+			final.PendingHosts = append(final.PendingHosts, hostname)
+		}
+		sort.Strings(final.PendingHosts)
+		final.TimedOutHosts = make(map[string]bool)
+	}
+	if expect != nil {
+		final.Compliance = complianceSummary(expectResults, msg.Hosts)
+	}
+	if timing {
+		final.Timing = timingSummary(timings)
+	}
+	final.Stats = &RunStats{Hosts: totalHosts, Succeeded: completed, Failed: failed, TimedOut: len(final.TimedOutHosts),
+		Pending: len(final.PendingHosts), Skipped: len(skippedHosts)}
+	if slowest != nil {
+		final.Stats.SlowestHost, final.Stats.SlowestTime = slowest.hostname, slowest.duration.Seconds()
+	}
+	final.Stats.BytesSent, final.Stats.BytesReceived = trafficSince(traffic)
+
+	for h := range timedOutHosts {
+		failedHosts[h] = true
+	}
+	for _, h := range skippedHosts {
+		failedHosts[h] = true
+	}
+	final.Tags = tagSummary(msg.Hosts, failedHosts)
+	final.HostKeyChanges = takeHostKeyChanges()
+	final.Annotations = failedAnnotations(failedHosts)
+
+	if failedHostsFile != "" && !dryRun {
+		if err := writeFailedHosts(failedHostsFile, msg.Hosts, failedHosts); err != nil {
+			reportErrorToUser(err.Error())
+		}
+	}
+
+	if latencies != nil && !dryRun {
+		if !interrupted && !failedFast {
+			elapsed := time.Duration(time.Now().UnixNano() - startTime)
+			startedMu.Lock()
+			for h := range timedOutHosts {
+				if startedHosts[h] {
+					latencies.observe(h, elapsed) // at least that long
+				}
+			}
+			startedMu.Unlock()
+		}
+		if err := latencies.save(latencyFile); err != nil {
+			reportErrorToUser(err.Error())
+		}
+	}
+
+	if health != nil && !dryRun {
+		if !interrupted && !failedFast {
+			for h := range timedOutHosts {
+				health.record(h, errors.New("Timed out"), "command-timeout", time.Now())
+			}
+		}
+		if err := health.save(healthFile); err != nil {
+			reportErrorToUser(err.Error())
+		}
+	}
+
+	if history != nil && !dryRun {
+		for h := range timedOutHosts {
+			reason := "Timed out"
+			if interrupted || failedFast {
+				reason = "Cancelled"
+			}
+			historyResults = append(historyResults, &SshResult{hostname: h, err: errors.New(reason)})
+		}
+		for _, h := range skippedHosts {
+			historyResults = append(historyResults, &SshResult{hostname: h, err: errors.New("Skipped")})
+		}
+		if err := history.save(msg, time.Unix(0, startTime), historyResults); err != nil {
+			reportErrorToUser(err.Error())
+		}
+	}
+
+	pipe.wait()
+
+	if !dryRun {
+		env := afterRunHookEnv(msg, len(failedHosts), time.Duration(time.Now().UnixNano()-startTime))
+		if err := runHook("after-run", hookAfterRun, env); err != nil {
+			reportErrorToUser(err.Error())
+		}
+	}
+
+	if (notifyURL != "" || shipper != nil) && !dryRun {
+		summary := newRunSummary(msg, failedHosts, time.Duration(time.Now().UnixNano()-startTime), interrupted || failedFast)
+		if notifyURL != "" {
+			if err := notifyRun(summary); err != nil {
+				reportErrorToUser(err.Error())
+			}
+		}
+		if shipper != nil {
+			shipper.finishRun(msg, shipRun, summary, time.Unix(0, startTime))
+		}
+	}
+
+	sendProxyReply(final)
 }
 
 func inputDecoder() {
@@ -680,7 +3731,9 @@ func inputDecoder() {
 func runProxy() {
 	for msg := range requestsChan {
 		switch {
-		case msg.Action == "ssh" || msg.Action == "scp":
+		case msg.Action == "ssh" || msg.Action == "scp" || msg.Action == "download" || msg.Action == "script",
+			msg.Action == "forward" || msg.Action == "unforward" || msg.Action == "facts" || msg.Action == "ping" || msg.Action == "reboot",
+			msg.Action == "service" || msg.Action == "pkg":
 			runAction(msg)
 		default:
 			reportCriticalErrorToUser("Unsupported action: " + msg.Action)
@@ -689,7 +3742,16 @@ func runProxy() {
 }
 
 func main() {
+	if run, args := subcommandOf(os.Args); run != nil {
+		os.Exit(run(args))
+	}
+
+	go interruptThread()
 	initialize(false)
 	sendProxyReply(&InitializeComplete{InitializeComplete: true})
 	runProxy()
+
+	if tuiMode {
+		select {} // results can be browsed until user quits
+	}
 }
@@ -1,14 +1,27 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 func must(err error, msg string) {
@@ -52,6 +65,9 @@ SAmEta/vUMI5a+meJBN+qWp53hUFrJHVUEroT2MJmAvodSyxcqqDGQ==
 
 const idRsaPub = `ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC+XLqj/VC43DaRn3LPzR/K0QMEaAdyAHI9VPHmNOUE8E7y5cVMEH4udE/UBRXh897Ij2ATGrvgeaAsNXEVInuurUwDYuG9kvrj55lVeBJHp2yT4t6cRX3WuFJSoXdQThitbvMMOu8XfYWWNW5psAZ0gjJzVaJLupmYtBKm9iQ/Nfu7DQVj1CM5pwDrcO7BKRJ+4GUtuVGRIDQt4Ye5avQptgYlPNFXlku9uYwVW16W4fYV/9/TVQkZerhQkbM/E0dztZUx/88ssZPnblDEkIrCPEyomJCOIgyRMXupq79EYJ8uWg5Uz0/V2JEGPA8oGR7dSVgWCXX3dP4eDdNiGJeN nasretdinov@Yuriys-iMac.local`
 
+// testTmpDir is removed after all tests, test servers keep their files in it
+var testTmpDir string
+
 func launchGoSSHa() {
 	initialize(true)
 	go runProxy()
@@ -61,6 +77,7 @@ func TestMain(m *testing.M) {
 	code := func() int {
 		rand.Seed(time.Now().UnixNano())
 		tmpDir := filepath.Join(os.TempDir(), fmt.Sprintf("gossha-test-%d", rand.Int()))
+		testTmpDir = tmpDir
 		sshDir := filepath.Join(tmpDir, ".ssh")
 		must(os.MkdirAll(sshDir, 0700), "Could not create temp dir")
 		must(ioutil.WriteFile(filepath.Join(sshDir, "id_rsa"), []byte(idRsa), 0600), "Could not write test private key")
@@ -87,6 +104,10 @@ type testResult struct {
 	slowServers []*testSSHServer
 	hostsLeft   map[string]struct{}
 	replies     map[string]*Reply
+	transfers   map[string]*TransferProgress // last transfer progress of each host
+	progress    []*RunProgress
+	chunks      []*OutputChunk // streamed output in order of arrival
+	final       *FinalReply
 }
 
 func injectFaults(srv *testSSHServer, i int) {
@@ -108,6 +129,7 @@ func makeTestResult() *testResult {
 		hostsLeft: make(map[string]struct{}),
 		hosts:     make(map[string]*testSSHServer),
 		replies:   make(map[string]*Reply),
+		transfers: make(map[string]*TransferProgress),
 	}
 }
 
@@ -119,6 +141,7 @@ func waitReply(t *testing.T, r *testResult, timeout time.Duration) {
 		case reply := <-repliesChan:
 			switch reply := reply.(type) {
 			case *FinalReply:
+				r.final = reply
 				return
 			case *Reply:
 				_, ok := r.hostsLeft[reply.Hostname]
@@ -128,6 +151,15 @@ func waitReply(t *testing.T, r *testResult, timeout time.Duration) {
 				delete(r.hostsLeft, reply.Hostname)
 
 				r.replies[reply.Hostname] = reply
+			case *TransferProgress:
+				r.transfers[reply.Hostname] = reply
+			case *RunProgress:
+				r.progress = append(r.progress, reply)
+			case *OutputChunk:
+				if _, ok := r.hostsLeft[reply.Hostname]; !ok {
+					t.Fatalf("Got output chunk after reply for %s", reply.Hostname)
+				}
+				r.chunks = append(r.chunks, reply)
 			}
 		case <-timeoutCh:
 			t.Fatalf("Timed out, hosts left: %#v", r.hostsLeft)
@@ -159,6 +191,10 @@ func checkSuccess(t *testing.T, r *testResult) {
 			}
 		}
 
+		if reply.ExitCode != srv.exitStatus {
+			t.Fatalf("Expected exit code %d for %s, got %d", srv.exitStatus, reply.Hostname, reply.ExitCode)
+		}
+
 		if reply.Stdout != srv.hostname {
 			t.Fatalf("Expected 'Test', got '%s' in stdout", reply.Stdout)
 		}
@@ -181,6 +217,52 @@ func checkSuccess(t *testing.T, r *testResult) {
 	}
 }
 
+// startTestServers starts count plain test servers and registers them in r
+func startTestServers(r *testResult, prefix string, count int) {
+	for i := 0; i < count; i++ {
+		srv := &testSSHServer{
+			hostname: fmt.Sprintf("%s-%d", prefix, i),
+		}
+		srv.start()
+
+		r.hosts[srv.addr] = srv
+		r.hostsLeft[srv.addr] = struct{}{}
+	}
+}
+
+// runTestRequest sends req to all hosts in r and waits until every host replies successfully
+func runTestRequest(t *testing.T, r *testResult, req *ProxyRequest) {
+	req.Timeout = uint64(maxTimeout / time.Millisecond)
+	for h := range r.hostsLeft {
+		req.Hosts = append(req.Hosts, h)
+	}
+
+	requestsChan <- req
+
+	waitReply(t, r, maxTimeout)
+
+	if len(r.hostsLeft) != 0 {
+		t.Fatalf("Hosts left: %#v", r.hostsLeft)
+	}
+
+	for _, reply := range r.replies {
+		if !reply.Success {
+			t.Fatalf("Request to %s failed: %s", reply.Hostname, reply.ErrMsg)
+		}
+	}
+}
+
+// sendTestRequest sends req to all hosts in r and waits for their replies, failed ones included
+func sendTestRequest(t *testing.T, r *testResult, req *ProxyRequest) {
+	req.Timeout = uint64(maxTimeout / time.Millisecond)
+	for addr := range r.hosts {
+		r.hostsLeft[addr] = struct{}{}
+		req.Hosts = append(req.Hosts, addr)
+	}
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+}
+
 func TestBasic(t *testing.T) {
 	r := makeTestResult()
 
@@ -213,8 +295,17 @@ func TestBasic(t *testing.T) {
 	checkSuccess(t, r)
 }
 
+// setDisconnectAfterUse changes -d under the lock that Release reads it with, connections of
+// previous tests can still be released meanwhile
+func setDisconnectAfterUse(v bool) {
+	connectedHosts.mu.Lock()
+	disconnectAfterUse = v
+	connectedHosts.mu.Unlock()
+}
+
 func TestDisconnectAfterUse(t *testing.T) {
-	disconnectAfterUse = true
+	setDisconnectAfterUse(true)
+	defer setDisconnectAfterUse(false)
 	TestBasic(t)
 }
 
@@ -275,3 +366,1132 @@ func TestLimitConcurrency(t *testing.T) {
 		t.Fatalf("Too many servers responded: got %d, expected %d", answeredServers, maxAnsweredServers)
 	}
 }
+
+func TestUpload(t *testing.T) {
+	const target = "dir with spaces/sub/it's a \"file\".txt"
+	contents := []byte(fmt.Sprintf("test contents %d\n", rand.Int()))
+
+	src, err := ioutil.TempFile("", "gossha-upload")
+	must(err, "Could not create source file")
+	defer os.Remove(src.Name())
+	_, err = src.Write(contents)
+	must(err, "Could not write source file")
+	must(src.Close(), "Could not close source file")
+
+	r := makeTestResult()
+	startTestServers(r, "test-upload", 10)
+
+	runTestRequest(t, r, &ProxyRequest{
+		Action: "scp",
+		Source: src.Name(),
+		Target: target,
+		Mode:   "0600",
+		Verify: true,
+	})
+
+	for _, reply := range r.replies {
+		name := filepath.Join(r.hosts[reply.Hostname].root, filepath.FromSlash(target))
+
+		got, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Could not read uploaded file: %s", err)
+		}
+
+		if string(got) != string(contents) {
+			t.Fatalf("Contents mismatch for %s: got %q", reply.Hostname, got)
+		}
+
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Could not stat uploaded file: %s", err)
+		}
+
+		if fi.Mode().Perm() != 0600 {
+			t.Fatalf("Expected mode 0600, got %s", fi.Mode())
+		}
+	}
+}
+
+func TestUploadReplacesFile(t *testing.T) {
+	const target = "app.conf"
+
+	src, err := ioutil.TempFile("", "gossha-upload")
+	must(err, "Could not create source file")
+	defer os.Remove(src.Name())
+	_, err = src.WriteString("new contents\n")
+	must(err, "Could not write source file")
+	must(src.Close(), "Could not close source file")
+
+	r := makeTestResult()
+
+	// servers without posix-rename@openssh.com only support renaming to non-existent paths
+	for i := 0; i < 4; i++ {
+		srv := &testSSHServer{
+			hostname:      fmt.Sprintf("test-replace-%d", i),
+			noPosixRename: i%2 == 0,
+		}
+		srv.start()
+
+		must(ioutil.WriteFile(filepath.Join(srv.root, target), []byte("old contents\n"), 0644), "Could not write remote file")
+
+		r.hosts[srv.addr] = srv
+		r.hostsLeft[srv.addr] = struct{}{}
+	}
+
+	runTestRequest(t, r, &ProxyRequest{
+		Action: "scp",
+		Source: src.Name(),
+		Target: target,
+	})
+
+	for _, srv := range r.hosts {
+		got, err := ioutil.ReadFile(filepath.Join(srv.root, target))
+		if err != nil {
+			t.Fatalf("Could not read uploaded file: %s", err)
+		}
+
+		if string(got) != "new contents\n" {
+			t.Fatalf("Contents mismatch for %s: got %q", srv.hostname, got)
+		}
+
+		if _, err := os.Stat(filepath.Join(srv.root, target+uploadTmpSuffix)); !os.IsNotExist(err) {
+			t.Fatalf("Temporary file was left on %s: %v", srv.hostname, err)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	localDir, err := ioutil.TempDir("", "gossha-download")
+	must(err, "Could not create local dir")
+	defer os.RemoveAll(localDir)
+
+	r := makeTestResult()
+	startTestServers(r, "test-download", 10)
+
+	for _, srv := range r.hosts {
+		must(os.MkdirAll(filepath.Join(srv.root, "logs"), 0755), "Could not create remote dir")
+		must(ioutil.WriteFile(filepath.Join(srv.root, "logs", "app.log"), []byte(srv.hostname), 0644), "Could not write remote file")
+	}
+
+	runTestRequest(t, r, &ProxyRequest{
+		Action: "download",
+		Source: "logs/app.log",
+		Target: localDir,
+	})
+
+	for _, reply := range r.replies {
+		got, err := ioutil.ReadFile(filepath.Join(localDir, downloadDirName(reply.Hostname), "app.log"))
+		if err != nil {
+			t.Fatalf("Could not read downloaded file: %s", err)
+		}
+
+		if string(got) != r.hosts[reply.Hostname].hostname {
+			t.Fatalf("Contents mismatch for %s: got %q", reply.Hostname, got)
+		}
+	}
+}
+
+func TestDownloadRecursive(t *testing.T) {
+	localDir, err := ioutil.TempDir("", "gossha-download")
+	must(err, "Could not create local dir")
+	defer os.RemoveAll(localDir)
+
+	r := makeTestResult()
+	startTestServers(r, "test-download-recursive", 2)
+
+	for _, srv := range r.hosts {
+		must(os.MkdirAll(filepath.Join(srv.root, "logs", "old"), 0755), "Could not create remote dir")
+		must(ioutil.WriteFile(filepath.Join(srv.root, "logs", "old", "app.log.1"), []byte(srv.hostname), 0644), "Could not write remote file")
+		must(os.Symlink("/etc/passwd", filepath.Join(srv.root, "logs", "passwd")), "Could not create symlink")
+	}
+
+	runTestRequest(t, r, &ProxyRequest{Action: "download", Source: "logs/", Target: localDir, Recursive: true})
+
+	for _, reply := range r.replies {
+		dir := filepath.Join(localDir, downloadDirName(reply.Hostname), "logs")
+		got, err := ioutil.ReadFile(filepath.Join(dir, "old", "app.log.1"))
+		if err != nil || string(got) != r.hosts[reply.Hostname].hostname {
+			t.Fatalf("Unexpected downloaded file from %s: %q, %v (%+v)", reply.Hostname, got, err, reply)
+		}
+		if _, err := os.Lstat(filepath.Join(dir, "passwd")); !os.IsNotExist(err) || !strings.Contains(reply.Stderr, "Skipped logs/passwd") {
+			t.Fatalf("Symbolic link must be skipped: %v, %+v", err, reply)
+		}
+	}
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	must(tw.WriteHeader(&tar.Header{Name: "../escaped", Typeflag: tar.TypeReg, Mode: 0644}), "Could not write archive")
+	must(tw.Close(), "Could not write archive")
+	if _, err := unpackTar(&archive, filepath.Join(localDir, "evil")); err == nil {
+		t.Fatalf("Entries outside of local directory must be refused")
+	}
+}
+
+func TestSplitHostPort(t *testing.T) {
+	for hostname, expected := range map[string][2]string{
+		"web1":               {"web1", "22"},
+		"web1:2222":          {"web1", "2222"},
+		"2001:db8::1":        {"2001:db8::1", "22"},
+		"[2001:db8::1]":      {"2001:db8::1", "22"},
+		"[2001:db8::1]:2222": {"2001:db8::1", "2222"},
+		"fe80::1%eth0":       {"fe80::1%eth0", "22"},
+	} {
+		if host, port := splitHostPort(hostname); host != expected[0] || port != expected[1] {
+			t.Fatalf("Unexpected host and port of %s: %s %s", hostname, host, port)
+		}
+	}
+}
+
+func TestDownloadDirName(t *testing.T) {
+	for hostname, expected := range map[string]string{
+		"web1.example.com":    "web1.example.com",
+		"web1.example.com:22": "web1.example.com",
+		"127.0.0.1:2222":      "127.0.0.1_2222",
+	} {
+		if got := downloadDirName(hostname); got != expected {
+			t.Fatalf("Unexpected download dir for %s: %s", hostname, got)
+		}
+	}
+
+	for _, name := range []string{"", ".", "..", "../etc", "a/b", `a\b`} {
+		if isSafeLocalName(name) {
+			t.Fatalf("Expected %q to be rejected", name)
+		}
+	}
+}
+
+func TestUploadDirectory(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "gossha-upload-dir")
+	must(err, "Could not create source dir")
+	defer os.RemoveAll(srcDir)
+
+	files := map[string]os.FileMode{
+		"README":              0640,
+		"bin/run.sh":          0755,
+		"conf/nested/app.ini": 0600,
+	}
+
+	for name, mode := range files {
+		localName := filepath.Join(srcDir, filepath.FromSlash(name))
+		must(os.MkdirAll(filepath.Dir(localName), 0750), "Could not create source subdir")
+		must(ioutil.WriteFile(localName, []byte(name), mode), "Could not write source file")
+		must(os.Chmod(localName, mode), "Could not chmod source file")
+	}
+
+	r := makeTestResult()
+	startTestServers(r, "test-upload-dir", 5)
+
+	runTestRequest(t, r, &ProxyRequest{
+		Action: "scp",
+		Source: srcDir,
+		Target: "deploy/app",
+	})
+
+	for _, srv := range r.hosts {
+		for name, mode := range files {
+			remoteName := filepath.Join(srv.root, "deploy", "app", filepath.FromSlash(name))
+
+			got, err := ioutil.ReadFile(remoteName)
+			if err != nil {
+				t.Fatalf("Could not read uploaded file: %s", err)
+			}
+
+			if string(got) != name {
+				t.Fatalf("Contents mismatch for %s: got %q", remoteName, got)
+			}
+
+			fi, err := os.Stat(remoteName)
+			must(err, "Could not stat uploaded file")
+
+			if fi.Mode().Perm() != mode {
+				t.Fatalf("Expected mode %s for %s, got %s", mode, remoteName, fi.Mode())
+			}
+		}
+
+		fi, err := os.Stat(filepath.Join(srv.root, "deploy", "app", "conf"))
+		must(err, "Could not stat uploaded dir")
+
+		if fi.Mode().Perm() != 0750 {
+			t.Fatalf("Expected mode 0750 for uploaded dir, got %s", fi.Mode())
+		}
+	}
+}
+
+func TestUploadPreserve(t *testing.T) {
+	mtime := time.Date(2017, time.June, 20, 12, 0, 0, 0, time.UTC)
+
+	src, err := ioutil.TempFile("", "gossha-upload-preserve")
+	must(err, "Could not create source file")
+	defer os.Remove(src.Name())
+	must(src.Close(), "Could not close source file")
+	must(os.Chmod(src.Name(), 0751), "Could not chmod source file")
+	must(os.Chtimes(src.Name(), mtime, mtime), "Could not change source file times")
+
+	r := makeTestResult()
+	startTestServers(r, "test-upload-preserve", 3)
+
+	runTestRequest(t, r, &ProxyRequest{
+		Action:   "scp",
+		Source:   src.Name(),
+		Target:   "preserved",
+		Preserve: true,
+	})
+
+	for _, srv := range r.hosts {
+		fi, err := os.Stat(filepath.Join(srv.root, "preserved"))
+		must(err, "Could not stat uploaded file")
+
+		if fi.Mode().Perm() != 0751 {
+			t.Fatalf("Expected mode 0751, got %s", fi.Mode())
+		}
+
+		if !fi.ModTime().Equal(mtime) {
+			t.Fatalf("Expected mtime %s, got %s", mtime, fi.ModTime())
+		}
+	}
+}
+
+func TestJumpHosts(t *testing.T) {
+	bastions := makeTestResult()
+	startTestServers(bastions, "test-bastion", 2)
+
+	for addr := range bastions.hosts {
+		jumpHosts = append(jumpHosts, testUserName+"@"+addr)
+	}
+	defer func() { jumpHosts = nil }()
+
+	r := makeTestResult()
+	startTestServers(r, "test-jump", 5)
+	runTestRequest(t, r, makeProxyRequest(maxTimeout))
+	checkSuccess(t, r)
+
+	for _, srv := range bastions.hosts {
+		if int(atomic.LoadInt32(&srv.forwardedConns)) != len(r.hosts) {
+			t.Fatalf("Expected %d connections forwarded through %s, got %d", len(r.hosts), srv.hostname, srv.forwardedConns)
+		}
+	}
+
+	// failure to reach the first jump host must be reported as a jump host error
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	must(err, "Could not listen")
+	ln.Close()
+
+	jumpHosts = []string{ln.Addr().String()}
+	for addr := range r.hosts {
+		_, err := dialHost(addr, &ssh.ClientConfig{User: testUserName})
+		if err == nil || !strings.HasPrefix(err.Error(), "Cannot connect to jump host "+ln.Addr().String()) {
+			t.Fatalf("Expected jump host error, got %v", err)
+		}
+		break
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	setDisconnectAfterUse(false)
+
+	r := makeTestResult()
+	startTestServers(r, "test-reuse", 5)
+
+	hosts := r.hosts
+	for i := 0; i < 3; i++ {
+		r = makeTestResult()
+		r.hosts = hosts
+		for h := range hosts {
+			r.hostsLeft[h] = struct{}{}
+		}
+
+		runTestRequest(t, r, makeProxyRequest(maxTimeout))
+		checkSuccess(t, r)
+	}
+
+	for _, srv := range hosts {
+		if cnt := atomic.LoadInt32(&srv.connections); cnt != 1 {
+			t.Fatalf("Expected single connection to %s, got %d", srv.hostname, cnt)
+		}
+	}
+
+	// connections that are in use must survive idle cleanup, stale releases must not affect them
+	held := make(map[string]*ssh.Client)
+	for h := range hosts {
+		conn, ok := connectedHosts.Get(h)
+		if !ok {
+			t.Fatalf("Connection to %s is not cached", h)
+		}
+		held[h] = conn
+		connectedHosts.Release(h, &ssh.Client{})
+	}
+
+	connectedHosts.CloseIdle(0)
+
+	for h, conn := range held {
+		if cached, ok := connectedHosts.Get(h); !ok || cached != conn {
+			t.Fatalf("Connection to %s that is in use was closed", h)
+		}
+		connectedHosts.Release(h, conn)
+		connectedHosts.Release(h, conn)
+	}
+
+	connectedHosts.CloseIdle(0)
+
+	for h := range hosts {
+		if conn, ok := connectedHosts.Get(h); ok {
+			connectedHosts.Release(h, conn)
+			t.Fatalf("Idle connection to %s was not closed", h)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	r := makeTestResult()
+
+	for i := 0; i < 5; i++ {
+		srv := &testSSHServer{
+			hostname:     fmt.Sprintf("test-retries-%d", i),
+			failConnects: 2,
+		}
+		srv.start()
+
+		r.hosts[srv.addr] = srv
+		r.hostsLeft[srv.addr] = struct{}{}
+	}
+
+	req := makeProxyRequest(maxTimeout)
+	req.Retries = 2
+	req.RetryDelay = 10
+
+	runTestRequest(t, r, req)
+	checkSuccess(t, r)
+
+	for _, srv := range r.hosts {
+		if cnt := atomic.LoadInt32(&srv.connections); cnt != 1 {
+			t.Fatalf("Expected single successful connection to %s, got %d", srv.hostname, cnt)
+		}
+	}
+}
+
+func TestTransientConnErrors(t *testing.T) {
+	transient := []error{
+		fmt.Errorf("ssh: handshake failed: %w", io.EOF),
+		fmt.Errorf("Cannot connect to jump host bastion: %w", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}),
+		&net.DNSError{Err: "server misbehaving", IsTemporary: true},
+	}
+
+	permanent := []error{
+		errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey], no supported methods remain"),
+		&net.DNSError{Err: "no such host", IsNotFound: true},
+		&ssh.ExitMissingError{},
+	}
+
+	for _, err := range transient {
+		if !isTransientConnError(err) {
+			t.Fatalf("Expected %q to be transient", err)
+		}
+	}
+
+	for _, err := range permanent {
+		if isTransientConnError(err) {
+			t.Fatalf("Expected %q not to be transient", err)
+		}
+	}
+}
+
+func TestGroupOutput(t *testing.T) {
+	hostnames := map[string]int{"test-group-a": 3, "test-group-b": 2}
+	var hosts []string
+
+	for hostname, cnt := range hostnames {
+		for i := 0; i < cnt; i++ {
+			srv := &testSSHServer{hostname: hostname}
+			srv.start()
+			hosts = append(hosts, srv.addr)
+		}
+	}
+
+	req := makeProxyRequest(maxTimeout)
+	req.Hosts = hosts
+	req.GroupOutput = true
+	requestsChan <- req
+
+	var groups []*GroupedReply
+	for done := false; !done; {
+		select {
+		case reply := <-repliesChan:
+			switch reply := reply.(type) {
+			case *Reply:
+				t.Fatalf("Unexpected per-host reply from %s", reply.Hostname)
+			case *GroupedReply:
+				groups = append(groups, reply)
+			case *FinalReply:
+				done = true
+			}
+		case <-time.After(maxTimeout):
+			t.Fatalf("Timed out waiting for grouped replies")
+		}
+	}
+
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 groups, got %d", len(groups))
+	}
+
+	if groups[0].Stdout != "test-group-a" || len(groups[0].Hosts) != 3 || groups[1].Stdout != "test-group-b" || len(groups[1].Hosts) != 2 {
+		t.Fatalf("Unexpected groups: %+v, %+v", groups[0], groups[1])
+	}
+}
+
+func TestSortReplies(t *testing.T) {
+	var hosts []string
+	for i := 0; i < 5; i++ {
+		srv := &testSSHServer{hostname: "test-sort"}
+		srv.start()
+		hosts = append(hosts, srv.addr)
+	}
+
+	for _, order := range []string{"input", "name"} {
+		req := makeProxyRequest(maxTimeout)
+		req.Hosts = append([]string{}, hosts...)
+		req.Sort = order
+		requestsChan <- req
+
+		var got []string
+		for done := false; !done; {
+			select {
+			case reply := <-repliesChan:
+				switch reply := reply.(type) {
+				case *Reply:
+					got = append(got, reply.Hostname)
+				case *FinalReply:
+					done = true
+				}
+			case <-time.After(maxTimeout):
+				t.Fatalf("Timed out waiting for replies")
+			}
+		}
+
+		expected := append([]string{}, hosts...)
+		if order == "name" {
+			sort.Strings(expected)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Fatalf("Unexpected %s order of replies: %v", order, got)
+		}
+	}
+
+	replies := []*Reply{{Hostname: "b", Duration: 2}, {Hostname: "c", Duration: 1}, {Hostname: "a", Duration: 2}}
+	if sortReplies(replies, "duration", nil); replies[0].Hostname != "c" || replies[1].Hostname != "a" {
+		t.Fatalf("Unexpected order by duration: %s %s %s", replies[0].Hostname, replies[1].Hostname, replies[2].Hostname)
+	}
+}
+
+func TestOutputDir(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "gossha-output")
+	must(err, "Could not create output dir")
+	defer os.RemoveAll(outputDir)
+
+	r := makeTestResult()
+	startTestServers(r, "test-outdir", 5)
+
+	req := makeProxyRequest(maxTimeout)
+	req.OutputDir = outputDir
+	runTestRequest(t, r, req)
+
+	for addr, srv := range r.hosts {
+		if r.replies[addr].Stdout != "" {
+			t.Fatalf("Stdout of %s must not be sent when OutputDir is set", addr)
+		}
+
+		stdout, err := ioutil.ReadFile(filepath.Join(outputDir, downloadDirName(addr)+".out"))
+		if err != nil || string(stdout) != srv.hostname {
+			t.Fatalf("Unexpected stdout file for %s: %q (%v)", addr, stdout, err)
+		}
+
+		if _, err := os.Stat(filepath.Join(outputDir, downloadDirName(addr)+".err")); err != nil {
+			t.Fatalf("Missing stderr file for %s: %s", addr, err)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	contents := make([]byte, chunkSize*3+100)
+	src, err := ioutil.TempFile("", "gossha-progress")
+	must(err, "Could not create source file")
+	defer os.Remove(src.Name())
+	_, err = src.Write(contents)
+	must(err, "Could not write source file")
+	must(src.Close(), "Could not close source file")
+
+	r := makeTestResult()
+	startTestServers(r, "test-progress", 5)
+
+	runTestRequest(t, r, &ProxyRequest{Action: "scp", Source: src.Name(), Target: "progress.bin", Progress: true})
+
+	for addr := range r.hosts {
+		p := r.transfers[addr]
+		if p == nil || p.Bytes != int64(len(contents)) || p.TotalBytes != int64(len(contents)) {
+			t.Fatalf("Unexpected final transfer progress for %s: %+v", addr, p)
+		}
+	}
+
+	if len(r.progress) != len(r.hosts) {
+		t.Fatalf("Expected %d progress messages, got %d", len(r.hosts), len(r.progress))
+	}
+
+	if last := r.progress[len(r.progress)-1]; last.Completed != len(r.hosts) || last.Pending != 0 || last.Failed != 0 {
+		t.Fatalf("Unexpected final run progress: %+v", last)
+	}
+}
+
+func TestStdin(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-stdin", 5)
+
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = "cat"
+	req.Stdin = "line 1\nline 2\n"
+	runTestRequest(t, r, req)
+
+	for addr, reply := range r.replies {
+		if reply.Stdout != req.Stdin {
+			t.Fatalf("Unexpected stdout from %s: %q", addr, reply.Stdout)
+		}
+	}
+}
+
+// fakeSudo emulates sudo: prints prompt of -p and checks password read from stdin (unless SUDO_NOPASSWD is
+// set, like with NOPASSWD in sudoers) and runs command after "--", with RUN_AS set to the user of -u
+const fakeSudo = `#!/bin/sh
+while [ "$1" != "--" ]; do
+	case "$1" in
+	-p) shift; prompt=$1 ;;
+	-u) shift; RUN_AS=$1; export RUN_AS ;;
+	esac
+	shift
+done
+shift
+if [ -n "$prompt" ] && [ -z "$SUDO_NOPASSWD" ]; then
+	printf %s "$prompt" >&2
+	read pw
+	[ "$pw" = "secret" ] || { echo "Sorry, try again." >&2; exit 1; }
+fi
+exec "$@"
+`
+
+func TestSudo(t *testing.T) {
+	binDir, err := ioutil.TempDir("", "gossha-sudo")
+	must(err, "Could not create bin dir")
+	defer os.RemoveAll(binDir)
+	must(ioutil.WriteFile(filepath.Join(binDir, "sudo"), []byte(fakeSudo), 0755), "Could not write fake sudo")
+
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", binDir+":"+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	r := makeTestResult()
+	startTestServers(r, "test-sudo", 3)
+
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = "cat; echo \"it's $TEST_HOSTNAME\""
+	req.Stdin = "data\n"
+	req.Sudo = true
+	req.SudoPassword = "secret"
+	runTestRequest(t, r, req)
+
+	for addr, reply := range r.replies {
+		if expected := "data\nit's " + r.hosts[addr].hostname + "\n"; reply.Stdout != expected || reply.Stderr != "" {
+			t.Fatalf("Unexpected output from %s: %q, %q", addr, reply.Stdout, reply.Stderr)
+		}
+	}
+
+	// sudo that does not ask for the password must not pass it to the command
+	r = makeTestResult()
+	startTestServers(r, "test-sudo-nopasswd", 3)
+	req.Hosts, req.Cmd = nil, "cat"
+	req.Env = map[string]string{"SUDO_NOPASSWD": "1"}
+	runTestRequest(t, r, req)
+
+	for addr, reply := range r.replies {
+		if reply.Stdout != "data\n" || reply.Stderr != "" {
+			t.Fatalf("Unexpected output from %s with NOPASSWD: %q, %q", addr, reply.Stdout, reply.Stderr)
+		}
+	}
+}
+
+func TestPty(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-pty", 3)
+
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = "echo pty=$TEST_PTY"
+	req.Pty = true
+	runTestRequest(t, r, req)
+
+	for addr, reply := range r.replies {
+		if reply.Stdout != "pty=1\n" {
+			t.Fatalf("Expected pty to be requested for %s, got %q", addr, reply.Stdout)
+		}
+	}
+}
+
+func TestEnv(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-env", 3)
+
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = `echo "$GREETING, $NAME"`
+	req.Env = map[string]string{"GREETING": "hello", "NAME": "it's me; $HOME"}
+	runTestRequest(t, r, req)
+
+	for addr, reply := range r.replies {
+		if reply.Stdout != "hello, it's me; $HOME\n" {
+			t.Fatalf("Unexpected stdout from %s: %q", addr, reply.Stdout)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	src, err := ioutil.TempFile("", "gossha-script")
+	must(err, "Could not create script")
+	defer os.Remove(src.Name())
+	_, err = src.WriteString("#!/bin/sh\nfor arg in \"$@\"; do echo \"[$arg]\"; done\necho \"$TEST_HOSTNAME\"\n")
+	must(err, "Could not write script")
+	must(src.Close(), "Could not close script")
+
+	r := makeTestResult()
+	startTestServers(r, "test-script", 3)
+
+	runTestRequest(t, r, &ProxyRequest{Action: "script", Source: src.Name(), Args: []string{"a b", "it's"}})
+
+	for addr, reply := range r.replies {
+		if expected := "[a b]\n[it's]\n" + r.hosts[addr].hostname + "\n"; reply.Stdout != expected {
+			t.Fatalf("Unexpected stdout from %s: %q", addr, reply.Stdout)
+		}
+
+		files, _ := filepath.Glob(filepath.Join(r.hosts[addr].root, ".gossha-script-*"))
+		if len(files) != 0 {
+			t.Fatalf("Script was not removed from %s: %v", addr, files)
+		}
+	}
+}
+
+func TestMultipleCommands(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-cmds", 3)
+
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = ""
+	req.Cmds = []string{"echo first", "hostname", "exit 3", "echo never"}
+
+	req.Timeout = uint64(maxTimeout / time.Millisecond)
+	for h := range r.hostsLeft {
+		req.Hosts = append(req.Hosts, h)
+	}
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+
+	for addr, reply := range r.replies {
+		if reply.Success || reply.ExitCode != 3 || len(reply.Commands) != 3 {
+			t.Fatalf("Unexpected result for %s: %+v", addr, reply)
+		}
+
+		if reply.Stdout != "first\n"+r.hosts[addr].hostname || !reply.Commands[1].Success || reply.Commands[2].ExitCode != 3 {
+			t.Fatalf("Unexpected command results for %s: %q, %+v", addr, reply.Stdout, reply.Commands)
+		}
+
+		if atomic.LoadInt32(&r.hosts[addr].connections) != 1 {
+			t.Fatalf("Commands must be executed over single connection")
+		}
+	}
+}
+
+func TestAgentForwarding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossha-agent")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	key, err := ssh.ParseRawPrivateKey([]byte(idRsa))
+	must(err, "Could not parse private key")
+
+	keyring := agent.NewKeyring()
+	must(keyring.Add(agent.AddedKey{PrivateKey: key}), "Could not add key to agent")
+
+	list, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	must(err, "Could not listen agent socket")
+	defer list.Close()
+
+	go func() {
+		for {
+			c, err := list.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(keyring, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	agentForwardSock = list.Addr().String()
+	defer func() { agentForwardSock = "" }()
+
+	r := makeTestResult()
+	startTestServers(r, "test-agent", 3)
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "agent-keys"})
+
+	for addr, reply := range r.replies {
+		if reply.Stdout != "1" {
+			t.Fatalf("Expected 1 forwarded key on %s, got %q", addr, reply.Stdout)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dryRun = true
+	defer func() { dryRun = false }()
+
+	r := makeTestResult()
+	startTestServers(r, "test-dry-run", 3)
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "touch created", Sudo: true})
+
+	for addr, reply := range r.replies {
+		if !strings.Contains(reply.Stdout, "Run: sudo -n -- /bin/sh -c 'touch created'\n") || !strings.Contains(reply.Stdout, "@127.0.0.1:") {
+			t.Fatalf("Unexpected dry run output for %s: %q", addr, reply.Stdout)
+		}
+
+		if atomic.LoadInt32(&r.hosts[addr].connections) != 0 {
+			t.Fatalf("Dry run must not connect to hosts")
+		}
+
+		if _, err := os.Stat(filepath.Join(r.hosts[addr].root, "created")); err == nil {
+			t.Fatalf("Command must not be executed in dry run")
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(10 << 20)
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		l.wait(100 << 10)
+	}
+
+	// first write is not delayed, each of others waits for 100K / 10M per second
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Fatalf("Unexpected time of limited writes: %s", elapsed)
+	}
+
+	if rate, err := parseByteRate("512K"); err != nil || rate != 512<<10 {
+		t.Fatalf("Unexpected rate: %d, %v", rate, err)
+	}
+}
+
+func TestConnectRate(t *testing.T) {
+	connectLimiter = newRateLimiter(20)
+	defer func() { connectLimiter = nil }()
+
+	r := makeTestResult()
+	startTestServers(r, "test-connect-rate", 5)
+
+	// first connection is not delayed, each of others waits for 1/20 s
+	start := time.Now()
+	runTestRequest(t, r, makeProxyRequest(maxTimeout))
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Fatalf("Connections were not paced: %s", elapsed)
+	}
+}
+
+func TestVerifyRemoteFile(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-verify", 1)
+
+	for addr, srv := range r.hosts {
+		must(ioutil.WriteFile(filepath.Join(srv.root, "file"), []byte("truncated"), 0644), "Could not write file")
+
+		conf, _ := makeConfig()
+		conn, err := dialHost(addr, conf)
+		must(err, "Could not connect")
+		defer conn.Close()
+
+		client, err := newSftpClient(conn)
+		must(err, "Could not start sftp")
+		defer client.Close()
+
+		if err := verifyRemoteFile(conn, client, "file", sha256Hex([]byte("truncated"))); err != nil {
+			t.Fatalf("Checksums must match: %s", err)
+		}
+
+		if err := verifyRemoteFile(conn, client, "file", sha256Hex([]byte("truncated file"))); err == nil || !strings.Contains(err.Error(), "Checksum mismatch") {
+			t.Fatalf("Expected checksum mismatch, got %v", err)
+		}
+
+		if sum, err := readBackSHA256(client, "file"); err != nil || sum != sha256Hex([]byte("truncated")) {
+			t.Fatalf("Unexpected checksum read over sftp: %s, %v", sum, err)
+		}
+	}
+}
+
+func TestUploadSources(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "gossha-sources")
+	must(err, "Could not create source dir")
+	defer os.RemoveAll(srcDir)
+
+	for _, name := range []string{"a.toml", "b.toml", "c.txt", "d.txt"} {
+		must(ioutil.WriteFile(filepath.Join(srcDir, name), []byte("contents of "+name), 0644), "Could not write source file")
+	}
+
+	r := makeTestResult()
+	startTestServers(r, "test-sources", 2)
+
+	runTestRequest(t, r, &ProxyRequest{
+		Action:  "scp",
+		Sources: []string{filepath.Join(srcDir, "*.toml"), filepath.Join(srcDir, "c.txt")},
+		Target:  "conf",
+	})
+
+	for addr, reply := range r.replies {
+		if len(reply.Files) != 3 || reply.Files[2].Target != "conf/c.txt" || !reply.Files[2].Success {
+			t.Fatalf("Unexpected file results of %s: %+v", addr, reply.Files)
+		}
+
+		for _, name := range []string{"a.toml", "b.toml", "c.txt"} {
+			if got, err := ioutil.ReadFile(filepath.Join(r.hosts[addr].root, "conf", name)); err != nil || string(got) != "contents of "+name {
+				t.Fatalf("Unexpected contents of %s on %s: %q, %v", name, addr, got, err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(r.hosts[addr].root, "conf", "d.txt")); err == nil {
+			t.Fatalf("File that does not match must not be uploaded")
+		}
+	}
+
+	if _, err := expandUploadSources([]string{filepath.Join(srcDir, "*.yml")}, "conf"); err == nil {
+		t.Fatalf("Pattern without matches must be rejected")
+	}
+	if _, err := expandUploadSources([]string{filepath.Join(srcDir, "c.txt"), "other/c.txt"}, "conf"); err == nil {
+		t.Fatalf("Sources with the same name must be rejected")
+	}
+}
+
+func TestUploadData(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-upload-data", 2)
+
+	req := new(ProxyRequest)
+	must(json.Unmarshal([]byte(`{"Action":"scp","Source":"-","Data":"AAH/dGd6","Target":"tmp/app.tgz"}`), req), "Could not parse request")
+	runTestRequest(t, r, req)
+
+	for addr := range r.replies {
+		if got, err := ioutil.ReadFile(filepath.Join(r.hosts[addr].root, "tmp", "app.tgz")); err != nil || string(got) != "\x00\x01\xfftgz" {
+			t.Fatalf("Unexpected contents on %s: %q, %v", addr, got, err)
+		}
+	}
+}
+
+func TestUploadLargeFile(t *testing.T) {
+	src, err := ioutil.TempFile("", "gossha-large")
+	must(err, "Could not create source file")
+	defer os.Remove(src.Name())
+
+	contents := make([]byte, 3*chunkSize+17)
+	rand.Read(contents)
+	_, err = src.Write(contents)
+	must(err, "Could not write source file")
+	must(src.Close(), "Could not close source file")
+
+	r := makeTestResult()
+	startTestServers(r, "test-large", 2)
+	runTestRequest(t, r, &ProxyRequest{Action: "scp", Source: src.Name(), Target: "large.bin", Verify: true})
+
+	for addr := range r.replies {
+		if got, err := ioutil.ReadFile(filepath.Join(r.hosts[addr].root, "large.bin")); err != nil || !bytes.Equal(got, contents) {
+			t.Fatalf("Unexpected contents on %s: %d bytes, %v", addr, len(got), err)
+		}
+	}
+
+	// file is streamed from disk, so changes after it was listed are detected
+	entries, err := readUploadSource(src.Name())
+	must(err, "Could not read source")
+	must(ioutil.WriteFile(src.Name(), contents[:100], 0644), "Could not truncate source file")
+
+	for addr := range r.replies {
+		if _, _, err := uploadFile("large.bin", entries, &uploadOptions{attrs: &sftpAttrs{}}, addr); err == nil || !strings.Contains(err.Error(), "changed during upload") {
+			t.Fatalf("Truncated source must be detected: %v", err)
+		}
+		if got, _ := ioutil.ReadFile(filepath.Join(r.hosts[addr].root, "large.bin")); !bytes.Equal(got, contents) {
+			t.Fatalf("Failed upload must not replace target on %s", addr)
+		}
+	}
+}
+
+func TestParallelUpload(t *testing.T) {
+	src, err := ioutil.TempFile("", "gossha-parallel")
+	must(err, "Could not create source file")
+	defer os.Remove(src.Name())
+
+	contents := make([]byte, 3*chunkSize+17)
+	rand.Read(contents)
+	_, err = src.Write(contents)
+	must(err, "Could not write source file")
+	must(src.Close(), "Could not close source file")
+
+	defer func(size int64) { parallelUploadMinSize = size }(parallelUploadMinSize)
+	parallelUploadMinSize = chunkSize
+
+	r := makeTestResult()
+	startTestServers(r, "test-parallel", 2)
+	runTestRequest(t, r, &ProxyRequest{Action: "scp", Source: src.Name(), Target: "parallel.bin", Parallel: 3})
+
+	for addr := range r.replies {
+		if got, err := ioutil.ReadFile(filepath.Join(r.hosts[addr].root, "parallel.bin")); err != nil || !bytes.Equal(got, contents) {
+			t.Fatalf("Unexpected contents on %s: %d bytes, %v", addr, len(got), err)
+		}
+	}
+
+	if _, err := parseUploadOptions(&ProxyRequest{Action: "scp", Parallel: maxParallelUploads + 1}); err == nil {
+		t.Fatalf("Too many parallel sessions must be rejected")
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	contents := make([]byte, 2*chunkSize+5)
+	rand.Read(contents)
+	entry := &uploadEntry{size: int64(len(contents)), contents: contents}
+
+	r := makeTestResult()
+	startTestServers(r, "test-resume", 1)
+
+	for addr, srv := range r.hosts {
+		partial := filepath.Join(srv.root, "resume.bin"+uploadTmpSuffix)
+
+		conf, _ := makeConfig()
+		conn, err := dialHost(addr, conf)
+		must(err, "Could not connect")
+		defer conn.Close()
+
+		client, err := newSftpClient(conn)
+		must(err, "Could not start sftp")
+		defer client.Close()
+
+		must(ioutil.WriteFile(partial, contents[:chunkSize+3], 0644), "Could not write partial file")
+		if off, err := resumeOffset(conn, client, "resume.bin"+uploadTmpSuffix, entry); err != nil || off != chunkSize+3 {
+			t.Fatalf("Partial file must be continued from its size: %d, %v", off, err)
+		}
+
+		// partial file of different contents is uploaded anew
+		must(ioutil.WriteFile(partial, []byte("other"), 0644), "Could not write partial file")
+		if off, err := resumeOffset(conn, client, "resume.bin"+uploadTmpSuffix, entry); err != nil || off != 0 {
+			t.Fatalf("Mismatching partial file must not be continued: %d, %v", off, err)
+		}
+
+		must(ioutil.WriteFile(partial, contents[:chunkSize+3], 0644), "Could not write partial file")
+	}
+
+	runTestRequest(t, r, &ProxyRequest{Action: "scp", Source: dataSource, Data: contents, Target: "resume.bin", Resume: true, Verify: true})
+
+	for addr := range r.replies {
+		if got, err := ioutil.ReadFile(filepath.Join(r.hosts[addr].root, "resume.bin")); err != nil || !bytes.Equal(got, contents) {
+			t.Fatalf("Unexpected contents on %s: %d bytes, %v", addr, len(got), err)
+		}
+	}
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	src, err := ioutil.TempFile("", "gossha-upload")
+	must(err, "Could not create source file")
+	defer os.Remove(src.Name())
+	_, err = src.WriteString("contents")
+	must(err, "Could not write source file")
+	must(src.Close(), "Could not close source file")
+
+	r := makeTestResult()
+	startTestServers(r, "test-skip-unchanged", 3)
+
+	oldTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	existing := map[string]string{}
+	i := 0
+	for addr, srv := range r.hosts {
+		// same contents, same size but different contents, no file at all
+		if i < 2 {
+			existing[addr] = []string{"contents", "Contents"}[i]
+			name := filepath.Join(srv.root, "app.bin")
+			must(ioutil.WriteFile(name, []byte(existing[addr]), 0644), "Could not write remote file")
+			must(os.Chtimes(name, oldTime, oldTime), "Could not change mtime")
+		}
+		i++
+	}
+
+	runTestRequest(t, r, &ProxyRequest{
+		Action:        "scp",
+		Source:        src.Name(),
+		Target:        "app.bin",
+		SkipUnchanged: true,
+	})
+
+	for addr, reply := range r.replies {
+		name := filepath.Join(r.hosts[addr].root, "app.bin")
+		if got, err := ioutil.ReadFile(name); err != nil || string(got) != "contents" {
+			t.Fatalf("Unexpected contents on %s: %q, %v", addr, got, err)
+		}
+
+		unchanged := existing[addr] == "contents"
+		if reply.Unchanged != unchanged {
+			t.Fatalf("Expected Unchanged=%v for %s with %q", unchanged, addr, existing[addr])
+		}
+
+		fi, err := os.Stat(name)
+		must(err, "Could not stat remote file")
+		if fi.ModTime().Equal(oldTime) != unchanged {
+			t.Fatalf("Unchanged file must not be rewritten and changed one must be (%s)", addr)
+		}
+	}
+}
+
+func TestStreamOutput(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-stream", 2)
+
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "echo one; echo err >&2; printf two", Stream: true})
+
+	streamed := make(map[string]string)
+	for _, c := range r.chunks {
+		streamed[c.Hostname+" "+c.Stream] += c.Data
+	}
+
+	for addr, reply := range r.replies {
+		if streamed[addr+" stdout"] != reply.Stdout || streamed[addr+" stderr"] != reply.Stderr || reply.Stdout != "one\ntwo" {
+			t.Fatalf("Streamed output of %s does not match reply: %q, got %+v", addr, streamed, reply)
+		}
+	}
+
+	if len(r.chunks) != 6 {
+		t.Fatalf("Expected complete lines and the rest to be sent separately, got %d chunks", len(r.chunks))
+	}
+}
+
+func TestPrefixOutput(t *testing.T) {
+	prefixOutput = true
+	defer func() { prefixOutput = false }()
+
+	r := makeTestResult()
+	startTestServers(r, "test-prefix", 1)
+
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "echo one; echo err >&2; echo two"})
+
+	// output is only streamed, so it is not duplicated in Reply
+	for addr, reply := range r.replies {
+		if reply.Stdout != "" || reply.Stderr != "" {
+			t.Fatalf("Output of %s must not be kept: %+v", addr, reply)
+		}
+	}
+
+	var out, errOut strings.Builder
+	for _, c := range r.chunks {
+		writeReplyText(&out, &errOut, c, "")
+	}
+
+	for addr := range r.replies {
+		for _, ln := range []string{addr + ": one\n", addr + ": two\n", addr + " (stderr): err\n"} {
+			if !strings.Contains(out.String(), ln) {
+				t.Fatalf("Line %q is not printed: %q", ln, out.String())
+			}
+		}
+	}
+}
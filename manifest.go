@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Upload manifest ("Manifest": "<file>" in request with Action == "scp"): YAML or JSON file that
+// lists files of a deploy, which are all uploaded to every host in one run, e.g.
+//
+//	files:
+//	  - source: build/app
+//	    target: /usr/local/bin/app
+//	    mode: "0755"
+//	  - source: conf/app.yml
+//	    target: /etc/app/app.yml
+//	    owner: "0:1000"
+//
+// Relative sources are relative to directory of the manifest. Mode and Owner of the request are
+// used for entries that do not have their own ones. Every file gets its own entry in "Files" of the
+// reply, like with "Sources".
+
+// manifestEntry is a file of upload manifest
+type manifestEntry struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Mode   string `json:"mode"`
+	Owner  string `json:"owner"`
+}
+
+// loadUploadManifest reads entries of manifest file, either a list of them or a mapping with "files" list
+func loadUploadManifest(filename string) ([]*manifestEntry, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.New("Cannot read manifest: " + err.Error())
+	}
+
+	var entries []*manifestEntry
+	if filepath.Ext(filename) == ".json" {
+		err = parseJSONManifest(data, &entries)
+	} else {
+		entries, err = parseYamlManifest(data)
+	}
+	if err != nil {
+		return nil, errors.New("Cannot parse manifest " + filename + ": " + err.Error())
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("Manifest " + filename + " has no files")
+	}
+
+	dir := filepath.Dir(filename)
+	targets := make(map[string]string)
+	for i, e := range entries {
+		if e.Source == "" || e.Target == "" {
+			return nil, fmt.Errorf("Invalid manifest %s: file #%d must have source and target", filename, i+1)
+		}
+		if e.Source == dataSource {
+			return nil, errors.New("'Data' cannot be uploaded with 'Manifest'")
+		}
+		if other, ok := targets[e.Target]; ok {
+			return nil, errors.New("Both " + other + " and " + e.Source + " would be uploaded to " + e.Target)
+		}
+		targets[e.Target] = e.Source
+		if !filepath.IsAbs(e.Source) {
+			e.Source = filepath.Join(dir, e.Source)
+		}
+	}
+	return entries, nil
+}
+
+func parseJSONManifest(data []byte, entries *[]*manifestEntry) error {
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		return json.Unmarshal(data, entries)
+	}
+	var doc struct {
+		Files []*manifestEntry `json:"files"`
+	}
+	err := json.Unmarshal(data, &doc)
+	*entries = doc.Files
+	return err
+}
+
+func parseYamlManifest(data []byte) ([]*manifestEntry, error) {
+	doc, err := parseYaml(data)
+	if err != nil {
+		return nil, err
+	}
+	if top, ok := doc.(*yamlMap); ok {
+		doc = top.Get("files")
+	}
+	list, ok := doc.([]interface{})
+	if !ok && doc != nil {
+		return nil, errors.New("files must be a list")
+	}
+
+	var res []*manifestEntry
+	for i, item := range list {
+		m, ok := item.(*yamlMap)
+		if !ok {
+			return nil, fmt.Errorf("file #%d must be a mapping", i+1)
+		}
+		res = append(res, &manifestEntry{Source: yamlString(m, "source"), Target: yamlString(m, "target"), Mode: yamlString(m, "mode"), Owner: yamlString(m, "owner")})
+	}
+	return res, nil
+}
+
+// manifestUploads returns files of manifest with upload options of every one, attributes of
+// entries override the ones of opts
+func manifestUploads(entries []*manifestEntry, opts *uploadOptions) ([]*uploadItem, error) {
+	res := make([]*uploadItem, len(entries))
+	for i, e := range entries {
+		itemOpts := opts
+		if e.Mode != "" || e.Owner != "" {
+			attrs := *opts.attrs
+			if err := setUploadAttrs(&attrs, e.Mode, e.Owner); err != nil {
+				return nil, errors.New("Invalid manifest entry for " + e.Target + ": " + err.Error())
+			}
+			withAttrs := *opts
+			withAttrs.attrs = &attrs
+			itemOpts = &withAttrs
+		}
+		res[i] = &uploadItem{source: e.Source, target: e.Target, opts: itemOpts}
+	}
+	return res, nil
+}
+
+// manifestExecFunc returns function that uploads files of manifest of msg to host
+func manifestExecFunc(msg *ProxyRequest) func(string) *SshResult {
+	if msg.Source != "" || len(msg.Sources) > 0 || msg.Target != "" || msg.Data != nil {
+		reportCriticalErrorToUser("'Manifest' cannot be combined with 'Source', 'Sources', 'Target' or 'Data'")
+		return nil
+	}
+
+	entries, err := loadUploadManifest(msg.Manifest)
+	if err != nil {
+		reportCriticalErrorToUser(err.Error())
+		return nil
+	}
+
+	opts, err := parseUploadOptions(msg)
+	if err != nil {
+		reportCriticalErrorToUser(err.Error())
+		return nil
+	}
+
+	items, err := manifestUploads(entries, opts)
+	if err != nil {
+		reportCriticalErrorToUser(err.Error())
+		return nil
+	}
+
+	sources := newUploadSourceCache()
+	for _, item := range items {
+		if _, err = sources.read(item.source); err != nil {
+			reportCriticalErrorToUser(err.Error())
+			return nil
+		}
+	}
+
+	return func(hostname string) *SshResult {
+		return uploadFiles(items, sources, hostname)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossha-manifest")
+	must(err, "Could not create manifest dir")
+	defer os.RemoveAll(dir)
+
+	must(ioutil.WriteFile(filepath.Join(dir, "app"), []byte("binary"), 0644), "Could not write source file")
+	must(ioutil.WriteFile(filepath.Join(dir, "app.yml"), []byte("config"), 0644), "Could not write source file")
+	manifest := filepath.Join(dir, "deploy.yml")
+	must(ioutil.WriteFile(manifest, []byte(`files:
+  - source: app
+    target: bin/app
+    mode: "0750"
+  - source: app.yml
+    target: etc/app.yml
+`), 0644), "Could not write manifest")
+
+	r := makeTestResult()
+	startTestServers(r, "test-manifest", 2)
+	runTestRequest(t, r, &ProxyRequest{Action: "scp", Manifest: manifest, Mode: "0640"})
+
+	for addr, reply := range r.replies {
+		if len(reply.Files) != 2 || reply.Files[0].Target != "bin/app" || !reply.Files[1].Success {
+			t.Fatalf("Unexpected file results of %s: %+v", addr, reply.Files)
+		}
+		for name, expected := range map[string]os.FileMode{"bin/app": 0750, "etc/app.yml": 0640} {
+			st, err := os.Stat(filepath.Join(r.hosts[addr].root, filepath.FromSlash(name)))
+			if err != nil || st.Mode().Perm() != expected {
+				t.Fatalf("Unexpected mode of %s on %s: %v, %v", name, addr, st, err)
+			}
+		}
+	}
+
+	jsonManifest := filepath.Join(dir, "deploy.json")
+	must(ioutil.WriteFile(jsonManifest, []byte(`[{"source":"app","target":"/a"},{"source":"app.yml","target":"/a"}]`), 0644), "Could not write manifest")
+	if _, err := loadUploadManifest(jsonManifest); err == nil {
+		t.Fatalf("Files with the same target must be rejected")
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mDNS host source: "mdns://[<service type>]?domain=local&timeout=2s&address=ip|name" browses the
+// local network for DNS-SD instances of the service (_ssh._tcp by default) with multicast DNS
+// (RFC 6762 and 6763) and returns their addresses (or .local names with address=name) with ports
+// of their SRV records. It is meant for labs and fleets of embedded devices without DNS or
+// inventory. Queries are sent over IPv4 and repeated during timeout, records that are missing from
+// replies (SRV records of instances and addresses of their targets) are asked for explicitly.
+
+const (
+	mdnsAddr           = "224.0.0.251:5353"
+	mdnsDefaultService = "_ssh._tcp"
+	mdnsDefaultTimeout = 2 * time.Second
+	mdnsQueries        = 3 // queries sent during timeout
+
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsClassIN  = 1
+)
+
+type (
+	// mdnsBrowser collects records from replies to browsing query for service
+	mdnsBrowser struct {
+		service   string                // e.g. "_ssh._tcp.local."
+		instances map[string]bool       // instance names from PTR records of service
+		srv       map[string]mdnsTarget // SRV records of instances
+		addrs     map[string][]net.IP   // A and AAAA records of targets
+	}
+
+	mdnsTarget struct {
+		host string
+		port uint16
+	}
+
+	dnsQuestion struct {
+		name  string
+		qtype uint16
+	}
+)
+
+func mdnsHosts(u *url.URL) ([]string, error) {
+	service := u.Host
+	if service == "" {
+		service = strings.Trim(u.Opaque, "/")
+	}
+	if service == "" {
+		service = mdnsDefaultService
+	}
+
+	q := u.Query()
+	domain := q.Get("domain")
+	if domain == "" {
+		domain = "local"
+	}
+
+	timeout := mdnsDefaultTimeout
+	if t := q.Get("timeout"); t != "" {
+		var err error
+		if timeout, err = time.ParseDuration(t); err != nil || timeout <= 0 {
+			return nil, errors.New("invalid timeout " + t)
+		}
+	}
+
+	byName := false
+	switch q.Get("address") {
+	case "", "ip":
+	case "name":
+		byName = true
+	default:
+		return nil, errors.New("address must be ip or name")
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	dst, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := browseMDNS(conn, dst, service+"."+domain, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return b.hosts(byName), nil
+}
+
+// browseMDNS sends queries for instances of service to dst over conn and collects replies until timeout
+func browseMDNS(conn net.PacketConn, dst net.Addr, service string, timeout time.Duration) (*mdnsBrowser, error) {
+	b := &mdnsBrowser{
+		service:   strings.ToLower(strings.TrimSuffix(service, ".") + "."),
+		instances: make(map[string]bool),
+		srv:       make(map[string]mdnsTarget),
+		addrs:     make(map[string][]net.IP),
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 9000) // mDNS messages may use jumbo frames
+
+	for i := 0; i < mdnsQueries; i++ {
+		if _, err := conn.WriteTo(buildDNSQuery(b.questions()), dst); err != nil {
+			return nil, errors.New("Cannot send mDNS query: " + err.Error())
+		}
+
+		next := time.Now().Add(timeout / mdnsQueries)
+		if i == mdnsQueries-1 || next.After(deadline) {
+			next = deadline
+		}
+		conn.SetReadDeadline(next)
+
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, errors.New("Cannot receive mDNS reply: " + err.Error())
+			}
+			b.add(buf[:n]) // malformed replies of other devices are ignored
+		}
+	}
+
+	return b, nil
+}
+
+// questions returns query for instances of service and for records that are missing from earlier replies
+func (b *mdnsBrowser) questions() []dnsQuestion {
+	res := []dnsQuestion{{b.service, dnsTypePTR}}
+	for instance := range b.instances {
+		target, ok := b.srv[instance]
+		if !ok {
+			res = append(res, dnsQuestion{instance, dnsTypeSRV})
+		} else if len(b.addrs[target.host]) == 0 {
+			res = append(res, dnsQuestion{target.host, dnsTypeA}, dnsQuestion{target.host, dnsTypeAAAA})
+		}
+	}
+	return res
+}
+
+// add collects records of reply msg, all sections are used because responders put SRV and address records into additional one
+func (b *mdnsBrowser) add(msg []byte) error {
+	if len(msg) < 12 {
+		return errors.New("short DNS message")
+	}
+	if msg[2]&0x80 == 0 {
+		return nil // query of another host
+	}
+
+	off := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		var err error
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return err
+		}
+		off += 4
+	}
+
+	records := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	for i := 0; i < records; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return err
+		}
+		if next+10 > len(msg) {
+			return errors.New("truncated DNS record")
+		}
+		rtype := binary.BigEndian.Uint16(msg[next:])
+		rdlen := int(binary.BigEndian.Uint16(msg[next+8:]))
+		rdata := next + 10
+		if rdata+rdlen > len(msg) {
+			return errors.New("truncated DNS record")
+		}
+		off = rdata + rdlen
+		name = strings.ToLower(name)
+
+		switch rtype {
+		case dnsTypePTR:
+			if name == b.service {
+				instance, _, err := readDNSName(msg, rdata)
+				if err != nil {
+					return err
+				}
+				b.instances[strings.ToLower(instance)] = true
+			}
+		case dnsTypeSRV:
+			if rdlen < 7 {
+				return errors.New("invalid SRV record")
+			}
+			target, _, err := readDNSName(msg, rdata+6)
+			if err != nil {
+				return err
+			}
+			b.srv[name] = mdnsTarget{host: strings.ToLower(target), port: binary.BigEndian.Uint16(msg[rdata+4:])}
+		case dnsTypeA, dnsTypeAAAA:
+			if rdlen == 4 || rdlen == 16 {
+				ip := net.IP(append([]byte{}, msg[rdata:rdata+rdlen]...))
+				if !containsIP(b.addrs[name], ip) {
+					b.addrs[name] = append(b.addrs[name], ip)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, el := range ips {
+		if el.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hosts returns sorted addresses (first IPv4 one if there is any) or names of instances with their ports
+func (b *mdnsBrowser) hosts(byName bool) []string {
+	seen := make(map[string]bool)
+	var res []string
+	for instance := range b.instances {
+		target, ok := b.srv[instance]
+		if !ok {
+			continue
+		}
+
+		host := strings.TrimSuffix(target.host, ".")
+		if !byName {
+			ips := b.addrs[target.host]
+			if len(ips) == 0 {
+				continue
+			}
+			sort.SliceStable(ips, func(i, j int) bool { return ips[i].To4() != nil && ips[j].To4() == nil })
+			host = ips[0].String()
+		}
+
+		if target.port != 22 {
+			host = net.JoinHostPort(host, strconv.Itoa(int(target.port)))
+		}
+		if !seen[host] {
+			seen[host] = true
+			res = append(res, host)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// buildDNSQuery encodes query with questions
+func buildDNSQuery(questions []dnsQuestion) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(questions)))
+	for _, q := range questions {
+		msg = appendDNSName(msg, q.name)
+		msg = append(msg, byte(q.qtype>>8), byte(q.qtype), 0, dnsClassIN)
+	}
+	return msg
+}
+
+// appendDNSName appends name in wire format without compression
+func appendDNSName(buf []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		buf = append(append(buf, byte(len(label))), label...)
+	}
+	return append(buf, 0)
+}
+
+// readDNSName decodes (possibly compressed) name at off, returns it with trailing dot and offset after it
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1 // offset after name if it has pointers
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("truncated DNS name")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errors.New("invalid DNS name pointer")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errors.New("truncated DNS name")
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// appendTestRecord appends resource record with name (pointer if it is a number) to msg
+func appendTestRecord(msg []byte, name interface{}, rtype uint16, rdata []byte) []byte {
+	switch name := name.(type) {
+	case int:
+		msg = append(msg, 0xc0|byte(name>>8), byte(name))
+	case string:
+		msg = appendDNSName(msg, name)
+	}
+	msg = append(msg, byte(rtype>>8), byte(rtype), 0x80, 1, 0, 0, 0x11, 0x94, byte(len(rdata)>>8), byte(len(rdata)))
+	return append(msg, rdata...)
+}
+
+func testSRV(port uint16, target string) []byte {
+	rdata := []byte{0, 0, 0, 0, byte(port >> 8), byte(port)}
+	return appendDNSName(rdata, target)
+}
+
+func TestBrowseMDNS(t *testing.T) {
+	responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	must(err, "Could not listen")
+	defer responder.Close()
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := responder.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := string(buf[:n])
+
+			reply := make([]byte, 12)
+			binary.BigEndian.PutUint16(reply[2:], 0x8400)
+			var records int
+			if strings.Contains(query, "\x04_ssh\x04_tcp\x05local\x00\x00\x0c") {
+				// "pi" has all records, "rtr" only PTR
+				reply = appendTestRecord(reply, "_ssh._tcp.local", dnsTypePTR, appendDNSName([]byte{2, 'p', 'i'}, "_ssh._tcp.local"))
+				reply = appendTestRecord(reply, 12, dnsTypePTR, append([]byte{3, 'r', 't', 'r'}, 0xc0, 12))
+				reply = appendTestRecord(reply, "pi._ssh._tcp.local", dnsTypeSRV, testSRV(22, "pi.local"))
+				reply = appendTestRecord(reply, "pi.local", dnsTypeAAAA, net.ParseIP("fe80::1"))
+				reply = appendTestRecord(reply, "pi.local", dnsTypeA, net.IPv4(192, 168, 1, 10).To4())
+				records += 5
+			}
+			if strings.Contains(query, "\x03rtr\x04_ssh\x04_tcp\x05local\x00\x00\x21") {
+				reply = appendTestRecord(reply, "rtr._ssh._tcp.local", dnsTypeSRV, testSRV(2222, "rtr.local"))
+				reply = appendTestRecord(reply, "rtr.local", dnsTypeA, net.IPv4(192, 168, 1, 1).To4())
+				records += 2
+			}
+			binary.BigEndian.PutUint16(reply[6:], uint16(records))
+			responder.WriteTo(reply, from)
+		}
+	}()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	must(err, "Could not listen")
+	defer conn.Close()
+
+	b, err := browseMDNS(conn, responder.LocalAddr(), "_ssh._tcp.local", 300*time.Millisecond)
+	must(err, "Could not browse")
+
+	if hosts := strings.Join(b.hosts(false), " "); hosts != "192.168.1.10 192.168.1.1:2222" {
+		t.Fatalf("Unexpected hosts: %s", hosts)
+	}
+	if hosts := strings.Join(b.hosts(true), " "); hosts != "pi.local rtr.local:2222" {
+		t.Fatalf("Unexpected hosts by name: %s", hosts)
+	}
+
+	for _, src := range []string{"mdns://?timeout=x", "mdns://?address=mac"} {
+		u, _ := url.Parse(src)
+		if _, err := mdnsHosts(u); err == nil {
+			t.Fatalf("Invalid source %s must be rejected", src)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics in Prometheus text format, served on /metrics in HTTP API mode (-serve). They are
+// collected in every mode, client library is not used to keep dependencies minimal.
+
+var defaultDurationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type (
+	metric interface {
+		write(w io.Writer)
+	}
+
+	counterVec struct {
+		name, help string
+		labels     []string
+
+		mu     sync.Mutex
+		values map[string]float64 // by label values joined with "\xff"
+	}
+
+	histogramVec struct {
+		name, help string
+		labels     []string
+		buckets    []float64
+
+		mu     sync.Mutex
+		values map[string]*histogram
+	}
+
+	histogram struct {
+		counts []uint64 // per bucket, not cumulative
+		sum    float64
+		count  uint64
+	}
+
+	gauge struct {
+		name, help string
+		value      int64
+	}
+)
+
+var (
+	metricConnections    = newCounterVec("gossha_connections_total", "SSH connection attempts by host and result (ok or failed)", "host", "result")
+	metricAuthFailures   = newCounterVec("gossha_auth_failures_total", "SSH connections that failed to authenticate", "host")
+	metricHostResults    = newCounterVec("gossha_host_results_total", "Actions finished on hosts by action and result (ok or failed)", "action", "result")
+	metricActionDuration = newHistogramVec("gossha_action_duration_seconds", "Time spent on action on a single host", defaultDurationBuckets, "action")
+	metricUploadedBytes  = newCounterVec("gossha_uploaded_bytes_total", "Bytes uploaded over SFTP")
+	metricActiveSessions = &gauge{name: "gossha_active_sessions", help: "SSH sessions (commands and SFTP) that are currently open"}
+
+	allMetrics = []metric{metricConnections, metricAuthFailures, metricHostResults, metricActionDuration, metricUploadedBytes, metricActiveSessions}
+)
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	c.values[strings.Join(labelValues, "\xff")] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, ""), formatFloat(c.values[key]))
+	}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+
+	for i, le := range h.buckets {
+		if v <= le {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hist := h.values[key]
+
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), hist.count)
+	}
+}
+
+func (g *gauge) add(delta int64) {
+	atomic.AddInt64(&g.value, delta)
+}
+
+func (g *gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, atomic.LoadInt64(&g.value))
+}
+
+func writeMetrics(w io.Writer) {
+	for _, m := range allMetrics {
+		m.write(w)
+	}
+}
+
+// formatLabels formats label values joined with "\xff" (and "le" label of histogram bucket if it is not empty)
+func formatLabels(names []string, key, le string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, names[i]+"="+quoteLabelValue(v))
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, "le="+quoteLabelValue(le))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func quoteLabelValue(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
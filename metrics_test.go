@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	c := newCounterVec("test_total", "Test counter", "host", "result")
+	c.add(1, "web\"1", "ok")
+	c.add(2, "web\"1", "ok")
+	c.add(1, "db", "failed")
+
+	h := newHistogramVec("test_seconds", "Test histogram", []float64{0.5, 1}, "action")
+	h.observe(0.2, "ssh")
+	h.observe(0.7, "ssh")
+	h.observe(3, "ssh")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	h.write(&buf)
+
+	expected := `# HELP test_total Test counter
+# TYPE test_total counter
+test_total{host="db",result="failed"} 1
+test_total{host="web\"1",result="ok"} 3
+# HELP test_seconds Test histogram
+# TYPE test_seconds histogram
+test_seconds_bucket{action="ssh",le="0.5"} 1
+test_seconds_bucket{action="ssh",le="1"} 2
+test_seconds_bucket{action="ssh",le="+Inf"} 3
+test_seconds_sum{action="ssh"} 3.9
+test_seconds_count{action="ssh"} 3
+`
+	if buf.String() != expected {
+		t.Fatalf("Unexpected metrics:\n%s", buf.String())
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-metrics", 1)
+	runTestRequest(t, r, makeProxyRequest(maxTimeout))
+
+	srv := httptest.NewServer(newAPIServer("", nil))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	must(err, "Could not get metrics")
+	defer resp.Body.Close()
+
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+
+	for addr := range r.hosts {
+		if !strings.Contains(buf.String(), `gossha_connections_total{host="`+addr+`",result="ok"} 1`) {
+			t.Fatalf("No successful connection to %s in metrics:\n%s", addr, buf.String())
+		}
+	}
+
+	if !strings.Contains(buf.String(), `gossha_action_duration_seconds_count{action="ssh"}`) || !strings.Contains(buf.String(), "\ngossha_active_sessions ") {
+		t.Fatalf("Unexpected metrics:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// Mirrored directories ("Mirror": true for "scp", -mirror of put/mscp): Target directory is made a
+// mirror of local Source directory. Only files that are missing or differ by SHA-256 are uploaded,
+// and with "MirrorDelete" (-delete) remote files and directories that are not in Source (or have
+// a different type) are removed before uploading; symlinks are removed, not followed. Reply has
+// "Changes" for every file like with ChangeReport, plus "deleted" ones. "MirrorPlan" (-plan)
+// connects to every host and only reports changes that would be made, with "Planned": true, so that
+// the diff of every host can be reviewed before it is applied. Mirror needs SFTP and cannot be
+// combined with "Sudo" or "Relay".
+
+// mirrorDeletion is remote file or directory that is removed to mirror Source
+type mirrorDeletion struct {
+	change *FileChange
+	isDir  bool
+}
+
+// isSftpDir tells whether attrs are attributes of directory
+func isSftpDir(attrs *sftpAttrs) bool {
+	return attrs.Flags&sshFileXferAttrPermissions != 0 && attrs.Perm&0170000 == 0040000
+}
+
+// checkMirrorOptions validates "Mirror" options of msg, which uploads entries
+func checkMirrorOptions(msg *ProxyRequest, entries []*uploadEntry) error {
+	if !msg.Mirror {
+		return errors.New("'MirrorDelete' and 'MirrorPlan' can only be used with 'Mirror'")
+	}
+	if len(entries) == 0 || !entries[0].isDir || len(msg.Sources) > 0 {
+		return errors.New("'Mirror' can only be used to upload a single local directory")
+	}
+	if msg.Sudo || msg.Relay > 0 {
+		return errors.New("'Sudo' and 'Relay' cannot be used with 'Mirror'")
+	}
+	return nil
+}
+
+// mirrorExtraneous returns remote files and directories under target that are not in entries, or
+// have different type; directories go after their contents, so they can be removed in this order
+func mirrorExtraneous(client *sftpClient, target string, entries []*uploadEntry) ([]*mirrorDeletion, error) {
+	local := make(map[string]bool) // relative path -> is directory
+	for _, entry := range entries {
+		local[entry.relPath] = entry.isDir
+	}
+
+	var res []*mirrorDeletion
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		dir := path.Join(target, rel)
+		list, err := client.ReadDir(dir)
+		if err != nil {
+			return errors.New("Cannot list " + dir + ": " + err.Error())
+		}
+		for _, e := range list {
+			relPath := path.Join(rel, e.name)
+			isDir := isSftpDir(e.attrs)
+			isFile := e.attrs.Flags&sshFileXferAttrPermissions == 0 || e.attrs.Perm&0170000 == 0100000
+			if wantDir, ok := local[relPath]; ok && (wantDir && isDir || !wantDir && isFile) {
+				if isDir {
+					if err := walk(relPath); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if isDir {
+				if err := collectRemoteTree(client, path.Join(target, relPath), e.attrs, &res); err != nil {
+					return err
+				}
+				continue
+			}
+			res = append(res, &mirrorDeletion{change: &FileChange{Target: path.Join(target, relPath), Change: "deleted", Previous: newFileState(e.attrs)}})
+		}
+		return nil
+	}
+
+	if attrs, err := client.Stat(target); isSftpNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.New("Cannot stat " + target + ": " + err.Error())
+	} else if !isSftpDir(attrs) {
+		return nil, errors.New(target + " exists and is not a directory")
+	}
+	return res, walk("")
+}
+
+// collectRemoteTree appends deletion of dir with attrs and all its contents to res, contents go first
+func collectRemoteTree(client *sftpClient, dir string, attrs *sftpAttrs, res *[]*mirrorDeletion) error {
+	list, err := client.ReadDir(dir)
+	if err != nil {
+		return errors.New("Cannot list " + dir + ": " + err.Error())
+	}
+	for _, e := range list {
+		p := path.Join(dir, e.name)
+		if isSftpDir(e.attrs) {
+			if err := collectRemoteTree(client, p, e.attrs, res); err != nil {
+				return err
+			}
+			continue
+		}
+		*res = append(*res, &mirrorDeletion{change: &FileChange{Target: p, Change: "deleted", Previous: newFileState(e.attrs)}})
+	}
+	*res = append(*res, &mirrorDeletion{change: &FileChange{Target: dir, Change: "deleted", Previous: newFileState(attrs)}, isDir: true})
+	return nil
+}
+
+// isMirrorDeleted tells whether remotePath or its parent directory is one of deleted
+func isMirrorDeleted(deleted []*FileChange, remotePath string) bool {
+	for _, c := range deleted {
+		if remotePath == c.Target || strings.HasPrefix(remotePath, c.Target+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// removeMirrorExtraneous removes files and directories of deletions returned by mirrorExtraneous
+// (only marks them as planned with plan) and returns changes that were made
+func removeMirrorExtraneous(client *sftpClient, deletions []*mirrorDeletion, plan bool) (changes []*FileChange, err error) {
+	for _, d := range deletions {
+		if plan {
+			d.change.Planned = true
+		} else {
+			remove := client.Remove
+			if d.isDir {
+				remove = client.Rmdir
+			}
+			if err = remove(d.change.Target); err != nil {
+				return changes, errors.New("Cannot delete " + d.change.Target + ": " + err.Error())
+			}
+		}
+		changes = append(changes, d.change)
+	}
+	return changes, nil
+}
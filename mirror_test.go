@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossha-mirror")
+	must(err, "Could not create source dir")
+	defer os.RemoveAll(dir)
+	for name, contents := range map[string]string{"same": "same\n", "a/changed": "new\n", "sub/created": "created\n"} {
+		must(os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755), "Could not create source dir")
+		must(ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644), "Could not write source file")
+	}
+
+	r := makeTestResult()
+	startTestServers(r, "test-mirror", 2)
+	for _, srv := range r.hosts {
+		for name, contents := range map[string]string{"app/same": "same\n", "app/a/changed": "old\n", "app/stale": "x", "app/olddir/f": "x", "app/sub": "file instead of directory"} {
+			must(os.MkdirAll(filepath.Join(srv.root, filepath.Dir(name)), 0755), "Could not create remote dir")
+			must(ioutil.WriteFile(filepath.Join(srv.root, name), []byte(contents), 0644), "Could not write remote file")
+		}
+	}
+
+	changesOf := func(reply *Reply, planned bool) map[string]string {
+		res := make(map[string]string)
+		for _, c := range reply.Changes {
+			if c.Planned != (planned && c.Change != "unchanged") {
+				t.Fatalf("Unexpected Planned of %s on %s: %+v", c.Target, reply.Hostname, c)
+			}
+			res[c.Target] = c.Change
+		}
+		return res
+	}
+	expected := map[string]string{
+		"app/same":        "unchanged",
+		"app/a/changed":   "replaced",
+		"app/sub/created": "created",
+		"app/stale":       "deleted",
+		"app/olddir/f":    "deleted",
+		"app/olddir":      "deleted",
+		"app/sub":         "deleted",
+	}
+
+	runTestRequest(t, r, &ProxyRequest{Action: "scp", Source: dir, Target: "app", Mirror: true, MirrorDelete: true, MirrorPlan: true})
+	for addr, reply := range r.replies {
+		if changes := changesOf(reply, true); !reply.Success || !reflect.DeepEqual(changes, expected) {
+			t.Fatalf("Unexpected plan of %s: %+v %v", addr, reply, changes)
+		}
+	}
+	for addr, srv := range r.hosts {
+		if got, _ := ioutil.ReadFile(filepath.Join(srv.root, "app/a/changed")); string(got) != "old\n" {
+			t.Fatalf("Plan must not change files on %s", addr)
+		}
+	}
+
+	sendTestRequest(t, r, &ProxyRequest{Action: "scp", Source: dir, Target: "app", Mirror: true, MirrorDelete: true})
+	for addr, reply := range r.replies {
+		if changes := changesOf(reply, false); !reply.Success || !reflect.DeepEqual(changes, expected) {
+			t.Fatalf("Unexpected changes of %s: %+v %v", addr, reply, changes)
+		}
+	}
+	for addr, srv := range r.hosts {
+		var files []string
+		filepath.Walk(filepath.Join(srv.root, "app"), func(p string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				rel, _ := filepath.Rel(srv.root, p)
+				files = append(files, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		sort.Strings(files)
+		if !reflect.DeepEqual(files, []string{"app/a/changed", "app/same", "app/sub/created"}) {
+			t.Fatalf("Target on %s is not a mirror of source: %v", addr, files)
+		}
+		if got, _ := ioutil.ReadFile(filepath.Join(srv.root, "app/a/changed")); string(got) != "new\n" {
+			t.Fatalf("Changed file was not uploaded to %s: %q", addr, got)
+		}
+	}
+
+	// the second run has nothing to do
+	sendTestRequest(t, r, &ProxyRequest{Action: "scp", Source: dir, Target: "app", Mirror: true, MirrorDelete: true})
+	for addr, reply := range r.replies {
+		if !reply.Success || !reply.Unchanged {
+			t.Fatalf("Expected mirror on %s to be unchanged: %+v", addr, reply)
+		}
+	}
+
+	if err := checkMirrorOptions(&ProxyRequest{Mirror: true}, []*uploadEntry{{size: 1}}); err == nil {
+		t.Fatalf("Expected Mirror of a single file to be rejected")
+	}
+	if err := checkMirrorOptions(&ProxyRequest{MirrorDelete: true}, []*uploadEntry{{isDir: true}}); err == nil {
+		t.Fatalf("Expected MirrorDelete without Mirror to be rejected")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Run notifications (-notify <url>): summary of every finished run is POSTed as JSON to the
+// webhook, Slack incoming webhooks (hooks.slack.com) get a message in Slack format instead.
+// With -notify-failures <percentage> only runs where more than that percentage of hosts failed
+// are reported.
+
+const maxNotifyHosts = 20 // failed hosts listed in Slack message
+
+var (
+	notifyURL            string  // webhook that run summaries are sent to (-notify)
+	notifyFailPercentage float64 // only notify if more than this percentage of hosts failed (-notify-failures)
+	notifyOnlyFailures   bool    // -notify-failures was specified
+
+	notifyClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// RunSummary is sent to notification webhook when run finishes
+type RunSummary struct {
+	User        string
+	Action      string
+	Operation   string
+	Hosts       int      // number of hosts in request
+	Succeeded   int      // hosts where action succeeded
+	Failed      int      // hosts where action failed, timed out or was not started
+	FailedHosts []string // sorted names of failed hosts
+	Duration    float64  // time of the whole run (in seconds)
+	Interrupted bool     `json:",omitempty"` // run was cancelled with Ctrl-C or by FailFast
+
+	Tags        map[string]*TagCounts `json:",omitempty"` // successful and failed hosts by "<tag>=<value>" (only if hosts have tags)
+	Annotations map[string]string     `json:",omitempty"` // annotations of failed hosts, by hostname
+}
+
+// checkNotifyURL validates -notify webhook
+func checkNotifyURL(spec string) error {
+	u, err := url.Parse(spec)
+	if err == nil && (u.Scheme != "http" && u.Scheme != "https" || u.Host == "") {
+		err = errors.New("only http:// and https:// URLs are supported")
+	}
+	if err != nil {
+		return errors.New("Invalid notification URL: " + err.Error())
+	}
+	return nil
+}
+
+// newRunSummary describes finished run of msg, failed contains all hosts that did not succeed
+func newRunSummary(msg *ProxyRequest, failed map[string]bool, duration time.Duration, interrupted bool) *RunSummary {
+	s := &RunSummary{
+		User:        localUser(),
+		Action:      msg.Action,
+		Operation:   strings.TrimSuffix(describeAction(msg), "\n"),
+		Hosts:       len(msg.Hosts),
+		Failed:      len(failed),
+		FailedHosts: []string{},
+		Duration:    duration.Seconds(),
+		Interrupted: interrupted,
+	}
+	s.Succeeded = s.Hosts - s.Failed
+	s.Tags = tagSummary(msg.Hosts, failed)
+	s.Annotations = failedAnnotations(failed)
+	for h := range failed {
+		s.FailedHosts = append(s.FailedHosts, h)
+	}
+	sort.Strings(s.FailedHosts)
+	return s
+}
+
+// slackMessage formats summary as Slack message text
+func (s *RunSummary) slackMessage() string {
+	status := "finished"
+	if s.Interrupted {
+		status = "cancelled"
+	}
+
+	text := fmt.Sprintf("gossha run by %s %s: `%s` on %d host(s), %d ok, %d failed (%.1fs)", s.User, status, s.Operation, s.Hosts, s.Succeeded, s.Failed, s.Duration)
+	if len(s.FailedHosts) > 0 {
+		hosts := s.FailedHosts
+		if len(hosts) > maxNotifyHosts {
+			hosts = append(hosts[:maxNotifyHosts:maxNotifyHosts], fmt.Sprintf("and %d more", len(s.FailedHosts)-maxNotifyHosts))
+		}
+		text += "\nFailed: " + strings.Join(hosts, ", ")
+	}
+	if annotations := formatAnnotations(s.Annotations); len(annotations) > 0 {
+		if len(annotations) > maxNotifyHosts {
+			annotations = append(annotations[:maxNotifyHosts:maxNotifyHosts], fmt.Sprintf("and %d more", len(s.Annotations)-maxNotifyHosts))
+		}
+		text += "\n" + strings.Join(annotations, "\n")
+	}
+	if tags := formatTagSummary(s.Tags, true); len(tags) > 0 {
+		text += "\nBy tag: " + strings.Join(tags, "; ")
+	}
+	return text
+}
+
+// notifyRun sends summary to notification webhook, unless it is disabled or threshold is not reached
+func notifyRun(s *RunSummary) error {
+	if notifyURL == "" || notifyOnlyFailures && !tooManyFailures(s.Failed, s.Hosts, notifyFailPercentage) {
+		return nil
+	}
+
+	var payload interface{} = s
+	if u, _ := url.Parse(notifyURL); u.Host == "hooks.slack.com" {
+		payload = map[string]string{"text": s.slackMessage()}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := notifyClient.Post(notifyURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// webhook URLs contain secrets, so they are not included in errors
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return errors.New("Cannot send notification: " + err.Error())
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return errors.New("Cannot send notification: webhook returned " + resp.Status)
+	}
+	return nil
+}
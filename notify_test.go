@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNotify(t *testing.T) {
+	summaries := make(chan *RunSummary, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var s RunSummary
+		must(json.NewDecoder(r.Body).Decode(&s), "Could not decode summary")
+		summaries <- &s
+	}))
+	defer hook.Close()
+
+	notifyURL = hook.URL
+	defer func() { notifyURL, notifyOnlyFailures, notifyFailPercentage = "", false, 0 }()
+
+	r := makeTestResult()
+	startTestServers(r, "test-notify", 2)
+	var failed string
+	for addr, srv := range r.hosts {
+		failed, srv.exitStatus = addr, 1
+		break
+	}
+
+	run := func() {
+		req := makeProxyRequest(maxTimeout)
+		for addr := range r.hosts {
+			req.Hosts = append(req.Hosts, addr)
+			r.hostsLeft[addr] = struct{}{}
+		}
+		requestsChan <- req
+		waitReply(t, r, maxTimeout)
+	}
+
+	run()
+	s := <-summaries
+	if s.Hosts != 2 || s.Succeeded != 1 || s.Failed != 1 || len(s.FailedHosts) != 1 || s.FailedHosts[0] != failed || s.Operation != "Run: hostname" {
+		t.Fatalf("Unexpected summary: %+v", s)
+	}
+
+	// half of hosts failed, which does not exceed threshold
+	notifyOnlyFailures, notifyFailPercentage = true, 50
+	run()
+	select {
+	case s := <-summaries:
+		t.Fatalf("Notification must not be sent below threshold: %+v", s)
+	default:
+	}
+
+	msg := (&RunSummary{User: "deploy", Operation: "Run: uptime", Hosts: 2, Succeeded: 1, Failed: 1, FailedHosts: []string{"web2"}, Duration: 1.25}).slackMessage()
+	if msg != "gossha run by deploy finished: `Run: uptime` on 2 host(s), 1 ok, 1 failed (1.2s)\nFailed: web2" {
+		t.Fatalf("Unexpected Slack message: %q", msg)
+	}
+
+	if err := checkNotifyURL("ftp://example.com/"); err == nil || !strings.Contains(err.Error(), "Invalid notification URL") {
+		t.Fatalf("Expected invalid URL error, got %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // hashes of signature algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDC authentication of HTTP API (-oidc-issuer and -oidc-audience): clients send ID or access
+// tokens (JWT) of the identity provider in "Authorization: Bearer <token>" header. Signatures are
+// verified with keys of the provider (jwks_uri of its discovery document, fetched again when token
+// is signed with unknown key), "iss", "aud", "exp" and "nbf" claims are checked. Claim -oidc-claim
+// ("sub" by default, e.g. "email") is identity of the client, which is recorded in jobs and audit
+// log and is matched by "users" of -policy entries.
+
+const (
+	oidcLeeway       = time.Minute      // allowed clock difference for "exp" and "nbf"
+	oidcRefreshDelay = 30 * time.Second // keys are not fetched again more often than that
+)
+
+var (
+	oidcIssuer   string // -oidc-issuer
+	oidcAudience string // -oidc-audience
+	oidcClaim    string // -oidc-claim
+)
+
+type (
+	oidcVerifier struct {
+		issuer, audience, claim string
+
+		mu      sync.Mutex
+		keys    map[string]crypto.PublicKey // by "kid"
+		fetched time.Time                   // last time keys were fetched
+	}
+
+	jwk struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+)
+
+// jwtAlgorithms are supported "alg" values of tokens
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+func newOIDCVerifier(issuer, audience, claim string) *oidcVerifier {
+	return &oidcVerifier{issuer: strings.TrimSuffix(issuer, "/"), audience: audience, claim: claim}
+}
+
+// verify checks token and returns identity of its subject
+func (v *oidcVerifier) verify(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("Token is not a JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", errors.New("Invalid token header: " + err.Error())
+	}
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return "", errors.New("Unsupported token algorithm " + header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("Invalid token signature: " + err.Error())
+	}
+	key, err := v.key(header.Kid, now)
+	if err != nil {
+		return "", err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := verifyJWTSignature(key, header.Alg, hash, h.Sum(nil), sig); err != nil {
+		return "", err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", errors.New("Invalid token claims: " + err.Error())
+	}
+	return v.checkClaims(claims, now)
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+func verifyJWTSignature(key crypto.PublicKey, alg string, hash crypto.Hash, digest, sig []byte) error {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] == "RS" && rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] == "ES" && len(sig) == 2*size {
+			r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return errors.New("Invalid token signature")
+}
+
+func (v *oidcVerifier) checkClaims(claims map[string]interface{}, now time.Time) (string, error) {
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != v.issuer {
+		return "", errors.New("Token is issued by " + iss + ", not by " + v.issuer)
+	}
+
+	audOK := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audOK = aud == v.audience
+	case []interface{}:
+		for _, a := range aud {
+			audOK = audOK || a == v.audience
+		}
+	}
+	if !audOK {
+		return "", errors.New("Token is not issued for audience " + v.audience)
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return "", errors.New("Token has no expiration time")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(oidcLeeway)) {
+		return "", errors.New("Token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", errors.New("Token is not valid yet")
+	}
+
+	identity, _ := claims[v.claim].(string)
+	if identity == "" {
+		return "", errors.New("Token has no " + v.claim + " claim")
+	}
+	return identity, nil
+}
+
+// key returns key with kid, keys of provider are fetched if it is not known yet
+func (v *oidcVerifier) key(kid string, now time.Time) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if now.Sub(v.fetched) < oidcRefreshDelay {
+		return nil, errors.New("Token is signed with unknown key " + kid)
+	}
+
+	keys, err := fetchOIDCKeys(v.issuer)
+	if err != nil {
+		return nil, err
+	}
+	v.keys, v.fetched = keys, now
+
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errors.New("Token is signed with unknown key " + kid)
+}
+
+// fetchOIDCKeys returns signing keys of issuer from jwks_uri of its discovery document
+func fetchOIDCKeys(issuer string) (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		JwksURI string `json:"jwks_uri"`
+	}
+	if err := getOIDCDocument(issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.JwksURI == "" {
+		return nil, errors.New("Discovery document of " + issuer + " has no jwks_uri")
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getOIDCDocument(discovery.JwksURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func getOIDCDocument(url string, v interface{}) error {
+	resp, err := httpAPIClient.Get(url)
+	if err != nil {
+		return errors.New("Cannot fetch " + url + ": " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Cannot fetch %s: status %d", url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.New("Cannot parse " + url + ": " + err.Error())
+	}
+	return nil
+}
+
+// publicKey converts RSA or EC key of JWK set, other keys are not supported
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		buf, err := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(buf), err
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, errors.New("Unsupported curve " + k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("Invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("Unsupported key type " + k.Kty)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signTestJWT returns token with claims signed by RS256 or ES256 with key
+func signTestJWT(key crypto.Signer, kid string, claims map[string]interface{}) string {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDC(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	must(err, "Could not generate RSA key")
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	must(err, "Could not generate EC key")
+
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": srv.URL, "jwks_uri": srv.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		ecBytes, _ := ecKey.PublicKey.Bytes() // uncompressed point
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {
+			{Kid: "rsa", Kty: "RSA", N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{Kid: "ec", Kty: "EC", Crv: "P-256", X: b64(ecBytes[1:33]), Y: b64(ecBytes[33:])},
+		}})
+	})
+
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		res := map[string]interface{}{"iss": srv.URL, "aud": []string{"other", "gossha"}, "exp": now.Add(time.Hour).Unix(), "sub": "alice@example.com"}
+		for k, v := range changes {
+			res[k] = v
+		}
+		return res
+	}
+
+	v := newOIDCVerifier(srv.URL+"/", "gossha", "sub")
+	for _, c := range []struct {
+		token string
+		err   string
+	}{
+		{signTestJWT(rsaKey, "rsa", claims(nil)), ""},
+		{signTestJWT(ecKey, "ec", claims(map[string]interface{}{"aud": "gossha"})), ""},
+		{signTestJWT(rsaKey, "rsa", claims(map[string]interface{}{"aud": "other"})), "not issued for audience"},
+		{signTestJWT(rsaKey, "rsa", claims(map[string]interface{}{"iss": "https://evil.example.com"})), "is issued by"},
+		{signTestJWT(rsaKey, "rsa", claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})), "expired"},
+		{signTestJWT(rsaKey, "ec", claims(nil)), "Invalid token signature"},
+		{signTestJWT(rsaKey, "unknown", claims(nil)), "unknown key"},
+		{strings.Replace(signTestJWT(rsaKey, "rsa", claims(nil)), ".", ".e30", 1), "Invalid token signature"},
+		{"not-a-token", "not a JWT"},
+	} {
+		user, err := v.verify(c.token, now)
+		if c.err == "" && (err != nil || user != "alice@example.com") {
+			t.Fatalf("Token is not accepted: %q, %v", user, err)
+		}
+		if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Fatalf("Unexpected error %v, expected %q", err, c.err)
+		}
+	}
+
+	// OIDC users are matched by "users" of policy
+	doc, err := parseYaml([]byte("tokens:\n  ops:\n    users: ['*@example.com']\n    actions: [ping]\n"))
+	must(err, "Could not parse policy")
+	s := newAPIServer("", nil)
+	s.oidc = v
+	s.policy, err = parsePolicy(doc)
+	must(err, "Could not load policy")
+
+	if user, client, err := s.authenticate("Bearer " + signTestJWT(rsaKey, "rsa", claims(nil))); err != nil || user != "alice@example.com" || client != s.policy.tokens[0] {
+		t.Fatalf("Unexpected identity %q, %v, %v", user, client, err)
+	}
+	if _, _, err := s.authenticate("Bearer " + signTestJWT(rsaKey, "rsa", claims(map[string]interface{}{"sub": "mallory@evil.com"}))); err == nil {
+		t.Fatalf("User outside of policy is accepted")
+	}
+	if _, _, err := s.authenticate(""); err == nil {
+		t.Fatalf("Request without token is accepted")
+	}
+}
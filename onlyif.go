@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Conditional execution ("OnlyIf": "<command>" or -only-if): the command is run on every host before
+// the action, with the same shell, Sudo and RunAs settings, and the action is only run where it
+// exits with zero status. Other hosts are reported as successful with "Skipped": true, so that
+// one-liners can be run on a mixed fleet, e.g. "OnlyIf": "test -f /etc/app/enabled". Host fails if
+// the command cannot be run at all.
+
+var onlyIfDefault string // -only-if
+
+// withOnlyIf runs OnlyIf command of msg on hosts before execFunc and skips hosts where it fails
+func withOnlyIf(msg *ProxyRequest, execFunc func(string) *SshResult) (func(string) *SshResult, error) {
+	cond := msg.OnlyIf
+	if cond == "" {
+		cond = onlyIfDefault
+	}
+	if cond == "" || dryRun {
+		return execFunc, nil
+	}
+
+	opts, err := parseCmdOptions(msg)
+	if err != nil {
+		return nil, err
+	}
+	opts.stdin, opts.stream, opts.streamOnly, opts.record, opts.maxOutput = nil, false, false, nil, 0
+
+	return func(hostname string) *SshResult {
+		_, _, err := executeCmd(cond, opts.forHost(), hostname)
+
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			logf(logInfo, hostname, "Skipped, OnlyIf command exited with status %d", exitErr.ExitStatus())
+			return &SshResult{hostname: hostname, skipped: true}
+		} else if err != nil {
+			return &SshResult{hostname: hostname, err: err}
+		}
+
+		return execFunc(hostname)
+	}, nil
+}
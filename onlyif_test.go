@@ -0,0 +1,30 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestOnlyIf(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-only-if", 2)
+
+	var enabled string
+	for addr, srv := range r.hosts {
+		enabled = addr
+		must(ioutil.WriteFile(filepath.Join(srv.root, "enabled"), nil, 0644), "Could not create file")
+		break
+	}
+
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "echo ran", OnlyIf: "test -f enabled"})
+
+	for addr, reply := range r.replies {
+		if addr == enabled && (reply.Skipped || reply.Stdout != "ran\n") {
+			t.Fatalf("Action must run where OnlyIf succeeds: %+v", reply)
+		}
+		if addr != enabled && (!reply.Skipped || !reply.Success || reply.Stdout != "") {
+			t.Fatalf("Host where OnlyIf fails must be skipped: %+v", reply)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+// Output limit ("MaxOutputBytes" or -max-output-bytes): stdout and stderr of every command are
+// buffered in memory until the command finishes, so a runaway command could use all memory of
+// GoSSHa. With the limit only that many first bytes of each stream are kept, the rest is counted
+// and dropped (streamed output and recordings still get everything) and the marker that tells how
+// many bytes were dropped is appended to the kept part; reply of the host has "Truncated": true.
+
+var (
+	maxOutputSpec  string // -max-output-bytes
+	maxOutputBytes uint64 // parsed maxOutputSpec
+)
+
+// outputLimit is the limit of output of one host, it counts bytes that were dropped by all its buffers
+type outputLimit struct {
+	max     int
+	dropped int64 // accessed atomically, stdout and stderr are written concurrently
+}
+
+// outputBuffer is bytes.Buffer that keeps at most limit.max bytes, nil limit means no limit
+type outputBuffer struct {
+	buf     bytes.Buffer
+	limit   *outputLimit
+	dropped int64
+}
+
+// newOutputLimit returns limit of output of a single run on host, nil if output is not limited
+func newOutputLimit(max uint64) *outputLimit {
+	if max == 0 {
+		return nil
+	}
+	return &outputLimit{max: int(max)}
+}
+
+func (l *outputLimit) truncated() bool {
+	return l != nil && atomic.LoadInt64(&l.dropped) > 0
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	if b.limit == nil {
+		return b.buf.Write(p)
+	}
+
+	keep := b.limit.max - b.buf.Len()
+	if keep > len(p) {
+		keep = len(p)
+	} else if keep < 0 {
+		keep = 0
+	}
+	b.buf.Write(p[:keep])
+
+	if dropped := int64(len(p) - keep); dropped > 0 {
+		b.dropped += dropped
+		atomic.AddInt64(&b.limit.dropped, dropped)
+	}
+	return len(p), nil // command must not fail because its output is not kept
+}
+
+func (b *outputBuffer) String() string {
+	if b.dropped == 0 {
+		return b.buf.String()
+	}
+	return b.buf.String() + fmt.Sprintf("\n[GoSSHa: %d more bytes were dropped, output exceeds %d bytes]\n", b.dropped, b.limit.max)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOutputBuffer(t *testing.T) {
+	limit := newOutputLimit(10)
+	b := &outputBuffer{limit: limit}
+	for _, s := range []string{"hello ", "world", "!!!"} {
+		if n, err := b.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write must consume all data: %d, %v", n, err)
+		}
+	}
+
+	if out := b.String(); !strings.HasPrefix(out, "hello worl\n") || !strings.Contains(out, "4 more bytes") || !limit.truncated() {
+		t.Fatalf("Unexpected truncated output: %q", out)
+	}
+
+	b = &outputBuffer{}
+	b.Write([]byte("unlimited"))
+	if b.String() != "unlimited" || newOutputLimit(0).truncated() {
+		t.Fatalf("Output without limit must be kept as is: %q", b.String())
+	}
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-max-output", 2)
+
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "head -c 100000 /dev/zero; echo short >&2", MaxOutputBytes: 1000})
+	for _, reply := range r.replies {
+		if !reply.Truncated || len(reply.Stdout) > 1100 || !strings.Contains(reply.Stdout, "99000 more bytes") || reply.Stderr != "short\n" {
+			t.Fatalf("Unexpected reply: truncated %v, %d bytes of stdout, stderr %q", reply.Truncated, len(reply.Stdout), reply.Stderr)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+	"sync/atomic"
+)
+
+// Output filtering ("Filter": "<regexp>" or -filter): only lines of stdout of commands and scripts
+// that match the regular expression are kept in replies and streamed output, and replies get
+// "Matches" with number of matching lines, so that fleet-wide log greps return only what matters.
+// Output is filtered as it arrives, before MaxOutputBytes applies. With "FilterRemote": true
+// (-filter-remote) stdout of command is piped to grep -E on remote host instead, so that the rest
+// of output does not cross the network; the expression must be valid for grep then, and exit status
+// of the command is kept. Stderr is never filtered, and neither are OnlyIf, Then and OnFail commands
+// and recordings.
+
+var (
+	filterDefault       string // -filter
+	filterRemoteDefault bool   // -filter-remote
+)
+
+// lineFilter passes lines that match re to w and counts them; nil re passes all lines, so that
+// lines filtered by remote grep are counted
+type lineFilter struct {
+	re      *regexp.Regexp
+	w       io.Writer
+	matches *int64 // shared by commands of host, see cmdOptions.forHost
+	buf     []byte
+}
+
+// requestFilter returns compiled "Filter" of msg (or -filter) and whether it is applied on remote side
+func requestFilter(msg *ProxyRequest) (pattern string, re *regexp.Regexp, remote bool, err error) {
+	if pattern = msg.Filter; pattern == "" {
+		pattern = filterDefault
+	}
+	if pattern == "" {
+		if msg.FilterRemote {
+			return "", nil, false, errors.New("'FilterRemote' is specified without 'Filter'")
+		}
+		return "", nil, false, nil
+	}
+	if re, err = regexp.Compile(pattern); err != nil {
+		return "", nil, false, errors.New("Invalid 'Filter': " + err.Error())
+	}
+	return pattern, re, msg.FilterRemote || filterRemoteDefault, nil
+}
+
+// remoteFilterCommand pipes stdout of cmd to grep -E pattern, exit status of cmd is kept
+func remoteFilterCommand(cmd, pattern string) string {
+	return "{ s=$( { { ( " + cmd + "\n) 3>&- 4>&-; echo $? >&3; } | grep -E -e " + shellQuote(pattern) + " >&4; } 3>&1 ); exit $s; } 4>&1"
+}
+
+func (f *lineFilter) Write(p []byte) (int, error) {
+	f.buf = append(f.buf, p...)
+
+	var err error
+	start := 0
+	for err == nil {
+		end := bytes.IndexByte(f.buf[start:], '\n') + 1
+		if end == 0 {
+			if len(f.buf)-start < outputChunkSize {
+				break
+			}
+			end = len(f.buf) - start // too long line is matched in pieces
+		}
+		err = f.line(f.buf[start : start+end])
+		start += end
+	}
+	f.buf = append(f.buf[:0], f.buf[start:]...)
+
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *lineFilter) line(line []byte) error {
+	if f.re != nil && !f.re.Match(bytes.TrimRight(line, "\r\n")) {
+		return nil
+	}
+	atomic.AddInt64(f.matches, 1)
+	_, err := f.w.Write(line)
+	return err
+}
+
+// Flush filters incomplete last line
+func (f *lineFilter) Flush() {
+	if len(f.buf) > 0 {
+		f.line(f.buf)
+		f.buf = nil
+	}
+}
+
+// filterMatches returns number of matching lines of host, nil if output is not filtered
+func (opts *cmdOptions) filterMatches() *int {
+	if opts.matches == nil {
+		return nil
+	}
+	n := int(atomic.LoadInt64(opts.matches))
+	return &n
+}
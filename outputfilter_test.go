@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+)
+
+func TestLineFilter(t *testing.T) {
+	var out bytes.Buffer
+	var matches int64
+	f := &lineFilter{re: regexp.MustCompile(`^ERROR`), w: &out, matches: &matches}
+	for _, chunk := range []string{"INFO start\nERR", "OR disk full\r\nINFO ok\n", "ERROR no newline"} {
+		f.Write([]byte(chunk))
+	}
+	f.Flush()
+
+	if out.String() != "ERROR disk full\r\nERROR no newline" || matches != 2 {
+		t.Fatalf("Unexpected filtered output: %q, %d matches", out.String(), matches)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	for _, remote := range []bool{false, true} {
+		r := makeTestResult()
+		startTestServers(r, "test-filter", 2)
+
+		req := makeProxyRequest(maxTimeout)
+		req.Cmd = "printf 'INFO start\\nERROR disk full\\nINFO done\\nERROR again\\n'; echo 'ERROR in stderr' >&2; exit 3"
+		req.Filter = "^ERROR"
+		req.FilterRemote = remote
+		sendTestRequest(t, r, req)
+
+		for addr, reply := range r.replies {
+			if reply.Stdout != "ERROR disk full\nERROR again\n" || reply.Stderr != "ERROR in stderr\n" {
+				t.Fatalf("Unexpected output from %s (remote: %v): %q, %q", addr, remote, reply.Stdout, reply.Stderr)
+			}
+			if reply.Success || reply.ExitCode != 3 || reply.Matches == nil || *reply.Matches != 2 {
+				t.Fatalf("Unexpected result from %s (remote: %v): %+v", addr, remote, reply)
+			}
+		}
+	}
+
+	r := makeTestResult()
+	startTestServers(r, "test-filter-cmds", 1)
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = ""
+	req.Cmds = []string{"echo match one; echo other", "echo match two"}
+	req.Filter = "match"
+	runTestRequest(t, r, req)
+	for addr, reply := range r.replies {
+		if reply.Stdout != "match one\nmatch two\n" || reply.Matches == nil || *reply.Matches != 2 || reply.Commands[0].Stdout != "match one\n" {
+			t.Fatalf("Unexpected result of commands from %s: %+v", addr, reply)
+		}
+	}
+
+	if _, _, _, err := requestFilter(&ProxyRequest{Filter: "("}); err == nil {
+		t.Fatalf("Expected invalid 'Filter' to be rejected")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Summary-only output ("SummaryOnly": true or -summary-only): for commands whose output is huge but
+// only their success matters (builds, data loads, verbose installers), stdout and stderr are not
+// kept at all, only counted: reply has empty "Stdout" and "Stderr" and "OutputSummary" with the
+// number of bytes and lines of each stream, and with "SummaryLines": N (or -summary-lines N) the
+// first and last N lines of them as an excerpt (lines longer than 1 KiB are cut). Memory used per
+// host does not depend on the size of output then. Streamed output and recordings still get
+// everything. Only commands and scripts are summarized; their Then/OnFail, OnlyIf and snapshot
+// commands are not.
+
+const maxSummaryLineBytes = 1024 // lines of excerpt are cut to that many bytes
+
+var (
+	summaryOnlyDefault  bool   // -summary-only
+	summaryLinesDefault uint64 // -summary-lines
+)
+
+// OutputSummary is what is reported instead of output with SummaryOnly
+type OutputSummary struct {
+	Stdout *StreamSummary
+	Stderr *StreamSummary
+}
+
+// StreamSummary is size of stdout or stderr with optional excerpt of it
+type StreamSummary struct {
+	Bytes int64
+	Lines int64    // the last line is counted even if it does not end with a newline
+	Head  []string `json:",omitempty"` // first SummaryLines lines
+	Tail  []string `json:",omitempty"` // last SummaryLines lines that are not in Head
+}
+
+// streamSummarizer counts lines written to it and keeps the first and last ones
+type streamSummarizer struct {
+	mu      sync.Mutex // commands of Cmds can run in parallel (see HostParallel)
+	keep    int
+	res     StreamSummary
+	tail    []string // ring buffer of the last lines
+	next    int      // position of the next line in tail
+	partial []byte   // unfinished line, at most maxSummaryLineBytes of it
+	open    bool     // there is unfinished line
+	cut     bool     // unfinished line is longer than maxSummaryLineBytes
+}
+
+// outputSummary summarizes stdout and stderr of run on host
+type outputSummary struct {
+	stdout, stderr *streamSummarizer
+}
+
+// requestSummary returns whether output of msg is only summarized and how many lines of excerpt are kept
+func requestSummary(msg *ProxyRequest) (bool, int, error) {
+	lines := msg.SummaryLines
+	if lines == 0 {
+		lines = summaryLinesDefault
+	}
+	if msg.SummaryOnly || summaryOnlyDefault {
+		return true, int(lines), nil
+	}
+	if msg.SummaryLines > 0 {
+		return false, 0, errors.New("'SummaryLines' is specified without 'SummaryOnly'")
+	}
+	return false, 0, nil
+}
+
+func newOutputSummary(keep int) *outputSummary {
+	return &outputSummary{stdout: &streamSummarizer{keep: keep}, stderr: &streamSummarizer{keep: keep}}
+}
+
+func (s *streamSummarizer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(p)
+	s.res.Bytes += int64(n)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			s.add(p)
+			break
+		}
+		s.add(p[:i])
+		s.finishLine()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// add appends data to the unfinished line
+func (s *streamSummarizer) add(data []byte) {
+	s.open = true
+	if s.keep == 0 {
+		return
+	}
+	if room := maxSummaryLineBytes - len(s.partial); room < len(data) {
+		data, s.cut = data[:room], true
+	}
+	s.partial = append(s.partial, data...)
+}
+
+// finishLine counts the unfinished line and adds it to the excerpt
+func (s *streamSummarizer) finishLine() {
+	line := string(s.partial)
+	if s.cut {
+		line += "..."
+	}
+	s.partial, s.open, s.cut = s.partial[:0], false, false
+	s.res.Lines++
+
+	switch {
+	case s.keep == 0:
+	case len(s.res.Head) < s.keep:
+		s.res.Head = append(s.res.Head, line)
+	case len(s.tail) < s.keep:
+		s.tail = append(s.tail, line)
+	default:
+		s.tail[s.next] = line
+		s.next = (s.next + 1) % s.keep
+	}
+}
+
+// result returns summary of everything written so far
+func (s *streamSummarizer) result() *StreamSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.open {
+		s.finishLine()
+	}
+	res := s.res
+	for i := range s.tail {
+		res.Tail = append(res.Tail, s.tail[(s.next+i)%len(s.tail)])
+	}
+	return &res
+}
+
+// outputSummary returns summary of output of run on host, nil if output is kept
+func (opts *cmdOptions) outputSummary() *OutputSummary {
+	if opts.summary == nil {
+		return nil
+	}
+	return &OutputSummary{Stdout: opts.summary.stdout.result(), Stderr: opts.summary.stderr.result()}
+}
+
+// formatOutputSummary returns human-readable description of output summary
+func formatOutputSummary(s *OutputSummary) string {
+	var b strings.Builder
+	for _, stream := range []struct {
+		name string
+		s    *StreamSummary
+	}{{"stdout", s.Stdout}, {"stderr", s.Stderr}} {
+		if stream.s.Bytes == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %d lines, %s\n", stream.name, stream.s.Lines, formatBytes(stream.s.Bytes))
+		for _, line := range stream.s.Head {
+			b.WriteString("  " + line + "\n")
+		}
+		if skipped := stream.s.Lines - int64(len(stream.s.Head)+len(stream.s.Tail)); skipped > 0 && len(stream.s.Head) > 0 {
+			fmt.Fprintf(&b, "  [%d more lines]\n", skipped)
+		}
+		for _, line := range stream.s.Tail {
+			b.WriteString("  " + line + "\n")
+		}
+	}
+	if b.Len() == 0 {
+		return "no output\n"
+	}
+	return b.String()
+}
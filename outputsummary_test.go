@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStreamSummarizer(t *testing.T) {
+	s := &streamSummarizer{keep: 2}
+	for _, chunk := range []string{"line 1\nli", "ne 2\nline 3\n", "line 4\nline 5\nline", " 6"} {
+		s.Write([]byte(chunk))
+	}
+	s.Write([]byte(strings.Repeat("x", 2*maxSummaryLineBytes)))
+	res := s.result()
+	expected := &StreamSummary{Bytes: int64(41 + 2*maxSummaryLineBytes), Lines: 6, Head: []string{"line 1", "line 2"},
+		Tail: []string{"line 5", "line 6" + strings.Repeat("x", maxSummaryLineBytes-6) + "..."}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("Unexpected summary: %+v", res)
+	}
+
+	s = &streamSummarizer{keep: 3}
+	s.Write([]byte("a\nb\nc\nd\n"))
+	if res := s.result(); res.Lines != 4 || !reflect.DeepEqual(res.Tail, []string{"d"}) {
+		t.Fatalf("Tail must not repeat lines of head: %+v", res)
+	}
+
+	s = &streamSummarizer{}
+	s.Write([]byte("a\nb"))
+	if res := s.result(); res.Lines != 2 || res.Head != nil || res.Tail != nil {
+		t.Fatalf("Unexpected summary without excerpt: %+v", res)
+	}
+}
+
+func TestSummaryOnly(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-summary", 2)
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "seq 100000; echo warning >&2", SummaryOnly: true, SummaryLines: 1})
+
+	for _, reply := range r.replies {
+		s := reply.OutputSummary
+		if reply.Stdout != "" || reply.Stderr != "" || s == nil {
+			t.Fatalf("Output must not be kept: %+v", reply)
+		}
+		if !reflect.DeepEqual(s.Stdout, &StreamSummary{Bytes: 588895, Lines: 100000, Head: []string{"1"}, Tail: []string{"100000"}}) {
+			t.Fatalf("Unexpected summary of stdout: %+v", s.Stdout)
+		}
+		if !reflect.DeepEqual(s.Stderr, &StreamSummary{Bytes: 8, Lines: 1, Head: []string{"warning"}}) {
+			t.Fatalf("Unexpected summary of stderr: %+v", s.Stderr)
+		}
+		if out := formatOutputSummary(s); !strings.HasPrefix(out, "stdout: 100000 lines, ") || !strings.Contains(out, "  1\n  [99998 more lines]\n  100000\n") {
+			t.Fatalf("Unexpected description: %s", out)
+		}
+	}
+
+	if _, _, err := requestSummary(&ProxyRequest{SummaryLines: 5}); err == nil {
+		t.Fatalf("Expected error for SummaryLines without SummaryOnly")
+	}
+}
@@ -0,0 +1,137 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Pageant does not listen on a socket: agent request is written to a shared memory mapping,
+// name of which is sent to Pageant window with WM_COPYDATA, and the reply is read from the same mapping.
+
+const (
+	pageantMaxMsgLen  = 8192       // size of shared memory mapping, as in PuTTY
+	pageantCopyDataID = 0x804e50ba // dwData of WM_COPYDATA sent to Pageant
+	wmCopyData        = 0x004a
+)
+
+var (
+	user32          = syscall.NewLazyDLL("user32.dll")
+	procFindWindow  = user32.NewProc("FindWindowW")
+	procSendMessage = user32.NewProc("SendMessageW")
+	procMoveMemory  = syscall.NewLazyDLL("kernel32.dll").NewProc("RtlMoveMemory")
+
+	pageantRequests uint32 // counter that makes names of mappings unique
+)
+
+type (
+	copyDataStruct struct {
+		dwData uintptr
+		cbData uint32
+		lpData uintptr
+	}
+
+	// pageantConn is agent connection to Pageant, every complete request written to it is sent
+	// to Pageant and the reply can be read back
+	pageantConn struct {
+		mapName []byte // NUL terminated name of shared memory mapping
+		req     []byte // request that is not complete yet
+		reply   []byte // unread part of reply
+	}
+)
+
+func findPageant() uintptr {
+	name, _ := syscall.UTF16PtrFromString("Pageant")
+	hwnd, _, _ := procFindWindow.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(name)))
+	return hwnd
+}
+
+func dialPageant() (io.ReadWriteCloser, error) {
+	if findPageant() == 0 {
+		return nil, errors.New("Pageant is not running")
+	}
+	name := fmt.Sprintf("PageantRequest%08x%08x", syscall.Getpid(), atomic.AddUint32(&pageantRequests, 1))
+	return &pageantConn{mapName: append([]byte(name), 0)}, nil
+}
+
+func (c *pageantConn) Write(p []byte) (int, error) {
+	c.req = append(c.req, p...)
+	if len(c.req) < 4 || len(c.req) < 4+int(binary.BigEndian.Uint32(c.req)) {
+		return len(p), nil
+	}
+
+	reply, err := c.query(c.req)
+	c.req = nil
+	if err != nil {
+		return 0, err
+	}
+	c.reply = append(c.reply, reply...)
+	return len(p), nil
+}
+
+func (c *pageantConn) Read(p []byte) (int, error) {
+	if len(c.reply) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.reply)
+	c.reply = c.reply[n:]
+	return n, nil
+}
+
+func (c *pageantConn) Close() error {
+	return nil
+}
+
+// query sends request (with length prefix) to Pageant and returns its reply with length prefix
+func (c *pageantConn) query(req []byte) ([]byte, error) {
+	if len(req) > pageantMaxMsgLen {
+		return nil, errors.New("Agent request is too long for Pageant")
+	}
+
+	hwnd := findPageant()
+	if hwnd == 0 {
+		return nil, errors.New("Pageant is not running")
+	}
+
+	name, _ := syscall.UTF16PtrFromString(string(c.mapName[:len(c.mapName)-1]))
+	mapping, err := syscall.CreateFileMapping(syscall.InvalidHandle, nil, syscall.PAGE_READWRITE, 0, pageantMaxMsgLen, name)
+	if err != nil {
+		return nil, errors.New("Cannot create Pageant request: " + err.Error())
+	}
+	defer syscall.CloseHandle(mapping)
+
+	view, err := syscall.MapViewOfFile(mapping, syscall.FILE_MAP_WRITE, 0, 0, 0)
+	if err != nil {
+		return nil, errors.New("Cannot create Pageant request: " + err.Error())
+	}
+	defer syscall.UnmapViewOfFile(view)
+
+	procMoveMemory.Call(view, uintptr(unsafe.Pointer(&req[0])), uintptr(len(req)))
+
+	cds := copyDataStruct{
+		dwData: pageantCopyDataID,
+		cbData: uint32(len(c.mapName)),
+		lpData: uintptr(unsafe.Pointer(&c.mapName[0])),
+	}
+	if ret, _, _ := procSendMessage.Call(hwnd, wmCopyData, 0, uintptr(unsafe.Pointer(&cds))); ret == 0 {
+		return nil, errors.New("Pageant refused agent request")
+	}
+
+	var header [4]byte
+	procMoveMemory.Call(uintptr(unsafe.Pointer(&header[0])), view, 4)
+	length := binary.BigEndian.Uint32(header[:])
+	if length > pageantMaxMsgLen-4 {
+		return nil, errors.New("Pageant reply is too long")
+	}
+
+	reply := make([]byte, 4+length)
+	procMoveMemory.Call(uintptr(unsafe.Pointer(&reply[0])), view, uintptr(len(reply)))
+	return reply, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Parallel uploads ("Parallel": N): files of at least parallelUploadMinSize bytes are split into
+// N ranges that are written into the same remote file concurrently, each over its own SFTP
+// session, because throughput of a single session is bound by latency of the link. Checksum of
+// the whole file is always verified afterwards.
+
+const maxParallelUploads = 8 // OpenSSH allows 10 sessions per connection by default (MaxSessions)
+
+var parallelUploadMinSize int64 = 16 << 20 // smaller files are uploaded over a single session
+
+// writeRemoteFileParallel creates remote file and writes ranges of entry into it over parallel sessions
+func writeRemoteFileParallel(conn *ssh.Client, client *sftpClient, target string, entry *uploadEntry, attrs *sftpAttrs, parallel int, progress *transferProgress, limiters []*rateLimiter) error {
+	fp, err := client.Create(target, attrs)
+	if err != nil {
+		return errors.New("Cannot create " + target + ": " + err.Error())
+	}
+	if err := fp.Close(); err != nil {
+		return errors.New("Cannot create " + target + ": " + err.Error())
+	}
+
+	partSize := (entry.size/int64(parallel) + chunkSize - 1) / chunkSize * chunkSize
+	errs := make(chan error, parallel)
+	parts := 0
+
+	for off := int64(0); off < entry.size; off += partSize {
+		size := partSize
+		if off+size > entry.size {
+			size = entry.size - off
+		}
+
+		parts++
+		go func(off, size int64) {
+			errs <- writeRemoteRange(conn, target, entry, off, size, progress, limiters)
+		}(off, size)
+	}
+
+	for i := 0; i < parts; i++ {
+		if partErr := <-errs; partErr != nil && err == nil {
+			err = partErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if attrs.Flags != 0 {
+		if err := client.Setstat(target, attrs); err != nil {
+			return errors.New("Cannot set attributes of " + target + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// writeRemoteRange writes size bytes of entry starting from off into existing remote file over a new SFTP session
+func writeRemoteRange(conn *ssh.Client, target string, entry *uploadEntry, off, size int64, progress *transferProgress, limiters []*rateLimiter) error {
+	client, err := newSftpClient(conn)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return writeFileRange(client, target, entry, off, size, progress, limiters)
+}
+
+// writeFileRange writes size bytes of entry starting from off into existing remote file at the same offset
+func writeFileRange(client *sftpClient, target string, entry *uploadEntry, off, size int64, progress *transferProgress, limiters []*rateLimiter) error {
+	r, err := entry.openRange(off, size)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	fp, err := client.OpenFile(target, sshFxfWrite, nil)
+	if err != nil {
+		return errors.New("Cannot open " + target + ": " + err.Error())
+	}
+	fp.offset = uint64(off)
+
+	written, err := copyChunks(fp, r, entry, progress, limiters)
+	if err != nil {
+		fp.Close()
+		return err
+	}
+
+	if written != size {
+		fp.Close()
+		return fmt.Errorf("Size of %s changed during upload: expected %d bytes at offset %d, read %d", entry.localPath, size, off, written)
+	}
+
+	return fp.Close()
+}
+
+// copyChunks writes contents of r to fp chunk by chunk, every chunk is written after waiting for all limiters
+func copyChunks(fp io.Writer, r io.Reader, entry *uploadEntry, progress *transferProgress, limiters []*rateLimiter) (written int64, err error) {
+	buf := make([]byte, chunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			for _, l := range limiters {
+				l.wait(n)
+			}
+
+			if _, err = fp.Write(buf[:n]); err != nil {
+				return
+			}
+			metricUploadedBytes.add(float64(n))
+			progress.add(n)
+			written += int64(n)
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			return written, nil
+		} else if readErr != nil {
+			return written, errors.New("Cannot read " + entry.localPath + " contents: " + readErr.Error())
+		}
+	}
+}
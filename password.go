@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Password authentication: login password is taken from GOSSHA_PASSWORD, -password-file, output of
+// -password-cmd or asked once at startup (-ask-password). Hosts with ansible_password inventory
+// variable use it instead, "passwords" section of configuration file sets it for groups from
+// environment variables ("env:NAME"), files ("file:PATH"), commands ("cmd:COMMAND") or a prompt
+// ("prompt"), so that passwords are not stored there. Passphrases of encrypted keys are asked with
+// PasswordRequest, or taken from output of -passphrase-cmd that is run with KEY set to the key file.
+// Passwords and passphrases that are asked for can be cached with -cache-credentials (see credcache.go).
+
+const passwordVar = "ansible_password"
+
+var (
+	passwordFile  string // file with login password (-password-file)
+	passwordCmd   string // command that prints login password (-password-cmd)
+	passphraseCmd string // command that prints passphrase of key in KEY environment variable (-passphrase-cmd)
+	askPassword   bool   // ask for login password at startup (-ask-password)
+	loginPassword string // password for hosts without ansible_password, empty disables password authentication
+)
+
+// initPasswords sets login password and passwords of groups listed in configuration
+func initPasswords(conf *gosshaConfig) (err error) {
+	loginPassword = os.Getenv("GOSSHA_PASSWORD")
+
+	if passwordFile != "" {
+		if loginPassword, err = readPasswordFile(passwordFile); err != nil {
+			return
+		}
+	} else if passwordCmd != "" {
+		if loginPassword, err = readPasswordCommand(passwordCmd, "login"); err != nil {
+			return
+		}
+	} else if askPassword {
+		if loginPassword, err = promptPassword("login"); err != nil {
+			return
+		}
+	}
+
+	if len(conf.passwords) == 0 {
+		return nil
+	}
+
+	groups := make([]string, 0, len(conf.passwords))
+	for name := range conf.passwords {
+		groups = append(groups, name)
+	}
+	sort.Strings(groups)
+
+	for _, name := range groups {
+		if hostInventory == nil || hostInventory.groups[name] == nil {
+			return errors.New("Unknown group " + name + " in passwords of config")
+		}
+
+		password, err := readPasswordSource(conf.passwords[name], "group "+name)
+		if err != nil {
+			return err
+		}
+		hostInventory.group(name).vars[passwordVar] = password
+	}
+	hostInventory.resolveVars()
+
+	return nil
+}
+
+// readPasswordSource returns password from "env:NAME", "file:PATH", "cmd:COMMAND" or "prompt" source
+func readPasswordSource(source, what string) (string, error) {
+	switch {
+	case strings.HasPrefix(source, "env:"):
+		name := strings.TrimPrefix(source, "env:")
+		password := os.Getenv(name)
+		if password == "" {
+			return "", errors.New("Environment variable " + name + " with password for " + what + " is not set")
+		}
+		return password, nil
+	case strings.HasPrefix(source, "file:"):
+		return readPasswordFile(expandHome(strings.TrimPrefix(source, "file:")))
+	case strings.HasPrefix(source, "cmd:"):
+		return readPasswordCommand(strings.TrimPrefix(source, "cmd:"), what)
+	case source == "prompt":
+		return promptPassword(what)
+	}
+
+	return "", errors.New("Invalid password source '" + source + "' for " + what + ", expected env:NAME, file:PATH, cmd:COMMAND or prompt")
+}
+
+// readPasswordCommand returns the first line of output of command, env is added to its environment
+func readPasswordCommand(command, what string, env ...string) (string, error) {
+	out, err := runHelperCommand(command, env...)
+	if err != nil {
+		return "", errors.New("Password command for " + what + " failed: " + err.Error())
+	}
+
+	password := strings.TrimRight(strings.SplitN(string(out), "\n", 2)[0], "\r")
+	if password == "" {
+		return "", errors.New("Password command for " + what + " printed nothing")
+	}
+	return password, nil
+}
+
+// keyPassphrase returns passphrase of encrypted key from -passphrase-cmd or asks for it with PasswordRequest
+func keyPassphrase(keyname string) (string, error) {
+	if passphraseCmd != "" {
+		return readPasswordCommand(passphraseCmd, keyname, "KEY="+keyname)
+	}
+
+	return cachedSecret(passphraseSecret(keyname), func() (string, error) {
+		repliesChan <- &PasswordRequest{PasswordFor: keyname}
+		response := <-requestsChan
+
+		if response.Password == "" {
+			return "", errors.New("No passphrase supplied in request for " + keyname)
+		}
+		return response.Password, nil
+	})
+}
+
+// passphraseSecret returns name of passphrase of key in credential cache
+func passphraseSecret(keyname string) string {
+	return "passphrase:" + keyname
+}
+
+// readPasswordFile returns the first line of file
+func readPasswordFile(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", errors.New("Cannot read password file: " + err.Error())
+	}
+
+	password := strings.TrimRight(strings.SplitN(string(data), "\n", 2)[0], "\r")
+	if password == "" {
+		return "", errors.New("Password file " + filename + " is empty")
+	}
+	return password, nil
+}
+
+// promptPassword asks for password with PasswordRequest, like passphrases of private keys
+func promptPassword(what string) (string, error) {
+	return cachedSecret("password:"+user+":"+what, func() (string, error) {
+		repliesChan <- &PasswordRequest{PasswordFor: what}
+		response := <-requestsChan
+
+		if response == nil || response.Password == "" {
+			return "", errors.New("No password supplied for " + what)
+		}
+		return response.Password, nil
+	})
+}
+
+// hostPassword returns password to authenticate on host with, if any
+func hostPassword(hostname string) string {
+	if hostInventory != nil {
+		if password := hostInventory.HostVars(hostname)[passwordVar]; password != "" {
+			return password
+		}
+	}
+	return loginPassword
+}
+
+// passwordAuth returns "password" authentication and, unless challenges are answered by user
+// (-kbd-interactive), keyboard-interactive one that answers password prompts (e.g. of PAM)
+func passwordAuth(password string, usage *authUsage) []ssh.AuthMethod {
+	methods := []ssh.AuthMethod{ssh.PasswordCallback(func() (string, error) {
+		usage.set("password", "")
+		return password, nil
+	})}
+	if kbdInteractive {
+		return methods
+	}
+
+	return append(methods, ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		usage.set("keyboard-interactive", "")
+		answers := make([]string, len(questions))
+		for i, q := range questions {
+			if !strings.Contains(strings.ToLower(q), "password") {
+				return nil, errors.New("Unexpected keyboard-interactive question: " + q)
+			}
+			answers[i] = password
+		}
+		return answers, nil
+	}))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPasswordAuth(t *testing.T) {
+	fp, err := ioutil.TempFile("", "gossha-password")
+	must(err, "Could not create password file")
+	defer os.Remove(fp.Name())
+	_, err = fp.WriteString("login secret\nignored\n")
+	must(err, "Could not write password file")
+	must(fp.Close(), "Could not close password file")
+
+	r := makeTestResult()
+	for _, srv := range []*testSSHServer{
+		{hostname: "test-password-0", password: "login secret"},
+		{hostname: "test-password-1", password: "group secret", passwordPrompt: true},
+	} {
+		srv.start()
+		r.hosts[srv.addr] = srv
+		r.hostsLeft[srv.addr] = struct{}{}
+	}
+
+	inv := newInventory()
+	inv.group("all")
+	for addr, srv := range r.hosts {
+		if srv.passwordPrompt {
+			must(inv.addHost("appliances", addr, nil), "Could not add host")
+		}
+	}
+
+	os.Setenv("TEST_GROUP_PASSWORD", "group secret")
+	defer os.Unsetenv("TEST_GROUP_PASSWORD")
+
+	hostInventory, passwordFile = inv, fp.Name()
+	defer func() { hostInventory, passwordFile, loginPassword = nil, "", "" }()
+
+	must(initPasswords(&gosshaConfig{passwords: map[string]string{"appliances": "env:TEST_GROUP_PASSWORD"}}), "Could not init passwords")
+	if loginPassword != "login secret" {
+		t.Fatalf("Unexpected login password: %q", loginPassword)
+	}
+
+	runTestRequest(t, r, makeProxyRequest(maxTimeout))
+	checkSuccess(t, r)
+
+	if err := initPasswords(&gosshaConfig{passwords: map[string]string{"appliances": "vault:deploy"}}); err == nil || !strings.Contains(err.Error(), "Invalid password source") {
+		t.Fatalf("Invalid source must be rejected: %v", err)
+	}
+	if err := initPasswords(&gosshaConfig{passwords: map[string]string{"unknown": "prompt"}}); err == nil || !strings.Contains(err.Error(), "Unknown group") {
+		t.Fatalf("Unknown group must be rejected: %v", err)
+	}
+}
+
+func TestPasswordCommands(t *testing.T) {
+	passwordCmd = "echo 'login secret'; echo ignored"
+	defer func() { passwordCmd, passphraseCmd, loginPassword = "", "", "" }()
+
+	must(initPasswords(&gosshaConfig{}), "Could not init passwords")
+	if loginPassword != "login secret" {
+		t.Fatalf("Unexpected login password: %q", loginPassword)
+	}
+
+	if password, err := readPasswordSource("cmd:printf 'group secret\\r\\n'", "group lab"); err != nil || password != "group secret" {
+		t.Fatalf("Unexpected password of cmd: source: %q, %v", password, err)
+	}
+	if _, err := readPasswordSource("cmd:echo oops >&2; exit 1", "group lab"); err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Fatalf("Stderr of failed command must be reported: %v", err)
+	}
+	if _, err := readPasswordSource("cmd:true", "group lab"); err == nil || !strings.Contains(err.Error(), "printed nothing") {
+		t.Fatalf("Empty output must be rejected: %v", err)
+	}
+
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+	dir, err := ioutil.TempDir("", "gossha-passphrase")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+	keyname := filepath.Join(dir, "id_rsa")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "rsa", "-b", "2048", "-m", "PEM", "-N", "key secret", "-f", keyname).CombinedOutput(); err != nil {
+		t.Fatalf("Could not generate key: %s %s", err, out)
+	}
+
+	passphraseCmd = `[ "$KEY" = ` + shellQuote(keyname) + ` ] && echo 'key secret'`
+	if _, err := makeSigner(keyname); err != nil {
+		t.Fatalf("Could not decrypt key with passphrase of command: %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Connectivity check (Action == "ping" or "gossha ping host1 ... hostN"): a new connection is
+// established to every host, bypassing the cache, so that reachability and credentials are
+// really checked, and it is closed right after a single keepalive round trip. No session is
+// opened, so nothing is run on hosts.
+
+type (
+	PingResult struct {
+		Address       string  // remote address of connection
+		ServerVersion string  // e.g. "SSH-2.0-OpenSSH_9.6"
+		AuthMethod    string  // "publickey", "password" or "keyboard-interactive"
+		Key           string  `json:",omitempty"` // type and fingerprint of public key that was accepted
+		ConnectTime   float64 // time spent on TCP connect, handshake and authentication (in seconds)
+		Latency       float64 // round trip time of a keepalive request (in seconds)
+	}
+
+	// authUsage records the last authentication method that was tried, which is the one
+	// that succeeded once connection is established
+	authUsage struct {
+		mu     sync.Mutex
+		method string
+		key    string
+	}
+
+	// usageSigner records public key in usage when it is used to sign, which only happens
+	// after server agreed to accept the key
+	usageSigner struct {
+		ssh.AlgorithmSigner
+		usage *authUsage
+	}
+
+	pingDone struct{ status int } // sent by pingMain after action finished
+)
+
+func (u *authUsage) set(method, key string) {
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	u.method, u.key = method, key
+	u.mu.Unlock()
+}
+
+func (u *authUsage) get() (method, key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.method, u.key
+}
+
+// signers wraps signers so that they are recorded in u when used, nil usage leaves them as is
+func (u *authUsage) signers(signers ...ssh.Signer) []ssh.Signer {
+	if u == nil {
+		return signers
+	}
+
+	res := make([]ssh.Signer, len(signers))
+	for i, s := range signers {
+		if as, ok := s.(ssh.AlgorithmSigner); ok {
+			res[i] = &usageSigner{AlgorithmSigner: as, usage: u}
+		} else {
+			res[i] = s
+		}
+	}
+	return res
+}
+
+func (s *usageSigner) record() {
+	pub := s.PublicKey()
+	s.usage.set("publickey", pub.Type()+" "+ssh.FingerprintSHA256(pub))
+}
+
+func (s *usageSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	s.record()
+	return s.AlgorithmSigner.Sign(rand, data)
+}
+
+func (s *usageSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	s.record()
+	return s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// pingHost connects to hostname and reports connection details without running anything
+func pingHost(hostname string) *SshResult {
+	usage := &authUsage{}
+	start := time.Now()
+
+	conn, err := connectHost(hostname, usage)
+	if err != nil {
+		return &SshResult{hostname: hostname, err: err}
+	}
+	defer conn.Close()
+
+	res := &PingResult{
+		Address:       conn.RemoteAddr().String(),
+		ServerVersion: string(conn.ServerVersion()),
+		ConnectTime:   time.Since(start).Seconds(),
+	}
+	res.AuthMethod, res.Key = usage.get()
+
+	// any reply (even failure) means that the other side is alive
+	start = time.Now()
+	if _, _, err := conn.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		return &SshResult{hostname: hostname, err: err, ping: res}
+	}
+	res.Latency = time.Since(start).Seconds()
+
+	return &SshResult{hostname: hostname, ping: res}
+}
+
+// formatPing returns human-readable description of ping result
+func formatPing(p *PingResult) string {
+	auth := p.AuthMethod
+	if p.Key != "" {
+		auth += " (" + p.Key + ")"
+	}
+	return fmt.Sprintf("%s %s, auth %s, connect %.1fms, latency %.1fms", p.Address, p.ServerVersion, auth, p.ConnectTime*1000, p.Latency*1000)
+}
+
+// pingMain implements "gossha ping [flags] host1 ... hostN", all flags of GoSSHa are accepted;
+// it returns exit status, which is 1 if any host could not be reached
+func pingMain(args []string) int {
+	os.Args = append([]string{os.Args[0]}, args...)
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gossha ping [flags] host1 ... hostN")
+		flag.PrintDefaults()
+	}
+
+	go interruptThread()
+	go func() {
+		initialize(true)
+		if flag.NArg() == 0 && retryFromFile == "" {
+			flag.Usage()
+			repliesChan <- pingDone{status: 2}
+			return
+		}
+
+		runAction(&ProxyRequest{Action: "ping", Hosts: flag.Args()})
+		repliesChan <- pingDone{}
+	}()
+
+	status := 0
+	stdin := bufio.NewReader(os.Stdin)
+	for reply := range repliesChan {
+		switch reply := reply.(type) {
+		case pingDone:
+			if reply.status != 0 {
+				return reply.status
+			}
+			return status
+		case *InitializeComplete, *ConnectionProgress:
+			continue
+		case *HostKeyRequest:
+			promptHostKey(stdin, reply)
+			continue
+		case *UserError:
+			if reply.IsCritical {
+				status = 1
+			}
+		case *Reply:
+			if !reply.Success {
+				status = 1
+			}
+		}
+
+		writeReplyText(os.Stdout, os.Stderr, reply, "")
+
+		if _, ok := reply.(*PasswordRequest); ok {
+			line, _ := stdin.ReadString('\n')
+			requestsChan <- &ProxyRequest{Password: strings.TrimRight(line, "\r\n")}
+		}
+	}
+
+	return status
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPing(t *testing.T) {
+	r := makeTestResult()
+	for _, srv := range []*testSSHServer{
+		{hostname: "test-ping-0"},
+		{hostname: "test-ping-1", password: "secret"},
+		{hostname: "test-ping-2", password: "secret", passwordPrompt: true},
+	} {
+		srv.start()
+		r.hosts[srv.addr] = srv
+		r.hostsLeft[srv.addr] = struct{}{}
+	}
+
+	loginPassword = "secret"
+	defer func() { loginPassword = "" }()
+
+	runTestRequest(t, r, &ProxyRequest{Action: "ping"})
+
+	for addr, reply := range r.replies {
+		p := reply.Ping
+		if p == nil || !strings.HasPrefix(p.ServerVersion, "SSH-2.0-") || p.Address == "" || p.ConnectTime <= 0 {
+			t.Fatalf("Unexpected ping result of %s: %+v", addr, p)
+		}
+
+		srv := r.hosts[addr]
+		switch {
+		case srv.passwordPrompt:
+			if p.AuthMethod != "keyboard-interactive" || p.Key != "" {
+				t.Fatalf("Expected keyboard-interactive auth for %s, got %+v", addr, p)
+			}
+		case srv.password != "":
+			if p.AuthMethod != "password" || p.Key != "" {
+				t.Fatalf("Expected password auth for %s, got %+v", addr, p)
+			}
+		default:
+			if p.AuthMethod != "publickey" || !strings.HasPrefix(p.Key, "ssh-rsa SHA256:") {
+				t.Fatalf("Expected public key auth for %s, got %+v", addr, p)
+			}
+		}
+
+		// connections of ping are checks, they must not be reused by other actions
+		if conn, ok := connectedHosts.Get(addr); ok {
+			connectedHosts.Release(addr, conn)
+			t.Fatalf("Connection to %s must not be cached", addr)
+		}
+	}
+}
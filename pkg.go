@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Packages (Action == "pkg" or "gossha pkg <operation> <package>[,<package>...] host1 ... hostN"):
+// package manager of every host is detected (apt, dnf or yum) and "Operation" (install, remove,
+// upgrade or status) is done on "Packages" with it, non-interactively. Use "Sudo": true if login
+// user is not root. Replies have "Pkg" with the package manager, the command that was run and the
+// installed version of every package before and after it; install and upgrade fail if a package is
+// not installed after them, remove fails if one still is, and status (which only queries versions)
+// fails if a package is not installed. Versions cannot be pinned, use "ssh" for that.
+
+var (
+	pkgOperations = []string{"install", "remove", "upgrade", "status"}
+
+	// pkgDetectCmd prints package manager of host: apt, dnf or yum
+	pkgDetectCmd = "for m in apt-get dnf yum; do if command -v $m >/dev/null 2>&1; then echo ${m%-get}; exit; fi; done"
+)
+
+// PkgResult is state of packages after Action == "pkg"
+type PkgResult struct {
+	Manager  string // package manager of host: apt, dnf or yum
+	Command  string `json:",omitempty"` // command that was run (none for status)
+	Packages []*PackageState
+}
+
+// PackageState is installed version of package before and after Action == "pkg"
+type PackageState struct {
+	Name     string
+	Version  string `json:",omitempty"` // version after command, empty if package is not installed
+	Previous string `json:",omitempty"` // version before command
+	Changed  bool   // version is different after command
+}
+
+// pkgOptions are parameters of Action == "pkg"
+type pkgOptions struct {
+	operation string
+	packages  []string
+	opts      *cmdOptions
+}
+
+// parsePkgOptions returns parameters of pkg request msg
+func parsePkgOptions(msg *ProxyRequest) (*pkgOptions, error) {
+	if !containsString(pkgOperations, msg.Operation) {
+		return nil, errors.New("'Operation' must be one of " + strings.Join(pkgOperations, ", "))
+	}
+	if len(msg.Packages) == 0 {
+		return nil, errors.New("'Packages' must be specified")
+	}
+	for _, p := range msg.Packages {
+		if !managedNameRe.MatchString(p) {
+			return nil, fmt.Errorf("Invalid package name %q", p)
+		}
+	}
+	opts, err := parseCmdOptions(msg)
+	if err != nil {
+		return nil, err
+	}
+	opts.stream, opts.streamOnly, opts.pty = false, false, false
+	return &pkgOptions{operation: msg.Operation, packages: msg.Packages, opts: opts}, nil
+}
+
+// pkgCommand returns command that does operation on packages with package manager, empty for status
+func pkgCommand(manager, operation string, packages []string) (string, error) {
+	if operation == "status" {
+		return "", nil
+	}
+	args := strings.Join(packages, " ")
+	switch manager {
+	case "apt":
+		op := operation
+		if operation == "upgrade" {
+			op = "install --only-upgrade"
+		}
+		return "DEBIAN_FRONTEND=noninteractive apt-get " + op + " -y -q -- " + args, nil
+	case "dnf", "yum":
+		return manager + " " + operation + " -y -q -- " + args, nil
+	}
+	return "", errors.New("Unsupported package manager " + manager)
+}
+
+// packageVersion returns installed version of package, empty if it is not installed
+func packageVersion(conn *ssh.Client, hostname, manager, name string, opts *cmdOptions) (string, error) {
+	cmd := "rpm -q --qf '%{VERSION}-%{RELEASE}' -- " + name
+	if manager == "apt" {
+		cmd = "dpkg-query -W -f='${Status} ${Version}' -- " + name
+	}
+	out, _, err := runCmd(conn, hostname, cmd, opts.forHost())
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return "", nil // not installed
+	} else if err != nil {
+		return "", err
+	}
+	if manager == "apt" {
+		// removed packages with configuration files left are listed too
+		const installed = "install ok installed "
+		if !strings.HasPrefix(out, installed) {
+			return "", nil
+		}
+		out = out[len(installed):]
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// managePackages does operation of p on packages of hostname
+func managePackages(p *pkgOptions, hostname string) *SshResult {
+	res := &SshResult{hostname: hostname}
+
+	conn, err := getConnection(hostname)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	defer connectedHosts.Release(hostname, conn)
+
+	manager, err := detectManager(conn, hostname, pkgDetectCmd, "package manager", p.opts)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	cmd, err := pkgCommand(manager, p.operation, p.packages)
+	if err != nil {
+		res.err = err
+		return res
+	}
+
+	r := &PkgResult{Manager: manager, Command: cmd}
+	for _, name := range p.packages {
+		version, err := packageVersion(conn, hostname, manager, name, p.opts)
+		if err != nil {
+			res.err = errors.New("Cannot get version of " + name + ": " + err.Error())
+			return res
+		}
+		r.Packages = append(r.Packages, &PackageState{Name: name, Version: version, Previous: version})
+	}
+
+	if cmd != "" {
+		res.stdout, res.stderr, err = runCmd(conn, hostname, cmd, p.opts.forHost())
+		var retryable *retryableError
+		if errors.As(err, &retryable) {
+			res.err = err // the command was not run
+			return res
+		}
+		res.err = err
+		for _, s := range r.Packages {
+			if s.Version, err = packageVersion(conn, hostname, manager, s.Name, p.opts); err != nil && res.err == nil {
+				res.err = errors.New("Cannot get version of " + s.Name + ": " + err.Error())
+			}
+			s.Changed = s.Version != s.Previous
+		}
+	}
+	res.pkg = r
+	if res.err != nil {
+		return res
+	}
+
+	var wrong []string
+	for _, s := range r.Packages {
+		if (s.Version == "") == (p.operation != "remove") {
+			wrong = append(wrong, s.Name)
+		}
+	}
+	if len(wrong) > 0 && p.operation == "remove" {
+		res.err = errors.New("Packages are still installed: " + strings.Join(wrong, ", "))
+	} else if len(wrong) > 0 {
+		res.err = errors.New("Packages are not installed: " + strings.Join(wrong, ", "))
+	}
+	return res
+}
+
+// formatPkg returns human-readable description of pkg result
+func formatPkg(r *PkgResult) string {
+	var res []string
+	for _, s := range r.Packages {
+		switch {
+		case s.Version == "" && s.Previous == "":
+			res = append(res, s.Name+" not installed")
+		case s.Version == "":
+			res = append(res, s.Name+" removed ("+s.Previous+")")
+		case s.Changed && s.Previous != "":
+			res = append(res, s.Name+" "+s.Version+" (was "+s.Previous+")")
+		default:
+			res = append(res, s.Name+" "+s.Version)
+		}
+	}
+	return r.Manager + ": " + strings.Join(res, ", ")
+}
+
+// pkgMain implements "gossha pkg [flags] <operation> <package>[,<package>...] host1 ... hostN"
+func pkgMain(args []string) int {
+	var serial string
+	var sudo bool
+
+	os.Args = append([]string{os.Args[0]}, args...)
+	flag.StringVar(&serial, "serial", "", "Manage packages on N hosts (or N% of hosts) at a time")
+	flag.BoolVar(&sudo, "sudo", false, "Run commands with sudo")
+
+	return actionMain("pkg [flags] <"+strings.Join(pkgOperations, "|")+"> <package>[,<package>...] host1 ... hostN", fixedArgs(2), func(args []string) *ProxyRequest {
+		return &ProxyRequest{Action: "pkg", Operation: args[0], Packages: strings.Split(args[1], ","), Hosts: args[2:], Serial: serial, Sudo: sudo}
+	})
+}
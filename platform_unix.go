@@ -0,0 +1,92 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// openSyslog connects to local syslog for audit log
+func openSyslog() (io.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_AUTHPRIV, "gossha")
+}
+
+// notifyResize sends to c when terminal is resized
+func notifyResize(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGWINCH)
+}
+
+// dialAgent connects to ssh-agent listening on unix socket sock
+func dialAgent(sock string) (io.ReadWriteCloser, error) {
+	return net.Dial("unix", sock)
+}
+
+// localShellCommand returns command that runs cmd with local shell
+func localShellCommand(ctx context.Context, cmd string) *exec.Cmd {
+	return exec.CommandContext(ctx, "/bin/sh", "-c", cmd)
+}
+
+// openFiles returns number of open file descriptors of the process and their limit, 0 if unknown
+func openFiles() (open, limit int) {
+	var rl syscall.Rlimit
+	if syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl) == nil && rl.Cur < 1<<31 {
+		limit = int(rl.Cur)
+	}
+
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		fp, err := os.Open(dir)
+		if err != nil {
+			continue
+		}
+		names, err := fp.Readdirnames(-1)
+		fp.Close()
+		if err == nil {
+			return len(names) - 1, limit // descriptor of dir itself is listed too
+		}
+	}
+	return 0, limit
+}
+
+// defaultAgentSock returns agent socket used when SSH_AUTH_SOCK is not set, there is none on unix
+func defaultAgentSock() string {
+	return ""
+}
+
+// agentSockCandidates returns usual places of agent sockets: sockets of systemd user units of
+// ssh-agent, gnome-keyring and gpg-agent, then sockets of ssh-agent processes and launchd, newest first
+func agentSockCandidates() []string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = fmt.Sprintf("/run/user/%d", os.Getuid())
+	}
+
+	var res []string
+	for _, name := range []string{"ssh-agent.socket", "openssh_agent", "gcr/ssh", "keyring/ssh", "gnupg/S.gpg-agent.ssh"} {
+		res = append(res, filepath.Join(runtimeDir, name))
+	}
+	res = append(res, filepath.Join(homeDir(), ".gnupg", "S.gpg-agent.ssh"))
+
+	agentSocks, _ := filepath.Glob(filepath.Join(os.TempDir(), "ssh-*", "agent.*"))
+	launchd, _ := filepath.Glob("/private/tmp/com.apple.launchd.*/Listeners")
+	socks := append(agentSocks, launchd...)
+	mtimes := make(map[string]int64)
+	for _, s := range socks {
+		if fi, err := os.Stat(s); err == nil {
+			mtimes[s] = fi.ModTime().UnixNano()
+		}
+	}
+	sort.SliceStable(socks, func(i, j int) bool { return mtimes[socks[i]] > mtimes[socks[j]] })
+
+	return append(res, socks...)
+}
@@ -0,0 +1,65 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Windows OpenSSH agent listens on a named pipe, Pageant is used through its window ("pageant"
+// as agent socket), other SSH_AUTH_SOCK values are unix sockets (supported by Windows 10 and later).
+
+const openSSHAgentPipe = `\\.\pipe\openssh-ssh-agent`
+
+func openSyslog() (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on Windows")
+}
+
+// openFiles returns 0, Windows has no limit of open files that the process could exceed by opening connections
+func openFiles() (open, limit int) {
+	return 0, 0
+}
+
+// notifyResize does nothing, Windows has no signal for terminal resize
+func notifyResize(c chan<- os.Signal) {}
+
+// dialAgent connects to ssh-agent listening on named pipe, unix socket or to Pageant
+func dialAgent(sock string) (io.ReadWriteCloser, error) {
+	switch {
+	case sock == "pageant":
+		return dialPageant()
+	case strings.HasPrefix(sock, `\\.\pipe\`):
+		return os.OpenFile(sock, os.O_RDWR, 0)
+	}
+	return net.Dial("unix", sock)
+}
+
+// localShellCommand returns command that runs cmd with cmd.exe
+func localShellCommand(ctx context.Context, cmd string) *exec.Cmd {
+	return exec.CommandContext(ctx, "cmd", "/C", cmd)
+}
+
+// defaultAgentSock returns agent socket used when SSH_AUTH_SOCK is not set: pipe of running
+// Windows OpenSSH agent or Pageant, empty if none of them is running
+func defaultAgentSock() string {
+	if fp, err := os.OpenFile(openSSHAgentPipe, os.O_RDWR, 0); err == nil {
+		fp.Close()
+		return openSSHAgentPipe
+	}
+	if findPageant() != 0 {
+		return "pageant"
+	}
+	return ""
+}
+
+// agentSockCandidates returns agents that can be used instead of SSH_AUTH_SOCK that does not answer
+func agentSockCandidates() []string {
+	return []string{openSSHAgentPipe, "pageant"}
+}
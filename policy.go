@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Request policy (-policy <file>) for HTTP API: every client authenticates with one of tokens of
+// the file instead of -serve-token, and its jobs are checked before they are queued:
+//
+//	audit_fields: [ticket, reason]       # AuditFields that every request must have
+//	deny_commands: ['\brm\s+-rf\b']      # commands that no token may run
+//	tokens:
+//	  ci:
+//	    token: <secret>
+//	    actions: [ssh]                   # allowed actions, default is all of them
+//	    allow_commands: ['^uptime$']     # commands must match one of them, default is any command
+//	    deny_commands: ['\breboot\b']
+//	    groups: [web]                    # inventory groups that all hosts must belong to, default is any host
+//	  ops:
+//	    users: ['*@example.com']         # identities of OIDC tokens (globs allowed) instead of token
+//	    admin: true                      # sees and cancels jobs of all clients, not only its own
+//
+// Commands are Cmd, Cmds, Snapshot and OnlyIf, Then and OnFail commands of request, scripts and
+// uploads are only limited by actions. Jobs that violate policy are rejected with 403 and list of
+// violations, identity of client (name of the token or OIDC identity) and AuditFields are written
+// to audit log. Clients only see and cancel their own jobs, unless their entry has admin. The file is read once at startup, API refuses all requests if it cannot be loaded.
+
+var (
+	policyFile string // -policy
+	policyErr  error  // policy could not be loaded or OIDC settings are invalid
+)
+
+type (
+	requestPolicy struct {
+		auditFields  []string
+		denyCommands []*regexp.Regexp
+		tokens       []*policyToken
+	}
+
+	policyToken struct {
+		name          string
+		token         string           // empty if entry is only for OIDC users
+		users         []string         // patterns of OIDC identities (see oidcVerifier)
+		actions       []string         // empty allows all actions
+		allowCommands []*regexp.Regexp // empty allows all commands that are not denied
+		denyCommands  []*regexp.Regexp
+		groups        []string // empty allows all hosts
+		admin         bool     // jobs of other clients are visible to it
+	}
+
+	// PolicyViolation is a rule of -policy that job does not conform to
+	PolicyViolation struct {
+		Rule    string // "actions", "allow_commands", "deny_commands", "groups" or "audit_fields"
+		Value   string // action, command, group, host or audit field that violates the rule
+		Pattern string `json:",omitempty"` // matching pattern of "deny_commands"
+	}
+
+	apiPolicyError struct {
+		Error      string
+		Violations []PolicyViolation
+	}
+)
+
+// loadPolicy reads policy file in YAML or TOML format (like configuration file)
+func loadPolicy(filename string) (*requestPolicy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.New("Cannot read policy: " + err.Error())
+	}
+
+	var doc interface{}
+	if filepath.Ext(filename) == ".toml" {
+		doc, err = parseToml(data)
+	} else {
+		doc, err = parseYaml(data)
+	}
+	if err != nil {
+		return nil, errors.New("Cannot parse policy " + filename + ": " + err.Error())
+	}
+
+	p, err := parsePolicy(doc)
+	if err != nil {
+		return nil, errors.New("Invalid policy " + filename + ": " + err.Error())
+	}
+	return p, nil
+}
+
+func parsePolicy(doc interface{}) (*requestPolicy, error) {
+	top, ok := doc.(*yamlMap)
+	if !ok {
+		return nil, errors.New("policy must be a mapping")
+	}
+
+	p := &requestPolicy{}
+	for _, key := range top.Keys() {
+		value := top.Get(key)
+
+		var err error
+		switch key {
+		case "audit_fields":
+			p.auditFields, err = configStrings(key, value)
+		case "deny_commands":
+			p.denyCommands, err = policyPatterns(key, value)
+		case "tokens":
+			tokens, ok := value.(*yamlMap)
+			if !ok {
+				return nil, errors.New("tokens must be a mapping of names to options")
+			}
+			for _, name := range tokens.Keys() {
+				t, err := parsePolicyToken(name, tokens.Get(name))
+				if err != nil {
+					return nil, err
+				}
+				p.tokens = append(p.tokens, t)
+			}
+		default:
+			return nil, errors.New("unknown option " + key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(p.tokens) == 0 {
+		return nil, errors.New("no tokens are defined")
+	}
+	return p, nil
+}
+
+func parsePolicyToken(name string, value interface{}) (*policyToken, error) {
+	options, ok := value.(*yamlMap)
+	if !ok {
+		return nil, errors.New("options of token " + name + " must be a mapping")
+	}
+
+	t := &policyToken{name: name}
+	for _, key := range options.Keys() {
+		value, prefix := options.Get(key), "token "+name+" "+key
+
+		var err error
+		switch key {
+		case "token":
+			if t.token, ok = value.(string); !ok {
+				return nil, errors.New(prefix + " must be a string")
+			}
+		case "actions":
+			t.actions, err = configStrings(prefix, value)
+		case "allow_commands":
+			t.allowCommands, err = policyPatterns(prefix, value)
+		case "deny_commands":
+			t.denyCommands, err = policyPatterns(prefix, value)
+		case "groups":
+			t.groups, err = configStrings(prefix, value)
+		case "users":
+			t.users, err = configStrings(prefix, value)
+		case "admin":
+			s, _ := value.(string)
+			if t.admin, err = strconv.ParseBool(s); err != nil {
+				err = errors.New(prefix + " must be true or false")
+			}
+		default:
+			return nil, errors.New("unknown option " + key + " of token " + name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if t.token == "" && len(t.users) == 0 {
+		return nil, errors.New("token " + name + " has neither token nor users")
+	}
+	return t, nil
+}
+
+func policyPatterns(key string, value interface{}) ([]*regexp.Regexp, error) {
+	patterns, err := configStrings(key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		if res[i], err = regexp.Compile(p); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q of %s: %s", p, key, err)
+		}
+	}
+	return res, nil
+}
+
+// lookup returns token that matches "Authorization" header auth, nil if none of them do
+func (p *requestPolicy) lookup(auth string) *policyToken {
+	var res *policyToken
+	for _, t := range p.tokens {
+		// all tokens are compared, so that time does not tell which one matched
+		if t.token != "" && subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+t.token)) == 1 {
+			res = t
+		}
+	}
+	return res
+}
+
+// lookupUser returns the first entry which users match OIDC identity, nil if none of them do
+func (p *requestPolicy) lookupUser(identity string) *policyToken {
+	for _, t := range p.tokens {
+		for _, pattern := range t.users {
+			if ok, _ := path.Match(pattern, identity); ok {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// check returns violations of policy by request msg submitted with token t
+func (p *requestPolicy) check(t *policyToken, msg *ProxyRequest) (res []PolicyViolation) {
+	if len(t.actions) > 0 && !containsString(t.actions, msg.Action) {
+		res = append(res, PolicyViolation{Rule: "actions", Value: msg.Action})
+	}
+
+	cmds := append(append(append([]string{msg.Cmd}, msg.Cmds...), msg.Snapshot...), msg.OnlyIf, msg.Then, msg.OnFail)
+	if msg.Action == "service" {
+		cmds = append(cmds, "service "+msg.Operation+" "+msg.Service) // checked like commands, e.g. "^service restart "
+	} else if msg.Action == "pkg" {
+		cmds = append(cmds, "pkg "+msg.Operation+" "+strings.Join(msg.Packages, " "))
+	}
+	for _, cmd := range cmds {
+		if cmd == "" {
+			continue
+		}
+		if v, ok := checkPolicyCommand(cmd, append(append([]*regexp.Regexp{}, p.denyCommands...), t.denyCommands...), t.allowCommands); !ok {
+			res = append(res, v)
+		}
+	}
+
+	if len(t.groups) > 0 {
+		res = append(res, t.checkHosts(msg)...)
+	}
+
+	for _, f := range p.auditFields {
+		if strings.TrimSpace(msg.AuditFields[f]) == "" {
+			res = append(res, PolicyViolation{Rule: "audit_fields", Value: f})
+		}
+	}
+	return res
+}
+
+func checkPolicyCommand(cmd string, deny, allow []*regexp.Regexp) (PolicyViolation, bool) {
+	for _, re := range deny {
+		if re.MatchString(cmd) {
+			return PolicyViolation{Rule: "deny_commands", Value: cmd, Pattern: re.String()}, false
+		}
+	}
+
+	if len(allow) == 0 {
+		return PolicyViolation{}, true
+	}
+	for _, re := range allow {
+		if re.MatchString(cmd) {
+			return PolicyViolation{}, true
+		}
+	}
+	return PolicyViolation{Rule: "allow_commands", Value: cmd}, false
+}
+
+// unrestricted tells whether t allows all actions, commands and hosts
+func (t *policyToken) unrestricted() bool {
+	return len(t.actions) == 0 && len(t.allowCommands) == 0 && len(t.denyCommands) == 0 && len(t.groups) == 0
+}
+
+// checkHosts returns violations by groups, stages, dynamic sources and hosts of msg that are outside of groups of t
+func (t *policyToken) checkHosts(msg *ProxyRequest) (res []PolicyViolation) {
+	var groups []string
+	for _, g := range msg.Groups {
+		groups = append(groups, groupExprNames(g)...) // every group of expression must be allowed
+	}
+	if msg.Stages != "" {
+		groups = append(groups, configStages[msg.Stages]...)
+	}
+	for _, g := range groups {
+		if !containsString(t.groups, g) {
+			res = append(res, PolicyViolation{Rule: "groups", Value: g})
+		}
+	}
+
+	for _, src := range withDefaultDiscover(msg) {
+		res = append(res, PolicyViolation{Rule: "groups", Value: src})
+	}
+
+	if len(msg.Hosts) == 0 {
+		return res
+	}
+
+	allowed := make(map[string]bool)
+	if hosts, err := inventoryHosts(t.groups); err == nil {
+		for _, h := range hosts {
+			allowed[h] = true
+		}
+	}
+
+	hosts, err := expandHosts(msg.Hosts)
+	if err != nil {
+		return append(res, PolicyViolation{Rule: "groups", Value: strings.Join(msg.Hosts, ",")})
+	}
+	for _, h := range hosts {
+		if !allowed[h] {
+			res = append(res, PolicyViolation{Rule: "groups", Value: h})
+		}
+	}
+	return res
+}
+
+func containsString(list []string, s string) bool {
+	for _, el := range list {
+		if el == s {
+			return true
+		}
+	}
+	return false
+}
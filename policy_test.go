@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+const testPolicy = `
+audit_fields: [ticket]
+deny_commands: ['\brm\s+-rf\b']
+tokens:
+  ci:
+    token: secret
+    actions: [ssh]
+    allow_commands: ['^systemctl (status|restart) \w+$', '^uptime$']
+    groups: [web]
+  admin:
+    token: other
+    admin: true
+  dev:
+    token: dev
+`
+
+func TestPolicy(t *testing.T) {
+	doc, err := parseYaml([]byte(testPolicy))
+	must(err, "Could not parse policy")
+	p, err := parsePolicy(doc)
+	must(err, "Could not load policy")
+
+	inv := newInventory()
+	must(inv.addHost("web", "web1", nil), "Could not add host")
+	must(inv.addHost("web", "web2", nil), "Could not add host")
+	must(inv.addHost("db", "db1", nil), "Could not add host")
+	inv.resolveVars()
+	hostInventory = inv
+	defer func() { hostInventory = nil }()
+
+	if p.lookup("Bearer other") != p.tokens[1] || p.lookup("Bearer wrong") != nil {
+		t.Fatalf("Tokens are not looked up correctly")
+	}
+
+	s := newAPIServer("", nil)
+	s.policy = p
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	var jobID string
+	for _, c := range []struct {
+		body       string
+		violations []PolicyViolation
+	}{
+		{`{"Action":"ssh","Cmd":"uptime","Groups":["web"],"AuditFields":{"ticket":"OPS-1"}}`, nil},
+		{`{"Action":"ssh","Cmd":"systemctl restart nginx","Hosts":["web[1-2]"],"AuditFields":{"ticket":"OPS-1"}}`, nil},
+		{`{"Action":"ssh","Cmd":"uptime","Hosts":["db1"],"AuditFields":{"ticket":"OPS-1"}}`, []PolicyViolation{{Rule: "groups", Value: "db1"}}},
+		{`{"Action":"ssh","Cmd":"uptime","Groups":["db"],"AuditFields":{"ticket":" "}}`, []PolicyViolation{{Rule: "groups", Value: "db"}, {Rule: "audit_fields", Value: "ticket"}}},
+		{
+			`{"Action":"ssh","Cmds":["uptime","rm -rf /tmp/x","reboot"],"Groups":["web"],"AuditFields":{"ticket":"OPS-1"}}`,
+			[]PolicyViolation{{Rule: "deny_commands", Value: "rm -rf /tmp/x", Pattern: `\brm\s+-rf\b`}, {Rule: "allow_commands", Value: "reboot"}},
+		},
+		{`{"Action":"scp","Source":"file","Target":"/tmp/file","Groups":["web"],"AuditFields":{"ticket":"OPS-1"}}`, []PolicyViolation{{Rule: "actions", Value: "scp"}}},
+	} {
+		var res struct {
+			ID         string
+			Client     string
+			Violations []PolicyViolation
+		}
+		code := apiRequest(t, "POST", srv.URL+"/jobs", c.body, &res)
+
+		if c.violations == nil {
+			if code != http.StatusAccepted || res.Client != "ci" {
+				t.Fatalf("Job %s is not accepted: %d %+v", c.body, code, res)
+			}
+			jobID = res.ID
+			continue
+		}
+		if code != http.StatusForbidden || !reflect.DeepEqual(res.Violations, c.violations) {
+			t.Fatalf("Unexpected result of %s: %d %+v", c.body, code, res.Violations)
+		}
+	}
+
+	// jobs of ci are only visible to it and to admin
+	for _, c := range []struct {
+		token string
+		jobs  int
+	}{{"secret", 2}, {"other", 2}, {"dev", 0}} {
+		var jobs []*apiJob
+		if code := apiRequestAs(t, c.token, "GET", srv.URL+"/jobs", "", &jobs); code != http.StatusOK || len(jobs) != c.jobs {
+			t.Fatalf("Token %s sees %d jobs (%d), expected %d", c.token, len(jobs), code, c.jobs)
+		}
+	}
+	for _, path := range []string{"", "/results", "/stream"} {
+		if code := apiRequestAs(t, "dev", "GET", srv.URL+"/jobs/"+jobID+path, "", &apiError{}); code != http.StatusNotFound {
+			t.Fatalf("Job of another token is visible at %s: %d", path, code)
+		}
+	}
+	if code := apiRequestAs(t, "dev", "POST", srv.URL+"/jobs/"+jobID+"/cancel", "", &apiError{}); code != http.StatusNotFound {
+		t.Fatalf("Job of another token was cancelled: %d", code)
+	}
+	if code := apiRequestAs(t, "other", "POST", srv.URL+"/jobs/"+jobID+"/cancel", "", &apiJob{}); code != http.StatusAccepted {
+		t.Fatalf("Admin could not cancel job: %d", code)
+	}
+
+	doc, err = parseYaml([]byte("tokens:\n  bad:\n    token: x\n    admin: maybe\n"))
+	must(err, "Could not parse policy")
+	if _, err := parsePolicy(doc); err == nil {
+		t.Fatalf("Invalid admin was accepted")
+	}
+}
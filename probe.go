@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TCP reachability probe ("Probe": <milliseconds> or -probe <duration>): before connecting, SSH
+// ports of all hosts of a run are probed in parallel with a short timeout (e.g. 500ms). Hosts that
+// do not accept TCP connections in time (e.g. powered off machines) fail right away with "connect"
+// or "connect-timeout" error kind, instead of using up a connection slot for the whole connection
+// timeout. Hosts with cached connections and hosts that are reached through jump hosts or proxy
+// are not probed.
+
+const probeConcurrency = 256 // simultaneous probes
+
+var probeDefault time.Duration // -probe
+
+// probeTimeout returns timeout of TCP probe for msg, 0 if hosts are not probed
+func probeTimeout(msg *ProxyRequest) time.Duration {
+	if msg.Probe > 0 {
+		return time.Duration(msg.Probe) * time.Millisecond
+	}
+	return probeDefault
+}
+
+// probeHosts connects to SSH ports of hosts in parallel and returns errors of hosts that could not
+// be connected to; hosts that already failed (e.g. names that do not exist) are not probed
+func probeHosts(hosts []string, alreadyFailed map[string]error, timeout time.Duration) map[string]error {
+	targets := make(map[string][]string) // address -> hosts of request
+	var addrs []string
+	for _, hostname := range hosts {
+		if _, ok := alreadyFailed[hostname]; ok {
+			continue
+		}
+		if conn, ok := connectedHosts.Get(hostname); ok {
+			connectedHosts.Release(hostname, conn)
+			continue
+		}
+
+		target, _ := inventoryTarget(hostname, &ssh.ClientConfig{})
+		host, port := splitHostPort(target)
+		if len(jumpHosts) > 0 || useProxy(host) {
+			continue
+		}
+
+		addr := net.JoinHostPort(host, port)
+		if _, ok := targets[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+		targets[addr] = append(targets[addr], hostname)
+	}
+
+	var mu sync.Mutex
+	failed := make(map[string]error)
+	sem := make(chan struct{}, probeConcurrency)
+	var wg sync.WaitGroup
+
+	for _, addr := range addrs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(addr string) {
+			defer func() { <-sem; wg.Done() }()
+
+			conn, err := dialDirect(addr, timeout)
+			if err == nil {
+				conn.Close()
+				return
+			}
+
+			logf(logInfo, addr, "TCP probe failed: %s", err)
+			mu.Lock()
+			for _, hostname := range targets[addr] {
+				failed[hostname] = fmt.Errorf("Host is unreachable (TCP probe): %w", err)
+			}
+			mu.Unlock()
+		}(addr)
+	}
+	wg.Wait()
+
+	return failed
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeHosts(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	must(err, "Could not listen")
+	dead := ln.Addr().String()
+	ln.Close() // nothing accepts connections there now
+
+	r := makeTestResult()
+	startTestServers(r, "test-probe", 2)
+	r.hostsLeft[dead] = struct{}{}
+
+	req := &ProxyRequest{Action: "ssh", Cmd: "echo ok", Probe: 500, Timeout: uint64(maxTimeout / time.Millisecond)}
+	for h := range r.hostsLeft {
+		req.Hosts = append(req.Hosts, h)
+	}
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+
+	for hostname, reply := range r.replies {
+		if hostname == dead {
+			if reply.Success || !strings.HasPrefix(reply.ErrMsg, "Host is unreachable (TCP probe)") || reply.ErrorKind != errorKindConnect {
+				t.Fatalf("Dead host must fail without connecting: %+v", reply)
+			}
+		} else if !reply.Success || reply.Stdout != "ok\n" {
+			t.Fatalf("Unexpected reply of %s: %+v", hostname, reply)
+		}
+	}
+
+	failed := probeHosts([]string{dead, "unresolved"}, map[string]error{"unresolved": nil}, time.Second)
+	if len(failed) != 1 || failed[dead] == nil {
+		t.Fatalf("Expected only %s to be probed and fail, got %v", dead, failed)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	proxyURL     *url.URL // proxy for outbound connections (nil if connections are made directly)
+	noProxyHosts []string // hosts (or domain suffixes) that are connected to directly
+	proxyErr     error    // error in proxy specification, all connections are refused if it is set
+
+	dialNetwork = "tcp" // "tcp4" or "tcp6" if only IPv4 or IPv6 addresses must be used (-4 and -6)
+)
+
+// initProxy parses proxy specification from -proxy flag or from environment variables;
+// if specification is invalid, dialTCP refuses to connect instead of silently connecting directly
+func initProxy(proxySpec string) error {
+	proxyErr = parseProxy(proxySpec)
+	return proxyErr
+}
+
+func parseProxy(proxySpec string) error {
+	if proxySpec == "" {
+		for _, env := range []string{"ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy"} {
+			if proxySpec = os.Getenv(env); proxySpec != "" {
+				break
+			}
+		}
+
+		for _, env := range []string{"NO_PROXY", "no_proxy"} {
+			if noProxy := os.Getenv(env); noProxy != "" {
+				for _, h := range strings.Split(noProxy, ",") {
+					if h = strings.TrimSpace(h); h != "" {
+						noProxyHosts = append(noProxyHosts, h)
+					}
+				}
+				break
+			}
+		}
+	}
+
+	if proxySpec == "" {
+		return nil
+	}
+
+	if !strings.Contains(proxySpec, "://") {
+		proxySpec = "http://" + proxySpec
+	}
+
+	u, err := url.Parse(proxySpec)
+	if err != nil {
+		return errors.New("Invalid proxy " + proxySpec + ": " + err.Error())
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return errors.New("Unsupported proxy scheme: " + u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return errors.New("Invalid proxy " + proxySpec + ": empty host")
+	}
+
+	proxyURL = u
+	return nil
+}
+
+func useProxy(host string) bool {
+	if proxyURL == nil {
+		return false
+	}
+
+	for _, h := range noProxyHosts {
+		if h == "*" || host == h || strings.HasSuffix(host, "."+strings.TrimPrefix(h, ".")) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dialTCP opens TCP connection to addr, directly or through configured proxy (zero timeout means no limit)
+func dialTCP(addr string, timeout time.Duration) (net.Conn, error) {
+	if proxyErr != nil {
+		return nil, proxyErr
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !useProxy(host) {
+		return dialDirect(addr, timeout)
+	}
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		if proxyURL.Scheme == "http" {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "8080")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "1080")
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, timeout)
+	if err != nil {
+		return nil, errors.New("Cannot connect to proxy " + proxyAddr + ": " + err.Error())
+	}
+
+	addr = overriddenAddr(addr) // proxy does not know overridden names
+	if proxyURL.Scheme == "http" {
+		conn, err = httpConnect(conn, addr)
+	} else {
+		err = socks5Connect(conn, addr)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// bufferedConn is a connection that has some data already read into buffer
+type bufferedConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+// lookupIP resolves host to its first address of family allowed by dialNetwork
+func lookupIP(host string) (net.IP, error) {
+	addrs, err := lookupHostIPs(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		family := "IPv4"
+		if dialNetwork == "tcp6" {
+			family = "IPv6"
+		}
+		return nil, errors.New("No " + family + " addresses found for " + host)
+	}
+	return addrs[0], nil
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.rd.Read(p)
+}
+
+// httpConnect asks HTTP proxy to establish tunnel to addr using CONNECT method
+func httpConnect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	// ssh server sends its version right away, so it can be read into buffer along with response headers
+	rd := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rd, req)
+	if err != nil {
+		return conn, errors.New("Cannot read proxy response: " + err.Error())
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return conn, errors.New("Proxy refused connection to " + addr + ": " + resp.Status)
+	}
+
+	return &bufferedConn{Conn: conn, rd: rd}, nil
+}
+
+// socks5Connect performs SOCKS5 handshake (RFC 1928) requesting connection to addr
+func socks5Connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return errors.New("Invalid port: " + portStr)
+	}
+
+	methods := []byte{0x00} // no authentication
+	if proxyURL.User != nil {
+		methods = append(methods, 0x02) // username/password
+	}
+
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return errors.New("Cannot read SOCKS5 greeting: " + err.Error())
+	}
+
+	switch resp[1] {
+	case 0x00:
+	case 0x02:
+		if proxyURL.User == nil {
+			return errors.New("SOCKS5 proxy requested authentication, but no credentials supplied")
+		}
+
+		username := proxyURL.User.Username()
+		password, _ := proxyURL.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 username or password is too long")
+		}
+
+		// RFC 1929 username/password authentication
+		authReq := append([]byte{0x01, byte(len(username))}, username...)
+		authReq = append(append(authReq, byte(len(password))), password...)
+		if _, err := conn.Write(authReq); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return errors.New("Cannot read SOCKS5 authentication response: " + err.Error())
+		}
+
+		if resp[1] != 0x00 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	default:
+		return errors.New("SOCKS5 proxy does not support any offered authentication method")
+	}
+
+	req := []byte{0x05, 0x01, 0x00} // version, CONNECT, reserved
+
+	ip := net.ParseIP(host)
+	if ip == nil && proxyURL.Scheme == "socks5" {
+		// "socks5h" means that names are resolved by proxy, and plain "socks5" means resolving them locally
+		var err error
+		if ip, err = lookupIP(host); err != nil {
+			return err
+		}
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 0x01), ip4...)
+	} else if ip != nil {
+		req = append(append(req, 0x04), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return errors.New("Host name is too long: " + host)
+		}
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	}
+
+	req = append(req, byte(port>>8), byte(port))
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// version, reply, reserved, address type
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return errors.New("Cannot read SOCKS5 response: " + err.Error())
+	}
+
+	if header[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 proxy refused connection to %s (reply code %d)", addr, header[1])
+	}
+
+	var addrLen int
+	switch header[3] {
+	case 0x01:
+		addrLen = net.IPv4len
+	case 0x04:
+		addrLen = net.IPv6len
+	case 0x03:
+		if _, err := io.ReadFull(conn, header[:1]); err != nil {
+			return err
+		}
+		addrLen = int(header[0])
+	default:
+		return fmt.Errorf("Unknown SOCKS5 address type %d", header[3])
+	}
+
+	// skip bound address and port
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
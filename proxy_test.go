@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+// startTestProxy starts SOCKS5 (without authentication) or HTTP CONNECT proxy and returns its address
+func startTestProxy(scheme string, tunnels *int32) string {
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Errorf("Could not listen: %s", err.Error()))
+	}
+
+	go func() {
+		for {
+			conn, err := list.Accept()
+			if err != nil {
+				panic(fmt.Errorf("Failed to accept incoming connection: %s", err))
+			}
+
+			go func() {
+				defer conn.Close()
+
+				rd := bufio.NewReader(conn)
+				var addr string
+
+				if scheme == "http" {
+					req, err := http.ReadRequest(rd)
+					if err != nil || req.Method != "CONNECT" {
+						return
+					}
+					addr = req.Host
+				} else {
+					greeting := make([]byte, 2)
+					io.ReadFull(rd, greeting)
+					io.ReadFull(rd, make([]byte, greeting[1]))
+					conn.Write([]byte{0x05, 0x00})
+
+					header := make([]byte, 4)
+					io.ReadFull(rd, header)
+					if header[3] != 0x01 {
+						return
+					}
+
+					ipPort := make([]byte, 6)
+					io.ReadFull(rd, ipPort)
+					addr = net.JoinHostPort(net.IP(ipPort[:4]).String(), fmt.Sprint(binary.BigEndian.Uint16(ipPort[4:])))
+				}
+
+				target, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+
+				atomic.AddInt32(tunnels, 1)
+
+				if scheme == "http" {
+					io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				} else {
+					conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+				}
+
+				go io.Copy(target, rd)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+
+	return list.Addr().String()
+}
+
+func TestProxy(t *testing.T) {
+	defer func() { proxyURL = nil }()
+
+	for _, scheme := range []string{"socks5", "http"} {
+		var tunnels int32
+		proxyURL = &url.URL{Scheme: scheme, Host: startTestProxy(scheme, &tunnels)}
+
+		r := makeTestResult()
+		startTestServers(r, "test-proxy-"+scheme, 5)
+		runTestRequest(t, r, makeProxyRequest(maxTimeout))
+		checkSuccess(t, r)
+
+		if int(atomic.LoadInt32(&tunnels)) != len(r.hosts) {
+			t.Fatalf("Expected %d connections through %s proxy, got %d", len(r.hosts), scheme, tunnels)
+		}
+	}
+}
+
+func TestInvalidProxy(t *testing.T) {
+	defer func() { proxyURL, proxyErr = nil, nil }()
+
+	for _, spec := range []string{"ftp://proxy.example.com", "socks5://", "http://[::1"} {
+		if err := initProxy(spec); err == nil {
+			t.Fatalf("Expected error for proxy %s", spec)
+		}
+
+		if _, err := dialTCP("127.0.0.1:22", 0); err != proxyErr {
+			t.Fatalf("Expected connections to be refused with invalid proxy %s, got %v", spec, err)
+		}
+	}
+}
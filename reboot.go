@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Reboots (Action == "reboot" or "gossha reboot host1 ... hostN"): "Cmd" (reboot by default, use
+// "Sudo": true if login user cannot reboot) is run on every host, and after "RebootGrace" the host is
+// connected to again every few seconds until SSH comes back or "RebootWait" runs out. Boot id of Linux
+// hosts is compared to the one before the reboot, so that a host that has not gone down yet is not
+// taken for one that came back. Replies have "Reboot" with the time it took the host to come back
+// online. Request "Timeout" defaults to the time that reboot can take, and "Serial" reboots hosts in
+// batches, e.g. to keep most of a cluster up.
+
+const (
+	defaultRebootCmd   = "reboot"
+	defaultRebootWait  = 10 * time.Minute
+	defaultRebootGrace = 10 * time.Second
+)
+
+var (
+	rebootPollInterval = 5 * time.Second                                   // time between connection attempts
+	rebootBootIDCmd    = "cat /proc/sys/kernel/random/boot_id 2>/dev/null" // prints id that changes on every boot
+)
+
+// RebootResult tells when host came back after reboot
+type RebootResult struct {
+	BackOnline float64 // time from reboot command until host accepted SSH connection again (in seconds)
+	BootID     string  `json:",omitempty"` // boot id after reboot (only on Linux)
+}
+
+// rebootOptions are parameters of Action == "reboot"
+type rebootOptions struct {
+	cmd         string
+	wait, grace time.Duration
+	opts        *cmdOptions
+}
+
+// parseRebootOptions returns parameters of reboot request msg
+func parseRebootOptions(msg *ProxyRequest) (*rebootOptions, error) {
+	if msg.GroupOutput {
+		return nil, errors.New("'GroupOutput' is not supported for reboot")
+	}
+	opts, err := parseCmdOptions(msg)
+	if err != nil {
+		return nil, err
+	}
+	opts.stream, opts.streamOnly, opts.pty = false, false, false
+
+	r := &rebootOptions{cmd: msg.Cmd, wait: rebootWait(msg), grace: defaultRebootGrace, opts: opts}
+	if r.cmd == "" {
+		r.cmd = defaultRebootCmd
+	}
+	if msg.RebootGrace > 0 {
+		r.grace = time.Duration(msg.RebootGrace) * time.Millisecond
+	}
+	return r, nil
+}
+
+// rebootWait returns "RebootWait" of msg
+func rebootWait(msg *ProxyRequest) time.Duration {
+	if msg.RebootWait > 0 {
+		return time.Duration(msg.RebootWait) * time.Millisecond
+	}
+	return defaultRebootWait
+}
+
+// rebootTimeout returns default "Timeout" of reboot request msg in milliseconds
+func rebootTimeout(msg *ProxyRequest) uint64 {
+	grace := defaultRebootGrace
+	if msg.RebootGrace > 0 {
+		grace = time.Duration(msg.RebootGrace) * time.Millisecond
+	}
+	return uint64((grace + rebootWait(msg) + requestTimeout) / time.Millisecond)
+}
+
+// rebootHost reboots hostname and waits until it accepts SSH connections again
+func rebootHost(r *rebootOptions, hostname string) *SshResult {
+	res := &SshResult{hostname: hostname}
+
+	conn, err := getConnection(hostname)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	bootID, _, err := runCmd(conn, hostname, rebootBootIDCmd, r.opts)
+	if bootID = strings.TrimSpace(bootID); err != nil {
+		bootID = "" // host is not Linux, the first successful connection is trusted
+	}
+
+	issued := time.Now()
+	res.stdout, res.stderr, err = runCmd(conn, hostname, r.cmd, r.opts)
+	connectedHosts.Release(hostname, conn)
+	if err != nil && !isConnClosed(conn, err) {
+		res.err = err
+		return res
+	}
+	connectedHosts.Forget(hostname, conn)
+	logf(logInfo, hostname, "Reboot is issued, waiting for host to come back")
+
+	time.Sleep(r.grace)
+	deadline := issued.Add(r.wait)
+	for {
+		if commandsInterrupted() {
+			res.err = errors.New("Interrupted while waiting for host to come back")
+			return res
+		}
+
+		newConn, err := connectHost(hostname, nil)
+		if err == nil {
+			newID, _, idErr := runCmd(newConn, hostname, rebootBootIDCmd, r.opts)
+			newConn.Close()
+			if newID = strings.TrimSpace(newID); bootID == "" || idErr == nil && newID != bootID {
+				res.reboot = &RebootResult{BackOnline: time.Since(issued).Seconds(), BootID: newID}
+				return res
+			}
+			err = errors.New("host has not rebooted yet")
+		} else {
+			var retryable *retryableError
+			if !errors.As(err, &retryable) {
+				res.err = err
+				return res
+			}
+		}
+
+		if time.Now().Add(rebootPollInterval).After(deadline) {
+			res.err = fmt.Errorf("Host did not come back in %s: %s", r.wait, err)
+			return res
+		}
+		time.Sleep(rebootPollInterval)
+	}
+}
+
+// formatReboot returns human-readable description of reboot result
+func formatReboot(r *RebootResult) string {
+	return fmt.Sprintf("back online after %.1fs", r.BackOnline)
+}
+
+// rebootMain implements "gossha reboot [flags] host1 ... hostN"
+func rebootMain(args []string) int {
+	var serial, cmd string
+	var sudo bool
+	var wait, grace time.Duration
+
+	os.Args = append([]string{os.Args[0]}, args...)
+	flag.StringVar(&serial, "serial", "", "Reboot N hosts (or N% of hosts) at a time")
+	flag.StringVar(&cmd, "cmd", defaultRebootCmd, "Command that reboots host")
+	flag.BoolVar(&sudo, "sudo", false, "Run reboot command with sudo")
+	flag.DurationVar(&wait, "wait", defaultRebootWait, "Time for host to come back after reboot command")
+	flag.DurationVar(&grace, "grace", defaultRebootGrace, "Time to wait after reboot command before connecting to host again")
+
+	return actionMain("reboot [flags] host1 ... hostN", fixedArgs(0), func(args []string) *ProxyRequest {
+		return &ProxyRequest{Action: "reboot", Cmd: cmd, Sudo: sudo, Hosts: args, Serial: serial,
+			RebootWait: uint64(wait / time.Millisecond), RebootGrace: uint64(grace / time.Millisecond)}
+	})
+}
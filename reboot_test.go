@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReboot(t *testing.T) {
+	defer func(cmd string, interval time.Duration) { rebootBootIDCmd, rebootPollInterval = cmd, interval }(rebootBootIDCmd, rebootPollInterval)
+	rebootBootIDCmd, rebootPollInterval = "cat boot_id", 50*time.Millisecond
+
+	r := makeTestResult()
+	startTestServers(r, "test-reboot", 2)
+	for _, srv := range r.hosts {
+		must(ioutil.WriteFile(filepath.Join(srv.root, "boot_id"), []byte("before\n"), 0644), "Could not write boot id")
+	}
+
+	// boot id changes a bit later than reboot command exits, like on a host that takes time to go down
+	runTestRequest(t, r, &ProxyRequest{Action: "reboot", Cmd: "(sleep 0.3; echo after > boot_id) >/dev/null 2>&1 &", RebootGrace: 1})
+	for _, reply := range r.replies {
+		if !reply.Success || reply.Reboot == nil || reply.Reboot.BootID != "after" || reply.Reboot.BackOnline < 0.3 {
+			t.Fatalf("Unexpected reboot result of %s: %+v", reply.Hostname, reply.Reboot)
+		}
+	}
+
+	// boot id stays the same, so host is not taken for rebooted
+	sendTestRequest(t, r, &ProxyRequest{Action: "reboot", Cmd: "true", RebootGrace: 1, RebootWait: 300})
+	for _, reply := range r.replies {
+		if reply.Success || !strings.HasPrefix(reply.ErrMsg, "Host did not come back in 300ms: host has not rebooted yet") {
+			t.Fatalf("Expected reboot timeout for %s, got %+v", reply.Hostname, reply)
+		}
+	}
+
+	sendTestRequest(t, r, &ProxyRequest{Action: "reboot", Cmd: "exit 3", RebootGrace: 1})
+	for _, reply := range r.replies {
+		if reply.Success || reply.ExitCode != 3 || reply.Reboot != nil {
+			t.Fatalf("Failed reboot command must fail host %s: %+v", reply.Hostname, reply)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Dropped connections: when connection is lost while command is running, it is removed from
+// connection cache, so that next actions on the host reconnect instead of failing on the dead
+// connection. With "RerunOnDisconnect" (or -rerun-on-disconnect) the action itself is run once
+// more over a new connection, which is only safe for idempotent commands.
+
+var rerunOnDisconnect bool // rerun actions on hosts which connection was lost while they were running (-rerun-on-disconnect)
+
+// disconnectedError is a failure of command caused by loss of connection while it was running
+type disconnectedError struct {
+	err error
+}
+
+func (e *disconnectedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *disconnectedError) Unwrap() error {
+	return e.err
+}
+
+// checkDisconnected wraps err into disconnectedError and drops conn from cache if command failed
+// because connection to hostname was lost
+func checkDisconnected(conn *ssh.Client, hostname string, err error) error {
+	if err == nil || !isConnClosed(conn, err) {
+		return err
+	}
+
+	logf(logInfo, hostname, "Connection lost while command was running: %s", err)
+	connectedHosts.Forget(hostname, conn)
+	return &disconnectedError{err}
+}
+
+// isConnClosed checks whether command error err means that conn is no longer usable
+func isConnClosed(conn *ssh.Client, err error) bool {
+	if err == errConnectionLost {
+		return true
+	}
+
+	var missing *ssh.ExitMissingError
+	if !errors.As(err, &missing) && err != io.EOF {
+		return false
+	}
+
+	// command that exited without status may have been killed by server while connection is fine,
+	// broken connection is closed by ssh package right away
+	closed := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		return true
+	case <-time.After(100 * time.Millisecond):
+		return false
+	}
+}
+
+// withReruns runs action on host once more if connection was lost while it was running
+func withReruns(msg *ProxyRequest, execFunc func(string) *SshResult) func(string) *SshResult {
+	if !msg.RerunOnDisconnect && !rerunOnDisconnect {
+		return execFunc
+	}
+
+	return func(hostname string) *SshResult {
+		res := execFunc(hostname)
+
+		var disconnected *disconnectedError
+		if res.err == nil || !errors.As(res.err, &disconnected) {
+			return res
+		}
+
+		logf(logInfo, hostname, "Running action again over new connection")
+		res = execFunc(hostname)
+		res.rerun = true
+		return res
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// runDroppedCmd runs command on a single server which drops connection during the first command and returns reply
+func runDroppedCmd(t *testing.T, rerun bool) (*testSSHServer, *Reply) {
+	r := makeTestResult()
+	startTestServers(r, "test-reconnect", 1)
+
+	var srv *testSSHServer
+	for _, s := range r.hosts {
+		srv = s
+	}
+	atomic.StoreInt32(&srv.dropCmds, 1)
+
+	req := makeProxyRequest(maxTimeout)
+	req.Hosts = []string{srv.addr}
+	req.RerunOnDisconnect = rerun
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+
+	return srv, r.replies[srv.addr]
+}
+
+func TestRerunOnDisconnect(t *testing.T) {
+	srv, reply := runDroppedCmd(t, true)
+	if reply == nil || !reply.Success || !reply.Rerun || reply.Stdout != srv.hostname {
+		t.Fatalf("Action must succeed after rerun, got %+v", reply)
+	}
+	if n := atomic.LoadInt32(&srv.connections); n != 2 {
+		t.Fatalf("Expected 2 connections, got %d", n)
+	}
+}
+
+func TestReconnectAfterDisconnect(t *testing.T) {
+	srv, reply := runDroppedCmd(t, false)
+	if reply == nil || reply.Success || reply.Rerun {
+		t.Fatalf("Action must fail without RerunOnDisconnect, got %+v", reply)
+	}
+
+	// dead connection is not reused by the next action
+	r := makeTestResult()
+	r.hosts[srv.addr] = srv
+	r.hostsLeft[srv.addr] = struct{}{}
+	req := makeProxyRequest(maxTimeout)
+	req.Hosts = []string{srv.addr}
+	runTestRequest(t, r, req)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session recording (-record DIR): output of commands of every "ssh" and "script" request is
+// stored in DIR/<start time>/<host>.cast in asciicast v2 format: header line followed by
+// [seconds since start of request, code, data] events, where "o" is stdout, "e" is stderr,
+// "m" marks start of a command and "x" is its exit code. "gossha replay" plays recordings back.
+
+var recordDir string // directory to record output of commands to (-record), empty disables recording
+
+const (
+	recordTimeFormat = "20060102-150405.000000" // names of request directories
+	maxCastLine      = 16 << 20                 // escaped output that session writes at once fits easily
+)
+
+type (
+	// runRecording is a directory with recordings of all hosts of a single request
+	runRecording struct {
+		mu    sync.Mutex // commands of a host can be started concurrently (see HostParallel)
+		dir   string
+		start time.Time
+	}
+
+	// castFile is a recording of a host that is being written
+	castFile struct {
+		mu    sync.Mutex
+		fp    *os.File
+		start time.Time
+		err   error // first write error
+	}
+
+	castWriter struct {
+		f    *castFile
+		code string
+	}
+
+	castHeader struct {
+		Version   int    `json:"version"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+		Timestamp int64  `json:"timestamp"`
+		Title     string `json:"title"`
+	}
+
+	castEvent struct {
+		host string
+		time float64
+		code string
+		data string
+	}
+)
+
+// startRecording creates directory for recordings of request, it returns nil if recording is disabled
+func startRecording() (*runRecording, error) {
+	if recordDir == "" || dryRun {
+		return nil, nil
+	}
+
+	r := &runRecording{start: time.Now()}
+	r.dir = filepath.Join(recordDir, r.start.Format(recordTimeFormat))
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return nil, errors.New("Cannot create recording directory: " + err.Error())
+	}
+
+	return r, nil
+}
+
+// open opens recording of host for appending events of cmd, header is written to new recordings
+func (r *runRecording) open(hostname, cmd string) (*castFile, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fp, err := os.OpenFile(filepath.Join(r.dir, hostname+".cast"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.New("Cannot create recording: " + err.Error())
+	}
+
+	f := &castFile{fp: fp, start: r.start}
+	if fi, err := fp.Stat(); err == nil && fi.Size() == 0 {
+		f.writeJSON(&castHeader{Version: 2, Width: ptyWidth, Height: ptyHeight, Timestamp: r.start.Unix(), Title: hostname})
+	}
+	f.event("m", cmd)
+
+	if f.err != nil {
+		fp.Close()
+		return nil, errors.New("Cannot write recording: " + f.err.Error())
+	}
+	return f, nil
+}
+
+func (f *castFile) writeJSON(v interface{}) {
+	buf, err := json.Marshal(v)
+	if err == nil {
+		_, err = f.fp.Write(append(buf, '\n'))
+	}
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *castFile) event(code, data string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := float64(time.Since(f.start)/time.Microsecond) / 1e6
+	f.writeJSON([]interface{}{t, code, data})
+}
+
+// writer returns writer that records data written to it as events with code
+func (f *castFile) writer(code string) io.Writer {
+	return &castWriter{f: f, code: code}
+}
+
+// Write never fails, so that recording problems do not break execution of commands
+func (w *castWriter) Write(p []byte) (int, error) {
+	w.f.event(w.code, string(p))
+	return len(p), nil
+}
+
+// finish records exit code of command that returned err and closes recording
+func (f *castFile) finish(err error) error {
+	f.event("x", fmt.Sprint(exitCode(err)))
+
+	if closeErr := f.fp.Close(); f.err == nil {
+		f.err = closeErr
+	}
+	return f.err
+}
+
+// readCast reads events of recording, host is taken from title of the header
+func readCast(filename string) (events []*castEvent, err error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(nil, maxCastLine)
+	var header castHeader
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &header) != nil || header.Version != 2 {
+		return nil, errors.New(filename + " is not an asciicast v2 recording")
+	}
+
+	for scanner.Scan() {
+		var fields []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil || len(fields) != 3 {
+			return nil, errors.New("Invalid event in " + filename + ": " + scanner.Text())
+		}
+
+		t, _ := fields[0].(float64)
+		code, _ := fields[1].(string)
+		data, _ := fields[2].(string)
+		events = append(events, &castEvent{host: header.Title, time: t, code: code, data: data})
+	}
+
+	return events, scanner.Err()
+}
+
+// replayEvents writes events to stdout and stderr in order of time, waiting between them as
+// they were recorded divided by speed (0 means no waiting). With prefix every line is prefixed
+// with host, and starts and exit codes of commands are shown.
+func replayEvents(stdout, stderr io.Writer, events []*castEvent, speed float64, prefix bool) {
+	sort.SliceStable(events, func(i, j int) bool { return events[i].time < events[j].time })
+
+	partial := make(map[string]string) // incomplete lines of host streams
+	writeLines := func(w io.Writer, key, host, data string) {
+		data = partial[key] + data
+		end := strings.LastIndexByte(data, '\n') + 1
+		for _, line := range strings.SplitAfter(data[:end], "\n") {
+			if line != "" {
+				fmt.Fprint(w, host+": "+line)
+			}
+		}
+		partial[key] = data[end:]
+	}
+	flush := func(w io.Writer, key, host string) {
+		if partial[key] != "" {
+			writeLines(w, key, host, "\n")
+		}
+	}
+
+	var last float64
+	for _, ev := range events {
+		if speed > 0 && ev.time > last {
+			time.Sleep(time.Duration((ev.time - last) / speed * float64(time.Second)))
+		}
+		last = ev.time
+
+		w := stdout
+		if ev.code == "e" {
+			w = stderr
+		}
+
+		switch {
+		case ev.code != "o" && ev.code != "e" && !prefix:
+		case ev.code == "m":
+			fmt.Fprintf(stdout, "%s: $ %s\n", ev.host, ev.data)
+		case ev.code == "x":
+			flush(stdout, ev.host+"o", ev.host)
+			flush(stderr, ev.host+"e", ev.host)
+			fmt.Fprintf(stdout, "%s: exit code %s\n", ev.host, ev.data)
+		case prefix:
+			writeLines(w, ev.host+ev.code, ev.host, ev.data)
+		default:
+			fmt.Fprint(w, ev.data)
+		}
+	}
+}
+
+// replayMain implements "gossha replay [-speed N] [-host HOST] <recording>", it returns exit status
+func replayMain(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speed := fs.Float64("speed", 1, "Playback speed, 0 prints recording without delays")
+	host := fs.String("host", "", "Replay only recording of the host")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gossha replay [-speed N] [-host HOST] <request directory or .cast file>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	path := fs.Arg(0)
+	fi, err := os.Stat(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	// raw output of a single host is replayed as is, output of the whole request is prefixed with hosts
+	files, prefix := []string{path}, false
+	if fi.IsDir() {
+		if *host != "" {
+			files = []string{filepath.Join(path, *host+".cast")}
+		} else {
+			infos, err := ioutil.ReadDir(path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				return 1
+			}
+
+			files, prefix = nil, true
+			for _, info := range infos {
+				if strings.HasSuffix(info.Name(), ".cast") {
+					files = append(files, filepath.Join(path, info.Name()))
+				}
+			}
+		}
+	}
+
+	var events []*castEvent
+	for _, filename := range files {
+		evs, err := readCast(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		events = append(events, evs...)
+	}
+
+	replayEvents(os.Stdout, os.Stderr, events, *speed, prefix)
+	return 0
+}
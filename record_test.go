@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossha-record")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	recordDir = dir
+	defer func() { recordDir = "" }()
+
+	r := makeTestResult()
+	startTestServers(r, "test-record", 2)
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmds: []string{"echo out; echo err >&2", "printf 'no newline'"}})
+
+	runs, err := ioutil.ReadDir(dir)
+	must(err, "Could not list recordings")
+	if len(runs) != 1 {
+		t.Fatalf("Expected one directory for request, got %d", len(runs))
+	}
+	runDir := filepath.Join(dir, runs[0].Name())
+
+	var events []*castEvent
+	for addr := range r.hosts {
+		evs, err := readCast(filepath.Join(runDir, addr+".cast"))
+		must(err, "Could not read recording")
+
+		var codes string
+		for _, ev := range evs {
+			if ev.host != addr {
+				t.Fatalf("Unexpected host of event: %+v", ev)
+			}
+			codes += ev.code
+		}
+		// stdout and stderr may be written in any order
+		if len(codes) != 7 || codes[0] != 'm' || codes[3:] != "xmox" {
+			t.Fatalf("Unexpected events of %s: %s", addr, codes)
+		}
+		events = append(events, evs...)
+	}
+
+	var stdout, stderr bytes.Buffer
+	replayEvents(&stdout, &stderr, events, 0, true)
+
+	for addr := range r.hosts {
+		for _, line := range []string{addr + ": $ echo out; echo err >&2\n", addr + ": out\n", addr + ": no newline\n", addr + ": exit code 0\n"} {
+			if !bytes.Contains(stdout.Bytes(), []byte(line)) {
+				t.Fatalf("Replayed output does not contain %q:\n%s", line, stdout.String())
+			}
+		}
+		if !bytes.Contains(stderr.Bytes(), []byte(addr+": err\n")) {
+			t.Fatalf("Unexpected replayed stderr:\n%s", stderr.String())
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Relayed uploads ("Relay": N or "gossha put -relay N"): uploading a large file to hundreds of hosts
+// saturates the uplink of the operator, so with "Relay" GoSSHa only uploads the file to the first N
+// hosts it starts, and every host that received the file pushes it to up to N hosts started after it
+// with scp, run by GoSSHa on the host, forming a distribution tree. Peers are addressed by their
+// ansible_host, ansible_port and ansible_user, so hosts must be able to log into each other: start
+// GoSSHa with -A to forward the agent, or provision keys. If the host a peer is assigned to fails, or
+// scp from it fails, the file is uploaded to the peer directly, so relaying never makes a run fail.
+// Replies of relayed hosts have "RelayedFrom". Only a single file can be relayed, and options that
+// need SFTP on every host ("Sudo", "Owner", "SkipUnchanged" and "ChangeReport") are not supported.
+
+var relayCopyCmd = "scp -q -p -o BatchMode=yes -o StrictHostKeyChecking=accept-new" // run on host that pushes the file
+
+// relayTree assigns hosts of request to hosts that push the file to them
+type relayTree struct {
+	fanout int
+
+	mu      sync.Mutex
+	started []string                 // hosts in order they were started
+	parents map[string]string        // host that pushes the file to host, empty if it is uploaded directly
+	done    map[string]chan struct{} // closed when host has finished
+	ok      map[string]bool          // host has received the file
+}
+
+// newRelayTree returns tree where every host pushes the file to up to fanout other hosts
+func newRelayTree(fanout int) *relayTree {
+	return &relayTree{fanout: fanout, parents: make(map[string]string), done: make(map[string]chan struct{}), ok: make(map[string]bool)}
+}
+
+// checkRelayOptions validates "Relay" of msg, which uploads entries to target
+func checkRelayOptions(msg *ProxyRequest, entries []*uploadEntry) error {
+	if len(entries) != 1 || entries[0].isDir || len(msg.Sources) > 0 || msg.Template {
+		return errors.New("'Relay' can only be used to upload a single file to the same target on every host")
+	}
+	if !isRelaySafePath(msg.Target) {
+		return fmt.Errorf("'Target' %q cannot be used with 'Relay', only letters, digits and /._-+,=@%% are allowed", msg.Target)
+	}
+	for _, o := range []struct {
+		set  bool
+		name string
+	}{
+		{msg.Sudo, "Sudo"},
+		{msg.Owner != "", "Owner"},
+		{msg.SkipUnchanged, "SkipUnchanged"},
+		{msg.ChangeReport, "ChangeReport"},
+	} {
+		if o.set {
+			return errors.New("'" + o.name + "' cannot be used with 'Relay'")
+		}
+	}
+	return nil
+}
+
+// isRelaySafePath tells whether p can be passed to scp run on host: in legacy mode the remote side
+// of scp runs "scp -t <path>" with the shell of the peer, in SFTP mode it does not, so the path is
+// interpreted differently if it is quoted and must not need quoting at all
+func isRelaySafePath(p string) bool {
+	for _, c := range p {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune("/._-+,=@%", c)) {
+			return false
+		}
+	}
+	return p != ""
+}
+
+// assign returns host that pushes the file to hostname, empty if it is uploaded directly
+func (t *relayTree) assign(hostname string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if parent, ok := t.parents[hostname]; ok { // retried
+		return parent
+	}
+
+	k := len(t.started)
+	t.started = append(t.started, hostname)
+	t.done[hostname] = make(chan struct{})
+	if k < t.fanout {
+		t.parents[hostname] = ""
+	} else {
+		t.parents[hostname] = t.started[k/t.fanout-1]
+	}
+	return t.parents[hostname]
+}
+
+// finish records whether hostname has received the file
+func (t *relayTree) finish(hostname string, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	select {
+	case <-t.done[hostname]:
+	default:
+		t.ok[hostname] = ok
+		close(t.done[hostname])
+	}
+}
+
+// wait waits for hostname to finish and tells whether it has received the file
+func (t *relayTree) wait(hostname string) bool {
+	t.mu.Lock()
+	done := t.done[hostname]
+	t.mu.Unlock()
+
+	<-done
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ok[hostname]
+}
+
+// upload uploads entries to target on hostname by relaying them from its parent, or directly
+func (t *relayTree) upload(target string, entries []*uploadEntry, opts *uploadOptions, hostname string) *SshResult {
+	res := &SshResult{hostname: hostname}
+	if parent := t.assign(hostname); parent != "" && t.wait(parent) {
+		err := relayFile(parent, hostname, target, entries[0], opts)
+		if err == nil {
+			res.relayedFrom = parent
+			t.finish(hostname, true)
+			return res
+		}
+		logf(logInfo, hostname, "Uploading directly: %s", err)
+	}
+
+	res.unchanged, res.changes, res.err = uploadFile(target, entries, opts, hostname)
+	t.finish(hostname, res.err == nil)
+	return res
+}
+
+// relayFile copies target from parent to the same path on hostname with scp run on parent
+func relayFile(parent, hostname, target string, entry *uploadEntry, opts *uploadOptions) error {
+	addr, conf := inventoryTarget(hostname, &ssh.ClientConfig{User: user})
+	host, port := splitHostPort(addr)
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	conn, err := getConnection(parent)
+	if err != nil {
+		return errors.New("Cannot connect to " + parent + ": " + err.Error())
+	}
+	cmd := fmt.Sprintf("%s -P %s -- %s %s", relayCopyCmd, port, shellQuote(target), shellQuote(conf.User+"@"+host+":"+target))
+	_, stderr, err := runCmd(conn, parent, cmd, &cmdOptions{})
+	connectedHosts.Release(parent, conn)
+	if err != nil {
+		if msg := strings.TrimSpace(stderr); msg != "" {
+			err = errors.New(msg)
+		}
+		return errors.New("Cannot relay " + path.Base(target) + " from " + parent + ": " + err.Error())
+	}
+
+	if !opts.verify {
+		return nil
+	}
+	expected, err := entry.sha256()
+	if err != nil {
+		return err
+	}
+	conn, err = getConnection(hostname)
+	if err != nil {
+		return err
+	}
+	defer connectedHosts.Release(hostname, conn)
+	actual, err := remoteSHA256(conn, target)
+	if err != nil {
+		return errors.New("Cannot verify " + target + ": " + err.Error())
+	}
+	if actual != expected {
+		return fmt.Errorf("Checksum mismatch for %s relayed from %s: expected sha256 %s, got %s", target, parent, expected, actual)
+	}
+	return nil
+}
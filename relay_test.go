@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRelayedUpload(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-relay", 7)
+
+	// scp is replaced with a copy into root of the server that listens on the port
+	dir, err := ioutil.TempDir("", "gossha-relay")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	var failing string
+	script := "port=$2; src=$4; dst=${5#*:}\ncase $port in\n"
+	for addr, srv := range r.hosts {
+		_, port := splitHostPort(addr)
+		if failing == "" {
+			failing = addr
+			script += port + ") echo 'Connection refused' >&2; exit 1;;\n"
+			continue
+		}
+		script += port + ") cp \"$src\" " + shellQuote(srv.root) + "/\"$dst\";;\n"
+	}
+	script += "esac\n"
+	must(ioutil.WriteFile(filepath.Join(dir, "scp"), []byte(script), 0755), "Could not write scp")
+
+	defer func(cmd string) { relayCopyCmd = cmd }(relayCopyCmd)
+	relayCopyCmd = "sh " + shellQuote(filepath.Join(dir, "scp"))
+
+	contents := []byte(strings.Repeat("artifact\n", 1000))
+	runTestRequest(t, r, &ProxyRequest{Action: "scp", Source: dataSource, Data: contents, Target: "artifact.bin", Relay: 2, Verify: true})
+
+	relayed := 0
+	for addr, reply := range r.replies {
+		if !reply.Success {
+			t.Fatalf("Upload to %s failed: %s", addr, reply.ErrMsg)
+		}
+		if got, err := ioutil.ReadFile(filepath.Join(r.hosts[addr].root, "artifact.bin")); err != nil || string(got) != string(contents) {
+			t.Fatalf("Unexpected contents on %s: %d bytes, %v", addr, len(got), err)
+		}
+		if reply.RelayedFrom != "" {
+			relayed++
+			if addr == failing {
+				t.Fatalf("Host that peers cannot copy to must get file directly")
+			}
+		}
+	}
+	// the first 2 hosts and the failing one (unless it is one of the first 2) get the file directly
+	if relayed < 4 {
+		t.Fatalf("Expected at least 4 relayed hosts, got %d", relayed)
+	}
+
+	if err := checkRelayOptions(&ProxyRequest{Relay: 2, Sudo: true}, []*uploadEntry{{}}); err == nil {
+		t.Fatalf("Sudo must not be allowed with Relay")
+	}
+	if err := checkRelayOptions(&ProxyRequest{Relay: 2}, []*uploadEntry{{isDir: true}}); err == nil {
+		t.Fatalf("Directories must not be relayed")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Remote timeout ("RemoteTimeout": true or -remote-timeout): timeout of the request (gossha_timeout
+// of host if it is shorter) is enforced on remote side as well, so that commands do not keep running
+// after GoSSHa gave up on them. Commands are run under timeout(1) of coreutils, which terminates them
+// (and kills them 5 seconds later if they are still running) when time is up, and hosts fail with
+// "command-timeout" error kind then; commands are run without it on hosts that do not have timeout.
+// Commands that are still running when the action times out get SIGKILL through their sessions
+// before connections are closed.
+
+const remoteKillAfter = 5 // seconds between SIGTERM and SIGKILL of timeout(1)
+
+var remoteTimeoutDefault bool // -remote-timeout
+
+// requestRemoteTimeout returns timeout to enforce on remote side for commands of msg, 0 if it is not enforced
+func requestRemoteTimeout(msg *ProxyRequest) time.Duration {
+	if !msg.RemoteTimeout && !remoteTimeoutDefault {
+		return 0
+	}
+	if msg.Timeout > 0 {
+		return time.Duration(msg.Timeout) * time.Millisecond
+	}
+	return requestTimeout
+}
+
+// remoteTimeoutOf returns timeout of command on hostname, gossha_timeout is used if it is shorter
+func remoteTimeoutOf(opts *cmdOptions, hostname string) time.Duration {
+	timeout := opts.remoteTimeout
+	if timeout == 0 || hostInventory == nil {
+		return timeout
+	}
+	if t := hostOptionsOf(hostname).timeout; t > 0 && t < timeout {
+		timeout = t
+	}
+	return timeout
+}
+
+// remoteTimeoutCommand wraps command line cmd so that it is terminated after timeout on remote host;
+// it is passed to /bin/sh, so that the wrapper works with any login shell
+func remoteTimeoutCommand(cmd string, timeout time.Duration) string {
+	secs := int64(math.Ceil(timeout.Seconds()))
+	script := fmt.Sprintf(`if command -v timeout >/dev/null 2>&1; then exec timeout -k %d %d /bin/sh -c "$0"; fi; exec /bin/sh -c "$0"`, remoteKillAfter, secs)
+	return "/bin/sh -c " + shellQuote(script) + " " + shellQuote(cmd)
+}
+
+// checkRemoteTimeout replaces exit status 124 of timeout(1) with timeout error
+func checkRemoteTimeout(err error, timeout time.Duration) error {
+	var exitErr *ssh.ExitError
+	if timeout > 0 && errors.As(err, &exitErr) && exitErr.ExitStatus() == 124 {
+		return &hostTimeoutError{fmt.Sprintf("Timed out on remote host after %s", timeout)}
+	}
+	return err
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestRemoteTimeout(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-remote-timeout", 2)
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: `printf '%s\n' "it's"`, RemoteTimeout: true})
+	for _, reply := range r.replies {
+		if reply.Stdout != "it's\n" {
+			t.Fatalf("Command must be passed to timeout verbatim, got %q", reply.Stdout)
+		}
+	}
+
+	if _, err := exec.LookPath("timeout"); err != nil {
+		t.Skip("timeout is not installed")
+	}
+
+	start := time.Now()
+	err := exec.Command("/bin/sh", "-c", remoteTimeoutCommand("sleep 10", 500*time.Millisecond)).Run()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 124 {
+		t.Fatalf("Command must be terminated by timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Command was terminated after %s instead of 1s", elapsed)
+	}
+}
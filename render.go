@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output renderers (-output <format>): replies are written by the renderer of the format. "json"
+// (default) writes every reply as a line of JSON and "text" (or "plain") in human-readable form,
+// "prefixed" prints every line of output as "<host>: <line>", "grouped" collects results of a run
+// and prints hosts with identical results once (like "GroupOutput"), "csv" writes a row per host and
+// "html" writes self-contained HTML report with collapsible section for every host when run finishes,
+// "events" writes lifecycle events of hosts (see events.go).
+// Reports and tables are written to stdout, other replies (errors, prompts) go to stderr as text.
+
+// OutputRenderer writes replies that are sent to user in one format
+type OutputRenderer interface {
+	// Render writes reply, it is called for every reply in order they are sent
+	Render(reply interface{})
+}
+
+// outputRenderers contains constructors of renderers of -output formats
+var outputRenderers = map[string]func(stdout, stderr io.Writer) OutputRenderer{
+	"json":  func(stdout, stderr io.Writer) OutputRenderer { return &jsonRenderer{w: stdout} },
+	"text":  newTextRenderer,
+	"plain": newTextRenderer,
+	"prefixed": func(stdout, stderr io.Writer) OutputRenderer {
+		return &prefixedRenderer{stdout: stdout, stderr: stderr}
+	},
+	"grouped": func(stdout, stderr io.Writer) OutputRenderer { return &groupedRenderer{stdout: stdout, stderr: stderr} },
+	"csv": func(stdout, stderr io.Writer) OutputRenderer {
+		return &csvRenderer{w: csv.NewWriter(stdout), stderr: stderr}
+	},
+	"html":   func(stdout, stderr io.Writer) OutputRenderer { return &htmlRenderer{w: stdout, stderr: stderr} },
+	"events": func(stdout, stderr io.Writer) OutputRenderer { return &eventsRenderer{stdout: stdout, stderr: stderr} },
+}
+
+// newOutputRenderer returns renderer of format that writes to stdout and stderr
+func newOutputRenderer(format string, stdout, stderr io.Writer) (OutputRenderer, error) {
+	newRenderer, ok := outputRenderers[format]
+	if !ok {
+		names := make([]string, 0, len(outputRenderers))
+		for name := range outputRenderers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, errors.New("Unsupported output format " + format + ", expected one of " + strings.Join(names, ", "))
+	}
+	return newRenderer(stdout, stderr), nil
+}
+
+// outputReplierThread writes replies with renderer r
+func outputReplierThread(r OutputRenderer) {
+	connectionReporting := true
+
+	for reply := range repliesChan {
+		switch reply.(type) {
+		case DisableReportConnectedHosts:
+			connectionReporting = false
+			continue
+
+		case EnableReportConnectedHosts:
+			connectionReporting = true
+			continue
+
+		case *ConnectionProgress:
+			if !connectionReporting || quiet {
+				continue
+			}
+		}
+
+		r.Render(reply)
+	}
+}
+
+type jsonRenderer struct {
+	w io.Writer
+}
+
+func (r *jsonRenderer) Render(reply interface{}) {
+	writeReplyJSON(r.w, reply)
+}
+
+type textRenderer struct {
+	stdout, stderr io.Writer
+}
+
+func newTextRenderer(stdout, stderr io.Writer) OutputRenderer {
+	return &textRenderer{stdout: stdout, stderr: stderr}
+}
+
+func (r *textRenderer) Render(reply interface{}) {
+	writeReplyText(r.stdout, r.stderr, reply, "")
+}
+
+// prefixedRenderer prints output of hosts line by line, so that it can be filtered with grep
+type prefixedRenderer struct {
+	stdout, stderr io.Writer
+}
+
+func (r *prefixedRenderer) Render(reply interface{}) {
+	switch reply := reply.(type) {
+	case *Reply:
+		r.writeResult(reply.Hostname, reply.Stdout, reply.Stderr, reply.Success, reply.ErrMsg, reply.Skipped, reply.FollowUp)
+	case *GroupedReply:
+		r.writeResult(strings.Join(reply.Hosts, ","), reply.Stdout, reply.Stderr, reply.Success, reply.ErrMsg, reply.Skipped, reply.FollowUp)
+	default:
+		writeReplyText(r.stdout, r.stderr, reply, "")
+	}
+}
+
+func (r *prefixedRenderer) writeResult(host, stdout, stderr string, success bool, errMsg string, skipped bool, followUp *CommandResult) {
+	writePrefixed(r.stdout, host+": ", stdout)
+	writePrefixed(r.stdout, host+" (stderr): ", stderr)
+	if followUp != nil {
+		writePrefixed(r.stdout, host+" ("+followUp.Cmd+"): ", followUp.Stdout)
+		writePrefixed(r.stdout, host+" ("+followUp.Cmd+", stderr): ", followUp.Stderr)
+	}
+	if !success {
+		fmt.Fprintf(r.stdout, "%s: failed: %s\n", host, errMsg)
+	} else if skipped {
+		fmt.Fprintf(r.stdout, "%s: skipped\n", host)
+	}
+}
+
+// groupedRenderer prints hosts with identical results of a run together when it finishes
+type groupedRenderer struct {
+	stdout, stderr io.Writer
+	replies        []*Reply
+}
+
+func (r *groupedRenderer) Render(reply interface{}) {
+	switch reply := reply.(type) {
+	case *Reply:
+		r.replies = append(r.replies, reply)
+	case *FinalReply:
+		for _, g := range groupReplies(r.replies) {
+			writeReplyText(r.stdout, r.stderr, g, "")
+		}
+		r.replies = nil
+		writeReplyText(r.stdout, r.stderr, reply, "")
+	default:
+		writeReplyText(r.stdout, r.stderr, reply, "")
+	}
+}
+
+var csvHeader = []string{"Hostname", "Success", "ExitCode", "ErrorKind", "ErrMsg", "Duration", "Tags", "Stdout", "Stderr"}
+
+// csvRenderer writes a row for every host, header is written before the first one
+type csvRenderer struct {
+	w             *csv.Writer
+	stderr        io.Writer
+	headerWritten bool
+}
+
+func (r *csvRenderer) Render(reply interface{}) {
+	switch reply := reply.(type) {
+	case *Reply:
+		r.write([]string{reply.Hostname, strconv.FormatBool(reply.Success), strconv.Itoa(reply.ExitCode), reply.ErrorKind, reply.ErrMsg,
+			strconv.FormatFloat(reply.Duration, 'f', 3, 64), formatTags(reply.Tags), reply.Stdout, reply.Stderr})
+	case *GroupedReply:
+		for _, h := range reply.Hosts {
+			r.write([]string{h, strconv.FormatBool(reply.Success), strconv.Itoa(reply.ExitCode), reply.ErrorKind, reply.ErrMsg, "", formatTags(hostTags(h)), reply.Stdout, reply.Stderr})
+		}
+	default:
+		writeReplyText(r.stderr, r.stderr, reply, "")
+	}
+}
+
+func (r *csvRenderer) write(row []string) {
+	if !r.headerWritten {
+		r.w.Write(csvHeader)
+		r.headerWritten = true
+	}
+	r.w.Write(row)
+	r.w.Flush()
+}
+
+// formatTags returns "<name>=<value>" of tags separated by spaces in alphabetical order
+func formatTags(tags map[string]string) string {
+	res := make([]string, 0, len(tags))
+	for name, value := range tags {
+		res = append(res, name+"="+value)
+	}
+	sort.Strings(res)
+	return strings.Join(res, " ")
+}
+
+// htmlHost is a section of HTML report
+type htmlHost struct {
+	Name     string
+	Success  bool
+	Status   string
+	Duration string
+	Stdout   string
+	Stderr   string
+	FollowUp *CommandResult
+}
+
+// htmlRenderer collects results of a run and writes HTML report when it finishes
+type htmlRenderer struct {
+	w      io.Writer
+	stderr io.Writer
+	hosts  []*htmlHost
+}
+
+func (r *htmlRenderer) Render(reply interface{}) {
+	switch reply := reply.(type) {
+	case *Reply:
+		r.hosts = append(r.hosts, &htmlHost{Name: reply.Hostname, Success: reply.Success, Status: replyStatus(reply.Success, reply.ErrMsg, reply.Skipped, reply.Unchanged),
+			Duration: fmt.Sprintf("%.2fs", reply.Duration), Stdout: reply.Stdout, Stderr: reply.Stderr, FollowUp: reply.FollowUp})
+	case *GroupedReply:
+		r.hosts = append(r.hosts, &htmlHost{Name: strings.Join(reply.Hosts, ", "), Success: reply.Success, Status: replyStatus(reply.Success, reply.ErrMsg, reply.Skipped, reply.Unchanged),
+			Stdout: reply.Stdout, Stderr: reply.Stderr, FollowUp: reply.FollowUp})
+	case *FinalReply:
+		if err := r.writeReport(reply); err != nil {
+			fmt.Fprintln(r.stderr, "Error: Cannot write HTML report: "+err.Error())
+		}
+		r.hosts = nil
+	default:
+		writeReplyText(r.stderr, r.stderr, reply, "")
+	}
+}
+
+func replyStatus(success bool, errMsg string, skipped, unchanged bool) string {
+	switch {
+	case !success:
+		return "failed: " + errMsg
+	case skipped:
+		return "skipped"
+	case unchanged:
+		return "unchanged"
+	}
+	return "ok"
+}
+
+func (r *htmlRenderer) writeReport(final *FinalReply) error {
+	data := struct {
+		Time             string
+		TotalTime        string
+		Hosts            []*htmlHost
+		Succeeded        int
+		Failed           int
+		TimedOut         []string
+		Pending, Skipped []string
+		Tags             []string
+	}{
+		Time:      time.Now().Format("2006-01-02 15:04:05 MST"),
+		TotalTime: fmt.Sprintf("%.2fs", final.TotalTime),
+		Hosts:     r.hosts,
+		Pending:   final.PendingHosts,
+		Skipped:   final.SkippedHosts,
+		Tags:      formatTagSummary(final.Tags, false),
+	}
+	for _, h := range r.hosts {
+		if h.Success {
+			data.Succeeded++
+		} else {
+			data.Failed++
+		}
+	}
+	for h := range final.TimedOutHosts {
+		data.TimedOut = append(data.TimedOut, h)
+	}
+	sort.Strings(data.TimedOut)
+
+	return htmlReportTemplate.Execute(r.w, data)
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>GoSSHa report {{.Time}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.ok { color: #1a7f37; } .failed { color: #cf222e; }
+details { border: 1px solid #d0d7de; border-radius: 4px; margin: 0.3em 0; padding: 0.3em 0.6em; }
+summary { cursor: pointer; }
+pre { background: #f6f8fa; padding: 0.5em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>GoSSHa report</h1>
+<p>{{.Time}}, {{len .Hosts}} result(s): <span class="ok">{{.Succeeded}} ok</span>, <span class="failed">{{.Failed}} failed</span>, total time {{.TotalTime}}</p>
+{{if .TimedOut}}<p class="failed">Timed out: {{range $i, $h := .TimedOut}}{{if $i}}, {{end}}{{$h}}{{end}}</p>
+{{end}}{{if .Pending}}<p class="failed">Interrupted, pending: {{range $i, $h := .Pending}}{{if $i}}, {{end}}{{$h}}{{end}}</p>
+{{end}}{{if .Skipped}}<p class="failed">Not started: {{range $i, $h := .Skipped}}{{if $i}}, {{end}}{{$h}}{{end}}</p>
+{{end}}{{if .Tags}}<ul>{{range .Tags}}<li>{{.}}</li>{{end}}</ul>
+{{end}}{{range .Hosts}}<details{{if not .Success}} open{{end}}>
+<summary><b>{{.Name}}</b> <span class="{{if .Success}}ok{{else}}failed{{end}}">{{.Status}}</span>{{if .Duration}} ({{.Duration}}){{end}}</summary>
+{{if .Stdout}}<pre>{{.Stdout}}</pre>
+{{end}}{{if .Stderr}}<p>stderr:</p>
+<pre>{{.Stderr}}</pre>
+{{end}}{{with .FollowUp}}<p>{{.Cmd}} <span class="{{if .Success}}ok{{else}}failed{{end}}">{{if .Success}}ok{{else}}failed: {{.ErrMsg}}{{end}}</span></p>
+{{if .Stdout}}<pre>{{.Stdout}}</pre>
+{{end}}{{if .Stderr}}<pre>{{.Stderr}}</pre>
+{{end}}{{end}}</details>
+{{end}}</body>
+</html>
+`))
+
+// initOutputRenderer returns renderer of -output, json one if format is not supported
+func initOutputRenderer() OutputRenderer {
+	r, err := newOutputRenderer(outputFormat, os.Stdout, os.Stderr)
+	if err != nil {
+		r, _ = newOutputRenderer("json", os.Stdout, os.Stderr)
+	}
+	return r
+}
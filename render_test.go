@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func renderTestReplies(t *testing.T, format string) (stdout, stderr string) {
+	var out, errOut strings.Builder
+	r, err := newOutputRenderer(format, &out, &errOut)
+	if err != nil {
+		t.Fatalf("Could not create %s renderer: %s", format, err)
+	}
+
+	for _, reply := range []interface{}{
+		&UserError{ErrorMsg: "warning"},
+		&Reply{Hostname: "web1", Stdout: "up 3 days\n", Success: true, Duration: 0.5},
+		&Reply{Hostname: "web2", Stdout: "up 3 days\n", Success: true, Duration: 0.25},
+		&Reply{Hostname: "db1", Stderr: "<oops>\n", ErrMsg: "Process exited with status 1", ExitCode: 1, Duration: 1},
+		&FinalReply{TotalTime: 1.5, TimedOutHosts: map[string]bool{"db2": true}},
+	} {
+		r.Render(reply)
+	}
+	return out.String(), errOut.String()
+}
+
+func TestOutputRenderers(t *testing.T) {
+	if _, err := newOutputRenderer("xml", nil, nil); err == nil {
+		t.Fatalf("Unknown format must be rejected")
+	}
+
+	out, _ := renderTestReplies(t, "prefixed")
+	for _, ln := range []string{"web1: up 3 days\n", "db1 (stderr): <oops>\n", "db1: failed: Process exited with status 1\n", "=== timed out: db2\n"} {
+		if !strings.Contains(out, ln) {
+			t.Fatalf("Line %q is not printed by prefixed renderer: %q", ln, out)
+		}
+	}
+
+	out, _ = renderTestReplies(t, "grouped")
+	if !strings.HasPrefix(out, "=== web1,web2 (2 host(s), ok)\n  up 3 days\n=== db1 (1 host(s), failed") {
+		t.Fatalf("Unexpected grouped output: %q", out)
+	}
+
+	out, errOut := renderTestReplies(t, "csv")
+	expected := "Hostname,Success,ExitCode,ErrorKind,ErrMsg,Duration,Tags,Stdout,Stderr\n" +
+		"web1,true,0,,,0.500,,\"up 3 days\n\",\n" +
+		"web2,true,0,,,0.250,,\"up 3 days\n\",\n" +
+		"db1,false,1,,Process exited with status 1,1.000,,,\"<oops>\n\"\n"
+	if out != expected || !strings.Contains(errOut, "Error: warning") {
+		t.Fatalf("Unexpected csv output: %q, stderr: %q", out, errOut)
+	}
+
+	out, _ = renderTestReplies(t, "html")
+	for _, s := range []string{"<!DOCTYPE html>", "<span class=\"ok\">2 ok</span>", "Timed out: db2", "<details open>\n<summary><b>db1</b>", "&lt;oops&gt;"} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("%q is not in HTML report: %s", s, out)
+		}
+	}
+}
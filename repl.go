@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Interactive mode (-repl <hosts>): lines typed at the prompt are executed on all hosts and
+// identical results are printed once; lines starting with ":" are REPL commands.
+
+const replPrompt = "gossha> "
+
+const replHelp = `:hosts <host1,host2,...>  set hosts to run commands on (patterns are allowed)
+:hosts                    show current hosts
+:help                     show this help
+:quit                     exit (Ctrl-D works too)
+`
+
+var replInitialized = make(chan struct{}) // closed when initialization is complete and commands can be run
+
+// replInputThread reads commands from stdin and sends requests; until initialization
+// is complete, lines are treated as passphrases for private keys
+func replInputThread(hosts []string) {
+	scanner := bufio.NewScanner(os.Stdin)
+	initialized := false
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if !initialized {
+			select {
+			case <-replInitialized:
+				initialized = true
+			default:
+				requestsChan <- &ProxyRequest{Password: line}
+				continue
+			}
+		}
+
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "":
+			fmt.Print(replPrompt)
+		case line == ":quit" || line == ":exit":
+			close(requestsChan)
+			return
+		case line == ":help":
+			fmt.Print(replHelp + replPrompt)
+		case line == ":hosts":
+			fmt.Print(strings.Join(hosts, ",") + "\n" + replPrompt)
+		case strings.HasPrefix(line, ":hosts "):
+			hosts = splitHostList(strings.TrimPrefix(line, ":hosts "))
+			fmt.Print(replPrompt)
+		case strings.HasPrefix(line, ":"):
+			fmt.Print("Unknown command " + line + ", type :help for help\n" + replPrompt)
+		case len(hosts) == 0:
+			fmt.Print("No hosts specified, use :hosts <host1,host2,...>\n" + replPrompt)
+		default:
+			requestsChan <- &ProxyRequest{Action: "ssh", Cmd: line, Hosts: hosts, GroupOutput: true}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading stdin: "+err.Error())
+	}
+
+	close(requestsChan)
+}
+
+func splitHostList(list string) (hosts []string) {
+	for _, h := range strings.Split(list, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return
+}
+
+// replReplierThread prints replies in human-readable form
+func replReplierThread() {
+	for reply := range repliesChan {
+		if _, ok := reply.(*InitializeComplete); ok {
+			close(replInitialized)
+		}
+		writeReplyText(os.Stdout, os.Stderr, reply, replPrompt)
+	}
+}
+
+// writePrefixed prints every line of out with prefix
+func writePrefixed(w io.Writer, prefix, out string) {
+	if out == "" {
+		return
+	}
+	for _, ln := range strings.SplitAfter(strings.TrimSuffix(out, "\n"), "\n") {
+		fmt.Fprint(w, prefix+strings.TrimSuffix(ln, "\n")+"\n")
+	}
+}
+
+// indentOutput prefixes every line of command output, so that it is distinguishable from headers
+func indentOutput(out string) string {
+	var buf bytes.Buffer
+	for _, ln := range strings.SplitAfter(strings.TrimSuffix(out, "\n"), "\n") {
+		buf.WriteString("  " + strings.TrimSuffix(ln, "\n") + "\n")
+	}
+	return buf.String()
+}
+
+// printFollowUp prints result of Then or OnFail command below output of the action
+func printFollowUp(stdout io.Writer, res *CommandResult) {
+	if res == nil {
+		return
+	}
+
+	status := "ok"
+	if !res.Success {
+		status = "failed: " + res.ErrMsg
+	}
+	fmt.Fprintf(stdout, "  --- %s (%s):\n", res.Cmd, status)
+	if res.Stdout != "" {
+		fmt.Fprint(stdout, indentOutput(res.Stdout))
+	}
+	if res.Stderr != "" {
+		fmt.Fprint(stdout, "  --- stderr:\n"+indentOutput(res.Stderr))
+	}
+}
+
+// writeReplyText prints reply in human-readable form, prompt is printed when new command can be entered
+func writeReplyText(stdout, stderr io.Writer, reply interface{}, prompt string) {
+	switch reply := reply.(type) {
+	case *PasswordRequest:
+		fmt.Fprintf(stderr, "Passphrase for %s: ", reply.PasswordFor)
+	case *UserError:
+		fmt.Fprintln(stderr, "Error: "+reply.ErrorMsg)
+	case *HostKeyRequest:
+		fmt.Fprintf(stdout, "=== unknown host key of %s: %s %s, send {\"AcceptHostKey\":true} to trust it\n", reply.Hostname, reply.KeyType, reply.Fingerprint)
+	case *ConfirmationRequest:
+		if reply.Reason != "" {
+			fmt.Fprintf(stdout, "=== %s, send {\"Confirm\":true} to start on %d host(s)\n", reply.Reason, reply.Remaining)
+			break
+		}
+		fmt.Fprintf(stdout, "=== canary succeeded on %s, send {\"Confirm\":true} to continue on %d remaining host(s)\n", strings.Join(reply.CanaryHosts, ","), reply.Remaining)
+	case *InitializeComplete:
+		fmt.Fprint(stdout, prompt)
+	case *OutputChunk:
+		prefix := reply.Hostname + ": "
+		if reply.Stream == "stderr" {
+			prefix = reply.Hostname + " (stderr): "
+		}
+		writePrefixed(stdout, prefix, reply.Data)
+	case *Reply:
+		status := "ok"
+		if reply.Unchanged {
+			status = "unchanged"
+		}
+		if reply.Skipped {
+			status = "skipped"
+		}
+		if !reply.Success {
+			status = "failed: " + reply.ErrMsg
+		}
+
+		if reply.SameAsReference {
+			status += ", same as reference"
+		} else if reply.Diff != "" {
+			status += ", differs from reference"
+		}
+		if reply.Matches != nil {
+			status += fmt.Sprintf(", %d matching lines", *reply.Matches)
+		}
+		if reply.RelayedFrom != "" {
+			status += ", relayed from " + reply.RelayedFrom
+		}
+		if reply.Health != "" {
+			status += "; " + reply.Health
+		}
+		if reply.Annotation != "" {
+			status += " — " + reply.Annotation
+		}
+
+		fmt.Fprintf(stdout, "=== %s (%s)\n", reply.Hostname, status)
+		if reply.Diff != "" {
+			fmt.Fprint(stdout, indentOutput(reply.Diff))
+		} else if reply.Stdout != "" && !reply.SameAsReference {
+			fmt.Fprint(stdout, indentOutput(reply.Stdout))
+		}
+		if reply.OutputSummary != nil {
+			fmt.Fprint(stdout, indentOutput(formatOutputSummary(reply.OutputSummary)))
+		}
+		if reply.Ping != nil {
+			fmt.Fprint(stdout, indentOutput(formatPing(reply.Ping)))
+		}
+		if reply.Service != nil {
+			fmt.Fprint(stdout, indentOutput(formatService(reply.Service)))
+		}
+		if reply.Pkg != nil {
+			fmt.Fprint(stdout, indentOutput(formatPkg(reply.Pkg)))
+		}
+		if reply.Reboot != nil {
+			fmt.Fprint(stdout, indentOutput(formatReboot(reply.Reboot)))
+		}
+		if reply.Facts != nil {
+			facts, _ := json.MarshalIndent(reply.Facts, "", "  ")
+			fmt.Fprint(stdout, indentOutput(string(facts)))
+		}
+		for _, f := range reply.Files {
+			status := "ok"
+			if f.Unchanged {
+				status = "unchanged"
+			}
+			if !f.Success {
+				status = "failed: " + f.ErrMsg
+			}
+			fmt.Fprintf(stdout, "  %s -> %s (%s)\n", f.Source, f.Target, status)
+		}
+		for _, c := range reply.Changes {
+			change := c.Change
+			if c.Planned {
+				change = "would be " + change
+			}
+			fmt.Fprintf(stdout, "  %s: %s%s\n", c.Target, change, formatPreviousState(c.Previous))
+		}
+		if reply.Stderr != "" {
+			fmt.Fprint(stdout, "  --- stderr:\n"+indentOutput(reply.Stderr))
+		}
+		printFollowUp(stdout, reply.FollowUp)
+		if reply.Snapshot != "" {
+			fmt.Fprint(stdout, indentOutput(formatSnapshot(reply)))
+		}
+	case *GroupedReply:
+		status := "ok"
+		if reply.Unchanged {
+			status = "unchanged"
+		}
+		if reply.Skipped {
+			status = "skipped"
+		}
+		if !reply.Success {
+			status = "failed: " + reply.ErrMsg
+		}
+
+		fmt.Fprintf(stdout, "=== %s (%d host(s), %s)\n", strings.Join(reply.Hosts, ","), len(reply.Hosts), status)
+		if reply.Stdout != "" {
+			fmt.Fprint(stdout, indentOutput(reply.Stdout))
+		}
+		if reply.Stderr != "" {
+			fmt.Fprint(stdout, "  --- stderr:\n"+indentOutput(reply.Stderr))
+		}
+		printFollowUp(stdout, reply.FollowUp)
+	case *FinalReply:
+		if len(reply.SkippedHosts) > 0 {
+			fmt.Fprintf(stdout, "=== skipped: %s\n", strings.Join(reply.SkippedHosts, ","))
+		}
+		if reply.Aborted != "" {
+			fmt.Fprintf(stdout, "=== aborted: %s, pending: %s\n", reply.Aborted, strings.Join(reply.PendingHosts, ","))
+		} else if reply.Interrupted {
+			fmt.Fprintf(stdout, "=== interrupted, pending: %s\n", strings.Join(reply.PendingHosts, ","))
+		}
+		if len(reply.TimedOutHosts) > 0 {
+			var hosts []string
+			for h := range reply.TimedOutHosts {
+				hosts = append(hosts, h)
+			}
+			sort.Strings(hosts)
+			fmt.Fprintf(stdout, "=== timed out: %s\n", strings.Join(hosts, ","))
+		}
+		if reply.Timing != nil {
+			writeTimingSummary(stdout, reply.Timing)
+		}
+		for _, ln := range formatTagSummary(reply.Tags, false) {
+			fmt.Fprintf(stdout, "=== %s\n", ln)
+		}
+		if c := reply.Compliance; c != nil {
+			fmt.Fprintf(stdout, "=== compliant: %d host(s), non-compliant: %d host(s)", c.Compliant, len(c.NonCompliantHosts))
+			if len(c.NonCompliantHosts) > 0 {
+				fmt.Fprintf(stdout, " (%s)", strings.Join(c.NonCompliantHosts, ","))
+			}
+			if len(c.UncheckedHosts) > 0 {
+				fmt.Fprintf(stdout, ", not checked: %s", strings.Join(c.UncheckedHosts, ","))
+			}
+			fmt.Fprintln(stdout)
+		}
+		for i, ln := range formatHostKeyChanges(reply.HostKeyChanges) {
+			if i == 0 {
+				ln = "=== " + ln
+			}
+			fmt.Fprintln(stdout, ln)
+		}
+		for i, ln := range formatAnnotations(reply.Annotations) {
+			if i == 0 {
+				fmt.Fprintln(stdout, "=== failed hosts:")
+			}
+			fmt.Fprintln(stdout, "  "+ln)
+		}
+		if reply.Stats != nil {
+			fmt.Fprintf(stdout, "=== %s\n", formatRunStats(reply.Stats))
+		}
+		fmt.Fprintf(stdout, "(%.2fs)\n%s", reply.TotalTime, prompt)
+	}
+}
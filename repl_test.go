@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteReplyText(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	writeReplyText(&stdout, &stderr, &GroupedReply{Hosts: []string{"a", "b"}, Stdout: "line1\nline2\n", Success: true}, replPrompt)
+	writeReplyText(&stdout, &stderr, &GroupedReply{Hosts: []string{"c"}, Stderr: "oops", ErrMsg: "Process exited with status 1"}, replPrompt)
+	writeReplyText(&stdout, &stderr, &FinalReply{TotalTime: 1.5, TimedOutHosts: map[string]bool{"e": true, "d": true}}, replPrompt)
+	writeReplyText(&stdout, &stderr, &UserError{ErrorMsg: "bad"}, replPrompt)
+
+	expected := "=== a,b (2 host(s), ok)\n  line1\n  line2\n" +
+		"=== c (1 host(s), failed: Process exited with status 1)\n  --- stderr:\n  oops\n" +
+		"=== timed out: d,e\n(1.50s)\n" + replPrompt
+
+	if stdout.String() != expected {
+		t.Fatalf("Unexpected output:\n%s", stdout.String())
+	}
+
+	if stderr.String() != "Error: bad\n" {
+		t.Fatalf("Unexpected errors output: %q", stderr.String())
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DNS pre-resolution ("PreResolve": true or -pre-resolve): names of all hosts of a run are resolved
+// up front in parallel instead of one by one inside of connection slots. Hosts which names do not
+// exist fail immediately without connecting, addresses of the rest are used for connections
+// until the run finishes. Hosts that are reached through jump hosts or proxy are resolved by
+// them, so they are not resolved in advance.
+//
+// Hosts with several addresses (e.g. dual-homed or dual-stack ones) are dialled happy eyeballs style
+// (RFC 8305): addresses of both families are tried alternately, the next attempt starts when the
+// previous one fails or does not succeed in happyEyeballsDelay, and the first established
+// connection wins, so that an unreachable address cannot use up the whole connection timeout.
+
+const (
+	preResolveConcurrency = 64               // simultaneous lookups
+	preResolveTimeout     = 10 * time.Second // of every lookup, hosts which names cannot be resolved in time are resolved when connecting
+	happyEyeballsDelay    = 250 * time.Millisecond
+)
+
+var preResolveDefault bool // -pre-resolve
+
+// resolvedHosts are addresses of host names resolved by preResolveHosts, used by dialTCP
+var resolvedHosts = struct {
+	sync.Mutex
+	addrs map[string][]string
+}{addrs: make(map[string][]string)}
+
+// preResolveHosts resolves names of hosts as they are dialled (see inventoryTarget); it returns errors
+// of hosts which names do not exist and resolved names that must be passed to forgetResolved after the run
+func preResolveHosts(hosts []string) (failed map[string]error, names []string) {
+	hostNames := make(map[string][]string) // host name -> hosts of request
+	for _, hostname := range hosts {
+		target, _ := inventoryTarget(hostname, &ssh.ClientConfig{})
+		host, _ := splitHostPort(target)
+		if net.ParseIP(host) != nil || len(jumpHosts) > 0 || useProxy(host) {
+			continue
+		}
+		if _, ok := hostNames[host]; !ok {
+			names = append(names, host)
+		}
+		hostNames[host] = append(hostNames[host], hostname)
+	}
+
+	var mu sync.Mutex
+	failed = make(map[string]error)
+	sem := make(chan struct{}, preResolveConcurrency)
+	var wg sync.WaitGroup
+
+	for _, name := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string) {
+			defer func() { <-sem; wg.Done() }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), preResolveTimeout)
+			defer cancel()
+			ips, err := lookupHostIPs(ctx, name)
+
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				mu.Lock()
+				for _, hostname := range hostNames[name] {
+					failed[hostname] = fmt.Errorf("Cannot resolve host: %w", err)
+				}
+				mu.Unlock()
+				return
+			} else if err != nil || len(ips) == 0 {
+				return // resolved again when connecting
+			}
+
+			addrs := make([]string, len(ips))
+			for i, ip := range ips {
+				addrs[i] = ip.String()
+			}
+			logf(logDebug, name, "Resolved to %s", strings.Join(addrs, ", "))
+
+			resolvedHosts.Lock()
+			resolvedHosts.addrs[name] = addrs
+			resolvedHosts.Unlock()
+		}(name)
+	}
+	wg.Wait()
+
+	return failed, names
+}
+
+// forgetResolved removes addresses of names resolved by preResolveHosts
+func forgetResolved(names []string) {
+	resolvedHosts.Lock()
+	defer resolvedHosts.Unlock()
+
+	for _, name := range names {
+		delete(resolvedHosts.addrs, name)
+	}
+}
+
+// withPreResolved fails hosts which names do not exist without running action on them
+func withPreResolved(failed map[string]error, execFunc func(string) *SshResult) func(string) *SshResult {
+	if len(failed) == 0 {
+		return execFunc
+	}
+
+	return func(hostname string) *SshResult {
+		if err, ok := failed[hostname]; ok {
+			return &SshResult{hostname: hostname, err: err}
+		}
+		return execFunc(hostname)
+	}
+}
+
+// dialDirect opens TCP connection to addr without proxy, using addresses resolved in advance if there are any
+func dialDirect(addr string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	resolvedHosts.Lock()
+	addrs := resolvedHosts.addrs[host]
+	resolvedHosts.Unlock()
+
+	if len(addrs) == 0 && net.ParseIP(host) == nil {
+		ctx, cancel := context.Background(), func() {}
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		ips, err := lookupHostIPs(ctx, host)
+		cancel()
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: dialNetwork, Err: err}
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, ip.String())
+		}
+	}
+
+	if len(addrs) == 0 {
+		return net.DialTimeout(dialNetwork, addr, timeout) // IP address
+	}
+	return dialAddrs(interleaveAddrs(addrs), port, timeout)
+}
+
+// interleaveAddrs orders IP addresses so that families alternate, starting with family of the first one
+func interleaveAddrs(addrs []string) []string {
+	var primary, secondary []string
+	isIPv4 := func(a string) bool { return net.ParseIP(a).To4() != nil }
+	for _, a := range addrs {
+		if isIPv4(a) == isIPv4(addrs[0]) {
+			primary = append(primary, a)
+		} else {
+			secondary = append(secondary, a)
+		}
+	}
+
+	res := make([]string, 0, len(addrs))
+	for i := 0; i < len(primary) || i < len(secondary); i++ {
+		if i < len(primary) {
+			res = append(res, primary[i])
+		}
+		if i < len(secondary) {
+			res = append(res, secondary[i])
+		}
+	}
+	return res
+}
+
+// dialAddrs connects to port of one of IP addresses, trying them in order with happyEyeballsDelay between attempts
+func dialAddrs(addrs []string, port string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.Background(), func() {}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	type attempt struct {
+		addr string
+		conn net.Conn
+		err  error
+	}
+	results := make(chan attempt, len(addrs))
+	var d net.Dialer
+
+	var firstErr error
+	var delay <-chan time.Time
+	next, pending, startNext := 0, 0, true
+	for next < len(addrs) || pending > 0 {
+		if next < len(addrs) && startNext {
+			go func(addr string) {
+				conn, err := d.DialContext(ctx, dialNetwork, addr)
+				results <- attempt{addr, conn, err}
+			}(net.JoinHostPort(addrs[next], port))
+			next++
+			pending++
+			delay, startNext = time.After(happyEyeballsDelay), false
+		}
+
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go func(pending int) { // connections of attempts that are still running are not needed
+					for ; pending > 0; pending-- {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+
+			logf(logDebug, res.addr, "Connection failed: %s", res.err)
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			startNext = true
+		case <-delay:
+			delay, startNext = nil, true
+		}
+	}
+
+	return nil, firstErr
+}
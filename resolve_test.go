@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreResolve(t *testing.T) {
+	const missing = "gossha-missing.invalid"
+	var dnsErr *net.DNSError
+	if _, err := net.LookupIP(missing); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Skipf("DNS is not available: %v", err)
+	}
+
+	servers := makeTestResult()
+	startTestServers(servers, "test-resolve", 2)
+	r := makeTestResult()
+	for addr := range servers.hosts {
+		_, port := splitHostPort(addr)
+		r.hostsLeft["localhost:"+port] = struct{}{}
+	}
+	r.hostsLeft[missing] = struct{}{}
+
+	req := &ProxyRequest{Action: "ssh", Cmd: "echo ok", PreResolve: true, Timeout: uint64(maxTimeout / time.Millisecond)}
+	for h := range r.hostsLeft {
+		req.Hosts = append(req.Hosts, h)
+	}
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+
+	for hostname, reply := range r.replies {
+		if hostname == missing {
+			if reply.Success || !strings.HasPrefix(reply.ErrMsg, "Cannot resolve host") {
+				t.Fatalf("Missing host must fail without connecting: %+v", reply)
+			}
+		} else if !reply.Success || reply.Stdout != "ok\n" {
+			t.Fatalf("Unexpected reply of %s: %+v", hostname, reply)
+		}
+	}
+
+	// names are forgotten when runAction returns, which can be right after FinalReply is sent
+	for deadline := time.Now().Add(maxTimeout); ; time.Sleep(10 * time.Millisecond) {
+		resolvedHosts.Lock()
+		addrs := fmt.Sprint(resolvedHosts.addrs)
+		left := len(resolvedHosts.addrs)
+		resolvedHosts.Unlock()
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Resolved addresses must be forgotten after run: %s", addrs)
+		}
+	}
+}
+
+func TestInterleaveAddrs(t *testing.T) {
+	addrs := interleaveAddrs([]string{"2001:db8::1", "2001:db8::2", "2001:db8::3", "192.0.2.1", "192.0.2.2"})
+	if expected := "[2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2 2001:db8::3]"; fmt.Sprint(addrs) != expected {
+		t.Fatalf("Unexpected order of addresses: %v, expected %s", addrs, expected)
+	}
+}
+
+func TestDialAddrs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	must(err, "Could not listen")
+	defer l.Close()
+	_, port := splitHostPort(l.Addr().String())
+
+	// nothing listens on 127.0.0.2, so the next address must be tried
+	conn, err := dialAddrs([]string{"127.0.0.2", "127.0.0.1"}, port, time.Second)
+	if err != nil {
+		t.Fatalf("Could not connect to the second address: %s", err)
+	}
+	conn.Close()
+
+	if _, err := dialAddrs([]string{"127.0.0.2", "127.0.0.3"}, port, time.Second); err == nil || !strings.Contains(err.Error(), "127.0.0.2") {
+		t.Fatalf("Error of the first address must be returned: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Name overrides (-resolve host=addr, -hosts-file <file>) and alternate resolver (-dns server[:port]):
+// newly provisioned machines can be reached before their names are in DNS. Names given with
+// -resolve (repeatable, several addresses of one name are dialled happy eyeballs style) come
+// first, then names of the hosts file (/etc/hosts format), and the rest are resolved with -dns
+// server, or with the system resolver without it. Overridden names are also replaced with their
+// addresses when dialling through jump hosts and proxies, which would resolve them otherwise.
+
+const dnsDialTimeout = 5 * time.Second // of connections to -dns server
+
+// resolveOverrides are addresses of names from -resolve
+type resolveOverrides map[string][]string
+
+var (
+	resolveFlag = make(resolveOverrides) // -resolve
+	hostsFile   string                   // -hosts-file
+	dnsServer   string                   // -dns
+
+	hostOverrides = make(map[string][]net.IP) // names of -resolve and -hosts-file, lower case
+	hostResolver  = net.DefaultResolver
+)
+
+func (r resolveOverrides) String() string {
+	var entries []string
+	for name, addrs := range r {
+		for _, a := range addrs {
+			entries = append(entries, name+"="+a)
+		}
+	}
+	return strings.Join(entries, ",")
+}
+
+// Set adds comma-separated host=addr entries
+func (r resolveOverrides) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return fmt.Errorf("%q must be host=address", entry)
+		}
+		name, addr := strings.TrimSpace(kv[0]), strings.Trim(strings.TrimSpace(kv[1]), "[]")
+		if net.ParseIP(addr) == nil {
+			return fmt.Errorf("Invalid address %q of %s", addr, name)
+		}
+		r[name] = append(r[name], addr)
+	}
+	return nil
+}
+
+// initResolver loads name overrides and sets up resolver of -dns
+func initResolver() error {
+	hostOverrides = make(map[string][]net.IP)
+	if hostsFile != "" {
+		if err := loadHostsFile(hostsFile); err != nil {
+			return err
+		}
+	}
+	for name, addrs := range resolveFlag { // -resolve replaces addresses of the hosts file
+		key := overrideKey(name)
+		hostOverrides[key] = nil
+		for _, a := range addrs {
+			hostOverrides[key] = append(hostOverrides[key], net.ParseIP(a))
+		}
+	}
+
+	hostResolver = net.DefaultResolver
+	if dnsServer == "" {
+		return nil
+	}
+	server := dnsServer
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+	}
+	if host, _, _ := net.SplitHostPort(server); net.ParseIP(host) == nil {
+		return errors.New("Invalid -dns " + dnsServer + ": must be IP address of DNS server")
+	}
+	hostResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{Timeout: dnsDialTimeout}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+	return nil
+}
+
+// loadHostsFile adds names of hosts file in /etc/hosts format to hostOverrides
+func loadHostsFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.New("Cannot read hosts file: " + err.Error())
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return fmt.Errorf("Invalid line %d of hosts file %s", lineNum, path)
+		}
+		for _, name := range fields[1:] {
+			hostOverrides[overrideKey(name)] = append(hostOverrides[overrideKey(name)], ip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.New("Cannot read hosts file: " + err.Error())
+	}
+	return nil
+}
+
+func overrideKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// familyAllowed tells whether ip can be dialled with dialNetwork
+func familyAllowed(ip net.IP) bool {
+	return dialNetwork == "tcp" || (dialNetwork == "tcp4") == (ip.To4() != nil)
+}
+
+// overriddenIPs returns addresses of host from -resolve or -hosts-file that can be dialled, ok is false if host is not overridden
+func overriddenIPs(host string) (ips []net.IP, ok bool) {
+	all, ok := hostOverrides[overrideKey(host)]
+	for _, ip := range all {
+		if familyAllowed(ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, ok
+}
+
+// lookupHostIPs resolves host to addresses of family allowed by dialNetwork, using overrides first
+func lookupHostIPs(ctx context.Context, host string) ([]net.IP, error) {
+	if ips, ok := overriddenIPs(host); ok {
+		if len(ips) == 0 {
+			return nil, &net.DNSError{Err: "no addresses of allowed family in overrides", Name: host, IsNotFound: true}
+		}
+		return ips, nil
+	}
+	return hostResolver.LookupIP(ctx, "ip"+strings.TrimPrefix(dialNetwork, "tcp"), host)
+}
+
+// overriddenAddr replaces overridden host name of addr with its first address, so that jump hosts and proxies do not resolve it
+func overriddenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ips, _ := overriddenIPs(host); len(ips) > 0 {
+		return net.JoinHostPort(ips[0].String(), port)
+	}
+	return addr
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func withResolver(t *testing.T, resolve []string, hosts string) {
+	t.Helper()
+	resolveFlag, hostsFile = make(resolveOverrides), ""
+	t.Cleanup(func() {
+		resolveFlag, hostsFile = make(resolveOverrides), ""
+		must(initResolver(), "initResolver")
+	})
+
+	for _, v := range resolve {
+		must(resolveFlag.Set(v), "Set")
+	}
+	if hosts != "" {
+		hostsFile = filepath.Join(t.TempDir(), "hosts")
+		must(os.WriteFile(hostsFile, []byte(hosts), 0644), "WriteFile")
+	}
+	if err := initResolver(); err != nil {
+		t.Fatalf("initResolver: %s", err)
+	}
+}
+
+func TestResolveFlag(t *testing.T) {
+	r := make(resolveOverrides)
+	if err := r.Set("web1=10.0.0.1, web1=[2001:db8::1],db=10.0.0.2"); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	if len(r["web1"]) != 2 || r["web1"][1] != "2001:db8::1" || r["db"][0] != "10.0.0.2" {
+		t.Fatalf("Unexpected overrides: %v", r)
+	}
+
+	for _, bad := range []string{"web1", "=10.0.0.1", "web1=web2"} {
+		if err := r.Set(bad); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+func TestHostsFileOverrides(t *testing.T) {
+	withResolver(t, []string{"web1=10.0.0.9"}, "# new machines\n10.0.0.1 web1 WEB1.example.com.\n10.0.0.2 db  # primary\n2001:db8::2 db\n")
+
+	ips, err := lookupHostIPs(context.Background(), "web1.example.com")
+	if err != nil || len(ips) != 1 || ips[0].String() != "10.0.0.1" {
+		t.Fatalf("web1.example.com resolved to %v, %v", ips, err)
+	}
+	if ips, _ := lookupHostIPs(context.Background(), "web1"); len(ips) != 1 || ips[0].String() != "10.0.0.9" {
+		t.Fatalf("-resolve did not replace hosts file entry: %v", ips)
+	}
+	if ips, _ := lookupHostIPs(context.Background(), "db"); len(ips) != 2 {
+		t.Fatalf("db resolved to %v", ips)
+	}
+
+	dialNetwork = "tcp6"
+	defer func() { dialNetwork = "tcp" }()
+	if ips, _ := lookupHostIPs(context.Background(), "db"); len(ips) != 1 || ips[0].String() != "2001:db8::2" {
+		t.Fatalf("db resolved to %v with -6", ips)
+	}
+	if _, err := lookupHostIPs(context.Background(), "web1"); err == nil {
+		t.Fatalf("web1 without IPv6 addresses was resolved with -6")
+	}
+	if addr := overriddenAddr("db:2222"); addr != "[2001:db8::2]:2222" {
+		t.Fatalf("overriddenAddr returned %s", addr)
+	}
+}
+
+func TestResolveDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	must(err, "Listen")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	withResolver(t, []string{"not-in-dns.invalid=127.0.0.1"}, "")
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	conn, err := dialDirect(net.JoinHostPort("not-in-dns.invalid", port), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Cannot connect to overridden host: %s", err)
+	}
+	conn.Close()
+}
+
+func TestInvalidResolverConfig(t *testing.T) {
+	defer func() {
+		dnsServer, hostsFile = "", ""
+		must(initResolver(), "initResolver")
+	}()
+
+	dnsServer = "dns.example.com"
+	if err := initResolver(); err == nil {
+		t.Errorf("-dns with host name was accepted")
+	}
+	dnsServer = "10.0.0.53"
+	if err := initResolver(); err != nil {
+		t.Errorf("-dns without port: %s", err)
+	}
+
+	dnsServer, hostsFile = "", filepath.Join(t.TempDir(), "hosts")
+	must(os.WriteFile(hostsFile, []byte("web1 10.0.0.1\n"), 0644), "WriteFile")
+	if err := initResolver(); err == nil {
+		t.Errorf("Hosts file with invalid line was accepted")
+	}
+}
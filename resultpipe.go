@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Result post-processors (-pipe-results <command>): every Reply is written as JSON (the same line
+// as in output) to stdin of a local command as soon as the host finishes, so that results can be
+// sent to ticketing systems, CMDBs and the like without integrations in GoSSHa. The command runs
+// with local shell like hooks do, with HOST, GOSSHA_ACTION and GOSSHA_RUN_ID in environment and
+// -hook-timeout; up to pipeResultsConcurrency of them run at a time, so a slow command does not
+// hold the run, and all of them finish before FinalReply. Failures are reported but do not affect
+// results. Hosts without Reply (timed out or skipped ones) are not piped, and nothing is with -dry-run.
+
+const pipeResultsConcurrency = 8
+
+var pipeResultsCmd string // -pipe-results
+
+// resultPipe feeds replies of a run to -pipe-results command
+type resultPipe struct {
+	msg   *ProxyRequest
+	runID string
+	sem   chan struct{}
+	wg    sync.WaitGroup
+}
+
+// newResultPipe returns pipe for replies to msg, nil if results are not piped
+func newResultPipe(msg *ProxyRequest, runID string) *resultPipe {
+	if pipeResultsCmd == "" || dryRun {
+		return nil
+	}
+	return &resultPipe{msg: msg, runID: runID, sem: make(chan struct{}, pipeResultsConcurrency)}
+}
+
+// send starts the command for reply, it waits only if pipeResultsConcurrency commands are running
+func (p *resultPipe) send(reply *Reply) {
+	if p == nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	writeReplyJSON(&buf, reply) // marshalled right away, outputs of kept replies are spilled to disk
+	hostname := reply.Hostname
+	env := []string{"HOST=" + hostname, "GOSSHA_ACTION=" + p.msg.Action, "GOSSHA_RUN_ID=" + p.runID}
+
+	p.sem <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer func() { <-p.sem; p.wg.Done() }()
+		if err := runHookInput("pipe-results", pipeResultsCmd, env, buf.Bytes()); err != nil {
+			reportErrorToUser(hostname + ": " + err.Error())
+		}
+	}()
+}
+
+// wait waits until commands for all replies finish
+func (p *resultPipe) wait() {
+	if p != nil {
+		p.wg.Wait()
+	}
+}
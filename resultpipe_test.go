@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPipeResults(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-pipe-results", 3)
+
+	dir, err := ioutil.TempDir("", "gossha-pipe")
+	must(err, "Could not create temporary directory")
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "results")
+
+	// a line is written at once, so lines of commands that run in parallel do not mix
+	pipeResultsCmd = `printf '%s %s %s\n' "$HOST" "$GOSSHA_ACTION" "$(cat)" >>` + out
+	defer func() { pipeResultsCmd = "" }()
+
+	runTestRequest(t, r, makeProxyRequest(maxTimeout))
+
+	data, err := ioutil.ReadFile(out)
+	must(err, "Could not read piped results")
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(r.hosts) {
+		t.Fatalf("Expected %d results, got %q", len(r.hosts), lines)
+	}
+
+	for _, line := range lines {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 || fields[1] != "ssh" {
+			t.Fatalf("Unexpected line %q", line)
+		}
+		var reply struct {
+			Type     string
+			Hostname string
+			Success  bool
+		}
+		if err := json.Unmarshal([]byte(fields[2]), &reply); err != nil {
+			t.Fatalf("Result is not JSON: %s: %q", err, fields[2])
+		}
+		if reply.Type != "Reply" || reply.Hostname != fields[0] || !reply.Success || r.hosts[fields[0]] == nil {
+			t.Fatalf("Unexpected result %q", line)
+		}
+	}
+}
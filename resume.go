@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Resumable uploads ("Resume": true or -resume): temporary file of failed upload is kept instead of
+// being removed, and the next upload of the same file continues writing it from its size if
+// contents of the partial file match the beginning of the source. Otherwise file is uploaded anew.
+
+// resumeOffset returns size of partial remote file if it is a prefix of entry contents, 0 means upload from scratch
+func resumeOffset(conn *ssh.Client, client *sftpClient, remotePath string, entry *uploadEntry) (int64, error) {
+	attrs, err := client.Stat(remotePath)
+	if isSftpNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.New("Cannot stat " + remotePath + ": " + err.Error())
+	}
+
+	if attrs.Flags&sshFileXferAttrSize == 0 || attrs.Size == 0 || attrs.Size > uint64(entry.size) {
+		return 0, nil
+	}
+	if attrs.Flags&sshFileXferAttrPermissions != 0 && attrs.Perm&0170000 != 0100000 {
+		return 0, nil
+	}
+
+	size := int64(attrs.Size)
+	expected, err := entry.prefixSHA256(size)
+	if err != nil {
+		return 0, err
+	}
+
+	actual, err := remoteChecksum(conn, client, remotePath)
+	if err != nil {
+		return 0, errors.New("Cannot compute checksum of " + remotePath + ": " + err.Error())
+	}
+
+	if actual != expected {
+		return 0, nil
+	}
+	return size, nil
+}
+
+// resumeRemoteFile writes the rest of entry contents starting from off into existing partial remote file
+func resumeRemoteFile(client *sftpClient, target string, entry *uploadEntry, off int64, attrs *sftpAttrs, progress *transferProgress, limiters []*rateLimiter) error {
+	// bytes that are already there count as sent
+	progress.add(int(off))
+
+	if err := writeFileRange(client, target, entry, off, entry.size-off, progress, limiters); err != nil {
+		return err
+	}
+
+	if attrs.Flags != 0 {
+		if err := client.Setstat(target, attrs); err != nil {
+			return errors.New("Cannot set attributes of " + target + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// prefixSHA256 returns hex-encoded SHA-256 of the first n bytes of entry contents
+func (e *uploadEntry) prefixSHA256(n int64) (string, error) {
+	r, err := e.openRange(0, n)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", errors.New("Cannot read " + e.localPath + " contents: " + err.Error())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// Running commands as another user ("RunAs": "<user>" or -run-as): ssh authentication is done
+// with the login user as usual, and commands (and scripts) are wrapped into "sudo -u <user>"
+// or, with "RunAsMethod": "su", into "su - <user> -c". Password for sudo ("SudoPassword" or
+// -sudo-password) is sent to sudo like for "Sudo". su reads password of the target user from
+// terminal only, so "su" is only usable without password (e.g. when login user is root) or
+// together with "Sudo": true, then su is run by root through sudo.
+
+var (
+	runAsDefault        string   // -run-as
+	runAsMethodDefault  = "sudo" // -run-as-method
+	sudoPasswordSource  string   // -sudo-password
+	sudoPasswordDefault string   // password read from sudoPasswordSource
+)
+
+// initRunAs checks -run-as flags and reads password of -sudo-password
+func initRunAs() (err error) {
+	if runAsMethodDefault != "sudo" && runAsMethodDefault != "su" {
+		return errors.New("-run-as-method must be sudo or su")
+	}
+	if strings.HasPrefix(runAsDefault, "-") {
+		return errors.New("Invalid -run-as user " + runAsDefault)
+	}
+
+	sudoPasswordDefault = ""
+	if sudoPasswordSource != "" {
+		sudoPasswordDefault, err = readPasswordSource(sudoPasswordSource, "sudo")
+	}
+	return err
+}
+
+// requestRunAs returns user and method of msg to run commands as, default ones are set by -run-as and -run-as-method
+func requestRunAs(msg *ProxyRequest) (user, method string, err error) {
+	user, method = msg.RunAs, msg.RunAsMethod
+	if user == "" {
+		user = runAsDefault
+	}
+	if method == "" {
+		method = runAsMethodDefault
+	}
+
+	if method != "sudo" && method != "su" {
+		return "", "", errors.New("Unknown 'RunAsMethod' " + method + ", expected sudo or su")
+	}
+	if strings.HasPrefix(user, "-") {
+		return "", "", errors.New("Invalid 'RunAs' user " + user)
+	}
+	return user, method, nil
+}
+
+// runAsCommand wraps cmd according to sudo and run-as settings of opts
+func runAsCommand(cmd string, opts *cmdOptions, auth *sudoAuth) string {
+	switch {
+	case opts.runAs == "":
+		return sudoCommand(cmd, "", auth)
+	case opts.runAsMethod == "su":
+		cmd = "su - " + shellQuote(opts.runAs) + " -c " + shellQuote(cmd)
+		if opts.sudo {
+			return sudoCommand(cmd, "", auth)
+		}
+		return cmd
+	}
+	return sudoCommand(cmd, opts.runAs, auth)
+}
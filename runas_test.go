@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeRunAsSu emulates su - -c: command is run with RUN_AS set to the user (sudo -u is emulated by fakeSudo)
+const fakeRunAsSu = `#!/bin/sh
+[ "$1" = "-" ] && [ "$3" = "-c" ] || exit 2
+RUN_AS=su:$2 exec /bin/sh -c "$4"
+`
+
+func TestRunAsCommand(t *testing.T) {
+	auth := &sudoAuth{password: "x", prompt: "P", ready: "R"}
+	for _, c := range []struct {
+		opts     cmdOptions
+		auth     *sudoAuth
+		expected string
+	}{
+		{cmdOptions{sudo: true}, nil, `sudo -n -- /bin/sh -c 'id'`},
+		{cmdOptions{runAs: "app", runAsMethod: "sudo", sudoPassword: "x"}, auth, `sudo -k -S -p 'P' -u 'app' -- /bin/sh -c 'printf %s '\''R'\'' >&2; id'`},
+		{cmdOptions{runAs: "app", runAsMethod: "su"}, nil, `su - 'app' -c 'id'`},
+		{cmdOptions{runAs: "app", runAsMethod: "su", sudo: true}, nil, `sudo -n -- /bin/sh -c 'su - '\''app'\'' -c '\''id'\'''`},
+	} {
+		if cmd := runAsCommand("id", &c.opts, c.auth); cmd != c.expected {
+			t.Errorf("Unexpected command for %+v: %s", c.opts, cmd)
+		}
+	}
+
+	for _, msg := range []*ProxyRequest{
+		{RunAs: "app", RunAsMethod: "doas"},
+		{RunAs: "-app"},
+		{RunAs: "app", RunAsMethod: "su", SudoPassword: "x"},
+		{SudoPassword: "x"},
+	} {
+		if _, err := parseCmdOptions(msg); err == nil {
+			t.Errorf("Request %+v must be rejected", msg)
+		}
+	}
+}
+
+func TestRunAs(t *testing.T) {
+	binDir, err := ioutil.TempDir("", "gossha-runas")
+	must(err, "Could not create bin dir")
+	defer os.RemoveAll(binDir)
+	must(ioutil.WriteFile(filepath.Join(binDir, "sudo"), []byte(fakeSudo), 0755), "Could not write fake sudo")
+	must(ioutil.WriteFile(filepath.Join(binDir, "su"), []byte(fakeRunAsSu), 0755), "Could not write fake su")
+
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", binDir+":"+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	defer func() { runAsDefault, sudoPasswordDefault = "", "" }()
+	runAsDefault, sudoPasswordDefault = "app", "secret"
+
+	r := makeTestResult()
+	startTestServers(r, "test-runas", 2)
+
+	check := func(req *ProxyRequest, expected string) {
+		r.replies = make(map[string]*Reply)
+		for addr := range r.hosts {
+			r.hostsLeft[addr] = struct{}{}
+		}
+		runTestRequest(t, r, req)
+
+		for addr, reply := range r.replies {
+			if reply.Stdout != expected {
+				t.Fatalf("Unexpected stdout of %+v from %s: %q", req, addr, reply.Stdout)
+			}
+		}
+	}
+
+	check(&ProxyRequest{Action: "ssh", Cmd: `echo "$RUN_AS: it's $(cat)"`, Stdin: "data"}, "app: it's data\n")
+	check(&ProxyRequest{Action: "ssh", Cmd: `echo "$RUN_AS"`, RunAs: "web", RunAsMethod: "su"}, "su:web\n")
+}
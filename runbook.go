@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Runbooks (gossha exec -commands-file <file>): commands of a file are run as "Cmds" of one request,
+// one after another on every host until one of them fails, and the reply has results of every step
+// in "Commands". A command takes a line, lines ending with a backslash are continued on the next one.
+// Empty lines and lines starting with # are skipped. A command can be prefixed with
+// "@timeout=<duration>" (e.g. "@timeout=30s systemctl restart app"), which is enforced on remote side
+// like with "RemoteTimeout" ("CmdTimeouts" of request).
+
+const runbookTimeoutPrefix = "@timeout="
+
+// loadRunbook reads commands of runbook filename and their timeouts in milliseconds
+func loadRunbook(filename string) (cmds []string, timeouts []uint64, err error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, errors.New("Cannot read runbook: " + err.Error())
+	}
+	defer fp.Close()
+
+	var hasTimeouts bool
+	var cmd string
+	var lineNo, cmdLine int
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if cmd == "" {
+			cmdLine = lineNo
+			if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+		}
+
+		if strings.HasSuffix(line, `\`) {
+			cmd += strings.TrimSuffix(line, `\`) + "\n"
+			continue
+		}
+		cmd += line
+
+		var timeout uint64
+		if cmd = strings.TrimSpace(cmd); strings.HasPrefix(cmd, runbookTimeoutPrefix) {
+			spec := strings.Fields(cmd)[0]
+			d, err := time.ParseDuration(strings.TrimPrefix(spec, runbookTimeoutPrefix))
+			if err != nil || d <= 0 {
+				return nil, nil, fmt.Errorf("Invalid timeout in runbook %s:%d: %s", filename, cmdLine, spec)
+			}
+			timeout, hasTimeouts = uint64(d/time.Millisecond), true
+			cmd = strings.TrimSpace(strings.TrimPrefix(cmd, spec))
+		}
+		if cmd == "" {
+			return nil, nil, fmt.Errorf("Empty command in runbook %s:%d", filename, cmdLine)
+		}
+
+		cmds, timeouts = append(cmds, cmd), append(timeouts, timeout)
+		cmd = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, errors.New("Cannot read runbook: " + err.Error())
+	}
+	if cmd != "" {
+		return nil, nil, fmt.Errorf("Runbook %s ends with continued line", filename)
+	}
+	if len(cmds) == 0 {
+		return nil, nil, errors.New("No commands in runbook " + filename)
+	}
+
+	if !hasTimeouts {
+		timeouts = nil
+	}
+	return cmds, timeouts, nil
+}
+
+// commandTimeouts returns "CmdTimeouts" of msg
+func commandTimeouts(msg *ProxyRequest) ([]time.Duration, error) {
+	if len(msg.CmdTimeouts) > len(msg.Cmds) {
+		return nil, errors.New("'CmdTimeouts' has more entries than 'Cmds'")
+	}
+	var res []time.Duration
+	for _, t := range msg.CmdTimeouts {
+		res = append(res, time.Duration(t)*time.Millisecond)
+	}
+	return res, nil
+}
+
+// forCommand returns opts for i-th command of Cmds, its timeout is enforced on remote side
+func (opts *cmdOptions) forCommand(i int) *cmdOptions {
+	if i >= len(opts.cmdTimeouts) || opts.cmdTimeouts[i] == 0 {
+		return opts
+	}
+	res := *opts
+	if t := opts.cmdTimeouts[i]; res.remoteTimeout == 0 || t < res.remoteTimeout {
+		res.remoteTimeout = t
+	}
+	return &res
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadRunbook(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatalf("Cannot write runbook: %s", err.Error())
+		}
+		return filename
+	}
+
+	cmds, timeouts, err := loadRunbook(write("runbook.txt", "# restart\n\nsystemctl restart app\r\n  @timeout=1.5s  curl -fs \\\n  localhost\n  # done\nuptime\n"))
+	if err != nil {
+		t.Fatalf("Cannot load runbook: %s", err.Error())
+	}
+	if exp := []string{"systemctl restart app", "curl -fs \n  localhost", "uptime"}; !reflect.DeepEqual(cmds, exp) {
+		t.Fatalf("Unexpected commands: %q", cmds)
+	}
+	if exp := []uint64{0, 1500, 0}; !reflect.DeepEqual(timeouts, exp) {
+		t.Fatalf("Unexpected timeouts: %v", timeouts)
+	}
+
+	if _, timeouts, _ := loadRunbook(write("plain.txt", "uptime\n")); timeouts != nil {
+		t.Fatalf("Expected no timeouts, got %v", timeouts)
+	}
+
+	for name, content := range map[string]string{
+		"empty.txt":     "# nothing\n\n",
+		"timeout.txt":   "@timeout=soon uptime\n",
+		"nocmd.txt":     "@timeout=1s\n",
+		"continued.txt": "uptime \\\n",
+	} {
+		if _, _, err := loadRunbook(write(name, content)); err == nil {
+			t.Fatalf("Expected runbook %s to be rejected", name)
+		}
+	}
+}
+
+func TestCmdTimeouts(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-cmd-timeouts", 1)
+
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = ""
+	req.Cmds = []string{"echo first", "sleep 5; echo second", "echo third"}
+	req.CmdTimeouts = []uint64{0, 500}
+	sendTestRequest(t, r, req)
+
+	for addr, reply := range r.replies {
+		if reply.Success || reply.ErrorKind != "command-timeout" || len(reply.Commands) != 2 || reply.Stdout != "first\n" {
+			t.Fatalf("Unexpected result for %s: %+v", addr, reply)
+		}
+	}
+
+	if _, err := commandTimeouts(&ProxyRequest{Cmds: []string{"a"}, CmdTimeouts: []uint64{1, 2}}); err == nil {
+		t.Fatalf("Expected extra timeouts to be rejected")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Comparison of runs ("gossha diff-runs <run-id-1> <run-id-2>"): results of hosts in two runs of
+// run history (see -history) are compared, e.g. before and after a maintenance window. Hosts that
+// are only in one of the runs, changed success, exit code or error, or changed output are listed,
+// with unified diffs of their stdout and stderr. Exit status is 0 if nothing changed, 1 if some
+// hosts changed and 2 on errors, like with diff(1).
+
+// runHostChange is a host whose result differs between two runs
+type runHostChange struct {
+	hostname      string
+	before, after *historyResult // nil if host was not in the run
+}
+
+// compareRuns returns hosts whose results differ between results of two runs, ordered by host
+func compareRuns(before, after []*historyResult) []*runHostChange {
+	byHost := make(map[string]*runHostChange)
+	for _, res := range before {
+		byHost[res.Hostname] = &runHostChange{hostname: res.Hostname, before: res}
+	}
+	for _, res := range after {
+		if c, ok := byHost[res.Hostname]; ok {
+			c.after = res
+		} else {
+			byHost[res.Hostname] = &runHostChange{hostname: res.Hostname, after: res}
+		}
+	}
+
+	var res []*runHostChange
+	for _, c := range byHost {
+		if c.changed() {
+			res = append(res, c)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].hostname < res[j].hostname })
+	return res
+}
+
+func (c *runHostChange) changed() bool {
+	a, b := c.before, c.after
+	if a == nil || b == nil {
+		return true
+	}
+	return a.Success != b.Success || a.ExitCode != b.ExitCode || a.ErrMsg != b.ErrMsg || a.Stdout != b.Stdout || a.Stderr != b.Stderr
+}
+
+// write prints change of host between runs before and after, diffs of output are omitted if brief is set
+func (c *runHostChange) write(w io.Writer, before, after *historyRun, brief bool) {
+	switch {
+	case c.before == nil:
+		fmt.Fprintf(w, "+ %s (only in run %d: %s)\n", c.hostname, after.ID, historyStatus(c.after))
+		return
+	case c.after == nil:
+		fmt.Fprintf(w, "- %s (only in run %d: %s)\n", c.hostname, before.ID, historyStatus(c.before))
+		return
+	}
+
+	fmt.Fprintf(w, "~ %s\n", c.hostname)
+	if c.before.Success != c.after.Success || c.before.ErrMsg != c.after.ErrMsg {
+		fmt.Fprintf(w, "  status: %s -> %s\n", historyStatus(c.before), historyStatus(c.after))
+	}
+	if c.before.ExitCode != c.after.ExitCode {
+		fmt.Fprintf(w, "  exit code: %d -> %d\n", c.before.ExitCode, c.after.ExitCode)
+	}
+	if brief {
+		return
+	}
+
+	streams := []struct{ name, before, after string }{
+		{"stdout", c.before.Stdout, c.after.Stdout},
+		{"stderr", c.before.Stderr, c.after.Stderr},
+	}
+	for _, s := range streams {
+		from, to := fmt.Sprintf("run %d %s", before.ID, s.name), fmt.Sprintf("run %d %s", after.ID, s.name)
+		if d := unifiedDiff(from, to, s.before, s.after); d != "" {
+			fmt.Fprint(w, indentOutput(d))
+		}
+	}
+}
+
+// historyStatus describes result of host as in output of "gossha show"
+func historyStatus(res *historyResult) string {
+	if res.Success != 0 {
+		return "ok"
+	}
+	return "failed: " + res.ErrMsg
+}
+
+// diffRunsMain implements "gossha diff-runs [-db FILE] [-host PATTERN] [-q] <run-id-1> <run-id-2>"
+func diffRunsMain(args []string) int {
+	fs := flag.NewFlagSet("diff-runs", flag.ContinueOnError)
+	db := fs.String("db", defaultHistoryDB(), "SQLite database that runs were stored in with -history")
+	host := fs.String("host", "", "Compare only results of hosts matching shell-style pattern")
+	brief := fs.Bool("q", false, "Only list changed hosts, without diffs of their output")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gossha diff-runs [-db FILE] [-host PATTERN] [-q] <run-id-1> <run-id-2>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	store := &historyStore{path: *db}
+	var runs [2]*historyRun
+	var results [2][]*historyResult
+	for i := range runs {
+		id, err := strconv.ParseInt(fs.Arg(i), 10, 64)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid run id "+fs.Arg(i))
+			return 2
+		}
+		if runs[i], results[i], err = store.run(id, *host); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 2
+		}
+	}
+
+	for _, run := range runs {
+		fmt.Printf("Run %d started at %s by %s: %s on %d host(s), %d failed\n", run.ID, formatHistoryTime(run.Started), run.User, run.Action, run.Hosts, run.Failed)
+	}
+	if runs[0].Operation != runs[1].Operation {
+		fmt.Print(indentOutput(unifiedDiff(fmt.Sprintf("run %d operation", runs[0].ID), fmt.Sprintf("run %d operation", runs[1].ID), runs[0].Operation+"\n", runs[1].Operation+"\n")))
+	}
+
+	changes := compareRuns(results[0], results[1])
+	for _, c := range changes {
+		c.write(os.Stdout, runs[0], runs[1], *brief)
+	}
+
+	hosts := make(map[string]bool)
+	for _, list := range results {
+		for _, res := range list {
+			hosts[res.Hostname] = true
+		}
+	}
+	fmt.Printf("%d host(s) changed, %d unchanged\n", len(changes), len(hosts)-len(changes))
+
+	if len(changes) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompareRuns(t *testing.T) {
+	ok := func(host, stdout string) *historyResult {
+		return &historyResult{Hostname: host, Success: 1, Stdout: stdout}
+	}
+	before := []*historyResult{ok("web1", "a\n"), ok("web2", "a\n"), ok("web3", "a\n"), ok("web4", "a\n")}
+	after := []*historyResult{
+		ok("web1", "a\n"),
+		ok("web2", "b\n"),
+		{Hostname: "web3", Stdout: "a\n", ExitCode: 1, ErrMsg: "Process exited with status 1"},
+		ok("web5", "a\n"),
+	}
+
+	changes := compareRuns(before, after)
+	var hosts []string
+	for _, c := range changes {
+		hosts = append(hosts, c.hostname)
+	}
+	if strings.Join(hosts, " ") != "web2 web3 web4 web5" {
+		t.Fatalf("Unexpected changed hosts: %v", hosts)
+	}
+
+	var out bytes.Buffer
+	runs := []*historyRun{{ID: 1}, {ID: 2}}
+	for _, c := range changes {
+		c.write(&out, runs[0], runs[1], false)
+	}
+	expected := `~ web2
+  --- run 1 stdout
+  +++ run 2 stdout
+  @@ -1 +1 @@
+  -a
+  +b
+~ web3
+  status: ok -> failed: Process exited with status 1
+  exit code: 0 -> 1
+- web4 (only in run 1: ok)
++ web5 (only in run 2: ok)
+`
+	if out.String() != expected {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Run environment: commands (and scripts, OnlyIf, Then and OnFail) get metadata of the run in
+// environment variables, so that scripts run across the fleet can make per-host decisions without
+// templates: GOSSHA_HOST (host name as in the request), GOSSHA_HOST_INDEX (position of the host
+// among hosts of the request, from 0), GOSSHA_HOST_COUNT, GOSSHA_RUN_ID (the same as "Run" of
+// shipped logs) and GOSSHA_TAG_<NAME> for every inventory tag of the host. The variables are
+// exported by the command line itself rather than with "Env", so sshd does not have to accept them
+// and they survive sudo; it needs a POSIX login shell, "NoRunEnv" (or -no-run-env) turns it off.
+
+var noRunEnvDefault bool // -no-run-env
+
+// runEnv is metadata of run that is exported to commands
+type runEnv struct {
+	runID   string
+	indexes map[string]int // position of hosts in request
+}
+
+// newRunEnv returns metadata of run of msg, nil if it is not exported
+func newRunEnv(msg *ProxyRequest) *runEnv {
+	if msg.NoRunEnv || noRunEnvDefault {
+		return nil
+	}
+	e := &runEnv{runID: msg.runID, indexes: make(map[string]int, len(msg.Hosts))}
+	for i, h := range msg.Hosts {
+		e.indexes[h] = i
+	}
+	return e
+}
+
+// vars returns variables of hostname
+func (e *runEnv) vars(hostname string) map[string]string {
+	res := map[string]string{"GOSSHA_HOST": hostname, "GOSSHA_HOST_COUNT": strconv.Itoa(len(e.indexes))}
+	if i, ok := e.indexes[hostname]; ok {
+		res["GOSSHA_HOST_INDEX"] = strconv.Itoa(i)
+	}
+	if e.runID != "" {
+		res["GOSSHA_RUN_ID"] = e.runID
+	}
+	for name, value := range hostTags(hostname) {
+		res["GOSSHA_TAG_"+runEnvName(name)] = value
+	}
+	return res
+}
+
+// wrap returns cmd that exports variables of hostname first
+func (e *runEnv) wrap(cmd, hostname string) string {
+	vars := e.vars(hostname)
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("export")
+	for _, name := range names {
+		b.WriteString(" " + name + "=" + shellQuote(vars[name]))
+	}
+	return b.String() + "; " + cmd
+}
+
+// runEnvName returns name of tag in upper case with characters that cannot be in variable names replaced by _
+func runEnvName(name string) string {
+	return strings.Map(func(c rune) rune {
+		switch {
+		case 'a' <= c && c <= 'z':
+			return c - 'a' + 'A'
+		case 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			return c
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunEnv(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-runenv", 2)
+
+	inv := newInventory()
+	inv.group("all")
+	var hosts []string
+	for addr, srv := range r.hosts {
+		host, port := splitHostPort(addr)
+		must(inv.addHost("testservers", srv.hostname, map[string]string{"ansible_host": host, "ansible_port": port, "gossha_tag_dc-name": "eu"}), "Could not add host")
+		delete(r.hostsLeft, addr)
+		hosts = append(hosts, srv.hostname)
+	}
+	inv.resolveVars()
+	hostInventory = inv
+	defer func() { hostInventory = nil }()
+
+	run := func(noRunEnv bool) map[string]*Reply {
+		r.replies = make(map[string]*Reply)
+		for _, h := range hosts {
+			r.hostsLeft[h] = struct{}{}
+		}
+		requestsChan <- &ProxyRequest{Action: "ssh", Cmd: `echo "$GOSSHA_HOST $GOSSHA_HOST_INDEX $GOSSHA_HOST_COUNT $GOSSHA_TAG_DC_NAME $GOSSHA_RUN_ID"`,
+			Hosts: hosts, NoRunEnv: noRunEnv, Timeout: uint64(maxTimeout / time.Millisecond)}
+		waitReply(t, r, maxTimeout)
+		return r.replies
+	}
+
+	runIDs := make(map[string]bool)
+	for i, h := range hosts {
+		reply := run(false)[h]
+		fields := strings.Fields(reply.Stdout)
+		if len(fields) != 5 || fields[0] != h || fields[1] != fmt.Sprint(i) || fields[2] != "2" || fields[3] != "eu" {
+			t.Fatalf("Unexpected run environment of %s: %q", h, reply.Stdout)
+		}
+		runIDs[fields[4]] = true
+	}
+	if len(runIDs) != 2 {
+		t.Fatalf("Every run must have its own id: %v", runIDs)
+	}
+
+	for h, reply := range run(true) {
+		if strings.TrimSpace(reply.Stdout) != "" {
+			t.Fatalf("Unexpected run environment of %s with NoRunEnv: %q", h, reply.Stdout)
+		}
+	}
+}
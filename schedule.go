@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scheduled jobs of control daemon (-daemon): request with "Schedule" (cron expression, e.g.
+// "*/15 * * * *" or "@daily") and "ScheduleName" that is sent to the daemon is not run, but
+// registered and run every time the expression matches local time of the daemon, in turn with
+// requests of sessions. {"Action":"schedules"} lists scheduled jobs with results of their last
+// runs, {"Action":"unschedule","ScheduleName":"<name>"} removes a job. "schedules" section of
+// configuration file registers jobs when daemon starts:
+//
+//	schedules:
+//	  disk-usage:
+//	    schedule: '*/15 * * * *'
+//	    cmd: df -h /
+//	    groups: [web]
+//
+// Replies of scheduled runs are not sent anywhere, results of hosts are stored in run history
+// (-history) and the summary is printed to stderr of the daemon. Run is skipped if the previous
+// run of the same job is still running. Jobs registered over control socket are lost when daemon
+// exits.
+
+var schedules = &scheduler{jobs: make(map[string]*scheduledJob)}
+
+type (
+	// cronSchedule is a set of minutes, hours, days of month, months and days of week as bit masks
+	cronSchedule struct {
+		minute, hour, dom, month, dow uint64
+		domStar, dowStar              bool // field starts with "*", so that only the other one restricts days
+	}
+
+	scheduledJob struct {
+		name    string
+		spec    string
+		cron    *cronSchedule
+		action  string
+		request []byte // JSON of request, decoded again for every run
+
+		next    time.Time
+		running bool
+
+		lastRun    time.Time
+		lastHosts  int
+		lastFailed int
+		lastError  string
+	}
+
+	scheduler struct {
+		mu   sync.Mutex
+		jobs map[string]*scheduledJob
+	}
+
+	// ScheduleInfo describes scheduled job in ScheduleList
+	ScheduleInfo struct {
+		Name       string
+		Schedule   string
+		Action     string
+		Next       time.Time  // next time job runs
+		Running    bool       `json:",omitempty"`
+		LastRun    *time.Time `json:",omitempty"` // start of the last run
+		LastHosts  int        `json:",omitempty"` // hosts of the last run
+		LastFailed int        `json:",omitempty"` // hosts that failed or timed out in the last run
+		LastError  string     `json:",omitempty"` // critical error of the last run
+	}
+
+	// ScheduleList is a reply to "schedules" and "unschedule" actions and requests with Schedule
+	ScheduleList struct {
+		Schedules []*ScheduleInfo
+	}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonths = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronDays   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCron parses cron expression with minute, hour, day of month, month and day of week fields
+func parseCron(spec string) (*cronSchedule, error) {
+	expr := strings.TrimSpace(spec)
+	if m, ok := cronMacros[expr]; ok {
+		expr = m
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("Invalid schedule " + spec + ": expected 5 fields (minute, hour, day of month, month, day of week)")
+	}
+
+	c := &cronSchedule{}
+	var err error
+	for i, f := range []struct {
+		dst      *uint64
+		min, max int
+		names    []string
+	}{
+		{&c.minute, 0, 59, nil},
+		{&c.hour, 0, 23, nil},
+		{&c.dom, 1, 31, nil},
+		{&c.month, 1, 12, cronMonths},
+		{&c.dow, 0, 7, cronDays},
+	} {
+		if *f.dst, err = parseCronField(fields[i], f.min, f.max, f.names); err != nil {
+			return nil, errors.New("Invalid schedule " + spec + ": " + err.Error())
+		}
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is Sunday as well
+	}
+	c.domStar, c.dowStar = fields[2][0] == '*', fields[4][0] == '*'
+
+	if c.next(time.Now()).IsZero() {
+		return nil, errors.New("Invalid schedule " + spec + ": it never matches")
+	}
+	return c, nil
+}
+
+// parseCronField parses comma-separated values, ranges ("1-5") and steps ("*/10", "0-30/5") into bit mask
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if name != "" && strings.EqualFold(s, name) {
+				return i, nil
+			}
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil || v < min || v > max {
+			return 0, fmt.Errorf("invalid value %q, expected %d-%d", s, min, max)
+		}
+		return v, nil
+	}
+
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rng = part[:i]
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = value(bounds[0]); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				hi = max // "5/10" is "5-<max>/10"
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << uint(v)
+		}
+	}
+	return mask, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := c.dom&(1<<uint(t.Day())) != 0, c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow // like cron, restricted day of month and day of week both match
+}
+
+// next returns the first minute after t that matches schedule, zero time if none does in 5 years
+func (c *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// add registers msg as job name that runs on schedule spec, job with the same name is replaced
+func (s *scheduler) add(name, spec string, msg *ProxyRequest) error {
+	if name == "" {
+		return errors.New("'ScheduleName' is required with 'Schedule'")
+	}
+	if msg.Action == "" {
+		return errors.New("Scheduled job " + name + " has no action")
+	}
+	c, err := parseCron(spec)
+	if err != nil {
+		return err
+	}
+
+	req := *msg
+	req.Schedule, req.ScheduleName = "", ""
+	buf, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// running job is updated in place, so that it is not started again before it finishes
+	job := s.jobs[name]
+	if job == nil {
+		job = &scheduledJob{name: name}
+		s.jobs[name] = job
+	}
+	job.spec, job.cron, job.action, job.request, job.next = spec, c, msg.Action, buf, c.next(time.Now())
+	return nil
+}
+
+func (s *scheduler) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.jobs[name] == nil {
+		return errors.New("Unknown scheduled job " + name)
+	}
+	delete(s.jobs, name)
+	return nil
+}
+
+// list returns scheduled jobs sorted by name
+func (s *scheduler) list() []*ScheduleInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make([]*ScheduleInfo, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		info := &ScheduleInfo{Name: j.name, Schedule: j.spec, Action: j.action, Next: j.next, Running: j.running}
+		if !j.lastRun.IsZero() {
+			lastRun := j.lastRun
+			info.LastRun, info.LastHosts, info.LastFailed, info.LastError = &lastRun, j.lastHosts, j.lastFailed, j.lastError
+		}
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, k int) bool { return res[i].Name < res[k].Name })
+	return res
+}
+
+// due returns jobs that must be started at now and marks them as running
+func (s *scheduler) due(now time.Time) (res []*scheduledJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, j := range s.jobs {
+		if j.next.After(now) {
+			continue
+		}
+		j.next = j.cron.next(now)
+		if j.running {
+			fmt.Fprintln(os.Stderr, "Scheduled job "+j.name+" is skipped: previous run is still running")
+			continue
+		}
+		j.running = true
+		j.lastRun, j.lastHosts, j.lastFailed, j.lastError = now, 0, 0, ""
+		res = append(res, j)
+	}
+	return res
+}
+
+// record counts reply of scheduled run of j
+func (s *scheduler) record(j *scheduledJob, reply interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch reply := reply.(type) {
+	case *Reply:
+		j.lastHosts++
+		if !reply.Success {
+			j.lastFailed++
+		}
+	case *GroupedReply:
+		j.lastHosts += len(reply.Hosts)
+		if !reply.Success {
+			j.lastFailed += len(reply.Hosts)
+		}
+	case *UserError:
+		if reply.IsCritical {
+			j.lastError = reply.ErrorMsg
+		}
+	case *FinalReply:
+		j.lastHosts += len(reply.TimedOutHosts)
+		j.lastFailed += len(reply.TimedOutHosts)
+	}
+}
+
+// finish marks run of j as finished and returns its summary
+func (s *scheduler) finish(j *scheduledJob) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j.running = false
+	if j.lastError != "" {
+		return "Scheduled job " + j.name + " failed: " + j.lastError
+	}
+	return fmt.Sprintf("Scheduled job %s finished: %d of %d hosts failed", j.name, j.lastFailed, j.lastHosts)
+}
+
+// loop starts due jobs of daemon d at the beginning of every minute
+func (s *scheduler) loop(d *controlServer) {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+
+		for _, j := range s.due(time.Now()) {
+			go d.runScheduled(j)
+		}
+	}
+}
+
+// runScheduled runs scheduled job j in turn with requests of sessions
+func (d *controlServer) runScheduled(j *scheduledJob) {
+	msg := new(ProxyRequest)
+	if err := json.Unmarshal(j.request, msg); err != nil {
+		schedules.record(j, &UserError{IsCritical: true, ErrorMsg: err.Error()})
+	} else {
+		msg.scheduled = j.name
+		d.run(&controlSession{job: j, done: make(chan struct{}, 1)}, msg)
+	}
+	fmt.Fprintln(os.Stderr, schedules.finish(j))
+}
+
+// handleSchedule registers, removes and lists scheduled jobs for requests of session, it returns
+// false if msg is not about scheduled jobs
+func (d *controlServer) handleSchedule(sess *controlSession, msg *ProxyRequest) bool {
+	var err error
+	switch {
+	case msg.Schedule != "":
+		if err = schedules.add(msg.ScheduleName, msg.Schedule, msg); err == nil && history == nil {
+			sess.write(&UserError{ErrorMsg: "Results of scheduled runs are not stored: daemon is started without -history"})
+		}
+	case msg.Action == "unschedule":
+		err = schedules.remove(msg.ScheduleName)
+	case msg.Action == "schedules":
+	default:
+		return false
+	}
+
+	if err != nil {
+		sess.write(&UserError{IsCritical: true, ErrorMsg: err.Error()})
+	} else {
+		sess.write(&ScheduleList{Schedules: schedules.list()})
+	}
+	return true
+}
+
+// parseConfigSchedules parses "schedules" section of configuration file
+func parseConfigSchedules(value interface{}) (map[string]*ProxyRequest, []string, error) {
+	jobs, ok := value.(*yamlMap)
+	if !ok {
+		return nil, nil, errors.New("schedules must be a mapping of names to jobs")
+	}
+
+	res := make(map[string]*ProxyRequest)
+	for _, name := range jobs.Keys() {
+		options, ok := jobs.Get(name).(*yamlMap)
+		if !ok {
+			return nil, nil, errors.New("schedule " + name + " must be a mapping")
+		}
+
+		msg := &ProxyRequest{Action: "ssh", ScheduleName: name}
+		for _, key := range options.Keys() {
+			value, prefix := options.Get(key), "schedule "+name+" "+key
+
+			var err error
+			switch key {
+			case "hosts":
+				msg.Hosts, err = configStrings(prefix, value)
+			case "groups":
+				msg.Groups, err = configStrings(prefix, value)
+			case "schedule", "action", "cmd", "timeout":
+				s, ok := value.(string)
+				if !ok {
+					return nil, nil, errors.New(prefix + " must be a string")
+				}
+				switch key {
+				case "schedule":
+					msg.Schedule = s
+				case "action":
+					msg.Action = s
+				case "cmd":
+					msg.Cmd = s
+				case "timeout":
+					d, err := time.ParseDuration(s)
+					if err != nil {
+						return nil, nil, errors.New("invalid " + prefix + ": " + err.Error())
+					}
+					msg.Timeout = uint64(d / time.Millisecond)
+				}
+			default:
+				return nil, nil, errors.New("unknown option " + key + " of schedule " + name)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if msg.Schedule == "" {
+			return nil, nil, errors.New("schedule " + name + " has no schedule")
+		}
+		res[name] = msg
+	}
+	return res, jobs.Keys(), nil
+}
+
+// initSchedules registers jobs of "schedules" section of configuration for daemon
+func initSchedules(conf *gosshaConfig) error {
+	if !daemonMode {
+		return nil
+	}
+
+	for _, name := range conf.scheduleNames {
+		msg := conf.schedules[name]
+		if err := schedules.add(name, msg.Schedule, msg); err != nil {
+			return err
+		}
+	}
+	if len(conf.schedules) > 0 && historyDB == "" {
+		reportErrorToUser("Results of scheduled runs are not stored: daemon is started without -history")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCron(t *testing.T) {
+	base := time.Date(2024, 5, 14, 12, 7, 30, 0, time.Local) // Tuesday
+	for _, c := range []struct {
+		spec, next string
+	}{
+		{"* * * * *", "2024-05-14 12:08"},
+		{"*/15 * * * *", "2024-05-14 12:15"},
+		{"5 */6 * * *", "2024-05-14 18:05"},
+		{"0 9-17/4 * * mon-fri", "2024-05-14 13:00"},
+		{"@daily", "2024-05-15 00:00"},
+		{"0 0 * * 0", "2024-05-19 00:00"},
+		{"0 0 * * 7", "2024-05-19 00:00"},
+		{"30 4 1,15 * *", "2024-05-15 04:30"},
+		{"0 0 13 * fri", "2024-05-17 00:00"}, // day of month or day of week
+		{"0 0 29 feb *", "2028-02-29 00:00"},
+		{"0 0 1 jan,jul *", "2024-07-01 00:00"},
+	} {
+		cron, err := parseCron(c.spec)
+		if err != nil {
+			t.Fatalf("Could not parse %q: %v", c.spec, err)
+		}
+		if next := cron.next(base).Format("2006-01-02 15:04"); next != c.next {
+			t.Errorf("Next run of %q is %s, expected %s", c.spec, next, c.next)
+		}
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "0 0 31 feb *", "@reboot"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("Invalid schedule %q is accepted", spec)
+		}
+	}
+}
+
+func TestScheduledJobs(t *testing.T) {
+	oldSchedules := schedules
+	defer func() { schedules = oldSchedules }()
+	schedules = &scheduler{jobs: make(map[string]*scheduledJob)}
+
+	requests := make(chan *ProxyRequest)
+	d := newControlServer(requests)
+	go func() {
+		for req := range requests {
+			if req.scheduled != "disk" || req.Cmd != "df -h" || req.Schedule != "" {
+				d.handleReply(&UserError{IsCritical: true, ErrorMsg: "Unexpected request"})
+				continue
+			}
+			d.handleReply(&Reply{Hostname: "web1", Success: true})
+			d.handleReply(&Reply{Hostname: "web2", Success: false})
+			d.handleReply(&FinalReply{TimedOutHosts: map[string]bool{"web3": true}})
+		}
+	}()
+
+	var out bytes.Buffer
+	sess := &controlSession{w: &out, done: make(chan struct{}, 1)}
+	if !d.handleSchedule(sess, &ProxyRequest{Action: "ssh", Cmd: "df -h", Hosts: []string{"web[1-3]"}, Schedule: "*/5 * * * *", ScheduleName: "disk"}) {
+		t.Fatalf("Scheduled job is not registered")
+	}
+	if d.handleSchedule(sess, &ProxyRequest{Action: "ssh", Cmd: "uptime"}) {
+		t.Fatalf("Request without Schedule is handled as scheduled job")
+	}
+	d.handleSchedule(sess, &ProxyRequest{Action: "ssh", Schedule: "*/5 * * * *"})
+	if !strings.Contains(out.String(), `"Schedules":[{"Name":"disk","Schedule":"*/5 * * * *","Action":"ssh"`) || !strings.Contains(out.String(), "ScheduleName' is required") {
+		t.Fatalf("Unexpected replies: %s", out.String())
+	}
+
+	next := schedules.list()[0].Next
+	if due := schedules.due(next.Add(-time.Second)); len(due) != 0 {
+		t.Fatalf("Job is started too early")
+	}
+	due := schedules.due(next)
+	if len(due) != 1 || len(schedules.due(next.Add(5*time.Minute))) != 0 {
+		t.Fatalf("Job must be started once while it is running")
+	}
+	d.runScheduled(due[0])
+
+	info := schedules.list()[0]
+	if info.Running || info.LastRun == nil || info.LastHosts != 3 || info.LastFailed != 2 || info.LastError != "" || !info.Next.After(next) {
+		t.Fatalf("Unexpected state of scheduled job: %+v", info)
+	}
+
+	out.Reset()
+	d.handleSchedule(sess, &ProxyRequest{Action: "unschedule", ScheduleName: "disk"})
+	if len(schedules.list()) != 0 || !strings.Contains(out.String(), `"Schedules":[]`) {
+		t.Fatalf("Scheduled job is not removed: %s", out.String())
+	}
+}
+
+func TestConfigSchedules(t *testing.T) {
+	doc, err := parseYaml([]byte("schedules:\n  disk:\n    schedule: '@hourly'\n    cmd: df -h\n    groups: [web]\n    timeout: 30s\n"))
+	must(err, "Could not parse config")
+	conf, err := applyConfig(doc)
+	must(err, "Could not apply config")
+
+	msg := conf.schedules["disk"]
+	if len(conf.scheduleNames) != 1 || msg.Action != "ssh" || msg.Cmd != "df -h" || msg.Schedule != "@hourly" || msg.Groups[0] != "web" || msg.Timeout != 30000 {
+		t.Fatalf("Unexpected schedules: %v %+v", conf.scheduleNames, msg)
+	}
+
+	doc, err = parseYaml([]byte("schedules:\n  disk:\n    cmd: df -h\n"))
+	must(err, "Could not parse config")
+	if _, err := applyConfig(doc); err == nil {
+		t.Fatalf("Schedule without cron expression is accepted")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// runScript uploads script to a temporary file in home directory of remote user (in /tmp with RunAs,
+// so that the other user can read it), runs it with args and removes it
+func runScript(script []byte, args []string, opts *cmdOptions, hostname string) (stdout, stderr string, err error) {
+	conn, err := getConnection(hostname)
+	if err != nil {
+		return
+	}
+	defer connectedHosts.Release(hostname, conn)
+
+	client, err := newSftpClient(conn)
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	suffix := make([]byte, 8)
+	if _, err = rand.Read(suffix); err != nil {
+		return
+	}
+	remotePath := "./.gossha-script-" + hex.EncodeToString(suffix)
+	attrs := &sftpAttrs{Flags: sshFileXferAttrPermissions, Perm: 0700}
+	if opts.runAs != "" {
+		remotePath, attrs.Perm = "/tmp/"+remotePath[2:], 0755
+	}
+
+	if err = writeRemoteFile(client, remotePath, &uploadEntry{size: int64(len(script)), contents: script}, attrs, nil, nil); err != nil {
+		return
+	}
+
+	defer func() {
+		if rmErr := client.Remove(remotePath); rmErr != nil && err == nil {
+			err = errors.New("Cannot remove " + remotePath + ": " + rmErr.Error())
+		}
+	}()
+
+	if opts.runAs != "" {
+		// permissions of created file are limited by umask of sftp server
+		if err = client.Setstat(remotePath, attrs); err != nil {
+			return
+		}
+	}
+
+	cmdPath := remotePath
+	if (opts.session != nil || opts.chdir != "") && opts.runAs == "" {
+		// command is not run in home directory with Chdir, setup commands of session can change it too
+		home, _, err := runCmd(conn, hostname, "pwd", &cmdOptions{})
+		if err != nil {
+			return "", "", err
+		}
+		cmdPath = strings.TrimSpace(home) + remotePath[1:]
+	}
+
+	return runCmd(conn, hostname, shellQuoteArgs(append([]string{cmdPath}, args...)), opts)
+}
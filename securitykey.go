@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Security keys (FIDO2, "sk-ssh-ed25519@openssh.com" and "sk-ecdsa-sha2-nistp256@openssh.com"):
+// private key file only contains a handle of the key that never leaves the device, so signing
+// is deferred to ssh-agent the key is added to, which asks the device to confirm user presence.
+// Devices handle one signature at a time, so signatures are requested one after another.
+
+var securityKeyMu sync.Mutex // held while security key signs
+
+type (
+	// securityKeySigner asks user to confirm presence before signer signs, one signature at a time
+	securityKeySigner struct {
+		name   string // key file or fingerprint of agent key
+		signer ssh.Signer
+	}
+
+	// agentKeySigner signs with key added to ssh-agent, connecting to it for every signature
+	agentKeySigner struct {
+		pub ssh.PublicKey
+	}
+)
+
+// securityKeyPublicKey returns public key of OpenSSH private key file contents if it is a security key;
+// public key is stored unencrypted, so passphrase is not needed
+func securityKeyPublicKey(buf []byte) (ssh.PublicKey, bool) {
+	block, _ := pem.Decode(buf)
+	if block == nil || block.Type != "OPENSSH PRIVATE KEY" {
+		return nil, false
+	}
+
+	const magic = "openssh-key-v1\x00"
+	if !bytes.HasPrefix(block.Bytes, []byte(magic)) {
+		return nil, false
+	}
+
+	var header struct {
+		CipherName, KdfName, KdfOpts string
+		NumKeys                      uint32
+		PubKey                       []byte
+		Rest                         []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(block.Bytes[len(magic):], &header); err != nil || header.NumKeys != 1 {
+		return nil, false
+	}
+
+	pub, err := ssh.ParsePublicKey(header.PubKey)
+	if err != nil || !strings.HasPrefix(pub.Type(), "sk-") {
+		return nil, false
+	}
+	return pub, true
+}
+
+// newSecurityKeySigner returns signer for security key pub from file keyname, the key must be added to ssh-agent
+func newSecurityKeySigner(keyname string, pub ssh.PublicKey) (ssh.Signer, error) {
+	if sshAuthSock == "" {
+		return nil, errors.New("Security key " + keyname + " can only be used through ssh-agent, but SSH_AUTH_SOCK is not set")
+	}
+
+	conn, err := dialCurrentAgent()
+	if err != nil {
+		return nil, errors.New("Cannot open connection to SSH agent: " + err.Error())
+	}
+	defer conn.Close()
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, errors.New("Cannot list keys of SSH agent: " + err.Error())
+	}
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), pub.Marshal()) {
+			return &securityKeySigner{name: keyname, signer: &agentKeySigner{pub: pub}}, nil
+		}
+	}
+	return nil, errors.New("Security key " + keyname + " is not added to ssh-agent, add it with ssh-add " + keyname)
+}
+
+// securityKeySigners wraps security keys among agent signers, so that user is asked to touch them
+func securityKeySigners(signers []ssh.Signer) []ssh.Signer {
+	res := make([]ssh.Signer, 0, len(signers))
+	for _, s := range signers {
+		if strings.HasPrefix(s.PublicKey().Type(), "sk-") {
+			s = &securityKeySigner{name: ssh.FingerprintSHA256(s.PublicKey()), signer: s}
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+func (s *securityKeySigner) PublicKey() ssh.PublicKey {
+	return s.signer.PublicKey()
+}
+
+func (s *securityKeySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	securityKeyMu.Lock()
+	defer securityKeyMu.Unlock()
+
+	reportErrorToUser("Confirm presence on security key " + s.name + " (touch it if it blinks)")
+	sig, err := s.signer.Sign(rand, data)
+	if err != nil {
+		return nil, errors.New("Security key " + s.name + " did not sign: " + err.Error())
+	}
+	return sig, nil
+}
+
+// SignWithAlgorithm makes it usable where AlgorithmSigner is needed, security keys only have one algorithm
+func (s *securityKeySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	if algorithm != "" && algorithm != s.PublicKey().Type() {
+		return nil, errors.New("Security key " + s.name + " does not support " + algorithm)
+	}
+	return s.Sign(rand, data)
+}
+
+func (s *agentKeySigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *agentKeySigner) Sign(rand io.Reader, data []byte) (sig *ssh.Signature, err error) {
+	a := agents.get()
+	defer agents.put(a)
+
+	err = a.call(func(client agent.ExtendedAgent) error {
+		sig, err = client.Sign(s.pub, data)
+		return err
+	})
+	return
+}
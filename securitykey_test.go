@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// securityKeyAgent is ssh-agent that holds one security key and signs with it
+type securityKeyAgent struct {
+	agent.Agent
+	pub ssh.PublicKey
+}
+
+func (a *securityKeyAgent) List() ([]*agent.Key, error) {
+	return []*agent.Key{{Format: a.pub.Type(), Blob: a.pub.Marshal(), Comment: "yubikey"}}, nil
+}
+
+func (a *securityKeyAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return &ssh.Signature{Format: a.pub.Type(), Blob: []byte("touched")}, nil
+}
+
+// writeSecurityKeyFile writes OpenSSH private key file of security key pub (private part is not needed)
+func writeSecurityKeyFile(filename string, pub ssh.PublicKey) {
+	header := struct {
+		CipherName, KdfName, KdfOpts string
+		NumKeys                      uint32
+		PubKey                       []byte
+		Rest                         []byte `ssh:"rest"`
+	}{"aes256-ctr", "bcrypt", "salt", 1, pub.Marshal(), []byte("encrypted key handle")}
+
+	block := &pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: append([]byte("openssh-key-v1\x00"), ssh.Marshal(header)...)}
+	must(ioutil.WriteFile(filename, pem.EncodeToMemory(block), 0600), "Could not write key file")
+}
+
+func TestSecurityKey(t *testing.T) {
+	keyBytes := make([]byte, 32)
+	rand.Read(keyBytes)
+	pub, err := ssh.ParsePublicKey(ssh.Marshal(struct {
+		Type string
+		Key  []byte
+		App  string
+	}{ssh.KeyAlgoSKED25519, keyBytes, "ssh:"}))
+	must(err, "Could not create security key")
+
+	dir, err := ioutil.TempDir("", "gossha-sk")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	keyName := filepath.Join(dir, "id_ed25519_sk")
+	writeSecurityKeyFile(keyName, pub)
+
+	if _, ok := securityKeyPublicKey([]byte(idRsa)); ok {
+		t.Errorf("RSA key is detected as security key")
+	}
+
+	list, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	must(err, "Could not listen agent socket")
+	defer list.Close()
+
+	go func() {
+		for {
+			c, err := list.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(&securityKeyAgent{Agent: agent.NewKeyring(), pub: pub}, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	oldSock := sshAuthSock
+	defer func() { sshAuthSock = oldSock }()
+
+	sshAuthSock = ""
+	go func() {
+		if msg := (<-repliesChan).(*UserError).ErrorMsg; !strings.Contains(msg, "SSH_AUTH_SOCK is not set") {
+			t.Errorf("Unexpected error without agent: %s", msg)
+		}
+	}()
+	if _, err := makeSigner(keyName); err == nil {
+		t.Fatalf("Security key is usable without agent")
+	}
+
+	sshAuthSock = list.Addr().String()
+	signer, err := makeSigner(keyName)
+	if err != nil {
+		t.Fatalf("Could not make security key signer: %v", err)
+	}
+
+	go func() {
+		if msg := (<-repliesChan).(*UserError).ErrorMsg; !strings.Contains(msg, "Confirm presence on security key "+keyName) {
+			t.Errorf("Unexpected message before signing: %s", msg)
+		}
+	}()
+	sig, err := signer.Sign(rand.Reader, []byte("session"))
+	if err != nil || string(sig.Blob) != "touched" {
+		t.Fatalf("Security key did not sign through agent: %v, %v", sig, err)
+	}
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP API mode (-serve <addr>): requests are submitted as jobs over HTTP instead of stdin and
+// run one after another using the same connection cache:
+//
+//	POST /jobs                      submit request (same JSON as on stdin), returns job
+//	GET  /jobs                      list jobs
+//	GET  /jobs/<id>                 job status
+//	GET  /jobs/<id>/results         replies of all hosts
+//	GET  /jobs/<id>/results/<host>  reply of a single host
+//	GET  /jobs/<id>/stream          server-sent events with replies and output (with "Stream": true)
+//	POST /jobs/<id>/cancel          cancel job (see cancel)
+//	GET  /drain, POST /drain        progress of draining, refuse new jobs and exit after the queued ones
+//	GET  /connections               cached connections
+//	GET  /circuits                  hosts with open circuit (see circuitBreaker)
+//	GET  /metrics                   metrics in Prometheus text format
+
+const (
+	apiMaxQueuedJobs = 100  // submitting more jobs than that fails with 503
+	apiJobHistory    = 1000 // finished jobs that are kept for polling
+	apiStreamBuffer  = 1024 // events buffered for stream client, slower clients are disconnected
+)
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed" // request was rejected as a whole (e.g. invalid request or unknown group)
+)
+
+var (
+	serveAddr  string // address to serve HTTP API on (-serve)
+	serveToken string // token required in "Authorization: Bearer <token>" header (-serve-token)
+
+	api              *apiServer
+	serveInitialized = make(chan struct{}) // closed when passphrases are entered and API is started
+)
+
+type (
+	apiJob struct {
+		ID        string
+		Status    string
+		Action    string
+		Hosts     []string    // hosts as submitted (before expanding groups and patterns)
+		Client    string      `json:",omitempty"` // -policy token that submitted job
+		Error     string      `json:",omitempty"` // critical error that prevented action from running
+		Errors    []string    `json:",omitempty"` // non-critical errors
+		Completed int         // hosts that finished successfully
+		Failed    int         // hosts that failed
+		Final     *FinalReply `json:",omitempty"`
+		Submitted time.Time
+		Started   *time.Time `json:",omitempty"`
+		Finished  *time.Time `json:",omitempty"`
+
+		request     *ProxyRequest
+		replies     map[string]*Reply
+		grouped     []*GroupedReply
+		done        chan struct{}
+		subscribers map[chan *apiEvent]bool // stream clients
+		cancelled   bool                    // running job was cancelled, it is interrupted
+	}
+
+	// apiEvent is a server-sent event: "output" (OutputChunk), "reply" (Reply), "grouped" (GroupedReply),
+	// "error" (UserError) or "final" (job itself, sent last)
+	apiEvent struct {
+		name string
+		data []byte
+	}
+
+	apiResults struct {
+		Replies        []*Reply
+		GroupedReplies []*GroupedReply `json:",omitempty"`
+	}
+
+	apiError struct {
+		Error string
+	}
+
+	// apiServer queues jobs, passes them to requests one at a time and collects replies for the running one
+	apiServer struct {
+		token    string
+		policy   *requestPolicy // replaces token if set
+		oidc     *oidcVerifier  // accepts OIDC tokens in addition to tokens of policy if set
+		requests chan<- *ProxyRequest
+		queue    chan *apiJob
+
+		mu       sync.Mutex
+		jobs     map[string]*apiJob
+		order    []string // job ids in order of submission
+		nextID   int
+		current  *apiJob
+		draining bool
+		drained  chan struct{} // closed when draining starts
+
+		server *http.Server // shut down after draining, nil in tests
+		exit   func()       // called after draining
+	}
+)
+
+func newAPIServer(token string, requests chan<- *ProxyRequest) *apiServer {
+	return &apiServer{
+		token:    token,
+		requests: requests,
+		queue:    make(chan *apiJob, apiMaxQueuedJobs),
+		jobs:     make(map[string]*apiJob),
+		drained:  make(chan struct{}),
+		exit:     func() { os.Exit(0) },
+	}
+}
+
+// serveInputThread reads passphrases for private keys from stdin until API (or control socket) is started
+func serveInputThread() {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		select {
+		case <-serveInitialized:
+			return
+		default:
+			requestsChan <- &ProxyRequest{Password: scanner.Text()}
+		}
+	}
+}
+
+// serveReplierThread passes replies to the running job, other replies are printed to stderr
+func serveReplierThread() {
+	for reply := range repliesChan {
+		if _, ok := reply.(*InitializeComplete); ok {
+			close(serveInitialized)
+			api.server = &http.Server{Addr: serveAddr, Handler: api}
+			go api.run()
+			go func() {
+				fmt.Fprintln(os.Stderr, "Serving HTTP API on "+serveAddr)
+				if err := api.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					fmt.Fprintln(os.Stderr, "Cannot serve HTTP API: "+err.Error())
+					os.Exit(1)
+				}
+			}()
+			continue
+		}
+
+		if !api.handleReply(reply) {
+			writeReplyText(os.Stderr, os.Stderr, reply, "")
+		}
+	}
+}
+
+// run sends queued jobs to requests one after another until the queue is drained
+func (s *apiServer) run() {
+	for {
+		var job *apiJob
+		select {
+		case job = <-s.queue:
+		case <-s.drained:
+			select {
+			case job = <-s.queue:
+			default:
+				s.shutdown()
+				return
+			}
+		}
+		now := time.Now()
+
+		s.mu.Lock()
+		if job.Status == jobCancelled {
+			s.mu.Unlock()
+			continue
+		}
+		job.Status, job.Started = jobRunning, &now
+		s.current = job
+		s.mu.Unlock()
+
+		s.requests <- job.request
+		<-job.done
+	}
+}
+
+// handleReply records reply for the running job, it returns false if no job is running
+func (s *apiServer) handleReply(reply interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := s.current
+	if job == nil {
+		return false
+	}
+
+	switch reply := reply.(type) {
+	case *OutputChunk:
+		s.broadcast(job, "output", reply)
+	case *Reply:
+		s.broadcast(job, "reply", reply)
+		job.replies[reply.Hostname] = reply
+		if reply.Success {
+			job.Completed++
+		} else {
+			job.Failed++
+		}
+	case *GroupedReply:
+		s.broadcast(job, "grouped", reply)
+		job.grouped = append(job.grouped, reply)
+		if reply.Success {
+			job.Completed += len(reply.Hosts)
+		} else {
+			job.Failed += len(reply.Hosts)
+		}
+	case *UserError:
+		s.broadcast(job, "error", reply)
+		if !reply.IsCritical {
+			job.Errors = append(job.Errors, reply.ErrorMsg)
+			break
+		}
+		job.Error = reply.ErrorMsg
+		s.finish(job, jobFailed)
+	case *FinalReply:
+		job.Final = reply
+		if job.cancelled {
+			s.finish(job, jobCancelled)
+		} else {
+			s.finish(job, jobDone)
+		}
+	}
+
+	return true
+}
+
+// finish marks job as finished and lets the next one run, s.mu must be held
+func (s *apiServer) finish(job *apiJob, status string) {
+	now := time.Now()
+	job.Status, job.Finished = status, &now
+	if s.current == job {
+		s.current = nil
+	}
+	close(job.done)
+
+	s.broadcast(job, "final", job)
+	for ch := range job.subscribers {
+		close(ch)
+	}
+	job.subscribers = nil
+
+	// forget oldest finished jobs
+	for len(s.order) > apiJobHistory {
+		oldest := s.jobs[s.order[0]]
+		if oldest.Finished == nil {
+			break
+		}
+		delete(s.jobs, oldest.ID)
+		s.order = s.order[1:]
+	}
+}
+
+// broadcast sends event to stream clients of job, s.mu must be held
+func (s *apiServer) broadcast(job *apiJob, name string, v interface{}) {
+	if len(job.subscribers) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	ev := &apiEvent{name: name, data: data}
+	for ch := range job.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			// client does not keep up, it will see end of stream
+			close(ch)
+			delete(job.subscribers, ch)
+		}
+	}
+}
+
+// subscribe returns events that already happened (replies of finished hosts) and channel for
+// the following ones, channel is nil if job is already finished; s.mu must be held
+func (s *apiServer) subscribe(job *apiJob) (past []*apiEvent, ch chan *apiEvent) {
+	for _, reply := range sortedReplies(job.replies) {
+		data, _ := json.Marshal(reply)
+		past = append(past, &apiEvent{name: "reply", data: data})
+	}
+	for _, g := range job.grouped {
+		data, _ := json.Marshal(g)
+		past = append(past, &apiEvent{name: "grouped", data: data})
+	}
+
+	if job.Finished != nil {
+		data, _ := json.Marshal(job)
+		return append(past, &apiEvent{name: "final", data: data}), nil
+	}
+
+	ch = make(chan *apiEvent, apiStreamBuffer)
+	if job.subscribers == nil {
+		job.subscribers = make(map[chan *apiEvent]bool)
+	}
+	job.subscribers[ch] = true
+	return past, ch
+}
+
+func (s *apiServer) unsubscribe(job *apiJob, ch chan *apiEvent) {
+	s.mu.Lock()
+	if job.subscribers[ch] {
+		delete(job.subscribers, ch)
+		close(ch)
+	}
+	s.mu.Unlock()
+}
+
+// serveStream sends server-sent events of job until it is finished or client goes away
+func (s *apiServer) serveStream(w http.ResponseWriter, r *http.Request, job *apiJob) {
+	past, ch := s.subscribe(job)
+	s.mu.Unlock()
+	if ch != nil {
+		defer s.unsubscribe(job, ch)
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for _, ev := range past {
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.name, ev.data)
+	}
+	flusher.Flush()
+
+	if ch == nil {
+		return
+	}
+
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.name, ev.data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func sortedReplies(replies map[string]*Reply) []*Reply {
+	res := make([]*Reply, 0, len(replies))
+	for _, reply := range replies {
+		res = append(res, reply)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Hostname < res[j].Hostname })
+	return res
+}
+
+func (s *apiServer) submit(req *ProxyRequest) (*apiJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return nil, errors.New("Draining, new jobs are not accepted")
+	}
+
+	s.nextID++
+	job := &apiJob{
+		ID:        strconv.Itoa(s.nextID),
+		Status:    jobQueued,
+		Action:    req.Action,
+		Hosts:     append([]string{}, req.Hosts...),
+		Client:    req.client,
+		Submitted: time.Now(),
+		request:   req,
+		replies:   make(map[string]*Reply),
+		done:      make(chan struct{}),
+	}
+
+	select {
+	case s.queue <- job:
+	default:
+		return nil, fmt.Errorf("Too many queued jobs (%d)", apiMaxQueuedJobs)
+	}
+
+	s.jobs[job.ID] = job
+	s.order = append(s.order, job.ID)
+	return job, nil
+}
+
+// authenticate returns identity of client with "Authorization" header auth and its -policy entry
+// (nil without policy), identity is empty if neither policy nor OIDC is used
+func (s *apiServer) authenticate(auth string) (user string, client *policyToken, err error) {
+	if s.policy != nil {
+		if client = s.policy.lookup(auth); client != nil {
+			return client.name, client, nil
+		}
+	}
+
+	if s.oidc != nil && strings.HasPrefix(auth, "Bearer ") {
+		user, err = s.oidc.verify(strings.TrimPrefix(auth, "Bearer "), time.Now())
+		if err != nil {
+			return "", nil, err
+		}
+		if s.policy == nil {
+			return user, nil, nil
+		}
+		if client = s.policy.lookupUser(user); client == nil {
+			return "", nil, errors.New("User " + user + " is not allowed by policy")
+		}
+		return user, client, nil
+	}
+
+	if s.policy != nil || s.oidc != nil || s.token != "" && subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+s.token)) != 1 {
+		return "", nil, errors.New("Invalid or missing token")
+	}
+	return "", nil, nil
+}
+
+// visible tells whether job can be seen and cancelled by client with identity user: jobs belong to
+// identities that submitted them, admin entries of -policy and -serve-token (without identity) see all
+func visible(job *apiJob, user string, client *policyToken) bool {
+	return user == "" || client != nil && client.admin || job.Client == user
+}
+
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if policyErr != nil { // -policy or -oidc-issuer are invalid
+		writeAPIError(w, http.StatusServiceUnavailable, policyErr.Error())
+		return
+	}
+
+	user, client, err := s.authenticate(r.Header.Get("Authorization"))
+	if err != nil {
+		writeAPIError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	if r.URL.Path == "/metrics" {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+		return
+	}
+
+	if r.URL.Path == "/connections" {
+		buf, err := json.Marshal(connectedHosts.List())
+		writeAPIResponse(w, http.StatusOK, buf, err)
+		return
+	}
+
+	if r.URL.Path == "/circuits" {
+		buf, err := json.Marshal(circuits.List())
+		writeAPIResponse(w, http.StatusOK, buf, err)
+		return
+	}
+
+	if r.URL.Path == "/drain" {
+		s.serveDrain(w, r, client)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "jobs" || len(parts) > 4 || len(parts) > 2 && parts[2] != "results" && (parts[2] != "stream" && parts[2] != "cancel" || len(parts) > 3) {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case "GET":
+			s.mu.Lock()
+			jobs := make([]*apiJob, 0, len(s.order))
+			for _, id := range s.order {
+				if job := s.jobs[id]; visible(job, user, client) {
+					jobs = append(jobs, job)
+				}
+			}
+			writeAPIResponseLocked(w, http.StatusOK, jobs, &s.mu)
+		case "POST":
+			req := new(ProxyRequest)
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "Cannot parse JSON: "+err.Error())
+				return
+			}
+
+			if client != nil {
+				if violations := s.policy.check(client, req); len(violations) > 0 {
+					buf, err := json.Marshal(&apiPolicyError{Error: "Request violates policy of token " + client.name, Violations: violations})
+					writeAPIResponse(w, http.StatusForbidden, buf, err)
+					return
+				}
+			}
+			req.client = user
+
+			job, err := s.submit(req)
+			if err != nil {
+				writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+				return
+			}
+
+			s.mu.Lock()
+			writeAPIResponseLocked(w, http.StatusAccepted, job, &s.mu)
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+		return
+	}
+
+	cancel := len(parts) == 3 && parts[2] == "cancel"
+	if cancel && r.Method != "POST" || !cancel && r.Method != "GET" {
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	s.mu.Lock()
+	job, ok := s.jobs[parts[1]]
+	if !ok || !visible(job, user, client) {
+		s.mu.Unlock()
+		writeAPIError(w, http.StatusNotFound, "No such job: "+parts[1])
+		return
+	}
+
+	switch len(parts) {
+	case 2:
+		writeAPIResponseLocked(w, http.StatusOK, job, &s.mu)
+	case 3:
+		if cancel {
+			s.serveCancel(w, job)
+			return
+		}
+		if parts[2] == "stream" {
+			s.serveStream(w, r, job)
+			return
+		}
+		writeAPIResponseLocked(w, http.StatusOK, &apiResults{Replies: sortedReplies(job.replies), GroupedReplies: job.grouped}, &s.mu)
+	case 4:
+		reply, ok := job.replies[parts[3]]
+		if !ok {
+			s.mu.Unlock()
+			writeAPIError(w, http.StatusNotFound, "No reply from "+parts[3])
+			return
+		}
+		writeAPIResponseLocked(w, http.StatusOK, reply, &s.mu)
+	}
+}
+
+// writeAPIResponseLocked encodes v while mu is held (so that job is not modified meanwhile) and unlocks it
+func writeAPIResponseLocked(w http.ResponseWriter, code int, v interface{}, mu *sync.Mutex) {
+	buf, err := json.Marshal(v)
+	mu.Unlock()
+	writeAPIResponse(w, code, buf, err)
+}
+
+// writeAPIResponse writes JSON-encoded response buf, or error if encoding failed
+func writeAPIResponse(w http.ResponseWriter, code int, buf []byte, err error) {
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Cannot marshal response: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(buf, '\n'))
+}
+
+func writeAPIError(w http.ResponseWriter, code int, msg string) {
+	buf, _ := json.Marshal(&apiError{Error: msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(buf, '\n'))
+}
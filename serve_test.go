@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// apiRequest performs HTTP request to API and decodes JSON response into v
+func apiRequest(t *testing.T, method, url, body string, v interface{}) int {
+	return apiRequestAs(t, "secret", method, url, body, v)
+}
+
+// apiRequestAs performs API request with token
+func apiRequestAs(t *testing.T, token, method, url, body string, v interface{}) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	must(err, "Could not create request")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	must(err, "Could not perform request")
+	defer resp.Body.Close()
+
+	if v != nil {
+		must(json.NewDecoder(resp.Body).Decode(v), "Could not decode response")
+	}
+	return resp.StatusCode
+}
+
+func TestAPIServer(t *testing.T) {
+	requests := make(chan *ProxyRequest)
+	s := newAPIServer("secret", requests)
+	go s.run()
+
+	gate := make(chan struct{}) // "stream" command produces output only after gate is closed
+
+	// replies are produced like runAction does it, "broken" actions are rejected
+	go func() {
+		for req := range requests {
+			if req.Action == "broken" {
+				s.handleReply(&UserError{IsCritical: true, ErrorMsg: "Unsupported action: broken"})
+				continue
+			}
+			s.handleReply(&ConnectionProgress{ConnectedHost: req.Hosts[0]})
+			if req.Cmd == "stream" {
+				<-gate
+				s.handleReply(&OutputChunk{Hostname: req.Hosts[0], Stream: "stdout", Data: "line\n"})
+			}
+			for _, h := range req.Hosts {
+				s.handleReply(&Reply{Hostname: h, Stdout: req.Cmd + " on " + h, Success: h != "bad"})
+			}
+			s.handleReply(&FinalReply{TimedOutHosts: map[string]bool{}})
+		}
+	}()
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	waitJob := func(id string) *apiJob {
+		for deadline := time.Now().Add(maxTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			job := new(apiJob)
+			if code := apiRequest(t, "GET", srv.URL+"/jobs/"+id, "", job); code != http.StatusOK {
+				t.Fatalf("Unexpected status of job %s: %d", id, code)
+			}
+			if job.Status == jobDone || job.Status == jobFailed {
+				return job
+			}
+		}
+		t.Fatalf("Job %s did not finish", id)
+		return nil
+	}
+
+	job := new(apiJob)
+	if code := apiRequest(t, "POST", srv.URL+"/jobs", `{"Action":"ssh","Cmd":"uptime","Hosts":["good","bad"]}`, job); code != http.StatusAccepted || job.ID == "" {
+		t.Fatalf("Could not submit job: %d %+v", code, job)
+	}
+
+	if job = waitJob(job.ID); job.Status != jobDone || job.Completed != 1 || job.Failed != 1 || job.Final == nil {
+		t.Fatalf("Unexpected finished job: %+v", job)
+	}
+
+	var results apiResults
+	apiRequest(t, "GET", srv.URL+"/jobs/"+job.ID+"/results", "", &results)
+	if len(results.Replies) != 2 || results.Replies[0].Hostname != "bad" || results.Replies[1].Stdout != "uptime on good" {
+		t.Fatalf("Unexpected results: %+v", results)
+	}
+
+	var reply Reply
+	if code := apiRequest(t, "GET", srv.URL+"/jobs/"+job.ID+"/results/good", "", &reply); code != http.StatusOK || !reply.Success {
+		t.Fatalf("Unexpected reply of host: %d %+v", code, reply)
+	}
+
+	broken := new(apiJob)
+	apiRequest(t, "POST", srv.URL+"/jobs", `{"Action":"broken","Hosts":["good"]}`, broken)
+	if broken = waitJob(broken.ID); broken.Status != jobFailed || broken.Error != "Unsupported action: broken" {
+		t.Fatalf("Unexpected rejected job: %+v", broken)
+	}
+
+	var jobs []*apiJob
+	if apiRequest(t, "GET", srv.URL+"/jobs", "", &jobs); len(jobs) != 2 || jobs[0].ID != job.ID {
+		t.Fatalf("Unexpected list of jobs: %+v", jobs)
+	}
+
+	for _, path := range []string{"/jobs/100", "/jobs/" + job.ID + "/results/unknown", "/other"} {
+		if code := apiRequest(t, "GET", srv.URL+path, "", &apiError{}); code != http.StatusNotFound {
+			t.Fatalf("Expected 404 for %s, got %d", path, code)
+		}
+	}
+
+	streamed := new(apiJob)
+	apiRequest(t, "POST", srv.URL+"/jobs", `{"Action":"ssh","Cmd":"stream","Stream":true,"Hosts":["good"]}`, streamed)
+
+	req, err := http.NewRequest("GET", srv.URL+"/jobs/"+streamed.ID+"/stream", nil)
+	must(err, "Could not create request")
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	must(err, "Could not open stream")
+
+	// output is produced only after client is subscribed
+	for subscribed := false; !subscribed; time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		subscribed = s.current != nil && len(s.current.subscribers) > 0
+		s.mu.Unlock()
+	}
+	close(gate)
+
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if ln := scanner.Text(); strings.HasPrefix(ln, "event: ") {
+			events = append(events, strings.TrimPrefix(ln, "event: "))
+		} else if strings.HasPrefix(ln, "data: ") && events[len(events)-1] == "output" && !strings.Contains(ln, `"Data":"line\n"`) {
+			t.Fatalf("Unexpected output event: %s", ln)
+		}
+	}
+	resp.Body.Close()
+
+	if strings.Join(events, ",") != "output,reply,final" {
+		t.Fatalf("Unexpected events: %v", events)
+	}
+
+	resp, err = http.Get(srv.URL + "/jobs")
+	must(err, "Could not perform request")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Requests without token must be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestConnectionsEndpoint(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-connections", 2)
+	runTestRequest(t, r, makeProxyRequest(maxTimeout))
+
+	srv := httptest.NewServer(newAPIServer("secret", nil))
+	defer srv.Close()
+
+	var conns []*ConnectionInfo
+	if code := apiRequest(t, "GET", srv.URL+"/connections", "", &conns); code != http.StatusOK {
+		t.Fatalf("Unexpected status: %d", code)
+	}
+
+	found := make(map[string]bool)
+	for _, c := range conns {
+		found[c.Hostname] = c.ServerVersion != ""
+	}
+	for addr := range r.hosts {
+		if !found[addr] {
+			t.Fatalf("No cached connection to %s in %+v", addr, conns)
+		}
+	}
+}
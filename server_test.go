@@ -1,17 +1,24 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 type testSSHServer struct {
@@ -19,10 +26,24 @@ type testSSHServer struct {
 	exitStatus int
 
 	// various fault injections
-	acceptSleep time.Duration
-	cmdSleep    time.Duration
+	acceptSleep  time.Duration
+	cmdSleep     time.Duration
+	failConnects int32 // how many first connections to drop right after accept
+	stalled      int32 // when set to 1, server stops reading from connections (as if network went down)
+	dropCmds     int32 // how many first commands to abort by closing connection after they are started
 
 	addr string
+	root string // directory that is served via sftp subsystem
+	otp  string // when set, keyboard-interactive one-time password is required instead of public key
+
+	password       string // when set, password is required instead of public key
+	passwordPrompt bool   // with password: ask for it with keyboard-interactive instead of password authentication
+
+	noPosixRename bool // do not announce posix-rename@openssh.com sftp extension
+	noSftp        bool // reject sftp subsystem requests
+
+	forwardedConns int32 // number of direct-tcpip channels opened (when used as jump host)
+	connections    int32 // number of accepted ssh connections
 }
 
 func (s *testSSHServer) start() {
@@ -55,6 +76,42 @@ func (s *testSSHServer) start() {
 
 	conf.PublicKeyCallback = certChecker.Authenticate
 
+	if s.otp != "" {
+		conf.PublicKeyCallback = nil
+		conf.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge(conn.User(), "Two-factor authentication", []string{"Verification code: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 1 || answers[0] != s.otp {
+				return nil, fmt.Errorf("invalid verification code")
+			}
+			return nil, nil
+		}
+	}
+
+	if s.password != "" && !s.passwordPrompt {
+		conf.PublicKeyCallback = nil
+		conf.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != s.password {
+				return nil, fmt.Errorf("invalid password")
+			}
+			return nil, nil
+		}
+	} else if s.password != "" {
+		conf.PublicKeyCallback = nil
+		conf.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge(conn.User(), "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 1 || answers[0] != s.password {
+				return nil, fmt.Errorf("invalid password")
+			}
+			return nil, nil
+		}
+	}
+
 	list, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		panic(fmt.Errorf("Could not listen: %s", err.Error()))
@@ -62,6 +119,11 @@ func (s *testSSHServer) start() {
 
 	s.addr = list.Addr().String()
 
+	s.root, err = ioutil.TempDir(testTmpDir, "gossha-sftp")
+	if err != nil {
+		panic(fmt.Errorf("Could not create sftp root: %s", err.Error()))
+	}
+
 	if verbose {
 		log.Printf("Host %s is listening on %s", s.hostname, s.addr)
 	}
@@ -80,23 +142,46 @@ func (s *testSSHServer) handleConnections(list net.Listener, conf *ssh.ServerCon
 			panic(fmt.Errorf("Failed to accept incoming connection: %s", err))
 		}
 
-		sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, conf)
+		if atomic.AddInt32(&s.failConnects, -1) >= 0 {
+			tcpConn.Close()
+			continue
+		}
+
+		sshConn, chans, reqs, err := ssh.NewServerConn(&stallableConn{Conn: tcpConn, stalled: &s.stalled}, conf)
 		if err != nil {
-			panic(fmt.Errorf("Handshake failed: %s", err))
+			// authentication failures are tested too
+			log.Printf("Handshake failed: %s", err)
+			tcpConn.Close()
+			continue
 		}
 
+		atomic.AddInt32(&s.connections, 1)
+
 		if verbose {
 			log.Printf("New SSH connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
 		}
 
 		go ssh.DiscardRequests(reqs)
-		go s.handleChannels(chans)
+		go s.handleChannels(sshConn, chans)
 	}
 }
 
-func (s *testSSHServer) handleChannels(chans <-chan ssh.NewChannel) {
+// stallableConn stops returning data when stalled is set
+type stallableConn struct {
+	net.Conn
+	stalled *int32
+}
+
+func (c *stallableConn) Read(p []byte) (int, error) {
+	for atomic.LoadInt32(c.stalled) == 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c.Conn.Read(p)
+}
+
+func (s *testSSHServer) handleChannels(conn ssh.Conn, chans <-chan ssh.NewChannel) {
 	for newChannel := range chans {
-		go s.handleChannel(newChannel)
+		go s.handleChannel(conn, newChannel)
 	}
 }
 
@@ -104,7 +189,12 @@ type channelRequestSuccessMsg struct {
 	PeersId uint32 `sshtype:"99"` // we have no legal way of getting PeersId but go client accepts 0 perfectly fine
 }
 
-func (s *testSSHServer) handleChannel(newChannel ssh.NewChannel) {
+func (s *testSSHServer) handleChannel(conn ssh.Conn, newChannel ssh.NewChannel) {
+	if newChannel.ChannelType() == "direct-tcpip" {
+		s.handleDirectTCPIP(newChannel)
+		return
+	}
+
 	if t := newChannel.ChannelType(); t != "session" {
 		newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
 		return
@@ -117,39 +207,106 @@ func (s *testSSHServer) handleChannel(newChannel ssh.NewChannel) {
 	}
 	defer ch.Close()
 
-	go io.Copy(os.Stdout, ch)
-	go io.Copy(os.Stderr, ch.Stderr())
+	var env []string
+	agentForwarded := false
+	var x11Cookie string
 
-	go func() {
-		rd := bufio.NewReader(ch)
-		for {
-			ln, err := rd.ReadString('\n')
-			if err != nil {
-				if err == io.EOF {
-					return
-				}
-				panic(fmt.Errorf("Could not read line: %s", err.Error()))
+	for req := range requests {
+		if req.Type == "subsystem" && string(req.Payload[4:]) == "sftp" {
+			if s.noSftp {
+				req.Reply(false, nil)
+				continue
 			}
-			log.Printf("Got line from client: %s", ln)
+			req.Reply(true, nil)
+			s.serveSftp(ch)
+			return
+		}
+
+		if req.Type == "pty-req" {
+			env = append(env, "TEST_PTY=1")
+			req.Reply(true, nil)
+			continue
+		}
+
+		if req.Type == "auth-agent-req@openssh.com" {
+			agentForwarded = true
+			req.Reply(true, nil)
+			continue
+		}
+
+		if req.Type == "x11-req" {
+			var msg struct {
+				SingleConnection bool
+				AuthProtocol     string
+				AuthCookie       string
+				ScreenNumber     uint32
+			}
+			if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+				panic(fmt.Errorf("Could not parse x11 request: %s", err))
+			}
+			x11Cookie = msg.AuthCookie
+			req.Reply(true, nil)
+			continue
+		}
+
+		if req.Type == "env" {
+			var msg struct{ Name, Value string }
+			if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+				panic(fmt.Errorf("Could not parse env request: %s", err))
+			}
+			env = append(env, msg.Name+"="+msg.Value)
+			req.Reply(true, nil)
+			continue
+		}
+
+		if req.Type == "shell" {
+			req.Reply(true, nil)
+			s.runShellCmd(ch, requests, "sh", env)
+			return
 		}
-	}()
 
-	for req := range requests {
 		if req.Type != "exec" {
 			panic(fmt.Errorf("Unsupported request type: %s", req.Type))
 		}
 
 		// first 4 bytes is length, ignore it
 		cmd := string(req.Payload[4:])
-
-		if cmd != "hostname" {
-			panic(fmt.Errorf("Unknown cmd: %s", cmd))
+		special := cmd // special commands below are recognized without exported run environment (see runEnv)
+		if strings.HasPrefix(cmd, "export GOSSHA_") {
+			special = cmd[strings.Index(cmd, "; ")+2:]
 		}
 
 		if !req.WantReply {
 			panic(fmt.Errorf("Expected that want reply is always set"))
 		}
 
+		if atomic.AddInt32(&s.dropCmds, -1) >= 0 {
+			req.Reply(true, nil)
+			conn.Close()
+			return
+		}
+
+		if special == "agent-keys" {
+			req.Reply(true, nil)
+			s.listAgentKeys(conn, ch, agentForwarded)
+			return
+		}
+
+		if special == "x11-hello" {
+			req.Reply(true, nil)
+			s.x11Hello(conn, ch, x11Cookie)
+			return
+		}
+
+		if special != "hostname" {
+			req.Reply(true, nil)
+			s.runShellCmd(ch, requests, cmd, env)
+			return
+		}
+
+		go io.Copy(os.Stdout, ch)
+		go io.Copy(os.Stderr, ch.Stderr())
+
 		if s.cmdSleep > 0 {
 			time.Sleep(s.cmdSleep)
 		}
@@ -157,9 +314,373 @@ func (s *testSSHServer) handleChannel(newChannel ssh.NewChannel) {
 		req.Reply(true, ssh.Marshal(&channelRequestSuccessMsg{}))
 		ch.Write([]byte(s.hostname))
 
-		var b bytes.Buffer
-		binary.Write(&b, binary.BigEndian, uint32(s.exitStatus))
-		ch.SendRequest("exit-status", false, b.Bytes())
+		s.sendExitStatus(ch, s.exitStatus)
+		return
+	}
+}
+
+func (s *testSSHServer) sendExitStatus(ch ssh.Channel, status int) {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint32(status))
+	ch.SendRequest("exit-status", false, b.Bytes())
+}
+
+// x11Hello sends "hello" over X11 channel and prints cookie of x11-req and reply of display
+func (s *testSSHServer) x11Hello(conn ssh.Conn, ch ssh.Channel, cookie string) {
+	if cookie == "" {
+		fmt.Fprint(ch.Stderr(), "X11 forwarding was not requested")
+		s.sendExitStatus(ch, 1)
+		return
+	}
+
+	x11Ch, reqs, err := conn.OpenChannel("x11", ssh.Marshal(&struct {
+		Addr string
+		Port uint32
+	}{"127.0.0.1", 0}))
+	if err != nil {
+		fmt.Fprint(ch.Stderr(), "could not open x11 channel: "+err.Error())
+		s.sendExitStatus(ch, 1)
+		return
+	}
+	defer x11Ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	x11Ch.Write([]byte("hello"))
+	x11Ch.CloseWrite()
+	reply, _ := ioutil.ReadAll(x11Ch)
+
+	fmt.Fprintf(ch, "%s %s", cookie, reply)
+	s.sendExitStatus(ch, 0)
+}
+
+// listAgentKeys prints number of keys in forwarded agent
+func (s *testSSHServer) listAgentKeys(conn ssh.Conn, ch ssh.Channel, agentForwarded bool) {
+	if !agentForwarded {
+		fmt.Fprint(ch.Stderr(), "agent forwarding was not requested")
+		s.sendExitStatus(ch, 1)
+		return
+	}
+
+	agentCh, reqs, err := conn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		fmt.Fprint(ch.Stderr(), "could not open agent channel: "+err.Error())
+		s.sendExitStatus(ch, 1)
+		return
+	}
+	defer agentCh.Close()
+	go ssh.DiscardRequests(reqs)
+
+	keys, err := agent.NewClient(agentCh).List()
+	if err != nil {
+		fmt.Fprint(ch.Stderr(), "could not list agent keys: "+err.Error())
+		s.sendExitStatus(ch, 1)
+		return
+	}
+
+	fmt.Fprint(ch, len(keys))
+	s.sendExitStatus(ch, 0)
+}
+
+// runShellCmd runs any command except "hostname" using local shell in server root directory,
+// signals are sent to the whole process group of the command
+func (s *testSSHServer) runShellCmd(ch ssh.Channel, requests <-chan *ssh.Request, cmd string, env []string) {
+	c := exec.Command("/bin/sh", "-c", cmd)
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Dir = s.root
+	c.Env = append(append(os.Environ(), "TEST_HOSTNAME="+s.hostname), env...)
+	c.Stdout = ch
+	c.Stderr = ch.Stderr()
+
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		panic(fmt.Errorf("Could not create stdin pipe: %s", err))
+	}
+
+	if err := c.Start(); err != nil {
+		panic(fmt.Errorf("Could not start %s: %s", cmd, err))
+	}
+
+	go func() {
+		io.Copy(stdin, ch)
+		stdin.Close()
+	}()
+
+	go func() {
+		signals := map[string]syscall.Signal{"INT": syscall.SIGINT, "KILL": syscall.SIGKILL}
+		for req := range requests {
+			var msg struct{ Signal string }
+			if req.Type == "signal" && ssh.Unmarshal(req.Payload, &msg) == nil && signals[msg.Signal] != 0 {
+				syscall.Kill(-c.Process.Pid, signals[msg.Signal])
+			}
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	status := 0
+	if err := c.Wait(); err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			panic(fmt.Errorf("Could not run %s: %s", cmd, err))
+		}
+
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			s.sendExitSignal(ch, ws.Signal())
+			return
+		}
+		status = exitErr.ExitCode()
+	}
+
+	s.sendExitStatus(ch, status)
+}
+
+func (s *testSSHServer) sendExitSignal(ch ssh.Channel, sig syscall.Signal) {
+	names := map[syscall.Signal]string{syscall.SIGINT: "INT", syscall.SIGKILL: "KILL"}
+	ch.SendRequest("exit-signal", false, ssh.Marshal(&struct {
+		Signal     string
+		CoreDumped bool
+		Error      string
+		Lang       string
+	}{Signal: names[sig]}))
+}
+
+type directTCPIPMsg struct {
+	Host     string
+	Port     uint32
+	OrigHost string
+	OrigPort uint32
+}
+
+// handleDirectTCPIP proxies forwarded connection, so that server can be used as a jump host
+func (s *testSSHServer) handleDirectTCPIP(newChannel ssh.NewChannel) {
+	atomic.AddInt32(&s.forwardedConns, 1)
+
+	var msg directTCPIPMsg
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &msg); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
 		return
 	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(msg.Host, fmt.Sprint(msg.Port)))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, requests, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	go func() {
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+
+	io.Copy(conn, ch)
+	conn.Close()
+}
+
+// testSftpAttrs returns sftp attributes of local file
+func testSftpAttrs(fi os.FileInfo) *sftpAttrs {
+	perm := uint32(fi.Mode().Perm())
+	switch {
+	case fi.IsDir():
+		perm |= 0040000
+	case fi.Mode()&os.ModeSymlink != 0:
+		perm |= 0120000
+	default:
+		perm |= 0100000
+	}
+
+	return &sftpAttrs{
+		Flags: sshFileXferAttrSize | sshFileXferAttrPermissions | sshFileXferAttrACModTime,
+		Size:  uint64(fi.Size()),
+		Perm:  perm,
+		Atime: uint32(fi.ModTime().Unix()),
+		Mtime: uint32(fi.ModTime().Unix()),
+	}
+}
+
+// serveSftp implements tiny subset of sftp server that operates on files in s.root
+func (s *testSSHServer) serveSftp(ch ssh.Channel) {
+	c := &sftpClient{w: ch, r: ch}
+	handles := make(map[string]*os.File)
+	listed := make(map[string]bool) // directory handles which entries were already returned
+	nextHandle := 0
+
+	localPath := func(p string) string {
+		return filepath.Join(s.root, filepath.FromSlash(p))
+	}
+
+	status := func(id uint32, err error) sftpPacket {
+		code := uint32(sshFxOk)
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) { // like OpenSSH does
+			code = sshFxNoSuchFile
+		} else if err == io.EOF {
+			code = sshFxEOF
+		} else if err != nil {
+			code = sshFxFailure
+		}
+
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+
+		return sftpPacket{sshFxpStatus}.appendUint32(id).appendUint32(code).appendString(msg).appendString("")
+	}
+
+	setstat := func(name string, a *sftpAttrs) error {
+		if a.Flags&sshFileXferAttrPermissions != 0 {
+			if err := os.Chmod(name, os.FileMode(a.Perm&0777)); err != nil {
+				return err
+			}
+		}
+		if a.Flags&sshFileXferAttrACModTime != 0 {
+			return os.Chtimes(name, time.Unix(int64(a.Atime), 0), time.Unix(int64(a.Mtime), 0))
+		}
+		return nil
+	}
+
+	for {
+		typ, r, err := c.readPacket()
+		if err != nil {
+			return
+		}
+
+		if typ == sshFxpInit {
+			version := sftpPacket{sshFxpVersion}.appendUint32(sftpProtocolVersion)
+			if !s.noPosixRename {
+				version = version.appendString("posix-rename@openssh.com").appendString("1")
+			}
+			c.writePacket(version)
+			continue
+		}
+
+		id := r.uint32()
+		var resp sftpPacket
+
+		switch typ {
+		case sshFxpOpen:
+			name, pflags := localPath(r.string()), r.uint32()
+			a := r.attrs()
+
+			flags := os.O_RDONLY
+			if pflags&sshFxfWrite != 0 {
+				flags = os.O_WRONLY
+			}
+			if pflags&sshFxfCreat != 0 {
+				flags |= os.O_CREATE
+			}
+			if pflags&sshFxfTrunc != 0 {
+				flags |= os.O_TRUNC
+			}
+			perm := os.FileMode(0644)
+			if a.Flags&sshFileXferAttrPermissions != 0 {
+				perm = os.FileMode(a.Perm & 0777)
+			}
+
+			fp, err := os.OpenFile(name, flags, perm)
+			if err != nil {
+				resp = status(id, err)
+				break
+			}
+
+			nextHandle++
+			handle := fmt.Sprint(nextHandle)
+			handles[handle] = fp
+			resp = sftpPacket{sshFxpHandle}.appendUint32(id).appendString(handle)
+		case sshFxpClose:
+			handle := r.string()
+			resp = status(id, handles[handle].Close())
+			delete(handles, handle)
+		case sshFxpWrite:
+			fp, offset := handles[r.string()], r.uint64()
+			_, err := fp.WriteAt(r.bytes(), int64(offset))
+			resp = status(id, err)
+		case sshFxpRead:
+			fp, offset, length := handles[r.string()], r.uint64(), r.uint32()
+			buf := make([]byte, length)
+			n, err := fp.ReadAt(buf, int64(offset))
+			if n > 0 {
+				resp = sftpPacket{sshFxpData}.appendUint32(id).appendBytes(buf[:n])
+			} else {
+				resp = status(id, err)
+			}
+		case sshFxpStat, sshFxpLstat:
+			stat := os.Stat
+			if typ == sshFxpLstat {
+				stat = os.Lstat
+			}
+			fi, err := stat(localPath(r.string()))
+			if err != nil {
+				resp = status(id, err)
+				break
+			}
+			resp = sftpPacket{sshFxpAttrs}.appendUint32(id).appendAttrs(testSftpAttrs(fi))
+		case sshFxpOpendir:
+			fp, err := os.Open(localPath(r.string()))
+			if err != nil {
+				resp = status(id, err)
+				break
+			}
+			nextHandle++
+			handle := fmt.Sprint(nextHandle)
+			handles[handle] = fp
+			resp = sftpPacket{sshFxpHandle}.appendUint32(id).appendString(handle)
+		case sshFxpReaddir:
+			handle := r.string()
+			if listed[handle] {
+				resp = status(id, io.EOF)
+				break
+			}
+			listed[handle] = true
+			fis, err := handles[handle].Readdir(-1)
+			if err != nil {
+				resp = status(id, err)
+				break
+			}
+			resp = sftpPacket{sshFxpName}.appendUint32(id).appendUint32(uint32(len(fis)))
+			for _, fi := range fis {
+				resp = resp.appendString(fi.Name()).appendString(fi.Name()).appendAttrs(testSftpAttrs(fi))
+			}
+		case sshFxpRmdir:
+			resp = status(id, os.Remove(localPath(r.string())))
+		case sshFxpSetstat:
+			name := localPath(r.string())
+			resp = status(id, setstat(name, r.attrs()))
+		case sshFxpFsetstat:
+			fp := handles[r.string()]
+			resp = status(id, setstat(fp.Name(), r.attrs()))
+		case sshFxpMkdir:
+			resp = status(id, os.Mkdir(localPath(r.string()), 0755))
+		case sshFxpRemove:
+			resp = status(id, os.Remove(localPath(r.string())))
+		case sshFxpRename:
+			// like OpenSSH, plain rename does not overwrite existing files
+			oldpath, newpath := localPath(r.string()), localPath(r.string())
+			if _, err := os.Lstat(newpath); err == nil {
+				resp = status(id, fmt.Errorf("%s already exists", newpath))
+			} else {
+				resp = status(id, os.Rename(oldpath, newpath))
+			}
+		case sshFxpExtended:
+			if name := r.string(); name != "posix-rename@openssh.com" || s.noPosixRename {
+				resp = status(id, fmt.Errorf("Unsupported sftp extension: %s", name))
+				break
+			}
+			oldpath, newpath := localPath(r.string()), localPath(r.string())
+			resp = status(id, os.Rename(oldpath, newpath))
+		default:
+			resp = status(id, fmt.Errorf("Unsupported sftp packet type: %d", typ))
+		}
+
+		if err := c.writePacket(resp); err != nil {
+			return
+		}
+	}
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Services (Action == "service" or "gossha service <operation> <service> host1 ... hostN"): init
+// system of every host is detected (systemd, or SysV init with "service" command) and "Operation"
+// (start, stop, restart, reload, status, and enable or disable with systemd) is done on "Service"
+// with the command of that system, so that fleets with mixed init systems need no shell scripts
+// around mssh. Use "Sudo": true if login user cannot manage services. Replies have "Service" with
+// the init system, the command that was run and state of the service after it ("Active", and
+// "Enabled" with systemd); start, restart and reload fail if the service is not active after them,
+// stop fails if it still is, and status fails if it is not active.
+
+var (
+	serviceOperations = []string{"start", "stop", "restart", "reload", "status", "enable", "disable"}
+
+	// serviceDetectCmd prints init system of host: systemd or sysv
+	serviceDetectCmd = "if [ -d /run/systemd/system ] && command -v systemctl >/dev/null 2>&1; then echo systemd; " +
+		"elif command -v service >/dev/null 2>&1; then echo sysv; fi"
+
+	managedNameRe = regexp.MustCompile(`^[a-zA-Z0-9_.:@+][a-zA-Z0-9_.:@+-]*$`) // names of services and packages
+)
+
+// ServiceResult is state of service after Action == "service"
+type ServiceResult struct {
+	Manager string // init system of host: systemd or sysv
+	Command string // command that was run
+	Active  string // state of service after command, e.g. active, inactive or failed (sysv only tells active or inactive)
+	Enabled string `json:",omitempty"` // whether service is started at boot, e.g. enabled or disabled (only with systemd)
+}
+
+// serviceOptions are parameters of Action == "service"
+type serviceOptions struct {
+	operation, service string
+	opts               *cmdOptions
+}
+
+// parseServiceOptions returns parameters of service request msg
+func parseServiceOptions(msg *ProxyRequest) (*serviceOptions, error) {
+	if !containsString(serviceOperations, msg.Operation) {
+		return nil, errors.New("'Operation' must be one of " + strings.Join(serviceOperations, ", "))
+	}
+	if !managedNameRe.MatchString(msg.Service) {
+		return nil, fmt.Errorf("Invalid 'Service' %q", msg.Service)
+	}
+	opts, err := parseCmdOptions(msg)
+	if err != nil {
+		return nil, err
+	}
+	opts.stream, opts.streamOnly, opts.pty = false, false, false
+	return &serviceOptions{operation: msg.Operation, service: msg.Service, opts: opts}, nil
+}
+
+// detectManager runs detectCmd on host and returns the name it prints
+func detectManager(conn *ssh.Client, hostname, detectCmd, what string, opts *cmdOptions) (string, error) {
+	out, _, err := runCmd(conn, hostname, detectCmd, opts.forHost())
+	if err != nil {
+		return "", errors.New("Cannot detect " + what + ": " + err.Error())
+	}
+	if out = strings.TrimSpace(out); out == "" {
+		return "", errors.New("Unsupported " + what)
+	}
+	return out, nil
+}
+
+// serviceCommand returns command that does operation on service with init system manager
+func serviceCommand(manager, operation, service string) (string, error) {
+	switch manager {
+	case "systemd":
+		if operation == "status" {
+			return "systemctl status --no-pager -- " + service, nil
+		}
+		return "systemctl " + operation + " -- " + service, nil
+	case "sysv":
+		if operation == "enable" || operation == "disable" {
+			return "", errors.New("Cannot " + operation + " " + service + " with sysv init, only with systemd")
+		}
+		return "service " + service + " " + operation, nil
+	}
+	return "", errors.New("Unsupported init system " + manager)
+}
+
+// serviceState sets state of service in r
+func serviceState(conn *ssh.Client, hostname string, r *ServiceResult, service string, opts *cmdOptions) {
+	if r.Manager == "sysv" {
+		r.Active = "inactive"
+		if _, _, err := runCmd(conn, hostname, "service "+service+" status >/dev/null 2>&1", opts.forHost()); err == nil {
+			r.Active = "active"
+		}
+		return
+	}
+	// is-active and is-enabled exit with non-zero status for inactive and disabled services
+	active, _, _ := runCmd(conn, hostname, "systemctl is-active -- "+service, opts.forHost())
+	enabled, _, _ := runCmd(conn, hostname, "systemctl is-enabled -- "+service, opts.forHost())
+	r.Active, r.Enabled = strings.TrimSpace(active), strings.TrimSpace(enabled)
+}
+
+// manageService does operation of s on service of hostname
+func manageService(s *serviceOptions, hostname string) *SshResult {
+	res := &SshResult{hostname: hostname}
+
+	conn, err := getConnection(hostname)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	defer connectedHosts.Release(hostname, conn)
+
+	manager, err := detectManager(conn, hostname, serviceDetectCmd, "init system", s.opts)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	cmd, err := serviceCommand(manager, s.operation, s.service)
+	if err != nil {
+		res.err = err
+		return res
+	}
+
+	r := &ServiceResult{Manager: manager, Command: cmd}
+	res.stdout, res.stderr, err = runCmd(conn, hostname, cmd, s.opts.forHost())
+	var retryable *retryableError
+	if errors.As(err, &retryable) {
+		res.err = err // the command was not run
+		return res
+	}
+	res.service = r
+	serviceState(conn, hostname, r, s.service, s.opts)
+
+	switch {
+	case s.operation == "status":
+		if r.Active != "active" {
+			res.err = errors.New("Service " + s.service + " is " + r.Active)
+		}
+	case err != nil:
+		res.err = err
+	case s.operation == "stop" && r.Active == "active":
+		res.err = errors.New("Service " + s.service + " is still active after stop")
+	case s.operation != "stop" && s.operation != "enable" && s.operation != "disable" && r.Active != "active":
+		res.err = errors.New("Service " + s.service + " is " + r.Active + " after " + s.operation)
+	}
+	return res
+}
+
+// formatService returns human-readable description of service result
+func formatService(r *ServiceResult) string {
+	res := r.Manager + ": " + r.Active
+	if r.Enabled != "" {
+		res += ", " + r.Enabled
+	}
+	return res
+}
+
+// serviceMain implements "gossha service [flags] <operation> <service> host1 ... hostN"
+func serviceMain(args []string) int {
+	var serial string
+	var sudo bool
+
+	os.Args = append([]string{os.Args[0]}, args...)
+	flag.StringVar(&serial, "serial", "", "Manage service on N hosts (or N% of hosts) at a time")
+	flag.BoolVar(&sudo, "sudo", false, "Run commands with sudo")
+
+	return actionMain("service [flags] <"+strings.Join(serviceOperations, "|")+"> <service> host1 ... hostN", fixedArgs(2), func(args []string) *ProxyRequest {
+		return &ProxyRequest{Action: "service", Operation: args[0], Service: args[1], Hosts: args[2:], Serial: serial, Sudo: sudo}
+	})
+}
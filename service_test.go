@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeManagers are scripts that pretend to be systemctl, service, apt-get and dpkg-query, state of
+// services and packages of each test server is kept as files in $FAKE_STATE
+var fakeManagers = map[string]string{
+	"systemctl": `case "$1" in
+is-active) if [ -f "$FAKE_STATE/$TEST_HOSTNAME-$3" ]; then echo active; else echo inactive; exit 3; fi ;;
+is-enabled) echo enabled ;;
+start|restart) [ "$3" = broken ] || touch "$FAKE_STATE/$TEST_HOSTNAME-$3" ;;
+stop) rm -f "$FAKE_STATE/$TEST_HOSTNAME-$3" ;;
+status) echo "$4 status"; [ -f "$FAKE_STATE/$TEST_HOSTNAME-$4" ] || exit 3 ;;
+esac`,
+	"service": `case "$2" in
+status) [ -f "$FAKE_STATE/$TEST_HOSTNAME-$1" ] ;;
+start) touch "$FAKE_STATE/$TEST_HOSTNAME-$1" ;;
+esac`,
+	"apt-get": `op=$1; while [ "$1" != -- ]; do shift; done; shift
+for p in "$@"; do
+	case "$op" in
+	install) echo 1.0 > "$FAKE_STATE/$TEST_HOSTNAME-pkg-$p" ;;
+	remove) rm -f "$FAKE_STATE/$TEST_HOSTNAME-pkg-$p" ;;
+	esac
+done`,
+	"dpkg-query": `f="$FAKE_STATE/$TEST_HOSTNAME-pkg-$4"; [ -f "$f" ] && printf 'install ok installed %s' "$(cat "$f")"`,
+}
+
+// withFakeManagers installs fake managers and returns environment of requests to use them
+func withFakeManagers(t *testing.T) map[string]string {
+	dir := t.TempDir()
+	for name, script := range fakeManagers {
+		must(ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755), "Could not write fake "+name)
+	}
+	state := filepath.Join(dir, "state")
+	must(os.Mkdir(state, 0755), "Could not create state directory")
+	return map[string]string{"PATH": dir + ":" + os.Getenv("PATH"), "FAKE_STATE": state}
+}
+
+func TestService(t *testing.T) {
+	oldDetect := serviceDetectCmd
+	defer func() { serviceDetectCmd = oldDetect }()
+	serviceDetectCmd = "echo systemd"
+	env := withFakeManagers(t)
+
+	r := makeTestResult()
+	startTestServers(r, "test-service", 2)
+	runTestRequest(t, r, &ProxyRequest{Action: "service", Operation: "restart", Service: "nginx", Env: env})
+	for _, reply := range r.replies {
+		if s := reply.Service; s == nil || s.Manager != "systemd" || s.Command != "systemctl restart -- nginx" || s.Active != "active" || s.Enabled != "enabled" {
+			t.Fatalf("Unexpected result: %+v", s)
+		}
+	}
+
+	r = makeTestResult()
+	startTestServers(r, "test-service-broken", 1)
+	sendTestRequest(t, r, &ProxyRequest{Action: "service", Operation: "start", Service: "broken", Env: env})
+	for _, reply := range r.replies {
+		if reply.Success || reply.ErrMsg != "Service broken is inactive after start" || reply.Service.Active != "inactive" {
+			t.Fatalf("Expected service that did not start to fail: %+v", reply)
+		}
+	}
+
+	r = makeTestResult()
+	startTestServers(r, "test-service-status", 1)
+	sendTestRequest(t, r, &ProxyRequest{Action: "service", Operation: "status", Service: "nginx", Env: env})
+	for _, reply := range r.replies {
+		if reply.Success || reply.Stdout != "nginx status\n" {
+			t.Fatalf("Expected status of inactive service to fail: %+v", reply)
+		}
+	}
+
+	serviceDetectCmd = "echo sysv"
+	r = makeTestResult()
+	startTestServers(r, "test-service-sysv", 1)
+	runTestRequest(t, r, &ProxyRequest{Action: "service", Operation: "start", Service: "cron", Env: env})
+	for _, reply := range r.replies {
+		if s := reply.Service; s.Manager != "sysv" || s.Command != "service cron start" || s.Active != "active" {
+			t.Fatalf("Unexpected result: %+v", s)
+		}
+	}
+
+	if _, err := serviceCommand("sysv", "enable", "cron"); err == nil {
+		t.Fatalf("Expected enable to need systemd")
+	}
+	for _, msg := range []*ProxyRequest{{Operation: "kill", Service: "nginx"}, {Operation: "start", Service: "-h"}, {Operation: "start", Service: "a;b"}} {
+		if _, err := parseServiceOptions(msg); err == nil {
+			t.Fatalf("Expected error for %+v", msg)
+		}
+	}
+}
+
+func TestPkg(t *testing.T) {
+	oldDetect := pkgDetectCmd
+	defer func() { pkgDetectCmd = oldDetect }()
+	pkgDetectCmd = "echo apt"
+	env := withFakeManagers(t)
+
+	r := makeTestResult()
+	startTestServers(r, "test-pkg", 2)
+	runTestRequest(t, r, &ProxyRequest{Action: "pkg", Operation: "install", Packages: []string{"jq", "htop"}, Env: env})
+	for _, reply := range r.replies {
+		p := reply.Pkg
+		if p == nil || p.Manager != "apt" || len(p.Packages) != 2 {
+			t.Fatalf("Unexpected result: %+v", p)
+		}
+		for _, s := range p.Packages {
+			if s.Version != "1.0" || s.Previous != "" || !s.Changed {
+				t.Fatalf("Unexpected state of %s: %+v", s.Name, s)
+			}
+		}
+		if formatPkg(p) != "apt: jq 1.0, htop 1.0" {
+			t.Fatalf("Unexpected description: %s", formatPkg(p))
+		}
+	}
+
+	r = makeTestResult()
+	startTestServers(r, "test-pkg", 2)
+	runTestRequest(t, r, &ProxyRequest{Action: "pkg", Operation: "remove", Packages: []string{"jq"}, Env: env})
+	for _, reply := range r.replies {
+		if s := reply.Pkg.Packages[0]; s.Version != "" || s.Previous != "1.0" || !s.Changed {
+			t.Fatalf("Unexpected state of %s: %+v", s.Name, s)
+		}
+	}
+
+	r = makeTestResult()
+	startTestServers(r, "test-pkg", 2)
+	sendTestRequest(t, r, &ProxyRequest{Action: "pkg", Operation: "status", Packages: []string{"jq", "htop"}, Env: env})
+	for _, reply := range r.replies {
+		if reply.Success || reply.ErrMsg != "Packages are not installed: jq" || reply.Pkg.Command != "" {
+			t.Fatalf("Expected status to fail for package that is not installed: %+v", reply)
+		}
+	}
+
+	if cmd, _ := pkgCommand("apt", "upgrade", []string{"jq"}); cmd != "DEBIAN_FRONTEND=noninteractive apt-get install --only-upgrade -y -q -- jq" {
+		t.Fatalf("Unexpected command: %s", cmd)
+	}
+	if cmd, _ := pkgCommand("dnf", "remove", []string{"jq", "htop"}); cmd != "dnf remove -y -q -- jq htop" {
+		t.Fatalf("Unexpected command: %s", cmd)
+	}
+	if _, err := parsePkgOptions(&ProxyRequest{Operation: "install", Packages: []string{"$(id)"}}); err == nil {
+		t.Fatalf("Expected error for invalid package name")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Named sessions ("Session": "<name>" or -session): "sessions" section of configuration file
+// defines environment that every command of a fleet needs:
+//
+//	sessions:
+//	  app:
+//	    setup: ["cd /srv/app", ". ./env.sh"]
+//	    teardown: ["rm -f /tmp/app.lock"]
+//
+// Setup commands are run before every command (and script and OnlyIf command) in the same shell,
+// so that directory and variables they set are kept, and the command is not run if one of them
+// fails. Teardown commands are run after action over the same connection, also if it failed.
+
+type sessionConfig struct {
+	setup    []string
+	teardown []string
+}
+
+var (
+	sessionDefault string                    // -session
+	configSessions map[string]*sessionConfig // "sessions" section of configuration file
+)
+
+// parseConfigSessions parses "sessions" section of configuration file
+func parseConfigSessions(value interface{}) (map[string]*sessionConfig, error) {
+	sessions, ok := value.(*yamlMap)
+	if !ok {
+		return nil, errors.New("sessions must be a mapping of names to setup and teardown commands")
+	}
+
+	res := make(map[string]*sessionConfig)
+	for _, name := range sessions.Keys() {
+		options, ok := sessions.Get(name).(*yamlMap)
+		if !ok {
+			return nil, errors.New("session " + name + " must be a mapping")
+		}
+
+		s := &sessionConfig{}
+		for _, key := range options.Keys() {
+			cmds, err := configStrings("session "+name+" "+key, options.Get(key))
+			if err != nil {
+				return nil, err
+			}
+			switch key {
+			case "setup":
+				s.setup = cmds
+			case "teardown":
+				s.teardown = cmds
+			default:
+				return nil, errors.New("unknown option " + key + " of session " + name)
+			}
+		}
+		res[name] = s
+	}
+	return res, nil
+}
+
+// initSessions sets sessions from configuration and checks -session
+func initSessions(conf *gosshaConfig) error {
+	configSessions = conf.sessions
+	if sessionDefault != "" && configSessions[sessionDefault] == nil {
+		return errors.New("Unknown -session " + sessionDefault + ", " + knownSessions())
+	}
+	return nil
+}
+
+func knownSessions() string {
+	if len(configSessions) == 0 {
+		return "sessions must be defined in \"sessions\" section of config"
+	}
+
+	names := make([]string, 0, len(configSessions))
+	for name := range configSessions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "known sessions are " + strings.Join(names, ", ")
+}
+
+// requestSession returns session of msg, nil if it does not use one
+func requestSession(msg *ProxyRequest) (*sessionConfig, error) {
+	name := msg.Session
+	if name == "" {
+		name = sessionDefault
+	}
+	if name == "" {
+		return nil, nil
+	}
+
+	s, ok := configSessions[name]
+	if !ok {
+		return nil, errors.New("Unknown session " + name + ", " + knownSessions())
+	}
+	return s, nil
+}
+
+// wrap prepends setup commands to cmd, cmd is only run if all of them succeed
+func (s *sessionConfig) wrap(cmd string) string {
+	if s == nil || len(s.setup) == 0 {
+		return cmd
+	}
+	return strings.Join(s.setup, " && ") + " || exit $?\n" + cmd
+}
+
+// withSessionTeardown runs teardown commands of session of msg on every host after execFunc
+func withSessionTeardown(msg *ProxyRequest, execFunc func(string) *SshResult) (func(string) *SshResult, error) {
+	opts, err := parseCmdOptions(msg)
+	if err != nil {
+		return nil, err
+	}
+	if opts.session == nil || len(opts.session.teardown) == 0 || dryRun {
+		return execFunc, nil
+	}
+	opts.stdin, opts.stream, opts.streamOnly, opts.record, opts.maxOutput = nil, false, false, nil, 0
+
+	// all teardown commands are run, host fails if one of them fails
+	teardown := "s=0\n"
+	for _, cmd := range opts.session.teardown {
+		teardown += cmd + " || s=$?\n"
+	}
+	teardown += "exit $s"
+
+	return func(hostname string) *SshResult {
+		res := execFunc(hostname)
+
+		_, stderr, err := executeCmd(teardown, opts.forHost(), hostname)
+		if err != nil {
+			if stderr = strings.TrimSpace(stderr); stderr != "" {
+				err = errors.New(err.Error() + ": " + stderr)
+			}
+			logf(logInfo, hostname, "Session teardown failed: %s", err)
+			if res.err == nil {
+				res.err = errors.New("Session teardown failed: " + err.Error())
+			}
+		}
+		return res
+	}, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigSessions(t *testing.T) {
+	yamlDoc, err := parseYaml([]byte("sessions:\n  app:\n    setup: [cd /srv/app, . ./env.sh]\n    teardown: rm -f lock\n"))
+	must(err, "Could not parse yaml config")
+	tomlDoc, err := parseToml([]byte("[sessions.app]\nsetup = [\"cd /srv/app\", \". ./env.sh\"]\nteardown = \"rm -f lock\"\n"))
+	must(err, "Could not parse toml config")
+
+	for _, doc := range []interface{}{yamlDoc, tomlDoc} {
+		conf, err := applyConfig(doc)
+		if err != nil {
+			t.Fatalf("Could not apply config: %s", err)
+		}
+		expected := &sessionConfig{setup: []string{"cd /srv/app", ". ./env.sh"}, teardown: []string{"rm -f lock"}}
+		if !reflect.DeepEqual(conf.sessions["app"], expected) {
+			t.Fatalf("Unexpected session: %+v", conf.sessions["app"])
+		}
+	}
+
+	doc, err := parseYaml([]byte("sessions:\n  app:\n    before: [cd /srv/app]\n"))
+	must(err, "Could not parse yaml config")
+	if _, err := applyConfig(doc); err == nil {
+		t.Fatalf("Unknown option of session must be rejected")
+	}
+}
+
+func TestSession(t *testing.T) {
+	configSessions = map[string]*sessionConfig{
+		"work": {setup: []string{"mkdir -p work", "cd work", "GREETING=hi"}, teardown: []string{"false", "echo done > ../teardown"}},
+	}
+	defer func() { configSessions = nil }()
+
+	r := makeTestResult()
+	startTestServers(r, "test-session", 2)
+
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = `echo "$GREETING from $(basename "$PWD")"`
+	req.Session = "work"
+	for addr := range r.hostsLeft {
+		req.Hosts = append(req.Hosts, addr)
+	}
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+
+	for addr, reply := range r.replies {
+		if reply.Stdout != "hi from work\n" || reply.Success || reply.ErrMsg != "Session teardown failed: Process exited with status 1" {
+			t.Fatalf("Unexpected reply from %s: %+v", addr, reply)
+		}
+		if _, err := os.Stat(filepath.Join(r.hosts[addr].root, "teardown")); err != nil {
+			t.Fatalf("Teardown commands must all be run: %s", err)
+		}
+	}
+
+	src, err := ioutil.TempFile("", "gossha-session")
+	must(err, "Could not create script")
+	defer os.Remove(src.Name())
+	_, err = src.WriteString("#!/bin/sh\nbasename \"$PWD\"\n")
+	must(err, "Could not write script")
+	src.Close()
+
+	configSessions["work"].teardown = nil
+	r.replies = make(map[string]*Reply)
+	for addr := range r.hosts {
+		r.hostsLeft[addr] = struct{}{}
+	}
+	runTestRequest(t, r, &ProxyRequest{Action: "script", Source: src.Name(), Session: "work"})
+	for addr, reply := range r.replies {
+		if reply.Stdout != "work\n" {
+			t.Fatalf("Script must be run after setup commands on %s: %+v", addr, reply)
+		}
+	}
+}
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Minimal client for SFTP protocol version 3 (draft-ietf-secsh-filexfer-02), which is
+// what OpenSSH and basically every other server speaks. Only the subset needed for
+// uploads and downloads is implemented.
+
+const (
+	sftpProtocolVersion = 3
+
+	sftpMaxData     = 32768 // max data length per read/write request (every server must support it)
+	sftpMaxInflight = 16    // max unacknowledged write requests per file
+	sftpMaxPacket   = 1 << 18
+)
+
+const (
+	sshFxpInit     = 1
+	sshFxpVersion  = 2
+	sshFxpOpen     = 3
+	sshFxpClose    = 4
+	sshFxpRead     = 5
+	sshFxpWrite    = 6
+	sshFxpLstat    = 7
+	sshFxpFstat    = 8
+	sshFxpSetstat  = 9
+	sshFxpFsetstat = 10
+	sshFxpOpendir  = 11
+	sshFxpReaddir  = 12
+	sshFxpRemove   = 13
+	sshFxpMkdir    = 14
+	sshFxpRmdir    = 15
+	sshFxpRealpath = 16
+	sshFxpStat     = 17
+	sshFxpRename   = 18
+	sshFxpExtended = 200
+	sshFxpStatus   = 101
+	sshFxpHandle   = 102
+	sshFxpData     = 103
+	sshFxpName     = 104
+	sshFxpAttrs    = 105
+)
+
+const (
+	sshFxOk               = 0
+	sshFxEOF              = 1
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+	sshFxFailure          = 4
+)
+
+const (
+	sshFxfRead   = 0x01
+	sshFxfWrite  = 0x02
+	sshFxfAppend = 0x04
+	sshFxfCreat  = 0x08
+	sshFxfTrunc  = 0x10
+	sshFxfExcl   = 0x20
+)
+
+const (
+	sshFileXferAttrSize        = 0x01
+	sshFileXferAttrUIDGID      = 0x02
+	sshFileXferAttrPermissions = 0x04
+	sshFileXferAttrACModTime   = 0x08
+	sshFileXferAttrExtended    = 0x80000000
+)
+
+type (
+	sftpClient struct {
+		session    *ssh.Session
+		w          io.WriteCloser
+		r          io.Reader
+		nextID     uint32
+		extensions map[string]string // extensions announced by server
+	}
+
+	sftpFile struct {
+		c        *sftpClient
+		path     string
+		handle   string
+		offset   uint64
+		inflight map[uint32]bool
+	}
+
+	// sftpAttrs is a file attributes structure; only fields mentioned in Flags are valid
+	sftpAttrs struct {
+		Flags uint32
+		Size  uint64
+		UID   uint32
+		GID   uint32
+		Perm  uint32
+		Atime uint32
+		Mtime uint32
+	}
+
+	sftpStatusError struct {
+		Code uint32
+		Msg  string
+	}
+
+	// sftpDirEntry is file in remote directory
+	sftpDirEntry struct {
+		name  string
+		attrs *sftpAttrs // attributes of the entry itself, symlinks are not followed
+	}
+)
+
+func (e *sftpStatusError) Error() string {
+	msg := e.Msg
+	if msg == "" {
+		switch e.Code {
+		case sshFxEOF:
+			msg = "end of file"
+		case sshFxNoSuchFile:
+			msg = "no such file"
+		case sshFxPermissionDenied:
+			msg = "permission denied"
+		default:
+			msg = "failure"
+		}
+	}
+	return fmt.Sprintf("sftp: %s (code %d)", msg, e.Code)
+}
+
+func isSftpNotExist(err error) bool {
+	statusErr, ok := err.(*sftpStatusError)
+	return ok && statusErr.Code == sshFxNoSuchFile
+}
+
+type sftpPacket []byte
+
+func (p sftpPacket) appendUint32(v uint32) sftpPacket {
+	return append(p, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (p sftpPacket) appendUint64(v uint64) sftpPacket {
+	return p.appendUint32(uint32(v >> 32)).appendUint32(uint32(v))
+}
+
+func (p sftpPacket) appendString(s string) sftpPacket {
+	return append(p.appendUint32(uint32(len(s))), s...)
+}
+
+func (p sftpPacket) appendBytes(b []byte) sftpPacket {
+	return append(p.appendUint32(uint32(len(b))), b...)
+}
+
+func (p sftpPacket) appendAttrs(a *sftpAttrs) sftpPacket {
+	if a == nil {
+		return p.appendUint32(0)
+	}
+
+	p = p.appendUint32(a.Flags &^ sshFileXferAttrExtended)
+	if a.Flags&sshFileXferAttrSize != 0 {
+		p = p.appendUint64(a.Size)
+	}
+	if a.Flags&sshFileXferAttrUIDGID != 0 {
+		p = p.appendUint32(a.UID).appendUint32(a.GID)
+	}
+	if a.Flags&sshFileXferAttrPermissions != 0 {
+		p = p.appendUint32(a.Perm)
+	}
+	if a.Flags&sshFileXferAttrACModTime != 0 {
+		p = p.appendUint32(a.Atime).appendUint32(a.Mtime)
+	}
+	return p
+}
+
+var errSftpShortPacket = errors.New("sftp: packet too short")
+
+type sftpReader struct {
+	buf []byte
+	err error
+}
+
+func (r *sftpReader) uint32() uint32 {
+	if len(r.buf) < 4 {
+		r.err = errSftpShortPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.buf)
+	r.buf = r.buf[4:]
+	return v
+}
+
+func (r *sftpReader) uint64() uint64 {
+	return uint64(r.uint32())<<32 | uint64(r.uint32())
+}
+
+func (r *sftpReader) bytes() []byte {
+	l := r.uint32()
+	if r.err != nil {
+		return nil
+	}
+	if uint32(len(r.buf)) < l {
+		r.err = errSftpShortPacket
+		return nil
+	}
+	v := r.buf[:l]
+	r.buf = r.buf[l:]
+	return v
+}
+
+func (r *sftpReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *sftpReader) attrs() *sftpAttrs {
+	a := &sftpAttrs{Flags: r.uint32()}
+	if a.Flags&sshFileXferAttrSize != 0 {
+		a.Size = r.uint64()
+	}
+	if a.Flags&sshFileXferAttrUIDGID != 0 {
+		a.UID = r.uint32()
+		a.GID = r.uint32()
+	}
+	if a.Flags&sshFileXferAttrPermissions != 0 {
+		a.Perm = r.uint32()
+	}
+	if a.Flags&sshFileXferAttrACModTime != 0 {
+		a.Atime = r.uint32()
+		a.Mtime = r.uint32()
+	}
+	if a.Flags&sshFileXferAttrExtended != 0 {
+		for i, cnt := uint32(0), r.uint32(); i < cnt && r.err == nil; i++ {
+			r.string()
+			r.string()
+		}
+	}
+	return a
+}
+
+// newSftpClient opens new session with sftp subsystem and performs protocol version negotiation
+func newSftpClient(conn *ssh.Client) (c *sftpClient, err error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, &retryableError{err}
+	}
+
+	c = &sftpClient{session: session}
+	metricActiveSessions.add(1)
+
+	defer func() {
+		if err != nil {
+			session.Close()
+			metricActiveSessions.add(-1)
+			c = nil
+		}
+	}()
+
+	if c.w, err = session.StdinPipe(); err != nil {
+		return
+	}
+
+	if c.r, err = session.StdoutPipe(); err != nil {
+		return
+	}
+
+	if err = session.RequestSubsystem("sftp"); err != nil {
+		return
+	}
+
+	if err = c.writePacket(sftpPacket{sshFxpInit}.appendUint32(sftpProtocolVersion)); err != nil {
+		return
+	}
+
+	typ, r, err := c.readPacket()
+	if err != nil {
+		return
+	}
+
+	if typ != sshFxpVersion {
+		err = fmt.Errorf("sftp: unexpected packet type %d in response to init", typ)
+		return
+	}
+
+	c.extensions = make(map[string]string)
+	for r.uint32(); len(r.buf) > 0 && r.err == nil; {
+		name, data := r.string(), r.string()
+		c.extensions[name] = data
+	}
+
+	return
+}
+
+func (c *sftpClient) Close() error {
+	c.w.Close()
+	metricActiveSessions.add(-1)
+	return c.session.Close()
+}
+
+func (c *sftpClient) writePacket(p sftpPacket) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(p)))
+	if _, err := c.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := c.w.Write(p)
+	return err
+}
+
+func (c *sftpClient) readPacket() (typ byte, r *sftpReader, err error) {
+	var length [4]byte
+	if _, err = io.ReadFull(c.r, length[:]); err != nil {
+		return
+	}
+
+	l := binary.BigEndian.Uint32(length[:])
+	if l < 1 || l > sftpMaxPacket {
+		err = fmt.Errorf("sftp: invalid packet length %d", l)
+		return
+	}
+
+	buf := make([]byte, l)
+	if _, err = io.ReadFull(c.r, buf); err != nil {
+		return
+	}
+
+	return buf[0], &sftpReader{buf: buf[1:]}, nil
+}
+
+// newRequest returns packet of specified type with freshly allocated request id
+func (c *sftpClient) newRequest(typ byte) (id uint32, p sftpPacket) {
+	c.nextID++
+	return c.nextID, sftpPacket{typ}.appendUint32(c.nextID)
+}
+
+// roundTrip sends request and reads response for it; status responses other than
+// SSH_FX_OK are converted to errors
+func (c *sftpClient) roundTrip(id uint32, p sftpPacket) (typ byte, r *sftpReader, err error) {
+	if err = c.writePacket(p); err != nil {
+		return
+	}
+
+	typ, r, err = c.readPacket()
+	if err != nil {
+		return
+	}
+
+	if respID := r.uint32(); respID != id {
+		err = fmt.Errorf("sftp: unexpected response id %d (expected %d)", respID, id)
+		return
+	}
+
+	if typ == sshFxpStatus {
+		err = readSftpStatus(r)
+	}
+
+	return
+}
+
+func readSftpStatus(r *sftpReader) error {
+	statusErr := &sftpStatusError{Code: r.uint32(), Msg: r.string()}
+	if r.err != nil {
+		return r.err
+	}
+	if statusErr.Code == sshFxOk {
+		return nil
+	}
+	return statusErr
+}
+
+func (c *sftpClient) simpleRequest(typ byte, path string, attrs *sftpAttrs) error {
+	id, p := c.newRequest(typ)
+	p = p.appendString(path)
+	if typ == sshFxpSetstat || typ == sshFxpMkdir {
+		p = p.appendAttrs(attrs)
+	}
+
+	respType, _, err := c.roundTrip(id, p)
+	if err == nil && respType != sshFxpStatus {
+		err = fmt.Errorf("sftp: unexpected packet type %d", respType)
+	}
+	return err
+}
+
+func (c *sftpClient) Stat(path string) (*sftpAttrs, error) {
+	return c.stat(sshFxpStat, path)
+}
+
+// Lstat returns attributes of path without following symlink
+func (c *sftpClient) Lstat(path string) (*sftpAttrs, error) {
+	return c.stat(sshFxpLstat, path)
+}
+
+func (c *sftpClient) stat(typ byte, path string) (*sftpAttrs, error) {
+	id, p := c.newRequest(typ)
+	typ, r, err := c.roundTrip(id, p.appendString(path))
+	if err != nil {
+		return nil, err
+	}
+
+	if typ != sshFxpAttrs {
+		return nil, fmt.Errorf("sftp: unexpected packet type %d in response to stat", typ)
+	}
+
+	attrs := r.attrs()
+	return attrs, r.err
+}
+
+func (c *sftpClient) Setstat(path string, attrs *sftpAttrs) error {
+	return c.simpleRequest(sshFxpSetstat, path, attrs)
+}
+
+func (c *sftpClient) Mkdir(path string) error {
+	return c.simpleRequest(sshFxpMkdir, path, nil)
+}
+
+func (c *sftpClient) Remove(path string) error {
+	return c.simpleRequest(sshFxpRemove, path, nil)
+}
+
+func (c *sftpClient) Rmdir(path string) error {
+	return c.simpleRequest(sshFxpRmdir, path, nil)
+}
+
+// ReadDir returns entries of remote directory dir except "." and ".."
+func (c *sftpClient) ReadDir(dir string) ([]*sftpDirEntry, error) {
+	id, p := c.newRequest(sshFxpOpendir)
+	typ, r, err := c.roundTrip(id, p.appendString(dir))
+	if err != nil {
+		return nil, err
+	}
+	if typ != sshFxpHandle {
+		return nil, fmt.Errorf("sftp: unexpected packet type %d in response to opendir", typ)
+	}
+	handle := r.string()
+	if r.err != nil {
+		return nil, r.err
+	}
+	defer func() {
+		id, p := c.newRequest(sshFxpClose)
+		c.roundTrip(id, p.appendString(handle))
+	}()
+
+	var res []*sftpDirEntry
+	for {
+		id, p := c.newRequest(sshFxpReaddir)
+		typ, r, err := c.roundTrip(id, p.appendString(handle))
+		if statusErr, ok := err.(*sftpStatusError); ok && statusErr.Code == sshFxEOF {
+			return res, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if typ != sshFxpName {
+			return nil, fmt.Errorf("sftp: unexpected packet type %d in response to readdir", typ)
+		}
+
+		for i, cnt := uint32(0), r.uint32(); i < cnt && r.err == nil; i++ {
+			name := r.string()
+			r.string() // long name, like output of ls -l
+			attrs := r.attrs()
+			if name != "." && name != ".." {
+				res = append(res, &sftpDirEntry{name: name, attrs: attrs})
+			}
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+}
+
+func (c *sftpClient) Rename(oldpath, newpath string) error {
+	id, p := c.newRequest(sshFxpRename)
+	_, _, err := c.roundTrip(id, p.appendString(oldpath).appendString(newpath))
+	return err
+}
+
+// Replace renames oldpath to newpath, overwriting newpath if it exists. Replacement is atomic
+// when server supports "posix-rename@openssh.com", otherwise newpath is removed first, because
+// SSH_FXP_RENAME does not overwrite existing files.
+func (c *sftpClient) Replace(oldpath, newpath string) error {
+	if _, ok := c.extensions["posix-rename@openssh.com"]; ok {
+		id, p := c.newRequest(sshFxpExtended)
+		_, _, err := c.roundTrip(id, p.appendString("posix-rename@openssh.com").appendString(oldpath).appendString(newpath))
+		return err
+	}
+
+	err := c.Rename(oldpath, newpath)
+	if err == nil {
+		return nil
+	}
+
+	if _, statErr := c.Stat(newpath); statErr != nil {
+		return err
+	}
+
+	if err := c.Remove(newpath); err != nil {
+		return err
+	}
+	return c.Rename(oldpath, newpath)
+}
+
+// MkdirAll creates directory dir along with any necessary parents, like "mkdir -p"
+func (c *sftpClient) MkdirAll(dir string) error {
+	if dir == "" || dir == "." || dir == "/" {
+		return nil
+	}
+
+	attrs, err := c.Stat(dir)
+	if err == nil {
+		if attrs.Flags&sshFileXferAttrPermissions != 0 && attrs.Perm&0170000 != 0040000 {
+			return fmt.Errorf("%s exists and is not a directory", dir)
+		}
+		return nil
+	} else if !isSftpNotExist(err) {
+		return err
+	}
+
+	if err := c.MkdirAll(path.Dir(strings.TrimSuffix(dir, "/"))); err != nil {
+		return err
+	}
+
+	return c.Mkdir(dir)
+}
+
+// OpenFile opens remote file using SSH_FXF_* flags; attrs are used when file is created
+func (c *sftpClient) OpenFile(path string, pflags uint32, attrs *sftpAttrs) (*sftpFile, error) {
+	id, p := c.newRequest(sshFxpOpen)
+	typ, r, err := c.roundTrip(id, p.appendString(path).appendUint32(pflags).appendAttrs(attrs))
+	if err != nil {
+		return nil, err
+	}
+
+	if typ != sshFxpHandle {
+		return nil, fmt.Errorf("sftp: unexpected packet type %d in response to open", typ)
+	}
+
+	handle := r.string()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return &sftpFile{c: c, path: path, handle: handle, inflight: make(map[uint32]bool)}, nil
+}
+
+// Create opens file for writing, creating or truncating it
+func (c *sftpClient) Create(path string, attrs *sftpAttrs) (*sftpFile, error) {
+	return c.OpenFile(path, sshFxfWrite|sshFxfCreat|sshFxfTrunc, attrs)
+}
+
+// Open opens file for reading
+func (c *sftpClient) Open(path string) (*sftpFile, error) {
+	return c.OpenFile(path, sshFxfRead, nil)
+}
+
+// waitWrite reads one write acknowledgement; after errors of the connection pending writes are
+// forgotten, because their replies cannot be matched to them anymore
+func (f *sftpFile) waitWrite() error {
+	typ, r, err := f.c.readPacket()
+	if err != nil {
+		f.inflight = make(map[uint32]bool)
+		return err
+	}
+
+	id := r.uint32()
+	if !f.inflight[id] {
+		f.inflight = make(map[uint32]bool)
+		return fmt.Errorf("sftp: unexpected response id %d", id)
+	}
+	delete(f.inflight, id)
+
+	if typ != sshFxpStatus {
+		return fmt.Errorf("sftp: unexpected packet type %d in response to write", typ)
+	}
+
+	return readSftpStatus(r)
+}
+
+// flush waits for all pending writes to be acknowledged
+func (f *sftpFile) flush() (err error) {
+	for len(f.inflight) > 0 {
+		if waitErr := f.waitWrite(); err == nil {
+			err = waitErr
+		}
+	}
+	return
+}
+
+// Write sends data to the server without waiting for each chunk to be acknowledged,
+// so that throughput is not bound by round-trip time
+func (f *sftpFile) Write(data []byte) (n int, err error) {
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > sftpMaxData {
+			chunk = chunk[:sftpMaxData]
+		}
+
+		id, p := f.c.newRequest(sshFxpWrite)
+		if err = f.c.writePacket(p.appendString(f.handle).appendUint64(f.offset).appendBytes(chunk)); err != nil {
+			return
+		}
+		f.inflight[id] = true
+
+		f.offset += uint64(len(chunk))
+		n += len(chunk)
+		data = data[len(chunk):]
+
+		if len(f.inflight) >= sftpMaxInflight {
+			if err = f.waitWrite(); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// Read reads data from current file offset
+func (f *sftpFile) Read(buf []byte) (n int, err error) {
+	if err = f.flush(); err != nil {
+		return
+	}
+
+	if len(buf) > sftpMaxData {
+		buf = buf[:sftpMaxData]
+	}
+
+	id, p := f.c.newRequest(sshFxpRead)
+	typ, r, err := f.c.roundTrip(id, p.appendString(f.handle).appendUint64(f.offset).appendUint32(uint32(len(buf))))
+	if err != nil {
+		if statusErr, ok := err.(*sftpStatusError); ok && statusErr.Code == sshFxEOF {
+			err = io.EOF
+		}
+		return
+	}
+
+	if typ != sshFxpData {
+		return 0, fmt.Errorf("sftp: unexpected packet type %d in response to read", typ)
+	}
+
+	data := r.bytes()
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n = copy(buf, data)
+	f.offset += uint64(n)
+	return
+}
+
+// Setstat changes attributes of opened file
+func (f *sftpFile) Setstat(attrs *sftpAttrs) error {
+	if err := f.flush(); err != nil {
+		return err
+	}
+
+	id, p := f.c.newRequest(sshFxpFsetstat)
+	_, _, err := f.c.roundTrip(id, p.appendString(f.handle).appendAttrs(attrs))
+	return err
+}
+
+// Close waits for pending writes and closes file handle
+func (f *sftpFile) Close() error {
+	err := f.flush()
+
+	id, p := f.c.newRequest(sshFxpClose)
+	if _, _, closeErr := f.c.roundTrip(id, p.appendString(f.handle)); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
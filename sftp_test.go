@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSftpAttrsRoundTrip(t *testing.T) {
+	in := &sftpAttrs{
+		Flags: sshFileXferAttrSize | sshFileXferAttrUIDGID | sshFileXferAttrPermissions | sshFileXferAttrACModTime,
+		Size:  1<<40 + 5,
+		UID:   1000,
+		GID:   100,
+		Perm:  0100644,
+		Atime: 1497916800,
+		Mtime: 1497916801,
+	}
+
+	r := &sftpReader{buf: sftpPacket{}.appendAttrs(in)}
+	out := r.attrs()
+
+	if r.err != nil {
+		t.Fatalf("Could not decode attrs: %s", r.err)
+	}
+
+	if *out != *in {
+		t.Fatalf("Attrs mismatch: expected %#v, got %#v", in, out)
+	}
+
+	if len(r.buf) != 0 {
+		t.Fatalf("Unexpected %d trailing bytes", len(r.buf))
+	}
+}
+
+func TestParseUploadOptions(t *testing.T) {
+	opts, err := parseUploadOptions(&ProxyRequest{Mode: "0755", Owner: "33:33"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	attrs := opts.attrs
+
+	if attrs.Perm != 0755 || attrs.UID != 33 || attrs.GID != 33 {
+		t.Fatalf("Unexpected attrs: %#v", attrs)
+	}
+
+	for _, req := range []*ProxyRequest{{Mode: "0999"}, {Mode: "17777"}, {Owner: "root:root"}, {Owner: "33"}} {
+		if _, err := parseUploadOptions(req); err == nil {
+			t.Fatalf("Expected error for %#v", req)
+		}
+	}
+}
+
+type discardCloser struct{ bytes.Buffer }
+
+func (discardCloser) Close() error { return nil }
+
+func TestSftpCloseAfterConnectionLoss(t *testing.T) {
+	c := &sftpClient{w: &discardCloser{}, r: strings.NewReader("")}
+	f := &sftpFile{c: c, handle: "h", inflight: make(map[uint32]bool)}
+	if _, err := f.Write(bytes.Repeat([]byte("x"), 3*sftpMaxData)); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- f.Close() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("Close succeeded without acknowledgements")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close hangs after connection was lost")
+	}
+}
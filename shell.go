@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// Remote shell: sshd passes command to login shell of user, so the same command can behave
+// differently on hosts where it is e.g. fish or csh. "Shell": "/bin/bash -c" passes quoted command
+// to the given shell instead, "NoShell": true splits command into words locally (quotes and
+// backslashes are handled like POSIX shell does, but nothing is expanded) and executes the
+// program directly with these arguments.
+//
+// Working directory ("Chdir" or -chdir): commands and scripts are run after "cd <dir> &&" in the
+// shell that sshd starts, so that sudo and su inherit the directory and relative paths are resolved
+// the same way on every host. The directory is rendered as a template like Cmd.
+
+var (
+	shellDefault   string // -shell
+	noShellDefault bool   // -no-shell
+	chdirDefault   string // -chdir
+)
+
+// requestShell returns shell settings of msg, default ones are set by -shell and -no-shell
+func requestShell(msg *ProxyRequest) (shell string, noShell bool) {
+	if msg.Shell == "" && !msg.NoShell {
+		return shellDefault, noShellDefault
+	}
+	return msg.Shell, msg.NoShell
+}
+
+// shellCommand returns command line that sshd must run for cmd according to opts
+func shellCommand(cmd string, opts *cmdOptions) (string, error) {
+	if opts.noShell {
+		args, err := splitCommandLine(cmd)
+		if err != nil {
+			return "", err
+		}
+		if len(args) == 0 {
+			return "", errors.New("Empty command")
+		}
+		return chdirCommand("exec "+shellQuoteArgs(args), opts.chdir), nil
+	}
+
+	if opts.shell != "" {
+		return chdirCommand(opts.shell+" "+shellQuote(cmd), opts.chdir), nil
+	}
+
+	return chdirCommand(cmd, opts.chdir), nil
+}
+
+// chdirCommand prefixes cmd with change of directory to dir unless it is empty
+func chdirCommand(cmd, dir string) string {
+	if dir == "" {
+		return cmd
+	}
+	if strings.HasPrefix(dir, "-") {
+		dir = "./" + dir // not every shell supports "cd --"
+	}
+	return "cd " + shellQuote(dir) + " && " + cmd
+}
+
+// withDefaultChdir returns msg with Chdir set to -chdir if it is a command or script without directory
+func withDefaultChdir(msg *ProxyRequest) *ProxyRequest {
+	if msg.Chdir != "" || chdirDefault == "" || msg.Action != "ssh" && msg.Action != "script" {
+		return msg
+	}
+	res := *msg
+	res.Chdir = chdirDefault
+	return &res
+}
+
+// shellQuoteArgs quotes every argument for POSIX shell and joins them with spaces
+func shellQuoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// splitCommandLine splits cmd into words like POSIX shell does, but without expansions: words are
+// separated by whitespace, single quotes keep everything verbatim, backslash escapes the next
+// character outside of quotes and ", \, $ and ` inside double quotes
+func splitCommandLine(cmd string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord := false
+
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		case c == '\\':
+			if i++; i == len(cmd) {
+				return nil, errors.New("Trailing backslash in command")
+			}
+			if cmd[i] == '\n' {
+				continue // line continuation
+			}
+			word.WriteByte(cmd[i])
+		case c == '\'':
+			end := strings.IndexByte(cmd[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("Unterminated single quote in command")
+			}
+			word.WriteString(cmd[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			for i++; ; i++ {
+				if i == len(cmd) {
+					return nil, errors.New("Unterminated double quote in command")
+				}
+				if cmd[i] == '"' {
+					break
+				}
+				if cmd[i] == '\\' && i+1 < len(cmd) && strings.IndexByte("\"\\$`", cmd[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(cmd[i])
+			}
+		default:
+			word.WriteByte(c)
+		}
+		inWord = true
+	}
+
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	for cmd, expected := range map[string][]string{
+		`ls -l /tmp`:                      {"ls", "-l", "/tmp"},
+		`  echo  'a b' "c \"d\" \$e $f" `: {"echo", "a b", `c "d" $e $f`},
+		`printf %s\ x 'it'\''s' ""`:       {"printf", "%s x", "it's", ""},
+		"echo a\\\nb":                     {"echo", "ab"},
+		"":                                nil,
+	} {
+		if args, err := splitCommandLine(cmd); err != nil || !reflect.DeepEqual(args, expected) {
+			t.Fatalf("Unexpected words of %q: %q, %v", cmd, args, err)
+		}
+	}
+
+	for _, cmd := range []string{`echo 'a`, `echo "a`, `echo a\`} {
+		if _, err := splitCommandLine(cmd); err == nil {
+			t.Fatalf("Invalid command %q must be rejected", cmd)
+		}
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-shell", 2)
+
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: `printf '%s|' "a  b" '$HOME' *`, NoShell: true})
+	for _, reply := range r.replies {
+		if reply.Stdout != "a  b|$HOME|*|" {
+			t.Fatalf("Command without shell must get arguments verbatim, got %q", reply.Stdout)
+		}
+	}
+
+	r = makeTestResult()
+	startTestServers(r, "test-shell", 2)
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: `echo "$GOSSHA_SHELL"`, Shell: "env GOSSHA_SHELL=custom sh -c"})
+	for _, reply := range r.replies {
+		if reply.Stdout != "custom\n" {
+			t.Fatalf("Command must be passed to shell, got %q", reply.Stdout)
+		}
+	}
+
+	r = makeTestResult()
+	startTestServers(r, "test-shell", 2)
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "pwd", NoShell: true, Chdir: "/"})
+	for _, reply := range r.replies {
+		if reply.Stdout != "/\n" {
+			t.Fatalf("Command must be run in Chdir, got %q", reply.Stdout)
+		}
+	}
+	if cmd := chdirCommand("ls", "-dir"); cmd != "cd './-dir' && ls" {
+		t.Fatalf("Unexpected command with Chdir: %s", cmd)
+	}
+
+	if _, err := parseCmdOptions(&ProxyRequest{Shell: "bash -c", NoShell: true}); err == nil {
+		t.Fatalf("Shell and NoShell must not be used together")
+	}
+
+	render, err := newHostRenderer(&ProxyRequest{Template: true, Cmd: "echo {{quote .Host}}"})
+	must(err, "Could not create renderer")
+	if req, _ := render("it's"); req.Cmd != `echo 'it'\''s'` {
+		t.Fatalf("Unexpected quoted command: %s", req.Cmd)
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Log shipping (-ship <url>): result of every host (with its output) and summary of every run are
+// sent to a central collector while the run goes on, so that operations started from laptops are
+// captured in central logging as well. Collectors are:
+//
+//	syslog://host[:514]         RFC 5424 messages over UDP, syslog+tcp://host[:601] over TCP
+//	fluent://host[:24224][/tag] Fluentd forward protocol ("gossha" is the default tag)
+//	http(s)://...               POST of newline-delimited JSON records
+//
+// Records are queued and sent in batches every second, the queue is flushed before reply to the
+// run is sent. Records are dropped (and reported) if collector cannot keep up, errors of sending
+// are reported but do not affect results.
+
+const (
+	shipQueueSize    = 10000           // records waiting to be sent
+	shipBatchSize    = 100             // records sent at once
+	shipInterval     = time.Second     // how often queued records are sent
+	shipFlushTimeout = 5 * time.Second // how long end of run waits for queued records to be sent
+	shipDialTimeout  = 5 * time.Second
+	maxShipOutput    = 64 << 10 // bytes of stdout and stderr of a host that are shipped
+)
+
+var (
+	shipSpec string      // -ship
+	shipper  *logShipper // nil if shipping is disabled
+
+	shipClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+type (
+	logShipper struct {
+		sink    shipSink
+		queue   chan *ShipRecord
+		flushes chan chan struct{}
+		dropped int64 // records dropped since the last flush (atomic)
+	}
+
+	// shipSink sends batch of records to collector
+	shipSink interface {
+		send(records []*ShipRecord) error
+	}
+
+	// ShipRecord is sent to collector for every host ("host" event) and every run ("run" event)
+	ShipRecord struct {
+		Time      string
+		Event     string // "host" or "run"
+		Run       string // identifies run, the same in all records of it
+		User      string
+		Client    string            `json:",omitempty"` // identity of HTTP API client that submitted request
+		Fields    map[string]string `json:",omitempty"` // AuditFields of request
+		Action    string
+		Operation string
+		Hostname  string  `json:",omitempty"` // only for "host" events
+		Success   bool    // for "run" events: all hosts succeeded
+		ExitCode  int     // only for "host" events
+		ErrMsg    string  `json:",omitempty"`
+		ErrorKind string  `json:",omitempty"`
+		Duration  float64 // time spent on host or duration of the whole run (in seconds)
+		Stdout    string  `json:",omitempty"`
+		Stderr    string  `json:",omitempty"`
+		Truncated bool    `json:",omitempty"` // output exceeded 64 KiB and was truncated
+
+		Summary *RunSummary `json:",omitempty"` // only for "run" events
+	}
+)
+
+// newLogShipper starts shipping to collector spec
+func newLogShipper(spec string) (*logShipper, error) {
+	sink, err := newShipSink(spec)
+	if err != nil {
+		return nil, errors.New("Invalid -ship collector: " + err.Error())
+	}
+
+	s := &logShipper{sink: sink, queue: make(chan *ShipRecord, shipQueueSize), flushes: make(chan chan struct{})}
+	go s.loop()
+	return s, nil
+}
+
+func newShipSink(spec string) (shipSink, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("no host in " + spec)
+	}
+
+	withPort := func(port string) string {
+		if u.Port() != "" {
+			return u.Host
+		}
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+
+	switch u.Scheme {
+	case "syslog":
+		return &syslogSink{network: "udp", addr: withPort("514")}, nil
+	case "syslog+tcp":
+		return &syslogSink{network: "tcp", addr: withPort("601")}, nil
+	case "fluent":
+		tag := strings.Trim(u.Path, "/")
+		if tag == "" {
+			tag = "gossha"
+		}
+		return &fluentSink{addr: withPort("24224"), tag: tag}, nil
+	case "http", "https":
+		return &httpSink{url: spec}, nil
+	}
+	return nil, errors.New("unsupported scheme " + u.Scheme + ", use syslog, syslog+tcp, fluent, http or https")
+}
+
+// add queues record, it is dropped if the queue is full
+func (s *logShipper) add(rec *ShipRecord) {
+	select {
+	case s.queue <- rec:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// flush waits until queued records are sent (or shipFlushTimeout passes)
+func (s *logShipper) flush() {
+	done := make(chan struct{})
+	select {
+	case s.flushes <- done:
+	case <-time.After(shipFlushTimeout):
+		return
+	}
+
+	select {
+	case <-done:
+	case <-time.After(shipFlushTimeout):
+	}
+
+	if n := atomic.SwapInt64(&s.dropped, 0); n > 0 {
+		reportErrorToUser(fmt.Sprintf("Log collector cannot keep up, %d records were not shipped", n))
+	}
+}
+
+func (s *logShipper) loop() {
+	ticker := time.NewTicker(shipInterval)
+	defer ticker.Stop()
+
+	var batch []*ShipRecord
+	failing := false // errors are reported once until sending succeeds again
+
+	send := func() {
+		for len(batch) > 0 {
+			n := len(batch)
+			if n > shipBatchSize {
+				n = shipBatchSize
+			}
+			if err := s.sink.send(batch[:n]); err != nil {
+				if !failing {
+					reportErrorToUser("Cannot ship logs: " + err.Error())
+				}
+				failing = true
+			} else {
+				failing = false
+			}
+			batch = batch[n:]
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case rec := <-s.queue:
+			if batch = append(batch, rec); len(batch) >= shipBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-s.flushes:
+			for len(s.queue) > 0 {
+				batch = append(batch, <-s.queue)
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+// recorder returns function that ships result of host for request msg of run, it is nil if shipping is disabled
+func (s *logShipper) recorder(msg *ProxyRequest, run string) func(res *SshResult, start time.Time) {
+	if s == nil {
+		return nil
+	}
+
+	render, _ := newHostRenderer(msg) // templates are already validated by getExecFunc
+	user := localUser()
+
+	return func(res *SshResult, start time.Time) {
+		rec := &ShipRecord{
+			Time:     start.Format(time.RFC3339Nano),
+			Event:    "host",
+			Run:      run,
+			User:     user,
+			Client:   msg.client,
+			Fields:   msg.AuditFields,
+			Action:   msg.Action,
+			Hostname: res.hostname,
+			Success:  res.err == nil,
+			ExitCode: exitCode(res.err),
+			Duration: res.duration.Seconds(),
+		}
+		if res.err != nil {
+			rec.ErrMsg = res.err.Error()
+			rec.ErrorKind = errorKind(res.err, msg.Action)
+		}
+
+		if req, err := render(res.hostname); err == nil {
+			rec.Operation = strings.TrimSuffix(describeAction(req), "\n")
+		} else {
+			rec.Operation = strings.TrimSuffix(describeAction(msg), "\n")
+		}
+
+		var cutOut, cutErr bool
+		rec.Stdout, cutOut = truncateShipOutput(res.stdout)
+		rec.Stderr, cutErr = truncateShipOutput(res.stderr)
+		rec.Truncated = cutOut || cutErr
+
+		s.add(rec)
+	}
+}
+
+// finishRun ships summary of run and waits until all records of it are sent
+func (s *logShipper) finishRun(msg *ProxyRequest, run string, summary *RunSummary, start time.Time) {
+	s.add(&ShipRecord{
+		Time:      start.Format(time.RFC3339Nano),
+		Event:     "run",
+		Run:       run,
+		User:      summary.User,
+		Client:    msg.client,
+		Fields:    msg.AuditFields,
+		Action:    summary.Action,
+		Operation: summary.Operation,
+		Success:   summary.Failed == 0 && !summary.Interrupted,
+		Duration:  summary.Duration,
+		Summary:   summary,
+	})
+	s.flush()
+}
+
+// newShipRunID returns identifier of run that started at start
+func newShipRunID(start time.Time) string {
+	return fmt.Sprintf("%d-%d", os.Getpid(), start.UnixNano())
+}
+
+func truncateShipOutput(s string) (string, bool) {
+	if len(s) <= maxShipOutput {
+		return s, false
+	}
+	return s[:maxShipOutput], true
+}
+
+// syslogSink sends records as RFC 5424 messages with JSON body, TCP messages are octet-counted (RFC 6587)
+type syslogSink struct {
+	network, addr string
+	conn          net.Conn
+}
+
+func (s *syslogSink) send(records []*ShipRecord) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.addr, shipDialTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+
+	for _, rec := range records {
+		body, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+
+		severity := 6 // informational
+		if !rec.Success {
+			severity = 4 // warning
+		}
+		// facility is local0
+		msg := fmt.Sprintf("<%d>1 %s %s gossha %d - - %s", 16*8+severity, time.Now().UTC().Format(time.RFC3339Nano), hostname, os.Getpid(), body)
+		if s.network == "tcp" {
+			msg = fmt.Sprintf("%d %s", len(msg), msg)
+		}
+
+		s.conn.SetWriteDeadline(time.Now().Add(shipDialTimeout))
+		if _, err := s.conn.Write([]byte(msg)); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// fluentSink sends records in Forward mode of Fluentd forward protocol: [tag, [[time, record], ...]]
+type fluentSink struct {
+	addr, tag string
+	conn      net.Conn
+}
+
+func (s *fluentSink) send(records []*ShipRecord) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.addr, shipDialTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	entries := make([]interface{}, 0, len(records))
+	for _, rec := range records {
+		fields, err := shipRecordFields(rec)
+		if err != nil {
+			return err
+		}
+		t, _ := time.Parse(time.RFC3339Nano, rec.Time)
+		entries = append(entries, []interface{}{t.Unix(), fields})
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(shipDialTimeout))
+	if _, err := s.conn.Write(appendMsgpack(nil, []interface{}{s.tag, entries})); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// shipRecordFields converts record to generic map with the same keys as in JSON
+func shipRecordFields(rec *ShipRecord) (map[string]interface{}, error) {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	return fields, dec.Decode(&fields)
+}
+
+// appendMsgpack appends MessagePack encoding of v, which consists of values produced by encoding/json with UseNumber
+func appendMsgpack(buf []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, 0xc0)
+	case bool:
+		if v {
+			return append(buf, 0xc3)
+		}
+		return append(buf, 0xc2)
+	case int64:
+		if v >= 0 && v < 128 {
+			return append(buf, byte(v))
+		}
+		return appendUint(append(buf, 0xd3), uint64(v), 8)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return appendMsgpack(buf, i)
+		}
+		f, _ := v.Float64()
+		return appendUint(append(buf, 0xcb), math.Float64bits(f), 8)
+	case string:
+		switch n := len(v); {
+		case n < 32:
+			buf = append(buf, 0xa0|byte(n))
+		case n < 1<<16:
+			buf = appendUint(append(buf, 0xda), uint64(n), 2)
+		default:
+			buf = appendUint(append(buf, 0xdb), uint64(n), 4)
+		}
+		return append(buf, v...)
+	case []interface{}:
+		buf = appendMsgpackHeader(buf, len(v), 0x90, 0xdc)
+		for _, el := range v {
+			buf = appendMsgpack(buf, el)
+		}
+		return buf
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		buf = appendMsgpackHeader(buf, len(v), 0x80, 0xde)
+		for _, k := range keys {
+			buf = appendMsgpack(appendMsgpack(buf, k), v[k])
+		}
+		return buf
+	}
+	return appendMsgpack(buf, fmt.Sprint(v))
+}
+
+// appendMsgpackHeader appends header of array or map with n elements, fix is the type byte of short ones
+func appendMsgpackHeader(buf []byte, n int, fix, long16 byte) []byte {
+	switch {
+	case n < 16:
+		return append(buf, fix|byte(n))
+	case n < 1<<16:
+		return appendUint(append(buf, long16), uint64(n), 2)
+	}
+	return appendUint(append(buf, long16+1), uint64(n), 4)
+}
+
+// appendUint appends size lowest bytes of v in big-endian order
+func appendUint(buf []byte, v uint64, size int) []byte {
+	for i := size - 1; i >= 0; i-- {
+		buf = append(buf, byte(v>>(8*uint(i))))
+	}
+	return buf
+}
+
+// httpSink POSTs records as newline-delimited JSON
+type httpSink struct {
+	url string
+}
+
+func (s *httpSink) send(records []*ShipRecord) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+
+	resp, err := shipClient.Post(s.url, "application/x-ndjson", &body)
+	if err != nil {
+		// URLs of collectors may contain secrets, so they are not included in errors
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return errors.New("collector returned " + resp.Status)
+	}
+	return nil
+}
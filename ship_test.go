@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestShipHTTP(t *testing.T) {
+	var mu sync.Mutex
+	var records []*ShipRecord
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dec := json.NewDecoder(r.Body)
+		for dec.More() {
+			rec := &ShipRecord{}
+			must(dec.Decode(rec), "Could not decode record")
+			mu.Lock()
+			records = append(records, rec)
+			mu.Unlock()
+		}
+	}))
+	defer collector.Close()
+
+	var err error
+	shipper, err = newLogShipper(collector.URL)
+	must(err, "Could not start shipper")
+	defer func() { shipper = nil }()
+
+	r := makeTestResult()
+	startTestServers(r, "test-ship", 2)
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "echo shipped", AuditFields: map[string]string{"ticket": "OPS-1"}})
+
+	// the run is replied to only after its records are sent
+	mu.Lock()
+	defer mu.Unlock()
+	if len(records) != 3 {
+		t.Fatalf("Expected 2 host records and a run record, got %d", len(records))
+	}
+
+	hosts := make(map[string]bool)
+	for _, rec := range records {
+		if rec.Run != records[0].Run || rec.Fields["ticket"] != "OPS-1" || !rec.Success {
+			t.Fatalf("Unexpected record %+v", rec)
+		}
+		switch rec.Event {
+		case "host":
+			if !strings.Contains(rec.Stdout, "shipped") || rec.Operation != "Run: echo shipped" {
+				t.Fatalf("Expected output and operation of host, got %+v", rec)
+			}
+			hosts[rec.Hostname] = true
+		case "run":
+			if rec.Summary == nil || rec.Summary.Hosts != 2 || rec.Summary.Succeeded != 2 {
+				t.Fatalf("Expected summary of run, got %+v", rec.Summary)
+			}
+		}
+	}
+	for addr := range r.hosts {
+		if !hosts[addr] {
+			t.Fatalf("No record for %s in %+v", addr, records)
+		}
+	}
+}
+
+func TestShipSyslog(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	must(err, "Could not listen")
+	defer ln.Close()
+
+	sink, err := newShipSink("syslog+tcp://" + ln.Addr().String())
+	must(err, "Could not create sink")
+
+	go func() {
+		must(sink.send([]*ShipRecord{{Event: "host", Hostname: "web1", Success: true}, {Event: "run", Success: false}}), "Could not send")
+	}()
+
+	conn, err := ln.Accept()
+	must(err, "Could not accept")
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+
+	for _, want := range []string{`<134>1 `, `<132>1 `} {
+		prefix, err := rd.ReadString(' ')
+		must(err, "Could not read length")
+		n, err := strconv.Atoi(strings.TrimSpace(prefix))
+		must(err, "Invalid octet count "+prefix)
+
+		buf := make([]byte, n)
+		_, err = io.ReadFull(rd, buf)
+		must(err, "Could not read message")
+		msg := string(buf)
+		if !strings.HasPrefix(msg, want) || !strings.Contains(msg, " gossha ") || !strings.HasSuffix(msg, "}") {
+			t.Fatalf("Unexpected syslog message %q", msg)
+		}
+	}
+}
+
+func TestMsgpack(t *testing.T) {
+	got := hex.EncodeToString(appendMsgpack(nil, []interface{}{"tag", []interface{}{int64(300), map[string]interface{}{
+		"b": json.Number("-1"),
+		"a": true,
+		"c": json.Number("1.5"),
+		"d": nil,
+	}}}))
+	want := "92a3746167" + "92" + "d3000000000000012c" + "84" + "a161c3" + "a162d3ffffffffffffffff" + "a163cb3ff8000000000000" + "a164c0"
+	if got != want {
+		t.Fatalf("Expected %s, got %s", want, got)
+	}
+
+	if _, err := newShipSink("ftp://collector"); err == nil {
+		t.Fatalf("Unsupported scheme must be rejected")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Environment snapshots ("Snapshot": ["<cmd>", ...] or -snapshot "cmd1;cmd2"): capture commands
+// (e.g. "ip route", "systemctl list-units", "sha256sum /etc/app/*") are run on every host right
+// before the action and again right after it, with the same shell, Sudo and RunAs settings, and
+// their outputs are written to "<SnapshotDir>/<time of run>/<host>.json" as before/after evidence of
+// the change. Reply has "Snapshot" with path of the bundle and "SnapshotChanged" with commands which
+// output or exit status differ. Capture commands may fail, their status is recorded, but host fails
+// without running the action if the "pre" snapshot cannot be taken at all. Hosts skipped by OnlyIf
+// have no snapshot.
+
+const defaultSnapshotDir = "snapshots"
+
+var (
+	snapshotDefault    string               // -snapshot
+	snapshotDirDefault = defaultSnapshotDir // -snapshot-dir
+)
+
+// SnapshotBundle is file with outputs of capture commands on host before and after action
+type SnapshotBundle struct {
+	Hostname string
+	Action   string
+	Cmd      string `json:",omitempty"` // command of the action (only for Action == "ssh")
+	Started  time.Time
+	Finished time.Time
+	Success  bool   // action succeeded
+	ErrMsg   string `json:",omitempty"`
+	Commands []*SnapshotCommand
+}
+
+// SnapshotCommand is capture command with its results before and after action
+type SnapshotCommand struct {
+	Cmd     string
+	Pre     *CommandResult
+	Post    *CommandResult `json:",omitempty"` // missing if snapshot after action could not be taken
+	Changed bool           // output or exit status is different after action
+}
+
+// requestSnapshot returns capture commands of msg
+func requestSnapshot(msg *ProxyRequest) []string {
+	if len(msg.Snapshot) > 0 {
+		return msg.Snapshot
+	}
+	var cmds []string
+	for _, cmd := range strings.Split(snapshotDefault, ";") {
+		if cmd = strings.TrimSpace(cmd); cmd != "" {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds
+}
+
+// withSnapshot runs capture commands of msg on every host before and after execFunc and writes bundle with their outputs
+func withSnapshot(msg *ProxyRequest, execFunc func(string) *SshResult) (func(string) *SshResult, error) {
+	cmds := requestSnapshot(msg)
+	if len(cmds) == 0 || dryRun {
+		return execFunc, nil
+	}
+
+	opts, err := parseCmdOptions(msg)
+	if err != nil {
+		return nil, err
+	}
+	opts.stdin, opts.stream, opts.streamOnly, opts.record, opts.pty = nil, false, false, nil, false
+
+	dir := msg.SnapshotDir
+	if dir == "" {
+		dir = snapshotDirDefault
+	}
+	dir = filepath.Join(dir, time.Now().Format("20060102-150405"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.New("Cannot create snapshot directory: " + err.Error())
+	}
+
+	return func(hostname string) *SshResult {
+		name := downloadDirName(hostname)
+		if !isSafeLocalName(name) {
+			return &SshResult{hostname: hostname, err: errors.New("Refusing to write snapshot of " + hostname + " to unsafe local path")}
+		}
+
+		bundle := &SnapshotBundle{Hostname: hostname, Action: msg.Action, Started: time.Now()}
+		if msg.Action == "ssh" {
+			bundle.Cmd = msg.Cmd
+		}
+		pre, err := takeSnapshot(cmds, opts, hostname)
+		if err != nil {
+			return &SshResult{hostname: hostname, err: errors.New("Cannot take snapshot before action: " + err.Error())}
+		}
+
+		res := execFunc(hostname)
+		var retryable *retryableError
+		if errors.As(res.err, &retryable) || res.skipped {
+			return res // action is retried with a new snapshot
+		}
+
+		post, postErr := takeSnapshot(cmds, opts, hostname)
+		bundle.Finished, bundle.Success = time.Now(), res.err == nil
+		if res.err != nil {
+			bundle.ErrMsg = res.err.Error()
+		}
+		for i, r := range pre {
+			c := &SnapshotCommand{Cmd: r.Cmd, Pre: r}
+			if i < len(post) {
+				c.Post = post[i]
+				c.Changed = r.Stdout != c.Post.Stdout || r.ExitCode != c.Post.ExitCode
+			}
+			if c.Changed || c.Post == nil {
+				res.snapshotChanged = append(res.snapshotChanged, c.Cmd)
+			}
+			bundle.Commands = append(bundle.Commands, c)
+		}
+
+		file := filepath.Join(dir, name+".json")
+		data, _ := json.MarshalIndent(bundle, "", "  ")
+		if err := ioutil.WriteFile(file, append(data, '\n'), 0644); err != nil {
+			postErr = errors.New("Cannot write snapshot: " + err.Error())
+		} else {
+			res.snapshot = file
+		}
+		if postErr != nil {
+			logf(logInfo, hostname, "Snapshot after action failed: %s", postErr)
+			if res.err == nil {
+				res.err = errors.New("Cannot take snapshot after action: " + postErr.Error())
+			}
+		}
+		return res
+	}, nil
+}
+
+// takeSnapshot runs capture commands on hostname; error is returned if a command could not be run at all
+func takeSnapshot(cmds []string, opts *cmdOptions, hostname string) ([]*CommandResult, error) {
+	var res []*CommandResult
+	for _, cmd := range cmds {
+		stdout, stderr, err := executeCmd(cmd, opts.forHost(), hostname)
+		r := &CommandResult{Cmd: cmd, Stdout: stdout, Stderr: stderr, Success: err == nil, ExitCode: exitCode(err)}
+		if err != nil {
+			r.ErrMsg, r.ErrorKind = err.Error(), errorKind(err, "ssh")
+			var exitErr *ssh.ExitError
+			if !errors.As(err, &exitErr) {
+				return res, err
+			}
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// formatSnapshot returns human-readable description of snapshot of reply
+func formatSnapshot(reply *Reply) string {
+	if len(reply.SnapshotChanged) == 0 {
+		return "snapshot " + reply.Snapshot + ": no changes"
+	}
+	return "snapshot " + reply.Snapshot + ": changed " + strings.Join(reply.SnapshotChanged, ", ")
+}
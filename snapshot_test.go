@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossha-snapshot")
+	must(err, "Could not create snapshot dir")
+	defer os.RemoveAll(dir)
+
+	r := makeTestResult()
+	startTestServers(r, "test-snapshot", 2)
+	for _, srv := range r.hosts {
+		must(ioutil.WriteFile(filepath.Join(srv.root, "state"), []byte("old\n"), 0644), "Could not write state")
+	}
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "echo new > state", Snapshot: []string{"cat state", "echo static", "exit 2"}, SnapshotDir: dir})
+
+	for addr, reply := range r.replies {
+		if !reply.Success || !reflect.DeepEqual(reply.SnapshotChanged, []string{"cat state"}) {
+			t.Fatalf("Unexpected reply of %s: %+v", addr, reply)
+		}
+		data, err := ioutil.ReadFile(reply.Snapshot)
+		if err != nil {
+			t.Fatalf("Cannot read snapshot of %s: %v", addr, err)
+		}
+		var bundle SnapshotBundle
+		must(json.Unmarshal(data, &bundle), "Could not parse snapshot")
+
+		if len(bundle.Commands) != 3 || !bundle.Success || bundle.Cmd != "echo new > state" {
+			t.Fatalf("Unexpected snapshot of %s: %s", addr, data)
+		}
+		if c := bundle.Commands[0]; c.Pre.Stdout != "old\n" || c.Post.Stdout != "new\n" || !c.Changed {
+			t.Fatalf("Unexpected capture of state on %s: %+v %+v", addr, c.Pre, c.Post)
+		}
+		if c := bundle.Commands[2]; c.Pre.Success || c.Pre.ExitCode != 2 || c.Changed {
+			t.Fatalf("Failed capture command must be recorded on %s: %+v", addr, c)
+		}
+	}
+
+	defer func(def string) { snapshotDefault = def }(snapshotDefault)
+	snapshotDefault = "uname -a; df -h ;;"
+	if cmds := requestSnapshot(&ProxyRequest{}); !reflect.DeepEqual(cmds, []string{"uname -a", "df -h"}) {
+		t.Fatalf("Unexpected commands of -snapshot: %q", cmds)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Spilling results to disk (-spill-dir <dir>): replies that are held until the action finishes
+// ("Sort", "GroupOutput" and "Diff") keep outputs of all hosts in memory, which does not scale to
+// fleets of thousands of hosts. With -spill-dir, outputs of held replies (stdout and stderr of host,
+// of "Commands" and of "FollowUp") of at least spillMinSize bytes are written to a temporary file in
+// the directory as replies arrive, and are read back one reply at a time when replies are sent, so
+// that only small per-host results stay in memory. Identical outputs are written once and replies
+// are grouped by SHA-256 of their outputs. The file is removed when the action finishes.
+
+const spillMinSize = 1024 // shorter outputs are kept in memory
+
+var spillDir string // -spill-dir
+
+type (
+	// spillFile is temporary file that outputs of replies of an action are written to
+	spillFile struct {
+		mu     sync.Mutex
+		f      *os.File
+		size   int64
+		stored map[[sha256.Size]byte]spillRef // identical outputs are written once
+		failed bool                           // write failed and was reported, outputs are kept in memory since then
+	}
+
+	// spillRef is location of output in spill file
+	spillRef struct {
+		off, n int64
+		sum    [sha256.Size]byte
+	}
+
+	// spilledOutput tells which outputs of reply are in spill file, by index in spillFields
+	spilledOutput struct {
+		file *spillFile
+		refs map[int]spillRef
+		key  string // digests of outputs, replies with the same key have identical outputs
+	}
+)
+
+// newSpillFile creates spill file in dir
+func newSpillFile(dir string) (*spillFile, error) {
+	f, err := ioutil.TempFile(dir, "gossha-spill-")
+	if err != nil {
+		return nil, errors.New("Cannot create spill file: " + err.Error())
+	}
+	return &spillFile{f: f, stored: make(map[[sha256.Size]byte]spillRef)}, nil
+}
+
+// Close removes spill file, nil s is ignored
+func (s *spillFile) Close() {
+	if s == nil {
+		return
+	}
+	s.f.Close()
+	os.Remove(s.f.Name())
+}
+
+// spillFields returns outputs of r that can be spilled
+func spillFields(r *Reply) []*string {
+	fields := []*string{&r.Stdout, &r.Stderr}
+	for _, c := range r.Commands {
+		fields = append(fields, &c.Stdout, &c.Stderr)
+	}
+	if r.FollowUp != nil {
+		fields = append(fields, &r.FollowUp.Stdout, &r.FollowUp.Stderr)
+	}
+	return fields
+}
+
+// store moves long outputs of r to spill file, nil s keeps them in memory
+func (s *spillFile) store(r *Reply) {
+	if s == nil {
+		return
+	}
+	long := false
+	for _, p := range spillFields(r) {
+		long = long || len(*p) >= spillMinSize
+	}
+	if !long {
+		return
+	}
+
+	// results of commands can be shared with cached results, so they are copied before outputs are cleared
+	cmds := make([]*CommandResult, len(r.Commands))
+	for i, c := range r.Commands {
+		copied := *c
+		cmds[i] = &copied
+	}
+	r.Commands = cmds
+	if r.FollowUp != nil {
+		followUp := *r.FollowUp
+		r.FollowUp = &followUp
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed {
+		return
+	}
+
+	o := &spilledOutput{file: s, refs: make(map[int]spillRef)}
+	for i, p := range spillFields(r) {
+		if len(*p) < spillMinSize {
+			continue
+		}
+		ref, err := s.write(*p)
+		if err != nil {
+			s.failed = true
+			reportErrorToUser("Cannot spill output to disk, it is kept in memory: " + err.Error())
+			break
+		}
+		o.refs[i], *p = ref, ""
+	}
+	if len(o.refs) == 0 {
+		return
+	}
+
+	idx := make([]int, 0, len(o.refs))
+	for i := range o.refs {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+	var key strings.Builder
+	for _, i := range idx {
+		fmt.Fprintf(&key, "%d:%x ", i, o.refs[i].sum)
+	}
+	o.key = key.String()
+	r.spilled = o
+}
+
+// write appends data to spill file unless it is already there, s.mu must be held
+func (s *spillFile) write(data string) (spillRef, error) {
+	sum := sha256.Sum256([]byte(data))
+	if ref, ok := s.stored[sum]; ok {
+		return ref, nil
+	}
+	n, err := s.f.WriteString(data)
+	if err != nil {
+		return spillRef{}, err
+	}
+	ref := spillRef{off: s.size, n: int64(n), sum: sum}
+	s.size += int64(n)
+	s.stored[sum] = ref
+	return ref, nil
+}
+
+// unspill reads spilled outputs of r back
+func (r *Reply) unspill() {
+	o := r.spilled
+	if o == nil {
+		return
+	}
+	fields := spillFields(r)
+	for i, ref := range o.refs {
+		buf := make([]byte, ref.n)
+		if _, err := o.file.f.ReadAt(buf, ref.off); err != nil {
+			reportErrorToUser("Cannot read spilled output of " + r.Hostname + ": " + err.Error())
+			continue
+		}
+		*fields[i] = string(buf)
+	}
+}
+
+// dropSpilled clears outputs of r that were read back with unspill, they stay in spill file
+func (r *Reply) dropSpilled() {
+	o := r.spilled
+	if o == nil {
+		return
+	}
+	fields := spillFields(r)
+	for i := range o.refs {
+		*fields[i] = ""
+	}
+}
+
+// unspill reads spilled outputs of the reply that g was made of
+func (g *GroupedReply) unspill() {
+	if r := g.source; r != nil {
+		r.unspill()
+		g.Stdout, g.Stderr, g.FollowUp = r.Stdout, r.Stderr, r.FollowUp
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpillFile(t *testing.T) {
+	s, err := newSpillFile(t.TempDir())
+	if err != nil {
+		t.Fatalf("Cannot create spill file: %s", err.Error())
+	}
+	defer s.Close()
+
+	long := strings.Repeat("x", spillMinSize)
+	cmd := &CommandResult{Cmd: "a", Stdout: long}
+	replies := []*Reply{
+		{Hostname: "a", Stdout: long, Stderr: "short", Commands: []*CommandResult{cmd}},
+		{Hostname: "b", Stdout: long, Stderr: "short"},
+	}
+	for _, r := range replies {
+		s.store(r)
+	}
+
+	if replies[0].Stdout != "" || replies[0].Stderr != "short" || replies[0].Commands[0].Stdout != "" {
+		t.Fatalf("Long outputs must be spilled: %+v", replies[0])
+	}
+	if cmd.Stdout != long {
+		t.Fatalf("Spilled command results must be copies")
+	}
+	if s.size != int64(len(long)) {
+		t.Fatalf("Identical outputs must be written once, spill file has %d bytes", s.size)
+	}
+	if replies[0].spilled.key == replies[1].spilled.key {
+		t.Fatalf("Replies with different outputs must have different keys")
+	}
+
+	replies[0].unspill()
+	if replies[0].Stdout != long || replies[0].Commands[0].Stdout != long {
+		t.Fatalf("Spilled outputs must be read back: %+v", replies[0])
+	}
+}
+
+func TestSpillReplies(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-spill", 3)
+
+	spillDir = t.TempDir()
+	defer func() { spillDir = "" }()
+
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = "head -c 2000 /dev/zero | tr '\\0' x"
+	for addr := range r.hosts {
+		req.Hosts = append(req.Hosts, addr)
+	}
+	req.GroupOutput = true
+	requestsChan <- req
+
+	var groups []*GroupedReply
+	for done := false; !done; {
+		select {
+		case reply := <-repliesChan:
+			switch reply := reply.(type) {
+			case *GroupedReply:
+				groups = append(groups, reply)
+			case *FinalReply:
+				done = true
+			}
+		case <-time.After(maxTimeout):
+			t.Fatalf("Timed out waiting for grouped replies")
+		}
+	}
+	if len(groups) != 1 || len(groups[0].Hosts) != 3 || groups[0].Stdout != strings.Repeat("x", 2000) {
+		t.Fatalf("Unexpected grouped replies: %+v", groups)
+	}
+
+	req.Hosts, req.GroupOutput, req.Sort = nil, false, "name"
+	sendTestRequest(t, r, req)
+	for addr, reply := range r.replies {
+		if !reply.Success || reply.Stdout != strings.Repeat("x", 2000) {
+			t.Fatalf("Unexpected reply for %s: %+v", addr, reply)
+		}
+	}
+
+	if files, _ := ioutil.ReadDir(spillDir); len(files) != 0 {
+		t.Fatalf("Spill file must be removed after action")
+	}
+}
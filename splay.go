@@ -0,0 +1,33 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Splay ("Splay": <milliseconds> or -splay <duration>): action is started on every host after a
+// random delay within the window, e.g. -splay 30s, so that cron-like runs on the whole fleet (cache
+// refreshes, package updates) do not hit shared backends at the same moment. Delay is chosen once
+// per host and is not repeated for retries. Hosts wait in their connection slot, so with -m the
+// run takes up to splay multiplied by number of hosts divided by -m. Default "Timeout" of request is
+// extended by the splay, and hosts that are still waiting when the action times out or is
+// interrupted are not started.
+
+var splayDefault time.Duration // -splay
+
+// requestSplay returns splay window of msg, 0 if hosts are started right away
+func requestSplay(msg *ProxyRequest) time.Duration {
+	if msg.Splay > 0 {
+		return time.Duration(msg.Splay) * time.Millisecond
+	}
+	return splayDefault
+}
+
+// splayDelay returns random delay before action of msg is started on a host
+func splayDelay(msg *ProxyRequest) time.Duration {
+	splay := requestSplay(msg)
+	if splay <= 0 || dryRun {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(splay)))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSplay(t *testing.T) {
+	msg := &ProxyRequest{Splay: 200}
+	for i := 0; i < 100; i++ {
+		if d := splayDelay(msg); d < 0 || d >= 200*time.Millisecond {
+			t.Fatalf("Delay %s is out of splay window", d)
+		}
+	}
+	if d := splayDelay(&ProxyRequest{}); d != 0 {
+		t.Fatalf("Expected no delay without splay, got %s", d)
+	}
+
+	r := makeTestResult()
+	startTestServers(r, "test-splay", 3)
+	runTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "hostname", Splay: 200})
+	checkSuccess(t, r)
+
+	// hosts that are still waiting when request times out are not started
+	r = makeTestResult()
+	startTestServers(r, "test-splay-timeout", 2)
+	req := &ProxyRequest{Action: "ssh", Cmd: "touch started", Splay: uint64(time.Hour / time.Millisecond), Timeout: 300}
+	for addr := range r.hosts {
+		r.hostsLeft[addr] = struct{}{}
+		req.Hosts = append(req.Hosts, addr)
+	}
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+
+	if len(r.final.TimedOutHosts) != 2 {
+		t.Fatalf("Expected all hosts to time out, got %+v", r.final)
+	}
+	for addr, srv := range r.hosts {
+		if _, err := os.Stat(filepath.Join(srv.root, "started")); err == nil {
+			t.Fatalf("Command was started on %s after timeout", addr)
+		}
+	}
+}
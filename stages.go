@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+// Ordered execution ("Stages": "<name>"): "stages" section of configuration file names sequences
+// of inventory groups, e.g. "restart: [db, app, lb]". Action is run on hosts of the first group,
+// next group is only started after the previous one succeeded (see MaxFailPercentage), hosts of
+// groups that are not started are reported in SkippedHosts. Host that is in several groups runs with
+// the first of them. Serial splits every stage into batches.
+
+var configStages map[string][]string // sequences of groups from "stages" section of configuration file
+
+// initStages checks that groups of stages from configuration exist
+func initStages(conf *gosshaConfig) error {
+	names := make([]string, 0, len(conf.stages))
+	for name := range conf.stages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, g := range conf.stages[name] {
+			if hostInventory == nil || g != "all" && hostInventory.groups[g] == nil {
+				return errors.New("Unknown group " + g + " in stages " + name + " of config")
+			}
+		}
+	}
+
+	configStages = conf.stages
+	return nil
+}
+
+// stageGroups returns groups of stages of msg, nil if it does not use stages
+func stageGroups(msg *ProxyRequest) ([]string, error) {
+	if msg.Stages == "" {
+		return nil, nil
+	}
+
+	groups, ok := configStages[msg.Stages]
+	if !ok {
+		return nil, errors.New("Unknown stages " + msg.Stages + ", they must be defined in \"stages\" section of config")
+	}
+	if len(msg.Hosts) > 0 || len(msg.Groups) > 0 || len(msg.Discover) > 0 {
+		return nil, errors.New("Stages cannot be combined with Hosts, Groups or Discover")
+	}
+	return groups, nil
+}
+
+// stageBatches splits hosts into batches of stage groups in order (see splitBatches)
+func stageBatches(groups []string, hosts []string, serial string) ([][]string, error) {
+	left := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		left[h] = true
+	}
+
+	var batches [][]string
+	for _, g := range groups {
+		groupHosts, err := inventoryHosts([]string{g})
+		if err != nil {
+			return nil, err
+		}
+		expanded, err := expandHosts(groupHosts)
+		if err != nil {
+			return nil, err
+		}
+
+		var stage []string
+		for _, h := range expanded {
+			if left[h] {
+				stage = append(stage, h)
+				delete(left, h)
+			}
+		}
+		if len(stage) == 0 {
+			continue
+		}
+
+		b, err := splitBatches(stage, serial)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, b...)
+	}
+
+	if len(batches) == 0 {
+		return [][]string{nil}, nil
+	}
+	return batches, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestStages(t *testing.T) {
+	inv := newInventory()
+	inv.group("all")
+	var db, app []string
+	for i := 0; i < 4; i++ {
+		srv := &testSSHServer{hostname: fmt.Sprintf("test-stages-%d", i)}
+		srv.start()
+
+		group := "app"
+		if i == 0 {
+			group = "db"
+			db = append(db, srv.addr)
+		} else {
+			app = append(app, srv.addr)
+		}
+		must(inv.addHost(group, srv.addr, nil), "Could not add host")
+	}
+	must(inv.addHost("app", db[0], nil), "Could not add host") // runs with db stage only
+	inv.resolveVars()
+
+	hostInventory = inv
+	defer func() { hostInventory, configStages = nil, nil }()
+	must(initStages(&gosshaConfig{stages: map[string][]string{"restart": {"db", "app"}}}), "Could not init stages")
+
+	run := func(cmd string) (replied, skipped []string) {
+		req := makeProxyRequest(maxTimeout)
+		req.Cmd = cmd
+		req.Stages = "restart"
+		requestsChan <- req
+
+		timeout := time.After(maxTimeout)
+		for {
+			select {
+			case reply := <-repliesChan:
+				switch reply := reply.(type) {
+				case *Reply:
+					replied = append(replied, reply.Hostname)
+				case *FinalReply:
+					return replied, reply.SkippedHosts
+				}
+			case <-timeout:
+				t.Fatalf("Timed out")
+			}
+		}
+	}
+
+	replied, skipped := run("true")
+	if len(replied) != 4 || replied[0] != db[0] || len(skipped) != 0 {
+		t.Fatalf("Hosts of db must run first and only once, replied: %v, skipped: %v", replied, skipped)
+	}
+
+	replied, skipped = run(`[ "$TEST_HOSTNAME" != test-stages-0 ]`)
+	sort.Strings(skipped)
+	sort.Strings(app)
+	if !reflect.DeepEqual(replied, db) || !reflect.DeepEqual(skipped, app) {
+		t.Fatalf("Next stage must not start after failure, replied: %v, skipped: %v", replied, skipped)
+	}
+
+	if err := initStages(&gosshaConfig{stages: map[string][]string{"restart": {"db", "web"}}}); err == nil {
+		t.Fatalf("Unknown groups of stages must be rejected")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Run statistics: FinalReply of every action has "Stats" with numbers of hosts by outcome, the slowest
+// host and bytes that were sent to and received from hosts over SSH connections while action was
+// running (traffic of other actions on the same hosts is counted as well if they run concurrently):
+//
+//	{"Hosts":10,"Succeeded":8,"Failed":1,"TimedOut":1,"SlowestHost":"web3","SlowestTime":12.3,"BytesSent":1048576,"BytesReceived":4096}
+//
+// Text output ends with the same statistics in one line (notifications have their own RunSummary).
+
+type (
+	// RunStats are aggregate statistics of action
+	RunStats struct {
+		Hosts         int
+		Succeeded     int
+		Failed        int
+		TimedOut      int
+		Pending       int     `json:",omitempty"` // hosts that were running when action was cancelled
+		Skipped       int     `json:",omitempty"` // hosts where action was not started
+		SlowestHost   string  `json:",omitempty"`
+		SlowestTime   float64 `json:",omitempty"` // duration of action on SlowestHost in seconds
+		BytesSent     int64
+		BytesReceived int64
+	}
+
+	// hostTraffic counts bytes of all connections to a host
+	hostTraffic struct {
+		sent, received int64
+	}
+
+	// countedConn is a connection which traffic is added to counters of its host
+	countedConn struct {
+		net.Conn
+		traffic *hostTraffic
+	}
+)
+
+var hostTrafficCounters sync.Map // hostname => *hostTraffic
+
+func trafficOf(hostname string) *hostTraffic {
+	t, _ := hostTrafficCounters.LoadOrStore(hostname, &hostTraffic{})
+	return t.(*hostTraffic)
+}
+
+// countTraffic returns conn that adds bytes it transfers to counters of hostname
+func countTraffic(hostname string, conn net.Conn) net.Conn {
+	return &countedConn{Conn: conn, traffic: trafficOf(hostname)}
+}
+
+func (c *countedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.traffic.received, int64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.traffic.sent, int64(n))
+	return n, err
+}
+
+// trafficSnapshot returns current counters of hosts, to compute traffic of action with trafficSince
+func trafficSnapshot(hosts []string) map[string]hostTraffic {
+	res := make(map[string]hostTraffic, len(hosts))
+	for _, h := range hosts {
+		t := trafficOf(h)
+		res[h] = hostTraffic{sent: atomic.LoadInt64(&t.sent), received: atomic.LoadInt64(&t.received)}
+	}
+	return res
+}
+
+// trafficSince returns bytes sent and received by hosts of snapshot after it was taken
+func trafficSince(snapshot map[string]hostTraffic) (sent, received int64) {
+	for h, before := range snapshot {
+		t := trafficOf(h)
+		sent += atomic.LoadInt64(&t.sent) - before.sent
+		received += atomic.LoadInt64(&t.received) - before.received
+	}
+	return
+}
+
+// formatBytes formats n with binary unit, e.g. "1.5 MiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatRunStats returns summary in one line for text output
+func formatRunStats(s *RunStats) string {
+	res := fmt.Sprintf("%d host(s): %d ok, %d failed", s.Hosts, s.Succeeded, s.Failed)
+	if s.TimedOut > 0 {
+		res += fmt.Sprintf(", %d timed out", s.TimedOut)
+	}
+	if s.Pending > 0 {
+		res += fmt.Sprintf(", %d pending", s.Pending)
+	}
+	if s.Skipped > 0 {
+		res += fmt.Sprintf(", %d skipped", s.Skipped)
+	}
+	if s.SlowestHost != "" {
+		res += fmt.Sprintf("; slowest %s (%s)", s.SlowestHost, time.Duration(s.SlowestTime*float64(time.Second)).Round(10*time.Millisecond))
+	}
+	return res + fmt.Sprintf("; sent %s, received %s", formatBytes(s.BytesSent), formatBytes(s.BytesReceived))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunStats(t *testing.T) {
+	r := makeTestResult()
+	for _, srv := range []*testSSHServer{{hostname: "test-stats-0"}, {hostname: "test-stats-1", exitStatus: 1}, {hostname: "test-stats-2"}} {
+		srv.start()
+		r.hosts[srv.addr] = srv
+	}
+
+	sendTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "hostname"})
+	s := r.final.Stats
+	if s == nil || s.Hosts != 3 || s.Succeeded != 2 || s.Failed != 1 || s.TimedOut != 0 || s.SlowestHost == "" {
+		t.Fatalf("Unexpected statistics of command: %+v", s)
+	}
+
+	r.replies = make(map[string]*Reply)
+	sendTestRequest(t, r, &ProxyRequest{Action: "scp", Source: dataSource, Data: bytes.Repeat([]byte("x"), 100000), Target: "stats.bin"})
+	if s = r.final.Stats; s.Succeeded != 3 || s.BytesSent < 3*100000 || s.BytesReceived == 0 {
+		t.Fatalf("Traffic of upload was not counted: %+v", s)
+	}
+}
+
+func TestFormatRunStats(t *testing.T) {
+	got := formatRunStats(&RunStats{Hosts: 10, Succeeded: 8, Failed: 1, TimedOut: 1, SlowestHost: "web3", SlowestTime: 12.304, BytesSent: 1536 << 10, BytesReceived: 100})
+	if want := "10 host(s): 8 ok, 1 failed, 1 timed out; slowest web3 (12.3s); sent 1.5 MiB, received 100 B"; got != want {
+		t.Fatalf("Unexpected statistics line %q, expected %q", got, want)
+	}
+	if !strings.Contains(formatRunStats(&RunStats{Hosts: 2, Pending: 1, Skipped: 1}), "1 pending, 1 skipped") {
+		t.Fatalf("Pending and skipped hosts must be listed")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "bytes"
+
+const outputChunkSize = 32768 // incomplete lines longer than that are sent in pieces
+
+// outputStreamer sends output written to it as OutputChunk replies; complete lines are sent
+// right away and incomplete line is kept until it is completed or Flush is called
+type outputStreamer struct {
+	hostname string
+	stream   string
+	decoder  *outputDecoder   // converts output to UTF-8, nil if it is sent as is
+	conv     *streamConverter // decoder of this stream, nil if output is in UTF-8
+	buf      []byte
+}
+
+func (s *outputStreamer) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+
+	end := bytes.LastIndexByte(s.buf, '\n') + 1
+	if len(s.buf) >= outputChunkSize {
+		end = len(s.buf)
+	}
+
+	if end > 0 {
+		s.send(s.buf[:end], false)
+		s.buf = append(s.buf[:0], s.buf[end:]...)
+	}
+
+	return len(p), nil
+}
+
+// Flush sends the rest of output
+func (s *outputStreamer) Flush() {
+	if len(s.buf) > 0 || s.conv != nil && len(s.conv.rest) > 0 {
+		s.send(s.buf, true)
+		s.buf = nil
+	}
+}
+
+// send sends data as OutputChunk, atEOF tells that no output follows it
+func (s *outputStreamer) send(data []byte, atEOF bool) {
+	text := string(data)
+	if s.conv != nil {
+		text = s.conv.convert(data, atEOF)
+	}
+	if text != "" {
+		sendProxyReply(&OutputChunk{Hostname: s.hostname, Stream: s.stream, Data: s.decoder.strip(text)})
+	}
+}
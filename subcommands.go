@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Subcommands ("gossha <subcommand> [flags] ..."): exec, put and get run a single action from the
+// command line and print replies as text, like "-output text" does; all flags of proxy mode can be
+// used with them. Target of put is rendered for every host if it has placeholders, e.g.
+// "/etc/app/{{.Host}}/config.yml". GoSSHa started through a symlink named mssh or mscp works as "gossha exec" or
+// "gossha put" for compatibility with scripts that call these tools.
+
+var subcommands = map[string]func([]string) int{
+	"exec":      execMain,
+	"put":       putMain,
+	"get":       getMain,
+	"ping":      pingMain,
+	"reboot":    rebootMain,
+	"service":   serviceMain,
+	"pkg":       pkgMain,
+	"tail":      tailMain,
+	"cssh":      csshMain,
+	"replay":    replayMain,
+	"history":   historyMain,
+	"show":      showMain,
+	"diff-runs": diffRunsMain,
+	"status":    statusMain,
+	"forget":    forgetMain,
+}
+
+// subcommandAliases are names of symlinks to GoSSHa that start subcommands
+var subcommandAliases = map[string]string{
+	"mssh": "exec",
+	"mscp": "put",
+}
+
+type actionDone struct{ status int } // sent by actionMain after action finished
+
+// subcommandOf returns subcommand that args (os.Args) start and its arguments, nil for proxy mode
+func subcommandOf(args []string) (func([]string) int, []string) {
+	name := strings.TrimSuffix(filepath.Base(args[0]), ".exe")
+	if alias, ok := subcommandAliases[name]; ok {
+		return subcommands[alias], args[1:]
+	}
+
+	if len(args) > 1 {
+		if run, ok := subcommands[args[1]]; ok {
+			return run, args[2:]
+		}
+	}
+	return nil, nil
+}
+
+func execMain(args []string) int {
+	var serial, commandsFile string
+	var pty bool
+
+	os.Args = append([]string{os.Args[0]}, args...)
+	flag.StringVar(&serial, "serial", "", "Run command on N hosts (or N% of hosts) at a time")
+	flag.BoolVar(&pty, "pty", false, "Allocate pseudo-terminal for command")
+	flag.StringVar(&commandsFile, "commands-file", "", "Run commands of runbook file one after another instead of <command>")
+
+	minArgs := func() int {
+		if commandsFile != "" {
+			return 0
+		}
+		return 1
+	}
+	return actionMain("exec [flags] <command> host1 ... hostN\n       gossha exec [flags] -commands-file <runbook> host1 ... hostN", minArgs, func(args []string) *ProxyRequest {
+		if commandsFile != "" {
+			cmds, timeouts, err := loadRunbook(commandsFile)
+			if err != nil {
+				reportCriticalErrorToUser(err.Error())
+				return nil
+			}
+			return &ProxyRequest{Action: "ssh", Cmds: cmds, CmdTimeouts: timeouts, Hosts: args, Serial: serial, Pty: pty}
+		}
+		return &ProxyRequest{Action: "ssh", Cmd: args[0], Hosts: args[1:], Serial: serial, Pty: pty}
+	})
+}
+
+func putMain(args []string) int {
+	var serial, mode, owner string
+	var verify, skipUnchanged, changes, sudo, mirror, mirrorDelete, plan bool
+	var relay uint64
+
+	os.Args = append([]string{os.Args[0]}, args...)
+	flag.StringVar(&serial, "serial", "", "Upload to N hosts (or N% of hosts) at a time")
+	flag.StringVar(&mode, "mode", "", "Octal permissions to set on target file, e.g. 0644")
+	flag.StringVar(&owner, "owner", "", "Numeric <uid>:<gid> to set on target file")
+	flag.BoolVar(&sudo, "sudo", false, "Upload into staging file and move it to target with sudo, for targets that login user cannot write")
+	flag.BoolVar(&verify, "verify", false, "Compare SHA-256 of uploaded file with local one")
+	flag.BoolVar(&skipUnchanged, "skip-unchanged", false, "Do not upload file to hosts which copy has the same SHA-256")
+	flag.BoolVar(&changes, "changes", false, "Report whether file was created, replaced or unchanged on each host")
+	flag.Uint64Var(&relay, "relay", 0, "Upload file only to N hosts, every host that received it pushes it to N others with scp")
+	flag.BoolVar(&mirror, "mirror", false, "Make target directory mirror of source directory, only new and changed files are uploaded")
+	flag.BoolVar(&mirrorDelete, "delete", false, "With -mirror: delete remote files that are not in source directory")
+	flag.BoolVar(&plan, "plan", false, "With -mirror: only print changes that would be made on every host")
+
+	return actionMain("put [flags] <source> <target> host1 ... hostN", fixedArgs(2), func(args []string) *ProxyRequest {
+		template := strings.Contains(args[1], "{{") // target is usually different for every host then
+		return &ProxyRequest{Action: "scp", Source: args[0], Target: args[1], Hosts: args[2:], Serial: serial, Mode: mode, Owner: owner, Sudo: sudo, Verify: verify, SkipUnchanged: skipUnchanged, ChangeReport: changes, Template: template, Relay: relay,
+			Mirror: mirror, MirrorDelete: mirrorDelete, MirrorPlan: plan}
+	})
+}
+
+func getMain(args []string) int {
+	var serial string
+	var recursive bool
+
+	os.Args = append([]string{os.Args[0]}, args...)
+	flag.StringVar(&serial, "serial", "", "Download from N hosts (or N% of hosts) at a time")
+	flag.BoolVar(&recursive, "recursive", false, "Download remote directory as a whole, streamed with tar")
+
+	return actionMain("get [flags] <remote file or directory> <local directory> host1 ... hostN", fixedArgs(2), func(args []string) *ProxyRequest {
+		return &ProxyRequest{Action: "download", Source: args[0], Target: args[1], Hosts: args[2:], Serial: serial, Recursive: recursive}
+	})
+}
+
+// fixedArgs returns minArgs of actionMain for actions with n arguments before hosts
+func fixedArgs(n int) func() int {
+	return func() int { return n }
+}
+
+// actionMain runs request made from arguments after flags (at least minArgs() of them followed by hosts,
+// which can be omitted with -retry-from, -vars or -g) and prints replies; makeRequest returns nil after
+// reporting critical error; exit status is 1 if action did not succeed on any host
+func actionMain(usage string, minArgs func() int, makeRequest func(args []string) *ProxyRequest) int {
+	var varsFile, groupExpr string
+	var template bool
+	flag.StringVar(&groupExpr, "g", "", "Inventory group or group expression to run on, e.g. 'web & eu - canary' (| is union, & intersection, - difference)")
+	flag.BoolVar(&template, "template", false, "Render arguments for every host as templates, e.g. {{.Host}} (same as \"Template\": true)")
+	flag.StringVar(&varsFile, "vars", "", "CSV or TSV file with host names and their variables for {{.Vars.name}} templates, hosts of the file are used if none are given")
+
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gossha "+usage)
+		flag.PrintDefaults()
+	}
+
+	go interruptThread()
+	go func() {
+		initialize(true)
+		if n := minArgs(); flag.NArg() < n || flag.NArg() == n && retryFromFile == "" && varsFile == "" && discoverDefault == "" && groupExpr == "" {
+			flag.Usage()
+			repliesChan <- actionDone{status: 2}
+			return
+		}
+
+		req := makeRequest(flag.Args())
+		if req == nil {
+			repliesChan <- actionDone{status: 1}
+			return
+		}
+		req.VarsFile = varsFile
+		if groupExpr != "" {
+			req.Groups = append(req.Groups, groupExpr)
+		}
+		req.Template = req.Template || template
+		runAction(req)
+		repliesChan <- actionDone{}
+	}()
+
+	status := 0
+	stdin := bufio.NewReader(os.Stdin)
+	var render OutputRenderer
+	for reply := range repliesChan {
+		switch reply := reply.(type) {
+		case actionDone:
+			if reply.status != 0 {
+				return reply.status
+			}
+			return status
+		case *InitializeComplete, *ConnectionProgress:
+			continue
+		case *HostKeyRequest:
+			promptHostKey(stdin, reply)
+			continue
+		case *ConfirmationRequest:
+			promptConfirmation(stdin, reply)
+			continue
+		case *UserError:
+			if reply.IsCritical {
+				status = 1
+			}
+		case *Reply:
+			if !reply.Success {
+				status = 1
+			}
+		case *FinalReply:
+			if len(reply.TimedOutHosts) > 0 || len(reply.SkippedHosts) > 0 || reply.Interrupted {
+				status = 1
+			}
+		}
+
+		// flags are parsed before the first reply is sent, text is the default here
+		if render == nil {
+			render = newTextRenderer(os.Stdout, os.Stderr)
+			if isFlagSet("output") || eventsOutput {
+				render = initOutputRenderer()
+			}
+		}
+		render.Render(reply)
+
+		if _, ok := reply.(*PasswordRequest); ok {
+			line, _ := stdin.ReadString('\n')
+			requestsChan <- &ProxyRequest{Password: strings.TrimRight(line, "\r\n")}
+		}
+	}
+
+	return status
+}
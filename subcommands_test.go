@@ -0,0 +1,28 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSubcommandOf(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		expected func([]string) int
+		rest     []string
+	}{
+		{[]string{"/usr/bin/gossha", "exec", "-serial", "2", "uptime", "web1"}, execMain, []string{"-serial", "2", "uptime", "web1"}},
+		{[]string{"gossha", "get", "/etc/hosts", "out", "web1"}, getMain, []string{"/etc/hosts", "out", "web1"}},
+		{[]string{"/usr/local/bin/mssh", "uptime", "web1"}, execMain, []string{"uptime", "web1"}},
+		{[]string{"bin/mscp.exe", "app.tgz", "/tmp/app.tgz", "web1"}, putMain, []string{"app.tgz", "/tmp/app.tgz", "web1"}},
+	} {
+		run, rest := subcommandOf(tc.args)
+		if run == nil || reflect.ValueOf(run).Pointer() != reflect.ValueOf(tc.expected).Pointer() || !reflect.DeepEqual(rest, tc.rest) {
+			t.Fatalf("Unexpected subcommand of %v: %v", tc.args, rest)
+		}
+	}
+
+	if run, _ := subcommandOf([]string{"gossha", "-inventory", "hosts.ini"}); run != nil {
+		t.Fatalf("Flags must start proxy mode")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Sudo passwords ("SudoPassword" or -sudo-password): sudo is run with -k, so that cached credentials
+// do not make it skip the prompt, and with a random prompt, and the password is written to its
+// stdin only after that prompt appears in output. The command prints another random marker when
+// it starts, and only then "Stdin" of the request is sent, so that the password never reaches the
+// command itself, e.g. when sudo does not ask for it because of NOPASSWD. Both markers are removed
+// from output. If sudo asks again (the password is wrong), stdin is closed and sudo fails.
+
+type sudoEvent int
+
+const (
+	sudoPrompted sudoEvent = iota // sudo printed its prompt
+	sudoStarted                   // command started
+)
+
+// sudoAuth answers password prompt of one sudo command
+type sudoAuth struct {
+	password      string
+	prompt, ready string // markers printed by sudo and by the command
+
+	mu      sync.Mutex
+	started bool // ready marker was seen, output is not filtered anymore
+	filters []*sudoFilter
+
+	events   chan sudoEvent
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// sudoFilter removes markers of auth from output written to w
+type sudoFilter struct {
+	auth    *sudoAuth
+	w       io.Writer
+	pending []byte // end of output that can be the beginning of a marker
+}
+
+// newSudoAuth returns answerer of sudo prompts with password, nil if there is no password
+func newSudoAuth(password string) *sudoAuth {
+	if password == "" {
+		return nil
+	}
+	var id [8]byte
+	rand.Read(id[:])
+	tag := hex.EncodeToString(id[:])
+	return &sudoAuth{
+		password: password,
+		prompt:   "[gossha-sudo-" + tag + "]",
+		ready:    "[gossha-started-" + tag + "]",
+		events:   make(chan sudoEvent),
+		done:     make(chan struct{}),
+	}
+}
+
+// sudoFlags returns flags of sudo that make it print the marker as prompt (% is never in it)
+func (a *sudoAuth) sudoFlags() string {
+	return "-k -S -p " + shellQuote(a.prompt)
+}
+
+// wrap makes cmd print the ready marker before it starts
+func (a *sudoAuth) wrap(cmd string) string {
+	return "printf %s " + shellQuote(a.ready) + " >&2; " + cmd
+}
+
+// filter returns w without markers of auth, w itself if auth is nil
+func (a *sudoAuth) filter(w io.Writer) io.Writer {
+	if a == nil {
+		return w
+	}
+	f := &sudoFilter{auth: a, w: w}
+	a.mu.Lock()
+	a.filters = append(a.filters, f)
+	a.mu.Unlock()
+	return f
+}
+
+// start sends password and then stdin to session when markers appear in its output
+func (a *sudoAuth) start(session *ssh.Session, stdin []byte) error {
+	if a == nil {
+		if stdin != nil {
+			session.Stdin = bytes.NewReader(stdin)
+		}
+		return nil
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	go a.feed(w, stdin)
+	return nil
+}
+
+// feed writes to stdin of session on events until finish is called
+func (a *sudoAuth) feed(w io.WriteCloser, stdin []byte) {
+	prompts, closed := 0, false
+	closeStdin := func() {
+		if !closed {
+			w.Close()
+			closed = true
+		}
+	}
+	defer closeStdin()
+
+	for {
+		select {
+		case ev := <-a.events:
+			switch {
+			case closed:
+			case ev == sudoStarted:
+				if stdin != nil {
+					w.Write(stdin)
+				}
+				closeStdin()
+			case prompts > 0:
+				closeStdin() // password was wrong
+			default:
+				prompts++
+				io.WriteString(w, a.password+"\n")
+			}
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// finish writes the rest of filtered output and stops feeding stdin, it must be called after session finished
+func (a *sudoAuth) finish() {
+	if a == nil {
+		return
+	}
+	a.doneOnce.Do(func() {
+		close(a.done)
+		a.mu.Lock()
+		filters := a.filters
+		a.mu.Unlock()
+		for _, f := range filters {
+			if len(f.pending) > 0 {
+				f.w.Write(f.pending)
+				f.pending = nil
+			}
+		}
+	})
+}
+
+// seen reports marker of ev that was found in output
+func (a *sudoAuth) seen(ev sudoEvent) {
+	if ev == sudoStarted {
+		a.mu.Lock()
+		a.started = true
+		a.mu.Unlock()
+	}
+	select {
+	case a.events <- ev:
+	case <-a.done:
+	}
+}
+
+func (a *sudoAuth) isStarted() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.started
+}
+
+func (f *sudoFilter) Write(p []byte) (int, error) {
+	if len(f.pending) == 0 && f.auth.isStarted() {
+		return f.w.Write(p)
+	}
+
+	data := append(f.pending, p...)
+	f.pending = nil
+	var out []byte
+	for {
+		i, marker, ev := f.nextMarker(data)
+		if i < 0 {
+			break
+		}
+		out = append(out, data[:i]...)
+		data = data[i+len(marker):]
+		f.auth.seen(ev)
+	}
+
+	// the rest is kept if it can be the beginning of a marker, the command does not print them
+	keep := 0
+	if !f.auth.isStarted() {
+		keep = markerPrefixLen(data, f.auth.prompt, f.auth.ready)
+	}
+	out = append(out, data[:len(data)-keep]...)
+	f.pending = append([]byte(nil), data[len(data)-keep:]...)
+
+	if len(out) > 0 {
+		if _, err := f.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// nextMarker returns position of the first marker in data, -1 if there is none
+func (f *sudoFilter) nextMarker(data []byte) (int, string, sudoEvent) {
+	if f.auth.isStarted() {
+		return -1, "", 0
+	}
+	i, marker, ev := bytes.Index(data, []byte(f.auth.prompt)), f.auth.prompt, sudoPrompted
+	if j := bytes.Index(data, []byte(f.auth.ready)); j >= 0 && (i < 0 || j < i) {
+		i, marker, ev = j, f.auth.ready, sudoStarted
+	}
+	return i, marker, ev
+}
+
+// markerPrefixLen returns length of the longest end of data that is the beginning of one of markers
+func markerPrefixLen(data []byte, markers ...string) int {
+	longest := 0
+	for _, m := range markers {
+		if len(m) > longest {
+			longest = len(m)
+		}
+	}
+	k := len(data)
+	if k >= longest {
+		k = longest - 1
+	}
+	for ; k > 0; k-- {
+		for _, m := range markers {
+			if k < len(m) && bytes.HasPrefix([]byte(m), data[len(data)-k:]) {
+				return k
+			}
+		}
+	}
+	return 0
+}
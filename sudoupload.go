@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Uploads with sudo ("Sudo": true for "scp", -sudo of put/mscp): files are uploaded over SFTP as the
+// login user into a staging file in its home directory, and then copied into place by a script run
+// with sudo, so that targets like /etc/... that the deploy account cannot write can be replaced.
+// Target gets owner and permissions of "Owner" and "Mode", or of the file it replaces, root:root and
+// 0644 for new files. Staging file is only readable by the login user and its name depends on target,
+// so that -resume continues it. Missing parent directories are created by root, directories cannot
+// be uploaded this way.
+
+const sudoStagingPrefix = ".gossha-sudo-" // prefix of staging files in home directory of login user
+
+// sudoStagingPath returns path of staging file for target relative to home directory
+func sudoStagingPath(target string) string {
+	sum := sha256.Sum256([]byte(target))
+	return sudoStagingPrefix + hex.EncodeToString(sum[:8])
+}
+
+// sudoTargetAttrs returns owner and permissions that target is installed with
+func sudoTargetAttrs(client *sftpClient, target string, attrs *sftpAttrs) (owner string, perm uint32) {
+	uid, gid, perm := uint32(0), uint32(0), uint32(0644)
+	if old, err := client.Stat(target); err == nil {
+		if old.Flags&sshFileXferAttrUIDGID != 0 {
+			uid, gid = old.UID, old.GID
+		}
+		if old.Flags&sshFileXferAttrPermissions != 0 {
+			perm = old.Perm & 07777
+		}
+	}
+	if attrs.Flags&sshFileXferAttrUIDGID != 0 {
+		uid, gid = attrs.UID, attrs.GID
+	}
+	if attrs.Flags&sshFileXferAttrPermissions != 0 {
+		perm = attrs.Perm & 07777
+	}
+	return fmt.Sprintf("%d:%d", uid, gid), perm
+}
+
+// sudoInstallScript returns script that installs staging file as target with owner and permissions,
+// staging is removed; without staging only owner and permissions of target are set
+func sudoInstallScript(staging, target, owner string, perm uint32) string {
+	vars := fmt.Sprintf("set -e; t=%s; owner=%s; mode=%04o; ", shellQuote(target), owner, perm)
+	if staging == "" {
+		return vars + `chown -- "$owner" "$t"; chmod -- "$mode" "$t"`
+	}
+	vars += fmt.Sprintf("s=%s; tmp=%s; ", shellQuote(staging), shellQuote(target+uploadTmpSuffix))
+	if inplaceUploads {
+		return vars + fmt.Sprintf(`mkdir -p -- %s; cat -- "$s" > "$t"; chown -- "$owner" "$t"; chmod -- "$mode" "$t"; rm -f -- "$s"`, shellQuote(path.Dir(target)))
+	}
+	return vars + fmt.Sprintf(`trap 'rm -f -- "$tmp"' EXIT; mkdir -p -- %s; cp -p -- "$s" "$tmp"; chown -- "$owner" "$tmp"; chmod -- "$mode" "$tmp"; mv -f -- "$tmp" "$t"; rm -f -- "$s"`, shellQuote(path.Dir(target)))
+}
+
+// runSudoScript runs script with sudo, password of sudo is sent when it asks for it
+func runSudoScript(conn *ssh.Client, script, password string) error {
+	session, err := conn.NewSession()
+	if err != nil {
+		return &retryableError{err}
+	}
+	defer session.Close()
+
+	auth := newSudoAuth(password)
+	defer auth.finish()
+	output := &combinedOutput{}
+	session.Stdout, session.Stderr = auth.filter(output), auth.filter(output)
+	if err := auth.start(session, nil); err != nil {
+		return err
+	}
+	err = session.Run(sudoCommand(script, "", auth))
+	auth.finish()
+	if err != nil {
+		return errors.New(strings.TrimSpace(err.Error() + " " + output.String()))
+	}
+	return nil
+}
+
+// installRemoteFileSudo uploads entry into staging file and installs it as target with sudo
+func installRemoteFileSudo(conn *ssh.Client, client *sftpClient, target string, entry *uploadEntry, attrs *sftpAttrs, opts *uploadOptions, progress *transferProgress, limiters []*rateLimiter) error {
+	owner, perm := sudoTargetAttrs(client, target, attrs)
+
+	staging := sudoStagingPath(target)
+	stagingAttrs := &sftpAttrs{Flags: sshFileXferAttrPermissions, Perm: 0600}
+	if attrs.Flags&sshFileXferAttrACModTime != 0 {
+		stagingAttrs.Flags |= sshFileXferAttrACModTime
+		stagingAttrs.Atime, stagingAttrs.Mtime = attrs.Atime, attrs.Mtime
+	}
+	if err := uploadRemoteFile(conn, client, staging, entry, stagingAttrs, opts, progress, limiters); err != nil {
+		return err
+	}
+
+	if err := runSudoScript(conn, sudoInstallScript(staging, target, owner, perm), opts.sudoPassword); err != nil {
+		client.Remove(staging)
+		return errors.New("Cannot install " + target + " with sudo: " + err.Error())
+	}
+	return nil
+}
+
+// setRemoteAttrsSudo sets owner and permissions of existing target with sudo
+func setRemoteAttrsSudo(conn *ssh.Client, client *sftpClient, target string, attrs *sftpAttrs, opts *uploadOptions) error {
+	owner, perm := sudoTargetAttrs(client, target, attrs)
+	if err := runSudoScript(conn, sudoInstallScript("", target, owner, perm), opts.sudoPassword); err != nil {
+		return errors.New("Cannot set attributes of " + target + " with sudo: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSudoUpload(t *testing.T) {
+	binDir, err := ioutil.TempDir("", "gossha-sudo")
+	must(err, "Could not create bin dir")
+	defer os.RemoveAll(binDir)
+	must(ioutil.WriteFile(filepath.Join(binDir, "sudo"), []byte(fakeSudo), 0755), "Could not write fake sudo")
+
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", binDir+":"+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	owner := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	r := makeTestResult()
+	startTestServers(r, "test-sudo-upload", 2)
+	runTestRequest(t, r, &ProxyRequest{Action: "scp", Source: dataSource, Data: []byte("key=value\n"), Target: "etc/app/app.conf", Mode: "0640", Owner: owner, Sudo: true, SudoPassword: "secret", Verify: true})
+
+	for addr, srv := range r.hosts {
+		name := filepath.Join(srv.root, "etc/app/app.conf")
+		if got, err := ioutil.ReadFile(name); err != nil || string(got) != "key=value\n" {
+			t.Fatalf("Unexpected contents on %s: %q, %v", addr, got, err)
+		}
+		if fi, err := os.Stat(name); err != nil || fi.Mode().Perm() != 0640 {
+			t.Fatalf("Unexpected mode on %s: %v, %v", addr, fi.Mode(), err)
+		}
+		if staging, _ := filepath.Glob(filepath.Join(srv.root, sudoStagingPrefix+"*")); len(staging) > 0 {
+			t.Fatalf("Staging files are left on %s: %v", addr, staging)
+		}
+	}
+
+	// mode of replaced file is kept
+	r = makeTestResult()
+	startTestServers(r, "test-sudo-upload-replace", 1)
+	for _, srv := range r.hosts {
+		must(ioutil.WriteFile(filepath.Join(srv.root, "app.conf"), []byte("old\n"), 0600), "Could not write target")
+	}
+	runTestRequest(t, r, &ProxyRequest{Action: "scp", Source: dataSource, Data: []byte("new\n"), Target: "app.conf", Owner: owner, Sudo: true, SudoPassword: "secret"})
+	for addr, srv := range r.hosts {
+		name := filepath.Join(srv.root, "app.conf")
+		if got, err := ioutil.ReadFile(name); err != nil || string(got) != "new\n" {
+			t.Fatalf("Unexpected contents on %s: %q, %v", addr, got, err)
+		}
+		if fi, err := os.Stat(name); err != nil || fi.Mode().Perm() != 0600 {
+			t.Fatalf("Unexpected mode on %s: %v, %v", addr, fi.Mode(), err)
+		}
+	}
+
+	r = makeTestResult()
+	startTestServers(r, "test-sudo-upload-password", 1)
+	sendTestRequest(t, r, &ProxyRequest{Action: "scp", Source: dataSource, Data: []byte("new\n"), Target: "app.conf", Owner: owner, Sudo: true, SudoPassword: "wrong"})
+	for addr, reply := range r.replies {
+		if reply.Success || !strings.Contains(reply.ErrMsg, "Cannot install app.conf with sudo") || !strings.Contains(reply.ErrMsg, "Sorry, try again.") {
+			t.Fatalf("Expected sudo to fail on %s, got %+v", addr, reply)
+		}
+	}
+	for addr, srv := range r.hosts {
+		if staging, _ := filepath.Glob(filepath.Join(srv.root, sudoStagingPrefix+"*")); len(staging) > 0 {
+			t.Fatalf("Staging files are left on %s after failure: %v", addr, staging)
+		}
+	}
+}
+
+func TestSudoUploadOptions(t *testing.T) {
+	if _, err := parseUploadOptions(&ProxyRequest{Action: "scp", SudoPassword: "secret"}); err == nil {
+		t.Fatalf("Expected 'SudoPassword' without 'Sudo' to be rejected")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Host tags: inventory variables gossha_tag_<name> (e.g. gossha_tag_dc=eu, usually set in [group:vars])
+// or "tags" mapping of hosts in "hosts" section of configuration file attach tags to hosts. Tags of
+// host are sent in "Tags" of its reply, and FinalReply and run notifications count successful and
+// failed hosts for every tag value, so that e.g. failures that are limited to one datacenter stand out.
+
+const tagVarPrefix = "gossha_tag_"
+
+// TagCounts is the number of hosts with a tag value that succeeded and failed in a run
+type TagCounts struct {
+	Succeeded int
+	Failed    int // hosts that failed, timed out or were not started
+}
+
+// hostTags returns tags of inventory host, nil if it has none
+func hostTags(hostname string) map[string]string {
+	if hostInventory == nil {
+		return nil
+	}
+
+	var tags map[string]string
+	for name, value := range hostInventory.HostVars(hostname) {
+		if strings.HasPrefix(name, tagVarPrefix) && value != "" {
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[strings.TrimPrefix(name, tagVarPrefix)] = value
+		}
+	}
+	return tags
+}
+
+// tagSummary counts hosts by "<name>=<value>" of their tags, nil if none of hosts have tags
+func tagSummary(hosts []string, failed map[string]bool) map[string]*TagCounts {
+	var res map[string]*TagCounts
+	for _, h := range hosts {
+		for name, value := range hostTags(h) {
+			if res == nil {
+				res = make(map[string]*TagCounts)
+			}
+			key := name + "=" + value
+			if res[key] == nil {
+				res[key] = &TagCounts{}
+			}
+			if failed[h] {
+				res[key].Failed++
+			} else {
+				res[key].Succeeded++
+			}
+		}
+	}
+	return res
+}
+
+// formatTagSummary returns "<tag>: <succeeded> ok, <failed> failed" lines for tags of summary in
+// alphabetical order, only for tags with failures if onlyFailed is set
+func formatTagSummary(summary map[string]*TagCounts, onlyFailed bool) []string {
+	keys := make([]string, 0, len(summary))
+	for k, c := range summary {
+		if !onlyFailed || c.Failed > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	res := make([]string, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, fmt.Sprintf("%s: %d ok, %d failed", k, summary[k].Succeeded, summary[k].Failed))
+	}
+	return res
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTagSummary(t *testing.T) {
+	inv, err := parseInventory([]byte("[eu]\nweb1\ndb1 gossha_tag_role=db\n\n[us]\nweb2\n\n[eu:vars]\ngossha_tag_dc=eu\n\n[us:vars]\ngossha_tag_dc=us\n"), "ini")
+	must(err, "Could not parse inventory")
+	hostInventory = inv
+	defer func() { hostInventory = nil }()
+
+	if tags := hostTags("db1"); !reflect.DeepEqual(tags, map[string]string{"dc": "eu", "role": "db"}) {
+		t.Fatalf("Unexpected tags of db1: %v", tags)
+	}
+	if tags := hostTags("other"); tags != nil {
+		t.Fatalf("Host outside of inventory must not have tags: %v", tags)
+	}
+
+	summary := tagSummary([]string{"web1", "db1", "web2", "other"}, map[string]bool{"db1": true, "other": true})
+	expected := map[string]*TagCounts{"dc=eu": {Succeeded: 1, Failed: 1}, "dc=us": {Succeeded: 1}, "role=db": {Failed: 1}}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("Unexpected summary: %v", formatTagSummary(summary, false))
+	}
+	if lines := formatTagSummary(summary, true); !reflect.DeepEqual(lines, []string{"dc=eu: 1 ok, 1 failed", "role=db: 0 ok, 1 failed"}) {
+		t.Fatalf("Unexpected tags with failures: %v", lines)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Log following ("gossha tail [flags] <file> host1 ... hostN"): "tail -F" is run on every host
+// with output streamed like with -P, so lines of all hosts are merged as they arrive. Sessions
+// live until Ctrl-C (or -duration), lost connections are reestablished once (see RerunOnDisconnect).
+
+const tailTimeout = 100 * 365 * 24 * time.Hour // tail runs until it is interrupted, unless -duration is set
+
+type tailDone struct{ status int } // sent by tailMain after action finished
+
+// tailRequest returns request that follows file on hosts for duration (0 means until Ctrl-C), starting with last lines of it
+func tailRequest(file string, lines uint64, duration time.Duration, hosts []string) *ProxyRequest {
+	timeout := tailTimeout
+	if duration > 0 {
+		timeout = duration
+	}
+
+	return &ProxyRequest{
+		Action:            "ssh",
+		Cmd:               fmt.Sprintf("tail -n %d -F -- %s", lines, shellQuote(file)),
+		Hosts:             hosts,
+		Timeout:           uint64(timeout / time.Millisecond),
+		RerunOnDisconnect: true,
+	}
+}
+
+// writeTailChunk writes lines of output chunk prefixed with host (and local receive time if timestamps is set)
+func writeTailChunk(w io.Writer, chunk *OutputChunk, now time.Time, timestamps bool) {
+	var buf bytes.Buffer
+	writeReplyText(&buf, &buf, chunk, "")
+	if !timestamps {
+		w.Write(buf.Bytes())
+		return
+	}
+
+	ts := now.Format("2006-01-02T15:04:05.000 ")
+	for _, ln := range strings.SplitAfter(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		fmt.Fprint(w, ts+ln)
+	}
+	fmt.Fprintln(w)
+}
+
+func tailMain(args []string) int {
+	var lines uint64
+	var timestamps bool
+	var duration time.Duration
+
+	os.Args = append([]string{os.Args[0]}, args...)
+	flag.Uint64Var(&lines, "n", 10, "Number of last lines of file to print before following it")
+	flag.BoolVar(&timestamps, "timestamps", false, "Prefix every line with local time it was received at")
+	flag.DurationVar(&duration, "duration", 0, "Stop following after this time (default is to follow until Ctrl-C)")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gossha tail [flags] <file> host1 ... hostN")
+		flag.PrintDefaults()
+	}
+
+	go interruptThread()
+	go func() {
+		initialize(true)
+		if flag.NArg() < 2 && !(flag.NArg() == 1 && retryFromFile != "") {
+			flag.Usage()
+			repliesChan <- tailDone{status: 2}
+			return
+		}
+
+		// output is printed as it arrives and is not kept for replies
+		prefixOutput = true
+		runAction(tailRequest(flag.Arg(0), lines, duration, flag.Args()[1:]))
+		repliesChan <- tailDone{}
+	}()
+
+	status := 0
+	stdin := bufio.NewReader(os.Stdin)
+	for reply := range repliesChan {
+		switch reply := reply.(type) {
+		case tailDone:
+			if reply.status != 0 {
+				return reply.status
+			}
+			return status
+		case *OutputChunk:
+			writeTailChunk(os.Stdout, reply, time.Now(), timestamps)
+			continue
+		case *Reply:
+			// commands stopped by Ctrl-C are not failures
+			if reply.Success || commandsInterrupted() {
+				continue
+			}
+			status = 1
+		case *UserError:
+			if reply.IsCritical {
+				status = 1
+			}
+		case *HostKeyRequest:
+			promptHostKey(stdin, reply)
+			continue
+		case *ConfirmationRequest:
+			promptConfirmation(stdin, reply)
+			continue
+		case *PasswordRequest:
+		default:
+			continue
+		}
+
+		writeReplyText(os.Stdout, os.Stderr, reply, "")
+
+		if _, ok := reply.(*PasswordRequest); ok {
+			line, _ := stdin.ReadString('\n')
+			requestsChan <- &ProxyRequest{Password: strings.TrimRight(line, "\r\n")}
+		}
+	}
+
+	return status
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTailRequest(t *testing.T) {
+	req := tailRequest("/var/log/app's.log", 5, 0, []string{"web1"})
+	if req.Cmd != `tail -n 5 -F -- '/var/log/app'\''s.log'` || !req.RerunOnDisconnect || req.Timeout != uint64(tailTimeout/time.Millisecond) {
+		t.Fatalf("Unexpected request: %+v", req)
+	}
+
+	if req := tailRequest("app.log", 0, time.Minute, nil); req.Timeout != 60000 {
+		t.Fatalf("Duration must limit request timeout: %+v", req)
+	}
+}
+
+func TestWriteTailChunk(t *testing.T) {
+	now := time.Date(2024, 5, 14, 12, 0, 1, 123e6, time.Local)
+	chunk := &OutputChunk{Hostname: "web1", Stream: "stderr", Data: "first\nsecond\n"}
+
+	var out bytes.Buffer
+	writeTailChunk(&out, chunk, now, true)
+	if expected := "2024-05-14T12:00:01.123 web1 (stderr): first\n2024-05-14T12:00:01.123 web1 (stderr): second\n"; out.String() != expected {
+		t.Fatalf("Unexpected output: %q", out.String())
+	}
+
+	out.Reset()
+	writeTailChunk(&out, chunk, now, false)
+	if expected := "web1 (stderr): first\nweb1 (stderr): second\n"; out.String() != expected {
+		t.Fatalf("Unexpected output without timestamps: %q", out.String())
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Per-host templates ("Template": true): Cmd, Cmds, Chdir and Source and Target of uploads are
+// rendered with text/template separately for every host, e.g. "conf/{{.ShortHost}}.cfg":
+//
+//	{{.Host}}       host name (without port)
+//	{{.ShortHost}}  host name up to the first dot, IP addresses are kept as is
+//	{{.Index}}      index of host in the request, starting from 0
+//	{{.Vars.name}}  per-host variable from Vars (or VarsFile) of the request
+
+type (
+	hostTemplateData struct {
+		Host      string
+		ShortHost string
+		Index     int
+		Vars      map[string]string
+	}
+
+	// uploadSourceCache reads every distinct rendered upload source only once
+	uploadSourceCache struct {
+		mu      sync.Mutex
+		sources map[string]*cachedUploadSource
+	}
+
+	cachedUploadSource struct {
+		once    sync.Once
+		entries []*uploadEntry
+		err     error
+	}
+)
+
+// templateFuncs are functions available in templates in addition to built-in ones
+var templateFuncs = template.FuncMap{
+	"quote": shellQuote, // {{quote .Vars.name}} quotes value for shell
+}
+
+// newHostRenderer returns function that renders request fields for hostname; templates are
+// validated beforehand, so that syntax errors are reported once instead of for every host
+func newHostRenderer(msg *ProxyRequest) (func(hostname string) (*ProxyRequest, error), error) {
+	if !msg.Template {
+		return func(string) (*ProxyRequest, error) { return msg, nil }, nil
+	}
+
+	// every variable that is set for some host is known, so that misspelled names are rejected
+	known := make(map[string]string)
+	for _, vars := range msg.Vars {
+		for k := range vars {
+			known[k] = ""
+		}
+	}
+	if _, err := renderRequest(msg, &hostTemplateData{Vars: known}); err != nil {
+		return nil, err
+	}
+
+	hostIdx := make(map[string]int, len(msg.Hosts))
+	for i, h := range msg.Hosts {
+		hostIdx[h] = i
+	}
+
+	return func(hostname string) (*ProxyRequest, error) {
+		host, _ := splitHostPort(hostname)
+		data := &hostTemplateData{Host: host, ShortHost: host, Index: hostIdx[hostname]}
+		if len(msg.Vars) > 0 {
+			if data.Vars = hostTemplateVars(msg.Vars, hostname); data.Vars == nil {
+				return nil, errors.New("No variables are set for " + hostname)
+			}
+		}
+		if idx := strings.Index(host, "."); idx > 0 && net.ParseIP(host) == nil {
+			data.ShortHost = host[:idx]
+		}
+		return renderRequest(msg, data)
+	}, nil
+}
+
+// renderRequest returns copy of msg with templates in Cmd, Cmds, Chdir, Source and Target rendered
+func renderRequest(msg *ProxyRequest, data *hostTemplateData) (*ProxyRequest, error) {
+	res := *msg
+	res.Cmds = make([]string, len(msg.Cmds))
+
+	var err error
+	if res.Cmd, err = renderHostTemplate("Cmd", msg.Cmd, data); err != nil {
+		return nil, err
+	}
+	for i, cmd := range msg.Cmds {
+		if res.Cmds[i], err = renderHostTemplate("Cmds", cmd, data); err != nil {
+			return nil, err
+		}
+	}
+	if res.Chdir, err = renderHostTemplate("Chdir", msg.Chdir, data); err != nil {
+		return nil, err
+	}
+	if res.Source, err = renderHostTemplate("Source", msg.Source, data); err != nil {
+		return nil, err
+	}
+	if res.Target, err = renderHostTemplate("Target", msg.Target, data); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func renderHostTemplate(field, text string, data *hostTemplateData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	tmpl, err := template.New(field).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", errors.New("Invalid template in '" + field + "': " + err.Error())
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", errors.New("Cannot render '" + field + "': " + err.Error())
+	}
+
+	return buf.String(), nil
+}
+
+// loadRequestVars adds variables from VarsFile of msg to its Vars (Vars take precedence) and uses
+// hosts of the file if no other hosts are requested
+func loadRequestVars(msg *ProxyRequest) error {
+	if msg.VarsFile != "" {
+		hosts, vars, err := loadVarsFile(msg.VarsFile)
+		if err != nil {
+			return err
+		}
+
+		if msg.Vars == nil {
+			msg.Vars = make(map[string]map[string]string, len(vars))
+		}
+		for host, fileVars := range vars {
+			hostVars := msg.Vars[host]
+			if hostVars == nil {
+				hostVars = make(map[string]string, len(fileVars))
+				msg.Vars[host] = hostVars
+			}
+			for k, v := range fileVars {
+				if _, ok := hostVars[k]; !ok {
+					hostVars[k] = v
+				}
+			}
+		}
+
+		if len(msg.Hosts) == 0 && len(msg.Groups) == 0 && len(msg.Discover) == 0 && msg.Stages == "" {
+			msg.Hosts = hosts
+		}
+	}
+
+	if len(msg.Vars) > 0 {
+		msg.Template = true
+	}
+	return nil
+}
+
+// hostTemplateVars returns variables of hostname, which can be listed with or without port
+func hostTemplateVars(vars map[string]map[string]string, hostname string) map[string]string {
+	if v, ok := vars[hostname]; ok {
+		return v
+	}
+	host, _ := splitHostPort(hostname)
+	return vars[host]
+}
+
+// loadVarsFile reads per-host variables from CSV file (TSV if it has .tsv extension or its header
+// has tabs but no commas): header names variables, first column of every row is host name;
+// hosts are returned in order of the file
+func loadVarsFile(filename string) (hosts []string, vars map[string]map[string]string, err error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, errors.New("Cannot read vars file: " + err.Error())
+	}
+
+	r := csv.NewReader(bytes.NewReader(contents))
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	header := string(contents)
+	if idx := strings.IndexByte(header, '\n'); idx >= 0 {
+		header = header[:idx]
+	}
+	if strings.EqualFold(filepath.Ext(filename), ".tsv") || strings.Contains(header, "\t") && !strings.Contains(header, ",") {
+		r.Comma = '\t'
+	}
+
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, nil, errors.New("Cannot parse vars file " + filename + ": " + err.Error())
+	}
+	if len(rows) == 0 {
+		return nil, nil, errors.New("Vars file " + filename + " is empty")
+	}
+
+	names := rows[0][1:]
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if name == "" || seen[name] {
+			return nil, nil, errors.New("Empty or duplicate variable name '" + name + "' in header of " + filename)
+		}
+		seen[name] = true
+	}
+
+	vars = make(map[string]map[string]string, len(rows)-1)
+	for _, row := range rows[1:] {
+		host := strings.TrimSpace(row[0])
+		if _, ok := vars[host]; ok || host == "" {
+			return nil, nil, errors.New("Empty or duplicate host '" + host + "' in " + filename)
+		}
+
+		hostVars := make(map[string]string, len(names))
+		for i, name := range names {
+			hostVars[name] = row[i+1]
+		}
+		vars[host] = hostVars
+		hosts = append(hosts, host)
+	}
+
+	return hosts, vars, nil
+}
+
+func newUploadSourceCache() *uploadSourceCache {
+	return &uploadSourceCache{sources: make(map[string]*cachedUploadSource)}
+}
+
+func (c *uploadSourceCache) read(source string) ([]*uploadEntry, error) {
+	c.mu.Lock()
+	s, ok := c.sources[source]
+	if !ok {
+		s = &cachedUploadSource{}
+		c.sources[source] = s
+	}
+	c.mu.Unlock()
+
+	s.once.Do(func() { s.entries, s.err = readUploadSource(source) })
+	return s.entries, s.err
+}
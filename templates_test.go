@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHostRenderer(t *testing.T) {
+	msg := &ProxyRequest{
+		Action:   "ssh",
+		Template: true,
+		Cmds:     []string{"echo {{.Host}}", "echo {{.ShortHost}}-{{.Index}}"},
+		Hosts:    []string{"web1.example.com", "10.0.0.1:2222"},
+	}
+
+	render, err := newHostRenderer(msg)
+	must(err, "Could not create renderer")
+
+	for hostname, expected := range map[string][]string{
+		"web1.example.com": {"echo web1.example.com", "echo web1-0"},
+		"10.0.0.1:2222":    {"echo 10.0.0.1", "echo 10.0.0.1-1"},
+	} {
+		req, err := render(hostname)
+		if err != nil || fmt.Sprint(req.Cmds) != fmt.Sprint(expected) {
+			t.Fatalf("Unexpected commands for %s: %v, %v", hostname, req, err)
+		}
+	}
+
+	if msg.Cmds[0] != "echo {{.Host}}" {
+		t.Fatalf("Original request must not be modified")
+	}
+
+	for _, cmd := range []string{"echo {{.Host", "echo {{.Unknown}}"} {
+		if _, err := newHostRenderer(&ProxyRequest{Template: true, Cmd: cmd}); err == nil {
+			t.Fatalf("Invalid template %q must be rejected", cmd)
+		}
+	}
+
+	// placeholders are left as is unless templates are requested
+	render, _ = newHostRenderer(&ProxyRequest{Cmd: "docker ps --format '{{.Names}}'"})
+	if req, _ := render("host"); req.Cmd != "docker ps --format '{{.Names}}'" {
+		t.Fatalf("Command without Template must be kept as is: %s", req.Cmd)
+	}
+}
+
+func TestTemplateUpload(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "gossha-template")
+	must(err, "Could not create source dir")
+	defer os.RemoveAll(srcDir)
+
+	r := makeTestResult()
+	startTestServers(r, "test-template", 3)
+
+	req := &ProxyRequest{
+		Action:   "scp",
+		Template: true,
+		Source:   filepath.Join(srcDir, "{{.Index}}.cfg"),
+		Target:   "app-{{.Index}}.cfg",
+	}
+
+	// runTestRequest appends the same hosts, so order (and hence indexes) is defined here
+	var hosts []string
+	for addr := range r.hostsLeft {
+		hosts = append(hosts, addr)
+	}
+	req.Hosts = append([]string{}, hosts...)
+
+	for i := range hosts {
+		must(ioutil.WriteFile(filepath.Join(srcDir, fmt.Sprintf("%d.cfg", i)), []byte(fmt.Sprint("config ", i)), 0644), "Could not write source file")
+	}
+
+	runTestRequest(t, r, req)
+
+	for i, addr := range hosts {
+		got, err := ioutil.ReadFile(filepath.Join(r.hosts[addr].root, fmt.Sprintf("app-%d.cfg", i)))
+		if err != nil || string(got) != fmt.Sprint("config ", i) {
+			t.Fatalf("Unexpected contents on %s: %q, %v", addr, got, err)
+		}
+	}
+}
+
+func TestLoadVarsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossha-vars")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	for name, contents := range map[string]string{
+		"hosts.csv": "host,node_id,role\n# comment\nweb1, 1,\"front, main\"\nweb2:2222,2,back\n",
+		"hosts.tsv": "host\tnode_id\trole\nweb1\t1\tfront, main\nweb2:2222\t2\tback\n",
+		"hosts.txt": "host\tnode_id\trole\nweb1\t1\tfront, main\nweb2:2222\t2\tback\n",
+	} {
+		filename := filepath.Join(dir, name)
+		must(ioutil.WriteFile(filename, []byte(contents), 0644), "Could not write vars file")
+
+		hosts, vars, err := loadVarsFile(filename)
+		if err != nil || fmt.Sprint(hosts) != "[web1 web2:2222]" || vars["web1"]["role"] != "front, main" || vars["web2:2222"]["node_id"] != "2" {
+			t.Fatalf("Unexpected vars of %s: %v, %v, %v", name, hosts, vars, err)
+		}
+	}
+
+	for _, contents := range []string{"", "host,a,a\nweb1,1,2\n", "host,a\nweb1,1\nweb1,2\n", "host,a\nweb1,1,2\n"} {
+		filename := filepath.Join(dir, "bad.csv")
+		must(ioutil.WriteFile(filename, []byte(contents), 0644), "Could not write vars file")
+		if _, _, err := loadVarsFile(filename); err == nil {
+			t.Fatalf("Invalid vars file must be rejected: %q", contents)
+		}
+	}
+
+	msg := &ProxyRequest{Cmd: "echo {{.Vars.node}}", Hosts: []string{"web1:22", "web2"}, Vars: map[string]map[string]string{"web1": {"node": "1"}}}
+	must(loadRequestVars(msg), "Could not load vars")
+	render, err := newHostRenderer(msg)
+	must(err, "Could not create renderer")
+	if req, err := render("web1:22"); err != nil || req.Cmd != "echo 1" {
+		t.Fatalf("Unexpected command for web1: %v, %v", req, err)
+	}
+	if _, err := render("web2"); err == nil {
+		t.Fatalf("Host without variables must fail")
+	}
+
+	msg.Cmd = "echo {{.Vars.nodes}}"
+	if _, err := newHostRenderer(msg); err == nil {
+		t.Fatalf("Unknown variable must be rejected")
+	}
+}
+
+func TestVarsFileCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossha-vars")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	r := makeTestResult()
+	startTestServers(r, "test-vars", 3)
+
+	contents := "host,shard\n"
+	shards := make(map[string]string)
+	i := 0
+	for addr := range r.hosts {
+		i++
+		shards[addr] = fmt.Sprint("shard-", i)
+		contents += addr + "," + shards[addr] + "\n"
+	}
+	varsFile := filepath.Join(dir, "hosts.csv")
+	must(ioutil.WriteFile(varsFile, []byte(contents), 0644), "Could not write vars file")
+
+	// hosts are taken from the file
+	req := &ProxyRequest{Action: "ssh", Cmd: "echo {{.Vars.shard}} > shard", VarsFile: varsFile, Timeout: uint64(maxTimeout / time.Millisecond)}
+	requestsChan <- req
+	waitReply(t, r, maxTimeout)
+
+	for addr, srv := range r.hosts {
+		got, err := ioutil.ReadFile(filepath.Join(srv.root, "shard"))
+		if err != nil || string(got) != shards[addr]+"\n" {
+			t.Fatalf("Unexpected shard on %s: %q, %v", addr, got, err)
+		}
+	}
+}
+
+func TestTemplateTargetDirs(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-template-dirs", 2)
+
+	// like in TestTemplateUpload, hosts are listed here to define their indexes
+	var hosts []string
+	for addr := range r.hostsLeft {
+		hosts = append(hosts, addr)
+	}
+	runTestRequest(t, r, &ProxyRequest{Action: "scp", Template: true, Source: dataSource, Data: []byte("config"), Target: "etc/app/{{.Index}}/config.yml", Hosts: append([]string{}, hosts...)})
+
+	for i, addr := range hosts {
+		if got, err := ioutil.ReadFile(filepath.Join(r.hosts[addr].root, "etc/app", fmt.Sprint(i), "config.yml")); err != nil || string(got) != "config" {
+			t.Fatalf("Missing parent directories must be created on %s: %q, %v", addr, got, err)
+		}
+	}
+}
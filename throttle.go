@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	globalUploadLimiter *rateLimiter // limit of total upload throughput of GoSSHa (-bwlimit)
+	connectLimiter      *rateLimiter // pace of new connections (-connect-rate), limiter counts connections instead of bytes
+)
+
+// rateLimiter limits throughput by delaying writes, so that on average no more than rate bytes
+// per second are written; nil rateLimiter means no limit
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate uint64    // bytes per second
+	next time.Time // time when next write can start
+}
+
+func newRateLimiter(rate uint64) *rateLimiter {
+	if rate == 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate}
+}
+
+// wait reserves time for writing n bytes and sleeps until the write can start
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(uint64(n) * uint64(time.Second) / l.rate))
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// parseByteRate parses bytes per second with optional K, M or G suffix (powers of 1024)
+func parseByteRate(s string) (uint64, error) {
+	rate, err := parseByteSize(s)
+	if err != nil {
+		return 0, errors.New("Invalid rate " + s + ", expected bytes per second with optional K, M or G suffix")
+	}
+	return rate, nil
+}
+
+// parseByteSize parses number of bytes with optional K, M or G suffix
+func parseByteSize(s string) (uint64, error) {
+	multiplier := uint64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	size, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, errors.New("Invalid size " + s + ", expected bytes with optional K, M or G suffix")
+	}
+	return size * multiplier, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Timing report ("Timing": true or -timing): every Reply gets time spent on TCP connection (through
+// jump hosts and proxy), key exchange, authentication and the action itself, and FinalReply gets
+// percentiles of them and the slowest hosts. Hosts which cached connection was reused only have
+// Exec time.
+
+const maxSlowestHosts = 10 // hosts listed in TimingSummary
+
+var (
+	timingDefault bool // report timing of every request (-timing)
+
+	connectTimingsMu sync.Mutex
+	connectTimings   = make(map[string]*connectTiming) // timing of the last connection established to host
+)
+
+type (
+	// HostTiming is time spent on host (in seconds)
+	HostTiming struct {
+		Hostname  string  `json:",omitempty"` // only set in TimingSummary
+		Dial      float64 // TCP connection to host, including jump hosts and proxy
+		Handshake float64 // key exchange
+		Auth      float64 // authentication
+		Exec      float64 // action itself
+		Total     float64
+		Reused    bool `json:",omitempty"` // cached connection was used, so there was no connection time
+	}
+
+	// TimingStats are percentiles of one of HostTiming values over all hosts (in seconds)
+	TimingStats struct {
+		P50, P90, P99, Max float64
+	}
+
+	// TimingSummary is sent in FinalReply when timing is reported
+	TimingSummary struct {
+		Dial, Handshake, Auth *TimingStats `json:",omitempty"` // only over hosts that were connected to
+		Exec, Total           *TimingStats
+		Slowest               []*HostTiming // hosts with the largest Total
+	}
+
+	// connectTiming records moments of establishing connection, zero times mean that stage was not reached
+	connectTiming struct {
+		hostname                            string // host of request that connect-ok and auth-ok events are sent for
+		start, connected, kexDone, authDone time.Time
+	}
+)
+
+// connectedConfig records that TCP connection is established and returns conf that records end of
+// key exchange in t (host key is checked right after it)
+func (t *connectTiming) connectedConfig(conf *ssh.ClientConfig) *ssh.ClientConfig {
+	if t == nil {
+		return conf
+	}
+	sendHostEvent(&HostEvent{Event: "connect-ok", Hostname: t.hostname})
+	if conf.HostKeyCallback == nil {
+		return conf
+	}
+	t.connected = time.Now()
+
+	timed := *conf
+	timed.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		t.kexDone = time.Now()
+		return conf.HostKeyCallback(hostname, remote, key)
+	}
+	return &timed
+}
+
+func (t *connectTiming) authenticated() {
+	if t != nil {
+		t.authDone = time.Now()
+		sendHostEvent(&HostEvent{Event: "auth-ok", Hostname: t.hostname})
+	}
+}
+
+func recordConnectTiming(hostname string, t *connectTiming) {
+	connectTimingsMu.Lock()
+	connectTimings[hostname] = t
+	connectTimingsMu.Unlock()
+}
+
+// hostTiming splits duration of action on host into stages using timing of connection established during it
+func hostTiming(hostname string, duration time.Duration, actionStart time.Time) *HostTiming {
+	connectTimingsMu.Lock()
+	t := connectTimings[hostname]
+	delete(connectTimings, hostname)
+	connectTimingsMu.Unlock()
+
+	res := &HostTiming{Total: duration.Seconds()}
+	if t == nil || t.start.Before(actionStart) || t.authDone.IsZero() {
+		res.Reused, res.Exec = true, res.Total
+		return res
+	}
+
+	res.Dial = t.connected.Sub(t.start).Seconds()
+	res.Handshake = t.kexDone.Sub(t.connected).Seconds()
+	res.Auth = t.authDone.Sub(t.kexDone).Seconds()
+	res.Exec = math.Max(0, res.Total-res.Dial-res.Handshake-res.Auth)
+	return res
+}
+
+// timingStats returns nearest-rank percentiles of values, nil if there are none
+func timingStats(values []float64) *TimingStats {
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Float64s(values)
+
+	rank := func(p float64) float64 {
+		return values[int(math.Ceil(p/100*float64(len(values))))-1]
+	}
+	return &TimingStats{P50: rank(50), P90: rank(90), P99: rank(99), Max: values[len(values)-1]}
+}
+
+// timingSummary computes percentiles and the slowest hosts from timings of hosts
+func timingSummary(timings []*HostTiming) *TimingSummary {
+	var dial, handshake, auth, exec, total []float64
+	for _, t := range timings {
+		if !t.Reused {
+			dial, handshake, auth = append(dial, t.Dial), append(handshake, t.Handshake), append(auth, t.Auth)
+		}
+		exec, total = append(exec, t.Exec), append(total, t.Total)
+	}
+
+	slowest := append([]*HostTiming(nil), timings...)
+	sort.SliceStable(slowest, func(i, j int) bool { return slowest[i].Total > slowest[j].Total })
+	if len(slowest) > maxSlowestHosts {
+		slowest = slowest[:maxSlowestHosts]
+	}
+
+	return &TimingSummary{
+		Dial:      timingStats(dial),
+		Handshake: timingStats(handshake),
+		Auth:      timingStats(auth),
+		Exec:      timingStats(exec),
+		Total:     timingStats(total),
+		Slowest:   slowest,
+	}
+}
+
+// writeTimingSummary prints summary as a table for -output text
+func writeTimingSummary(w io.Writer, s *TimingSummary) {
+	fmt.Fprintf(w, "=== timing (s)  %8s %8s %8s %8s\n", "p50", "p90", "p99", "max")
+	for _, row := range []struct {
+		name  string
+		stats *TimingStats
+	}{{"dial", s.Dial}, {"handshake", s.Handshake}, {"auth", s.Auth}, {"exec", s.Exec}, {"total", s.Total}} {
+		if row.stats != nil {
+			fmt.Fprintf(w, "  %-13s %8.3f %8.3f %8.3f %8.3f\n", row.name, row.stats.P50, row.stats.P90, row.stats.P99, row.stats.Max)
+		}
+	}
+
+	fmt.Fprintln(w, "=== slowest hosts")
+	for _, t := range s.Slowest {
+		if t.Reused {
+			fmt.Fprintf(w, "  %s: total %.3f (connection reused)\n", t.Hostname, t.Total)
+		} else {
+			fmt.Fprintf(w, "  %s: total %.3f, dial %.3f, handshake %.3f, auth %.3f, exec %.3f\n", t.Hostname, t.Total, t.Dial, t.Handshake, t.Auth, t.Exec)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTimingStats(t *testing.T) {
+	values := []float64{10, 1, 9, 2, 8, 3, 7, 4, 6, 5}
+	if s := timingStats(values); !reflect.DeepEqual(s, &TimingStats{P50: 5, P90: 9, P99: 10, Max: 10}) {
+		t.Fatalf("Unexpected stats: %+v", s)
+	}
+	if s := timingStats(nil); s != nil {
+		t.Fatalf("No stats expected without values: %+v", s)
+	}
+}
+
+func TestTiming(t *testing.T) {
+	r := makeTestResult()
+	startTestServers(r, "test-timing", 3)
+
+	run := func() {
+		req := makeProxyRequest(maxTimeout)
+		req.Timing = true
+		for addr := range r.hosts {
+			r.hostsLeft[addr] = struct{}{}
+		}
+		runTestRequest(t, r, req)
+	}
+
+	for _, reused := range []bool{false, true} {
+		run()
+
+		for addr, reply := range r.replies {
+			timing := reply.Timing
+			if timing == nil || timing.Reused != reused || timing.Hostname != "" || timing.Total < timing.Exec {
+				t.Fatalf("Unexpected timing of %s (reused: %v): %+v", addr, reused, timing)
+			}
+			if !reused && (timing.Dial <= 0 || timing.Handshake <= 0 || timing.Auth <= 0) {
+				t.Fatalf("Connection stages of %s were not measured: %+v", addr, timing)
+			}
+		}
+
+		s := r.final.Timing
+		if s == nil || len(s.Slowest) != 3 || s.Slowest[0].Hostname == "" || s.Total == nil || (s.Dial == nil) != reused {
+			t.Fatalf("Unexpected timing summary (reused: %v): %+v", reused, s)
+		}
+	}
+}
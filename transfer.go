@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/YuriyNasretdinov/GoSSHa/gossha"
+	"golang.org/x/crypto/ssh"
+)
+
+// Transfer backends ("Transfer": "<backend>", gossha_transfer inventory variable or -transfer, in
+// order of precedence): "sftp" uploads over SFTP subsystem and supports every upload option, "scp"
+// speaks protocol of classic scp (runs "scp -t" on host) for appliances without SFTP, and "cat" pipes
+// contents to cat(1) through remote shell for hosts that have neither. "auto" (the default) uses SFTP
+// if the host supports it, then scp, then cat, and remembers the choice for the host until GoSSHa
+// exits. scp and cat upload regular files only: directory uploads, Verify, SkipUnchanged,
+// ChangeReport and Sudo require SFTP, as do Owner with scp and Preserve with cat. Parallel, Resume,
+// Delta and Compress are optimizations of SFTP uploads and are ignored by other backends. scp writes
+// target in place, cat writes it to a temporary file that replaces target like SFTP uploads do.
+// Downloads always use SFTP.
+
+const (
+	transferAuto = "auto"
+	transferSftp = "sftp"
+	transferScp  = "scp"
+	transferCat  = "cat"
+)
+
+var (
+	transferDefault = transferAuto // -transfer
+
+	negotiatedTransfers sync.Map // backends chosen for hosts in "auto" mode, by hostname
+)
+
+// transfer uploads files to a host
+type transfer interface {
+	name() string
+	// mkdirAll creates directory dir and its parents
+	mkdirAll(dir string) error
+	// writeFile uploads contents of entry to target and sets attrs of it
+	writeFile(target string, entry *uploadEntry, attrs *sftpAttrs, opts *uploadOptions, progress *transferProgress, limiters []*rateLimiter) error
+	Close() error
+}
+
+type (
+	sftpTransfer struct {
+		conn   *ssh.Client
+		client *sftpClient
+	}
+
+	scpTransfer struct{ conn *ssh.Client }
+
+	catTransfer struct{ conn *ssh.Client }
+)
+
+// checkTransfer validates name of transfer backend
+func checkTransfer(name string) error {
+	switch name {
+	case transferAuto, transferSftp, transferScp, transferCat:
+		return nil
+	}
+	return errors.New("Invalid transfer " + name + ": must be auto, sftp, scp or cat")
+}
+
+// openTransfer returns backend of requested transfer (empty if it is not specified in request) for hostname
+func openTransfer(conn *ssh.Client, hostname, requested string) (transfer, error) {
+	name := requested
+	if name == "" {
+		name = hostOptionsOf(hostname).transfer
+	}
+	if name == "" {
+		name = transferDefault
+	}
+
+	if name == transferAuto {
+		if negotiated, ok := negotiatedTransfers.Load(hostname); ok {
+			name = negotiated.(string)
+		}
+	}
+
+	switch name {
+	case transferScp:
+		return &scpTransfer{conn}, nil
+	case transferCat:
+		return &catTransfer{conn}, nil
+	}
+
+	client, err := newSftpClient(conn)
+	if err == nil {
+		negotiatedTransfers.Store(hostname, transferSftp)
+		return &sftpTransfer{conn, client}, nil
+	}
+	var retryable *retryableError
+	if name == transferSftp || errors.As(err, &retryable) {
+		return nil, err
+	}
+
+	logf(logInfo, hostname, "SFTP is not available (%s), trying scp", err)
+	t := transfer(&scpTransfer{conn})
+	if err := probeScp(conn); err != nil {
+		var retryable *retryableError
+		if errors.As(err, &retryable) {
+			return nil, err
+		}
+		logf(logInfo, hostname, "scp is not available (%s), using cat", err)
+		t = &catTransfer{conn}
+	}
+	negotiatedTransfers.Store(hostname, t.name())
+	return t, nil
+}
+
+// checkTransferOptions returns error if upload needs options that t does not support
+func checkTransferOptions(t transfer, target string, opts *uploadOptions, isDirUpload bool) error {
+	if _, ok := t.(*sftpTransfer); ok {
+		return nil
+	}
+	if isDirUpload {
+		return errors.New("Directory " + target + " cannot be uploaded with " + t.name() + " transfer, SFTP is required")
+	}
+
+	_, isScp := t.(*scpTransfer)
+	for _, o := range []struct {
+		set  bool
+		name string
+	}{
+		{opts.verify, "Verify"},
+		{opts.skipUnchanged, "SkipUnchanged"},
+		{opts.changeReport, "ChangeReport"},
+		{opts.sudo, "Sudo"},
+		{isScp && opts.attrs.Flags&sshFileXferAttrUIDGID != 0, "Owner"},
+		{!isScp && opts.preserve, "Preserve"},
+	} {
+		if o.set {
+			return errors.New("'" + o.name + "' is not supported with " + t.name() + " transfer, SFTP is required")
+		}
+	}
+	return nil
+}
+
+// writeEntry writes contents of entry to w, making sure that all of it was written
+func writeEntry(w io.Writer, entry *uploadEntry, progress *transferProgress, limiters []*rateLimiter) error {
+	r, err := entry.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	written, err := copyChunks(w, r, entry, progress, limiters)
+	if err != nil {
+		return err
+	}
+	if written != entry.size {
+		return fmt.Errorf("Size of %s changed during upload: expected %d bytes, read %d", entry.localPath, entry.size, written)
+	}
+	return nil
+}
+
+func (t *sftpTransfer) name() string { return transferSftp }
+
+func (t *sftpTransfer) mkdirAll(dir string) error { return t.client.MkdirAll(dir) }
+
+func (t *sftpTransfer) writeFile(target string, entry *uploadEntry, attrs *sftpAttrs, opts *uploadOptions, progress *transferProgress, limiters []*rateLimiter) error {
+	if opts.sudo {
+		return installRemoteFileSudo(t.conn, t.client, target, entry, attrs, opts, progress, limiters)
+	}
+	return uploadRemoteFile(t.conn, t.client, target, entry, attrs, opts, progress, limiters)
+}
+
+func (t *sftpTransfer) Close() error { return t.client.Close() }
+
+// scpSession is "scp -t" started on remote side
+type scpSession struct {
+	session *ssh.Session
+	w       io.WriteCloser
+	r       *bufio.Reader
+	stderr  bytes.Buffer
+	closed  bool
+}
+
+// startScp runs "scp -t" with flags and target and waits for it to become ready
+func startScp(conn *ssh.Client, flags, target string) (s *scpSession, err error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, &retryableError{err}
+	}
+	s = &scpSession{session: session}
+	session.Stderr = &s.stderr
+	defer func() {
+		if err != nil {
+			session.Close()
+		}
+	}()
+
+	if s.w, err = session.StdinPipe(); err != nil {
+		return
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return
+	}
+	s.r = bufio.NewReader(stdout)
+
+	if err = session.Start("scp " + flags + " -- " + shellQuote(target)); err != nil {
+		return
+	}
+	metricActiveSessions.add(1)
+	if err = s.ack(); err != nil {
+		s.Close()
+	}
+	return s, err
+}
+
+// ack reads response to the last record: zero byte or error message
+func (s *scpSession) ack() error {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		// stderr is complete only after scp exits
+		if err := s.Close(); err != nil {
+			return err
+		}
+		return errors.New("scp exited unexpectedly")
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := s.r.ReadString('\n')
+	return errors.New("scp: " + strings.TrimSpace(msg))
+}
+
+// send writes record and reads response to it
+func (s *scpSession) send(format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(s.w, format, args...); err != nil {
+		return err
+	}
+	return s.ack()
+}
+
+// Close ends the session, scp exits when its input is closed
+func (s *scpSession) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.w.Close()
+	err := s.session.Wait()
+	s.session.Close()
+	metricActiveSessions.add(-1)
+	if err != nil {
+		if msg := strings.TrimSpace(s.stderr.String()); msg != "" {
+			return errors.New("scp: " + msg)
+		}
+	}
+	return err
+}
+
+// probeScp checks that host can receive files with scp
+func probeScp(conn *ssh.Client) error {
+	s, err := startScp(conn, "-t", ".")
+	if err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+func (t *scpTransfer) name() string { return transferScp }
+
+// mkdirAll sends directory records for every element of dir, scp creates ones that do not exist
+func (t *scpTransfer) mkdirAll(dir string) error {
+	root, dir := ".", path.Clean(dir)
+	if strings.HasPrefix(dir, "/") {
+		root, dir = "/", strings.TrimPrefix(dir, "/")
+	}
+	if dir == "" || dir == "." {
+		return nil
+	}
+
+	s, err := startScp(t.conn, "-r -t", root)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	elems := strings.Split(dir, "/")
+	for _, elem := range elems {
+		if err := s.send("D0755 0 %s\n", elem); err != nil {
+			return err
+		}
+	}
+	for range elems {
+		if err := s.send("E\n"); err != nil {
+			return err
+		}
+	}
+	return s.Close()
+}
+
+func (t *scpTransfer) writeFile(target string, entry *uploadEntry, attrs *sftpAttrs, opts *uploadOptions, progress *transferProgress, limiters []*rateLimiter) error {
+	perm := uint32(0644)
+	if attrs.Flags&sshFileXferAttrPermissions != 0 {
+		perm = attrs.Perm & 07777
+	}
+	flags := "-t"
+	if attrs.Flags&sshFileXferAttrACModTime != 0 {
+		flags = "-p -t"
+	}
+
+	s, err := startScp(t.conn, flags, target)
+	if err != nil {
+		return errors.New("Cannot upload " + target + ": " + err.Error())
+	}
+	defer s.Close()
+
+	if attrs.Flags&sshFileXferAttrACModTime != 0 {
+		if err := s.send("T%d 0 %d 0\n", attrs.Mtime, attrs.Atime); err != nil {
+			return errors.New("Cannot upload " + target + ": " + err.Error())
+		}
+	}
+	if err := s.send("C%04o %d %s\n", perm, entry.size, path.Base(target)); err != nil {
+		return errors.New("Cannot upload " + target + ": " + err.Error())
+	}
+	if err := writeEntry(s.w, entry, progress, limiters); err != nil {
+		return err
+	}
+	if err := s.send("\x00"); err != nil {
+		return errors.New("Cannot upload " + target + ": " + err.Error())
+	}
+	if err := s.Close(); err != nil {
+		return errors.New("Cannot upload " + target + ": " + err.Error())
+	}
+	return nil
+}
+
+func (t *scpTransfer) Close() error { return nil }
+
+func (t *catTransfer) name() string { return transferCat }
+
+// combinedOutput collects stdout and stderr of session, which are copied by different goroutines
+type combinedOutput struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (o *combinedOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.Write(p)
+}
+
+func (o *combinedOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.String()
+}
+
+// run executes script with stdin written by write, output of failed script is returned as error
+func (t *catTransfer) run(script string, write func(io.Writer) error) error {
+	session, err := t.conn.NewSession()
+	if err != nil {
+		return &retryableError{err}
+	}
+	defer session.Close()
+
+	metricActiveSessions.add(1)
+	defer metricActiveSessions.add(-1)
+
+	output := &combinedOutput{}
+	session.Stdout, session.Stderr = output, output
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.Start(script); err != nil {
+		return err
+	}
+
+	if write != nil {
+		if err := write(stdin); err != nil {
+			return err
+		}
+	}
+	stdin.Close()
+
+	if err := session.Wait(); err != nil {
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			return errors.New(msg)
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *catTransfer) mkdirAll(dir string) error {
+	return t.run("mkdir -p -- "+shellQuote(dir), nil)
+}
+
+func (t *catTransfer) writeFile(target string, entry *uploadEntry, attrs *sftpAttrs, opts *uploadOptions, progress *transferProgress, limiters []*rateLimiter) error {
+	tmpPath := target
+	if !inplaceUploads {
+		tmpPath = target + uploadTmpSuffix
+	}
+
+	mode, uid, gid := -1, -1, -1
+	if attrs.Flags&sshFileXferAttrPermissions != 0 {
+		mode = int(attrs.Perm & 07777)
+	}
+	if attrs.Flags&sshFileXferAttrUIDGID != 0 {
+		uid, gid = int(attrs.UID), int(attrs.GID)
+	}
+
+	err := t.run(gossha.UploadScript(target, tmpPath, mode, uid, gid), func(w io.Writer) error { return writeEntry(w, entry, progress, limiters) })
+	if err != nil {
+		return errors.New("Cannot upload " + target + ": " + err.Error())
+	}
+	return nil
+}
+
+func (t *catTransfer) Close() error { return nil }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTransferBackends(t *testing.T) {
+	for _, backend := range []string{transferScp, transferCat} {
+		r := makeTestResult()
+		startTestServers(r, "test-transfer-"+backend, 2)
+		runTestRequest(t, r, &ProxyRequest{Action: "scp", Source: dataSource, Data: []byte("key=value\n"), Target: "etc/app/app.conf", Mode: "0640", Transfer: backend})
+
+		for addr, srv := range r.hosts {
+			name := filepath.Join(srv.root, "etc/app/app.conf")
+			if got, err := ioutil.ReadFile(name); err != nil || string(got) != "key=value\n" {
+				t.Fatalf("Unexpected contents uploaded with %s to %s: %q, %v", backend, addr, got, err)
+			}
+			if fi, err := os.Stat(name); err != nil || fi.Mode().Perm() != 0640 {
+				t.Fatalf("Unexpected mode of file uploaded with %s to %s: %v, %v", backend, addr, fi.Mode(), err)
+			}
+			if tmp, _ := filepath.Glob(filepath.Join(srv.root, "etc/app/*"+uploadTmpSuffix)); len(tmp) > 0 {
+				t.Fatalf("Temporary files are left on %s: %v", addr, tmp)
+			}
+		}
+
+		r = makeTestResult()
+		startTestServers(r, "test-transfer-verify-"+backend, 1)
+		req := &ProxyRequest{Action: "scp", Source: dataSource, Data: []byte("x"), Target: "x", Verify: true, Transfer: backend}
+		sendTestRequest(t, r, req)
+		for addr, reply := range r.replies {
+			if reply.Success || !strings.Contains(reply.ErrMsg, "'Verify' is not supported with "+backend) {
+				t.Fatalf("Expected Verify to be rejected with %s on %s: %+v", backend, addr, reply)
+			}
+		}
+	}
+}
+
+func TestTransferNegotiation(t *testing.T) {
+	r := makeTestResult()
+	srv := &testSSHServer{hostname: "test-transfer-auto", noSftp: true}
+	srv.start()
+	r.hosts[srv.addr] = srv
+	r.hostsLeft[srv.addr] = struct{}{}
+
+	runTestRequest(t, r, &ProxyRequest{Action: "scp", Source: dataSource, Data: []byte("hello\n"), Target: "hello.txt"})
+	if got, err := ioutil.ReadFile(filepath.Join(srv.root, "hello.txt")); err != nil || string(got) != "hello\n" {
+		t.Fatalf("Unexpected contents: %q, %v", got, err)
+	}
+	if backend, _ := negotiatedTransfers.Load(srv.addr); backend != transferScp {
+		t.Fatalf("Expected scp to be used without SFTP, got %v", backend)
+	}
+
+	if err := checkTransfer("rsync"); err == nil {
+		t.Fatalf("Expected unknown transfer to be rejected")
+	}
+}
+
+func TestHostileUploadTargets(t *testing.T) {
+	binDir, err := ioutil.TempDir("", "gossha-sudo")
+	must(err, "Could not create bin dir")
+	defer os.RemoveAll(binDir)
+	must(ioutil.WriteFile(filepath.Join(binDir, "sudo"), []byte(fakeSudo), 0755), "Could not write fake sudo")
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", binDir+":"+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	names := []string{"x; touch pwned", "$(touch pwned)", "`touch pwned`", "a'b\"c", "-rf", "x && touch pwned #"}
+	owner := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+
+	for _, backend := range []string{transferSftp, transferScp, transferCat, "sudo"} {
+		for _, name := range names {
+			r := makeTestResult()
+			startTestServers(r, "test-hostile-"+backend, 1)
+			req := &ProxyRequest{Action: "scp", Source: dataSource, Data: []byte("data\n"), Target: name, Mode: "0600", Transfer: backend}
+			if backend == "sudo" {
+				req.Transfer, req.Sudo, req.Owner, req.SudoPassword = "", true, owner, "secret"
+			}
+			runTestRequest(t, r, req)
+
+			for addr, srv := range r.hosts {
+				if got, err := ioutil.ReadFile(filepath.Join(srv.root, name)); err != nil || string(got) != "data\n" {
+					t.Fatalf("Unexpected contents of %q uploaded with %s to %s: %q, %v", name, backend, addr, got, err)
+				}
+				if _, err := os.Stat(filepath.Join(srv.root, "pwned")); err == nil {
+					t.Fatalf("Target %q uploaded with %s ran a command on %s", name, backend, addr)
+				}
+			}
+		}
+	}
+
+	// names of uploaded local files are not interpreted either
+	dir, err := ioutil.TempDir("", "gossha-hostile")
+	must(err, "Could not create source dir")
+	defer os.RemoveAll(dir)
+	for _, name := range names {
+		must(ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644), "Could not write source file")
+	}
+	for _, backend := range []string{transferSftp, transferScp, transferCat} {
+		r := makeTestResult()
+		startTestServers(r, "test-hostile-files-"+backend, 1)
+		runTestRequest(t, r, &ProxyRequest{Action: "scp", Source: filepath.Join(dir, "*"), Target: "$(touch pwned)", Transfer: backend})
+		for addr, srv := range r.hosts {
+			for _, name := range names {
+				if got, err := ioutil.ReadFile(filepath.Join(srv.root, "$(touch pwned)", name)); err != nil || string(got) != name {
+					t.Fatalf("Unexpected contents of %q uploaded with %s to %s: %q, %v", name, backend, addr, got, err)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(srv.root, "pwned")); err == nil {
+				t.Fatalf("Files uploaded with %s ran a command on %s", backend, addr)
+			}
+		}
+	}
+}
+
+func TestCheckRemotePath(t *testing.T) {
+	for p, valid := range map[string]bool{
+		"/etc/app.conf":   true,
+		"x; rm -rf /":     true, // quoted for remote shell
+		"":                false,
+		"a\nC0644 1 evil": false,
+		"a\rb":            false,
+		"a\x00b":          false,
+	} {
+		if err := checkRemotePath("Target", p); (err == nil) != valid {
+			t.Errorf("Unexpected result of checking %q: %v", p, err)
+		}
+	}
+
+	for p, safe := range map[string]bool{"/srv/app-1.2_x+y.tar.gz": true, "a b": false, "a;b": false, "host:path": false, "$(id)": false, "": false} {
+		if isRelaySafePath(p) != safe {
+			t.Errorf("Unexpected relay safety of %q", p)
+		}
+	}
+}
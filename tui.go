@@ -0,0 +1,656 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Terminal UI (-tui): requests are read from stdin as usual, but instead of printing replies
+// a live table of hosts of the current action with their status is shown on the terminal
+// (/dev/tty), and output of a selected host can be scrolled and searched. Keys are read from
+// /dev/tty as well, ISIG is kept, so that Ctrl-C cancels running action as usual.
+
+var tuiMode bool // show results in terminal UI (-tui)
+
+const tuiRefreshInterval = 100 * time.Millisecond // how often screen is redrawn while replies arrive
+
+const tuiHelp = "Up/Down select  Enter show output  / search  n next match  q quit"
+
+type (
+	// actionStarted is sent to TUI before action is started on hosts
+	actionStarted struct {
+		description string
+		hosts       []string
+	}
+
+	// hostStarted is sent to TUI when action is started on host
+	hostStarted struct {
+		hostname string
+	}
+
+	tuiHost struct {
+		hostname string
+		status   string // pending, connecting, running, ok, failed, timed out, cancelled or skipped
+		reply    *Reply
+		output   string // output that was streamed so far
+		transfer *TransferProgress
+		version  int // incremented on every change, so that lines of shown output are rebuilt
+	}
+
+	tuiScreen struct {
+		width, height int
+
+		description string
+		started     time.Time
+		total       float64 // time of the whole action after it finished
+		finished    bool
+		hosts       []*tuiHost
+		byName      map[string]*tuiHost
+		connected   map[string]bool // hosts (without port) that had connections established
+
+		selected, top int // selected host and the first shown one in table
+
+		view        *tuiHost // host whose output is shown, nil in table
+		viewLines   []string
+		viewVersion int
+		offset      int // first shown line of output
+
+		search    string
+		searching bool   // search is being typed
+		message   string // last error
+	}
+
+	tuiTerminal struct {
+		tty       *os.File
+		saved     string // stty settings to restore
+		altScreen bool   // alternate screen is shown and must be left on restore
+		once      sync.Once
+	}
+)
+
+var activeTerminal *tuiTerminal // terminal that is restored before exit, nil without TUI
+
+func newTUIScreen(width, height int) *tuiScreen {
+	return &tuiScreen{width: width, height: height, byName: make(map[string]*tuiHost), connected: make(map[string]bool)}
+}
+
+// openTerminal switches /dev/tty to non-canonical mode without echo and to alternate screen
+func openTerminal() (*tuiTerminal, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.New("Cannot open terminal: " + err.Error())
+	}
+
+	t := &tuiTerminal{tty: tty, altScreen: true}
+	if t.saved, err = t.stty("-g"); err == nil {
+		_, err = t.stty("-icanon", "-echo", "min", "1")
+	}
+	if err != nil {
+		tty.Close()
+		return nil, errors.New("Cannot set up terminal: " + err.Error())
+	}
+
+	io.WriteString(tty, "\x1b[?1049h\x1b[?25l")
+	return t, nil
+}
+
+func (t *tuiTerminal) stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = t.tty
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// size returns terminal size, 80x24 is used if it is unknown
+func (t *tuiTerminal) size() (width, height int) {
+	width, height = 80, 24
+	if out, err := t.stty("size"); err == nil {
+		if f := strings.Fields(out); len(f) == 2 {
+			if h, err := strconv.Atoi(f[0]); err == nil && h > 0 {
+				height = h
+			}
+			if w, err := strconv.Atoi(f[1]); err == nil && w > 0 {
+				width = w
+			}
+		}
+	}
+	return
+}
+
+// restore returns terminal to the state it was in before TUI was started
+func (t *tuiTerminal) restore() {
+	if t == nil {
+		return
+	}
+
+	t.once.Do(func() {
+		if t.altScreen {
+			io.WriteString(t.tty, "\x1b[?25h\x1b[?1049l")
+		}
+		t.stty(t.saved)
+	})
+}
+
+// readKeys sends key presses to keys: special keys are "up", "down", "pgup", "pgdn", "home",
+// "end", "enter", "esc" and "backspace", other keys are sent as typed
+func (t *tuiTerminal) readKeys(keys chan<- string) {
+	buf := make([]byte, 64)
+	for {
+		n, err := t.tty.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for _, key := range parseKeys(buf[:n]) {
+			keys <- key
+		}
+	}
+}
+
+var escapeKeys = map[string]string{
+	"[A": "up", "[B": "down", "OA": "up", "OB": "down",
+	"[5~": "pgup", "[6~": "pgdn",
+	"[H": "home", "[F": "end", "OH": "home", "OF": "end", "[1~": "home", "[4~": "end",
+}
+
+// parseKeys splits input read from terminal at once into keys
+func parseKeys(in []byte) (keys []string) {
+	s := string(in)
+	for s != "" {
+		switch {
+		case s[0] == 0x1b:
+			key := "esc"
+			s = s[1:]
+			for seq, k := range escapeKeys {
+				if strings.HasPrefix(s, seq) {
+					key, s = k, s[len(seq):]
+					break
+				}
+			}
+			keys = append(keys, key)
+			continue
+		case s[0] == '\r' || s[0] == '\n':
+			keys = append(keys, "enter")
+		case s[0] == 0x7f || s[0] == 0x08:
+			keys = append(keys, "backspace")
+		default:
+			r := []rune(s)[0]
+			keys = append(keys, string(r))
+			s = s[len(string(r)):]
+			continue
+		}
+		s = s[1:]
+	}
+	return
+}
+
+// tuiReplierThread shows replies in terminal, it never returns
+func tuiReplierThread(t *tuiTerminal) {
+	width, height := t.size()
+	screen := newTUIScreen(width, height)
+
+	keys := make(chan string, 64)
+	go t.readKeys(keys)
+
+	resized := make(chan os.Signal, 1)
+	notifyResize(resized)
+
+	ticker := time.NewTicker(tuiRefreshInterval)
+	defer ticker.Stop()
+
+	draw := func() { io.WriteString(t.tty, screen.render()) }
+	draw()
+
+	dirty := false
+	for {
+		select {
+		case reply := <-repliesChan:
+			screen.handleReply(reply)
+			dirty = true
+		case key := <-keys:
+			if !screen.handleKey(key) {
+				t.restore()
+				os.Exit(0)
+			}
+			draw()
+		case <-resized:
+			screen.width, screen.height = t.size()
+			draw()
+		case <-ticker.C:
+			// elapsed time changes while action is running
+			if dirty || (!screen.finished && !screen.started.IsZero()) {
+				draw()
+				dirty = false
+			}
+		}
+	}
+}
+
+func (s *tuiScreen) host(hostname string) *tuiHost {
+	h, ok := s.byName[hostname]
+	if !ok {
+		h = &tuiHost{hostname: hostname, status: "pending"}
+		s.byName[hostname] = h
+		s.hosts = append(s.hosts, h)
+	}
+	return h
+}
+
+func (s *tuiScreen) setStatus(hostname, status string) {
+	h := s.host(hostname)
+	h.status = status
+	h.version++
+}
+
+func (s *tuiScreen) handleReply(reply interface{}) {
+	switch reply := reply.(type) {
+	case *actionStarted:
+		*s = tuiScreen{width: s.width, height: s.height, byName: make(map[string]*tuiHost), connected: s.connected, started: time.Now()}
+		s.description = strings.TrimSuffix(reply.description, "\n")
+		for _, h := range reply.hosts {
+			s.host(h)
+		}
+	case *hostStarted:
+		host, _ := splitHostPort(reply.hostname)
+		if s.connected[host] {
+			s.setStatus(reply.hostname, "running")
+		} else {
+			s.setStatus(reply.hostname, "connecting")
+		}
+	case *ConnectionProgress:
+		s.connected[reply.ConnectedHost] = true
+		for _, h := range s.hosts {
+			if host, _ := splitHostPort(h.hostname); host == reply.ConnectedHost && h.status == "connecting" {
+				s.setStatus(h.hostname, "running")
+			}
+		}
+	case *OutputChunk:
+		h := s.host(reply.Hostname)
+		h.output += reply.Data
+		h.version++
+	case *TransferProgress:
+		h := s.host(reply.Hostname)
+		h.transfer = reply
+		h.version++
+	case *Reply:
+		s.setReply(reply)
+	case *GroupedReply:
+		for _, hostname := range reply.Hosts {
+			s.setReply(&Reply{Hostname: hostname, Stdout: reply.Stdout, Stderr: reply.Stderr, Success: reply.Success, ErrMsg: reply.ErrMsg, ExitCode: reply.ExitCode, Unchanged: reply.Unchanged, Skipped: reply.Skipped})
+		}
+	case *FinalReply:
+		for hostname := range reply.TimedOutHosts {
+			s.setStatus(hostname, "timed out")
+		}
+		for _, hostname := range reply.PendingHosts {
+			s.setStatus(hostname, "cancelled")
+		}
+		for _, hostname := range reply.SkippedHosts {
+			s.setStatus(hostname, "skipped")
+		}
+		s.finished, s.total = true, reply.TotalTime
+	case *UserError:
+		s.message = "Error: " + reply.ErrorMsg
+	case *PasswordRequest:
+		s.message = "Passphrase for " + reply.PasswordFor + " is expected on stdin"
+	case *ConfirmationRequest:
+		if reply.Reason != "" {
+			s.message = fmt.Sprintf("%s, send {\"Confirm\":true} on stdin to start on %d host(s)", reply.Reason, reply.Remaining)
+			break
+		}
+		s.message = fmt.Sprintf("Canary succeeded, send {\"Confirm\":true} on stdin to continue on %d remaining host(s)", reply.Remaining)
+	case *HostKeyRequest:
+		s.message = "Unknown host key of " + reply.Hostname + " " + reply.Fingerprint + ", send {\"AcceptHostKey\":true} on stdin to trust it"
+	case *ChallengeRequest:
+		s.message = "Answers to challenge of " + reply.Hostname + " are expected on stdin"
+	}
+}
+
+func (s *tuiScreen) setReply(reply *Reply) {
+	h := s.host(reply.Hostname)
+	h.reply = reply
+	h.status = "ok"
+	if reply.Skipped {
+		h.status = "skipped"
+	}
+	if !reply.Success {
+		h.status = "failed"
+	}
+	h.version++
+}
+
+// handleKey changes state of screen after key press, it returns false if TUI must be closed
+func (s *tuiScreen) handleKey(key string) bool {
+	s.message = "" // messages are shown until the next key press
+
+	if s.searching {
+		switch key {
+		case "enter":
+			s.searching = false
+			s.findNext()
+		case "esc":
+			s.searching, s.search = false, ""
+		case "backspace":
+			if r := []rune(s.search); len(r) > 0 {
+				s.search = string(r[:len(r)-1])
+			}
+		default:
+			if len([]rune(key)) == 1 {
+				s.search += key
+			}
+		}
+		return true
+	}
+
+	page := s.height - 3
+	if page < 1 {
+		page = 1
+	}
+
+	switch key {
+	case "q":
+		if s.view == nil {
+			return false
+		}
+		s.view = nil
+	case "esc":
+		s.view = nil
+	case "/":
+		s.searching, s.search = true, ""
+	case "n":
+		s.findNext()
+	case "enter":
+		if s.view == nil && s.selected < len(s.hosts) {
+			s.view, s.offset, s.viewLines = s.hosts[s.selected], 0, nil
+		}
+	case "up", "k":
+		s.move(-1)
+	case "down", "j":
+		s.move(1)
+	case "pgup":
+		s.move(-page)
+	case "pgdn", " ":
+		s.move(page)
+	case "home", "g":
+		s.move(-1 << 30)
+	case "end", "G":
+		s.move(1 << 30)
+	}
+	return true
+}
+
+// move moves selection in table or scrolls output by delta lines
+func (s *tuiScreen) move(delta int) {
+	if s.view != nil {
+		s.offset = clampInt(s.offset+delta, 0, len(s.outputLines())-(s.height-2))
+		return
+	}
+	s.selected = clampInt(s.selected+delta, 0, len(s.hosts)-1)
+}
+
+func clampInt(v, min, max int) int {
+	if v > max {
+		v = max
+	}
+	if v < min {
+		v = min
+	}
+	return v
+}
+
+// findNext selects next host (or output line) after the current one that contains search text
+func (s *tuiScreen) findNext() {
+	if s.search == "" {
+		return
+	}
+	needle := strings.ToLower(s.search)
+
+	if s.view != nil {
+		lines := s.outputLines()
+		for i := 1; i <= len(lines); i++ {
+			idx := (s.offset + i) % len(lines)
+			if strings.Contains(strings.ToLower(lines[idx]), needle) {
+				s.offset = idx
+				return
+			}
+		}
+		s.message = "Not found: " + s.search
+		return
+	}
+
+	for i := 1; i <= len(s.hosts); i++ {
+		idx := (s.selected + i) % len(s.hosts)
+		h := s.hosts[idx]
+		if strings.Contains(strings.ToLower(h.hostname), needle) || strings.Contains(strings.ToLower(strings.Join(hostOutputLines(h), "\n")), needle) {
+			s.selected = idx
+			return
+		}
+	}
+	s.message = "Not found: " + s.search
+}
+
+// hostOutputLines returns full output of host split into lines
+func hostOutputLines(h *tuiHost) (lines []string) {
+	addLines := func(out string) {
+		if out != "" {
+			lines = append(lines, strings.Split(strings.TrimSuffix(out, "\n"), "\n")...)
+		}
+	}
+
+	if h.reply == nil {
+		addLines(h.output)
+		return
+	}
+
+	addLines(h.reply.Stdout)
+	if h.reply.Stderr != "" {
+		lines = append(lines, "--- stderr:")
+		addLines(h.reply.Stderr)
+	}
+	if h.reply.ErrMsg != "" {
+		lines = append(lines, "--- error: "+h.reply.ErrMsg)
+	}
+	return
+}
+
+func (s *tuiScreen) outputLines() []string {
+	if s.viewLines == nil || s.viewVersion != s.view.version {
+		s.viewLines, s.viewVersion = hostOutputLines(s.view), s.view.version
+	}
+	return s.viewLines
+}
+
+// summary returns last line of output or error of host for the table
+func (h *tuiHost) summary() string {
+	if h.transfer != nil && h.reply == nil {
+		return fmt.Sprintf("uploaded %d of %d bytes", h.transfer.Bytes, h.transfer.TotalBytes)
+	}
+	if h.reply != nil && h.reply.ErrMsg != "" {
+		return h.reply.ErrMsg
+	}
+
+	lines := hostOutputLines(h)
+	if len(lines) == 0 {
+		return ""
+	}
+	return lines[len(lines)-1]
+}
+
+// tuiSanitize replaces control characters, so that output cannot change state of terminal
+func tuiSanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return ' '
+		}
+		if r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0) {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// fitLine sanitizes s and pads or truncates it to width characters
+func fitLine(s string, width int) string {
+	r := []rune(tuiSanitize(s))
+	if len(r) > width {
+		return string(r[:width])
+	}
+	return string(r) + strings.Repeat(" ", width-len(r))
+}
+
+var tuiStatusColors = map[string]string{
+	"ok":         "\x1b[32m",
+	"failed":     "\x1b[31m",
+	"timed out":  "\x1b[31m",
+	"running":    "\x1b[33m",
+	"connecting": "\x1b[33m",
+}
+
+// render returns escape sequences that redraw the whole screen
+func (s *tuiScreen) render() string {
+	var lines []string
+	if s.view != nil {
+		lines = s.renderOutput()
+	} else {
+		lines = s.renderTable()
+	}
+
+	bottom := tuiHelp
+	if s.view != nil {
+		bottom = "Up/Down/PgUp/PgDn scroll  / search  n next match  Esc back"
+	}
+	if s.message != "" {
+		bottom = s.message
+	}
+	if s.searching {
+		bottom = "/" + s.search
+	}
+
+	var buf strings.Builder
+	buf.WriteString("\x1b[H")
+	for i := 0; i < s.height-1; i++ {
+		if i < len(lines) {
+			buf.WriteString(lines[i])
+		}
+		buf.WriteString("\x1b[K\r\n")
+	}
+	buf.WriteString("\x1b[7m" + fitLine(bottom, s.width) + "\x1b[0m")
+	return buf.String()
+}
+
+func (s *tuiScreen) renderTable() []string {
+	counts := make(map[string]int)
+	for _, h := range s.hosts {
+		counts[h.status]++
+	}
+
+	elapsed := s.total
+	if !s.finished && !s.started.IsZero() {
+		elapsed = time.Since(s.started).Seconds()
+	}
+
+	description := s.description
+	if idx := strings.IndexByte(description, '\n'); idx >= 0 {
+		description = description[:idx] + " ..."
+	}
+	if description == "" {
+		description = "Waiting for requests"
+	}
+
+	header := fmt.Sprintf("%s | %d host(s): %d ok, %d failed, %d running | %.1fs", description, len(s.hosts), counts["ok"],
+		counts["failed"]+counts["timed out"]+counts["cancelled"], counts["running"]+counts["connecting"], elapsed)
+
+	hostWidth := 4
+	for _, h := range s.hosts {
+		if l := len([]rune(h.hostname)); l > hostWidth {
+			hostWidth = l
+		}
+	}
+	if hostWidth > s.width/3 {
+		hostWidth = s.width / 3
+	}
+	outputWidth := s.width - hostWidth - 12 - 5 - 8 - 4
+	if outputWidth < 0 {
+		outputWidth = 0
+	}
+
+	lines := []string{
+		"\x1b[1m" + fitLine(header, s.width) + "\x1b[0m",
+		fitLine(fmt.Sprintf("%s %-12s %-5s %-8s %s", fitLine("HOST", hostWidth), "STATUS", "EXIT", "TIME", "OUTPUT"), s.width),
+	}
+
+	rows := s.height - 3
+	if rows < 1 {
+		rows = 1
+	}
+	if s.selected < s.top {
+		s.top = s.selected
+	} else if s.selected >= s.top+rows {
+		s.top = s.selected - rows + 1
+	}
+
+	for i := s.top; i < len(s.hosts) && i < s.top+rows; i++ {
+		h := s.hosts[i]
+		exit, duration := "", ""
+		if h.reply != nil {
+			exit, duration = strconv.Itoa(h.reply.ExitCode), fmt.Sprintf("%.2fs", h.reply.Duration)
+		}
+
+		status := fitLine(h.status, 12)
+		if color, ok := tuiStatusColors[h.status]; ok && i != s.selected {
+			status = color + status + "\x1b[0m"
+		}
+
+		line := fitLine(h.hostname, hostWidth) + " " + status + " " + fitLine(exit, 5) + " " + fitLine(duration, 8) + " " + fitLine(h.summary(), outputWidth)
+		if i == s.selected {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func (s *tuiScreen) renderOutput() []string {
+	h := s.view
+	all := s.outputLines()
+
+	header := fmt.Sprintf("=== %s (%s)", h.hostname, h.status)
+	if h.reply != nil {
+		header += fmt.Sprintf(", exit code %d, %.2fs", h.reply.ExitCode, h.reply.Duration)
+	}
+	if len(all) > 0 {
+		header += fmt.Sprintf(" | lines %d-%d of %d", s.offset+1, clampInt(s.offset+s.height-2, 0, len(all)), len(all))
+	}
+
+	lines := []string{"\x1b[1m" + fitLine(header, s.width) + "\x1b[0m"}
+	for i := s.offset; i < len(all) && i < s.offset+s.height-2; i++ {
+		lines = append(lines, highlight(fitLine(all[i], s.width), s.search))
+	}
+	return lines
+}
+
+// highlight shows occurrences of search in line (case-insensitive) in reverse video
+func highlight(line, search string) string {
+	if search == "" {
+		return line
+	}
+
+	var buf strings.Builder
+	lower, needle := strings.ToLower(line), strings.ToLower(search)
+	for {
+		idx := strings.Index(lower, needle)
+		if idx < 0 || len(lower) != len(line) {
+			buf.WriteString(line)
+			return buf.String()
+		}
+		buf.WriteString(line[:idx] + "\x1b[7m" + line[idx:idx+len(needle)] + "\x1b[0m")
+		line, lower = line[idx+len(needle):], lower[idx+len(needle):]
+	}
+}
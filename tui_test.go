@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	keys := parseKeys([]byte("\x1b[Aj\r\x1b/\x7f\x1b[6~é"))
+	expected := []string{"up", "j", "enter", "esc", "/", "backspace", "pgdn", "é"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Unexpected keys: %q", keys)
+	}
+}
+
+func TestTUIScreen(t *testing.T) {
+	s := newTUIScreen(80, 10)
+	s.handleReply(&actionStarted{description: "Run: uptime\n", hosts: []string{"web1", "web2:2222", "web3"}})
+	s.handleReply(&hostStarted{hostname: "web1"})
+	s.handleReply(&hostStarted{hostname: "web2:2222"})
+	s.handleReply(&ConnectionProgress{ConnectedHost: "web2"})
+	s.handleReply(&Reply{Hostname: "web1", Stdout: "first\nsecond \x1b[31mred\n", Success: true, Duration: 0.5})
+	s.handleReply(&FinalReply{TimedOutHosts: map[string]bool{"web3": true}})
+
+	for host, status := range map[string]string{"web1": "ok", "web2:2222": "running", "web3": "timed out"} {
+		if s.byName[host].status != status {
+			t.Fatalf("Expected %s to be %s, got %s", host, status, s.byName[host].status)
+		}
+	}
+
+	screen := s.render()
+	if !strings.Contains(screen, "Run: uptime | 3 host(s): 1 ok, 1 failed, 1 running") || !strings.Contains(screen, "second ?[31mred") {
+		t.Fatalf("Unexpected table: %q", screen)
+	}
+
+	// search selects host with matching output, output of selected host is shown on Enter
+	s.handleKey("down")
+	for _, key := range []string{"/", "s", "e", "c", "enter", "enter"} {
+		s.handleKey(key)
+	}
+	if s.view != s.byName["web1"] {
+		t.Fatalf("Output of web1 must be shown, got %+v", s.view)
+	}
+	if screen := s.render(); !strings.Contains(screen, "=== web1 (ok), exit code 0") || !strings.Contains(screen, "\x1b[7msec\x1b[0mond") {
+		t.Fatalf("Unexpected output view: %q", screen)
+	}
+
+	if !s.handleKey("q") || s.view != nil {
+		t.Fatalf("q must return to table from output")
+	}
+	if s.handleKey("q") {
+		t.Fatalf("q must quit from table")
+	}
+}
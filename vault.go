@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HashiCorp Vault credentials (-vault-role): a key pair is generated in memory at startup and its
+// public key is signed by SSH secrets engine of Vault (VAULT_ADDR, VAULT_TOKEN or ~/.vault-token,
+// VAULT_NAMESPACE) using the role. The certificate is offered before other keys and is signed
+// again shortly before it expires, so nothing has to be stored on disk.
+
+const vaultRenewBefore = time.Minute // certificates that expire sooner are signed again
+
+var (
+	vaultRole  string // role of SSH secrets engine to sign certificates with (-vault-role), empty disables Vault
+	vaultMount string // path SSH secrets engine is mounted at (-vault-mount)
+
+	vault *vaultSigner
+)
+
+type vaultSigner struct {
+	mu          sync.Mutex
+	url         string // URL of sign endpoint
+	token       string
+	namespace   string
+	key         ssh.Signer
+	cert        ssh.Signer // nil until public key is signed
+	validBefore time.Time
+}
+
+// newVaultSigner generates key pair for certificates signed by role of SSH secrets engine mounted at mount
+func newVaultSigner(mount, role string) (*vaultSigner, error) {
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		buf, err := ioutil.ReadFile(filepath.Join(homeDir(), ".vault-token"))
+		if err != nil {
+			return nil, errors.New("Cannot find Vault token: VAULT_TOKEN is not set and ~/.vault-token cannot be read")
+		}
+		token = strings.TrimSpace(string(buf))
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.New("Cannot generate key for Vault: " + err.Error())
+	}
+	key, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, errors.New("Cannot generate key for Vault: " + err.Error())
+	}
+
+	return &vaultSigner{
+		url:       apiBaseURL("VAULT_ADDR", "https://127.0.0.1:8200") + "/v1/" + strings.Trim(mount, "/") + "/sign/" + url.PathEscape(role),
+		token:     token,
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		key:       key,
+	}, nil
+}
+
+// signer returns signer that presents certificate, the certificate is signed if it is missing or expires soon
+func (v *vaultSigner) signer() (ssh.Signer, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.cert != nil && time.Until(v.validBefore) > vaultRenewBefore {
+		return v.cert, nil
+	}
+
+	if err := v.sign(); err != nil {
+		if v.cert != nil && time.Now().Before(v.validBefore) {
+			// current certificate can still be used for a while
+			logf(logInfo, "", "%s", err)
+			return v.cert, nil
+		}
+		return nil, err
+	}
+
+	return v.cert, nil
+}
+
+// sign requests certificate for key from Vault
+func (v *vaultSigner) sign() error {
+	body, err := json.Marshal(map[string]string{
+		"public_key":       string(ssh.MarshalAuthorizedKey(v.key.PublicKey())),
+		"valid_principals": user,
+		"cert_type":        "user",
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", v.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	var resp struct {
+		Data struct {
+			SignedKey string `json:"signed_key"`
+		} `json:"data"`
+	}
+	if err := doJSONRequest(req, &resp); err != nil {
+		return errors.New("Cannot sign key with Vault: " + err.Error())
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(resp.Data.SignedKey))
+	if err != nil {
+		return errors.New("Cannot parse certificate signed by Vault: " + err.Error())
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok || !bytes.Equal(cert.Key.Marshal(), v.key.PublicKey().Marshal()) {
+		return errors.New("Vault returned certificate for another key")
+	}
+
+	if v.cert, err = ssh.NewCertSigner(cert, v.key); err != nil {
+		return err
+	}
+
+	v.validBefore = time.Unix(1<<62, 0)
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		v.validBefore = time.Unix(int64(cert.ValidBefore), 0)
+	}
+	logf(logInfo, "", "Vault signed certificate with serial %d valid until %s", cert.Serial, v.validBefore)
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestVaultSigner(t *testing.T) {
+	// test servers trust certificates signed by their own host key
+	ca, err := ssh.ParsePrivateKey([]byte(idRsa))
+	must(err, "Could not parse CA key")
+
+	signed := 0
+	vaultSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.Method != "POST" || r.URL.Path != "/v1/ssh-client/sign/deploy" || r.Header.Get("X-Vault-Token") != "token" || req["valid_principals"] != user {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req["public_key"]))
+		must(err, "Could not parse public key")
+		cert := &ssh.Certificate{
+			Key:             pub,
+			Serial:          uint64(signed),
+			CertType:        ssh.UserCert,
+			ValidPrincipals: []string{testUserName},
+			ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+		}
+		must(cert.SignCert(rand.Reader, ca), "Could not sign certificate")
+		signed++
+
+		buf, _ := json.Marshal(string(ssh.MarshalAuthorizedKey(cert)))
+		fmt.Fprintf(w, `{"data":{"serial_number":"%d","signed_key":%s}}`, cert.Serial, buf)
+	}))
+	defer vaultSrv.Close()
+
+	os.Setenv("VAULT_ADDR", vaultSrv.URL)
+	os.Setenv("VAULT_TOKEN", "token")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	v, err := newVaultSigner("/ssh-client/", "deploy")
+	must(err, "Could not create Vault signer")
+
+	signer, err := v.signer()
+	must(err, "Could not sign key")
+	if _, err := v.signer(); err != nil || signed != 1 {
+		t.Fatalf("Valid certificate must be reused: %d certificates signed, %v", signed, err)
+	}
+
+	v.validBefore = time.Now().Add(vaultRenewBefore / 2)
+	if _, err := v.signer(); err != nil || signed != 2 {
+		t.Fatalf("Expiring certificate must be signed again: %d certificates signed, %v", signed, err)
+	}
+
+	r := makeTestResult()
+	startTestServers(r, "test-vault", 1)
+
+	for addr := range r.hosts {
+		conf := &ssh.ClientConfig{User: testUserName, HostKeyCallback: ssh.InsecureIgnoreHostKey(), Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)}}
+		conn, err := dialHost(addr, conf)
+		if err != nil {
+			t.Fatalf("Could not authenticate with certificate signed by Vault: %s", err)
+		}
+		conn.Close()
+	}
+
+	// certificate that has not expired yet is used if Vault is unavailable
+	v.token = "expired"
+	v.validBefore = time.Now().Add(vaultRenewBefore / 2)
+	if s, err := v.signer(); err != nil || s != v.cert {
+		t.Fatalf("Current certificate must be used: %v", err)
+	}
+
+	v.validBefore = time.Now()
+	if _, err := v.signer(); err == nil {
+		t.Fatalf("Rejected signing request must fail")
+	}
+}
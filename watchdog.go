@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Run guardrails (-max-run-time and -max-open-files): while an action runs, a watchdog checks
+// once a second how long it has been running and how many file descriptors GoSSHa has open. If
+// the action runs longer than -max-run-time (whatever "Timeout" of the request is), or more than
+// -max-open-files descriptors are open (90% of the limit of the process by default, so that the
+// run is stopped before connections start failing with "too many open files"), the action is
+// aborted like with Ctrl-C: hosts are not started anymore, remote commands get SIGINT and are
+// killed if they are still running after watchdogKillAfter. FinalReply has "Aborted" with the
+// reason, which is also reported as an error.
+
+const openFilesAutoPercent = 90 // default -max-open-files in percent of limit of the process
+
+var (
+	maxRunTime   time.Duration // -max-run-time, 0 means no limit
+	maxOpenFiles int           // -max-open-files, 0 means openFilesAutoPercent of the limit, negative disables the check
+
+	watchdogInterval  = time.Second      // how often limits are checked
+	watchdogKillAfter = 10 * time.Second // time for interrupted commands to exit before they are killed
+)
+
+// runWatchdog aborts running action when it exceeds limits
+type runWatchdog struct {
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	reason string // why action was aborted, empty if it was not
+}
+
+// startWatchdog starts checking the limits of action that started at start, nil is returned if there are none
+func startWatchdog(start time.Time) *runWatchdog {
+	fileLimit := openFilesLimit()
+	if maxRunTime <= 0 && fileLimit <= 0 {
+		return nil
+	}
+
+	w := &runWatchdog{stopCh: make(chan struct{})}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(watchdogInterval)
+		defer ticker.Stop()
+
+		var abortedAt time.Time
+		for {
+			select {
+			case <-w.stopCh:
+				return
+			case now := <-ticker.C:
+				if !abortedAt.IsZero() {
+					if now.Sub(abortedAt) >= watchdogKillAfter {
+						interruptAction() // the second interrupt kills remote commands
+						return
+					}
+					continue
+				}
+
+				var reason string
+				if maxRunTime > 0 && now.Sub(start) > maxRunTime {
+					reason = fmt.Sprintf("run exceeded -max-run-time %s", maxRunTime)
+				} else if open, _ := openFiles(); fileLimit > 0 && open > fileLimit {
+					reason = fmt.Sprintf("%d open files exceed -max-open-files %d", open, fileLimit)
+				}
+				if reason == "" {
+					continue
+				}
+
+				w.mu.Lock()
+				w.reason = reason
+				w.mu.Unlock()
+				reportErrorToUser("Aborting action: " + reason)
+				abortedAt = now
+				interruptAction()
+			}
+		}
+	}()
+	return w
+}
+
+// stop stops the watchdog and returns why action was aborted, empty if it was not
+func (w *runWatchdog) stop() string {
+	if w == nil {
+		return ""
+	}
+	close(w.stopCh)
+	w.wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.reason
+}
+
+// interruptAction interrupts running action like Ctrl-C does
+func interruptAction() {
+	select {
+	case actionInterrupts <- struct{}{}:
+	default:
+	}
+}
+
+// openFilesLimit returns number of open files that aborts action, 0 if it is not limited
+func openFilesLimit() int {
+	if maxOpenFiles < 0 {
+		return 0
+	} else if maxOpenFiles > 0 {
+		return maxOpenFiles
+	}
+	if open, limit := openFiles(); open > 0 && limit > 0 {
+		return limit * openFilesAutoPercent / 100
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdogMaxRunTime(t *testing.T) {
+	oldRunTime, oldInterval, oldKill := maxRunTime, watchdogInterval, watchdogKillAfter
+	defer func() { maxRunTime, watchdogInterval, watchdogKillAfter = oldRunTime, oldInterval, oldKill }()
+	maxRunTime, watchdogInterval, watchdogKillAfter = 200*time.Millisecond, 20*time.Millisecond, 200*time.Millisecond
+
+	r := makeTestResult()
+	startTestServers(r, "test-watchdog", 2)
+	start := time.Now()
+	sendTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "trap '' INT; sleep 5"})
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Action was not aborted in time: %s", elapsed)
+	}
+	if !r.final.Interrupted || !strings.Contains(r.final.Aborted, "-max-run-time") {
+		t.Fatalf("Expected action to be aborted, got %+v", r.final)
+	}
+}
+
+func TestWatchdogMaxOpenFiles(t *testing.T) {
+	if open, _ := openFiles(); open == 0 {
+		t.Skip("Cannot count open files")
+	}
+	oldOpen, oldInterval := maxOpenFiles, watchdogInterval
+	defer func() { maxOpenFiles, watchdogInterval = oldOpen, oldInterval }()
+	maxOpenFiles, watchdogInterval = 1, 20*time.Millisecond
+
+	r := makeTestResult()
+	startTestServers(r, "test-watchdog-files", 1)
+	sendTestRequest(t, r, &ProxyRequest{Action: "ssh", Cmd: "sleep 5"})
+
+	if !r.final.Interrupted || !strings.Contains(r.final.Aborted, "-max-open-files 1") {
+		t.Fatalf("Expected action to be aborted, got %+v", r.final)
+	}
+
+	// negative limit disables the check
+	maxOpenFiles = -1
+	if w := startWatchdog(time.Now()); w != nil {
+		w.stop()
+		t.Fatalf("Expected no watchdog without limits")
+	}
+}
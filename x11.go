@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// X11 forwarding (-X): every session requests X11 forwarding, and X11 connections that remote
+// programs open are relayed to the local display of $DISPLAY, so that GUI tools started on hosts
+// (e.g. with mssh on lab machines) show up locally. Cookie of the display is taken from
+// "xauth list" and sent to hosts as is (like ssh -Y, programs get full access to the display),
+// a random one is sent if xauth does not know the display.
+
+const x11AuthProtocol = "MIT-MAGIC-COOKIE-1"
+
+var (
+	forwardX11 bool        // -X
+	x11        *x11Display // local display that X11 connections are relayed to, nil if forwarding is disabled
+)
+
+// x11Display is local X11 display
+type x11Display struct {
+	network, address string // where to connect to
+	screen           uint32
+	cookie           string // hex-encoded MIT-MAGIC-COOKIE-1
+}
+
+// parseDisplay parses $DISPLAY: "[host]:display[.screen]" or path of socket (e.g. of XQuartz)
+func parseDisplay(display string) (*x11Display, error) {
+	idx := strings.LastIndex(display, ":")
+	if idx < 0 {
+		return nil, errors.New("invalid DISPLAY " + display)
+	}
+	host, num := display[:idx], display[idx+1:]
+
+	d := &x11Display{}
+	if dot := strings.Index(num, "."); dot >= 0 {
+		screen, err := strconv.ParseUint(num[dot+1:], 10, 32)
+		if err != nil {
+			return nil, errors.New("invalid DISPLAY " + display)
+		}
+		d.screen, num = uint32(screen), num[:dot]
+	}
+	n, err := strconv.ParseUint(num, 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid DISPLAY " + display)
+	}
+
+	switch {
+	case strings.HasPrefix(display, "/"):
+		d.network, d.address = "unix", display
+	case host == "" || host == "unix":
+		d.network, d.address = "unix", "/tmp/.X11-unix/X"+num
+	default:
+		d.network, d.address = "tcp", net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(6000+int(n)))
+	}
+	return d, nil
+}
+
+// displayCookie returns hex-encoded cookie of display from xauth, or a random one
+func displayCookie(display string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), helperCommandTimeout)
+	defer cancel()
+
+	if out, err := exec.CommandContext(ctx, "xauth", "list", display).Output(); err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			if fields := strings.Fields(line); len(fields) == 3 && fields[1] == x11AuthProtocol {
+				return fields[2]
+			}
+		}
+	}
+	logf(logInfo, "", "No cookie of display %s in xauth, sending a random one", display)
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// initX11 sets up forwarding to display of $DISPLAY
+func initX11() error {
+	display := os.Getenv("DISPLAY")
+	if display == "" {
+		return errors.New("Cannot forward X11: DISPLAY is not set")
+	}
+	d, err := parseDisplay(display)
+	if err != nil {
+		return errors.New("Cannot forward X11: " + err.Error())
+	}
+	d.cookie = displayCookie(display)
+	x11 = d
+	return nil
+}
+
+// requestX11Forwarding asks remote side to forward X11 connections of programs of session
+func requestX11Forwarding(session *ssh.Session) error {
+	msg := struct {
+		SingleConnection bool
+		AuthProtocol     string
+		AuthCookie       string
+		ScreenNumber     uint32
+	}{false, x11AuthProtocol, x11.cookie, x11.screen}
+
+	ok, err := session.SendRequest("x11-req", true, ssh.Marshal(&msg))
+	if err == nil && !ok {
+		err = errors.New("rejected by remote side (check X11Forwarding of remote sshd)")
+	}
+	return err
+}
+
+// serveX11Forwarding relays X11 channels opened by remote side of conn to local display
+func serveX11Forwarding(conn *ssh.Client) error {
+	channels := conn.HandleChannelOpen("x11")
+	if channels == nil {
+		return errors.New("X11 forwarding is already set up")
+	}
+
+	go func() {
+		for ch := range channels {
+			local, err := net.Dial(x11.network, x11.address)
+			if err != nil {
+				ch.Reject(ssh.ConnectionFailed, "cannot connect to display: "+err.Error())
+				continue
+			}
+			channel, reqs, err := ch.Accept()
+			if err != nil {
+				local.Close()
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+
+			go func() {
+				defer channel.Close()
+				defer local.Close()
+
+				// both directions are half-closed, so that replies to the last request are delivered
+				done := make(chan struct{})
+				go func() {
+					io.Copy(channel, local)
+					channel.CloseWrite()
+					close(done)
+				}()
+				io.Copy(local, channel)
+				if c, ok := local.(interface{ CloseWrite() error }); ok {
+					c.CloseWrite()
+				}
+				<-done
+			}()
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseDisplay(t *testing.T) {
+	tests := []struct {
+		display, network, address string
+		screen                    uint32
+	}{
+		{":0", "unix", "/tmp/.X11-unix/X0", 0},
+		{"unix:1.2", "unix", "/tmp/.X11-unix/X1", 2},
+		{"localhost:10.0", "tcp", "localhost:6010", 0},
+		{"[::1]:2", "tcp", "[::1]:6002", 0},
+		{"/private/tmp/com.apple.launchd.abc/org.xquartz:0", "unix", "/private/tmp/com.apple.launchd.abc/org.xquartz:0", 0},
+	}
+	for _, tt := range tests {
+		d, err := parseDisplay(tt.display)
+		if err != nil || d.network != tt.network || d.address != tt.address || d.screen != tt.screen {
+			t.Fatalf("Unexpected display for %s: %+v, %v", tt.display, d, err)
+		}
+	}
+	for _, display := range []string{"", "localhost", ":x", ":0.x"} {
+		if _, err := parseDisplay(display); err == nil {
+			t.Fatalf("Expected %q to be invalid", display)
+		}
+	}
+}
+
+func TestX11Forwarding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossha-x11")
+	must(err, "Could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("unix", filepath.Join(dir, "X0"))
+	must(err, "Could not listen display socket")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				if req, _ := ioutil.ReadAll(c); string(req) == "hello" {
+					c.Write([]byte("world"))
+				}
+			}()
+		}
+	}()
+
+	x11 = &x11Display{network: "unix", address: l.Addr().String(), cookie: "0123abcd"}
+	defer func() { x11 = nil }()
+
+	r := makeTestResult()
+	startTestServers(r, "test-x11", 2)
+
+	req := makeProxyRequest(maxTimeout)
+	req.Cmd = "x11-hello"
+	runTestRequest(t, r, req)
+
+	for addr, reply := range r.replies {
+		if reply.Stdout != "0123abcd world" {
+			t.Fatalf("Unexpected stdout from %s: %q", addr, reply.Stdout)
+		}
+	}
+}
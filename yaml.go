@@ -0,0 +1,516 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parser for the subset of YAML that is used in configuration and inventory files:
+// block mappings and sequences, plain and quoted scalars, literal/folded block scalars,
+// simple flow sequences and mappings and comments. Anchors, tags and multiple documents
+// are not supported. Scalars are always returned as strings (or nil for null values),
+// mappings as *yamlMap and sequences as []interface{}.
+
+type yamlMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newYamlMap() *yamlMap {
+	return &yamlMap{values: make(map[string]interface{})}
+}
+
+// Keys returns mapping keys in document order
+func (m *yamlMap) Keys() []string {
+	return m.keys
+}
+
+func (m *yamlMap) Get(key string) interface{} {
+	return m.values[key]
+}
+
+func (m *yamlMap) set(key string, value interface{}) {
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+type yamlLine struct {
+	num     int
+	indent  int
+	content string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func parseYaml(data []byte) (interface{}, error) {
+	p := &yamlParser{}
+
+	for i, ln := range strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n") {
+		trimmed := strings.TrimLeft(ln, " ")
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("yaml: line %d: tabs are not allowed for indentation", i+1)
+		}
+
+		if trimmed == "---" {
+			continue
+		} else if trimmed == "..." {
+			break
+		}
+
+		// comments and blank lines are preserved only as part of block scalars, so keep raw lines
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: len(ln) - len(trimmed), content: trimmed})
+	}
+
+	p.skipBlank()
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+
+	v, err := p.parseBlock(p.lines[p.pos].indent)
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipBlank()
+	if p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected content %q", p.lines[p.pos].content)
+	}
+
+	return v, nil
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	return p.errorfAt(p.pos, format, args...)
+}
+
+// errorfAt returns error that refers to line with index idx
+func (p *yamlParser) errorfAt(idx int, format string, args ...interface{}) error {
+	num := 0
+	if idx < len(p.lines) {
+		num = p.lines[idx].num
+	} else if len(p.lines) > 0 {
+		num = p.lines[len(p.lines)-1].num
+	}
+	return fmt.Errorf("yaml: line %d: %s", num, fmt.Sprintf(format, args...))
+}
+
+func isYamlBlank(content string) bool {
+	return content == "" || strings.HasPrefix(content, "#")
+}
+
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) && isYamlBlank(p.lines[p.pos].content) {
+		p.pos++
+	}
+}
+
+// stripYamlComment removes trailing comment from the line, taking quotes into account
+func stripYamlComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || s[i-1] == ' ' || s[i-1] == '[' || s[i-1] == '{' || s[i-1] == ',' {
+				quote = c
+			}
+		case c == '#':
+			if i == 0 || s[i-1] == ' ' {
+				return strings.TrimRight(s[:i], " ")
+			}
+		}
+	}
+	return strings.TrimRight(s, " ")
+}
+
+func isYamlSeqItem(content string) bool {
+	return content == "-" || strings.HasPrefix(content, "- ")
+}
+
+// parseBlock parses mapping or sequence which lines have exactly the specified indent
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	if isYamlSeqItem(stripYamlComment(p.lines[p.pos].content)) {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	var res []interface{}
+
+	for {
+		p.skipBlank()
+		if p.pos >= len(p.lines) {
+			break
+		}
+
+		ln := p.lines[p.pos]
+		content := stripYamlComment(ln.content)
+		if ln.indent < indent || ln.indent == indent && !isYamlSeqItem(content) {
+			break
+		}
+
+		if ln.indent > indent {
+			return nil, p.errorf("bad indentation of a sequence entry")
+		}
+
+		item := strings.TrimLeft(strings.TrimPrefix(content, "-"), " ")
+		if item == "" {
+			p.pos++
+			v, err := p.parseNested(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, v)
+			continue
+		}
+
+		if isYamlSeqItem(item) || yamlKeyEnd(item) >= 0 {
+			// "- key: value" or "- - value" starts nested block at the position of item
+			itemIndent := ln.indent + len(content) - len(item)
+			p.lines[p.pos] = yamlLine{num: ln.num, indent: itemIndent, content: item}
+			v, err := p.parseBlock(itemIndent)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, v)
+			continue
+		}
+
+		p.pos++
+		v, err := p.parseValue(item, indent)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+
+	return res, nil
+}
+
+// yamlKeyEnd returns position of ':' that ends mapping key or -1 if content is not a mapping entry
+func yamlKeyEnd(content string) int {
+	if content == "" {
+		return -1
+	}
+
+	if c := content[0]; c == '"' || c == '\'' {
+		end := 1
+		for ; end < len(content); end++ {
+			if content[end] == '\\' && c == '"' {
+				end++
+			} else if content[end] == c {
+				if c == '\'' && end+1 < len(content) && content[end+1] == '\'' {
+					end++
+					continue
+				}
+				break
+			}
+		}
+		if end+1 < len(content) && content[end+1] == ':' && (end+2 == len(content) || content[end+2] == ' ') {
+			return end + 1
+		}
+		return -1
+	}
+
+	if c := content[0]; c == '[' || c == '{' {
+		return -1
+	}
+
+	for i := 0; i < len(content); i++ {
+		if content[i] == ':' && (i+1 == len(content) || content[i+1] == ' ') {
+			return i
+		}
+		if content[i] == ' ' && i+1 < len(content) && content[i+1] == '#' {
+			return -1
+		}
+	}
+
+	return -1
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	res := newYamlMap()
+
+	for {
+		p.skipBlank()
+		if p.pos >= len(p.lines) {
+			break
+		}
+
+		ln := p.lines[p.pos]
+		if ln.indent < indent {
+			break
+		}
+
+		if ln.indent > indent {
+			return nil, p.errorf("bad indentation of a mapping entry")
+		}
+
+		content := stripYamlComment(ln.content)
+		if isYamlSeqItem(content) {
+			break
+		}
+
+		end := yamlKeyEnd(content)
+		if end < 0 {
+			return nil, p.errorf("expected 'key: value', got %q", content)
+		}
+
+		key, err := parseYamlScalar(strings.TrimRight(content[:end], " "))
+		if err != nil {
+			return nil, p.errorf("%s", err.Error())
+		}
+
+		keyStr := ""
+		if key != nil {
+			keyStr = key.(string)
+		}
+
+		value := strings.TrimLeft(content[end+1:], " ")
+		p.pos++
+
+		var v interface{}
+		if value == "" {
+			v, err = p.parseNested(indent, true)
+		} else {
+			v, err = p.parseValue(value, indent)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		res.set(keyStr, v)
+	}
+
+	return res, nil
+}
+
+// parseNested parses block that follows an entry with empty value; sequences are allowed
+// to have the same indent as parent mapping key
+func (p *yamlParser) parseNested(parentIndent int, allowSameIndentSeq bool) (interface{}, error) {
+	p.skipBlank()
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+
+	ln := p.lines[p.pos]
+	if ln.indent > parentIndent || allowSameIndentSeq && ln.indent == parentIndent && isYamlSeqItem(stripYamlComment(ln.content)) {
+		return p.parseBlock(ln.indent)
+	}
+
+	return nil, nil
+}
+
+// parseValue parses inline value (scalar, flow collection or block scalar header)
+// of the previous line
+func (p *yamlParser) parseValue(value string, indent int) (interface{}, error) {
+	if value == "|" || value == ">" || value == "|-" || value == ">-" || value == "|+" || value == ">+" {
+		return p.parseBlockScalar(value, indent), nil
+	}
+
+	if value[0] == '[' || value[0] == '{' {
+		v, rest, err := parseYamlFlow(value)
+		if err != nil {
+			return nil, p.errorfAt(p.pos-1, "%s", err.Error())
+		}
+		if strings.TrimSpace(rest) != "" {
+			return nil, p.errorfAt(p.pos-1, "unexpected %q after flow collection", rest)
+		}
+		return v, nil
+	}
+
+	v, err := parseYamlScalar(value)
+	if err != nil {
+		return nil, p.errorfAt(p.pos-1, "%s", err.Error())
+	}
+	return v, nil
+}
+
+func (p *yamlParser) parseBlockScalar(header string, indent int) string {
+	var lines []string
+	blockIndent := -1
+
+	for ; p.pos < len(p.lines); p.pos++ {
+		ln := p.lines[p.pos]
+		if ln.content == "" {
+			lines = append(lines, "")
+			continue
+		}
+
+		if ln.indent <= indent {
+			break
+		}
+
+		if blockIndent < 0 {
+			blockIndent = ln.indent
+		}
+
+		if ln.indent < blockIndent {
+			break
+		}
+
+		lines = append(lines, strings.Repeat(" ", ln.indent-blockIndent)+ln.content)
+	}
+
+	// trailing empty lines belong to the next entry
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+
+	var res string
+	if header[0] == '|' {
+		res = strings.Join(lines, "\n")
+	} else {
+		for i, ln := range lines {
+			if i > 0 {
+				if ln == "" || lines[i-1] == "" {
+					res += "\n"
+				} else {
+					res += " "
+				}
+			}
+			res += ln
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(header, "-"):
+	case strings.HasSuffix(header, "+"):
+		res += strings.Repeat("\n", trailing+1)
+	default:
+		res += "\n"
+	}
+
+	return res
+}
+
+func parseYamlScalar(s string) (interface{}, error) {
+	switch {
+	case s == "" || s == "~" || s == "null" || s == "Null" || s == "NULL":
+		return nil, nil
+	case s[0] == '"':
+		if len(s) < 2 || s[len(s)-1] != '"' {
+			return nil, errors.New("unterminated double-quoted string")
+		}
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, errors.New("invalid double-quoted string " + s)
+		}
+		return v, nil
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, errors.New("unterminated single-quoted string")
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case s[0] == '&' || s[0] == '*' || s[0] == '!' || s[0] == '@' || s[0] == '`':
+		return nil, errors.New("unsupported yaml syntax: " + s)
+	}
+
+	return s, nil
+}
+
+// parseYamlFlow parses flow sequence or mapping at the start of s and returns the rest of s
+func parseYamlFlow(s string) (v interface{}, rest string, err error) {
+	s = strings.TrimLeft(s, " ")
+	if s == "" {
+		return nil, "", errors.New("unexpected end of flow collection")
+	}
+
+	if s[0] != '[' && s[0] != '{' {
+		// scalar inside flow collection ends with ',' or closing bracket
+		end := 0
+		if s[0] == '"' || s[0] == '\'' {
+			for end = 1; end < len(s) && s[end] != s[0]; end++ {
+				if s[end] == '\\' && s[0] == '"' {
+					end++
+				}
+			}
+			end++
+			if end > len(s) {
+				return nil, "", errors.New("unterminated string in flow collection")
+			}
+		} else {
+			for end < len(s) && !strings.ContainsRune(",]}", rune(s[end])) && !(s[end] == ':' && (end+1 == len(s) || s[end+1] == ' ')) {
+				end++
+			}
+		}
+		v, err = parseYamlScalar(strings.TrimSpace(s[:end]))
+		return v, s[end:], err
+	}
+
+	closing := byte(']')
+	if s[0] == '{' {
+		closing = '}'
+	}
+
+	var seq []interface{}
+	m := newYamlMap()
+	s = strings.TrimLeft(s[1:], " ")
+
+	for {
+		if s == "" {
+			return nil, "", errors.New("unterminated flow collection")
+		}
+
+		if s[0] == closing {
+			break
+		}
+
+		var item interface{}
+		item, s, err = parseYamlFlow(s)
+		if err != nil {
+			return nil, "", err
+		}
+		s = strings.TrimLeft(s, " ")
+
+		if closing == '}' {
+			if !strings.HasPrefix(s, ":") {
+				return nil, "", errors.New("expected ':' in flow mapping")
+			}
+
+			var value interface{}
+			value, s, err = parseYamlFlow(s[1:])
+			if err != nil {
+				return nil, "", err
+			}
+			s = strings.TrimLeft(s, " ")
+
+			key, _ := item.(string)
+			m.set(key, value)
+		} else {
+			seq = append(seq, item)
+		}
+
+		if strings.HasPrefix(s, ",") {
+			s = strings.TrimLeft(s[1:], " ")
+		} else if s == "" || s[0] != closing {
+			return nil, "", errors.New("expected ',' in flow collection")
+		}
+	}
+
+	if closing == '}' {
+		return m, s[1:], nil
+	}
+
+	if seq == nil {
+		seq = []interface{}{}
+	}
+	return seq, s[1:], nil
+}
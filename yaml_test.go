@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// yamlToPlain converts parsed yaml into plain maps for easier comparison
+func yamlToPlain(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *yamlMap:
+		res := make(map[string]interface{})
+		for _, k := range v.Keys() {
+			res[k] = yamlToPlain(v.Get(k))
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, item := range v {
+			res[i] = yamlToPlain(item)
+		}
+		return res
+	}
+	return v
+}
+
+func TestParseYaml(t *testing.T) {
+	doc := `
+# inventory
+all:
+  hosts:
+    mail.example.com:
+  children:
+    webservers:
+      hosts:
+        foo.example.com:
+          ansible_port: 2222 # comment
+        "bar.example.com":
+      vars:
+        ansible_user: 'deploy''s'
+list:
+- a
+- "b # not a comment"
+-   c: 1
+    d: 2
+-
+  - nested
+flow: [x, "y", {k: v}]
+empty: []
+script: |
+  echo 1
+    # indented
+  echo 2
+folded: >-
+  one
+  two
+url: http://example.com:8080/path
+`
+
+	v, err := parseYaml([]byte(doc))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := map[string]interface{}{
+		"all": map[string]interface{}{
+			"hosts": map[string]interface{}{"mail.example.com": nil},
+			"children": map[string]interface{}{
+				"webservers": map[string]interface{}{
+					"hosts": map[string]interface{}{
+						"foo.example.com": map[string]interface{}{"ansible_port": "2222"},
+						"bar.example.com": nil,
+					},
+					"vars": map[string]interface{}{"ansible_user": "deploy's"},
+				},
+			},
+		},
+		"list": []interface{}{
+			"a",
+			"b # not a comment",
+			map[string]interface{}{"c": "1", "d": "2"},
+			[]interface{}{"nested"},
+		},
+		"flow":   []interface{}{"x", "y", map[string]interface{}{"k": "v"}},
+		"empty":  []interface{}{},
+		"script": "echo 1\n  # indented\necho 2\n",
+		"folded": "one two",
+		"url":    "http://example.com:8080/path",
+	}
+
+	if got := yamlToPlain(v); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Unexpected result:\n%#v\nexpected:\n%#v", got, expected)
+	}
+
+	for _, bad := range []string{"a: [1, 2", "a: 1\n  b: 2", "a: \"x", "just a string\nanother: 1"} {
+		if _, err := parseYaml([]byte(bad)); err == nil {
+			t.Fatalf("Expected error for %q", bad)
+		}
+	}
+}